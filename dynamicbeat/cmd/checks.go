@@ -4,9 +4,7 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/scorestack/scorestack/dynamicbeat/pkg/checksource"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
-	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/setup"
 	"github.com/spf13/cobra"
 )
@@ -41,15 +39,15 @@ var checksCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		es, err := esclient.New(c.Elasticsearch, c.Setup.Username, c.Setup.Password, c.VerifyCerts)
+		client, err := setup.NewClient(c)
 		cobra.CheckErr(err)
 
-		f := &checksource.Filesystem{
-			Path:  args[0],
-			Teams: teams,
+		summary, err := client.AddChecksFromDir(cmd.Context(), args[0], teams)
+		fmt.Printf("Added %d checks, updated %d checks, and failed to add %d checks.\n", summary.Added, summary.Updated, summary.Failed)
+		cobra.CheckErr(err)
+		if c.Setup.DryRun {
+			cobra.CheckErr(setup.PrintPlan(os.Stdout, client.Elasticsearch.Plan))
 		}
-
-		cobra.CheckErr(setup.Checks(es, f))
 	},
 }
 
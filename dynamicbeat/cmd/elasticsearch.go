@@ -1,8 +1,9 @@
 package cmd
 
 import (
+	"os"
+
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
-	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/setup"
 	"github.com/spf13/cobra"
 )
@@ -16,9 +17,12 @@ var elasticsearchCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		c := config.Get()
 
-		es, err := esclient.New(c.Elasticsearch, c.Setup.Username, c.Setup.Password, c.VerifyCerts)
+		client, err := setup.NewClient(c)
 		cobra.CheckErr(err)
-		cobra.CheckErr(setup.Elasticsearch(es, c.Teams))
+		cobra.CheckErr(client.SetupElasticsearch(cmd.Context(), c.Teams))
+		if c.Setup.DryRun {
+			cobra.CheckErr(setup.PrintPlan(os.Stdout, client.Elasticsearch.Plan))
+		}
 	},
 }
 
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"os"
+
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/setup"
 	"github.com/spf13/cobra"
@@ -15,7 +17,12 @@ var kibanaCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		c := config.Get()
 
-		cobra.CheckErr(setup.Kibana(c.Setup.Kibana, c.Setup.Username, c.Setup.Password, c.VerifyCerts, c.Teams))
+		client, err := setup.NewClient(c)
+		cobra.CheckErr(err)
+		cobra.CheckErr(client.SetupKibana(cmd.Context(), c.Teams))
+		if c.Setup.DryRun {
+			cobra.CheckErr(setup.PrintPlan(os.Stdout, client.Kibana.Plan))
+		}
 	},
 }
 
@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
 
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/version"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -23,9 +26,10 @@ var cfgFile string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "dynamicbeat [command]",
-	Short: rootShort,
-	Long:  rootLong,
+	Use:     "dynamicbeat [command]",
+	Short:   rootShort,
+	Long:    rootLong,
+	Version: version.Version,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		// Configure logging
 		c := config.Get()
@@ -61,7 +65,12 @@ func NewRootCommand() *cobra.Command {
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	cobra.CheckErr(rootCmd.Execute())
+	// Cancel the context passed to commands when CTRL-C is hit, so that
+	// long-running operations like setup can exit cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cobra.CheckErr(rootCmd.ExecuteContext(ctx))
 }
 
 func init() {
@@ -72,13 +81,16 @@ func init() {
 
 	// Config file contents
 	addFlag("round_time", "r", "30s", "time to wait between rounds of checks")
-	addFlag("elasticsearch", "e", "https://localhost:9200", "address of Elasticsearch host to pull checks from and store results in")
+	addInt8Flag("jitter", "j", 0, "percent of the round time to spread the start of checks across, so that they don't all start at once")
+	addFlag("shutdown_grace", "", "30s", "time to wait for running checks to finish when stopping, before they are cancelled")
+	addFlag("elasticsearch", "e", "https://localhost:9200", "comma-separated addresses of Elasticsearch hosts to pull checks from and store results in")
 	addFlag("username", "u", "dynamicbeat", "username for authentication with Elasticsearch")
 	addFlag("password", "p", "changeme", "password for authentication with Elasticsearch")
 	addInt8Flag("log.level", "l", 0, "minimum log level to display; lower is more verbose - the lowest is -1 for DEBUG")
 	addBoolFlag("log.verbose", "V", false, "adds a timestamp and code location to each log line")
 	addBoolFlag("log.no_color", "c", false, "removes colorization from logs")
 	addBoolFlag("verify_certs", "v", false, "whether to verify the Elasticsearch TLS certificates")
+	addFlag("namespace", "", "scorestack", "namespace of the Kibana space and indices to use, so that several Scorestack deployments can share a cluster")
 
 	// Configure five default teams
 	teams := make([]config.Team, 5)
@@ -86,6 +98,19 @@ func init() {
 		teams[i] = config.Team{Name: fmt.Sprintf("team%02d", i+1)}
 	}
 	viper.SetDefault("teams", teams)
+
+	// Exec checks can't run anything unless commands are allowed
+	viper.SetDefault("exec.allowed_commands", []string{})
+
+	// Results are indexed in bulk
+	viper.SetDefault("bulk.max_docs", 500)
+	viper.SetDefault("bulk.max_size_kb", 5120)
+	viper.SetDefault("bulk.interval", "1s")
+
+	// Results are spooled to disk while Elasticsearch is unavailable
+	viper.SetDefault("spool.path", "spool")
+	viper.SetDefault("spool.max_size_mb", 100)
+	viper.SetDefault("spool.replay_rate", 100)
 }
 
 func addFlag(name string, short string, value string, help string) {
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/setup"
+	"github.com/spf13/cobra"
+)
+
+const serviceAccountShort = "Add the least-privilege user that Dynamicbeat runs as."
+const serviceAccountLong = serviceAccountShort + `
+
+Creates a dynamicbeat role that can only read check definitions and add results,
+and a dynamicbeat user with a random password. The Dynamicbeat configuration
+needed to run as the new user is printed. If the user already exists, it is
+left untouched unless --rotate is passed, which resets its password.`
+
+var serviceAccountRotate bool
+
+// serviceAccountCmd represents the service-account command
+var serviceAccountCmd = &cobra.Command{
+	Use:   "service-account",
+	Short: serviceAccountShort,
+	Long:  serviceAccountLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := config.Get()
+
+		client, err := setup.NewClient(c)
+		cobra.CheckErr(err)
+		cobra.CheckErr(client.Elasticsearch.Wait(cmd.Context()))
+		cobra.CheckErr(client.Kibana.Wait(cmd.Context()))
+
+		password, err := client.AddServiceAccount(cmd.Context(), serviceAccountRotate)
+		cobra.CheckErr(err)
+		if password == "" {
+			fmt.Printf("The %s user already exists. Pass --rotate to reset its password.\n", client.ServiceAccount())
+			return
+		}
+
+		fmt.Println("# Add these settings to the Dynamicbeat configuration file")
+		fmt.Println("elasticsearch:")
+		for _, host := range c.Elasticsearch {
+			fmt.Printf("  - %s\n", host)
+		}
+		if !c.Namespace.IsDefault() {
+			fmt.Printf("namespace: %s\n", c.Namespace)
+		}
+		fmt.Printf("username: %s\n", client.ServiceAccount())
+		fmt.Printf("password: %q\n", password)
+	},
+}
+
+func init() {
+	setupCmd.AddCommand(serviceAccountCmd)
+
+	serviceAccountCmd.Flags().BoolVar(&serviceAccountRotate, "rotate", false, "reset the password of the dynamicbeat user if it already exists")
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/setup"
 	"github.com/spf13/cobra"
@@ -23,7 +24,7 @@ var setupCmd = &cobra.Command{
 	Short: setupShort,
 	Long:  setupLong,
 	Run: func(cmd *cobra.Command, args []string) {
-		cobra.CheckErr(setup.Run())
+		cobra.CheckErr(setup.Run(cmd.Context()))
 	},
 }
 
@@ -33,11 +34,59 @@ func setupFlag(name string, short string, value string, help string) {
 	_ = viper.BindPFlag(settingName, setupCmd.PersistentFlags().Lookup(name))
 }
 
+func setupStringFlag(name string, value string, help string) {
+	setupCmd.PersistentFlags().String(name, value, help)
+	_ = viper.BindPFlag(fmt.Sprintf("setup.%s", name), setupCmd.PersistentFlags().Lookup(name))
+}
+
+func setupBoolFlag(name string, value bool, help string) {
+	setupCmd.PersistentFlags().Bool(name, value, help)
+	_ = viper.BindPFlag(fmt.Sprintf("setup.%s", name), setupCmd.PersistentFlags().Lookup(name))
+}
+
+func setupIntFlag(name string, value int, help string) {
+	setupCmd.PersistentFlags().Int(name, value, help)
+	_ = viper.BindPFlag(fmt.Sprintf("setup.%s", name), setupCmd.PersistentFlags().Lookup(name))
+}
+
+func setupDurationFlag(name string, value time.Duration, help string) {
+	setupCmd.PersistentFlags().Duration(name, value, help)
+	_ = viper.BindPFlag(fmt.Sprintf("setup.%s", name), setupCmd.PersistentFlags().Lookup(name))
+}
+
 func init() {
 	rootCmd.AddCommand(setupCmd)
 
 	// Config file contents
-	setupFlag("kibana", "k", "https://localhost:5601", "address of Kibana host to set up")
+	setupFlag("kibana", "k", "https://localhost:5601", "comma-separated addresses of Kibana hosts to set up")
 	setupFlag("setup-username", "U", "elastic", "username of Elasticsearch superuser to use for setup")
 	setupFlag("setup-password", "P", "changeme", "password of Elasticsearch superuser to use for setup")
+	setupStringFlag("api_key", "", "base64-encoded id:key API key to use for setup instead of the setup username and password")
+	setupBoolFlag("create_api_key", false, "create an API key with the setup username and password, and use it for the rest of setup")
+	setupIntFlag("max_attempts", 0, "number of times to check if Elasticsearch and Kibana are ready before giving up; 0 waits forever")
+	setupDurationFlag("poll_interval", 5*time.Second, "how often to check if Elasticsearch and Kibana are ready")
+	setupDurationFlag("log_every", 5*time.Second, "how often to log that setup is still waiting for Elasticsearch and Kibana")
+	setupBoolFlag("update_mappings", false, "update the mappings of results indices that already exist instead of skipping them")
+	setupBoolFlag("rotate_passwords", false, "reset the passwords of users that already exist instead of skipping them")
+	setupBoolFlag("force_dashboards", false, "import dashboards even if they haven't changed since the last import, overwriting any customizations")
+	setupIntFlag("alert_failures", 3, "number of rounds in a row a team's check must fail before its Kibana alerting rule fires; 0 disables alerting rules")
+	setupStringFlag("resources", "", "directory of extra resources to add after the default resources, as <kind>/<name>.json files")
+	setupBoolFlag("dry_run", false, "log the changes that setup would make without making them")
+	setupIntFlag("concurrency", 1, "number of teams to set up at the same time")
+	setupBoolFlag("skip_version_check", false, "continue setup even if Elasticsearch or Kibana is an unsupported version")
+	setupStringFlag("results_retention", "30d", "how long to keep results indices before deleting them with ILM; empty keeps results forever")
+	setupStringFlag("proxy", "", "URL of an HTTP proxy to send setup requests through; defaults to the HTTP_PROXY and HTTPS_PROXY environment variables")
+	setupBoolFlag("compress", false, "compress setup requests and responses with gzip")
+	setupBoolFlag("debug_requests", false, "log every setup request and response at debug level, with secrets redacted")
+	setupStringFlag("snapshots.type", "", "type of snapshot repository to add, either fs or s3; snapshots are not set up if empty")
+	setupStringFlag("snapshots.location", "", "path of an fs snapshot repository, which must be listed in path.repo on every node")
+	setupStringFlag("snapshots.bucket", "", "bucket of an s3 snapshot repository")
+	setupStringFlag("snapshots.base_path", "", "path within the bucket of an s3 snapshot repository")
+	setupStringFlag("snapshots.schedule", "0 30 1 * * ?", "cron schedule to take snapshots of the Scorestack indices on")
+	setupStringFlag("snapshots.retention", "7d", "how long to keep snapshots before deleting them")
+	setupStringFlag("tls.ca", "", "path to a PEM file of CA certificates to trust when connecting to Elasticsearch and Kibana")
+	setupStringFlag("tls.cert", "", "path to a PEM client certificate to present to Elasticsearch and Kibana")
+	setupStringFlag("tls.key", "", "path to the PEM private key for the client certificate")
+	setupIntFlag("max_retries", 3, "number of times to retry a setup request that fails due to a temporary error")
+	setupStringFlag("minimum_cluster_status", "green", "lowest Elasticsearch cluster health status to consider ready; use yellow for single-node clusters")
 }
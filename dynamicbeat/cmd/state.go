@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/setup"
+	"github.com/spf13/cobra"
+)
+
+const exportShort = "Write the current Scorestack setup state to a file."
+const exportLong = exportShort + `
+
+Exports the checks, attributes, roles, users, Kibana spaces, and dashboards that
+setup manages as an NDJSON archive. User passwords are not exported. If the
+file already exists, it will be overwritten. The archive can be restored with
+the import command.`
+
+const importShort = "Restore Scorestack setup state from a file."
+const importLong = importShort + `
+
+Restores an archive that was written by the export command. Users that don't
+exist yet are created with a random password, which must be reset afterward.`
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export [output file]",
+	Short: exportShort,
+	Long:  exportLong,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c := config.Get()
+
+		client, err := setup.NewClient(c)
+		cobra.CheckErr(err)
+
+		f, err := os.Create(args[0])
+		cobra.CheckErr(err)
+		defer f.Close()
+
+		cobra.CheckErr(client.ExportState(cmd.Context(), f, c.Teams))
+	},
+}
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import [input file]",
+	Short: importShort,
+	Long:  importLong,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c := config.Get()
+
+		client, err := setup.NewClient(c)
+		cobra.CheckErr(err)
+
+		f, err := os.Open(args[0])
+		cobra.CheckErr(err)
+		defer f.Close()
+
+		cobra.CheckErr(client.ImportState(cmd.Context(), f))
+		if c.Setup.DryRun {
+			cobra.CheckErr(setup.PrintPlan(os.Stdout, client.Kibana.Plan, client.Elasticsearch.Plan))
+		}
+	},
+}
+
+func init() {
+	setupCmd.AddCommand(exportCmd)
+	setupCmd.AddCommand(importCmd)
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/setup"
+	"github.com/spf13/cobra"
+)
+
+const statusShort = "Show the health of a Scorestack instance."
+const statusLong = statusShort + `
+
+Reports the Elasticsearch cluster health, the Kibana state, whether the
+Scorestack indices exist, the number of results and check definitions, and the
+time of the most recent result. Anything that can't be checked is reported as
+unreachable.`
+
+var statusJSON bool
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: statusShort,
+	Long:  statusLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := setup.NewClient(config.Get())
+		cobra.CheckErr(err)
+
+		status := client.Status(cmd.Context())
+		if statusJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			cobra.CheckErr(enc.Encode(status))
+			return
+		}
+		cobra.CheckErr(setup.PrintStatus(os.Stdout, status))
+	},
+}
+
+func init() {
+	setupCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "print the status as JSON")
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/setup"
+	"github.com/spf13/cobra"
+)
+
+const teamsShort = "Add users, roles, and spaces for each configured team."
+const teamsLong = teamsShort + `
+
+A random password is generated for each team user, and existing team users will
+have their passwords reset. The team names and passwords are written as CSV to
+the file specified with --credentials, or printed if no file is specified.`
+
+var (
+	teamsCredentials string
+	teamsConcurrency int
+	teamsSpaces      bool
+)
+
+// teamsCmd represents the teams command
+var teamsCmd = &cobra.Command{
+	Use:   "teams",
+	Short: teamsShort,
+	Long:  teamsLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := config.Get()
+
+		client, err := setup.NewClient(c)
+		cobra.CheckErr(err)
+		cobra.CheckErr(client.Elasticsearch.Wait(cmd.Context()))
+		cobra.CheckErr(client.Kibana.Wait(cmd.Context()))
+
+		teams := make([]setup.TeamConfig, 0, len(c.Teams))
+		for _, team := range c.Teams {
+			teams = append(teams, setup.TeamConfig{
+				Name:        team.Name,
+				TeamOptions: setup.TeamOptions{Space: teamsSpaces},
+			})
+		}
+		creds, teamErr := client.AddTeams(cmd.Context(), teams, teamsConcurrency)
+
+		// Write out the credentials for the teams that were created, even if
+		// some teams failed
+		var out io.Writer = os.Stdout
+		if teamsCredentials != "" {
+			f, err := os.Create(teamsCredentials)
+			cobra.CheckErr(err)
+			defer f.Close()
+			out = f
+		}
+		w := csv.NewWriter(out)
+		cobra.CheckErr(w.Write([]string{"team", "password"}))
+		for _, cred := range creds {
+			cobra.CheckErr(w.Write([]string{cred.Name, cred.Password}))
+		}
+		w.Flush()
+		cobra.CheckErr(w.Error())
+
+		cobra.CheckErr(teamErr)
+	},
+}
+
+func init() {
+	setupCmd.AddCommand(teamsCmd)
+
+	teamsCmd.Flags().StringVar(&teamsCredentials, "credentials", "", "path to a CSV file to write the team credentials to")
+	teamsCmd.Flags().IntVar(&teamsConcurrency, "concurrency", 4, "number of teams to add at the same time")
+	teamsCmd.Flags().BoolVar(&teamsSpaces, "spaces", false, "create a Kibana space for each team")
+}
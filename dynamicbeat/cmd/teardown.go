@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/setup"
+	"github.com/spf13/cobra"
+)
+
+const teardownShort = "Remove everything that setup added to a Scorestack instance."
+const teardownLong = teardownShort + `
+
+Removes the dashboards, Kibana space, users, roles, indices, and index template
+that are added by setup, including the objects for each configured team. All
+check results and check definitions will be deleted. Use --dry-run to see what
+would be removed without removing anything.`
+
+var teardownDryRun bool
+
+// teardownCmd represents the teardown command
+var teardownCmd = &cobra.Command{
+	Use:   "teardown",
+	Short: teardownShort,
+	Long:  teardownLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := config.Get()
+
+		es, err := setup.ElasticsearchClient(c)
+		cobra.CheckErr(err)
+		kib, err := setup.KibanaClient(c)
+		cobra.CheckErr(err)
+		cobra.CheckErr(setup.Teardown(cmd.Context(), es, kib, c.Namespace, c.Teams, teardownDryRun))
+	},
+}
+
+func init() {
+	setupCmd.AddCommand(teardownCmd)
+
+	teardownCmd.Flags().BoolVar(&teardownDryRun, "dry-run", false, "log what would be removed without removing anything")
+}
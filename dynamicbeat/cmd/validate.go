@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/setup"
+	"github.com/spf13/cobra"
+)
+
+const validateShort = "Check setup resources for problems without connecting to Scorestack."
+const validateLong = validateShort + `
+
+Checks that the built-in resources, and the resources in each given directory,
+are JSON objects with the fields that their kind of resource needs. Resource
+directories use the same <kind>/<name>.json layout as setup.resources.`
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate [resource directories]",
+	Short: validateShort,
+	Long:  validateLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		cobra.CheckErr(setup.ValidateResources())
+		for _, dir := range args {
+			cobra.CheckErr(setup.ValidateResourceDir(dir))
+		}
+		fmt.Println("No problems found.")
+	},
+}
+
+func init() {
+	setupCmd.AddCommand(validateCmd)
+}
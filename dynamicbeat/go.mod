@@ -6,21 +6,30 @@ require (
 	github.com/denisenkom/go-mssqldb v0.9.0
 	github.com/elastic/go-elasticsearch/v7 v7.12.0
 	github.com/emersion/go-imap v1.0.6
+	github.com/go-asn1-ber/asn1-ber v1.5.1
 	github.com/go-git/go-billy/v5 v5.4.1
-	github.com/go-git/go-git/v5 v5.6.0
+	github.com/go-git/go-git/v5 v5.7.0
 	github.com/go-ldap/ldap/v3 v3.2.4
 	github.com/go-ping/ping v0.0.0-20210312085107-d90f3778a8a3
 	github.com/go-sql-driver/mysql v1.5.0
+	github.com/gorilla/websocket v1.5.0
+	github.com/gosnmp/gosnmp v1.35.0
 	github.com/hirochachacha/go-smb2 v1.0.3
+	github.com/jackc/pgconn v1.8.0
+	github.com/jackc/pgproto3/v2 v2.0.6
 	github.com/jackc/pgx/v4 v4.10.1
-	github.com/jlaffaye/ftp v0.0.0-20210307004419-5d4190119067
+	github.com/jcmturner/gofork v1.7.6
+	github.com/jcmturner/gokrb5/v8 v8.4.4
 	github.com/miekg/dns v1.1.41
 	github.com/mitchellh/go-vnc v0.0.0-20150629162542-723ed9867aed
 	github.com/oneNutW0nder/winrm v0.0.0-20200403191630-928a10cb3c1e
+	github.com/pkg/sftp v1.13.5
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/viper v1.7.1
+	go.mongodb.org/mongo-driver v1.11.9
 	go.uber.org/zap v1.16.0
-	golang.org/x/crypto v0.3.0
+	golang.org/x/crypto v0.9.0
+	google.golang.org/grpc v1.50.1
 	gopkg.in/yaml.v2 v2.4.0
 	gosrc.io/xmpp v0.5.1
 )
@@ -3,7 +3,9 @@ package assets
 import (
 	"bytes"
 	"embed"
+	"fmt"
 	"io"
+	"io/fs"
 	"text/template"
 
 	"go.uber.org/zap"
@@ -71,3 +73,35 @@ func ReadTeamOverview(filename string, name string, checks int) io.Reader {
 
 	return bytes.NewReader(buf.Bytes())
 }
+
+// Files returns the paths of every embedded JSON asset, like roles/team.json.
+func Files() ([]string, error) {
+	return fs.Glob(f, "*/*.json")
+}
+
+// Render reads an embedded asset with a placeholder team name and number of
+// checks templated in, so that team assets can be checked without a real team.
+// Unlike the other functions, problems are returned instead of panicking.
+func Render(filename string) ([]byte, error) {
+	data, err := f.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded asset %s: %s", filename, err)
+	}
+
+	vars := struct {
+		Team   string
+		Checks int
+	}{"team00", 1}
+	tmpl, err := template.New("").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read asset %s as template: %s", filename, err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, vars)
+	if err != nil {
+		return nil, fmt.Errorf("failed to template asset %s: %s", filename, err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -17,3 +17,7 @@ func ResultsAll() io.Reader {
 func ResultsTeam() io.Reader {
 	return assets.Read("indices/results-team.json")
 }
+
+func Checkdef() io.Reader {
+	return assets.Read("indices/checkdef.json")
+}
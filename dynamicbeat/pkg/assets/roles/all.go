@@ -18,10 +18,6 @@ func Common() io.Reader {
 	return assets.Read("roles/common.json")
 }
 
-func Dynamicbeat() io.Reader {
-	return assets.Read("roles/dynamicbeat.json")
-}
-
 func Spectator() io.Reader {
 	return assets.Read("roles/spectator.json")
 }
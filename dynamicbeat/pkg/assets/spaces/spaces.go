@@ -9,3 +9,7 @@ import (
 func Scorestack() io.Reader {
 	return assets.Read("spaces/scorestack.json")
 }
+
+func Team(name string) io.Reader {
+	return assets.ReadTeam("spaces/team.json", name)
+}
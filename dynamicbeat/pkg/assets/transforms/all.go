@@ -0,0 +1,11 @@
+package transforms
+
+import (
+	"io"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets"
+)
+
+func Scoreboard() io.Reader {
+	return assets.Read("transforms/scoreboard.json")
+}
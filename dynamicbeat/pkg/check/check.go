@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"time"
 )
 
 type Check interface {
@@ -24,6 +25,9 @@ type Metadata struct {
 
 type Config struct {
 	Metadata
+	Timeout    time.Duration // how long the check can run for; 0 uses the default timeout
+	Period     time.Duration // how often the check runs; 0 runs it every round
+	SLA        SLA           // the penalty for failing too many rounds in a row
 	Definition []byte
 	Attributes `json:"attributes"`
 }
@@ -57,6 +61,26 @@ func (v ValidationError) Error() string {
 	return fmt.Sprintf("Error: check (Type: `%s`, ID: `%s`) is missing value for required field `%s`", v.Type, v.ID, v.Field)
 }
 
+// Validate checks that the fields that every check needs are set.
+func (c *Config) Validate() error {
+	fields := []struct {
+		name  string
+		empty bool
+	}{
+		{"id", c.ID == ""},
+		{"name", c.Name == ""},
+		{"type", c.Type == ""},
+		{"definition", len(c.Definition) == 0 || string(c.Definition) == "null"},
+	}
+	for _, f := range fields {
+		if f.empty {
+			return ValidationError{ID: c.ID, Type: c.Type, Field: f.name}
+		}
+	}
+
+	return nil
+}
+
 func (c *Config) Documents() (io.Reader, io.Reader, io.Reader, io.Reader, error) {
 	def := make(map[string]interface{})
 	err := json.Unmarshal(c.Definition, &def)
@@ -65,10 +89,20 @@ func (c *Config) Documents() (io.Reader, io.Reader, io.Reader, io.Reader, error)
 	}
 
 	// The check definition document doesn't include the attributes
+	var timeout, period string
+	if c.Timeout > 0 {
+		timeout = c.Timeout.String()
+	}
+	if c.Period > 0 {
+		period = c.Period.String()
+	}
 	chk := struct {
 		Metadata
+		Timeout string `json:"timeout,omitempty"`
+		Period  string `json:"period,omitempty"`
+		SLA
 		Definition map[string]interface{} `json:"definition"`
-	}{c.Metadata, def}
+	}{c.Metadata, timeout, period, c.SLA, def}
 	checkDoc, err := json.Marshal(chk)
 	if err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("failed to marshal definition for '%s': %s", c.ID, err)
@@ -0,0 +1,68 @@
+package check
+
+import (
+	"fmt"
+	"net"
+)
+
+// A ConfigError is a problem with how Dynamicbeat is set up to run a check,
+// rather than a problem with the service that is being checked.
+type ConfigError struct {
+	Err error
+}
+
+// ConfigErrorPrefix starts the messages of ConfigErrors, so that they can be
+// recognized in the messages of results.
+const ConfigErrorPrefix = "scoring configuration error"
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", ConfigErrorPrefix, e.Err)
+}
+
+func (e ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// NewDialer creates a dialer for a network like tcp or udp that connects from
+// sourceIP, which must be assigned to one of this host's interfaces. If
+// sourceIP is empty, the operating system picks the source address. Invalid
+// source addresses are reported as a ConfigError.
+func NewDialer(network string, sourceIP string) (*net.Dialer, error) {
+	dialer := &net.Dialer{}
+	if sourceIP == "" {
+		return dialer, nil
+	}
+
+	ip := net.ParseIP(sourceIP)
+	if ip == nil {
+		return nil, ConfigError{fmt.Errorf("invalid source IP '%s'", sourceIP)}
+	}
+	if !isLocal(ip) {
+		return nil, ConfigError{fmt.Errorf("source IP %s is not assigned to any interface on this host", ip)}
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	case "udp", "udp4", "udp6":
+		dialer.LocalAddr = &net.UDPAddr{IP: ip}
+	default:
+		return nil, ConfigError{fmt.Errorf("can't bind a source IP for network '%s'", network)}
+	}
+	return dialer, nil
+}
+
+// isLocal checks whether an IP is assigned to one of this host's interfaces.
+func isLocal(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// Let the dial fail instead if the address really isn't local
+		return true
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
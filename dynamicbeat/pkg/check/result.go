@@ -14,14 +14,68 @@ type Result struct {
 	Passed    bool
 	Message   string
 	Details   map[string]string
+
+	// Details that are only written to the admin results, like command output
+	// that might contain flags
+	AdminDetails map[string]string
+
+	// How long the service took to respond, for checks that measure it
+	ResponseTime time.Duration
+
+	// The timeout that the check ran with, and how long it actually ran for
+	Timeout time.Duration
+	Elapsed time.Duration
+
+	// Whether each of the assertions that the check made passed, and the
+	// score from 0 to 1 that they add up to. Checks without partial credit
+	// scoring score 1 if they passed, and 0 otherwise.
+	Assertions map[string]bool
+	Score      float64
+
+	// The SLA of the check, which the result counts towards
+	SLA SLA
+
+	// When the round that the check ran in started, how often the check
+	// runs, how long after the start of the round it was started, and how
+	// long it then waited for a free worker
+	RoundStart time.Time
+	Period     time.Duration
+	Delay      time.Duration
+	Wait       time.Duration
+}
+
+// An Event is published to the results indices, like a Result or a Violation.
+type Event interface {
+	Generic() (string, io.Reader, error)
+	Team() (string, io.Reader, error)
+	Admin() (string, io.Reader, error)
+
+	// Key returns a string that is the same every time the documents of the
+	// event are created, and different for every other event.
+	Key() string
+}
+
+// Assert records whether an assertion passed. An assertion that is made more
+// than once, like for each request of an HTTP check, only passes if it passed
+// every time.
+func (r *Result) Assert(name string, passed bool) {
+	if r.Assertions == nil {
+		r.Assertions = make(map[string]bool)
+	}
+	if prev, ok := r.Assertions[name]; ok {
+		passed = passed && prev
+	}
+	r.Assertions[name] = passed
 }
 
 type generic struct {
 	Metadata
-	Timestamp string `json:"@timestamp"`
-	Passed    bool   `json:"passed"`
-	PassedInt uint8  `json:"passed_int"`
-	Epoch     int64  `json:"epoch"`
+	Timestamp string  `json:"@timestamp"`
+	Passed    bool    `json:"passed"`
+	PassedInt uint8   `json:"passed_int"`
+	Score     float64 `json:"score"`
+	EventType string  `json:"event_type"`
+	Epoch     int64   `json:"epoch"`
 }
 
 func newGeneric(r *Result) generic {
@@ -30,6 +84,8 @@ func newGeneric(r *Result) generic {
 		Timestamp: r.Timestamp.Format(time.RFC3339),
 		Passed:    r.Passed,
 		PassedInt: 0,
+		Score:     r.Score,
+		EventType: EventResult,
 		Epoch:     r.Timestamp.Unix(),
 	}
 
@@ -42,16 +98,57 @@ func newGeneric(r *Result) generic {
 
 type full struct {
 	generic
-	Message string            `json:"message"`
-	Details map[string]string `json:"details"`
+	Message        string            `json:"message"`
+	Details        map[string]string `json:"details"`
+	ResponseTimeMS *float64          `json:"response_time_ms,omitempty"`
+	TimeoutMS      *float64          `json:"timeout_ms,omitempty"`
+	ElapsedMS      *float64          `json:"elapsed_ms,omitempty"`
+	Assertions     map[string]bool   `json:"assertions,omitempty"`
+	RoundStart     string            `json:"round_start,omitempty"`
+	PeriodMS       *float64          `json:"period_ms,omitempty"`
+	DelayMS        *float64          `json:"delay_ms,omitempty"`
+	WaitMS         *float64          `json:"wait_ms,omitempty"`
 }
 
-func newFull(r *Result) full {
-	return full{
-		generic: newGeneric(r),
-		Message: r.Message,
-		Details: r.Details,
+func newFull(r *Result, admin bool) full {
+	out := full{
+		generic:    newGeneric(r),
+		Message:    r.Message,
+		Details:    r.Details,
+		Assertions: r.Assertions,
+	}
+
+	if admin && len(r.AdminDetails) > 0 {
+		out.Details = make(map[string]string, len(r.Details)+len(r.AdminDetails))
+		for k, v := range r.Details {
+			out.Details[k] = v
+		}
+		for k, v := range r.AdminDetails {
+			out.Details[k] = v
+		}
 	}
+
+	out.ResponseTimeMS = milliseconds(r.ResponseTime)
+	out.TimeoutMS = milliseconds(r.Timeout)
+	out.ElapsedMS = milliseconds(r.Elapsed)
+	if !r.RoundStart.IsZero() {
+		out.RoundStart = r.RoundStart.Format(time.RFC3339)
+	}
+	out.PeriodMS = milliseconds(r.Period)
+	out.DelayMS = milliseconds(r.Delay)
+	out.WaitMS = milliseconds(r.Wait)
+
+	return out
+}
+
+// milliseconds converts a duration to milliseconds, or nil if it wasn't
+// measured.
+func milliseconds(d time.Duration) *float64 {
+	if d <= 0 {
+		return nil
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	return &ms
 }
 
 func marshalError(err error) (string, io.Reader, error) {
@@ -62,6 +159,11 @@ func ok(index string, body []byte) (string, io.Reader, error) {
 	return index, bytes.NewReader(body), nil
 }
 
+// Key identifies a result by its check and the time that it started.
+func (r *Result) Key() string {
+	return fmt.Sprintf("%s/%s/%d", EventResult, r.ID, r.Timestamp.UnixNano())
+}
+
 // Generic creates a JSON blob containing a check result without an error
 // message or details field, as well as a destination index name for the check
 // result document. The check results generated by this function can be used
@@ -81,7 +183,7 @@ func (r *Result) Generic() (string, io.Reader, error) {
 // provide more in-depth feedback to a team about why their checks may be
 // failing.
 func (r *Result) Team() (string, io.Reader, error) {
-	body, err := json.Marshal(newFull(r))
+	body, err := json.Marshal(newFull(r, false))
 	if err != nil {
 		return marshalError(err)
 	}
@@ -92,12 +194,13 @@ func (r *Result) Team() (string, io.Reader, error) {
 // Admin creates a JSON blob containing a check result and the destination
 // index name for the check result document. The check results generated by
 // this function are identical to the results generated for each team, but they
-// are aggregated in a single index. This is intended to make it easier for
-// Scorestack administrators to quickly view all available check result
-// information to debug check definition problems, infrastructure issues, or
-// anything else that might go awry during a competition.
+// are aggregated in a single index and include the admin details. This is
+// intended to make it easier for Scorestack administrators to quickly view all
+// available check result information to debug check definition problems,
+// infrastructure issues, or anything else that might go awry during a
+// competition.
 func (r *Result) Admin() (string, io.Reader, error) {
-	body, err := json.Marshal(newFull(r))
+	body, err := json.Marshal(newFull(r, true))
 	if err != nil {
 		return marshalError(err)
 	}
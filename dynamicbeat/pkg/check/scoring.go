@@ -0,0 +1,93 @@
+package check
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scoring gives a check partial credit for each of the assertions that it
+// makes, instead of only passing or failing. The score of a result is the
+// weight of the assertions that passed over the total weight, and the result
+// passes if its score reaches the threshold.
+type Scoring struct {
+	Threshold  float64              `optiontype:"optional" optiondefault:"1"` // The lowest score that passes, from 0 to 1
+	Assertions []*WeightedAssertion `optiontype:"list"`                       // The assertions that make up the score
+}
+
+// A WeightedAssertion is one of the assertions that a check makes, along with
+// how much of the score it is worth.
+type WeightedAssertion struct {
+	Name   string  `optiontype:"required"` // The name of the assertion, like content for HTTP checks
+	Weight float64 `optiontype:"required"` // How much the assertion is worth compared to the others
+}
+
+// A Scorer is a check that records the outcome of each of its assertions in
+// its results, so that it can be scored with partial credit.
+type Scorer interface {
+	Check
+
+	// Assertions returns the names of the assertions that the check can make.
+	Assertions() []string
+}
+
+// Validate checks that the scoring only uses assertions that a check makes,
+// and that the weights and threshold make sense.
+func (s *Scoring) Validate(chk Check) error {
+	scorer, ok := chk.(Scorer)
+	if !ok {
+		return fmt.Errorf("%s checks can't be scored with partial credit", chk.GetConfig().Type)
+	}
+	if len(s.Assertions) == 0 {
+		return fmt.Errorf("at least one assertion must be weighted")
+	}
+	if s.Threshold <= 0 || s.Threshold > 1 {
+		return fmt.Errorf("threshold %g must be greater than 0 and at most 1", s.Threshold)
+	}
+
+	names := scorer.Assertions()
+	for _, a := range s.Assertions {
+		if !contains(names, a.Name) {
+			return fmt.Errorf("unknown assertion %s - must be %s", a.Name, orList(names))
+		}
+		if a.Weight <= 0 {
+			return fmt.Errorf("weight of assertion %s must be greater than 0", a.Name)
+		}
+	}
+	return nil
+}
+
+// Apply scores a result. Assertions that the check didn't get to make count
+// as failed.
+func (s *Scoring) Apply(r *Result) {
+	var total, passed float64
+	for _, a := range s.Assertions {
+		total += a.Weight
+		if r.Assertions[a.Name] {
+			passed += a.Weight
+		}
+	}
+	r.Score = passed / total
+
+	// Allow for rounding, so that weights like 0.3 and 0.7 can add up to 1
+	r.Passed = r.Score >= s.Threshold-1e-9
+	if r.Passed && r.Score < 1 && r.Message != "" {
+		r.Message = fmt.Sprintf("Passed with a score of %.2f : %s", r.Score, r.Message)
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// orList formats names like "a, b, or c".
+func orList(names []string) string {
+	if len(names) < 3 {
+		return strings.Join(names, " or ")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + ", or " + names[len(names)-1]
+}
@@ -0,0 +1,196 @@
+package check
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// The event types of the documents in the results indices, so that SLA
+// violations can be told apart from check results.
+const (
+	EventResult       = "result"
+	EventSLAViolation = "sla_violation"
+)
+
+// An SLA penalizes a check that fails for too many rounds in a row. Every
+// Threshold failures in a row is a violation, which costs Penalty points, so
+// the penalty grows the longer the check is down.
+type SLA struct {
+	Threshold int   `json:"sla_threshold,omitempty"` // the number of failures in a row that violate the SLA; 0 disables it
+	Penalty   int64 `json:"sla_penalty,omitempty"`   // the points that each violation costs
+}
+
+// Validate checks that the SLA makes sense.
+func (s SLA) Validate() error {
+	switch {
+	case s.Threshold < 0:
+		return fmt.Errorf("sla_threshold %d must not be negative", s.Threshold)
+	case s.Penalty < 0:
+		return fmt.Errorf("sla_penalty %d must not be negative", s.Penalty)
+	case s.Penalty > 0 && s.Threshold == 0:
+		return errors.New("sla_penalty is set, but sla_threshold isn't")
+	}
+	return nil
+}
+
+// A Violation is published to the results indices when a check has failed
+// for a multiple of its SLA threshold rounds in a row.
+type Violation struct {
+	Metadata
+	Timestamp time.Time
+	Failures  int // the number of rounds in a row that the check has failed
+	SLA
+}
+
+type violation struct {
+	generic
+	Failures  int   `json:"sla_failures"`
+	Threshold int   `json:"sla_threshold"`
+	Penalty   int64 `json:"sla_penalty"`
+}
+
+// newViolation creates the document of a violation. Violations count as
+// failed results, so that dashboards that only look at the passed fields still
+// show the check as down.
+func newViolation(v *Violation) violation {
+	return violation{
+		generic: generic{
+			Metadata:  v.Metadata,
+			Timestamp: v.Timestamp.Format(time.RFC3339),
+			EventType: EventSLAViolation,
+			Epoch:     v.Timestamp.Unix(),
+		},
+		Failures:  v.Failures,
+		Threshold: v.Threshold,
+		Penalty:   v.Penalty,
+	}
+}
+
+type fullViolation struct {
+	violation
+	Message string `json:"message"`
+}
+
+func newFullViolation(v *Violation) fullViolation {
+	return fullViolation{
+		violation: newViolation(v),
+		Message:   fmt.Sprintf("SLA violated: the check has failed %d rounds in a row, for a penalty of %d", v.Failures, v.Penalty),
+	}
+}
+
+// Key identifies a violation by its check and the time of the result that
+// caused it.
+func (v *Violation) Key() string {
+	return fmt.Sprintf("%s/%s/%d", EventSLAViolation, v.ID, v.Timestamp.UnixNano())
+}
+
+// Generic creates the document of a violation for the results-all index.
+func (v *Violation) Generic() (string, io.Reader, error) {
+	body, err := json.Marshal(newViolation(v))
+	if err != nil {
+		return marshalError(err)
+	}
+
+	return ok("results-all", body)
+}
+
+// Team creates the document of a violation for the index of the check's team.
+func (v *Violation) Team() (string, io.Reader, error) {
+	body, err := json.Marshal(newFullViolation(v))
+	if err != nil {
+		return marshalError(err)
+	}
+
+	return ok(fmt.Sprintf("results-%s", v.Group), body)
+}
+
+// Admin creates the document of a violation for the results-admin index.
+func (v *Violation) Admin() (string, io.Reader, error) {
+	body, err := json.Marshal(newFullViolation(v))
+	if err != nil {
+		return marshalError(err)
+	}
+
+	return ok("results-admin", body)
+}
+
+// A PastEvent is a result or violation of a check that was already
+// published, which is used to restore a Tracker.
+type PastEvent struct {
+	EventType string `json:"event_type"`
+	Epoch     int64  `json:"epoch"`
+	Passed    bool   `json:"passed"`
+	Failures  int    `json:"sla_failures"`
+}
+
+// A Tracker counts how many rounds in a row each check has failed, to find SLA
+// violations.
+type Tracker struct {
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+// NewTracker creates a Tracker that hasn't seen any failures.
+func NewTracker() *Tracker {
+	return &Tracker{failures: make(map[string]int)}
+}
+
+// Restore sets how many rounds in a row a check has failed from its newest
+// published events, newest first, so that runs of failures carry over when
+// Dynamicbeat restarts. Results before the newest violation don't need to be
+// counted, since the violation has the length of the run up to it.
+func (t *Tracker) Restore(id string, events []PastEvent) {
+	failures := 0
+	for i, e := range events {
+		if e.EventType == EventSLAViolation {
+			// The violation was published with the result that caused it,
+			// which has the same epoch and is already counted by it
+			failures = e.Failures
+			for _, newer := range events[:i] {
+				if newer.Epoch > e.Epoch {
+					failures++
+				}
+			}
+			break
+		}
+		if e.Passed {
+			break
+		}
+		failures++
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures[id] = failures
+}
+
+// Record counts a result towards the run of failures of its check, and
+// returns a Violation if the run reached a multiple of the SLA threshold.
+func (t *Tracker) Record(r Result) *Violation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r.SLA.Threshold <= 0 {
+		delete(t.failures, r.ID)
+		return nil
+	}
+	if r.Passed {
+		t.failures[r.ID] = 0
+		return nil
+	}
+
+	t.failures[r.ID]++
+	failures := t.failures[r.ID]
+	if failures%r.SLA.Threshold != 0 {
+		return nil
+	}
+	return &Violation{
+		Metadata:  r.Metadata,
+		Timestamp: r.Timestamp,
+		Failures:  failures,
+		SLA:       r.SLA,
+	}
+}
@@ -0,0 +1,45 @@
+package check
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ParseTimeout parses the timeout of a check definition, like 10s or 1m30s.
+// An empty timeout is parsed as 0, which means that the check uses the
+// default timeout.
+func ParseTimeout(s string) (time.Duration, error) {
+	return parseDuration("timeout", s)
+}
+
+// ParsePeriod parses how often a check runs, like 5m. An empty period is
+// parsed as 0, which means that the check runs every round.
+func ParsePeriod(s string) (time.Duration, error) {
+	return parseDuration("period", s)
+}
+
+func parseDuration(field string, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s': %s", field, s, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s': must be greater than 0", field, s)
+	}
+	return d, nil
+}
+
+// TimeLeft returns how long a check has left before its context's deadline,
+// for libraries that take a timeout instead of a context. If the context has
+// no deadline, fallback is returned instead.
+func TimeLeft(ctx context.Context, fallback time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return fallback
+	}
+	return time.Until(deadline)
+}
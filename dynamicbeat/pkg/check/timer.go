@@ -0,0 +1,35 @@
+package check
+
+import (
+	"sync"
+	"time"
+)
+
+// A Timer measures how long a service takes to respond to a check. Time that
+// shouldn't count against the service, like a DNS lookup, can be left out
+// with Exclude. Timers use the monotonic clock, so they aren't affected by
+// changes to the system time.
+type Timer struct {
+	mu       sync.Mutex
+	start    time.Time
+	excluded time.Duration
+}
+
+// StartTimer starts a new Timer.
+func StartTimer() *Timer {
+	return &Timer{start: time.Now()}
+}
+
+// Exclude leaves d out of the measured time.
+func (t *Timer) Exclude(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.excluded += d
+}
+
+// Elapsed returns the time since the Timer started, without the excluded time.
+func (t *Timer) Elapsed() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Since(t.start) - t.excluded
+}
@@ -0,0 +1,300 @@
+package check
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"golang.org/x/crypto/ssh"
+)
+
+// A JumpHost is an SSH server that a check connects to its target through,
+// for targets that Dynamicbeat can't reach directly.
+type JumpHost struct {
+	Host               string `optiontype:"required"`                    // IP or hostname of the jump host
+	Port               string `optiontype:"optional" optiondefault:"22"` // The port of the jump host's SSH server
+	Username           string `optiontype:"required"`                    // The user to log in to the jump host as
+	Password           string `optiontype:"optional"`                    // The password for the user
+	PrivateKey         string `optiontype:"optional"`                    // PEM or OpenSSH private key to log in with
+	KeyPassphrase      string `optiontype:"optional"`                    // The passphrase of PrivateKey, if it is encrypted
+	HostKeyFingerprint string `optiontype:"optional"`                    // The SHA256 fingerprint that the jump host's host key must have
+	KnownHosts         string `optiontype:"optional"`                    // known_hosts lines, one of which must have the jump host's host key
+}
+
+// A JumpHostError is a failure to connect or log in to a check's jump host,
+// rather than a failure of the check's target.
+type JumpHostError struct {
+	Host string
+	Err  error
+}
+
+func (e JumpHostError) Error() string {
+	return fmt.Sprintf("jump host %s : %s", e.Host, e.Err)
+}
+
+func (e JumpHostError) Unwrap() error {
+	return e.Err
+}
+
+// A Tunnel dials a check's connections through its jump host. The SSH
+// connection to the jump host is made by the first dial, and is shared by the
+// rest of the check's connections until the Tunnel is closed.
+type Tunnel struct {
+	jumpHost *JumpHost
+	mu       sync.Mutex
+	client   *ssh.Client
+	err      error
+	closed   bool
+}
+
+// NewTunnel creates a Tunnel through a jump host. It doesn't connect until
+// the first dial.
+func NewTunnel(j *JumpHost) *Tunnel {
+	return &Tunnel{jumpHost: j}
+}
+
+// tunnelKey is the context key of the Tunnel of a check.
+type tunnelKey struct{}
+
+// WithTunnel returns a context that makes a Dialer connect through t.
+func WithTunnel(ctx context.Context, t *Tunnel) context.Context {
+	return context.WithValue(ctx, tunnelKey{}, t)
+}
+
+// HasTunnel reports whether a Dialer would connect through a jump host with
+// ctx.
+func HasTunnel(ctx context.Context) bool {
+	_, ok := ctx.Value(tunnelKey{}).(*Tunnel)
+	return ok
+}
+
+// DialContext connects to addr through the jump host. Only TCP networks are
+// supported, since SSH can't forward UDP.
+func (t *Tunnel) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ConfigError{fmt.Errorf("%s connections can't be made through a jump host", network)}
+	}
+
+	client, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// SSH channels can't be cancelled, so give up on them instead
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		conn, err := client.Dial(network, addr)
+		done <- dialed{conn, err}
+	}()
+	select {
+	case <-ctx.Done():
+		go func() {
+			if d := <-done; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case d := <-done:
+		var openErr *ssh.OpenChannelError
+		if errors.As(d.err, &openErr) {
+			return nil, fmt.Errorf("jump host %s could not connect to %s : %s", t.jumpHost.Host, addr, openErr.Message)
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+		return withDeadlines(d.conn), nil
+	}
+}
+
+// Err returns the error from connecting to the jump host, if there was one.
+func (t *Tunnel) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Close closes the connection to the jump host, along with every connection
+// that was made through it.
+func (t *Tunnel) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.client == nil {
+		return nil
+	}
+	return t.client.Close()
+}
+
+// connect makes the SSH connection to the jump host, or returns the one that
+// was already made.
+func (t *Tunnel) connect(ctx context.Context) (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, errors.New("the tunnel through the jump host was closed")
+	}
+	if t.client == nil && t.err == nil {
+		t.client, t.err = t.jumpHost.connect(ctx)
+		if t.err != nil {
+			t.err = JumpHostError{Host: t.jumpHost.Host, Err: t.err}
+		}
+	}
+	return t.client, t.err
+}
+
+// connect logs in to the jump host. Connecting counts against the check's
+// timeout, since it uses the check's context.
+func (j *JumpHost) connect(ctx context.Context) (*ssh.Client, error) {
+	var auth []ssh.AuthMethod
+	if j.PrivateKey != "" {
+		signer, err := util.ParsePrivateKey(j.PrivateKey, j.KeyPassphrase)
+		if err != nil {
+			return nil, ConfigError{err}
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if j.Password != "" {
+		auth = append(auth, ssh.Password(j.Password))
+	}
+	if len(auth) == 0 {
+		return nil, ConfigError{errors.New("the jump host needs a Password or a PrivateKey")}
+	}
+	hostKeyCallback, err := util.HostKeyCallback(j.HostKeyFingerprint, j.KnownHosts)
+	if err != nil {
+		return nil, ConfigError{err}
+	}
+	config := &ssh.ClientConfig{
+		User:            j.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	addr := net.JoinHostPort(j.Host, j.Port)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	// Closing the connection interrupts the handshake if the check is
+	// cancelled
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	close(stop)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// A Dialer connects to a check's target, through the check's jump host if it
+// has one. Checks should dial with a Dialer instead of a net.Dialer, so that
+// jump hosts work for them.
+type Dialer struct {
+	Timeout time.Duration // The longest that a dial can take, like net.Dialer's Timeout
+}
+
+// DialContext connects to addr on network, like net.Dialer's DialContext.
+func (d *Dialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	tunnel, ok := ctx.Value(tunnelKey{}).(*Tunnel)
+	if !ok {
+		dialer := net.Dialer{Timeout: d.Timeout}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	return tunnel.DialContext(ctx, network, addr)
+}
+
+// DialTLS connects to addr and does a TLS handshake with config, like
+// tls.Dialer's DialContext. The server name is taken from addr if config
+// doesn't set one.
+func (d *Dialer) DialTLS(ctx context.Context, network string, addr string, config *tls.Config) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	raw, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = raw.SetDeadline(deadline)
+	}
+	conn := tls.Client(raw, config)
+	err = conn.Handshake()
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	_ = raw.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// tunnelConn is a connection through the jump host. SSH channels don't
+// support deadlines, which many checks depend on, so the channel is copied to
+// and from one end of a pipe, and the other end is used as the connection.
+type tunnelConn struct {
+	net.Conn
+	channel net.Conn
+}
+
+// withDeadlines wraps a channel in a tunnelConn.
+func withDeadlines(channel net.Conn) net.Conn {
+	local, remote := net.Pipe()
+	go func() {
+		_, _ = io.Copy(remote, channel)
+		remote.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(channel, remote)
+		channel.Close()
+	}()
+	return &tunnelConn{Conn: local, channel: channel}
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return c.channel.LocalAddr()
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.channel.RemoteAddr()
+}
@@ -13,12 +13,13 @@ import (
 
 	elasticsearch "github.com/elastic/go-elasticsearch/v7"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
 	"go.uber.org/zap"
 )
 
-func NewElasticsearch(host string, username string, password string, verify bool, index string) (*Elasticsearch, error) {
+func NewElasticsearch(hosts []string, username string, password string, verify bool, index string) (*Elasticsearch, error) {
 	c := elasticsearch.Config{
-		Addresses: []string{host},
+		Addresses: hosts,
 		Username:  username,
 		Password:  password,
 		Transport: &http.Transport{
@@ -40,7 +41,8 @@ func NewElasticsearch(host string, username string, password string, verify bool
 
 type Elasticsearch struct {
 	elasticsearch.Client
-	Index string
+	Index     string
+	Namespace config.Namespace // the namespace that the attribute indices are in
 }
 
 // The Document struct is used to parse Elasticsearch's JSON representation of
@@ -192,11 +194,11 @@ func (e *Elasticsearch) LoadAll() ([]check.Config, error) {
 	}
 
 	// Get admin and user attributes
-	admin, err := e.GetAllAttributes("attrib_admin_*")
+	admin, err := e.GetAllAttributes(e.Namespace.Index("attrib_admin_*"))
 	if err != nil {
 		return nil, err
 	}
-	user, err := e.GetAllAttributes("attrib_user_*")
+	user, err := e.GetAllAttributes(e.Namespace.Index("attrib_user_*"))
 	if err != nil {
 		return nil, err
 	}
@@ -226,15 +228,15 @@ func (e *Elasticsearch) LoadCheck(id string) (*check.Config, error) {
 	team := s[len(s)-1]
 
 	// Get attribute documents
-	admin, err := e.GetAttributes(id, fmt.Sprintf("attrib_admin_%s", team))
+	admin, err := e.GetAttributes(id, e.Namespace.Index(fmt.Sprintf("attrib_admin_%s", team)))
 	if err != nil {
 		return nil, err
 	}
-	user, err := e.GetAttributes(id, fmt.Sprintf("admin_user_%s", team))
+	user, err := e.GetAttributes(id, e.Namespace.Index(fmt.Sprintf("admin_user_%s", team)))
 	if err != nil {
 		return nil, err
 	}
-	indices, err := e.GetIndices(fmt.Sprintf("attrib_*_%s", team))
+	indices, err := e.GetIndices(e.Namespace.Index(fmt.Sprintf("attrib_*_%s", team)))
 	if err != nil {
 		return nil, err
 	}
@@ -257,6 +259,29 @@ func buildCheckConfig(doc *Document, admin map[string]string, user map[string]st
 		return nil, fmt.Errorf("Error encoding definition for %s to JSON string: %s", doc.ID, err)
 	}
 
+	// Checks without a timeout use the default timeout
+	timeoutString, _ := doc.Source["timeout"].(string)
+	timeout, err := check.ParseTimeout(timeoutString)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing timeout for %s: %s", doc.ID, err)
+	}
+
+	// Checks without a period run every round
+	periodString, _ := doc.Source["period"].(string)
+	period, err := check.ParsePeriod(periodString)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing period for %s: %s", doc.ID, err)
+	}
+
+	// Checks without an SLA threshold aren't penalized for failing in a row
+	threshold, _ := doc.Source["sla_threshold"].(float64)
+	penalty, _ := doc.Source["sla_penalty"].(float64)
+	sla := check.SLA{Threshold: int(threshold), Penalty: int64(penalty)}
+	err = sla.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing SLA for %s: %s", doc.ID, err)
+	}
+
 	// Unpack check definition into CheckConfig struct
 	c := &check.Config{
 		Metadata: check.Metadata{
@@ -266,6 +291,9 @@ func buildCheckConfig(doc *Document, admin map[string]string, user map[string]st
 			Group:       doc.Source["group"].(string),
 			ScoreWeight: int64(doc.Source["score_weight"].(float64)),
 		},
+		Timeout:    timeout,
+		Period:     period,
+		SLA:        sla,
 		Definition: def,
 		Attributes: check.Attributes{
 			Admin: admin,
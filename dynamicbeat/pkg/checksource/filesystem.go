@@ -88,21 +88,13 @@ func (f *Filesystem) LoadCheck(id string) (*check.Config, error) {
 		return nil, fmt.Errorf("failed to read check file '%s': %s", filepath, err)
 	}
 
-	// Grab team attribute overrides, if they exist
-	overrides := make(map[string]string)
-	for k, v := range team.Overrides {
-		overrides[k] = v
-	}
-
-	// Add attribute for team number if it doesn't exist
-	if _, exists := overrides["TeamNum"]; !exists {
-		re := regexp.MustCompile(`\S?0*(\d+)$`)
-		mat := re.FindStringSubmatch(team.Name)
-		overrides["TeamNum"] = mat[len(mat)-1]
-	}
+	overrides := TeamOverrides(*team)
 
 	checkFile := struct {
 		check.Metadata
+		Timeout string `json:"timeout"`
+		Period  string `json:"period"`
+		check.SLA
 		Definition map[string]interface{} `json:"definition"`
 		Attributes struct {
 			Admin map[string]string `json:"admin"`
@@ -114,6 +106,19 @@ func (f *Filesystem) LoadCheck(id string) (*check.Config, error) {
 		return nil, fmt.Errorf("failed to unmarshal check file '%s' from JSON: %s", filepath, err)
 	}
 
+	timeout, err := check.ParseTimeout(checkFile.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load check file '%s': %s", filepath, err)
+	}
+	period, err := check.ParsePeriod(checkFile.Period)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load check file '%s': %s", filepath, err)
+	}
+	err = checkFile.SLA.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load check file '%s': %s", filepath, err)
+	}
+
 	def, err := json.Marshal(checkFile.Definition)
 	if err != nil {
 		return nil, fmt.Errorf("failed to re-marshal check definition from '%s' to JSON string: %s", filepath, err)
@@ -136,6 +141,9 @@ func (f *Filesystem) LoadCheck(id string) (*check.Config, error) {
 
 	return &check.Config{
 		Metadata:   checkFile.Metadata,
+		Timeout:    timeout,
+		Period:     period,
+		SLA:        checkFile.SLA,
 		Definition: def,
 		Attributes: check.Attributes{
 			Admin: admin,
@@ -144,6 +152,25 @@ func (f *Filesystem) LoadCheck(id string) (*check.Config, error) {
 	}, nil
 }
 
+// TeamOverrides returns the attribute overrides for a team, including the
+// TeamNum attribute if the team doesn't override it.
+func TeamOverrides(team config.Team) map[string]string {
+	// Grab team attribute overrides, if they exist
+	overrides := make(map[string]string)
+	for k, v := range team.Overrides {
+		overrides[k] = v
+	}
+
+	// Add attribute for team number if it doesn't exist
+	if _, exists := overrides["TeamNum"]; !exists {
+		re := regexp.MustCompile(`\S?0*(\d+)$`)
+		mat := re.FindStringSubmatch(team.Name)
+		overrides["TeamNum"] = mat[len(mat)-1]
+	}
+
+	return overrides
+}
+
 func applyOverrides(overrides map[string]string, attributes map[string]string) (map[string]string, error) {
 	for k, v := range attributes {
 		// If the attribute name exists in the overrides map, set its value to
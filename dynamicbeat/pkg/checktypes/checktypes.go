@@ -2,21 +2,43 @@ package checktypes
 
 import (
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/dhcp"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/dns"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/elasticsearch"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/exec"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/ftp"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/git"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/grpc"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/http"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/icmp"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/imap"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/kerberos"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/kubernetes"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/ldap"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/mongodb"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/mqtt"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/mssql"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/mysql"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/nfs"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/noop"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/ntp"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/pop3"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/postgresql"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/prometheus"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/rdp"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/redis"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/registry"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/sip"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/smb"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/smtp"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/snmp"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/ssh"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/syslog"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/tcp"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/tftp"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/tls"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/vnc"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/websocket"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/winrm"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/xmpp"
 	"go.uber.org/zap"
@@ -45,6 +67,8 @@ func GetCheckType(c check.Config) check.Check {
 		def = &imap.Definition{}
 	case "smtp":
 		def = &smtp.Definition{}
+	case "pop3":
+		def = &pop3.Definition{}
 	case "winrm":
 		def = &winrm.Definition{}
 	case "xmpp":
@@ -59,6 +83,48 @@ func GetCheckType(c check.Config) check.Check {
 		def = &mssql.Definition{}
 	case "git":
 		def = &git.Definition{}
+	case "rdp":
+		def = &rdp.Definition{}
+	case "tcp":
+		def = &tcp.Definition{}
+	case "ntp":
+		def = &ntp.Definition{}
+	case "snmp":
+		def = &snmp.Definition{}
+	case "redis":
+		def = &redis.Definition{}
+	case "mongodb":
+		def = &mongodb.Definition{}
+	case "elasticsearch":
+		def = &elasticsearch.Definition{}
+	case "registry":
+		def = &registry.Definition{}
+	case "kubernetes":
+		def = &kubernetes.Definition{}
+	case "grpc":
+		def = &grpc.Definition{}
+	case "websocket":
+		def = &websocket.Definition{}
+	case "tls":
+		def = &tls.Definition{}
+	case "nfs":
+		def = &nfs.Definition{}
+	case "tftp":
+		def = &tftp.Definition{}
+	case "sip":
+		def = &sip.Definition{}
+	case "kerberos":
+		def = &kerberos.Definition{}
+	case "dhcp":
+		def = &dhcp.Definition{}
+	case "syslog":
+		def = &syslog.Definition{}
+	case "prometheus":
+		def = &prometheus.Definition{}
+	case "mqtt":
+		def = &mqtt.Definition{}
+	case "exec":
+		def = &exec.Definition{}
 	default:
 		zap.S().Warnf("check id %s had an invalid type: %s", c.ID, c.Type)
 		def = &noop.Definition{}
@@ -66,3 +132,35 @@ func GetCheckType(c check.Config) check.Check {
 
 	return def
 }
+
+// noJumpHost are the check types that can't connect through a jump host,
+// because they use UDP or ICMP, run a command on this host, or their libraries
+// dial for themselves.
+var noJumpHost = map[string]bool{
+	"dhcp":     true,
+	"dns":      true,
+	"exec":     true,
+	"git":      true,
+	"icmp":     true,
+	"kerberos": true,
+	"ntp":      true,
+	"snmp":     true,
+	"tftp":     true,
+	"xmpp":     true,
+}
+
+// SupportsJumpHost reports whether checks of a type can connect to their
+// targets through a jump host.
+func SupportsJumpHost(typ string) bool {
+	return !noJumpHost[typ]
+}
+
+// EscapePlaceholders escapes the placeholders in a definition that checks of
+// a type fill in for themselves when they run, so that they are left alone
+// when the definition is rendered with the check's attributes.
+func EscapePlaceholders(typ string, def string) string {
+	if typ == "http" {
+		return http.EscapePlaceholders(def)
+	}
+	return def
+}
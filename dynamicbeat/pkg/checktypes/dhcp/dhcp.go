@@ -0,0 +1,369 @@
+package dhcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"go.uber.org/zap"
+)
+
+// The Definition configures the behavior of the DHCP check
+// it implements the "check" interface
+type Definition struct {
+	Config     check.Config // generic metadata about the check
+	Interface  string       `optiontype:"optional"` // The network interface to send from, like eth0
+	Server     string       `optiontype:"optional"` // IP of a DHCP server or relay to send to as a relay agent, instead of broadcasting
+	Request    string       `optiontype:"optional"` // Whether to request the offered address, and release it once the server acknowledges it
+	Subnet     string       `optiontype:"optional"` // CIDR that the offered address must be in, like 10.0.0.0/24
+	Routers    []string     `optiontype:"optional"` // Routers that the server must offer
+	DNSServers []string     `optiontype:"optional"` // DNS servers that the server must offer
+}
+
+// Ports of DHCP servers and clients.
+const (
+	serverPort = 67
+	clientPort = 68
+)
+
+// retransmit is the first interval after which a request is sent again.
+const retransmit = time.Second
+
+// A client sends DHCP messages for a single random MAC address.
+type client struct {
+	conn net.PacketConn
+	mac  net.HardwareAddr
+	xid  uint32
+	buf  []byte
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	var subnet *net.IPNet
+	var err error
+	if d.Subnet != "" {
+		_, subnet, err = net.ParseCIDR(d.Subnet)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error parsing subnet %s : %s", d.Subnet, err)
+			return result
+		}
+	}
+	routers, err := parseIPs(d.Routers)
+	if err != nil {
+		result.Message = fmt.Sprintf("Invalid router : %s", err)
+		return result
+	}
+	dnsServers, err := parseIPs(d.DNSServers)
+	if err != nil {
+		result.Message = fmt.Sprintf("Invalid DNS server : %s", err)
+		return result
+	}
+	request, _ := strconv.ParseBool(d.Request)
+
+	// Broadcast from the client port, or act as a relay agent and unicast
+	// from the server port, since servers send their replies to the relay
+	// agent's server port
+	dest := &net.UDPAddr{IP: net.IPv4bcast, Port: serverPort}
+	localPort := clientPort
+	var relay net.IP
+	if d.Server != "" {
+		dest, err = net.ResolveUDPAddr("udp4", net.JoinHostPort(d.Server, strconv.Itoa(serverPort)))
+		if err != nil {
+			result.Message = fmt.Sprintf("Could not resolve %s : %s", d.Server, err)
+			return result
+		}
+		relay, err = d.relayAddress(dest)
+		if err != nil {
+			result.Message = fmt.Sprintf("Could not find an address to relay from : %s", err)
+			return result
+		}
+		localPort = serverPort
+	}
+
+	lc := net.ListenConfig{Control: control(d.Interface)}
+	conn, err := lc.ListenPacket(ctx, "udp4", ":"+strconv.Itoa(localPort))
+	if err != nil {
+		result.Message = d.socketError(localPort, err)
+		return result
+	}
+	defer conn.Close()
+
+	c := &client{conn: conn, mac: randomMAC(), buf: make([]byte, 65536)}
+	xid := make([]byte, 4)
+	_, _ = rand.Read(xid)
+	c.xid = binary.BigEndian.Uint32(xid)
+
+	discover := newMessage(msgDiscover, c.xid, c.mac)
+	discover.set(optParameterList, []byte{optSubnetMask, optRouter, optDNS, optLeaseTime, optServerID})
+	if relay != nil {
+		discover.giaddr = relay
+		discover.hops = 1
+	}
+	offer, err := c.exchange(ctx, discover, dest, msgOffer)
+	if err != nil {
+		result.Message = d.exchangeError("DISCOVER", err)
+		return result
+	}
+	reply := offer
+	server := offer.ip(optServerID)
+	result.Details = details(offer)
+
+	if request {
+		req := newMessage(msgRequest, c.xid, c.mac)
+		req.set(optRequestedIP, ip4(offer.yiaddr))
+		if server != nil {
+			req.set(optServerID, ip4(server))
+		}
+		req.set(optParameterList, discover.options[optParameterList])
+		req.giaddr, req.hops = discover.giaddr, discover.hops
+		reply, err = c.exchange(ctx, req, dest, msgAck, msgNak)
+		if err != nil {
+			result.Message = d.exchangeError("REQUEST", err)
+			return result
+		}
+		if reply.messageType() == msgNak {
+			result.Message = fmt.Sprintf("Server %s refused the request for %s with a NAK", server, offer.yiaddr)
+			if text := reply.options[optMessage]; len(text) > 0 {
+				result.Message += " : " + string(text)
+			}
+			return result
+		}
+		result.Details = details(reply)
+
+		// Give the address back, so that checks don't use up the pool
+		err = c.release(reply, dest)
+		if err != nil {
+			zap.S().Debugf("Failed to release %s to %s: %s", reply.yiaddr, server, err)
+		}
+	}
+
+	if subnet != nil && !subnet.Contains(reply.yiaddr) {
+		result.Message = fmt.Sprintf("Offered address %s is not in %s", reply.yiaddr, d.Subnet)
+		return result
+	}
+	if missing := missingIP(reply.ips(optRouter), routers); missing != nil {
+		result.Message = fmt.Sprintf("Server did not offer router %s : offered %s", missing, formatIPs(reply.ips(optRouter)))
+		return result
+	}
+	if missing := missingIP(reply.ips(optDNS), dnsServers); missing != nil {
+		result.Message = fmt.Sprintf("Server did not offer DNS server %s : offered %s", missing, formatIPs(reply.ips(optDNS)))
+		return result
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// exchange sends a message, and waits for a reply with one of the message
+// types. The message is sent again with a doubling interval until a reply
+// arrives or the check times out.
+func (c *client) exchange(ctx context.Context, m *message, dest net.Addr, types ...byte) (*message, error) {
+	out := m.marshal()
+	interval := retransmit
+	for {
+		_, err := c.conn.WriteTo(out, dest)
+		if err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(interval)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		_ = c.conn.SetReadDeadline(deadline)
+		reply, err := c.read(types)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+			interval *= 2
+			continue
+		}
+		return reply, err
+	}
+}
+
+// read reads replies until one for this client with one of the message types
+// arrives. Replies to other clients are skipped, since servers broadcast
+// them.
+func (c *client) read(types []byte) (*message, error) {
+	for {
+		n, _, err := c.conn.ReadFrom(c.buf)
+		if err != nil {
+			return nil, err
+		}
+		m, err := parseMessage(c.buf[:n])
+		if err != nil || m.op != bootReply || m.xid != c.xid || m.chaddr.String() != c.mac.String() {
+			continue
+		}
+		for _, t := range types {
+			if m.messageType() == t {
+				return m, nil
+			}
+		}
+	}
+}
+
+// release gives a leased address back to the server that leased it.
+func (c *client) release(ack *message, dest *net.UDPAddr) error {
+	release := newMessage(msgRelease, c.xid, c.mac)
+	release.flags = 0
+	release.ciaddr = ack.yiaddr
+	to := dest
+	if server := ack.ip(optServerID); server != nil {
+		release.set(optServerID, ip4(server))
+		to = &net.UDPAddr{IP: server, Port: serverPort}
+	}
+	_, err := c.conn.WriteTo(release.marshal(), to)
+	return err
+}
+
+// relayAddress returns the address that servers send their replies to when
+// the check acts as a relay agent: the first IPv4 address of the interface,
+// or the address that the server is reached from.
+func (d *Definition) relayAddress(server *net.UDPAddr) (net.IP, error) {
+	if d.Interface != "" {
+		iface, err := net.InterfaceByName(d.Interface)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				return ipNet.IP.To4(), nil
+			}
+		}
+		return nil, fmt.Errorf("interface %s has no IPv4 address", d.Interface)
+	}
+
+	// Connecting a UDP socket doesn't send anything, but picks the route
+	conn, err := net.DialUDP("udp4", nil, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.To4(), nil
+}
+
+// socketError describes why the socket couldn't be opened. Binding the DHCP
+// ports and an interface needs privileges that Dynamicbeat might not have.
+func (d *Definition) socketError(port int, err error) string {
+	switch {
+	case errors.Is(err, syscall.ENODEV):
+		return fmt.Sprintf("Could not open a DHCP socket on port %d : interface %s does not exist", port, d.Interface)
+	case errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM):
+		return fmt.Sprintf("Could not open a DHCP socket on port %d : permission denied - Dynamicbeat must run as root, or with the CAP_NET_BIND_SERVICE and CAP_NET_RAW capabilities", port)
+	case errors.Is(err, syscall.EADDRINUSE):
+		return fmt.Sprintf("Could not open a DHCP socket on port %d : the port is already in use by other DHCP software on this host", port)
+	default:
+		return fmt.Sprintf("Could not open a DHCP socket on port %d : %s", port, err)
+	}
+}
+
+// exchangeError describes why no reply to a message arrived.
+func (d *Definition) exchangeError(msgType string, err error) string {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return fmt.Sprintf("Sending the %s failed : %s", msgType, err)
+	}
+	if d.Server != "" {
+		return fmt.Sprintf("No response from %s to the %s", d.Server, msgType)
+	}
+	return fmt.Sprintf("No DHCP server responded to the %s", msgType)
+}
+
+// details records the address and options that the server sent.
+func details(m *message) map[string]string {
+	details := map[string]string{"address": m.yiaddr.String()}
+	if server := m.ip(optServerID); server != nil {
+		details["server"] = server.String()
+	}
+	if mask := m.options[optSubnetMask]; len(mask) == 4 {
+		details["subnet_mask"] = net.IP(mask).String()
+	}
+	if lease := m.options[optLeaseTime]; len(lease) == 4 {
+		details["lease_time"] = strconv.FormatUint(uint64(binary.BigEndian.Uint32(lease)), 10)
+	}
+	if routers := m.ips(optRouter); len(routers) > 0 {
+		details["routers"] = formatIPs(routers)
+	}
+	if dns := m.ips(optDNS); len(dns) > 0 {
+		details["dns_servers"] = formatIPs(dns)
+	}
+	return details
+}
+
+// randomMAC returns a random locally administered unicast MAC address, so
+// that the check doesn't get the lease of a real client.
+func randomMAC() net.HardwareAddr {
+	mac := make(net.HardwareAddr, 6)
+	_, _ = rand.Read(mac)
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	return mac
+}
+
+// parseIPs parses a list of IPv4 addresses.
+func parseIPs(values []string) ([]net.IP, error) {
+	ips := make([]net.IP, 0, len(values))
+	for _, v := range values {
+		ip := net.ParseIP(strings.TrimSpace(v)).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("%s is not an IPv4 address", v)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// missingIP returns the first expected address that wasn't offered, or nil
+// if all of them were.
+func missingIP(offered []net.IP, expected []net.IP) net.IP {
+	for _, e := range expected {
+		found := false
+		for _, o := range offered {
+			if o.Equal(e) {
+				found = true
+			}
+		}
+		if !found {
+			return e
+		}
+	}
+	return nil
+}
+
+// formatIPs joins addresses with commas, or returns "none".
+func formatIPs(ips []net.IP) string {
+	if len(ips) == 0 {
+		return "none"
+	}
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
@@ -0,0 +1,193 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// DHCP message types.
+const (
+	msgDiscover = 1
+	msgOffer    = 2
+	msgRequest  = 3
+	msgAck      = 5
+	msgNak      = 6
+	msgRelease  = 7
+)
+
+// DHCP option codes used by the check.
+const (
+	optPad           = 0
+	optSubnetMask    = 1
+	optRouter        = 3
+	optDNS           = 6
+	optRequestedIP   = 50
+	optLeaseTime     = 51
+	optMessageType   = 53
+	optServerID      = 54
+	optParameterList = 55
+	optMessage       = 56
+	optClientID      = 61
+	optEnd           = 255
+)
+
+// Fields of the fixed-size header that comes before the options.
+const (
+	bootRequest      = 1
+	bootReply        = 2
+	hardwareEthernet = 1
+	broadcastFlag    = 0x8000
+	headerLength     = 236
+	minMessageLength = 300
+)
+
+// magicCookie starts the options of every DHCP message.
+var magicCookie = []byte{99, 130, 83, 99}
+
+// A message is a DHCP message that the check sends or receives.
+type message struct {
+	op      byte
+	hops    byte
+	xid     uint32
+	flags   uint16
+	ciaddr  net.IP
+	yiaddr  net.IP
+	giaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+	order   []byte
+}
+
+// newMessage creates a request from the client with a MAC address.
+func newMessage(msgType byte, xid uint32, mac net.HardwareAddr) *message {
+	m := &message{
+		op:      bootRequest,
+		xid:     xid,
+		flags:   broadcastFlag,
+		chaddr:  mac,
+		options: make(map[byte][]byte),
+	}
+	m.set(optMessageType, []byte{msgType})
+	m.set(optClientID, append([]byte{hardwareEthernet}, mac...))
+	return m
+}
+
+// set sets an option. Options are sent in the order that they were set.
+func (m *message) set(code byte, value []byte) {
+	if _, ok := m.options[code]; !ok {
+		m.order = append(m.order, code)
+	}
+	m.options[code] = value
+}
+
+// messageType returns the DHCP message type, or 0 if the message doesn't
+// have one.
+func (m *message) messageType() byte {
+	if v := m.options[optMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// ip returns the first address of an option, or nil if the message doesn't
+// have it.
+func (m *message) ip(code byte) net.IP {
+	if v := m.options[code]; len(v) >= 4 {
+		return net.IP(v[:4])
+	}
+	return nil
+}
+
+// ips returns all of the addresses of an option.
+func (m *message) ips(code byte) []net.IP {
+	v := m.options[code]
+	var ips []net.IP
+	for i := 0; i+4 <= len(v); i += 4 {
+		ips = append(ips, net.IP(v[i:i+4]))
+	}
+	return ips
+}
+
+// marshal encodes the message. Messages are padded to the 300 bytes that
+// BOOTP relays and some servers expect.
+func (m *message) marshal() []byte {
+	var b bytes.Buffer
+	b.Write([]byte{m.op, hardwareEthernet, byte(len(m.chaddr)), m.hops})
+	_ = binary.Write(&b, binary.BigEndian, m.xid)
+	_ = binary.Write(&b, binary.BigEndian, uint16(0)) // secs
+	_ = binary.Write(&b, binary.BigEndian, m.flags)
+	for _, ip := range []net.IP{m.ciaddr, m.yiaddr, nil, m.giaddr} {
+		b.Write(ip4(ip))
+	}
+	chaddr := make([]byte, 16)
+	copy(chaddr, m.chaddr)
+	b.Write(chaddr)
+	b.Write(make([]byte, 64+128)) // sname, file
+	b.Write(magicCookie)
+	for _, code := range m.order {
+		b.WriteByte(code)
+		b.WriteByte(byte(len(m.options[code])))
+		b.Write(m.options[code])
+	}
+	b.WriteByte(optEnd)
+	for b.Len() < minMessageLength {
+		b.WriteByte(optPad)
+	}
+	return b.Bytes()
+}
+
+// parseMessage decodes a message.
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < headerLength+4 || !bytes.Equal(b[headerLength:headerLength+4], magicCookie) {
+		return nil, errors.New("not a DHCP message")
+	}
+	hlen := int(b[2])
+	if hlen > 16 {
+		return nil, errors.New("invalid hardware address length")
+	}
+	// Copy the message, since the buffer that it was read into is reused
+	b = append([]byte(nil), b...)
+	m := &message{
+		op:      b[0],
+		hops:    b[3],
+		xid:     binary.BigEndian.Uint32(b[4:]),
+		flags:   binary.BigEndian.Uint16(b[10:]),
+		ciaddr:  net.IP(b[12:16]),
+		yiaddr:  net.IP(b[16:20]),
+		giaddr:  net.IP(b[24:28]),
+		chaddr:  net.HardwareAddr(b[28 : 28+hlen]),
+		options: make(map[byte][]byte),
+	}
+	opts := b[headerLength+4:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, errors.New("truncated option")
+		}
+		value := opts[2 : 2+int(opts[1])]
+		// Long options are split into several options with the same code
+		if _, ok := m.options[code]; !ok {
+			m.order = append(m.order, code)
+		}
+		m.options[code] = append(m.options[code], value...)
+		opts = opts[2+len(value):]
+	}
+	return m, nil
+}
+
+// ip4 returns the 4-byte form of an address, or 0.0.0.0 for nil.
+func ip4(ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return make([]byte, 4)
+}
@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package dhcp
+
+import "syscall"
+
+// control lets the socket share its port with other DHCP software on the
+// host, and binds it to an interface if one is set.
+func control(iface string) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			if sockErr == nil && iface != "" {
+				sockErr = syscall.BindToDevice(int(fd), iface)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package dhcp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// control fails if an interface is set, since sockets can only be bound to
+// an interface on Linux.
+func control(iface string) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		if iface != "" {
+			return errors.New("selecting an interface is only supported on Linux")
+		}
+		return nil
+	}
+}
@@ -2,7 +2,12 @@ package dns
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -12,57 +17,271 @@ import (
 // The Definition configures the behavior of the DNS check
 // it implements the "check" interface
 type Definition struct {
-	Config     check.Config // generic metadata about the check
-	Server     string       `optiontype:"required"`                    // The IP of the DNS server to query
-	Fqdn       string       `optiontype:"required"`                    // The FQDN of the host you are looking up
-	ExpectedIP string       `optiontype:"required"`                    // The expected IP of the host you are looking up
-	Port       string       `optiontype:"optional" optiondefault:"53"` // The port of the DNS server
+	Config            check.Config // generic metadata about the check
+	Server            string       `optiontype:"required"`                      // The IP of the DNS server to query
+	Fqdn              string       `optiontype:"required"`                      // The FQDN of the host you are looking up, or the IP for PTR records
+	ExpectedIP        string       `optiontype:"optional"`                      // The expected IP of the host you are looking up, for A and AAAA records
+	Port              string       `optiontype:"optional" optiondefault:"53"`   // The port of the DNS server
+	RecordType        string       `optiontype:"optional" optiondefault:"A"`    // The type of record to look up
+	Expected          string       `optiontype:"optional"`                      // The expected value of one of the records; see recordValue for the format of each type
+	ExpectedRegex     string       `optiontype:"optional"`                      // A regex that the value of one of the records must match
+	StrictAnswerCount int          `optiontype:"optional"`                      // The exact number of records that must be returned; 0 allows any number
+	Protocol          string       `optiontype:"optional" optiondefault:"auto"` // udp, tcp, or auto to retry truncated UDP responses over TCP
+	UDPSize           uint16       `optiontype:"optional"`                      // The EDNS0 UDP buffer size to advertise; 0 doesn't use EDNS0
+	SourceIP          string       `optiontype:"optional"`                      // The local IP to send the query from
+	DNSSEC            string       `optiontype:"optional"`                      // Whether the answer must have a valid DNSSEC signature
+	DNSKey            string       `optiontype:"optional"`                      // A DNSKEY record that must have signed the zone's keys, in zone file format
 }
 
 // Run a single instance of the check
-// For now we only support A record querries
 func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
-	// Setup for dns query
+	recordType, ok := dns.StringToType[strings.ToUpper(d.RecordType)]
+	if !ok {
+		result.Message = fmt.Sprintf("Unknown record type %s", d.RecordType)
+		return result
+	}
+	expected := d.Expected
+	if expected == "" {
+		expected = d.ExpectedIP
+	}
+	var regex *regexp.Regexp
+	if d.ExpectedRegex != "" {
+		var err error
+		regex, err = regexp.Compile(d.ExpectedRegex)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ExpectedRegex, err)
+			return result
+		}
+	}
+	if expected == "" && regex == nil {
+		result.Message = "One of Expected, ExpectedIP, or ExpectedRegex must be set"
+		return result
+	}
+
+	// Setup for dns query. PTR records are looked up by the reverse name of
+	// an IP.
 	var msg dns.Msg
 	fqdn := dns.Fqdn(d.Fqdn)
-	msg.SetQuestion(fqdn, dns.TypeA)
+	if recordType == dns.TypePTR && net.ParseIP(d.Fqdn) != nil {
+		fqdn, _ = dns.ReverseAddr(d.Fqdn)
+	}
+	msg.SetQuestion(fqdn, recordType)
+	dnssec, _ := strconv.ParseBool(d.DNSSEC)
+	if d.UDPSize > 0 || dnssec {
+		// Signatures are only returned if the DO bit is set, which needs EDNS0
+		size := d.UDPSize
+		if size == 0 {
+			size = 4096
+		}
+		msg.SetEdns0(size, dnssec)
+	}
 
-	// Make it obey timeout via deadline
-	// TODO: change this to be relative to the parent context's timeout
-	deadctx, cancel := context.WithDeadline(ctx, time.Now().Add(20*time.Second))
+	// Make it obey the check's timeout via deadline
+	deadctx, cancel := context.WithTimeout(ctx, check.TimeLeft(ctx, 20*time.Second))
 	defer cancel()
 
 	// Send the query
-	in, err := dns.ExchangeContext(deadctx, &msg, fmt.Sprintf("%s:%s", d.Server, d.Port))
+	addr := net.JoinHostPort(d.Server, d.Port)
+	protocol := strings.ToLower(d.Protocol)
+	in, transport, err := exchange(deadctx, &msg, addr, protocol, d.SourceIP)
+	if errors.As(err, &check.ConfigError{}) {
+		result.Message = err.Error()
+		return result
+	}
+	result.Assert("respond", err == nil)
 	if err != nil {
 		result.Message = fmt.Sprintf("Problem sending query to %s : %s", d.Server, err)
 		return result
 	}
 
+	// Save the answers for troubleshooting
+	answers := make([]string, 0, len(in.Answer))
+	for _, answer := range in.Answer {
+		answers = append(answers, answer.String())
+	}
+	result.Details = map[string]string{"answers": strings.Join(answers, "\n"), "transport": transport}
+
+	// Only answers of the requested type count, since other answers like
+	// CNAMEs can be returned along with them
+	var values []string
+	for _, answer := range in.Answer {
+		if answer.Header().Rrtype == recordType {
+			values = append(values, recordValue(answer))
+		}
+	}
+
+	// The rest of the assertions are all made, so that each of them can be
+	// scored, but the first one that fails is the one that is reported
+	var messages []string
+
 	// Check if we got any records
-	if len(in.Answer) < 1 {
-		result.Message = fmt.Sprintf("No records received from %s", d.Server)
-		return result
+	message := ""
+	if len(values) < 1 {
+		message = fmt.Sprintf("No %s records received from %s", dns.TypeToString[recordType], d.Server)
+	} else if d.StrictAnswerCount > 0 && len(values) != d.StrictAnswerCount {
+		message = fmt.Sprintf("Received %d %s records, but expected %d", len(values), dns.TypeToString[recordType], d.StrictAnswerCount)
+	}
+	result.Assert("records", message == "")
+	messages = append(messages, message)
+
+	// Check the signatures over the records
+	if dnssec && len(values) > 0 {
+		v, err := newValidator(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+			in, _, err := exchange(ctx, m, addr, protocol, d.SourceIP)
+			return in, err
+		}, d.DNSKey)
+		if err != nil {
+			result.Message = err.Error()
+			return result
+		}
+		state, err := v.validate(deadctx, in, recordType)
+		result.Details["dnssec"] = state
+		message = ""
+		if err != nil {
+			message = fmt.Sprintf("DNSSEC validation failed: %s", err)
+		}
+		result.Assert("dnssec", message == "")
+		messages = append(messages, message)
 	}
 
 	// Loop through results and check for correct match
-	for _, answer := range in.Answer {
-		// Check if an answer is an A record and it matches the expected IP
-		if a, ok := answer.(*dns.A); ok && (a.A).String() == d.ExpectedIP {
-			// If we reach here the check succeeds
-			result.Passed = true
+	message = "Incorrect Records Returned"
+	for _, value := range values {
+		if expected != "" && !sameValue(recordType, value, expected) {
+			continue
+		}
+		if regex != nil && !regex.MatchString(value) {
+			continue
+		}
+		message = ""
+		break
+	}
+	result.Assert("match", message == "")
+	messages = append(messages, message)
+
+	for _, message := range messages {
+		if message != "" {
+			result.Message = message
 			return result
 		}
 	}
 
-	// If we reach here no records matched expected IP and check fails
-	result.Message = "Incorrect Records Returned"
+	// If we reach here the check succeeds
+	result.Passed = true
 	return result
 }
 
+// errTruncated is returned by exchange when a response was truncated, so that
+// the auto protocol knows to retry the query over TCP.
+var errTruncated = errors.New("response was truncated")
+
+// exchange sends a query over the given protocol, and returns the response
+// and the transport that it was received over. With the auto protocol, the
+// query is sent over UDP first, and then sent again over TCP if the UDP
+// response was truncated. Queries are sent from sourceIP if it is set.
+func exchange(ctx context.Context, msg *dns.Msg, addr string, protocol string, sourceIP string) (*dns.Msg, string, error) {
+	switch protocol {
+	case "udp", "tcp":
+		dialer, err := check.NewDialer(protocol, sourceIP)
+		if err != nil {
+			return nil, protocol, err
+		}
+		client := &dns.Client{Net: protocol, Dialer: dialer}
+		in, _, err := client.ExchangeContext(ctx, msg, addr)
+		if err == nil && in.Truncated {
+			return nil, protocol, errTruncated
+		}
+		return in, protocol, err
+	case "auto":
+		in, transport, err := exchange(ctx, msg, addr, "udp", sourceIP)
+		if err != errTruncated {
+			return in, transport, err
+		}
+		return exchange(ctx, msg, addr, "tcp", sourceIP)
+	default:
+		return nil, "", fmt.Errorf("unknown protocol %s - must be udp, tcp, or auto", protocol)
+	}
+}
+
+// recordValue formats the value of a record for matching:
+//
+//	A, AAAA    the IP, like 10.0.0.1
+//	CNAME, NS  the name, like ns1.example.com
+//	PTR        the name that the IP points to, like host.example.com
+//	MX         the priority and mail server, like 10 mail.example.com
+//	SRV        the target and port, like ldap.example.com:389
+//	TXT        the text, with the strings of the record joined together
+//
+// Names are lowercase and don't have a trailing dot. Other types use their
+// zone file format without the header.
+func recordValue(rr dns.RR) string {
+	switch r := rr.(type) {
+	case *dns.A:
+		return r.A.String()
+	case *dns.AAAA:
+		return r.AAAA.String()
+	case *dns.CNAME:
+		return name(r.Target)
+	case *dns.NS:
+		return name(r.Ns)
+	case *dns.PTR:
+		return name(r.Ptr)
+	case *dns.MX:
+		return fmt.Sprintf("%d %s", r.Preference, name(r.Mx))
+	case *dns.SRV:
+		return net.JoinHostPort(name(r.Target), strconv.Itoa(int(r.Port)))
+	case *dns.TXT:
+		return strings.Join(r.Txt, "")
+	default:
+		return strings.TrimPrefix(rr.String(), rr.Header().String())
+	}
+}
+
+// sameValue checks whether a record value matches the expected value. IPs are
+// compared as addresses, and names are compared without case or a trailing
+// dot. An MX value matches an expected mail server without a priority, and an
+// SRV value matches an expected target without a port.
+func sameValue(recordType uint16, value string, expected string) bool {
+	switch recordType {
+	case dns.TypeA, dns.TypeAAAA:
+		ip := net.ParseIP(expected)
+		return ip != nil && ip.Equal(net.ParseIP(value))
+	case dns.TypeCNAME, dns.TypeNS, dns.TypePTR:
+		return value == name(expected)
+	case dns.TypeMX:
+		fields := strings.Fields(expected)
+		if len(fields) == 1 {
+			// Null MX records, like "0 .", don't have a mail server
+			f := strings.Fields(value)
+			return len(f) == 2 && f[1] == name(fields[0])
+		}
+		return len(fields) == 2 && value == fmt.Sprintf("%s %s", fields[0], name(fields[1]))
+	case dns.TypeSRV:
+		host, port, err := net.SplitHostPort(expected)
+		if err != nil {
+			target, _, _ := net.SplitHostPort(value)
+			return target == name(expected)
+		}
+		return value == net.JoinHostPort(name(host), port)
+	default:
+		return value == expected
+	}
+}
+
+// name normalizes a domain name for comparison.
+func name(n string) string {
+	return strings.ToLower(strings.TrimSuffix(n, "."))
+}
+
+// Assertions returns the names of the assertions that DNS checks make, for
+// partial credit scoring. The dnssec assertion is only made if DNSSEC is set.
+func (d *Definition) Assertions() []string {
+	return []string{"respond", "records", "match", "dnssec"}
+}
+
 // GetConfig returns the current CheckConfig struct this check has been
 // configured with.
 func (d *Definition) GetConfig() check.Config {
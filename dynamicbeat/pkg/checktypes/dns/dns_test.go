@@ -0,0 +1,70 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordValue(t *testing.T) {
+	tests := []struct {
+		record string
+		want   string
+	}{
+		{record: "www.example.com. 300 IN A 10.0.0.1", want: "10.0.0.1"},
+		{record: "www.example.com. 300 IN AAAA 2001:db8::0001", want: "2001:db8::1"},
+		{record: "web.example.com. 300 IN CNAME WWW.Example.com.", want: "www.example.com"},
+		{record: "example.com. 300 IN NS ns1.example.com.", want: "ns1.example.com"},
+		{record: "1.0.0.10.in-addr.arpa. 300 IN PTR host.example.com.", want: "host.example.com"},
+		{record: "example.com. 300 IN MX 10 Mail.example.com.", want: "10 mail.example.com"},
+		{record: "example.com. 300 IN MX 0 .", want: "0 "},
+		{record: "_ldap._tcp.example.com. 300 IN SRV 0 100 389 dc01.example.com.", want: "dc01.example.com:389"},
+		{record: `example.com. 300 IN TXT "v=spf1 " "-all"`, want: "v=spf1 -all"},
+		{record: "example.com. 300 IN CAA 0 issue \"letsencrypt.org\"", want: "0 issue \"letsencrypt.org\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.record, func(t *testing.T) {
+			rr, err := dns.NewRR(tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := recordValue(rr); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameValue(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordType uint16
+		value      string
+		expected   string
+		want       bool
+	}{
+		{name: "IPv4", recordType: dns.TypeA, value: "10.0.0.1", expected: "10.0.0.1", want: true},
+		{name: "different IPv4", recordType: dns.TypeA, value: "10.0.0.1", expected: "10.0.0.2"},
+		{name: "IPv6 written differently", recordType: dns.TypeAAAA, value: "2001:db8::1", expected: "2001:DB8:0:0::1", want: true},
+		{name: "invalid IP", recordType: dns.TypeA, value: "10.0.0.1", expected: "server"},
+		{name: "name with a trailing dot", recordType: dns.TypeCNAME, value: "www.example.com", expected: "WWW.example.com.", want: true},
+		{name: "different name", recordType: dns.TypeNS, value: "ns1.example.com", expected: "ns2.example.com"},
+		{name: "MX with a priority", recordType: dns.TypeMX, value: "10 mail.example.com", expected: "10 mail.example.com.", want: true},
+		{name: "MX with a different priority", recordType: dns.TypeMX, value: "10 mail.example.com", expected: "20 mail.example.com"},
+		{name: "MX without a priority", recordType: dns.TypeMX, value: "10 mail.example.com", expected: "Mail.example.com", want: true},
+		{name: "null MX", recordType: dns.TypeMX, value: "0 ", expected: "mail.example.com"},
+		{name: "expected null MX", recordType: dns.TypeMX, value: "0 ", expected: "0 .", want: true},
+		{name: "SRV with a port", recordType: dns.TypeSRV, value: "dc01.example.com:389", expected: "DC01.example.com.:389", want: true},
+		{name: "SRV with a different port", recordType: dns.TypeSRV, value: "dc01.example.com:389", expected: "dc01.example.com:636"},
+		{name: "SRV without a port", recordType: dns.TypeSRV, value: "dc01.example.com:389", expected: "dc01.example.com", want: true},
+		{name: "TXT", recordType: dns.TypeTXT, value: "v=spf1 -all", expected: "v=spf1 -all", want: true},
+		{name: "TXT is case sensitive", recordType: dns.TypeTXT, value: "v=spf1 -all", expected: "V=SPF1 -all"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameValue(tt.recordType, tt.value, tt.expected); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
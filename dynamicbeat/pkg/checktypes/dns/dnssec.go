@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The DNSSEC states that are recorded in the check result details.
+const (
+	secure   = "secure"   // the answer has a valid signature
+	insecure = "insecure" // the answer isn't signed
+	bogus    = "bogus"    // the answer is signed, but the signature can't be validated
+)
+
+// validator checks the DNSSEC signatures of answers against the DNSKEY records
+// of the zone that signed them. Validation stops at the zone; the chain of
+// trust to the root isn't checked.
+type validator struct {
+	exchange func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	pinned   *dns.DNSKEY // a key that must have signed the zone's DNSKEY records, if any
+	now      time.Time
+}
+
+// newValidator creates a validator that fetches DNSKEY records with exchange.
+// If pinned is set, it must be a DNSKEY record in zone file format.
+func newValidator(exchange func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error), pinned string) (*validator, error) {
+	v := &validator{exchange: exchange, now: time.Now()}
+	if pinned != "" {
+		rr, err := dns.NewRR(pinned)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pinned DNSKEY: %s", err)
+		}
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, fmt.Errorf("pinned key is a %s record, not a DNSKEY record", dns.TypeToString[rr.Header().Rrtype])
+		}
+		v.pinned = key
+	}
+	return v, nil
+}
+
+// validate checks the signatures over the answers of a type in a response,
+// and returns the DNSSEC state of the answers. An error describes why the
+// answers aren't secure.
+func (v *validator) validate(ctx context.Context, in *dns.Msg, recordType uint16) (string, error) {
+	rrset, sigs := signedSet(in.Answer, recordType)
+	if len(sigs) == 0 {
+		return insecure, fmt.Errorf("no RRSIG records were returned for the %s records", dns.TypeToString[recordType])
+	}
+
+	// Every signature over the RRset is made by the same zone
+	keys, err := v.zoneKeys(ctx, sigs[0].SignerName)
+	if err != nil {
+		return bogus, err
+	}
+	err = v.verify(rrset, sigs, keys)
+	if err != nil {
+		return bogus, fmt.Errorf("invalid signature over the %s records: %s", dns.TypeToString[recordType], err)
+	}
+	return secure, nil
+}
+
+// zoneKeys fetches the DNSKEY records of a zone, and checks that they are
+// signed by one of themselves, or by the pinned key if there is one.
+func (v *validator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	var msg dns.Msg
+	msg.SetQuestion(zone, dns.TypeDNSKEY)
+	msg.SetEdns0(4096, true)
+	in, err := v.exchange(ctx, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch DNSKEY records for %s: %s", zone, err)
+	}
+
+	rrset, sigs := signedSet(in.Answer, dns.TypeDNSKEY)
+	keys := make([]*dns.DNSKEY, 0, len(rrset))
+	for _, rr := range rrset {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no DNSKEY records were returned for %s", zone)
+	}
+
+	trusted := keys
+	if v.pinned != nil {
+		trusted = []*dns.DNSKEY{v.pinned}
+	}
+	err = v.verify(rrset, sigs, trusted)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature over the DNSKEY records for %s: %s", zone, err)
+	}
+	return keys, nil
+}
+
+// verify checks that at least one of the signatures over an RRset is valid
+// and was made by one of the keys.
+func (v *validator) verify(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	err := fmt.Errorf("no signature was made by a known key")
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm {
+				continue
+			}
+			if !sig.ValidityPeriod(v.now) {
+				err = fmt.Errorf("signature by key %d has expired or is not valid yet", sig.KeyTag)
+				continue
+			}
+			err = sig.Verify(key, rrset)
+			if err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// signedSet splits the records of a type in a section of a response from the
+// signatures over them.
+func signedSet(section []dns.RR, recordType uint16) ([]dns.RR, []*dns.RRSIG) {
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == recordType {
+			sigs = append(sigs, sig)
+		} else if rr.Header().Rrtype == recordType {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset, sigs
+}
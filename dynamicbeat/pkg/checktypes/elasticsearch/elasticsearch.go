@@ -0,0 +1,237 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// The Definition configures the behavior of the Elasticsearch check
+// it implements the "check" interface
+type Definition struct {
+	Config    check.Config // generic metadata about the check
+	Host      string       `optiontype:"required"`                        // IP or hostname of an Elasticsearch node
+	Port      string       `optiontype:"optional" optiondefault:"9200"`   // Port of the REST API
+	TLS       string       `optiontype:"optional" optiondefault:"true"`   // Whether to connect with HTTPS
+	Verify    string       `optiontype:"optional"`                        // Whether the server's certificate should be validated
+	CA        string       `optiontype:"optional"`                        // PEM CA certificates to trust instead of the system pool
+	Username  string       `optiontype:"optional"`                        // User to log in as with basic auth
+	Password  string       `optiontype:"optional"`                        // Password for the user
+	APIKey    string       `optiontype:"optional"`                        // Base64-encoded API key to use instead of basic auth
+	MinHealth string       `optiontype:"optional" optiondefault:"yellow"` // The worst cluster health that passes: green, yellow, or red
+	Index     string       `optiontype:"optional"`                        // Index pattern to search; no search is run if it isn't set
+	Query     string       `optiontype:"optional"`                        // JSON query DSL for the search; all documents are matched if it isn't set
+	MinHits   int          `optiontype:"optional" optiondefault:"1"`      // The fewest documents that the search must match
+}
+
+// healths ranks the cluster health statuses from worst to best.
+var healths = map[string]int{
+	"red":    0,
+	"yellow": 1,
+	"green":  2,
+}
+
+// maxResponse is the largest response body that is read.
+const maxResponse = 1 << 20
+
+// apiError is the error that Elasticsearch returns in the body of a failed
+// request.
+type apiError struct {
+	Error struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	minHealth, ok := healths[strings.ToLower(d.MinHealth)]
+	if !ok {
+		result.Message = fmt.Sprintf("Unknown health %s - must be green, yellow, or red", d.MinHealth)
+		return result
+	}
+	var search []byte
+	if d.Index != "" {
+		query := json.RawMessage(`{"match_all":{}}`)
+		if d.Query != "" {
+			if !json.Valid([]byte(d.Query)) {
+				result.Message = fmt.Sprintf("Query %s is not valid JSON", d.Query)
+				return result
+			}
+			query = json.RawMessage(d.Query)
+		}
+		var err error
+		search, err = json.Marshal(map[string]interface{}{
+			"query": query,
+			"size":  0,
+		})
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to encode search : %s", err)
+			return result
+		}
+	}
+
+	scheme := "http"
+	var dialer check.Dialer
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	if useTLS, _ := strconv.ParseBool(d.TLS); useTLS {
+		verify, _ := strconv.ParseBool(d.Verify)
+		config, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to create TLS config : %s", err)
+			return result
+		}
+		scheme = "https"
+		transport.TLSClientConfig = config
+	}
+	// Connections aren't kept around between rounds
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	base := url.URL{Scheme: scheme, Host: net.JoinHostPort(d.Host, d.Port)}
+
+	// Check the health of the cluster
+	var health struct {
+		ClusterName   string `json:"cluster_name"`
+		Status        string `json:"status"`
+		NumberOfNodes int    `json:"number_of_nodes"`
+	}
+	message := d.request(ctx, client, base, http.MethodGet, "/_cluster/health", nil, &health)
+	if message != "" {
+		result.Message = message
+		return result
+	}
+	result.Details = map[string]string{
+		"cluster_name": health.ClusterName,
+		"status":       health.Status,
+		"nodes":        strconv.Itoa(health.NumberOfNodes),
+	}
+	status, ok := healths[health.Status]
+	if !ok {
+		result.Message = fmt.Sprintf("Cluster at %s reported unknown health %s", d.Host, health.Status)
+		return result
+	}
+	if status < minHealth {
+		result.Message = fmt.Sprintf("Cluster health is %s, but must be at least %s", health.Status, strings.ToLower(d.MinHealth))
+		return result
+	}
+
+	if d.Index != "" {
+		var response struct {
+			Hits struct {
+				Total json.RawMessage `json:"total"`
+			} `json:"hits"`
+		}
+		message := d.request(ctx, client, base, http.MethodPost, "/"+d.Index+"/_search", search, &response)
+		if message != "" {
+			result.Message = message
+			return result
+		}
+		hits, err := total(response.Hits.Total)
+		if err != nil {
+			result.Message = fmt.Sprintf("Search of %s returned an unexpected response : %s", d.Index, err)
+			return result
+		}
+		result.Details["hits"] = strconv.Itoa(hits)
+		if hits < d.MinHits {
+			result.Message = fmt.Sprintf("Search of %s matched %d documents, but expected at least %d", d.Index, hits, d.MinHits)
+			return result
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// request sends a request to the REST API and decodes the JSON response into
+// out. It returns why the request failed, or an empty string if it worked.
+func (d *Definition) request(ctx context.Context, client *http.Client, base url.URL, method string, path string, body []byte, out interface{}) string {
+	target := base
+	target.Path = path
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Sprintf("Failed to create request : %s", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if d.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+d.APIKey)
+	} else if d.Username != "" {
+		req.SetBasicAuth(d.Username, d.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return fmt.Sprintf("Failed to read response from %s : %s", d.Host, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		reason := resp.Status
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Reason != "" {
+			reason = apiErr.Error.Reason
+		}
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			return fmt.Sprintf("Login to %s failed : %s", d.Host, reason)
+		case resp.StatusCode == http.StatusForbidden:
+			return fmt.Sprintf("User is not allowed to %s %s : %s", method, path, reason)
+		case apiErr.Error.Type == "index_not_found_exception":
+			return fmt.Sprintf("Index %s does not exist", d.Index)
+		default:
+			return fmt.Sprintf("Request for %s failed : %s", path, reason)
+		}
+	}
+
+	err = json.Unmarshal(data, out)
+	if err != nil {
+		return fmt.Sprintf("Failed to decode response for %s : %s", path, err)
+	}
+	return ""
+}
+
+// total reads the total number of hits of a search. Versions before 7.0
+// return the total as a number instead of an object.
+func total(raw json.RawMessage) (int, error) {
+	var hits int
+	if json.Unmarshal(raw, &hits) == nil {
+		return hits, nil
+	}
+	var object struct {
+		Value int `json:"value"`
+	}
+	err := json.Unmarshal(raw, &object)
+	return object.Value, err
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
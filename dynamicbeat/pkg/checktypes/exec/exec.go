@@ -0,0 +1,221 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// The Definition configures the behavior of the exec check
+// it implements the "check" interface
+type Definition struct {
+	Config         check.Config      // generic metadata about the check
+	Command        string            `optiontype:"required"` // The command to run, which must be allowed in the Dynamicbeat config
+	Args           []string          `optiontype:"optional"` // Arguments to pass to the command, without a shell
+	Env            map[string]string `optiontype:"optional"` // Environment variables to run the command with
+	WorkingDir     string            `optiontype:"optional"` // The directory to run the command in; defaults to the temporary directory
+	ExpectedOutput string            `optiontype:"optional"` // A regex that the command's stdout must match
+	Timeout        string            `optiontype:"optional"` // How long the command can run for; defaults to the check's timeout
+}
+
+// maxOutput is the most output that is kept from each of stdout and stderr.
+const maxOutput = 64 << 10
+
+// allowed are the real paths of the commands that exec checks are allowed to
+// run.
+var allowed = map[string]bool{}
+
+// Allow sets the commands that exec checks are allowed to run. Each command
+// must be an absolute path. Symlinks are resolved, so that a check can't run
+// anything else by pointing a symlink at it.
+func Allow(commands []string) error {
+	resolved := make(map[string]bool, len(commands))
+	for _, c := range commands {
+		if !filepath.IsAbs(c) {
+			return fmt.Errorf("exec.allowed_commands entry %s must be an absolute path", c)
+		}
+		path, err := filepath.EvalSymlinks(c)
+		if err != nil {
+			zap.S().Warnf("Allowed exec command %s can't be found, so it can't be run: %s", c, err)
+			continue
+		}
+		resolved[path] = true
+	}
+	allowed = resolved
+	return nil
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	path, err := resolve(d.Command)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+
+	var regex *regexp.Regexp
+	if d.ExpectedOutput != "" {
+		regex, err = regexp.Compile(d.ExpectedOutput)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ExpectedOutput, err)
+			return result
+		}
+	}
+
+	if d.Timeout != "" {
+		timeout, err := time.ParseDuration(d.Timeout)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error parsing timeout %s : %s", d.Timeout, err)
+			return result
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	dir := d.WorkingDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		result.Message = fmt.Sprintf("Working directory %s does not exist", dir)
+		return result
+	}
+
+	// The command doesn't inherit Dynamicbeat's environment, which can have
+	// the Elasticsearch credentials in it
+	env := make([]string, 0, len(d.Env))
+	for k, v := range d.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+
+	cmd := exec.Command(path, d.Args...)
+	cmd.Args[0] = d.Command
+	cmd.Dir = dir
+	cmd.Env = env
+	stdout := &util.LimitedBuffer{Max: maxOutput}
+	stderr := &util.LimitedBuffer{Max: maxOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+
+	exitCode, err := run(ctx, cmd)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		result.Message = fmt.Sprintf("Command %s did not finish in time, so it was killed", d.Command)
+		return result
+	}
+	if err != nil {
+		result.Message = fmt.Sprintf("Error executing command %s : %s", d.Command, err)
+		return result
+	}
+	result.Details = map[string]string{
+		"exit_code": strconv.Itoa(exitCode),
+		"stdout":    stdout.String(),
+		"stderr":    stderr.String(),
+	}
+
+	if exitCode != 0 {
+		result.Message = fmt.Sprintf("Command %s exited with status %d", d.Command, exitCode)
+		return result
+	}
+
+	if regex != nil && !regex.Match(stdout.Bytes()) {
+		result.Message = "Matching content not found"
+		return result
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// resolve finds the real path of a command, and makes sure that it's allowed.
+// Check definitions can be changed by anyone who can write to the checkdef
+// index, so only the commands that whoever runs Dynamicbeat allowed can be
+// run, and the reason is given in the errors.
+func resolve(command string) (string, error) {
+	if len(allowed) == 0 {
+		return "", check.ConfigError{Err: errors.New("exec checks are disabled, since exec.allowed_commands in the Dynamicbeat config is empty - commands must be allowed there so that check definitions can't run arbitrary commands on the Dynamicbeat host")}
+	}
+
+	path := command
+	if !strings.ContainsRune(command, filepath.Separator) && !strings.ContainsRune(command, '/') {
+		var err error
+		path, err = exec.LookPath(command)
+		if err != nil {
+			return "", check.ConfigError{Err: fmt.Errorf("command %s can't be found : %s", command, err)}
+		}
+	}
+	if !filepath.IsAbs(path) {
+		return "", check.ConfigError{Err: fmt.Errorf("command %s must be an absolute path or the name of a command in Dynamicbeat's PATH", command)}
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", check.ConfigError{Err: fmt.Errorf("command %s can't be found : %s", command, err)}
+	}
+	if !allowed[resolved] {
+		return "", check.ConfigError{Err: fmt.Errorf("command %s (%s) is not in exec.allowed_commands in the Dynamicbeat config - only allowed commands are run, so that check definitions can't run arbitrary commands on the Dynamicbeat host", command, resolved)}
+	}
+	return resolved, nil
+}
+
+// run starts a command and waits for it to exit, or kills it and everything
+// that it started once the context is done. The exit code is returned if the
+// command exited on its own.
+func run(ctx context.Context, cmd *exec.Cmd) (int, error) {
+	err := cmd.Start()
+	if err != nil {
+		return 0, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		// Give up on the output if a process that escaped the group still
+		// holds stdout or stderr open
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		return 0, ctx.Err()
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package exec
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// setProcessGroup does nothing, since the processes that the command starts
+// are found through their parents instead.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command and every process that it started, with
+// taskkill. The command is killed directly if taskkill fails.
+func killProcessGroup(cmd *exec.Cmd) {
+	err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	if err != nil {
+		_ = cmd.Process.Kill()
+	}
+}
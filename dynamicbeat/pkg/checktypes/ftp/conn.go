@@ -0,0 +1,309 @@
+package ftp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// conn is a small FTP client for the operations that the check needs. Unlike
+// the FTP library, it supports active data connections, where the server
+// connects back to Dynamicbeat.
+type conn struct {
+	ctx      context.Context // the context of the check, which data connections are dialed with
+	cancel   context.CancelFunc
+	raw      net.Conn
+	text     *textproto.Conn
+	host     string      // the host of the server, which passive data connections are opened to
+	tls      *tls.Config // set once the control connection is protected with TLS
+	active   bool
+	deadline time.Time
+}
+
+// dial connects to an FTP server and reads its greeting. Every operation on
+// the connection must finish before the deadline of the context.
+func dial(ctx context.Context, addr string, active bool) (*conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if active && check.HasTunnel(ctx) {
+		// The server can't connect back to Dynamicbeat through the jump host
+		return nil, check.ConfigError{Err: errors.New("active data connections can't be made through a jump host")}
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(20 * time.Second)
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+
+	var dialer check.Dialer
+	raw, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c := &conn{ctx: ctx, cancel: cancel, raw: raw, text: textproto.NewConn(raw), host: host, active: active, deadline: deadline}
+	_ = raw.SetDeadline(deadline)
+
+	_, _, err = c.text.ReadResponse(220)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmd sends a command, and returns an error if the response code doesn't
+// start with expect.
+func (c *conn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	err := c.text.PrintfLine(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	return c.text.ReadResponse(expect)
+}
+
+// authTLS upgrades the control connection to TLS with AUTH TLS, and makes
+// data connections use TLS too.
+func (c *conn) authTLS(config *tls.Config) error {
+	_, _, err := c.cmd(234, "AUTH TLS")
+	if err != nil {
+		return err
+	}
+
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = c.host
+	}
+	// Many servers require data connections to resume the TLS session of the
+	// control connection
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	t := tls.Client(c.raw, config)
+	err = t.Handshake()
+	if err != nil {
+		return err
+	}
+	c.raw = t
+	c.text = textproto.NewConn(t)
+	c.tls = config
+
+	_, _, err = c.cmd(200, "PBSZ 0")
+	if err != nil {
+		return err
+	}
+	_, _, err = c.cmd(200, "PROT P")
+	return err
+}
+
+// login authenticates with a username and password, and switches to binary
+// transfers.
+func (c *conn) login(user string, password string) error {
+	code, msg, err := c.cmd(0, "USER %s", user)
+	switch {
+	case err != nil:
+		return err
+	case code == 331:
+		_, _, err = c.cmd(2, "PASS %s", password)
+		if err != nil {
+			return err
+		}
+	case code != 230:
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+
+	_, _, err = c.cmd(200, "TYPE I")
+	return err
+}
+
+// changeDir changes the working directory.
+func (c *conn) changeDir(path string) error {
+	_, _, err := c.cmd(250, "CWD %s", path)
+	return err
+}
+
+// currentDir returns the working directory.
+func (c *conn) currentDir() (string, error) {
+	_, msg, err := c.cmd(257, "PWD")
+	if err != nil {
+		return "", err
+	}
+	start := strings.Index(msg, "\"")
+	end := strings.LastIndex(msg, "\"")
+	if start == -1 || start == end {
+		return "", fmt.Errorf("unexpected PWD response: %s", msg)
+	}
+	return msg[start+1 : end], nil
+}
+
+// retr downloads a file into w.
+func (c *conn) retr(path string, w io.Writer) error {
+	return c.transfer(fmt.Sprintf("RETR %s", path), func(data net.Conn) error {
+		_, err := io.Copy(w, data)
+		return err
+	})
+}
+
+// stor uploads the contents of r to a file.
+func (c *conn) stor(path string, r io.Reader) error {
+	return c.transfer(fmt.Sprintf("STOR %s", path), func(data net.Conn) error {
+		_, err := io.Copy(data, r)
+		return err
+	})
+}
+
+// dele deletes a file.
+func (c *conn) dele(path string) error {
+	_, _, err := c.cmd(250, "DELE %s", path)
+	return err
+}
+
+// quit ends the session and closes the connection. The response isn't
+// waited for, since the check is already done.
+func (c *conn) quit() error {
+	err := c.text.PrintfLine("QUIT")
+	if cerr := c.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *conn) close() error {
+	c.cancel()
+	return c.raw.Close()
+}
+
+// transfer sends a command that transfers data, calls f with the data
+// connection, and waits for the server to confirm the transfer.
+func (c *conn) transfer(command string, f func(data net.Conn) error) error {
+	var data net.Conn
+	var err error
+	if c.active {
+		data, err = c.activeData(command)
+	} else {
+		data, err = c.passiveData(command)
+	}
+	if err != nil {
+		return err
+	}
+	if c.tls != nil {
+		data = tls.Client(data, c.tls)
+	}
+	_ = data.SetDeadline(c.deadline)
+
+	err = f(data)
+	if cerr := data.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	_, _, err = c.text.ReadResponse(2)
+	return err
+}
+
+// passiveData opens a passive data connection and sends the command. The
+// port from the response to EPSV, or PASV for servers that don't support it,
+// is connected to on the host of the control connection, so that servers
+// behind NAT work.
+func (c *conn) passiveData(command string) (net.Conn, error) {
+	port, err := c.epsv()
+	if err != nil {
+		port, err = c.pasv()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer check.Dialer
+	data, err := dialer.DialContext(c.ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data connection: %s", err)
+	}
+	_, _, err = c.cmd(1, command)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// epsv requests an extended passive data connection, and returns its port.
+func (c *conn) epsv() (int, error) {
+	_, msg, err := c.cmd(229, "EPSV")
+	if err != nil {
+		return 0, err
+	}
+	start := strings.Index(msg, "(|||")
+	end := strings.LastIndex(msg, "|)")
+	if start == -1 || end < start {
+		return 0, fmt.Errorf("unexpected EPSV response: %s", msg)
+	}
+	return strconv.Atoi(msg[start+4 : end])
+}
+
+// pasv requests a passive data connection, and returns its port. The address
+// in the response is ignored.
+func (c *conn) pasv() (int, error) {
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start == -1 || end < start {
+		return 0, fmt.Errorf("unexpected PASV response: %s", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("unexpected PASV response: %s", msg)
+	}
+	high, err1 := strconv.Atoi(fields[4])
+	low, err2 := strconv.Atoi(fields[5])
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("unexpected PASV response: %s", msg)
+	}
+	return high<<8 | low, nil
+}
+
+// activeData listens for an active data connection on the local address of
+// the control connection, sends the command, and waits for the server to
+// connect.
+func (c *conn) activeData(command string) (net.Conn, error) {
+	local := c.raw.LocalAddr().(*net.TCPAddr)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for data connection: %s", err)
+	}
+	defer listener.Close()
+	_ = listener.SetDeadline(c.deadline)
+
+	addr := listener.Addr().(*net.TCPAddr)
+	if ip := addr.IP.To4(); ip != nil {
+		_, _, err = c.cmd(200, "PORT %d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], addr.Port>>8, addr.Port&0xff)
+	} else {
+		_, _, err = c.cmd(200, "EPRT |2|%s|%d|", addr.IP, addr.Port)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = c.cmd(1, command)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := listener.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("server did not open data connection: %s", err)
+	}
+	return data, nil
+}
@@ -1,16 +1,19 @@
 package ftp
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"path"
 	"regexp"
 	"strconv"
 	"time"
 
-	"github.com/jlaffaye/ftp"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/sha3"
 )
@@ -19,15 +22,20 @@ import (
 // it implements the "check" interface
 type Definition struct {
 	Config           check.Config // generic metadata about the check
-	Host             string       `optiontype:"required"`                    // IP or hostname of the host to run the FTP check against
-	Username         string       `optiontype:"required"`                    // The user to login with over FTP
-	Password         string       `optiontype:"required"`                    // The password for the user that you wish to login with
-	File             string       `optiontype:"required"`                    // The path to the file to access during the FTP check
-	ContentRegex     string       `optiontype:"optional" optiondefault:".*"` // Regex to match if reading a file
-	HashContentMatch string       `optiontype:"optional"`                    // Whether or not to match a hash of the file contents
-	Hash             string       `optiontype:"optional"`                    // The hash digest from sha3-256 to compare the hashed file contents to
-	Port             string       `optiontype:"optional" optiondefault:"21"` // The port to attempt an ftp connection on
-	Simple           string       `optiontype:"optional"`                    // Very simple FTP check for older servers
+	Host             string       `optiontype:"required"`                          // IP or hostname of the host to run the FTP check against
+	Username         string       `optiontype:"required"`                          // The user to login with over FTP
+	Password         string       `optiontype:"required"`                          // The password for the user that you wish to login with
+	File             string       `optiontype:"required"`                          // The path to the file to access during the FTP check
+	ContentRegex     string       `optiontype:"optional" optiondefault:".*"`       // Regex to match if reading a file
+	HashContentMatch string       `optiontype:"optional"`                          // Whether or not to match a hash of the file contents
+	Hash             string       `optiontype:"optional"`                          // The hash digest from sha3-256 to compare the hashed file contents to
+	Port             string       `optiontype:"optional" optiondefault:"21"`       // The port to attempt an ftp connection on
+	Simple           string       `optiontype:"optional"`                          // Very simple FTP check for older servers
+	Mode             string       `optiontype:"optional" optiondefault:"download"` // download to check the contents of File, or upload to write, read, and delete a file in the File directory
+	TLS              string       `optiontype:"optional"`                          // Whether to upgrade the connection to FTPS with AUTH TLS
+	Verify           string       `optiontype:"optional"`                          // Whether the FTPS certificate should be validated
+	CA               string       `optiontype:"optional"`                          // PEM CA certificates to trust instead of the system pool
+	Active           string       `optiontype:"optional"`                          // Whether to use active data connections instead of passive ones
 }
 
 // Run a single instance of the check
@@ -35,22 +43,46 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
+	if d.Mode != "download" && d.Mode != "upload" {
+		result.Message = fmt.Sprintf("Unknown mode %s - must be download or upload", d.Mode)
+		return result
+	}
+
+	// The check's timeout applies to the whole session
+	deadctx, cancel := context.WithTimeout(ctx, check.TimeLeft(ctx, 20*time.Second))
+	defer cancel()
+
 	// Connect to the ftp server
-	// TODO: create child context with deadline less than the parent context
-	conn, err := ftp.Dial(fmt.Sprintf("%s:%s", d.Host, d.Port), ftp.DialWithContext(ctx))
+	active, _ := strconv.ParseBool(d.Active)
+	conn, err := dial(deadctx, net.JoinHostPort(d.Host, d.Port), active)
 	if err != nil {
 		result.Message = fmt.Sprintf("Connection to %s on port %s failed : %s", d.Host, d.Port, err)
 		return result
 	}
 	defer func() {
-		err := conn.Quit()
+		err := conn.quit()
 		if err != nil {
 			zap.S().Warnf("Failed to close FTP connection: %s", err)
 		}
 	}()
 
+	// Upgrade to FTPS before sending the password
+	if useTLS, _ := strconv.ParseBool(d.TLS); useTLS {
+		verify, _ := strconv.ParseBool(d.Verify)
+		config, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+		if err != nil {
+			result.Message = fmt.Sprintf("Error configuring TLS : %s", err)
+			return result
+		}
+		err = conn.authTLS(config)
+		if err != nil {
+			result.Message = fmt.Sprintf("TLS negotiation with %s failed : %s", d.Host, err)
+			return result
+		}
+	}
+
 	// Login
-	err = conn.Login(d.Username, d.Password)
+	err = conn.login(d.Username, d.Password)
 	if err != nil {
 		result.Message = fmt.Sprintf("Login attempt with user %s failed : %s", d.Username, err)
 		return result
@@ -59,14 +91,13 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// ***********************************************
 	if simple, _ := strconv.ParseBool(d.Simple); simple {
 		// Do a simple FTP check for servers that don't support a lot of FTP commands
-		err = conn.ChangeDir(d.File)
+		err = conn.changeDir(d.File)
 		if err != nil {
 			result.Message = fmt.Sprintf("Changing to directory %s failed : %s", d.File, err)
 			return result
 		}
 
-		_, err := conn.CurrentDir()
-		// entries, err := conn.List("/")
+		_, err := conn.currentDir()
 		if err != nil {
 			result.Message = fmt.Sprintf("Getting current directory %s failed : %s", d.File, err)
 			return result
@@ -78,19 +109,18 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	}
 	// **************
 
-	// Retrieve file contents
-	resp, err := conn.Retr(d.File)
-	if err != nil {
-		result.Message = fmt.Sprintf("Could not retrieve file %s : %s", d.File, err)
-		return result
+	if d.Mode == "upload" {
+		return d.upload(conn, result)
 	}
-	defer resp.Close()
 
-	content, err := ioutil.ReadAll(resp)
+	// Retrieve file contents
+	var buf bytes.Buffer
+	err = conn.retr(d.File, &buf)
 	if err != nil {
-		result.Message = fmt.Sprintf("Could not read file %s contents : %s", d.File, err)
+		result.Message = fmt.Sprintf("Could not retrieve file %s : %s", d.File, err)
 		return result
 	}
+	content := buf.Bytes()
 
 	// Check if we are doing hash matching, non default
 	if matchHash, _ := strconv.ParseBool(d.HashContentMatch); matchHash {
@@ -126,6 +156,47 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	return result
 }
 
+// upload writes a file with random contents to the File directory, reads it
+// back, and deletes it.
+func (d *Definition) upload(conn *conn, result check.Result) check.Result {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error generating file contents : %s", err)
+		return result
+	}
+	content := []byte(hex.EncodeToString(buf))
+	name := path.Join(d.File, fmt.Sprintf(".scorestack-%x", buf[:4]))
+
+	err = conn.stor(name, bytes.NewReader(content))
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not upload file %s : %s", name, err)
+		return result
+	}
+
+	var read bytes.Buffer
+	err = conn.retr(name, &read)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not retrieve uploaded file %s : %s", name, err)
+		return result
+	}
+
+	// Always try to clean up, but report a mismatch before a failed delete
+	delErr := conn.dele(name)
+	if !bytes.Equal(read.Bytes(), content) {
+		result.Message = fmt.Sprintf("Uploaded file %s did not contain what was written to it", name)
+		return result
+	}
+	if delErr != nil {
+		result.Message = fmt.Sprintf("Could not delete uploaded file %s : %s", name, delErr)
+		return result
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
 // GetConfig returns the current CheckConfig struct this check has been
 // configured with.
 func (d *Definition) GetConfig() check.Config {
@@ -2,35 +2,48 @@ package git
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 )
 
 // The Definition configures the behavior of the Git check and implements the "check" interface.
 type Definition struct {
-	Config          check.Config // Generic metadata about the check
-	Host            string       `optiontype:"required"`                    // IIP or FQDN the remote repository is located
-	Repository      string       `optiontype:"required"`                    // The path to the remote repository
-	Branch          string       `optiontype:"required"`                    // The branch to clone from the repository
-	Port            int          `optiontype:"optional"`                    // The port to connect to for cloning the repository
-	HTTPS           bool         `optiontype:"optional"`                    // Whether to use HTTP or HTTPS
-	HttpsValidate   bool         `optiontype:"optional"`                    // Whether HTTPS certificates should be validated
-	Username        string       `optiontype:"optional"`                    // Username to use for private repositories
-	Password        string       `optiontype:"optional"`                    // Password for the user
-	ContentMatch    bool         `optiontype:"optional"`                    // Whether to check the contents of a file
-	ContentFile     string       `optiontype:"optional"`                    // The path of the file to check the contents of
-	ContentRegex    string       `optiontype:"optional" optiondefault:".*"` // The regex to match against the checked file
-	CommitHashMatch bool         `optiontype:"optional"`                    // Whether or not to match the hash of the latest commit
-	CommitHash      string       `optiontype:"optional"`                    // The hash to check against the latest commit
+	Config             check.Config // Generic metadata about the check
+	Host               string       `optiontype:"required"`                      // IIP or FQDN the remote repository is located
+	Repository         string       `optiontype:"required"`                      // The path to the remote repository
+	Branch             string       `optiontype:"required"`                      // The branch to clone from the repository
+	Port               int          `optiontype:"optional"`                      // The port to connect to for cloning the repository
+	HTTPS              bool         `optiontype:"optional"`                      // Whether to use HTTP or HTTPS
+	HttpsValidate      bool         `optiontype:"optional"`                      // Whether HTTPS certificates should be validated
+	Username           string       `optiontype:"optional"`                      // Username to use for private repositories
+	Password           string       `optiontype:"optional"`                      // Password for the user
+	ContentMatch       bool         `optiontype:"optional"`                      // Whether to check the contents of a file
+	ContentFile        string       `optiontype:"optional"`                      // The path of the file to check the contents of
+	ContentRegex       string       `optiontype:"optional" optiondefault:".*"`   // The regex to match against the checked file
+	CommitHashMatch    bool         `optiontype:"optional"`                      // Whether or not to match the hash of the latest commit
+	CommitHash         string       `optiontype:"optional"`                      // The hash to check against the latest commit
+	Transport          string       `optiontype:"optional" optiondefault:"http"` // http to use smart HTTP, or ssh
+	PrivateKey         string       `optiontype:"optional"`                      // PEM or OpenSSH private key to login with over ssh
+	KeyPassphrase      string       `optiontype:"optional"`                      // The passphrase of PrivateKey, if it is encrypted
+	HostKeyFingerprint string       `optiontype:"optional"`                      // The SHA256 fingerprint that the ssh host key must have
+	KnownHosts         string       `optiontype:"optional"`                      // known_hosts lines, one of which must have the ssh host key
+	MaxCommitAge       string       `optiontype:"optional"`                      // How old the latest commit can be, like 24h
+	CommitMessageRegex string       `optiontype:"optional"`                      // The regex to match against the latest commit's message
 }
 
 // Run a single instance of the check.
@@ -38,24 +51,72 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialilze empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
-	// Fail the check if an invalid method is attempted
-	var protocol string
-	switch d.HTTPS {
-	case true:
-		protocol = "https"
-	case false:
-		protocol = "http"
+	// Parse the commit checks before connecting to anything
+	var maxAge time.Duration
+	var err error
+	if d.MaxCommitAge != "" {
+		maxAge, err = time.ParseDuration(d.MaxCommitAge)
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to parse max commit age '%s': %s", d.MaxCommitAge, err)
+			return result
+		}
+	}
+	var messageRegex *regexp.Regexp
+	if d.CommitMessageRegex != "" {
+		messageRegex, err = regexp.Compile(d.CommitMessageRegex)
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to compile regex '%s': %s", d.CommitMessageRegex, err)
+			return result
+		}
+	}
+
+	// Craft the repository url and credentials for the configured transport
+	repoUrl, auth, err := d.endpoint()
+	if err != nil {
+		result.Message = fmt.Sprintf("Error configuring authentication: %s", err)
+		return result
+	}
+
+	// List the remote's references first, which is cheap and tells the
+	// different reasons the repository can't be used apart
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{repoUrl},
+	})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{
+		Auth:            auth,
+		InsecureSkipTLS: !d.HttpsValidate,
+	})
+	if err != nil {
+		result.Message = d.listError(err)
+		return result
 	}
 
-	// Craft the repository url for git.Clone
-	// Using the implementation provided by go-git as it's probably better than anything I can come up with
-	repoUrl := transport.Endpoint{
-		Protocol: protocol,
-		Host:     d.Host,
-		Port:     d.Port,
-		User:     d.Username,
-		Password: d.Password,
-		Path:     d.Repository,
+	// Find the tip of the branch and record it
+	branch := plumbing.NewBranchReferenceName(d.Branch)
+	var tip *plumbing.Reference
+	for _, ref := range refs {
+		if ref.Name() == branch {
+			tip = ref
+		}
+	}
+	if tip == nil {
+		result.Message = fmt.Sprintf("Branch %s does not exist in the repository", d.Branch)
+		return result
+	}
+	result.Details = map[string]string{"commit": tip.Hash().String()}
+
+	// Check the latest commit's hash
+	if d.CommitHashMatch && d.CommitHash != tip.Hash().String() {
+		result.Message = "Commit hash does not match"
+		return result
+	}
+
+	// The rest of the checks need the latest commit, so stop here if none
+	// of them are configured
+	if !d.ContentMatch && maxAge == 0 && messageRegex == nil {
+		result.Passed = true
+		return result
 	}
 
 	// Intialize memory storage for cloning
@@ -64,9 +125,10 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 
 	// Clone the Git repository into memory
 	// We only clone the latest commit from a single branch to minimize memory usage
-	repo, err := git.Clone(store, tree, &git.CloneOptions{
-		URL:             repoUrl.String(),
-		ReferenceName:   plumbing.NewBranchReferenceName(d.Branch),
+	repo, err := git.CloneContext(ctx, store, tree, &git.CloneOptions{
+		URL:             repoUrl,
+		Auth:            auth,
+		ReferenceName:   branch,
 		SingleBranch:    true,
 		Depth:           1,
 		InsecureSkipTLS: !d.HttpsValidate,
@@ -77,6 +139,34 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		return result
 	}
 
+	// Check the age and message of the latest commit if configured
+	if maxAge != 0 || messageRegex != nil {
+
+		// Get the latest commit
+		head, err := repo.Head()
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to get where HEAD is point to: %s", err)
+			return result
+		}
+		commit, err := repo.CommitObject(head.Hash())
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to read the latest commit: %s", err)
+			return result
+		}
+		result.Details["commit_time"] = commit.Committer.When.UTC().Format(time.RFC3339)
+
+		if maxAge != 0 && time.Since(commit.Committer.When) > maxAge {
+			result.Message = fmt.Sprintf("Latest commit is older than %s", d.MaxCommitAge)
+			return result
+		}
+		if messageRegex != nil && !messageRegex.MatchString(commit.Message) {
+			result.Message = "Commit message does not match"
+			return result
+		}
+
+		// This check has passed, contiune with any other configured checks
+	}
+
 	// Check the contents of the file if configured
 	if d.ContentMatch {
 
@@ -111,28 +201,84 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		// This check has passed, contiune with any other configured checks
 	}
 
-	// Check the latest commit's hash
-	if d.CommitHashMatch {
+	// If we reach here, all configured checks have passed
+	result.Passed = true
+	return result
+}
 
-		// Get the latest commit
-		head, err := repo.Head()
-		if err != nil {
-			result.Message = fmt.Sprintf("Failed to get where HEAD is point to: %s", err)
-			return result
+// endpoint returns the URL of the repository and the credentials to use
+// with it for the configured transport.
+func (d *Definition) endpoint() (string, transport.AuthMethod, error) {
+	switch d.Transport {
+	case "http":
+		// Use HTTPS if configured
+		protocol := "http"
+		if d.HTTPS {
+			protocol = "https"
 		}
 
-		// Compare the hashes
-		if d.CommitHash != head.Hash().String() {
-			result.Message = "Commit hash does not match"
-			return result
+		// Using the implementation provided by go-git as it's probably better than anything I can come up with
+		repoUrl := transport.Endpoint{
+			Protocol: protocol,
+			Host:     d.Host,
+			Port:     d.Port,
+			Path:     d.Repository,
 		}
-
-		// This check has passed, contiune with any other configured checks
+		if d.Username == "" && d.Password == "" {
+			return repoUrl.String(), nil, nil
+		}
+		return repoUrl.String(), &githttp.BasicAuth{Username: d.Username, Password: d.Password}, nil
+	case "ssh":
+		// Most git servers take every ssh login as the git user
+		user := d.Username
+		if user == "" {
+			user = "git"
+		}
+		repoUrl := transport.Endpoint{
+			Protocol: "ssh",
+			User:     user,
+			Host:     d.Host,
+			Port:     d.Port,
+			Path:     d.Repository,
+		}
+		hostKeyCallback, err := util.HostKeyCallback(d.HostKeyFingerprint, d.KnownHosts)
+		if err != nil {
+			return "", nil, err
+		}
+		helper := gitssh.HostKeyCallbackHelper{HostKeyCallback: hostKeyCallback}
+		switch {
+		case d.PrivateKey != "":
+			signer, err := util.ParsePrivateKey(d.PrivateKey, d.KeyPassphrase)
+			if err != nil {
+				return "", nil, err
+			}
+			return repoUrl.String(), &gitssh.PublicKeys{User: user, Signer: signer, HostKeyCallbackHelper: helper}, nil
+		case d.Password != "":
+			return repoUrl.String(), &gitssh.Password{User: user, Password: d.Password, HostKeyCallbackHelper: helper}, nil
+		default:
+			return "", nil, fmt.Errorf("a Password or PrivateKey must be set for the ssh transport")
+		}
+	default:
+		return "", nil, fmt.Errorf("unknown transport %s - must be http or ssh", d.Transport)
 	}
+}
 
-	// If we reach here, all configured checks have passed
-	result.Passed = true
-	return result
+// listError describes why the remote's references couldn't be listed.
+// Rejected credentials and missing repositories are told apart from other
+// failures.
+func (d *Definition) listError(err error) string {
+	switch {
+	case errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		strings.Contains(err.Error(), "unable to authenticate"):
+		return fmt.Sprintf("Login to %s failed: %s", d.Host, err)
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		return fmt.Sprintf("Repository %s does not exist on %s", d.Repository, d.Host)
+	case errors.Is(err, transport.ErrEmptyRemoteRepository):
+		return fmt.Sprintf("Repository %s is empty", d.Repository)
+	default:
+		return fmt.Sprintf("Failed to list the repository's references: %s", err)
+	}
 }
 
 // GetConfig returns the current CheckConfig struct
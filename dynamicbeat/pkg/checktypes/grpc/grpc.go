@@ -0,0 +1,200 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+// The Definition configures the behavior of the gRPC check
+// it implements the "check" interface
+type Definition struct {
+	Config    check.Config      // generic metadata about the check
+	Host      string            `optiontype:"required"`                        // IP or hostname of the gRPC server
+	Port      string            `optiontype:"required"`                        // Port of the gRPC server
+	TLS       string            `optiontype:"optional"`                        // Whether to connect with TLS
+	Verify    string            `optiontype:"optional"`                        // Whether the server's certificate should be validated
+	CA        string            `optiontype:"optional"`                        // PEM CA certificates to trust instead of the system pool
+	Operation string            `optiontype:"optional" optiondefault:"health"` // health or reflection
+	Service   string            `optiontype:"optional"`                        // Name of the service to check, like package.Service; the whole server is checked by health if it isn't set
+	Metadata  map[string]string `optiontype:"optional"`                        // Metadata to send with each RPC, like an authorization header
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	operation := strings.ToLower(d.Operation)
+	switch operation {
+	case "health":
+	case "reflection":
+		if d.Service == "" {
+			result.Message = "Service must be set for the reflection operation"
+			return result
+		}
+	default:
+		result.Message = fmt.Sprintf("Unknown operation %s - must be health or reflection", d.Operation)
+		return result
+	}
+
+	creds := insecure.NewCredentials()
+	if useTLS, _ := strconv.ParseBool(d.TLS); useTLS {
+		verify, _ := strconv.ParseBool(d.Verify)
+		config, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to create TLS config : %s", err)
+			return result
+		}
+		config.ServerName = d.Host
+		creds = credentials.NewTLS(config)
+	}
+
+	// gRPC doesn't pass the check's context to the dialer, so it is captured
+	// for the jump host
+	var dialer check.Dialer
+	dial := func(_ context.Context, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	// Wait for the connection, so that servers that are down fail here
+	// instead of in the RPC. Refused connections fail right away instead of
+	// being retried until the check times out.
+	conn, err := grpc.DialContext(ctx, net.JoinHostPort(d.Host, d.Port),
+		grpc.WithContextDialer(dial),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithBlock(),
+		grpc.WithReturnConnectionError(),
+		grpc.FailOnNonTempDialError(true),
+	)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer conn.Close()
+
+	if len(d.Metadata) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(d.Metadata))
+	}
+
+	switch operation {
+	case "health":
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: d.Service})
+		if err != nil {
+			result.Message = d.rpcError("health", err)
+			return result
+		}
+		result.Details = map[string]string{"status": resp.Status.String()}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			result.Message = fmt.Sprintf("%s is %s", d.name(), resp.Status)
+			return result
+		}
+	case "reflection":
+		services, err := d.listServices(ctx, conn)
+		if err != nil {
+			result.Message = d.rpcError("reflection", err)
+			return result
+		}
+		found := false
+		for _, service := range services {
+			if service == d.Service {
+				found = true
+			}
+		}
+		result.Details = map[string]string{"services": strings.Join(services, ",")}
+		if !found {
+			result.Message = fmt.Sprintf("Server at %s does not list service %s", d.Host, d.Service)
+			return result
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// listServices asks the reflection service for the names of the services
+// that the server has.
+func (d *Definition) listServices(ctx context.Context, conn *grpc.ClientConn) ([]string, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = stream.CloseSend()
+	}()
+	err = stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if errResp := resp.GetErrorResponse(); errResp != nil {
+		return nil, status.Error(codes.Code(errResp.ErrorCode), errResp.ErrorMessage)
+	}
+	list := resp.GetListServicesResponse()
+	if list == nil {
+		return nil, fmt.Errorf("server sent an unexpected reflection response")
+	}
+	services := make([]string, 0, len(list.Service))
+	for _, service := range list.Service {
+		services = append(services, service.Name)
+	}
+	return services, nil
+}
+
+// rpcError describes why an RPC to one of the standard services failed.
+func (d *Definition) rpcError(service string, err error) string {
+	s, _ := status.FromError(err)
+	switch s.Code() {
+	case codes.Unimplemented:
+		return fmt.Sprintf("Server at %s does not have the %s service", d.Host, service)
+	case codes.NotFound:
+		return fmt.Sprintf("Server at %s does not know service %s", d.Host, d.Service)
+	case codes.Unauthenticated:
+		return fmt.Sprintf("Login to %s failed : %s", d.Host, s.Message())
+	case codes.PermissionDenied:
+		return fmt.Sprintf("Not allowed to call the %s service on %s : %s", service, d.Host, s.Message())
+	case codes.DeadlineExceeded:
+		return fmt.Sprintf("The %s RPC to %s timed out", service, d.Host)
+	default:
+		return fmt.Sprintf("The %s RPC to %s failed : %s", service, d.Host, err)
+	}
+}
+
+// name names what the health RPC checks in messages.
+func (d *Definition) name() string {
+	if d.Service == "" {
+		return fmt.Sprintf("Server at %s", d.Host)
+	}
+	return fmt.Sprintf("Service %s", d.Service)
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
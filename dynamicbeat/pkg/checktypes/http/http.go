@@ -2,20 +2,29 @@ package http
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
 
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 	"go.uber.org/zap"
 )
 
@@ -24,23 +33,212 @@ type Definition struct {
 	Config               check.Config // generic metadata about the check
 	Verify               string       `optiontype:"optional"` // whether HTTPS certs should be validated
 	ReportMatchedContent string       `optiontype:"optional"` // whether the matched content should be returned in the CheckResult
+	ClientCert           string       `optiontype:"optional"` // PEM client certificate to present to the server
+	ClientKey            string       `optiontype:"optional"` // PEM private key of the client certificate
+	CA                   string       `optiontype:"optional"` // PEM CA certificates to trust instead of the system pool
+	ServerFingerprint    string       `optiontype:"optional"` // SHA-256 fingerprint that the server certificate must have
+	MaxResponseTime      string       `optiontype:"optional"` // the longest each response can take, like 5s
+	DNSTimeout           string       `optiontype:"optional"` // how long DNS lookups can take; lookups aren't counted in the response time if this is set
 	Requests             []*Request   `optiontype:"list"`     // a list of requests to make
 }
 
 // A Request represents a single HTTP request to make.
 type Request struct {
-	Host         string            `optiontype:"required"`                     // IP or FQDN of the HTTP server
-	Path         string            `optiontype:"required"`                     // Path to request - see RFC3986, section 3.3
-	HTTPS        bool              `optiontype:"optional"`                     // if HTTPS is to be used
-	Port         uint16            `optiontype:"optional" optiondefault:"80"`  // TCP port number the HTTP server is listening on
-	Method       string            `optiontype:"optional" optiondefault:"GET"` // HTTP method to use
-	Headers      map[string]string `optiontype:"optional"`                     // name-value pairs of header fields to add/override
-	Body         string            `optiontype:"optional"`                     // the request body
-	MatchCode    bool              `optiontype:"optional"`                     // whether the response code must match a defined value for the check to pass
-	Code         int               `optiontype:"optional" optiondefault:"200"` // the response status code to match
-	MatchContent bool              `optiontype:"optional"`                     // whether the response body must match a defined regex for the check to pass
-	ContentRegex string            `optiontype:"optional" optiondefault:".*"`  // regex for the response body to match
-	StoreValue   bool              `optiontype:"optional"`                     // whether the matched content should be saved for use in a later request
+	Host            string            `optiontype:"required"`                         // IP or FQDN of the HTTP server
+	Path            string            `optiontype:"required"`                         // Path to request - see RFC3986, section 3.3
+	HTTPS           bool              `optiontype:"optional"`                         // if HTTPS is to be used
+	Port            uint16            `optiontype:"optional" optiondefault:"80"`      // TCP port number the HTTP server is listening on
+	Method          string            `optiontype:"optional" optiondefault:"GET"`     // HTTP method to use
+	Headers         map[string]string `optiontype:"optional"`                         // name-value pairs of header fields to add/override
+	Body            string            `optiontype:"optional"`                         // the request body
+	Form            map[string]string `optiontype:"optional"`                         // form fields to send as the body instead of Body
+	Files           []*File           `optiontype:"list"`                             // files to upload in a multipart body along with Form
+	MatchCode       bool              `optiontype:"optional"`                         // whether the response code must match a defined value for the check to pass
+	Code            int               `optiontype:"optional" optiondefault:"200"`     // the response status code to match
+	MatchContent    bool              `optiontype:"optional"`                         // whether the response body must match a defined regex for the check to pass
+	ContentRegex    string            `optiontype:"optional" optiondefault:".*"`      // regex for the response body to match
+	StoreValue      bool              `optiontype:"optional"`                         // whether the matched content should be saved for use in a later request
+	Codes           []int             `optiontype:"optional"`                         // response status codes that pass the check; overrides Code and MatchCode
+	FollowRedirects string            `optiontype:"optional" optiondefault:"true"`    // whether redirects should be followed
+	MaxRedirects    int               `optiontype:"optional" optiondefault:"10"`      // the number of redirects to follow before failing
+	LocationRegex   string            `optiontype:"optional"`                         // regex for the Location header of the last response to match
+	Extract         []*Extractor      `optiontype:"list"`                             // values to save from the response for later requests
+	Matchers        []*Matcher        `optiontype:"list"`                             // extra conditions on the response that must all pass
+	MaxBodySize     int64             `optiontype:"optional" optiondefault:"1048576"` // the number of bytes of the response body to read for matching
+}
+
+// A File is uploaded in a multipart request body.
+type File struct {
+	Field    string `optiontype:"required"` // the name of the form field for the file
+	Filename string `optiontype:"required"` // the name of the uploaded file
+	Content  string `optiontype:"optional"` // the contents of the file
+}
+
+// maxRequestBody is the largest request body that a request can send.
+const maxRequestBody = 10 << 20
+
+// requestBody builds the body of a request and its Content-Type. Form fields
+// are URL-encoded, unless there are files, in which case the fields and files
+// are sent as a multipart body. Otherwise, Body is sent as-is with no
+// Content-Type.
+func requestBody(r Request) (string, string, error) {
+	if (len(r.Form) > 0 || len(r.Files) > 0) && r.Body != "" {
+		return "", "", fmt.Errorf("Body can't be used with Form or Files")
+	}
+
+	var body, contentType string
+	switch {
+	case len(r.Files) > 0:
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		names := make([]string, 0, len(r.Form))
+		for name := range r.Form {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			err := w.WriteField(name, r.Form[name])
+			if err != nil {
+				return "", "", fmt.Errorf("failed to add form field %s: %s", name, err)
+			}
+		}
+		for _, f := range r.Files {
+			part, err := w.CreateFormFile(f.Field, f.Filename)
+			if err == nil {
+				_, err = io.WriteString(part, f.Content)
+			}
+			if err != nil {
+				return "", "", fmt.Errorf("failed to add file %s: %s", f.Filename, err)
+			}
+		}
+		err := w.Close()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to build multipart body: %s", err)
+		}
+		body, contentType = buf.String(), w.FormDataContentType()
+	case len(r.Form) > 0:
+		values := make(url.Values, len(r.Form))
+		for name, value := range r.Form {
+			values.Set(name, value)
+		}
+		body, contentType = values.Encode(), "application/x-www-form-urlencoded"
+	default:
+		body = r.Body
+	}
+
+	if len(body) > maxRequestBody {
+		return "", "", fmt.Errorf("request body is %d bytes, but at most %d bytes can be sent", len(body), maxRequestBody)
+	}
+	return body, contentType, nil
+}
+
+// An Extractor saves a value from a response, so that later requests in the
+// same check can use it as {{.Name}}, like a CSRF token from a login page.
+type Extractor struct {
+	Name     string `optiontype:"required"` // the name that later requests use for the value
+	Regex    string `optiontype:"optional"` // regex to match; the first capture group is saved, or the whole match if there isn't one
+	JSONPath string `optiontype:"optional"` // dot-separated path to a value in a JSON body, like data.items.0.token
+	Header   string `optiontype:"optional"` // the response header to extract from instead of the body
+}
+
+// extract finds the value of the extractor in content.
+func (e *Extractor) extract(content []byte) (string, error) {
+	switch {
+	case e.JSONPath != "":
+		var doc interface{}
+		err := json.Unmarshal(content, &doc)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode response as JSON to extract %s: %s", e.Name, err)
+		}
+		return jsonPath(doc, e.JSONPath)
+	case e.Regex != "":
+		regex, err := regexp.Compile(e.Regex)
+		if err != nil {
+			return "", fmt.Errorf("Error compiling regex string %s : %s", e.Regex, err)
+		}
+		matches := regex.FindSubmatch(content)
+		if matches == nil {
+			return "", fmt.Errorf("failed to extract %s: no match for regex %s", e.Name, e.Regex)
+		}
+		if len(matches) > 1 {
+			return string(matches[1]), nil
+		}
+		return string(matches[0]), nil
+	default:
+		// Without a regex or path, the whole header or body is saved
+		return string(content), nil
+	}
+}
+
+// jsonPath finds the value at a dot-separated path in a decoded JSON document.
+// Strings are returned as-is, and other values are returned as JSON.
+func jsonPath(doc interface{}, path string) (string, error) {
+	v := doc
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return "", fmt.Errorf("JSON path %s not found: no field %s", path, key)
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("JSON path %s not found: no index %s", path, key)
+			}
+			v = node[i]
+		default:
+			return "", fmt.Errorf("JSON path %s not found: %s is not an object or array", path, key)
+		}
+	}
+
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode value at JSON path %s: %s", path, err)
+	}
+	return string(encoded), nil
+}
+
+// A Matcher is a condition on the response body, or on a response header, that
+// must pass for the check to pass.
+type Matcher struct {
+	Type   string `optiontype:"optional" optiondefault:"regex"` // how Value is matched: regex, contains, or not_contains
+	Value  string `optiontype:"required"`                       // the regex or substring to match
+	Header string `optiontype:"optional"`                       // the response header to match instead of the body
+}
+
+// match checks whether content passes the matcher.
+func (m *Matcher) match(content []byte) error {
+	target := "response body"
+	if m.Header != "" {
+		target = fmt.Sprintf("response header %s", m.Header)
+	}
+
+	switch m.Type {
+	case "regex":
+		regex, err := regexp.Compile(m.Value)
+		if err != nil {
+			return fmt.Errorf("Error compiling regex string %s : %s", m.Value, err)
+		}
+		if !regex.Match(content) {
+			return fmt.Errorf("%s does not match regex %s", target, m.Value)
+		}
+	case "contains":
+		if !bytes.Contains(content, []byte(m.Value)) {
+			return fmt.Errorf("%s does not contain %q", target, m.Value)
+		}
+	case "not_contains":
+		if bytes.Contains(content, []byte(m.Value)) {
+			return fmt.Errorf("%s contains %q", target, m.Value)
+		}
+	default:
+		return fmt.Errorf("unknown matcher type %s - must be regex, contains, or not_contains", m.Type)
+	}
+	return nil
 }
 
 // Run a single instance of the check.
@@ -52,76 +250,106 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	verify, _ := strconv.ParseBool(d.Verify)
 	reportMatchedContent, _ := strconv.ParseBool(d.ReportMatchedContent)
 
+	// Parse the certificates once for every request
+	tlsConfig, err := util.NewTLSConfigFromPEM(verify, d.CA, d.ClientCert, d.ClientKey)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not configure TLS: %s", err)
+		return result
+	}
+	if d.ServerFingerprint != "" {
+		err = util.PinFingerprint(tlsConfig, d.ServerFingerprint)
+		if err != nil {
+			result.Message = fmt.Sprintf("Could not configure TLS: %s", err)
+			return result
+		}
+	}
+
+	// Convert strings to durations to allow templating
+	opts := options{Roots: tlsConfig.RootCAs}
+	if d.MaxResponseTime != "" {
+		opts.MaxResponseTime, err = time.ParseDuration(d.MaxResponseTime)
+		if err != nil {
+			result.Message = fmt.Sprintf("Invalid MaxResponseTime: %s", err)
+			return result
+		}
+	}
+	var dnsTimeout time.Duration
+	if d.DNSTimeout != "" {
+		dnsTimeout, err = time.ParseDuration(d.DNSTimeout)
+		if err != nil {
+			result.Message = fmt.Sprintf("Invalid DNSTimeout: %s", err)
+			return result
+		}
+		opts.ExcludeDNS = true
+	}
+
 	// Configure HTTP client
 	cookieJar, err := cookiejar.New(nil)
 	if err != nil {
 		result.Message = "Could not create CookieJar"
 		return result
 	}
-	// TODO: change http.Client.Timeout to be relative to the parent context's
-	// timeout
+	var dialer check.Dialer
+	transport := &http.Transport{
+		DialContext:     dialer.DialContext,
+		IdleConnTimeout: 10 * time.Second,
+		TLSClientConfig: tlsConfig,
+	}
+	if dnsTimeout > 0 {
+		transport.DialContext = dialWithDNSTimeout(dnsTimeout)
+	}
+	// Requests are made with the check's context, so they obey its timeout
 	client := &http.Client{
-		Jar: cookieJar,
-		Transport: &http.Transport{
-			IdleConnTimeout: 10 * time.Second,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: !verify,
-			},
-		},
+		Jar:       cookieJar,
+		Transport: transport,
+	}
+
+	if len(d.Requests) > maxRequests {
+		result.Message = fmt.Sprintf("Too many requests: %d, but at most %d are allowed", len(d.Requests), maxRequests)
+		return result
 	}
 
 	// Save match strings
 	var lastMatch *string
-	var storedValue *string
-
-	type storedValTempl struct {
-		SavedValue string
-	}
+	var lastTrace trace
+	values := make(map[string]string)
 
 	// Make each request in the list
-	// TODO: use "happy line" structure instead of deeply-nested if statements
-	for _, r := range d.Requests {
-		// Check to see if the StoredValue needs to be templated in
-		if storedValue != nil {
-			// Re-encode definition to JSON string
-			def, err := json.Marshal(r)
-			if err != nil {
-				zap.S().Warnf("Error encoding HTTP definition as JSON for StoredValue templating: %s", err)
-			} else {
-				attrs := storedValTempl{
-					SavedValue: *storedValue,
-				}
-				templ := template.Must(template.New("http-storedvalue").Parse(string(def)))
-				var buf bytes.Buffer
-				err := templ.Execute(&buf, attrs)
-				if err != nil {
-					zap.S().Warnf("Error templating HTTP definition for StoredValue templating: %s", err)
-				} else {
-					newReq := &Request{}
-					err := json.Unmarshal(buf.Bytes(), &newReq)
-					if err != nil {
-						zap.S().Warnf("Error decoding StoredValue-templated HTTP definition: %s", err)
-					} else {
-						r = newReq
-					}
-				}
-			}
+	for i, r := range d.Requests {
+		// Stop once the check has run out of time, instead of starting
+		// requests that can't finish
+		if ctx.Err() != nil {
+			result.Passed = false
+			result.Message = fmt.Sprintf("request %d of %d: %s", i+1, len(d.Requests), ctx.Err())
+			break
+		}
+
+		// Template in the values saved from earlier requests
+		if len(values) > 0 {
+			r = templateRequest(r, values)
 		}
 
-		// TODO: create child context with deadline less than the parent context
-		pass, match, err := request(ctx, client, *r)
+		pass, match, trace, err := request(ctx, client, *r, opts, &result)
+		lastTrace = trace
+		result.ResponseTime += trace.Duration
 
 		// Process request results
 		result.Passed = pass
 		if err != nil {
 			result.Message = fmt.Sprintf("%s", err)
+			if len(d.Requests) > 1 {
+				result.Message = fmt.Sprintf("request %d of %d: %s", i+1, len(d.Requests), err)
+			}
 		}
 		if match != nil {
 			lastMatch = match
 			if r.StoreValue {
-				storedValue = match
+				values["SavedValue"] = *match
 			}
 		}
+		for k, v := range trace.Extracted {
+			values[k] = v
+		}
 
 		// If this request failed, don't continue on to the next request
 		if !pass {
@@ -133,12 +361,147 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	if reportMatchedContent && lastMatch != nil {
 		details["matched_content"] = *lastMatch
 	}
+	if lastTrace.Code != 0 {
+		details["status_code"] = strconv.Itoa(lastTrace.Code)
+	}
+	if len(lastTrace.Redirects) > 0 {
+		details["redirects"] = strings.Join(lastTrace.Redirects, " -> ")
+	}
 	result.Details = details
 
 	return result
 }
 
-func request(ctx context.Context, client *http.Client, r Request) (bool, *string, error) {
+// maxRequests is the most requests that a single HTTP check can make.
+const maxRequests = 20
+
+// A trace records how a request was answered, for the check result details
+// and the requests that come after it.
+type trace struct {
+	Code      int               // the status code of the last response
+	Redirects []string          // the URLs that were redirected to, in order
+	Extracted map[string]string // the values that were extracted from the response
+	Duration  time.Duration     // how long the response took, including the redirects
+}
+
+// options are the settings from a Definition that apply to every request.
+type options struct {
+	MaxResponseTime time.Duration  // the longest a response can take; 0 means there is no limit
+	ExcludeDNS      bool           // whether DNS lookups are left out of the response time
+	Roots           *x509.CertPool // the CAs that server certificates are checked against for the tls assertion
+}
+
+// dialWithDNSTimeout returns a dial function that gives up on resolving the
+// host after timeout, and then tries each of the host's addresses in turn.
+func dialWithDNSTimeout(timeout time.Duration) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	dialer := &check.Dialer{}
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		// The jump host resolves the host itself
+		if check.HasTunnel(ctx) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(lookupCtx, host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %s", host, err)
+		}
+
+		err = fmt.Errorf("no addresses found for %s", host)
+		for _, a := range addrs {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// extractorName matches the name of an extractor in a definition, and
+// placeholder matches a template action that only inserts a single value,
+// like {{.SavedValue}}.
+var (
+	extractorName = regexp.MustCompile(`"(?i:name)"\s*:\s*"(\w+)"`)
+	placeholder   = regexp.MustCompile(`{{\s*\.(\w+)\s*}}`)
+)
+
+// EscapePlaceholders escapes the placeholders for values that requests save
+// for later requests, like {{.SavedValue}} and the names of extractors, in a
+// definition that hasn't been rendered yet. This leaves them in the rendered
+// definition for the check to fill in when it runs, instead of having them
+// replaced like attributes.
+func EscapePlaceholders(def string) string {
+	saved := map[string]bool{"SavedValue": true}
+	for _, match := range extractorName.FindAllStringSubmatch(def, -1) {
+		saved[match[1]] = true
+	}
+	return placeholder.ReplaceAllStringFunc(def, func(action string) string {
+		if !saved[placeholder.FindStringSubmatch(action)[1]] {
+			return action
+		}
+		return fmt.Sprintf("{{`%s`}}", action)
+	})
+}
+
+// templateRequest templates the values saved from earlier requests into a
+// request. The values are escaped so that they can't break out of the JSON
+// strings that they are inserted into. If templating fails, the request is
+// returned untouched.
+func templateRequest(r *Request, values map[string]string) *Request {
+	escaped := make(map[string]string, len(values))
+	for k, v := range values {
+		quoted, _ := json.Marshal(v)
+		escaped[k] = string(quoted[1 : len(quoted)-1])
+	}
+
+	// Re-encode definition to JSON string
+	def, err := json.Marshal(r)
+	if err != nil {
+		zap.S().Warnf("Error encoding HTTP definition as JSON for saved value templating: %s", err)
+		return r
+	}
+	templ, err := template.New("http-storedvalue").Parse(string(def))
+	if err != nil {
+		zap.S().Warnf("Error parsing HTTP definition for saved value templating: %s", err)
+		return r
+	}
+	var buf bytes.Buffer
+	err = templ.Execute(&buf, escaped)
+	if err != nil {
+		zap.S().Warnf("Error templating HTTP definition for saved value templating: %s", err)
+		return r
+	}
+	newReq := &Request{}
+	err = json.Unmarshal(buf.Bytes(), &newReq)
+	if err != nil {
+		zap.S().Warnf("Error decoding saved value-templated HTTP definition: %s", err)
+		return r
+	}
+	return newReq
+}
+
+func request(ctx context.Context, client *http.Client, r Request, opts options, result *check.Result) (bool, *string, trace, error) {
+	var t trace
+
+	// Leave DNS lookups out of the response time if they have their own
+	// timeout
+	timer := check.StartTimer()
+	if opts.ExcludeDNS {
+		var lookupStart time.Time
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			DNSStart: func(httptrace.DNSStartInfo) { lookupStart = time.Now() },
+			DNSDone:  func(httptrace.DNSDoneInfo) { timer.Exclude(time.Since(lookupStart)) },
+		})
+	}
+
 	// Construct URL
 	var schema string
 	if r.HTTPS {
@@ -149,51 +512,215 @@ func request(ctx context.Context, client *http.Client, r Request) (bool, *string
 	url := fmt.Sprintf("%s://%s:%d%s", schema, r.Host, r.Port, r.Path)
 
 	// Construct request
-	req, err := http.NewRequestWithContext(ctx, r.Method, url, strings.NewReader(r.Body))
+	reqBody, contentType, err := requestBody(r)
 	if err != nil {
-		return false, nil, fmt.Errorf("Error constructing request: %s", err)
+		return false, nil, t, fmt.Errorf("Error constructing request: %s", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, url, strings.NewReader(reqBody))
+	if err != nil {
+		return false, nil, t, fmt.Errorf("Error constructing request: %s", err)
 	}
 
-	// Add headers
+	// Add headers. A multipart Content-Type can't be overridden, since it has
+	// to have the boundary that the body was built with.
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
 	for k, v := range r.Headers {
+		if len(r.Files) > 0 && http.CanonicalHeaderKey(k) == "Content-Type" {
+			continue
+		}
 		req.Header[k] = []string{v}
 	}
 
-	// Send request
-	resp, err := client.Do(req)
+	// Record each redirect, and stop at the first response if redirects
+	// aren't followed. The client is copied so that the cookie jar is still
+	// shared with the other requests.
+	follow, err := strconv.ParseBool(r.FollowRedirects)
 	if err != nil {
-		return false, nil, fmt.Errorf("Error making request: %s", err)
+		follow = true
+	}
+	redirectClient := *client
+	redirectClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !follow {
+			return http.ErrUseLastResponse
+		}
+		if len(via) > r.MaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", r.MaxRedirects)
+		}
+		t.Redirects = append(t.Redirects, req.URL.String())
+		return nil
+	}
+
+	// Send request, and time it until the whole body has been read
+	resp, err := redirectClient.Do(req)
+	if err != nil {
+		result.Assert("respond", false)
+		return false, nil, t, fmt.Errorf("Error making request: %s", err)
 	}
 	defer resp.Body.Close()
+	t.Code = resp.StatusCode
+	body, err := read(resp, r.MaxBodySize)
+	t.Duration = timer.Elapsed()
+	if err != nil {
+		result.Assert("respond", false)
+		return false, nil, t, fmt.Errorf("Recieved error when reading response body: %s", err)
+	}
+	if resp.TLS != nil {
+		result.Assert("tls", validCertificate(resp.TLS, resp.Request.URL.Hostname(), opts.Roots))
+	}
+
+	// The rest of the assertions are all made, so that each of them can be
+	// scored, but the first one that fails is the one that is reported
+	var errs []error
 
-	// Check status code
-	if r.MatchCode && resp.StatusCode != r.Code {
-		return false, nil, fmt.Errorf("Recieved bad status code: %d", resp.StatusCode)
+	// Check response time
+	err = nil
+	if opts.MaxResponseTime > 0 && t.Duration > opts.MaxResponseTime {
+		err = fmt.Errorf("response took %s, which is longer than the maximum of %s", t.Duration.Round(time.Millisecond), opts.MaxResponseTime)
 	}
+	result.Assert("respond", err == nil)
+	errs = append(errs, err)
 
-	// Check body content
+	// Check status code and redirect location
+	err = checkCode(r, resp)
+	result.Assert("code", err == nil)
+	errs = append(errs, err)
+
+	// Check the matchers, the values to save for the next requests, and the
+	// body content
 	var matchStr string
-	if r.MatchContent {
-		// Read response body
-		body, err := ioutil.ReadAll(resp.Body)
+	matchStr, err = checkContent(r, resp, body, &t)
+	result.Assert("content", err == nil)
+	errs = append(errs, err)
+
+	for _, err := range errs {
 		if err != nil {
-			return false, nil, fmt.Errorf("Recieved error when reading response body: %s", err)
+			return false, nil, t, err
 		}
+	}
+
+	// If we've reached this point, then the check succeeded
+	return true, &matchStr, t, nil
+}
 
-		// Check if body matches regex
-		regex, err := regexp.Compile(r.ContentRegex)
+// checkCode checks the status code and the Location header of a response.
+func checkCode(r Request, resp *http.Response) error {
+	if len(r.Codes) > 0 {
+		ok := false
+		for _, code := range r.Codes {
+			ok = ok || resp.StatusCode == code
+		}
+		if !ok {
+			return fmt.Errorf("Recieved bad status code: %d", resp.StatusCode)
+		}
+	} else if r.MatchCode && resp.StatusCode != r.Code {
+		return fmt.Errorf("Recieved bad status code: %d", resp.StatusCode)
+	}
+
+	// Check the redirect location
+	if r.LocationRegex != "" {
+		regex, err := regexp.Compile(r.LocationRegex)
 		if err != nil {
-			return false, nil, fmt.Errorf("Error compiling regex string %s : %s", r.ContentRegex, err)
+			return fmt.Errorf("Error compiling regex string %s : %s", r.LocationRegex, err)
 		}
-		if !regex.Match(body) {
-			return false, nil, fmt.Errorf("recieved bad response body")
+		location := resp.Header.Get("Location")
+		if !regex.MatchString(location) {
+			return fmt.Errorf("Location header %q does not match regex %s", location, r.LocationRegex)
 		}
-		matches := regex.FindSubmatch(body)
-		matchStr = fmt.Sprintf("%s", matches[len(matches)-1])
 	}
+	return nil
+}
 
-	// If we've reached this point, then the check succeeded
-	return true, &matchStr, nil
+// checkContent checks the matchers and the content regex of a response, and
+// extracts the values to save for the next requests into the trace. The
+// content that the regex matched is returned.
+func checkContent(r Request, resp *http.Response, body []byte, t *trace) (string, error) {
+	// Check the matchers
+	for _, m := range r.Matchers {
+		content := body
+		if m.Header != "" {
+			content = []byte(strings.Join(resp.Header.Values(m.Header), "\n"))
+		}
+		err := m.match(content)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Save values for the next requests
+	for _, e := range r.Extract {
+		content := body
+		if e.Header != "" {
+			content = []byte(resp.Header.Get(e.Header))
+		}
+		value, err := e.extract(content)
+		if err != nil {
+			return "", err
+		}
+		if t.Extracted == nil {
+			t.Extracted = make(map[string]string)
+		}
+		t.Extracted[e.Name] = value
+	}
+
+	// Check body content
+	if !r.MatchContent {
+		return "", nil
+	}
+	// Check if body matches regex
+	regex, err := regexp.Compile(r.ContentRegex)
+	if err != nil {
+		return "", fmt.Errorf("Error compiling regex string %s : %s", r.ContentRegex, err)
+	}
+	if !regex.Match(body) {
+		return "", fmt.Errorf("recieved bad response body")
+	}
+	matches := regex.FindSubmatch(body)
+	return fmt.Sprintf("%s", matches[len(matches)-1]), nil
+}
+
+// validCertificate reports whether the server's certificate chain is valid
+// for the host, whether or not Verify is set, so that TLS can be scored
+// separately from the rest of the check.
+func validCertificate(state *tls.ConnectionState, host string, roots *x509.CertPool) bool {
+	if len(state.PeerCertificates) == 0 {
+		return false
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err == nil
+}
+
+// read reads up to max bytes of a response body, decompressing it first if
+// the server compressed it without being asked to by the transport. Anything
+// past max bytes is ignored, so large downloads aren't kept in memory.
+func read(resp *http.Response, max int64) ([]byte, error) {
+	var body io.Reader = resp.Body
+	if !resp.Uncompressed && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress body: %s", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	return ioutil.ReadAll(io.LimitReader(body, max))
+}
+
+// Assertions returns the names of the assertions that HTTP checks make, for
+// partial credit scoring. Each assertion only passes if it passed for every
+// request that was made.
+func (d *Definition) Assertions() []string {
+	return []string{"respond", "code", "content", "tls"}
 }
 
 // GetConfig returns the current CheckConfig struct this check has been
@@ -0,0 +1,40 @@
+package http
+
+import "testing"
+
+func TestEscapePlaceholders(t *testing.T) {
+	tests := []struct {
+		name string
+		def  string
+		want string
+	}{
+		{
+			name: "attributes are left alone",
+			def:  `{"Requests": [{"Host": "{{.Host}}", "Path": "/"}]}`,
+			want: `{"Requests": [{"Host": "{{.Host}}", "Path": "/"}]}`,
+		},
+		{
+			name: "saved value",
+			def:  `{"Requests": [{"Headers": {"Authorization": "Bearer {{.SavedValue}}"}}]}`,
+			want: "{\"Requests\": [{\"Headers\": {\"Authorization\": \"Bearer {{`{{.SavedValue}}`}}\"}}]}",
+		},
+		{
+			name: "extractor names",
+			def:  `{"requests": [{"extract": [{"name": "CSRF", "regex": "token=(\\w+)"}]}, {"Body": "csrf={{.CSRF}}&user={{ .Username }}"}]}`,
+			want: "{\"requests\": [{\"extract\": [{\"name\": \"CSRF\", \"regex\": \"token=(\\\\w+)\"}]}, {\"Body\": \"csrf={{`{{.CSRF}}`}}&user={{ .Username }}\"}]}",
+		},
+		{
+			name: "other template actions are left alone",
+			def:  `{"Extract": [{"Name": "Token"}], "Body": "{{if .Token}}x{{end}}"}`,
+			want: `{"Extract": [{"Name": "Token"}], "Body": "{{if .Token}}x{{end}}"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EscapePlaceholders(tt.def)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMatcherMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher Matcher
+		content string
+		err     string // the error, if the content doesn't pass
+	}{
+		{name: "regex", matcher: Matcher{Type: "regex", Value: `team\d+`}, content: "owned by team07"},
+		{name: "regex mismatch", matcher: Matcher{Type: "regex", Value: `^team\d+$`}, content: "owned by team07", err: `response body does not match regex ^team\d+$`},
+		{name: "invalid regex", matcher: Matcher{Type: "regex", Value: `team(`}, content: "team", err: "Error compiling regex string team( : "},
+		{name: "contains", matcher: Matcher{Type: "contains", Value: "Welcome"}, content: "<h1>Welcome</h1>"},
+		{name: "doesn't contain", matcher: Matcher{Type: "contains", Value: "Welcome"}, content: "<h1>Hacked</h1>", err: `response body does not contain "Welcome"`},
+		{name: "not contains", matcher: Matcher{Type: "not_contains", Value: "Hacked"}, content: "<h1>Welcome</h1>"},
+		{name: "contains forbidden", matcher: Matcher{Type: "not_contains", Value: "Hacked"}, content: "<h1>Hacked</h1>", err: `response body contains "Hacked"`},
+		{name: "empty content", matcher: Matcher{Type: "contains", Value: "x"}, content: "", err: `response body does not contain "x"`},
+		{name: "header", matcher: Matcher{Type: "contains", Value: "nginx", Header: "Server"}, content: "Apache", err: `response header Server does not contain "nginx"`},
+		{name: "unknown type", matcher: Matcher{Type: "equals", Value: "x"}, content: "x", err: "unknown matcher type equals - must be regex, contains, or not_contains"},
+
+		// Content is matched as UTF-8, so multibyte characters are single
+		// characters to regexes
+		{name: "multibyte contains", matcher: Matcher{Type: "contains", Value: "Grüße"}, content: "Viele Grüße, team01"},
+		{name: "multibyte regex", matcher: Matcher{Type: "regex", Value: `^Bienvenue à l'équipe .$`}, content: "Bienvenue à l'équipe ✓"},
+		{name: "multibyte character class", matcher: Matcher{Type: "regex", Value: `^\p{Han}{2}$`}, content: "欢迎"},
+		{name: "multibyte mismatch", matcher: Matcher{Type: "regex", Value: `^.{2}$`}, content: "欢迎!", err: "response body does not match regex ^.{2}$"},
+		{name: "multibyte not contains", matcher: Matcher{Type: "not_contains", Value: "☠"}, content: "pwned ☠", err: `response body contains "☠"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.matcher.match([]byte(tt.content))
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write([]byte(s))
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRead(t *testing.T) {
+	large := strings.Repeat("0123456789", 200)
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		max      int64
+		want     string
+		err      string
+	}{
+		{name: "small body", body: []byte("hello"), max: 1024, want: "hello"},
+		{name: "empty body", body: nil, max: 1024, want: ""},
+		{name: "body at the cap", body: []byte(large[:1024]), max: 1024, want: large[:1024]},
+		{name: "body over the cap", body: []byte(large), max: 1024, want: large[:1024]},
+
+		// The cap counts bytes, so it can split a multibyte character
+		{name: "multibyte under the cap", body: []byte("équipe"), max: 7, want: "équipe"},
+		{name: "multibyte over the cap", body: []byte("✓✓✓"), max: 4, want: "✓\xe2"},
+
+		// The cap applies to the decompressed body
+		{name: "compressed", body: gzipped(t, large), encoding: "gzip", max: 4096, want: large},
+		{name: "compressed over the cap", body: gzipped(t, large), encoding: "GZIP", max: 100, want: large[:100]},
+		{name: "invalid compressed body", body: []byte("plain"), encoding: "gzip", max: 100, err: "failed to decompress body"},
+		{name: "other encoding", body: []byte("br"), encoding: "br", max: 100, want: "br"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{},
+				Body:   ioutil.NopCloser(bytes.NewReader(tt.body)),
+			}
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			got, err := read(resp, tt.max)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %d bytes %q, want %d bytes", len(got), truncate(string(got)), len(tt.want))
+			}
+		})
+	}
+}
+
+func truncate(s string) string {
+	if len(s) > 40 {
+		return s[:40] + "..."
+	}
+	return s
+}
+
+func TestRunMaxBodySize(t *testing.T) {
+	// The flag is 2000 bytes into the body
+	body := strings.Repeat("x", 2000) + "flag{team01}"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	tests := []struct {
+		name        string
+		maxBodySize int64
+		matcher     Matcher
+		passed      bool
+		message     string
+	}{
+		{name: "flag within the cap", maxBodySize: 1 << 20, matcher: Matcher{Type: "contains", Value: "flag{team01}"}, passed: true},
+		{name: "flag past the cap", maxBodySize: 2000, matcher: Matcher{Type: "contains", Value: "flag{team01}"}, message: `response body does not contain "flag{team01}"`},
+		{name: "flag cut off by the cap", maxBodySize: 2005, matcher: Matcher{Type: "regex", Value: `flag\{\w+\}`}, message: `response body does not match regex flag\{\w+\}`},
+		{name: "forbidden content past the cap", maxBodySize: 2000, matcher: Matcher{Type: "not_contains", Value: "flag"}, passed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Definition{Requests: []*Request{{
+				Host:            host,
+				Port:            uint16(port),
+				Path:            "/",
+				Method:          "GET",
+				FollowRedirects: "true",
+				MaxRedirects:    10,
+				ContentRegex:    ".*",
+				Matchers:        []*Matcher{&tt.matcher},
+				MaxBodySize:     tt.maxBodySize,
+			}}}
+
+			result := d.Run(context.Background())
+			if result.Passed != tt.passed {
+				t.Errorf("got passed %v, want %v (message: %s)", result.Passed, tt.passed, result.Message)
+			}
+			if result.Message != tt.message {
+				t.Errorf("got message %q, want %q", result.Message, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRunTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	host, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	// The test server's certificate is self-signed, so it is its own CA
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name        string
+		verify      string
+		ca          string
+		fingerprint string
+		cert        string
+		passed      bool
+		tls         bool   // whether the tls assertion passes
+		message     string // part of the message
+	}{
+		{name: "trusted CA", verify: "true", ca: ca, passed: true, tls: true},
+		{name: "untrusted", verify: "true", message: "certificate"},
+		{name: "verification disabled", verify: "false", passed: true},
+		{name: "pinned", verify: "false", fingerprint: fingerprint, passed: true},
+		{name: "pinned with colons", verify: "false", fingerprint: strings.ToUpper(fingerprint[:2]) + ":" + fingerprint[2:], passed: true},
+		{name: "pinned and trusted", verify: "true", ca: ca, fingerprint: fingerprint, passed: true, tls: true},
+		{name: "wrong fingerprint", verify: "false", fingerprint: strings.Repeat("00", sha256.Size), message: "does not match the pinned fingerprint"},
+		{name: "invalid fingerprint", verify: "false", fingerprint: "abc", message: "Could not configure TLS: invalid SHA-256 fingerprint 'abc'"},
+		{name: "invalid CA", verify: "true", ca: "not a certificate", message: "Could not configure TLS: no valid PEM certificates found"},
+		{name: "client certificate without key", verify: "false", cert: ca, message: "Could not configure TLS: both a client certificate and a client key must be provided"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Definition{
+				Verify:            tt.verify,
+				CA:                tt.ca,
+				ServerFingerprint: tt.fingerprint,
+				ClientCert:        tt.cert,
+				Requests: []*Request{{
+					Host:            host,
+					Port:            uint16(port),
+					HTTPS:           true,
+					Path:            "/",
+					Method:          "GET",
+					FollowRedirects: "true",
+					MaxRedirects:    10,
+					ContentRegex:    ".*",
+					MaxBodySize:     1 << 20,
+				}},
+			}
+
+			result := d.Run(context.Background())
+			if result.Passed != tt.passed {
+				t.Errorf("got passed %v, want %v (message: %s)", result.Passed, tt.passed, result.Message)
+			}
+			if !strings.Contains(result.Message, tt.message) {
+				t.Errorf("got message %q, want it to contain %q", result.Message, tt.message)
+			}
+			if tt.passed && result.Assertions["tls"] != tt.tls {
+				t.Errorf("got tls assertion %v, want %v", result.Assertions["tls"], tt.tls)
+			}
+		})
+	}
+}
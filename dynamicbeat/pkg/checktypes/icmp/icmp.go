@@ -2,7 +2,9 @@ package icmp
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"time"
 
@@ -19,25 +21,51 @@ type Definition struct {
 	Count           int          `optiontype:"optional" optiondefault:"1"`    // The number of ICMP requests to send per check
 	AllowPacketLoss string       `optiontype:"optional" optiondefault:"true"` // Pass check based on received pings matching Count; if false, will use percent packet loss
 	Percent         int          `optiontype:"optional" optiondefault:"100"`  // Percent of packets needed to come back to pass the check
+	Interval        string       `optiontype:"optional" optiondefault:"1s"`   // The time between each ICMP request
+	MaxPacketLoss   string       `optiontype:"optional"`                      // The highest percent of packets that can be lost; overrides AllowPacketLoss and Percent
+	MaxRTT          string       `optiontype:"optional"`                      // The highest average round trip time, like 100ms
+	IPVersion       string       `optiontype:"optional"`                      // 4 or 6 to only use that IP version; the version of the resolved address is used otherwise
 }
 
+// replyTimeout is how long to wait for replies after the last request is sent.
+const replyTimeout = 5 * time.Second
+
 // Run a single instance of the check
 func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
-	// Create pinger
-	pinger, err := ping.NewPinger(d.Host)
+	var network string
+	switch d.IPVersion {
+	case "":
+		network = "ip"
+	case "4", "6":
+		network = "ip" + d.IPVersion
+	default:
+		result.Message = fmt.Sprintf("Unknown IP version %s - must be 4 or 6", d.IPVersion)
+		return result
+	}
+	interval, err := time.ParseDuration(d.Interval)
 	if err != nil {
-		result.Message = fmt.Sprintf("Error creating pinger: %s", err)
+		result.Message = fmt.Sprintf("Error parsing interval %s : %s", d.Interval, err)
 		return result
 	}
-
-	// Send ping
-	pinger.Count = d.Count
-	// TODO: change this to be relative to the parent context's timeout
-	pinger.Timeout = 25 * time.Second
-	_ = pinger.Run()
+	var maxRTT time.Duration
+	if d.MaxRTT != "" {
+		maxRTT, err = time.ParseDuration(d.MaxRTT)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error parsing max RTT %s : %s", d.MaxRTT, err)
+			return result
+		}
+	}
+	var maxLoss float64
+	if d.MaxPacketLoss != "" {
+		maxLoss, err = strconv.ParseFloat(d.MaxPacketLoss, 64)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error parsing max packet loss %s : %s", d.MaxPacketLoss, err)
+			return result
+		}
+	}
 
 	// Convert PassCount to bool
 	passCount, err := strconv.ParseBool(d.AllowPacketLoss)
@@ -46,29 +74,67 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		return result
 	}
 
+	// Wait for replies to the last request, but finish before the check
+	// times out
+	timeout := time.Duration(d.Count-1)*interval + replyTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline)-time.Second < timeout {
+		timeout = time.Until(deadline) - time.Second
+	}
+
+	// Send pings with an unprivileged datagram socket, or with a raw socket
+	// if they aren't allowed
+	pinger, err := d.ping(network, interval, timeout, false)
+	if errors.Is(err, os.ErrPermission) {
+		pinger, err = d.ping(network, interval, timeout, true)
+	}
+	if errors.Is(err, os.ErrPermission) {
+		result.Message = fmt.Sprintf("Dynamicbeat does not have permission to send pings : %s", err)
+		return result
+	}
+	if err != nil {
+		result.Message = fmt.Sprintf("Error sending pings to %s : %s", d.Host, err)
+		return result
+	}
+
 	stats := pinger.Statistics()
+	details := map[string]string{
+		"ip":                 stats.IPAddr.String(),
+		"packets_sent":       strconv.Itoa(stats.PacketsSent),
+		"packets_received":   strconv.Itoa(stats.PacketsRecv),
+		"packetloss_percent": strconv.FormatFloat(stats.PacketLoss, 'f', -1, 64),
+	}
+	if stats.PacketsRecv > 0 {
+		details["rtt_min"] = stats.MinRtt.String()
+		details["rtt_avg"] = stats.AvgRtt.String()
+		details["rtt_max"] = stats.MaxRtt.String()
+	}
+	result.Details = details
 
-	details := make(map[string]string)
-	// Check packet loss instead of count
-	if !passCount {
+	switch {
+	case d.MaxPacketLoss != "":
+		if stats.PacketLoss > maxLoss {
+			result.Message = fmt.Sprintf("Packet loss of %.1f%% is above the maximum of %s%%", stats.PacketLoss, d.MaxPacketLoss)
+			return result
+		}
+	case !passCount:
+		// Check packet loss instead of count
 		if stats.PacketLoss >= float64(d.Percent) {
 			result.Message = "Not all pings made it back!"
-			details["packetloss_percent"] = strconv.FormatFloat(stats.PacketLoss, 'f', -1, 64)
-			result.Details = details
 			return result
 		}
-
-		// If we make it here the check passes by percentage
-		result.Passed = true
+	case stats.PacketsRecv != d.Count:
+		// Check for failure of ICMP
+		result.Message = "Not all pings made it back!"
+		details["packets_expected"] = fmt.Sprintf("%d", d.Count)
 		return result
 	}
 
-	// Check for failure of ICMP
-	if stats.PacketsRecv != d.Count {
-		result.Message = "Not all pings made it back!"
-		details["packets_received"] = fmt.Sprintf("%d", stats.PacketsRecv)
-		details["packets_expected"] = fmt.Sprintf("%d", d.Count)
-		result.Details = details
+	if stats.PacketsRecv == 0 {
+		result.Message = fmt.Sprintf("No pings to %s made it back", d.Host)
+		return result
+	}
+	if maxRTT > 0 && stats.AvgRtt > maxRTT {
+		result.Message = fmt.Sprintf("Average round trip time of %s is above the maximum of %s", stats.AvgRtt, d.MaxRTT)
 		return result
 	}
 
@@ -77,6 +143,27 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	return result
 }
 
+// ping sends the pings and waits for the replies. Each attempt needs a new
+// pinger, since a pinger can't be run again after it fails to open a socket.
+func (d *Definition) ping(network string, interval time.Duration, timeout time.Duration, privileged bool) (*ping.Pinger, error) {
+	pinger := ping.New(d.Host)
+	pinger.SetNetwork(network)
+	pinger.SetPrivileged(privileged)
+	err := pinger.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve host: %s", err)
+	}
+
+	pinger.Count = d.Count
+	pinger.Interval = interval
+	pinger.Timeout = timeout
+	err = pinger.Run()
+	if err != nil {
+		return nil, err
+	}
+	return pinger, nil
+}
+
 // GetConfig returns the current CheckConfig struct this check has been
 // configured with.
 func (d *Definition) GetConfig() check.Config {
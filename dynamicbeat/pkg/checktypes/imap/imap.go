@@ -2,50 +2,96 @@ package imap
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 	"go.uber.org/zap"
 )
 
 // The Definition configures the behavior of the imap check
 // it implements the "check" interface
 type Definition struct {
-	Config    check.Config // generic metadata about the check
-	Host      string       `optiontype:"required"`                     // IP or hostname for the imap server
-	Username  string       `optiontype:"required"`                     // Username for the imap server
-	Password  string       `optiontype:"required"`                     // Password for the user of the imap server
-	Encrypted string       `optiontype:"optional"`                     // Whether or not to use TLS (IMAPS)
-	Port      string       `optiontype:"optional" optiondefault:"143"` // Port for the imap server
+	Config      check.Config // generic metadata about the check
+	Host        string       `optiontype:"required"`                       // IP or hostname for the imap server
+	Username    string       `optiontype:"required"`                       // Username for the imap server
+	Password    string       `optiontype:"required"`                       // Password for the user of the imap server
+	Encrypted   string       `optiontype:"optional"`                       // Whether or not to use TLS (IMAPS); the same as an Encryption of imaps
+	Encryption  string       `optiontype:"optional"`                       // none, starttls, or imaps
+	Verify      string       `optiontype:"optional"`                       // Whether the server's certificate should be validated
+	CA          string       `optiontype:"optional"`                       // PEM CA certificates to trust instead of the system pool
+	Port        string       `optiontype:"optional"`                       // Port for the imap server; defaults to 993 for imaps, or 143 otherwise
+	Mailbox     string       `optiontype:"optional" optiondefault:"INBOX"` // The mailbox to search
+	Search      string       `optiontype:"optional"`                       // IMAP SEARCH criteria that messages must match, like SUBJECT "scorestack"
+	MinMessages int          `optiontype:"optional" optiondefault:"1"`     // The fewest messages that must match Search
+	MaxAge      string       `optiontype:"optional"`                       // How recently matching messages must have been received, like 15m
+	BodyRegex   string       `optiontype:"optional"`                       // Regex that the body of the newest matching message must match
 }
 
 // Run a single instance of the check
-// We are only supporting the listing of mailboxes as a check currently
+// Without Search, only the listing of mailboxes is checked
 func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
-	// Create a dialer so we can set timeouts
-	// TODO: change this to be relative to the parent context's timeout
-	dialer := net.Dialer{
-		Timeout: 20 * time.Second,
+	encryption := strings.ToLower(d.Encryption)
+	if encrypted, _ := strconv.ParseBool(d.Encrypted); encryption == "" && encrypted {
+		encryption = "imaps"
+	}
+	if encryption == "" {
+		encryption = "none"
+	}
+	port := d.Port
+	switch encryption {
+	case "none", "starttls":
+		if port == "" {
+			port = "143"
+		}
+	case "imaps":
+		if port == "" {
+			port = "993"
+		}
+	default:
+		result.Message = fmt.Sprintf("Unknown encryption %s - must be none, starttls, or imaps", d.Encryption)
+		return result
 	}
 
-	// Defining these allow the if/else block below
-	var c *client.Client
-	var err error
+	// Create a dialer that can take as long as the check has left
+	dialer := check.Dialer{
+		Timeout: check.TimeLeft(ctx, 20*time.Second),
+	}
+
+	// Certificates are only validated if Verify is set
+	verify, _ := strconv.ParseBool(d.Verify)
+	tlsConfig, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+	if err != nil {
+		result.Message = fmt.Sprintf("Invalid TLS configuration : %s", err)
+		return result
+	}
+	tlsConfig.ServerName = d.Host
 
 	// Connect to server with TLS or not
-	if encrypted, _ := strconv.ParseBool(d.Encrypted); encrypted {
-		c, err = client.DialWithDialerTLS(&dialer, fmt.Sprintf("%s:%s", d.Host, d.Port), &tls.Config{})
+	var conn net.Conn
+	var c *client.Client
+	addr := net.JoinHostPort(d.Host, port)
+	if encryption == "imaps" {
+		conn, err = dialer.DialTLS(ctx, "tcp", addr, tlsConfig)
 	} else {
-		c, err = client.DialWithDialer(&dialer, fmt.Sprintf("%s:%s", d.Host, d.Port))
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err == nil {
+		// The greeting is read before the client's Timeout applies
+		_ = conn.SetDeadline(time.Now().Add(dialer.Timeout))
+		c, err = client.New(conn)
+		if err != nil {
+			conn.Close()
+		}
 	}
 	if err != nil {
 		result.Message = fmt.Sprintf("Connecting to server %s failed : %s", d.Host, err)
@@ -61,6 +107,14 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// Set timeout for commands
 	c.Timeout = 5 * time.Second
 
+	if encryption == "starttls" {
+		err = c.StartTLS(tlsConfig)
+		if err != nil {
+			result.Message = fmt.Sprintf("STARTTLS with server %s failed : %s", d.Host, err)
+			return result
+		}
+	}
+
 	// Login
 	err = c.Login(d.Username, d.Password)
 	if err != nil {
@@ -68,6 +122,10 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		return result
 	}
 
+	if d.Search != "" {
+		return d.checkMessages(c, result)
+	}
+
 	// List mailboxes
 	mailboxes := make(chan *imap.MailboxInfo, 10)
 	err = c.List("", "*", mailboxes)
@@ -0,0 +1,172 @@
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// maxBody is the most of a message's body that is checked against BodyRegex.
+const maxBody = 64 << 10
+
+// checkMessages searches the mailbox for messages that match the search
+// criteria, and checks the body of the newest one.
+func (d *Definition) checkMessages(c *client.Client, result check.Result) check.Result {
+	criteria, err := parseSearch(d.Search)
+	if err != nil {
+		result.Message = fmt.Sprintf("Invalid search criteria %s : %s", d.Search, err)
+		return result
+	}
+	var maxAge time.Duration
+	if d.MaxAge != "" {
+		maxAge, err = time.ParseDuration(d.MaxAge)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error parsing max age %s : %s", d.MaxAge, err)
+			return result
+		}
+	}
+	var regex *regexp.Regexp
+	if d.BodyRegex != "" {
+		regex, err = regexp.Compile(d.BodyRegex)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.BodyRegex, err)
+			return result
+		}
+	}
+
+	// The mailbox is opened read-only, so that checking messages doesn't
+	// mark them as seen
+	_, err = c.Select(d.Mailbox, true)
+	if err != nil {
+		result.Message = fmt.Sprintf("Selecting mailbox %s failed : %s", d.Mailbox, err)
+		return result
+	}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		result.Message = fmt.Sprintf("Searching mailbox %s failed : %s", d.Mailbox, err)
+		return result
+	}
+
+	// Find the messages that were received recently enough, and the newest
+	// of them
+	var newest *imap.Message
+	count := 0
+	if len(uids) > 0 {
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uids...)
+		messages, err := fetch(c, seqset, []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate})
+		if err != nil {
+			result.Message = fmt.Sprintf("Fetching messages failed : %s", err)
+			return result
+		}
+		for _, msg := range messages {
+			if maxAge > 0 && time.Since(msg.InternalDate) > maxAge {
+				continue
+			}
+			count++
+			if newest == nil || msg.InternalDate.After(newest.InternalDate) {
+				newest = msg
+			}
+		}
+	}
+
+	result.Details = map[string]string{"messages": strconv.Itoa(count)}
+	if newest != nil {
+		result.Details["uid"] = strconv.FormatUint(uint64(newest.Uid), 10)
+		result.Details["date"] = newest.InternalDate.Format(time.RFC3339)
+	}
+	if count < d.MinMessages {
+		if maxAge > 0 {
+			result.Message = fmt.Sprintf("Found %d messages from the last %s matching the search, but expected at least %d", count, d.MaxAge, d.MinMessages)
+		} else {
+			result.Message = fmt.Sprintf("Found %d messages matching the search, but expected at least %d", count, d.MinMessages)
+		}
+		return result
+	}
+
+	if regex != nil {
+		if newest == nil {
+			result.Message = "No messages matched the search"
+			return result
+		}
+		body, err := fetchBody(c, newest.Uid)
+		if err != nil {
+			result.Message = fmt.Sprintf("Fetching message %d failed : %s", newest.Uid, err)
+			return result
+		}
+		// The message might contain flags, so only admins get to see it
+		result.AdminDetails = map[string]string{"body": string(body)}
+		if !regex.Match(body) {
+			result.Message = "Matching content not found"
+			return result
+		}
+	}
+
+	// If we make it here the check passes
+	result.Passed = true
+	return result
+}
+
+// parseSearch parses IMAP SEARCH criteria, like SUBJECT "scorestack" SINCE
+// 1-Jan-2021.
+func parseSearch(s string) (*imap.SearchCriteria, error) {
+	r := imap.NewReader(bufio.NewReader(strings.NewReader(s + "\r\n")))
+	fields, err := r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	criteria := imap.NewSearchCriteria()
+	err = criteria.ParseWithCharset(fields, nil)
+	if err != nil {
+		return nil, err
+	}
+	return criteria, nil
+}
+
+// fetch fetches items of the messages with the UIDs in a set.
+func fetch(c *client.Client, seqset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, items, ch)
+	}()
+
+	var messages []*imap.Message
+	for msg := range ch {
+		messages = append(messages, msg)
+	}
+	return messages, <-done
+}
+
+// fetchBody fetches the start of the body of a message, without its headers.
+func fetchBody(c *client.Client, uid uint32) ([]byte, error) {
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.TextSpecifier},
+		Peek:         true,
+		Partial:      []int{0, maxBody},
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	messages, err := fetch(c, seqset, []imap.FetchItem{section.FetchItem()})
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("message was not returned")
+	}
+
+	body := messages[0].GetBody(section)
+	if body == nil {
+		return nil, fmt.Errorf("message body was not returned")
+	}
+	return ioutil.ReadAll(io.LimitReader(body, maxBody))
+}
@@ -0,0 +1,157 @@
+package kerberos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/krberror"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// The Definition configures the behavior of the Kerberos check
+// it implements the "check" interface
+type Definition struct {
+	Config    check.Config // generic metadata about the check
+	Host      string       `optiontype:"required"`                    // IP or hostname of the KDC
+	Port      string       `optiontype:"optional" optiondefault:"88"` // Port of the KDC
+	Realm     string       `optiontype:"required"`                    // The realm to log in to, like EXAMPLE.COM
+	Principal string       `optiontype:"required"`                    // The principal to log in as, without the realm
+	Password  string       `optiontype:"required"`                    // The password of the principal
+	SPN       string       `optiontype:"optional"`                    // A service principal to get a ticket for after logging in, like HTTP/web.example.com
+}
+
+// krbErrorCode finds the error code of a KRB-ERROR in the text of an error.
+// gokrb5 only keeps the text of the errors that the KDC sends.
+var krbErrorCode = regexp.MustCompile(`KRB Error: \((\d+)\)`)
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	// Only talk to the configured KDC, instead of looking one up in DNS
+	cfg := config.New()
+	cfg.LibDefaults.DefaultRealm = d.Realm
+	cfg.LibDefaults.DNSLookupKDC = false
+	cfg.LibDefaults.DNSLookupRealm = false
+	cfg.Realms = []config.Realm{{
+		Realm: d.Realm,
+		KDC:   []string{net.JoinHostPort(d.Host, d.Port)},
+	}}
+	cl := client.NewWithPassword(d.Principal, d.Realm, d.Password, cfg, client.DisablePAFXFAST(true))
+	defer cl.Destroy()
+
+	// gokrb5 doesn't take a context, so wait for it in the background
+	done := make(chan error, 1)
+	go func() {
+		err := cl.Login()
+		if err == nil && d.SPN != "" {
+			_, _, err = cl.GetServiceTicket(d.SPN)
+			if err != nil {
+				err = &ticketError{err: err}
+			}
+		}
+		done <- err
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		result.Message = fmt.Sprintf("No response from %s before the check timed out", d.Host)
+		return result
+	}
+	if err != nil {
+		result.Message = d.loginError(err)
+		return result
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// A ticketError is an error from getting a service ticket, after the login
+// worked.
+type ticketError struct {
+	err error
+}
+
+func (e *ticketError) Error() string {
+	return e.err.Error()
+}
+
+// loginError describes why logging in or getting a service ticket failed.
+// An unreachable KDC, a wrong password, an unknown principal, and clocks
+// that are too far apart are told apart, since they are fixed differently.
+func (d *Definition) loginError(err error) string {
+	var ticketErr *ticketError
+	if errors.As(err, &ticketErr) {
+		switch errorCode(ticketErr.err) {
+		case errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN:
+			return fmt.Sprintf("Service principal %s is unknown to %s", d.SPN, d.Host)
+		case errorcode.KRB_AP_ERR_SKEW:
+			return fmt.Sprintf("Clock skew with %s is too great to get a ticket for %s", d.Host, d.SPN)
+		default:
+			return fmt.Sprintf("Getting a ticket for %s failed : %s", d.SPN, ticketErr.err)
+		}
+	}
+
+	var krbErr krberror.Krberror
+	if errors.As(err, &krbErr) && krbErr.RootCause == krberror.NetworkingError {
+		return fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+	}
+	switch errorCode(err) {
+	case errorcode.KDC_ERR_PREAUTH_FAILED, errorcode.KRB_AP_ERR_BAD_INTEGRITY:
+		return fmt.Sprintf("Login to %s as %s failed : pre-authentication failed, so the password is probably wrong", d.Host, d.Principal)
+	case errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN:
+		return fmt.Sprintf("Login to %s as %s failed : the principal is unknown in realm %s", d.Host, d.Principal, d.Realm)
+	case errorcode.KRB_AP_ERR_SKEW:
+		return fmt.Sprintf("Login to %s as %s failed : the clock skew with the KDC is too great", d.Host, d.Principal)
+	case errorcode.KDC_ERR_CLIENT_REVOKED:
+		return fmt.Sprintf("Login to %s as %s failed : the principal is disabled or locked out", d.Host, d.Principal)
+	case errorcode.KDC_ERR_KEY_EXPIRED:
+		return fmt.Sprintf("Login to %s as %s failed : the password has expired", d.Host, d.Principal)
+	case errorcode.KDC_ERR_WRONG_REALM:
+		return fmt.Sprintf("Login to %s as %s failed : the KDC does not serve realm %s", d.Host, d.Principal, d.Realm)
+	}
+	if strings.Contains(err.Error(), "password/keytab incorrect") {
+		// KDCs that don't require pre-authentication send a reply that
+		// can't be decrypted with the wrong password
+		return fmt.Sprintf("Login to %s as %s failed : the password is wrong", d.Host, d.Principal)
+	}
+	return fmt.Sprintf("Login to %s as %s failed : %s", d.Host, d.Principal, err)
+}
+
+// errorCode returns the code of the KRB-ERROR that the KDC sent, or -1 if the
+// error didn't come from the KDC.
+func errorCode(err error) int32 {
+	match := krbErrorCode.FindStringSubmatch(err.Error())
+	if match == nil {
+		return -1
+	}
+	code, err := strconv.ParseInt(match[1], 10, 32)
+	if err != nil {
+		return -1
+	}
+	return int32(code)
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
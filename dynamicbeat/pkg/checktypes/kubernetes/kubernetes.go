@@ -0,0 +1,249 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// The Definition configures the behavior of the Kubernetes check
+// it implements the "check" interface
+type Definition struct {
+	Config     check.Config // generic metadata about the check
+	Host       string       `optiontype:"required"`                         // IP or hostname of the API server
+	Port       string       `optiontype:"optional" optiondefault:"6443"`    // Port of the API server
+	Token      string       `optiontype:"optional"`                         // Bearer token to authenticate with
+	ClientCert string       `optiontype:"optional"`                         // PEM client certificate to authenticate with, instead of Token
+	ClientKey  string       `optiontype:"optional"`                         // PEM private key of the client certificate
+	CA         string       `optiontype:"optional"`                         // PEM CA certificates of the cluster
+	Verify     string       `optiontype:"optional"`                         // Whether the API server's certificate should be validated
+	Health     string       `optiontype:"optional" optiondefault:"readyz"`  // The health endpoint to check: readyz, livez, or healthz
+	Namespace  string       `optiontype:"optional" optiondefault:"default"` // Namespace of the Deployment and Service
+	Deployment string       `optiontype:"optional"`                         // Name of a Deployment whose replicas must be ready
+	Replicas   int          `optiontype:"optional"`                         // The fewest ready replicas that the Deployment must have; defaults to the Deployment's desired replicas
+	Service    string       `optiontype:"optional"`                         // Name of a Service that must have ready endpoints
+}
+
+// maxResponse is the largest response body that is read.
+const maxResponse = 4 << 20
+
+// apiStatus is the body of a failed request to the API.
+type apiStatus struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	switch d.Health {
+	case "readyz", "livez", "healthz":
+	default:
+		result.Message = fmt.Sprintf("Unknown health endpoint %s - must be readyz, livez, or healthz", d.Health)
+		return result
+	}
+
+	verify, _ := strconv.ParseBool(d.Verify)
+	config, err := util.NewTLSConfigFromPEM(verify, pemData(d.CA), pemData(d.ClientCert), pemData(d.ClientKey))
+	if err != nil {
+		result.Message = fmt.Sprintf("Failed to create TLS config : %s", err)
+		return result
+	}
+	var dialer check.Dialer
+	transport := &http.Transport{DialContext: dialer.DialContext, TLSClientConfig: config}
+	// Connections aren't kept around between rounds
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	base := url.URL{Scheme: "https", Host: net.JoinHostPort(d.Host, d.Port)}
+
+	// Check the health of the API server. Unhealthy servers respond with a
+	// 500 and list the checks that failed.
+	status, body, err := d.get(ctx, client, base, "/"+d.Health)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to API server %s : %s", d.Host, err)
+		return result
+	}
+	if status != http.StatusOK {
+		if message := d.statusError(status, body, d.Health); message != "" {
+			result.Message = message
+			return result
+		}
+		result.Message = fmt.Sprintf("API server %s is not healthy : %s", d.Host, strings.ReplaceAll(strings.TrimSpace(string(body)), "\n", ", "))
+		return result
+	}
+	result.Details = make(map[string]string)
+
+	if d.Deployment != "" {
+		var deployment struct {
+			Spec struct {
+				Replicas *int `json:"replicas"`
+			} `json:"spec"`
+			Status struct {
+				ReadyReplicas int `json:"readyReplicas"`
+			} `json:"status"`
+		}
+		path := fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", d.Namespace, d.Deployment)
+		message := d.getObject(ctx, client, base, path, "Deployment", d.Deployment, &deployment)
+		if message != "" {
+			result.Message = message
+			return result
+		}
+
+		// Deployments have 1 replica if they don't say
+		desired := 1
+		if deployment.Spec.Replicas != nil {
+			desired = *deployment.Spec.Replicas
+		}
+		want := d.Replicas
+		if want == 0 {
+			want = desired
+		}
+		ready := deployment.Status.ReadyReplicas
+		result.Details["ready_replicas"] = strconv.Itoa(ready)
+		result.Details["desired_replicas"] = strconv.Itoa(desired)
+		if ready < want {
+			result.Message = fmt.Sprintf("Deployment %s has %d/%d replicas ready, but needs %d", d.Deployment, ready, desired, want)
+			return result
+		}
+	}
+
+	if d.Service != "" {
+		var endpoints struct {
+			Subsets []struct {
+				Addresses []json.RawMessage `json:"addresses"`
+			} `json:"subsets"`
+		}
+		path := fmt.Sprintf("/api/v1/namespaces/%s/endpoints/%s", d.Namespace, d.Service)
+		message := d.getObject(ctx, client, base, path, "Service", d.Service, &endpoints)
+		if message != "" {
+			result.Message = message
+			return result
+		}
+
+		// Only the endpoints that are ready are listed as addresses
+		ready := 0
+		for _, subset := range endpoints.Subsets {
+			ready += len(subset.Addresses)
+		}
+		result.Details["endpoints"] = strconv.Itoa(ready)
+		if ready == 0 {
+			result.Message = fmt.Sprintf("Service %s does not have any ready endpoints", d.Service)
+			return result
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// get requests a path from the API server, and returns the status and body
+// of the response.
+func (d *Definition) get(ctx context.Context, client *http.Client, base url.URL, path string) (int, []byte, error) {
+	target := base
+	target.Path = path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if d.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// getObject gets an object from the API and decodes it into out. It returns
+// why the object couldn't be fetched, or an empty string if it was.
+func (d *Definition) getObject(ctx context.Context, client *http.Client, base url.URL, path string, kind string, name string, out interface{}) string {
+	status, body, err := d.get(ctx, client, base, path)
+	if err != nil {
+		return fmt.Sprintf("Could not connect to API server %s : %s", d.Host, err)
+	}
+	if status == http.StatusNotFound {
+		return fmt.Sprintf("%s %s does not exist in namespace %s", kind, name, d.Namespace)
+	}
+	if status != http.StatusOK {
+		if message := d.statusError(status, body, path); message != "" {
+			return message
+		}
+		return fmt.Sprintf("Request for %s failed : %s", path, reason(status, body))
+	}
+	err = json.Unmarshal(body, out)
+	if err != nil {
+		return fmt.Sprintf("Failed to decode %s %s : %s", kind, name, err)
+	}
+	return ""
+}
+
+// statusError describes responses that mean the credentials were rejected
+// or the user isn't allowed to make the request. It returns an empty string
+// for other responses.
+func (d *Definition) statusError(status int, body []byte, path string) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return fmt.Sprintf("Login to API server %s failed : %s", d.Host, reason(status, body))
+	case http.StatusForbidden:
+		return fmt.Sprintf("User is not allowed to get %s : %s", path, reason(status, body))
+	default:
+		return ""
+	}
+}
+
+// reason returns the message of a Status object in a response body, or the
+// status code if there isn't one.
+func reason(status int, body []byte) string {
+	var s apiStatus
+	if json.Unmarshal(body, &s) == nil && s.Kind == "Status" && s.Message != "" {
+		return s.Message
+	}
+	return http.StatusText(status)
+}
+
+// pemData returns PEM data, which can also be given in base64 like the
+// *-data fields of a kubeconfig file.
+func pemData(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.HasPrefix(s, "-----BEGIN") {
+		return s
+	}
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return s
+	}
+	return string(decoded)
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
@@ -4,22 +4,48 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	ldap "github.com/go-ldap/ldap/v3"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 )
 
 // The Definition configures the behavior of the LDAP check
 // it implements the "check" interface
 type Definition struct {
-	Config   check.Config // generic metadata about the check
-	User     string       `optiontype:"required"`                     // The user written in user@domain syntax
-	Password string       `optiontype:"required"`                     // the password for the user
-	Fqdn     string       `optiontype:"required"`                     // The Fqdn of the ldap server
-	Ldaps    string       `optiontype:"optional"`                     // Whether or not to use LDAP+TLS
-	Port     string       `optiontype:"optional" optiondefault:"389"` // Port for ldap
+	Config     check.Config // generic metadata about the check
+	User       string       `optiontype:"required"`                                 // The user written in user@domain syntax
+	Password   string       `optiontype:"required"`                                 // the password for the user
+	Fqdn       string       `optiontype:"required"`                                 // The Fqdn of the ldap server
+	Ldaps      string       `optiontype:"optional"`                                 // Whether or not to use LDAP+TLS; the same as an Encryption of starttls
+	Port       string       `optiontype:"optional" optiondefault:"389"`             // Port for ldap
+	Encryption string       `optiontype:"optional"`                                 // none, starttls, or ldaps
+	Verify     string       `optiontype:"optional"`                                 // Whether the server's certificate should be validated
+	CA         string       `optiontype:"optional"`                                 // PEM CA certificates to trust instead of the system pool
+	BaseDN     string       `optiontype:"optional"`                                 // The DN to search under after binding; no search is done if this is empty
+	Scope      string       `optiontype:"optional" optiondefault:"sub"`             // base, one, or sub
+	Filter     string       `optiontype:"optional" optiondefault:"(objectClass=*)"` // The filter of the search
+	MinResults int          `optiontype:"optional" optiondefault:"1"`               // The fewest entries that the search must return
+	Assertions []*Assertion `optiontype:"list"`                                     // Conditions on the attributes of the entries that must all pass
+}
+
+// An Assertion requires one of the entries that a search returned to have an
+// attribute value that matches a regex.
+type Assertion struct {
+	Attribute string `optiontype:"required"` // The name of the attribute, like memberOf
+	Regex     string `optiontype:"required"` // The regex that one of the attribute's values must match
+}
+
+// scopes are the search scopes that can be used.
+var scopes = map[string]int{
+	"base": ldap.ScopeBaseObject,
+	"one":  ldap.ScopeSingleLevel,
+	"sub":  ldap.ScopeWholeSubtree,
 }
 
 // Run a single instance of the check
@@ -27,12 +53,33 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
-	// Set timeout
-	// TODO: change this to be relative to the parent context's timeout
-	ldap.DefaultTimeout = 20 * time.Second
+	encryption := strings.ToLower(d.Encryption)
+	if ldaps, _ := strconv.ParseBool(d.Ldaps); encryption == "" && ldaps {
+		encryption = "starttls"
+	}
+	verify, _ := strconv.ParseBool(d.Verify)
+	tlsConfig, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+	if err != nil {
+		result.Message = fmt.Sprintf("Error configuring TLS : %s", err)
+		return result
+	}
+	tlsConfig.ServerName = d.Fqdn
 
 	// Normal, default ldap check
-	lconn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%s", d.Fqdn, d.Port))
+	var lconn *ldap.Conn
+	addr := net.JoinHostPort(d.Fqdn, d.Port)
+	switch encryption {
+	case "", "none", "starttls":
+		lconn, err = dial(ctx, addr)
+	case "ldaps":
+		lconn, result.Message = dialTLS(ctx, addr, tlsConfig)
+		if lconn == nil {
+			return result
+		}
+	default:
+		result.Message = fmt.Sprintf("Unknown encryption %s - must be none, starttls, or ldaps", d.Encryption)
+		return result
+	}
 	if err != nil {
 		result.Message = fmt.Sprintf("Could not dial server %s : %s", d.Fqdn, err)
 		return result
@@ -43,8 +90,8 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	lconn.SetTimeout(5 * time.Second)
 
 	// Add TLS if needed
-	if ldaps, _ := strconv.ParseBool(d.Ldaps); ldaps {
-		err = lconn.StartTLS(&tls.Config{InsecureSkipVerify: true})
+	if encryption == "starttls" {
+		err = lconn.StartTLS(tlsConfig)
 		if err != nil {
 			result.Message = fmt.Sprintf("TLS session creation failed : %s", err)
 			return result
@@ -58,11 +105,119 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		return result
 	}
 
+	if d.BaseDN == "" {
+		// If we reached here the check passes
+		result.Passed = true
+		return result
+	}
+	return d.search(lconn, result)
+}
+
+// dial connects to the server without TLS.
+func dial(ctx context.Context, addr string) (*ldap.Conn, error) {
+	var dialer check.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	lconn := ldap.NewConn(conn, false)
+	lconn.Start()
+	return lconn, nil
+}
+
+// dialTLS connects to an LDAPS server. Unlike ldap.DialTLS, failed TLS
+// handshakes are told apart from failed connections in the returned message.
+func dialTLS(ctx context.Context, addr string, config *tls.Config) (*ldap.Conn, string) {
+	var dialer check.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Sprintf("Could not dial server %s : %s", config.ServerName, err)
+	}
+
+	tlsConn := tls.Client(conn, config)
+	_ = tlsConn.SetDeadline(time.Now().Add(check.TimeLeft(ctx, 20*time.Second)))
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Sprintf("TLS session creation failed : %s", err)
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+
+	lconn := ldap.NewConn(tlsConn, true)
+	lconn.Start()
+	return lconn, ""
+}
+
+// search runs the search, and checks the entries that it returned.
+func (d *Definition) search(lconn *ldap.Conn, result check.Result) check.Result {
+	scope, ok := scopes[strings.ToLower(d.Scope)]
+	if !ok {
+		result.Message = fmt.Sprintf("Unknown scope %s - must be base, one, or sub", d.Scope)
+		return result
+	}
+
+	attributes := make([]string, 0, len(d.Assertions))
+	regexes := make([]*regexp.Regexp, 0, len(d.Assertions))
+	for _, a := range d.Assertions {
+		regex, err := regexp.Compile(a.Regex)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", a.Regex, err)
+			return result
+		}
+		attributes = append(attributes, a.Attribute)
+		regexes = append(regexes, regex)
+	}
+	if len(attributes) == 0 {
+		// Only ask for the DNs of the entries
+		attributes = append(attributes, "1.1")
+	}
+
+	req := ldap.NewSearchRequest(d.BaseDN, scope, ldap.NeverDerefAliases, 0, 0, false, d.Filter, attributes, nil)
+	res, err := lconn.Search(req)
+	// Large directories like Active Directory stop at a size limit, but the
+	// entries that were returned can still be checked
+	if err != nil && !(ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) && res != nil) {
+		result.Message = fmt.Sprintf("Search of %s failed : %s", d.BaseDN, err)
+		return result
+	}
+	result.Details = map[string]string{"results": strconv.Itoa(len(res.Entries))}
+
+	if len(res.Entries) < d.MinResults {
+		result.Message = fmt.Sprintf("Search of %s returned %d entries, but expected at least %d", d.BaseDN, len(res.Entries), d.MinResults)
+		return result
+	}
+
+	for i, a := range d.Assertions {
+		if !matchAttribute(res.Entries, a.Attribute, regexes[i]) {
+			result.Message = fmt.Sprintf("No entry has a %s value matching %s", a.Attribute, a.Regex)
+			return result
+		}
+	}
+
 	// If we reached here the check passes
 	result.Passed = true
 	return result
 }
 
+// matchAttribute checks whether any of the entries has a value of an
+// attribute that matches a regex. Attribute names are compared without case,
+// like LDAP servers do.
+func matchAttribute(entries []*ldap.Entry, attribute string, regex *regexp.Regexp) bool {
+	for _, e := range entries {
+		for _, attr := range e.Attributes {
+			if !strings.EqualFold(attr.Name, attribute) {
+				continue
+			}
+			for _, value := range attr.Values {
+				if regex.MatchString(value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 // GetConfig returns the current CheckConfig struct this check has been
 // configured with.
 func (d *Definition) GetConfig() check.Config {
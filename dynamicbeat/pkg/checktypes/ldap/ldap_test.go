@@ -0,0 +1,529 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/internal/checktest"
+)
+
+// LDAP protocol operations, from RFC 4511.
+const (
+	opBindRequest     = 0
+	opBindResponse    = 1
+	opUnbindRequest   = 2
+	opSearchRequest   = 3
+	opSearchEntry     = 4
+	opSearchDone      = 5
+	opExtendedRequest = 23
+	opExtendedResult  = 24
+
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+// A directory is the server software that fakeServer imitates. The results
+// that each kind of directory returns for failures were recorded from real
+// servers.
+type directory struct {
+	invalidCredentials string // the diagnostic message of a failed bind
+	noSuchObject       string // the diagnostic message of a search of a base that doesn't exist
+	sizeLimit          int    // how many entries a search returns at most
+}
+
+var (
+	openLDAP        = directory{}
+	activeDirectory = directory{
+		invalidCredentials: "80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 52e, v4563\x00",
+		noSuchObject:       "0000208D: NameErr: DSID-0310028B, problem 2001 (NO_OBJECT), data 0, best match of:\n\t'DC=corp,DC=example,DC=com'\n\x00",
+		sizeLimit:          2,
+	}
+)
+
+type attribute struct {
+	name   string
+	values []string
+}
+
+type entry struct {
+	dn         string
+	attributes []attribute
+}
+
+// fakeServer is an LDAP server that speaks just enough of the protocol for
+// the check: simple binds, StartTLS, and searches with equality filters.
+type fakeServer struct {
+	directory
+	addr     string
+	users    map[string]string // passwords by bind name
+	entries  []entry
+	tls      *tls.Config // the certificate for StartTLS and LDAPS
+	ldaps    bool        // whether connections start with a TLS handshake
+	startTLS bool        // whether StartTLS is supported
+}
+
+func newFakeServer(t *testing.T, configure func(s *fakeServer)) *fakeServer {
+	t.Helper()
+	s := &fakeServer{users: make(map[string]string), startTLS: true}
+	if configure != nil {
+		configure(s)
+	}
+	s.addr = checktest.Serve(t, s.serve).Addr().String()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	if s.ldaps {
+		conn = tls.Server(conn, s.tls)
+	}
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case opBindRequest:
+			name := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			if want, ok := s.users[name]; ok && want == password {
+				s.respond(conn, id, opBindResponse, ldap.LDAPResultSuccess, "", "")
+			} else {
+				s.respond(conn, id, opBindResponse, ldap.LDAPResultInvalidCredentials, "", s.invalidCredentials)
+			}
+		case opExtendedRequest:
+			if op.Children[0].Data.String() != startTLSOID || !s.startTLS || s.tls == nil {
+				s.respond(conn, id, opExtendedResult, ldap.LDAPResultProtocolError, "", "unsupported extended operation")
+				continue
+			}
+			s.respond(conn, id, opExtendedResult, ldap.LDAPResultSuccess, "", "")
+			conn = tls.Server(conn, s.tls)
+		case opSearchRequest:
+			s.search(conn, id, op)
+		case opUnbindRequest:
+			return
+		}
+	}
+}
+
+// respond sends an LDAPResult.
+func (s *fakeServer) respond(conn net.Conn, id int64, tag ber.Tag, code uint16, matched string, message string) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, matched, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, ""))
+	s.send(conn, id, op)
+}
+
+func (s *fakeServer) send(conn net.Conn, id int64, op *ber.Packet) {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	envelope.AppendChild(op)
+	_, _ = conn.Write(envelope.Bytes())
+}
+
+var equality = regexp.MustCompile(`^\((\w+)=([^)*]*)\)$`)
+
+func (s *fakeServer) search(conn net.Conn, id int64, op *ber.Packet) {
+	base := op.Children[0].Value.(string)
+	filter, err := ldap.DecompileFilter(op.Children[6])
+	if err != nil {
+		s.respond(conn, id, opSearchDone, ldap.LDAPResultProtocolError, "", err.Error())
+		return
+	}
+	var requested []string
+	for _, a := range op.Children[7].Children {
+		requested = append(requested, a.Value.(string))
+	}
+
+	found := false
+	var matches []entry
+	for _, e := range s.entries {
+		if !strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(base)) {
+			continue
+		}
+		found = true
+		if e.matches(filter) {
+			matches = append(matches, e)
+		}
+	}
+	if !found {
+		s.respond(conn, id, opSearchDone, ldap.LDAPResultNoSuchObject, "dc=example,dc=com", s.noSuchObject)
+		return
+	}
+
+	for i, e := range matches {
+		if s.sizeLimit > 0 && i == s.sizeLimit {
+			s.respond(conn, id, opSearchDone, ldap.LDAPResultSizeLimitExceeded, "", "")
+			return
+		}
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, opSearchEntry, nil, "")
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+		attributes := ber.NewSequence("")
+		for _, a := range e.attributes {
+			if !contains(requested, a.name) {
+				continue
+			}
+			attr := ber.NewSequence("")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a.name, ""))
+			values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, v := range a.values {
+				values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+			}
+			attr.AppendChild(values)
+			attributes.AppendChild(attr)
+		}
+		result.AppendChild(attributes)
+		s.send(conn, id, result)
+	}
+	s.respond(conn, id, opSearchDone, ldap.LDAPResultSuccess, "", "")
+}
+
+// matches checks whether an entry matches a presence filter like
+// (objectClass=*) or an equality filter like (uid=alice).
+func (e entry) matches(filter string) bool {
+	if filter == "(objectClass=*)" {
+		return true
+	}
+	m := equality.FindStringSubmatch(filter)
+	if m == nil {
+		return false
+	}
+	for _, a := range e.attributes {
+		if strings.EqualFold(a.name, m[1]) && contains(a.values, m[2]) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains checks whether a list has a string, ignoring case like LDAP does.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenLDAP users bind with their DN, and groups are found with memberOf.
+func openLDAPServer(t *testing.T, configure func(s *fakeServer)) *fakeServer {
+	return newFakeServer(t, func(s *fakeServer) {
+		s.directory = openLDAP
+		s.users["cn=admin,dc=example,dc=com"] = "hunter2"
+		s.entries = []entry{
+			{dn: "ou=people,dc=example,dc=com", attributes: []attribute{{"objectClass", []string{"organizationalUnit"}}}},
+			{dn: "uid=alice,ou=people,dc=example,dc=com", attributes: []attribute{
+				{"objectClass", []string{"inetOrgPerson"}},
+				{"uid", []string{"alice"}},
+				{"memberOf", []string{"cn=blueteam,ou=groups,dc=example,dc=com"}},
+			}},
+			{dn: "uid=bob,ou=people,dc=example,dc=com", attributes: []attribute{
+				{"objectClass", []string{"inetOrgPerson"}},
+				{"uid", []string{"bob"}},
+			}},
+		}
+		if configure != nil {
+			configure(s)
+		}
+	})
+}
+
+// Active Directory users bind with their user principal name.
+func activeDirectoryServer(t *testing.T, configure func(s *fakeServer)) *fakeServer {
+	return newFakeServer(t, func(s *fakeServer) {
+		s.directory = activeDirectory
+		s.users["administrator@corp.example.com"] = "Passw0rd!"
+		s.entries = []entry{
+			{dn: "CN=Users,DC=corp,DC=example,DC=com", attributes: []attribute{{"objectClass", []string{"container"}}}},
+			{dn: "CN=Alice,CN=Users,DC=corp,DC=example,DC=com", attributes: []attribute{
+				{"objectClass", []string{"user"}},
+				{"sAMAccountName", []string{"alice"}},
+				{"memberOf", []string{"CN=Domain Admins,CN=Users,DC=corp,DC=example,DC=com", "CN=Blue Team,CN=Users,DC=corp,DC=example,DC=com"}},
+			}},
+			{dn: "CN=Bob,CN=Users,DC=corp,DC=example,DC=com", attributes: []attribute{
+				{"objectClass", []string{"user"}},
+				{"sAMAccountName", []string{"bob"}},
+			}},
+			{dn: "CN=Carol,CN=Users,DC=corp,DC=example,DC=com", attributes: []attribute{
+				{"objectClass", []string{"user"}},
+				{"sAMAccountName", []string{"carol"}},
+			}},
+		}
+		if configure != nil {
+			configure(s)
+		}
+	})
+}
+
+func (s *fakeServer) definition(user string, password string) *Definition {
+	host, port, _ := net.SplitHostPort(s.addr)
+	return &Definition{
+		User:       user,
+		Password:   password,
+		Fqdn:       host,
+		Port:       port,
+		Scope:      "sub",
+		Filter:     "(objectClass=*)",
+		MinResults: 1,
+	}
+}
+
+func TestRunOpenLDAP(t *testing.T) {
+	cert, ca := checktest.NewCert(t, "ldap.example.com")
+	_, otherCA := checktest.NewCert(t, "ldap.example.com")
+
+	tests := []struct {
+		name    string
+		server  func(s *fakeServer)
+		def     func(d *Definition)
+		passed  bool
+		message string // the start of the message
+		results string // the number of entries that the search returned
+	}{
+		{name: "bind", passed: true},
+		{
+			name:    "wrong password",
+			def:     func(d *Definition) { d.Password = "hunter3" },
+			message: `Failed to login with user cn=admin,dc=example,dc=com : LDAP Result Code 49 "Invalid Credentials"`,
+		},
+		{
+			name:    "unknown user",
+			def:     func(d *Definition) { d.User = "cn=root,dc=example,dc=com" },
+			message: `Failed to login with user cn=root,dc=example,dc=com : LDAP Result Code 49 "Invalid Credentials"`,
+		},
+		{
+			name:    "empty password",
+			def:     func(d *Definition) { d.Password = "" },
+			message: "Failed to login with user cn=admin,dc=example,dc=com : ",
+		},
+		{
+			name:   "starttls",
+			server: func(s *fakeServer) { s.tls = cert },
+			def:    func(d *Definition) { d.Encryption, d.Verify, d.CA = "starttls", "true", ca },
+			passed: true,
+		},
+		{
+			name:   "legacy ldaps flag",
+			server: func(s *fakeServer) { s.tls = cert },
+			def:    func(d *Definition) { d.Ldaps = "true" },
+			passed: true,
+		},
+		{
+			name:    "starttls with an untrusted certificate",
+			server:  func(s *fakeServer) { s.tls = cert },
+			def:     func(d *Definition) { d.Encryption, d.Verify, d.CA = "starttls", "true", otherCA },
+			message: "TLS session creation failed : ",
+		},
+		{
+			name:    "starttls unsupported",
+			server:  func(s *fakeServer) { s.tls, s.startTLS = cert, false },
+			def:     func(d *Definition) { d.Encryption = "starttls" },
+			message: `TLS session creation failed : LDAP Result Code 2 "Protocol Error"`,
+		},
+		{
+			name:   "ldaps",
+			server: func(s *fakeServer) { s.tls, s.ldaps = cert, true },
+			def:    func(d *Definition) { d.Encryption, d.Verify, d.CA = "LDAPS", "true", ca },
+			passed: true,
+		},
+		{
+			name:    "ldaps with an untrusted certificate",
+			server:  func(s *fakeServer) { s.tls, s.ldaps = cert, true },
+			def:     func(d *Definition) { d.Encryption, d.Verify = "ldaps", "true" },
+			message: "TLS session creation failed : ",
+		},
+		{
+			name:    "ldaps to a plain server",
+			def:     func(d *Definition) { d.Encryption, d.Verify = "ldaps", "false" },
+			message: "TLS session creation failed : ",
+		},
+		{
+			name:    "unknown encryption",
+			def:     func(d *Definition) { d.Encryption = "ssl" },
+			message: "Unknown encryption ssl - must be none, starttls, or ldaps",
+		},
+		{
+			name:    "invalid CA",
+			def:     func(d *Definition) { d.CA = "not a certificate" },
+			message: "Error configuring TLS : ",
+		},
+		{
+			name:    "search",
+			def:     func(d *Definition) { d.BaseDN = "ou=people,dc=example,dc=com" },
+			passed:  true,
+			results: "3",
+		},
+		{
+			name: "user is in a group",
+			def: func(d *Definition) {
+				d.BaseDN, d.Filter = "ou=people,dc=example,dc=com", "(uid=alice)"
+				d.Assertions = []*Assertion{{Attribute: "memberof", Regex: "^cn=blueteam,"}}
+			},
+			passed:  true,
+			results: "1",
+		},
+		{
+			name: "user isn't in the group",
+			def: func(d *Definition) {
+				d.BaseDN, d.Filter = "ou=people,dc=example,dc=com", "(uid=bob)"
+				d.Assertions = []*Assertion{{Attribute: "memberOf", Regex: "^cn=blueteam,"}}
+			},
+			message: "No entry has a memberOf value matching ^cn=blueteam,",
+			results: "1",
+		},
+		{
+			name: "missing user",
+			def: func(d *Definition) {
+				d.BaseDN, d.Filter = "ou=people,dc=example,dc=com", "(uid=mallory)"
+			},
+			message: "Search of ou=people,dc=example,dc=com returned 0 entries, but expected at least 1",
+			results: "0",
+		},
+		{
+			name: "too few entries",
+			def: func(d *Definition) {
+				d.BaseDN, d.Filter, d.MinResults = "ou=people,dc=example,dc=com", "(objectClass=inetOrgPerson)", 3
+			},
+			message: "Search of ou=people,dc=example,dc=com returned 2 entries, but expected at least 3",
+			results: "2",
+		},
+		{
+			name:    "missing base",
+			def:     func(d *Definition) { d.BaseDN = "ou=missing,dc=example,dc=com" },
+			message: `Search of ou=missing,dc=example,dc=com failed : LDAP Result Code 32 "No Such Object"`,
+		},
+		{
+			name:    "unknown scope",
+			def:     func(d *Definition) { d.BaseDN, d.Scope = "dc=example,dc=com", "children" },
+			message: "Unknown scope children - must be base, one, or sub",
+		},
+		{
+			name: "invalid regex",
+			def: func(d *Definition) {
+				d.BaseDN = "dc=example,dc=com"
+				d.Assertions = []*Assertion{{Attribute: "uid", Regex: "("}}
+			},
+			message: "Error compiling regex string ( : ",
+		},
+		{
+			name: "invalid filter",
+			def: func(d *Definition) {
+				d.BaseDN, d.Filter = "dc=example,dc=com", "uid=alice"
+			},
+			message: "Search of dc=example,dc=com failed : ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openLDAPServer(t, tt.server)
+			d := s.definition("cn=admin,dc=example,dc=com", "hunter2")
+			if tt.def != nil {
+				tt.def(d)
+			}
+
+			result := d.Run(context.Background())
+			if result.Passed != tt.passed {
+				t.Errorf("got passed %v, want %v (message: %s)", result.Passed, tt.passed, result.Message)
+			}
+			if !strings.HasPrefix(result.Message, tt.message) || (tt.message == "" && result.Message != "") {
+				t.Errorf("got message %q, want it to start with %q", result.Message, tt.message)
+			}
+			if got := result.Details["results"]; got != tt.results {
+				t.Errorf("got %q results, want %q", got, tt.results)
+			}
+		})
+	}
+}
+
+func TestRunActiveDirectory(t *testing.T) {
+	tests := []struct {
+		name    string
+		def     func(d *Definition)
+		passed  bool
+		message string
+		results string
+	}{
+		{name: "bind", passed: true},
+		{
+			// Active Directory explains why the bind failed in the data field,
+			// which is kept in the message
+			name:    "wrong password",
+			def:     func(d *Definition) { d.Password = "password" },
+			message: `Failed to login with user administrator@corp.example.com : LDAP Result Code 49 "Invalid Credentials": 80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 52e`,
+		},
+		{
+			name: "user is in a group",
+			def: func(d *Definition) {
+				d.BaseDN, d.Filter = "CN=Users,DC=corp,DC=example,DC=com", "(sAMAccountName=alice)"
+				d.Assertions = []*Assertion{{Attribute: "memberOf", Regex: "^CN=Blue Team,"}}
+			},
+			passed:  true,
+			results: "1",
+		},
+		{
+			// Entries up to the size limit are still checked
+			name: "size limit exceeded",
+			def: func(d *Definition) {
+				d.BaseDN, d.MinResults = "CN=Users,DC=corp,DC=example,DC=com", 2
+			},
+			passed:  true,
+			results: "2",
+		},
+		{
+			name: "size limit exceeded before enough entries",
+			def: func(d *Definition) {
+				d.BaseDN, d.MinResults = "CN=Users,DC=corp,DC=example,DC=com", 4
+			},
+			message: "Search of CN=Users,DC=corp,DC=example,DC=com returned 2 entries, but expected at least 4",
+			results: "2",
+		},
+		{
+			name:    "missing base",
+			def:     func(d *Definition) { d.BaseDN = "OU=Missing,DC=corp,DC=example,DC=com" },
+			message: `Search of OU=Missing,DC=corp,DC=example,DC=com failed : LDAP Result Code 32 "No Such Object": 0000208D: NameErr:`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := activeDirectoryServer(t, nil)
+			d := s.definition("administrator@corp.example.com", "Passw0rd!")
+			if tt.def != nil {
+				tt.def(d)
+			}
+
+			result := d.Run(context.Background())
+			if result.Passed != tt.passed {
+				t.Errorf("got passed %v, want %v (message: %s)", result.Passed, tt.passed, result.Message)
+			}
+			if !strings.HasPrefix(result.Message, tt.message) || (tt.message == "" && result.Message != "") {
+				t.Errorf("got message %q, want it to start with %q", result.Message, tt.message)
+			}
+			if got := result.Details["results"]; got != tt.results {
+				t.Errorf("got %q results, want %q", got, tt.results)
+			}
+		})
+	}
+}
+
+func TestRunConnectionRefused(t *testing.T) {
+	host, port := checktest.ClosedPort(t)
+
+	for _, encryption := range []string{"none", "starttls", "ldaps"} {
+		d := &Definition{User: "cn=admin", Password: "hunter2", Fqdn: host, Port: port, Encryption: encryption}
+		result := d.Run(context.Background())
+		if result.Passed || !strings.HasPrefix(result.Message, "Could not dial server 127.0.0.1 : ") {
+			t.Errorf("%s: got passed %v with message %q, want a dial failure", encryption, result.Passed, result.Message)
+		}
+	}
+}
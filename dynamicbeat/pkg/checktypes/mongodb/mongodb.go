@@ -0,0 +1,265 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/auth"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// The Definition configures the behavior of the MongoDB check
+// it implements the "check" interface
+type Definition struct {
+	Config           check.Config // generic metadata about the check
+	URI              string       `optiontype:"optional"`                       // Connection string to use instead of Host, Port, and the credentials
+	Host             string       `optiontype:"optional"`                       // IP or hostname of the MongoDB server, if URI isn't set
+	Port             string       `optiontype:"optional" optiondefault:"27017"` // Port of the MongoDB server
+	Username         string       `optiontype:"optional"`                       // User to log in as; the check doesn't log in if this isn't set
+	Password         string       `optiontype:"optional"`                       // Password for the user
+	AuthSource       string       `optiontype:"optional" optiondefault:"admin"` // Database that the user is defined in
+	AuthMechanism    string       `optiontype:"optional"`                       // SCRAM-SHA-1 or SCRAM-SHA-256; the mechanism is negotiated if it isn't set
+	ReplicaSet       string       `optiontype:"optional"`                       // Name of the replica set that the server must be part of
+	DirectConnection string       `optiontype:"optional"`                       // Whether to only connect to the given server instead of discovering the replica set
+	TLS              string       `optiontype:"optional"`                       // Whether to connect with TLS
+	Verify           string       `optiontype:"optional"`                       // Whether the server's certificate should be validated
+	CA               string       `optiontype:"optional"`                       // PEM CA certificates to trust instead of the system pool
+	Database         string       `optiontype:"optional"`                       // Name of the database to run the find against
+	Collection       string       `optiontype:"optional"`                       // Name of the collection to run the find against; only a ping is run if it isn't set
+	Filter           string       `optiontype:"optional" optiondefault:"{}"`    // Extended JSON filter document for the find
+	MinDocuments     int          `optiontype:"optional"`                       // The fewest documents that the find must return
+	Field            string       `optiontype:"optional"`                       // Dotted path of a field in the first document to check
+	ExpectedValue    string       `optiontype:"optional" optiondefault:".*"`    // Regex that the field must match
+}
+
+// unauthorized is the code of the error that the server returns when a user
+// doesn't have permission to run a command.
+const unauthorized = 13
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	if d.Collection != "" && d.Database == "" {
+		result.Message = "Database must be set to run a find"
+		return result
+	}
+	var filter bson.D
+	err := bson.UnmarshalExtJSON([]byte(d.Filter), false, &filter)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error parsing filter %s : %s", d.Filter, err)
+		return result
+	}
+	regex, err := regexp.Compile(d.ExpectedValue)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ExpectedValue, err)
+		return result
+	}
+
+	opts, err := d.clientOptions(ctx)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		result.Message = fmt.Sprintf("Creating client failed : %s", err)
+		return result
+	}
+	// Connection pools aren't kept around after the check, so that teams'
+	// connection limits aren't used up between rounds. The check's context
+	// might already be done, so disconnecting gets its own.
+	defer func() {
+		disconnectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = client.Disconnect(disconnectCtx)
+	}()
+
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		result.Message = d.serverError(fmt.Sprintf("ping %s", d.target()), err)
+		return result
+	}
+
+	if d.Collection == "" {
+		// If we reach here the check is successful
+		result.Passed = true
+		return result
+	}
+
+	// Only the documents that are needed are fetched
+	limit := int64(d.MinDocuments)
+	if limit < 1 {
+		limit = 1
+	}
+	collection := client.Database(d.Database).Collection(d.Collection)
+	cursor, err := collection.Find(ctx, filter, options.Find().SetLimit(limit))
+	if err != nil {
+		result.Message = d.serverError(fmt.Sprintf("find documents in %s.%s", d.Database, d.Collection), err)
+		return result
+	}
+	defer cursor.Close(ctx)
+
+	count := 0
+	for cursor.Next(ctx) {
+		if count == 0 && d.Field != "" {
+			value, err := cursor.Current.LookupErr(strings.Split(d.Field, ".")...)
+			if err != nil {
+				result.Message = fmt.Sprintf("First document does not have field %s", d.Field)
+				return result
+			}
+			str, ok := value.StringValueOK()
+			if !ok {
+				str = value.String()
+			}
+
+			// The value might contain flags, so only admins get to see it
+			result.AdminDetails = map[string]string{"value": str}
+			if !regex.MatchString(str) {
+				result.Message = fmt.Sprintf("Value of field %s did not match %s", d.Field, d.ExpectedValue)
+				return result
+			}
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		result.Message = d.serverError(fmt.Sprintf("read documents from %s.%s", d.Database, d.Collection), err)
+		return result
+	}
+
+	if count < d.MinDocuments {
+		result.Message = fmt.Sprintf("Find returned %d documents, but expected at least %d", count, d.MinDocuments)
+		return result
+	}
+	if d.Field != "" && count == 0 {
+		result.Message = "Find did not return any documents"
+		return result
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// clientOptions builds the options for the client. The timeouts of the client
+// are set from the deadline of the context.
+func (d *Definition) clientOptions(ctx context.Context) (*options.ClientOptions, error) {
+	opts := options.Client().SetMaxPoolSize(1)
+	if d.URI != "" {
+		opts.ApplyURI(d.URI)
+	} else {
+		if d.Host == "" {
+			return nil, fmt.Errorf("Either URI or Host must be set")
+		}
+		opts.SetHosts([]string{net.JoinHostPort(d.Host, d.Port)})
+		if d.Username != "" {
+			switch d.AuthMechanism {
+			case "", auth.SCRAMSHA1, auth.SCRAMSHA256:
+			default:
+				return nil, fmt.Errorf("Unknown auth mechanism %s - must be SCRAM-SHA-1 or SCRAM-SHA-256", d.AuthMechanism)
+			}
+			opts.SetAuth(options.Credential{
+				AuthMechanism: d.AuthMechanism,
+				AuthSource:    d.AuthSource,
+				Username:      d.Username,
+				Password:      d.Password,
+			})
+		}
+	}
+
+	if d.ReplicaSet != "" {
+		opts.SetReplicaSet(d.ReplicaSet)
+	}
+	if d.DirectConnection != "" {
+		direct, err := strconv.ParseBool(d.DirectConnection)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing direct connection %s : %s", d.DirectConnection, err)
+		}
+		opts.SetDirect(direct)
+	}
+
+	if useTLS, _ := strconv.ParseBool(d.TLS); useTLS {
+		verify, _ := strconv.ParseBool(d.Verify)
+		config, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create TLS config : %s", err)
+		}
+		opts.SetTLSConfig(config)
+	}
+
+	// The driver dials from its own goroutines, with contexts that aren't
+	// derived from the check's, so the check's context is captured for the
+	// jump host
+	var dialer check.Dialer
+	opts.SetDialer(dialFunc(func(_ context.Context, network string, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}))
+
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		opts.SetConnectTimeout(remaining)
+		opts.SetServerSelectionTimeout(remaining)
+		opts.SetTimeout(remaining)
+	}
+	return opts, nil
+}
+
+// dialFunc adapts a function to the driver's ContextDialer interface.
+type dialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+
+func (f dialFunc) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// serverError describes why an operation on the server failed. Login
+// failures come back from whichever operation opened the first connection,
+// since the driver connects lazily.
+func (d *Definition) serverError(operation string, err error) string {
+	var authErr *auth.Error
+	var cmdErr mongo.CommandError
+	var selectErr topology.ServerSelectionError
+	switch {
+	case errors.As(err, &authErr):
+		return fmt.Sprintf("Login to %s failed : %s", d.target(), err)
+	case errors.As(err, &cmdErr) && cmdErr.Code == unauthorized:
+		return fmt.Sprintf("User is not allowed to %s : %s", operation, err)
+	case errors.As(err, &selectErr):
+		return fmt.Sprintf("Could not connect to %s : %s", d.target(), err)
+	case mongo.IsTimeout(err):
+		return fmt.Sprintf("Timed out trying to %s : %s", operation, err)
+	default:
+		return fmt.Sprintf("Failed to %s : %s", operation, err)
+	}
+}
+
+// target names the server in messages. The URI might contain a password, so
+// it isn't used.
+func (d *Definition) target() string {
+	if d.Host != "" {
+		return d.Host
+	}
+	return "the server"
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
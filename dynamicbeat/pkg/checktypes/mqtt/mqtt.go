@@ -0,0 +1,327 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// The Definition configures the behavior of the MQTT check
+// it implements the "check" interface
+type Definition struct {
+	Config     check.Config // generic metadata about the check
+	Host       string       `optiontype:"required"`                                  // IP or hostname of the MQTT broker
+	Port       string       `optiontype:"optional"`                                  // Port of the broker; defaults to 1883, or 8883 with TLS
+	TLS        string       `optiontype:"optional"`                                  // Whether to connect with TLS
+	Verify     string       `optiontype:"optional"`                                  // Whether the broker's certificate should be validated
+	CA         string       `optiontype:"optional"`                                  // PEM CA certificates to trust instead of the system pool
+	ClientCert string       `optiontype:"optional"`                                  // PEM client certificate to present to the broker
+	ClientKey  string       `optiontype:"optional"`                                  // PEM private key of the client certificate
+	Username   string       `optiontype:"optional"`                                  // User to log in as
+	Password   string       `optiontype:"optional"`                                  // Password for the user
+	ClientID   string       `optiontype:"optional"`                                  // The client identifier; a random one is used if it isn't set
+	Mode       string       `optiontype:"optional" optiondefault:"roundtrip"`        // roundtrip to publish and receive a message, or connect to only log in
+	Topic      string       `optiontype:"optional" optiondefault:"scorestack/check"` // The topic to subscribe and publish to
+	QoS        int          `optiontype:"optional"`                                  // The QoS of the subscription and the message: 0, 1, or 2
+	Timeout    string       `optiontype:"optional" optiondefault:"5s"`               // How long to wait for the message to come back
+}
+
+// keepAlive is the keep alive that the check connects with, in seconds.
+const keepAlive = 60
+
+// Packet identifiers of the subscription and the message.
+const (
+	subscribeID = 1
+	publishID   = 2
+)
+
+// A client is a connection to a broker.
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	mode := strings.ToLower(d.Mode)
+	if mode != "roundtrip" && mode != "connect" {
+		result.Message = fmt.Sprintf("Unknown mode %s - must be roundtrip or connect", d.Mode)
+		return result
+	}
+	if d.QoS < 0 || d.QoS > 2 {
+		result.Message = fmt.Sprintf("Invalid QoS %d - must be 0, 1, or 2", d.QoS)
+		return result
+	}
+	if strings.ContainsAny(d.Topic, "+#") {
+		result.Message = fmt.Sprintf("Topic %s can't contain wildcards, since messages are published to it", d.Topic)
+		return result
+	}
+	timeout, err := time.ParseDuration(d.Timeout)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error parsing timeout %s : %s", d.Timeout, err)
+		return result
+	}
+	useTLS, _ := strconv.ParseBool(d.TLS)
+	port := d.Port
+	if port == "" && useTLS {
+		port = "8883"
+	} else if port == "" {
+		port = "1883"
+	}
+
+	var dialer check.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, port))
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if useTLS {
+		verify, _ := strconv.ParseBool(d.Verify)
+		config, err := util.NewTLSConfigFromPEM(verify, d.CA, d.ClientCert, d.ClientKey)
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to create TLS config : %s", err)
+			return result
+		}
+		config.ServerName = d.Host
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.Handshake()
+		if err != nil {
+			result.Message = fmt.Sprintf("TLS handshake with %s failed : %s", d.Host, err)
+			return result
+		}
+		conn = tlsConn
+	}
+	c := &client{conn: conn, reader: bufio.NewReader(conn)}
+
+	clientID := d.ClientID
+	if clientID == "" {
+		clientID = "scorestack-" + randomToken()
+	}
+	err = c.connect(clientID, d.Username, d.Password)
+	var refused connectError
+	if errors.As(err, &refused) {
+		result.Message = fmt.Sprintf("Broker %s refused the connection : %s", d.Host, refused)
+		return result
+	}
+	if err != nil {
+		result.Message = fmt.Sprintf("MQTT connection to %s failed : %s", d.Host, err)
+		return result
+	}
+	defer c.disconnect()
+
+	if mode == "connect" {
+		// If we reach here the check is successful
+		result.Passed = true
+		return result
+	}
+
+	granted, err := c.subscribe(d.Topic, byte(d.QoS))
+	if err != nil {
+		result.Message = fmt.Sprintf("Subscribing to %s failed : %s", d.Topic, err)
+		return result
+	}
+	if granted == 0x80 {
+		result.Message = fmt.Sprintf("Broker %s refused the subscription to %s", d.Host, d.Topic)
+		return result
+	}
+
+	token := randomToken()
+	result.Details = map[string]string{"token": token, "granted_qos": strconv.Itoa(int(granted))}
+	sent := time.Now()
+	_, err = c.conn.Write(encode(typePublish, byte(d.QoS)<<1, str(d.Topic), publishIDField(byte(d.QoS)), []byte("scorestack "+token)))
+	if err != nil {
+		result.Message = fmt.Sprintf("Publishing to %s failed : %s", d.Topic, err)
+		return result
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = c.conn.SetReadDeadline(deadline)
+	err = c.roundTrip(d.Topic, byte(d.QoS), token)
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		result.Message = fmt.Sprintf("Message was not received back on %s within %s", d.Topic, d.Timeout)
+		return result
+	case errors.Is(err, io.EOF):
+		// MQTT 3.1.1 brokers close the connection when a client isn't
+		// allowed to publish
+		result.Message = fmt.Sprintf("Broker %s closed the connection after the message was published to %s", d.Host, d.Topic)
+		return result
+	case err != nil:
+		result.Message = fmt.Sprintf("Round trip through %s failed : %s", d.Host, err)
+		return result
+	}
+	result.Details["round_trip"] = time.Since(sent).String()
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// connect logs in to the broker with a clean session.
+func (c *client) connect(clientID string, username string, password string) error {
+	flags := byte(0x02) // clean session
+	payload := str(clientID)
+	if username != "" {
+		flags |= 0x80
+		payload = append(payload, str(username)...)
+		if password != "" {
+			flags |= 0x40
+			payload = append(payload, str(password)...)
+		}
+	}
+	_, err := c.conn.Write(encode(typeConnect, 0, str("MQTT"), []byte{4, flags}, u16(keepAlive), payload))
+	if err != nil {
+		return err
+	}
+	p, err := readPacket(c.reader)
+	if err != nil {
+		return err
+	}
+	if p.kind != typeConnack || len(p.body) != 2 {
+		return fmt.Errorf("expected a CONNACK, but received packet type %d", p.kind)
+	}
+	if p.body[1] != 0 {
+		return connectError(p.body[1])
+	}
+	return nil
+}
+
+// subscribe subscribes to a topic, and returns the QoS that the broker
+// granted, or 0x80 if it refused the subscription.
+func (c *client) subscribe(topic string, qos byte) (byte, error) {
+	_, err := c.conn.Write(encode(typeSubscribe, 0x02, u16(subscribeID), str(topic), []byte{qos}))
+	if err != nil {
+		return 0, err
+	}
+	for {
+		p, err := readPacket(c.reader)
+		if err != nil {
+			return 0, err
+		}
+		if p.kind == typeSuback && p.packetID() == subscribeID && len(p.body) == 3 {
+			return p.body[2], nil
+		}
+		// Retained messages can arrive before the SUBACK
+		err = c.handle(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// roundTrip waits for the message with the token to come back, and for the
+// broker to acknowledge the message that was published.
+func (c *client) roundTrip(topic string, qos byte, token string) error {
+	received := false
+	acknowledged := qos == 0
+	for !received || !acknowledged {
+		p, err := readPacket(c.reader)
+		if err != nil {
+			return err
+		}
+		switch {
+		case p.kind == typePuback && p.packetID() == publishID && qos == 1:
+			acknowledged = true
+		case p.kind == typePubrec && p.packetID() == publishID && qos == 2:
+			_, err = c.conn.Write(encode(typePubrel, 0x02, u16(publishID)))
+		case p.kind == typePubcomp && p.packetID() == publishID && qos == 2:
+			acknowledged = true
+		case p.kind == typePublish:
+			var pub *publish
+			pub, err = parsePublish(p)
+			if err == nil && pub.topic == topic && bytes.Contains(pub.payload, []byte(token)) {
+				received = true
+			}
+			if err == nil {
+				err = c.handle(p)
+			}
+		default:
+			err = c.handle(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle acknowledges the messages that the broker delivers, so that it
+// keeps delivering them.
+func (c *client) handle(p *packet) error {
+	switch p.kind {
+	case typePublish:
+		pub, err := parsePublish(p)
+		if err != nil {
+			return err
+		}
+		switch pub.qos {
+		case 1:
+			_, err = c.conn.Write(encode(typePuback, 0, u16(pub.packetID)))
+		case 2:
+			_, err = c.conn.Write(encode(typePubrec, 0, u16(pub.packetID)))
+		}
+		return err
+	case typePubrel:
+		_, err := c.conn.Write(encode(typePubcomp, 0, u16(p.packetID())))
+		return err
+	}
+	return nil
+}
+
+// disconnect tells the broker that the client is done.
+func (c *client) disconnect() {
+	_, _ = c.conn.Write(encode(typeDisconnect, 0))
+}
+
+// publishIDField returns the packet identifier of the message, which is only
+// sent for QoS 1 and 2.
+func publishIDField(qos byte) []byte {
+	if qos == 0 {
+		return nil
+	}
+	return u16(publishID)
+}
+
+// randomToken returns a random hex string for client identifiers and
+// messages.
+func randomToken() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT control packet types.
+const (
+	typeConnect    = 1
+	typeConnack    = 2
+	typePublish    = 3
+	typePuback     = 4
+	typePubrec     = 5
+	typePubrel     = 6
+	typePubcomp    = 7
+	typeSubscribe  = 8
+	typeSuback     = 9
+	typeDisconnect = 14
+)
+
+// maxPacket is the largest packet that is read from the broker.
+const maxPacket = 1 << 20
+
+// A packet is a control packet, split into its fixed header and the rest.
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// connectError is the return code of a CONNACK that refused the connection.
+type connectError byte
+
+func (e connectError) Error() string {
+	switch e {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad username or password"
+	case 5:
+		return "not authorized"
+	default:
+		return fmt.Sprintf("return code %d", byte(e))
+	}
+}
+
+// encode builds a packet from its type, flags, and the rest of its contents.
+func encode(kind byte, flags byte, parts ...[]byte) []byte {
+	length := 0
+	for _, p := range parts {
+		length += len(p)
+	}
+	b := []byte{kind<<4 | flags}
+	// The remaining length is a variable-length integer
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			break
+		}
+	}
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// str encodes a length-prefixed UTF-8 string or binary field.
+func str(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// u16 encodes a packet identifier or keep alive.
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+// readPacket reads a packet from the broker.
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("invalid remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(digit&0x7f) << (7 * i)
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxPacket {
+		return nil, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+	return &packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+// packetID returns the packet identifier at the start of an acknowledgement.
+func (p *packet) packetID() uint16 {
+	if len(p.body) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(p.body)
+}
+
+// publish is the contents of a PUBLISH packet.
+type publish struct {
+	qos      byte
+	topic    string
+	packetID uint16
+	payload  []byte
+}
+
+// parsePublish parses a PUBLISH packet.
+func parsePublish(p *packet) (*publish, error) {
+	pub := &publish{qos: (p.flags >> 1) & 3}
+	if len(p.body) < 2 {
+		return nil, errors.New("truncated PUBLISH")
+	}
+	n := int(binary.BigEndian.Uint16(p.body))
+	rest := p.body[2:]
+	if len(rest) < n {
+		return nil, errors.New("truncated PUBLISH")
+	}
+	pub.topic = string(rest[:n])
+	rest = rest[n:]
+	if pub.qos > 0 {
+		if len(rest) < 2 {
+			return nil, errors.New("truncated PUBLISH")
+		}
+		pub.packetID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	pub.payload = rest
+	return pub, nil
+}
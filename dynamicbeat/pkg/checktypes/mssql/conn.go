@@ -0,0 +1,81 @@
+package mssql
+
+import (
+	"context"
+	"database/sql/driver"
+	"net"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// connector connects to the database with the driver, and works around two of
+// its problems:
+//
+// - The driver only uses the context to dial, so a server that stops
+// responding would keep the check running. Connections are given the
+// deadline of the check instead.
+//
+// - The driver panics when it closes a connection encrypted with TLS, since
+// its wrapper around the connection doesn't implement deadlines. The panic is
+// recovered, and the connection is closed without the TLS close_notify alert.
+type connector struct {
+	*mssql.Connector
+	dialer *dialer
+}
+
+func newConnector(dsn string, deadline time.Time) (*connector, error) {
+	c, err := mssql.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := &dialer{deadline: deadline}
+	c.Dialer = d
+	return &connector{Connector: c, dialer: d}, nil
+}
+
+// Connect connects to the database.
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	inner, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: inner.(*mssql.Conn), raw: c.dialer.conn}, nil
+}
+
+// A dialer dials connections with the deadline of the check, and remembers
+// the last one that it dialed.
+type dialer struct {
+	check.Dialer
+	deadline time.Time
+	conn     net.Conn
+}
+
+func (d *dialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Connections through tunnels might not support deadlines, but they use
+	// the context of the check already
+	_ = conn.SetDeadline(d.deadline)
+	d.conn = conn
+	return conn, nil
+}
+
+// conn is a connection to the database that is closed even if the driver
+// panics while closing it.
+type conn struct {
+	*mssql.Conn
+	raw net.Conn
+}
+
+func (c *conn) Close() (err error) {
+	defer func() {
+		if recover() != nil {
+			err = c.raw.Close()
+		}
+	}()
+	return c.Conn.Close()
+}
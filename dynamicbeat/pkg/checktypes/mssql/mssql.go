@@ -4,26 +4,35 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"net"
+	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
-	// MSSQL driver
-	_ "github.com/denisenkom/go-mssqldb"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
 )
 
+// The Definition configures the behavior of the MSSQL check
+// it implements the "check" interface
 type Definition struct {
-	Config       check.Config // generic metadata about the check
-	Host         string       `optiontype:"required"`                      // IP or Hostname for the MSSQL server
-	Username     string       `optiontype:"required"`                      // Username for the database
-	Password     string       `optiontype:"required"`                      // Password for the user
-	Database     string       `optiontype:"required"`                      // Name of the database to access
-	Table        string       `optiontype:"required"`                      // Name of the table to access
-	Column       string       `optiontype:"required"`                      // Name of the column to access
-	MatchContent string       `optiontype:"optional"`                      // Whether to perform a regex content match on the results of the query
-	ContentRegex string       `optiontype:"optional" optiondefault:".*"`   // Regex to match on
-	Port         string       `optiontype:"optional" optiondefault:"1433"` // Port for the server
+	Config        check.Config // generic metadata about the check
+	Host          string       `optiontype:"required"`                       // IP or Hostname for the MSSQL server
+	Username      string       `optiontype:"required"`                       // Username for the database, or DOMAIN\user for NTLM
+	Password      string       `optiontype:"required"`                       // Password for the user
+	Database      string       `optiontype:"optional"`                       // Name of the database to access, instead of the login's default database
+	Table         string       `optiontype:"optional"`                       // Name of the table to access, if Query isn't set
+	Column        string       `optiontype:"optional"`                       // Name of the column to access, if Query isn't set
+	MatchContent  string       `optiontype:"optional"`                       // Whether to perform a regex content match on the results of the query
+	ContentRegex  string       `optiontype:"optional" optiondefault:".*"`    // Regex to match on
+	Port          string       `optiontype:"optional"`                       // Port for the server; defaults to 1433 if Instance isn't set
+	Instance      string       `optiontype:"optional"`                       // Name of the instance to look up with the SQL Server Browser, if Port isn't set
+	Encrypt       string       `optiontype:"optional" optiondefault:"false"` // disable, false to only encrypt the login, or true
+	Verify        string       `optiontype:"optional"`                       // Whether the server's certificate should be validated
+	Query         string       `optiontype:"optional"`                       // The query to run instead of selecting Column from Table
+	ExpectedRows  int          `optiontype:"optional"`                       // The fewest rows that the query must return
+	ExpectedValue string       `optiontype:"optional"`                       // Regex that the first column of the first row must match
 }
 
 // Run a single instance of the check
@@ -31,74 +40,167 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
+	query := d.Query
+	if query == "" {
+		if d.Table == "" || d.Column == "" {
+			result.Message = "Either Query or both Table and Column must be set"
+			return result
+		}
+		query = fmt.Sprintf("SELECT %s FROM %s;", quote(d.Column), quote(d.Table))
+	}
+	encrypt := strings.ToLower(d.Encrypt)
+	switch encrypt {
+	case "disable", "false", "true":
+	default:
+		result.Message = fmt.Sprintf("Unknown encryption %s - must be disable, false, or true", d.Encrypt)
+		return result
+	}
+
 	// Create DB handle
-	db, err := sql.Open("mssql", fmt.Sprintf("sqlserver://%s:%s@%s:%s/instance?database=%s", d.Username, d.Password, d.Host, d.Port, d.Database))
+	deadline, _ := ctx.Deadline()
+	connector, err := newConnector(d.dsn(encrypt), deadline)
 	if err != nil {
 		result.Message = fmt.Sprintf("Creating database handle failed : %s", err)
 		return result
 	}
+	db := sql.OpenDB(connector)
 	defer db.Close()
 
-	// Set connection parameters
+	// Set connection parameters. Connections aren't kept around after the
+	// check, so that teams' connection limits aren't used up between rounds.
 	db.SetMaxIdleConns(-1)
 	db.SetMaxOpenConns(1)
 
-	// Check db connection
+	// Check db connection. The driver doesn't wrap its errors, so failed
+	// logins can only be told apart by their message.
 	err = db.PingContext(ctx)
+	if err != nil && strings.HasPrefix(err.Error(), "Login error") {
+		result.Message = fmt.Sprintf("Failed to login with user %s : %s", d.Username, err)
+		return result
+	}
 	if err != nil {
-		result.Message = fmt.Sprintf("Failed to ping database : %s", err)
+		result.Message = fmt.Sprintf("Failed to connect to database : %s", err)
 		return result
 	}
 
-	// Query the Db
-	// TODO: This is SQL injectable. FIgure out paramerterized queries
-	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s;", d.Column, d.Table))
+	// Query the DB
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		result.Message = fmt.Sprintf("Could not query database : %s", err)
 		return result
 	}
 	defer rows.Close()
 
-	// Store the value from the column
-	var val string
+	columns, err := rows.Columns()
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not get query columns : %s", err)
+		return result
+	}
+	if len(columns) == 0 {
+		result.Message = "Query did not return any columns"
+		return result
+	}
 
-	// Perform regex matching if necessary
+	// Compile the regexes
+	var contentRegex, valueRegex *regexp.Regexp
 	if matchContent, _ := strconv.ParseBool(d.MatchContent); matchContent {
-		// Compile the regex
-		regex, err := regexp.Compile(d.ContentRegex)
+		contentRegex, err = regexp.Compile(d.ContentRegex)
 		if err != nil {
 			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ContentRegex, err)
 			return result
 		}
+	}
+	if d.ExpectedValue != "" {
+		valueRegex, err = regexp.Compile(d.ExpectedValue)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ExpectedValue, err)
+			return result
+		}
+	}
 
-		// Check the rows
-		for rows.Next() {
-			// Grab a value
-			err := rows.Scan(&val)
-			if err != nil {
-				result.Message = fmt.Sprintf("Could not scan row values : %s", err)
-				return result
-			}
-			// Check value with regex
-			if regex.MatchString(val) {
-				// If we reach here the check passes
-				result.Passed = true
+	// Check the first column of each row
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	count := 0
+	matched := false
+	for rows.Next() {
+		err := rows.Scan(dest...)
+		if err != nil {
+			result.Message = fmt.Sprintf("Could not scan row values : %s", err)
+			return result
+		}
+		val := string(values[0])
+		if count == 0 {
+			result.AdminDetails = map[string]string{"first_value": val}
+			if valueRegex != nil && !valueRegex.MatchString(val) {
+				result.Message = "First value returned by the query does not match the expected value"
 				return result
 			}
-
+		}
+		count++
+		if contentRegex != nil && contentRegex.MatchString(val) {
+			matched = true
 		}
 	}
 
 	// Check for error in the rows
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		result.Message = fmt.Sprintf("Something happened to the rows : %s", err)
 		return result
 	}
 
+	if count < d.ExpectedRows {
+		result.Message = fmt.Sprintf("Query returned %d rows, but expected at least %d", count, d.ExpectedRows)
+		return result
+	}
+	if valueRegex != nil && count == 0 {
+		result.Message = "Query did not return any rows"
+		return result
+	}
+	if contentRegex != nil && !matched {
+		result.Message = "Matching content not found"
+		return result
+	}
+
 	// Check passes if we reach here
 	result.Passed = true
 	return result
+}
+
+// dsn creates the connection string for the database. Named instances are
+// looked up with the SQL Server Browser on UDP port 1434 when no port is
+// given. A username with a domain, like CORP\user, logs in with NTLM.
+func (d *Definition) dsn(encrypt string) string {
+	host := d.Host
+	port := d.Port
+	if port == "" && d.Instance == "" {
+		port = "1433"
+	}
+	if port != "" {
+		host = net.JoinHostPort(d.Host, port)
+	}
+	verify, _ := strconv.ParseBool(d.Verify)
 
+	params := url.Values{
+		"encrypt":                {encrypt},
+		"trustservercertificate": {strconv.FormatBool(!verify)},
+	}
+	if d.Database != "" {
+		params.Set("database", d.Database)
+	}
+	u := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(d.Username, d.Password),
+		Host:     host,
+		RawQuery: params.Encode(),
+	}
+	if port == "" {
+		u.Path = "/" + d.Instance
+	}
+	return u.String()
 }
 
 // GetConfig returns the current CheckConfig struct this check has been
@@ -111,3 +213,13 @@ func (d *Definition) GetConfig() check.Config {
 func (d *Definition) SetConfig(c check.Config) {
 	d.Config = c
 }
+
+// quote returns name as a bracketed identifier, so that it can't change the
+// query it's used in. Dots separate the parts of a name, like in dbo.teams.
+func quote(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "[" + strings.ReplaceAll(part, "]", "]]") + "]"
+	}
+	return strings.Join(parts, ".")
+}
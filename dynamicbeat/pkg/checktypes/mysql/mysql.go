@@ -3,29 +3,38 @@ package mysql
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"net"
 	"regexp"
 	"strconv"
 	"time"
 
 	// MySQL driver
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 )
 
 // The Definition configures the behavior of the MySQL check
 // it implements the "check" interface
 type Definition struct {
-	Config       check.Config // generic metadata about the check
-	Host         string       `optiontype:"required"`                      // IP of Hostname for the MySQL server
-	Username     string       `optiontype:"required"`                      // Username for the database
-	Password     string       `optiontype:"required"`                      // Password for the user
-	Database     string       `optiontype:"required"`                      // Name of the database to access
-	Table        string       `optiontype:"required"`                      // Name of the table to access
-	Column       string       `optiontype:"required"`                      // Name of the column to access
-	MatchContent string       `optiontype:"optional"`                      // Whether to perform a regex content match on the results of the query
-	ContentRegex string       `optiontype:"optional" optiondefault:".*"`   // Regex to match on
-	Port         string       `optiontype:"optional" optiondefault:"3306"` // Port for the server
+	Config        check.Config // generic metadata about the check
+	Host          string       `optiontype:"required"`                      // IP of Hostname for the MySQL server
+	Username      string       `optiontype:"required"`                      // Username for the database
+	Password      string       `optiontype:"required"`                      // Password for the user
+	Database      string       `optiontype:"required"`                      // Name of the database to access
+	Table         string       `optiontype:"optional"`                      // Name of the table to access, if Query isn't set
+	Column        string       `optiontype:"optional"`                      // Name of the column to access, if Query isn't set
+	MatchContent  string       `optiontype:"optional"`                      // Whether to perform a regex content match on the results of the query
+	ContentRegex  string       `optiontype:"optional" optiondefault:".*"`   // Regex to match on
+	Port          string       `optiontype:"optional" optiondefault:"3306"` // Port for the server
+	Query         string       `optiontype:"optional"`                      // The query to run instead of selecting Column from Table
+	ExpectedRows  int          `optiontype:"optional"`                      // The fewest rows that the query must return
+	ExpectedValue string       `optiontype:"optional"`                      // Regex that the first column of the first row must match
+	TLS           string       `optiontype:"optional"`                      // Whether to require TLS
+	Verify        string       `optiontype:"optional"`                      // Whether the server's certificate should be validated
+	CA            string       `optiontype:"optional"`                      // PEM CA certificates to trust instead of the system pool
 }
 
 // Run a single instance of the check
@@ -33,15 +42,27 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
+	query := d.Query
+	if query == "" {
+		if d.Table == "" || d.Column == "" {
+			result.Message = "Either Query or both Table and Column must be set"
+			return result
+		}
+		// TODO: This is SQL injectable. Figure out Paramerterized queries
+		query = fmt.Sprintf("SELECT %s FROM %s;", d.Column, d.Table)
+	}
+
 	// Create DB handle
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", d.Username, d.Password, d.Host, d.Port, d.Database))
+	connector, err := d.connector()
 	if err != nil {
 		result.Message = fmt.Sprintf("Creating database handle failed : %s", err)
 		return result
 	}
+	db := sql.OpenDB(connector)
 	defer db.Close()
 
-	// Set connection parameters
+	// Set connection parameters. Connections aren't kept around after the
+	// check, so that teams' connection limits aren't used up between rounds.
 	db.SetMaxIdleConns(-1)
 	db.SetMaxOpenConns(1)
 
@@ -49,58 +70,140 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	err = db.PingContext(ctx)
 	if err != nil {
 		result.Message = fmt.Sprintf("Failed to ping database : %s", err)
+		return result
 	}
 
 	// Query the DB
-	// TODO: This is SQL injectable. Figure out Paramerterized queries
-	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s;", d.Column, d.Table))
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		result.Message = fmt.Sprintf("Could not query database : %s", err)
 		return result
 	}
 	defer rows.Close()
 
-	// Store the value from the column
-	var val string
+	columns, err := rows.Columns()
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not get query columns : %s", err)
+		return result
+	}
+	if len(columns) == 0 {
+		result.Message = "Query did not return any columns"
+		return result
+	}
 
-	// Perform regex matching, if necessary
+	// Compile the regexes
+	var contentRegex, valueRegex *regexp.Regexp
 	if matchContent, _ := strconv.ParseBool(d.MatchContent); matchContent {
-		// Compile the regex
-		regex, err := regexp.Compile(d.ContentRegex)
+		contentRegex, err = regexp.Compile(d.ContentRegex)
 		if err != nil {
 			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ContentRegex, err)
 			return result
 		}
+	}
+	if d.ExpectedValue != "" {
+		valueRegex, err = regexp.Compile(d.ExpectedValue)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ExpectedValue, err)
+			return result
+		}
+	}
 
-		// Check the rows
-		for rows.Next() {
-			// Grab a value
-			err := rows.Scan(&val)
-			if err != nil {
-				result.Message = fmt.Sprintf("Could not scan row values : %s", err)
-				return result
-			}
-			// Check value with regex
-			if regex.MatchString(val) {
-				// If we reach here the check passes
-				result.Passed = true
+	// Check the first column of each row
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	count := 0
+	matched := false
+	for rows.Next() {
+		err := rows.Scan(dest...)
+		if err != nil {
+			result.Message = fmt.Sprintf("Could not scan row values : %s", err)
+			return result
+		}
+		val := string(values[0])
+		if count == 0 {
+			result.AdminDetails = map[string]string{"first_value": val}
+			if valueRegex != nil && !valueRegex.MatchString(val) {
+				result.Message = "First value returned by the query does not match the expected value"
 				return result
 			}
-
+		}
+		count++
+		if contentRegex != nil && contentRegex.MatchString(val) {
+			matched = true
 		}
 	}
 
 	// Check for error in the rows
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		result.Message = fmt.Sprintf("Something happened to the rows : %s", err)
 		return result
 	}
 
+	if count < d.ExpectedRows {
+		result.Message = fmt.Sprintf("Query returned %d rows, but expected at least %d", count, d.ExpectedRows)
+		return result
+	}
+	if valueRegex != nil && count == 0 {
+		result.Message = "Query did not return any rows"
+		return result
+	}
+	if contentRegex != nil && !matched {
+		result.Message = "Matching content not found"
+		return result
+	}
+
 	// Check passes if we reach here
 	result.Passed = true
 	return result
 }
 
+// dialNetwork is the name that the driver knows the check's dialer by.
+const dialNetwork = "scorestack"
+
+func init() {
+	// The driver only takes custom dialers by name, but it passes the
+	// context of the check to them
+	mysql.RegisterDialContext(dialNetwork, func(ctx context.Context, addr string) (net.Conn, error) {
+		var dialer check.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	})
+}
+
+// connector creates a connector for the database, which requires TLS if it
+// is enabled.
+func (d *Definition) connector() (driver.Connector, error) {
+	cfg := mysql.NewConfig()
+	cfg.User = d.Username
+	cfg.Passwd = d.Password
+	cfg.Net = dialNetwork
+	cfg.Addr = net.JoinHostPort(d.Host, d.Port)
+	cfg.DBName = d.Database
+
+	if useTLS, _ := strconv.ParseBool(d.TLS); useTLS {
+		verify, _ := strconv.ParseBool(d.Verify)
+		tlsConfig, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = d.Host
+
+		// The driver only takes custom TLS configs by name, and copies them
+		// when the connector is created
+		name := fmt.Sprintf("scorestack-%p", tlsConfig)
+		err = mysql.RegisterTLSConfig(name, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		defer mysql.DeregisterTLSConfig(name)
+		cfg.TLSConfig = name
+	}
+
+	return mysql.NewConnector(cfg)
+}
+
 // GetConfig returns the current CheckConfig struct this check has been
 // configured with
 func (d *Definition) GetConfig() check.Config {
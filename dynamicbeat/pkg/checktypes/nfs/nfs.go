@@ -0,0 +1,216 @@
+package nfs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"go.uber.org/zap"
+)
+
+// The Definition configures the behavior of the NFS check
+// it implements the "check" interface
+type Definition struct {
+	Config      check.Config // generic metadata about the check
+	Host        string       `optiontype:"required"`                         // IP or hostname of the NFS server
+	Port        string       `optiontype:"optional" optiondefault:"111"`     // Port of the portmapper
+	ExportPath  string       `optiontype:"required"`                         // The export to mount, like /srv/nfs
+	FilePath    string       `optiontype:"optional"`                         // Path of a file to read, relative to the export
+	ContentHash string       `optiontype:"optional"`                         // The SHA256 hash that the file must have
+	MaxBytes    int64        `optiontype:"optional" optiondefault:"1048576"` // The largest file that is read
+	Write       string       `optiontype:"optional"`                         // Whether to write and remove a scratch file to check that the export is writable
+	UID         int          `optiontype:"optional"`                         // The user ID to present to the server
+	GID         int          `optiontype:"optional"`                         // The group ID to present to the server
+}
+
+// readSize is how much of the file is requested at once.
+const readSize = 64 << 10
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	port, err := strconv.Atoi(d.Port)
+	if err != nil {
+		result.Message = fmt.Sprintf("Invalid port %s : %s", d.Port, err)
+		return result
+	}
+	if d.ContentHash != "" && d.FilePath == "" {
+		result.Message = "FilePath must be set to check the ContentHash"
+		return result
+	}
+	writable, _ := strconv.ParseBool(d.Write)
+	uid, gid := uint32(d.UID), uint32(d.GID)
+
+	// Find the mount daemon and NFS server through the portmapper
+	mountPort, err := getPort(ctx, d.Host, port, mountProgram, mountVersion)
+	if err != nil {
+		result.Message = d.portmapError("mount daemon", err)
+		return result
+	}
+	nfsPort, err := getPort(ctx, d.Host, port, nfsProgram, nfsVersion)
+	if err != nil {
+		result.Message = d.portmapError("NFSv3 server", err)
+		return result
+	}
+
+	// Mount the export
+	mountClient, err := dialRPC(ctx, d.Host, mountPort, mountProgram, mountVersion, uid, gid)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to mount daemon on %s : %s", d.Host, err)
+		return result
+	}
+	defer mountClient.Close()
+	root, err := mount(mountClient, d.ExportPath)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		result.Message = d.mountError(mountClient, err)
+		return result
+	}
+	if err != nil {
+		result.Message = fmt.Sprintf("Mounting %s failed : %s", d.ExportPath, err)
+		return result
+	}
+	defer func() {
+		err := unmount(mountClient, d.ExportPath)
+		if err != nil {
+			zap.S().Debugf("Failed to unmount %s from %s: %s", d.ExportPath, d.Host, err)
+		}
+	}()
+
+	nfsClient, err := dialRPC(ctx, d.Host, nfsPort, nfsProgram, nfsVersion, uid, gid)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to NFS server on %s : %s", d.Host, err)
+		return result
+	}
+	defer nfsClient.Close()
+
+	if d.FilePath != "" {
+		content, message := d.readFile(nfsClient, root)
+		if message != "" {
+			result.Message = message
+			return result
+		}
+		hash := sha256.Sum256(content)
+		result.Details = map[string]string{"sha256": hex.EncodeToString(hash[:])}
+		if d.ContentHash != "" && !strings.EqualFold(result.Details["sha256"], d.ContentHash) {
+			result.Message = fmt.Sprintf("File %s has SHA256 hash %s instead of %s", d.FilePath, result.Details["sha256"], d.ContentHash)
+			return result
+		}
+	}
+
+	if writable {
+		if message := d.writeScratch(nfsClient, root); message != "" {
+			result.Message = message
+			return result
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// readFile reads the whole file at FilePath. It returns why the file
+// couldn't be read, or an empty string if it was.
+func (d *Definition) readFile(client *rpcClient, root []byte) ([]byte, string) {
+	handle, attrs, err := lookup(client, root, d.FilePath)
+	if err != nil {
+		return nil, fmt.Sprintf("Failed to find %s in %s : %s", d.FilePath, d.ExportPath, err)
+	}
+	if attrs.fileType != 0 && attrs.fileType != fileTypeRegular {
+		return nil, fmt.Sprintf("%s is not a regular file", d.FilePath)
+	}
+	if attrs.size > uint64(d.MaxBytes) {
+		return nil, fmt.Sprintf("File %s is larger than %d bytes", d.FilePath, d.MaxBytes)
+	}
+
+	var content []byte
+	for {
+		data, eof, err := read(client, handle, uint64(len(content)), readSize)
+		if err != nil {
+			return nil, fmt.Sprintf("Failed to read %s : %s", d.FilePath, err)
+		}
+		content = append(content, data...)
+		if int64(len(content)) > d.MaxBytes {
+			return nil, fmt.Sprintf("File %s is larger than %d bytes", d.FilePath, d.MaxBytes)
+		}
+		if eof || len(data) == 0 {
+			return content, ""
+		}
+	}
+}
+
+// writeScratch writes a scratch file to the root of the export and removes
+// it. It returns why the file couldn't be written or removed, or an empty
+// string if it was.
+func (d *Definition) writeScratch(client *rpcClient, root []byte) string {
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return fmt.Sprintf("Failed to generate a scratch file name : %s", err)
+	}
+	name := ".scorestack-" + hex.EncodeToString(suffix)
+	display := path.Join(d.ExportPath, name)
+
+	handle, err := create(client, root, name)
+	if err != nil {
+		return fmt.Sprintf("Failed to create scratch file %s : %s", display, err)
+	}
+	err = write(client, handle, []byte("scorestack\n"))
+	if err != nil {
+		_ = remove(client, root, name)
+		return fmt.Sprintf("Failed to write scratch file %s : %s", display, err)
+	}
+	err = remove(client, root, name)
+	if err != nil {
+		return fmt.Sprintf("Failed to remove scratch file %s : %s", display, err)
+	}
+	return ""
+}
+
+// portmapError describes why the port of a service couldn't be found.
+func (d *Definition) portmapError(service string, err error) string {
+	if errors.Is(err, errPortmap) {
+		return fmt.Sprintf("The %s is not registered with the portmapper on %s", service, d.Host)
+	}
+	return fmt.Sprintf("Portmapper request to %s failed : %s", d.Host, err)
+}
+
+// mountError describes why the mount daemon refused to mount the export,
+// with the exports that the server has.
+func (d *Definition) mountError(client *rpcClient, err error) string {
+	paths, listErr := exports(client)
+	if listErr != nil {
+		return fmt.Sprintf("Mount of %s was denied : %s", d.ExportPath, err)
+	}
+	for _, p := range paths {
+		if p == d.ExportPath {
+			return fmt.Sprintf("Mount of %s was denied : %s ; it is exported, but not to Dynamicbeat", d.ExportPath, err)
+		}
+	}
+	if len(paths) == 0 {
+		return fmt.Sprintf("Mount of %s was denied : %s ; the server does not export anything", d.ExportPath, err)
+	}
+	return fmt.Sprintf("Mount of %s was denied : %s ; the server only exports %s", d.ExportPath, err, strings.Join(paths, ", "))
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
@@ -0,0 +1,255 @@
+package nfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MOUNT and NFSv3 procedure numbers used by the check.
+const (
+	mountProcMount   = 1
+	mountProcUnmount = 3
+	mountProcExport  = 5
+
+	nfsProcLookup = 3
+	nfsProcRead   = 6
+	nfsProcWrite  = 7
+	nfsProcCreate = 8
+	nfsProcRemove = 12
+)
+
+// fileTypeRegular is the ftype3 of regular files.
+const fileTypeRegular = 1
+
+// A statusError is a MOUNT or NFSv3 procedure that failed with a status
+// code.
+type statusError struct {
+	procedure string
+	status    uint32
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s failed : %s", e.procedure, statusName(e.status))
+}
+
+// statusName returns the name of a mountstat3 or nfsstat3 code.
+func statusName(status uint32) string {
+	switch status {
+	case 1:
+		return "permission denied (NFS3ERR_PERM)"
+	case 2:
+		return "no such file or directory (NFS3ERR_NOENT)"
+	case 5:
+		return "I/O error (NFS3ERR_IO)"
+	case 13:
+		return "access denied (NFS3ERR_ACCES)"
+	case 17:
+		return "file exists (NFS3ERR_EXIST)"
+	case 20:
+		return "not a directory (NFS3ERR_NOTDIR)"
+	case 21:
+		return "is a directory (NFS3ERR_ISDIR)"
+	case 22:
+		return "invalid argument (NFS3ERR_INVAL)"
+	case 28:
+		return "no space left on device (NFS3ERR_NOSPC)"
+	case 30:
+		return "read-only file system (NFS3ERR_ROFS)"
+	case 63:
+		return "name too long (NFS3ERR_NAMETOOLONG)"
+	case 69:
+		return "disk quota exceeded (NFS3ERR_DQUOT)"
+	case 70:
+		return "stale file handle (NFS3ERR_STALE)"
+	case 10004:
+		return "operation not supported (NFS3ERR_NOTSUPP)"
+	case 10006:
+		return "server fault (NFS3ERR_SERVERFAULT)"
+	default:
+		return fmt.Sprintf("status %d", status)
+	}
+}
+
+// mount asks the mount daemon for the file handle of an export.
+func mount(client *rpcClient, export string) ([]byte, error) {
+	var args xdrWriter
+	args.string(export)
+	r, err := client.call(mountProcMount, args.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	status := r.uint32()
+	if r.err == nil && status != 0 {
+		return nil, &statusError{procedure: "MNT", status: status}
+	}
+	handle := r.opaque()
+	return handle, r.err
+}
+
+// unmount tells the mount daemon that the export isn't mounted anymore.
+func unmount(client *rpcClient, export string) error {
+	var args xdrWriter
+	args.string(export)
+	_, err := client.call(mountProcUnmount, args.Bytes())
+	return err
+}
+
+// exports lists the paths that the mount daemon exports.
+func exports(client *rpcClient) ([]string, error) {
+	r, err := client.call(mountProcExport, nil)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for r.bool() {
+		paths = append(paths, r.string())
+		// Skip the groups that are allowed to mount the export
+		for r.bool() {
+			r.string()
+		}
+	}
+	return paths, r.err
+}
+
+// attributes are the parts of an fattr3 that the check uses.
+type attributes struct {
+	fileType uint32
+	size     uint64
+}
+
+// readAttributes reads a post_op_attr.
+func readAttributes(r *xdrReader) (attributes, bool) {
+	if !r.bool() {
+		return attributes{}, false
+	}
+	var a attributes
+	a.fileType = r.uint32()
+	r.next(16) // mode, nlink, uid, gid
+	a.size = r.uint64()
+	r.next(56) // used, rdev, fsid, fileid, atime, mtime, ctime
+	return a, true
+}
+
+// skipWcc skips over a wcc_data.
+func skipWcc(r *xdrReader) {
+	if r.bool() {
+		r.next(24) // size, mtime, ctime
+	}
+	readAttributes(r)
+}
+
+// nfsCall calls an NFSv3 procedure, and returns a reader for the results
+// once it has checked that the status is NFS3_OK.
+func nfsCall(client *rpcClient, procedure uint32, name string, args []byte) (*xdrReader, error) {
+	r, err := client.call(procedure, args)
+	if err != nil {
+		return nil, err
+	}
+	status := r.uint32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if status != 0 {
+		return nil, &statusError{procedure: name, status: status}
+	}
+	return r, nil
+}
+
+// lookup finds the file handle and attributes of a path under a directory.
+func lookup(client *rpcClient, dir []byte, path string) ([]byte, attributes, error) {
+	handle := dir
+	var attrs attributes
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		var args xdrWriter
+		args.opaque(handle)
+		args.string(name)
+		r, err := nfsCall(client, nfsProcLookup, "LOOKUP", args.Bytes())
+		if err != nil {
+			return nil, attrs, err
+		}
+		handle = r.opaque()
+		attrs, _ = readAttributes(r)
+		if r.err != nil {
+			return nil, attrs, r.err
+		}
+	}
+	return handle, attrs, nil
+}
+
+// read reads part of a file, and says whether the end of the file was
+// reached.
+func read(client *rpcClient, handle []byte, offset uint64, count uint32) ([]byte, bool, error) {
+	var args xdrWriter
+	args.opaque(handle)
+	args.uint64(offset)
+	args.uint32(count)
+	r, err := nfsCall(client, nfsProcRead, "READ", args.Bytes())
+	if err != nil {
+		return nil, false, err
+	}
+	readAttributes(r)
+	r.uint32() // count
+	eof := r.bool()
+	data := r.opaque()
+	return data, eof, r.err
+}
+
+// create creates a new file in a directory, and returns its handle.
+func create(client *rpcClient, dir []byte, name string) ([]byte, error) {
+	var args xdrWriter
+	args.opaque(dir)
+	args.string(name)
+	args.uint32(1) // GUARDED, so that existing files aren't truncated
+	// Leave all of the attributes to the server, since some servers can't
+	// set them and fail the call after creating the file
+	for i := 0; i < 6; i++ {
+		args.uint32(0)
+	}
+	r, err := nfsCall(client, nfsProcCreate, "CREATE", args.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if r.bool() {
+		return r.opaque(), r.err
+	}
+
+	// The server didn't send the handle, so look it up
+	handle, _, err := lookup(client, dir, name)
+	return handle, err
+}
+
+// write writes some data to the start of a file, and makes sure that the
+// server has stored all of it.
+func write(client *rpcClient, handle []byte, data []byte) error {
+	var args xdrWriter
+	args.opaque(handle)
+	args.uint64(0)
+	args.uint32(uint32(len(data)))
+	args.uint32(2) // FILE_SYNC
+	args.opaque(data)
+	r, err := nfsCall(client, nfsProcWrite, "WRITE", args.Bytes())
+	if err != nil {
+		return err
+	}
+	skipWcc(r)
+	count := r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+	if int(count) != len(data) {
+		return fmt.Errorf("WRITE only wrote %d of %d bytes", count, len(data))
+	}
+	return nil
+}
+
+// remove removes a file from a directory.
+func remove(client *rpcClient, dir []byte, name string) error {
+	var args xdrWriter
+	args.opaque(dir)
+	args.string(name)
+	_, err := nfsCall(client, nfsProcRemove, "REMOVE", args.Bytes())
+	return err
+}
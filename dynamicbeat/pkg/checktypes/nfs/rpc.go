@@ -0,0 +1,297 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// ONC RPC program numbers and versions used by the check.
+const (
+	portmapProgram = 100000
+	portmapVersion = 2
+	mountProgram   = 100005
+	mountVersion   = 3
+	nfsProgram     = 100003
+	nfsVersion     = 3
+)
+
+// maxRecord is the largest RPC reply that is read.
+const maxRecord = 4 << 20
+
+// errPortmap is returned when a program isn't registered with the
+// portmapper.
+var errPortmap = errors.New("program is not registered")
+
+// An rpcClient makes ONC RPC calls over a TCP connection, with AUTH_UNIX
+// credentials.
+type rpcClient struct {
+	conn    net.Conn
+	program uint32
+	version uint32
+	uid     uint32
+	gid     uint32
+	xid     uint32
+}
+
+// dialRPC connects to an RPC program. Servers often only accept requests
+// from reserved ports, so one is used if Dynamicbeat is allowed to bind it.
+func dialRPC(ctx context.Context, host string, port int, program uint32, version uint32, uid uint32, gid uint32) (*rpcClient, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	var conn net.Conn
+	var err error
+	var dialer check.Dialer
+	if check.HasTunnel(ctx) {
+		// The jump host picks the source port of connections through it
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		for attempt := 0; attempt < 10; attempt++ {
+			reserved := net.Dialer{LocalAddr: &net.TCPAddr{Port: 512 + rand.Intn(512)}}
+			conn, err = reserved.DialContext(ctx, "tcp", address)
+			if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+				break
+			}
+		}
+		if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) {
+			conn, err = dialer.DialContext(ctx, "tcp", address)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return &rpcClient{
+		conn:    conn,
+		program: program,
+		version: version,
+		uid:     uid,
+		gid:     gid,
+		xid:     rand.Uint32(),
+	}, nil
+}
+
+// Close closes the connection.
+func (c *rpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// call runs a procedure with some encoded arguments, and returns a reader
+// for the results.
+func (c *rpcClient) call(procedure uint32, args []byte) (*xdrReader, error) {
+	c.xid++
+	var w xdrWriter
+	w.uint32(c.xid)
+	w.uint32(0) // CALL
+	w.uint32(2) // RPC version
+	w.uint32(c.program)
+	w.uint32(c.version)
+	w.uint32(procedure)
+
+	// AUTH_UNIX credentials, with no verifier
+	var cred xdrWriter
+	cred.uint32(uint32(time.Now().Unix()))
+	cred.string("scorestack")
+	cred.uint32(c.uid)
+	cred.uint32(c.gid)
+	cred.uint32(0) // no supplementary groups
+	w.uint32(1)
+	w.opaque(cred.Bytes())
+	w.uint32(0)
+	w.opaque(nil)
+	w.Write(args)
+
+	// Send the call as a single record
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, 1<<31|uint32(w.Len()))
+	_, err := c.conn.Write(append(header, w.Bytes()...))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		reply, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		r := &xdrReader{b: reply}
+		if r.uint32() != c.xid {
+			// A reply to an earlier call that timed out
+			continue
+		}
+		return r, parseReply(r)
+	}
+}
+
+// readRecord reads the fragments of a record.
+func (c *rpcClient) readRecord() ([]byte, error) {
+	var record []byte
+	header := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(c.conn, header)
+		if err != nil {
+			return nil, err
+		}
+		fragment := binary.BigEndian.Uint32(header)
+		size := int(fragment &^ (1 << 31))
+		if len(record)+size > maxRecord {
+			return nil, fmt.Errorf("RPC reply is larger than %d bytes", maxRecord)
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(c.conn, data)
+		if err != nil {
+			return nil, err
+		}
+		record = append(record, data...)
+		if fragment&(1<<31) != 0 {
+			return record, nil
+		}
+	}
+}
+
+// parseReply reads the header of a reply after its XID, and returns why the
+// call wasn't accepted if it wasn't.
+func parseReply(r *xdrReader) error {
+	if r.uint32() != 1 {
+		return fmt.Errorf("server sent an RPC call instead of a reply")
+	}
+	if r.uint32() != 0 {
+		// The call was denied
+		if r.uint32() == 0 {
+			return fmt.Errorf("RPC version mismatch")
+		}
+		return fmt.Errorf("RPC authentication failed with status %d", r.uint32())
+	}
+	r.uint32() // verifier flavor
+	r.opaque() // verifier body
+	switch status := r.uint32(); status {
+	case 0:
+		return r.err
+	case 1:
+		return fmt.Errorf("program is not available")
+	case 2:
+		return fmt.Errorf("program version is not supported")
+	case 3:
+		return fmt.Errorf("procedure is not available")
+	case 4:
+		return fmt.Errorf("server could not decode the arguments")
+	default:
+		return fmt.Errorf("RPC failed with status %d", status)
+	}
+}
+
+// getPort asks the portmapper which TCP port a program is listening on.
+func getPort(ctx context.Context, host string, port int, program uint32, version uint32) (int, error) {
+	client, err := dialRPC(ctx, host, port, portmapProgram, portmapVersion, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	var args xdrWriter
+	args.uint32(program)
+	args.uint32(version)
+	args.uint32(6) // TCP
+	args.uint32(0)
+	r, err := client.call(3, args.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	mapped := r.uint32()
+	if r.err != nil {
+		return 0, r.err
+	}
+	if mapped == 0 {
+		return 0, errPortmap
+	}
+	return int(mapped), nil
+}
+
+// An xdrWriter encodes XDR data.
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	w.Write(b)
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	w.Write(b)
+}
+
+func (w *xdrWriter) opaque(v []byte) {
+	w.uint32(uint32(len(v)))
+	w.Write(v)
+	w.Write(make([]byte, (4-len(v)%4)%4))
+}
+
+func (w *xdrWriter) string(v string) {
+	w.opaque([]byte(v))
+}
+
+// An xdrReader decodes XDR data. Once a read fails, the rest of the reads
+// return zero values, and err says why the first one failed.
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+func (r *xdrReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = fmt.Errorf("RPC reply is too short")
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *xdrReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *xdrReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+func (r *xdrReader) opaque() []byte {
+	n := int(r.uint32())
+	v := r.next(n)
+	r.next((4 - n%4) % 4)
+	return v
+}
+
+func (r *xdrReader) string() string {
+	return string(r.opaque())
+}
@@ -0,0 +1,164 @@
+package ntp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// The Definition configures the behavior of the NTP check
+// it implements the "check" interface
+type Definition struct {
+	Config     check.Config // generic metadata about the check
+	Host       string       `optiontype:"required"`                     // IP or hostname of the NTP server
+	Port       string       `optiontype:"optional" optiondefault:"123"` // Port of the NTP server
+	MaxStratum int          `optiontype:"optional" optiondefault:"15"`  // The highest stratum that the server can report
+	MaxOffset  string       `optiontype:"optional"`                     // The largest difference between the server's clock and Dynamicbeat's clock, like 500ms
+}
+
+const (
+	packetSize     = 48
+	modeClient     = 3
+	modeServer     = 4
+	leapNotSynced  = 3          // the leap indicator of servers whose clocks aren't synchronized
+	ntpEpochOffset = 2208988800 // the seconds between the NTP epoch in 1900 and the Unix epoch
+)
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	var maxOffset time.Duration
+	if d.MaxOffset != "" {
+		var err error
+		maxOffset, err = time.ParseDuration(d.MaxOffset)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error parsing max offset %s : %s", d.MaxOffset, err)
+			return result
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(d.Host, d.Port))
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	// Send an SNTP request. The transmit timestamp is sent back as the origin
+	// timestamp of the response, which shows that the response is for this
+	// request.
+	request := make([]byte, packetSize)
+	request[0] = 4<<3 | modeClient
+	sent := time.Now()
+	putTimestamp(request[40:48], sent)
+	_, err = conn.Write(request)
+	if err != nil {
+		result.Message = fmt.Sprintf("Failed to send request to %s : %s", d.Host, err)
+		return result
+	}
+
+	var response []byte
+	var received time.Time
+	buf := make([]byte, 1024)
+	for response == nil {
+		n, err := conn.Read(buf)
+		received = time.Now()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			result.Message = fmt.Sprintf("No response from NTP server %s", d.Host)
+			return result
+		}
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to read response from %s : %s", d.Host, err)
+			return result
+		}
+		if n >= packetSize && bytes.Equal(buf[24:32], request[40:48]) {
+			response = buf[:n]
+		}
+	}
+
+	leap := response[0] >> 6
+	mode := response[0] & 0x7
+	stratum := int(response[1])
+	if mode != modeServer {
+		result.Message = fmt.Sprintf("Response from %s is not an NTP server response", d.Host)
+		return result
+	}
+
+	// Servers that refuse to answer send a kiss-of-death response, which has
+	// a stratum of 0 and a code in the reference ID
+	if stratum == 0 {
+		code := strings.TrimRight(string(response[12:16]), "\x00")
+		result.Message = fmt.Sprintf("NTP server %s sent a kiss-of-death response with code %s", d.Host, code)
+		return result
+	}
+
+	// The offset and delay come from the four timestamps of the exchange
+	serverReceived := timestamp(response[32:40])
+	serverSent := timestamp(response[40:48])
+	offset := (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2
+	delay := received.Sub(sent) - serverSent.Sub(serverReceived)
+	result.Details = map[string]string{
+		"stratum": strconv.Itoa(stratum),
+		"offset":  offset.String(),
+		"delay":   delay.String(),
+	}
+
+	if leap == leapNotSynced {
+		result.Message = fmt.Sprintf("NTP server %s is not synchronized", d.Host)
+		return result
+	}
+	if stratum > d.MaxStratum {
+		result.Message = fmt.Sprintf("NTP server %s has stratum %d, but the maximum is %d", d.Host, stratum, d.MaxStratum)
+		return result
+	}
+	if maxOffset > 0 && (offset > maxOffset || offset < -maxOffset) {
+		result.Message = fmt.Sprintf("Offset of %s from NTP server %s is larger than the maximum of %s", offset, d.Host, d.MaxOffset)
+		return result
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// putTimestamp writes a time as an NTP timestamp, which is the seconds since
+// 1900 followed by the fraction of a second.
+func putTimestamp(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b[0:4], uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:8], uint32((uint64(t.Nanosecond())<<32)/uint64(time.Second)))
+}
+
+// timestamp reads an NTP timestamp.
+func timestamp(b []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	nanos := (uint64(binary.BigEndian.Uint32(b[4:8])) * uint64(time.Second)) >> 32
+	return time.Unix(seconds, int64(nanos))
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
@@ -0,0 +1,142 @@
+package pop3
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// conn is a small POP3 client for the commands that the check needs.
+type conn struct {
+	raw  net.Conn
+	text *textproto.Reader
+}
+
+// dial connects to a POP3 server and reads its greeting. If config is set,
+// the connection uses TLS from the start. Every command must finish before
+// the deadline of the context.
+func dial(ctx context.Context, addr string, config *tls.Config) (*conn, error) {
+	dialer := check.Dialer{Timeout: 20 * time.Second}
+	var raw net.Conn
+	var err error
+	if config != nil {
+		raw, err = dialer.DialTLS(ctx, "tcp", addr, config)
+	} else {
+		raw, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = raw.SetDeadline(deadline)
+	}
+
+	c := &conn{raw: raw, text: textproto.NewReader(bufio.NewReader(raw))}
+	_, err = c.response()
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// response reads a single line response, and returns an error if it isn't
+// +OK.
+func (c *conn) response() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	}
+	return "", fmt.Errorf("server responded with %s", line)
+}
+
+// cmd sends a command and reads its single line response.
+func (c *conn) cmd(format string, args ...interface{}) (string, error) {
+	_, err := fmt.Fprintf(c.raw, format+"\r\n", args...)
+	if err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+// stls upgrades the connection to TLS with STLS.
+func (c *conn) stls(config *tls.Config) error {
+	_, err := c.cmd("STLS")
+	if err != nil {
+		return err
+	}
+	t := tls.Client(c.raw, config)
+	err = t.Handshake()
+	if err != nil {
+		return err
+	}
+	c.raw = t
+	c.text = textproto.NewReader(bufio.NewReader(t))
+	return nil
+}
+
+// login authenticates with USER and PASS.
+func (c *conn) login(user string, password string) error {
+	_, err := c.cmd("USER %s", user)
+	if err != nil {
+		return err
+	}
+	_, err = c.cmd("PASS %s", password)
+	return err
+}
+
+// stat returns the number of messages in the mailbox.
+func (c *conn) stat() (int, error) {
+	msg, err := c.cmd("STAT")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(msg)
+	if len(fields) < 1 {
+		return 0, fmt.Errorf("unexpected STAT response: %s", msg)
+	}
+	return strconv.Atoi(fields[0])
+}
+
+// retr downloads a message, and returns up to max bytes of it. The rest of
+// the message is read and discarded.
+func (c *conn) retr(n int, max int64) ([]byte, error) {
+	_, err := c.cmd("RETR %d", n)
+	if err != nil {
+		return nil, err
+	}
+	r := c.text.DotReader()
+	msg, err := ioutil.ReadAll(io.LimitReader(r, max))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	return msg, err
+}
+
+// quit ends the session and closes the connection. The response isn't
+// waited for, since the check is already done.
+func (c *conn) quit() error {
+	_, err := fmt.Fprintf(c.raw, "QUIT\r\n")
+	if cerr := c.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *conn) close() error {
+	return c.raw.Close()
+}
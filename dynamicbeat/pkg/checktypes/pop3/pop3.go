@@ -0,0 +1,155 @@
+package pop3
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// The Definition configures the behavior of the POP3 check
+// it implements the "check" interface
+type Definition struct {
+	Config       check.Config // generic metadata about the check
+	Host         string       `optiontype:"required"` // IP or hostname for the POP3 server
+	Username     string       `optiontype:"required"` // Username for the POP3 server
+	Password     string       `optiontype:"required"` // Password for the user of the POP3 server
+	Encryption   string       `optiontype:"optional"` // none, starttls, or pop3s
+	Verify       string       `optiontype:"optional"` // Whether the server's certificate should be validated
+	CA           string       `optiontype:"optional"` // PEM CA certificates to trust instead of the system pool
+	Port         string       `optiontype:"optional"` // Port for the POP3 server; defaults to 995 for pop3s, or 110 otherwise
+	MinMessages  int          `optiontype:"optional"` // The fewest messages that must be in the mailbox
+	MessageRegex string       `optiontype:"optional"` // Regex that the newest message must match
+}
+
+// maxMessage is the most of a message that is checked against MessageRegex.
+const maxMessage = 64 << 10
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	encryption := strings.ToLower(d.Encryption)
+	if encryption == "" {
+		encryption = "none"
+	}
+	port := d.Port
+	switch encryption {
+	case "none", "starttls":
+		if port == "" {
+			port = "110"
+		}
+	case "pop3s":
+		if port == "" {
+			port = "995"
+		}
+	default:
+		result.Message = fmt.Sprintf("Unknown encryption %s - must be none, starttls, or pop3s", d.Encryption)
+		return result
+	}
+	var regex *regexp.Regexp
+	if d.MessageRegex != "" {
+		var err error
+		regex, err = regexp.Compile(d.MessageRegex)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.MessageRegex, err)
+			return result
+		}
+	}
+
+	// Certificates are only validated if Verify is set
+	verify, _ := strconv.ParseBool(d.Verify)
+	tlsConfig, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+	if err != nil {
+		result.Message = fmt.Sprintf("Invalid TLS configuration : %s", err)
+		return result
+	}
+	tlsConfig.ServerName = d.Host
+
+	// Connect to server with TLS or not
+	var implicit *tls.Config
+	if encryption == "pop3s" {
+		implicit = tlsConfig
+	}
+	c, err := dial(ctx, net.JoinHostPort(d.Host, port), implicit)
+	if err != nil {
+		result.Message = fmt.Sprintf("Connecting to server %s failed : %s", d.Host, err)
+		return result
+	}
+	defer func() {
+		err = c.quit()
+		if err != nil {
+			zap.S().Warnf("Failed to close POP3 connection: %s", err)
+		}
+	}()
+
+	if encryption == "starttls" {
+		err = c.stls(tlsConfig)
+		if err != nil {
+			result.Message = fmt.Sprintf("STLS with server %s failed : %s", d.Host, err)
+			return result
+		}
+	}
+
+	// Login
+	err = c.login(d.Username, d.Password)
+	if err != nil {
+		result.Message = fmt.Sprintf("Login with user %s failed : %s", d.Username, err)
+		return result
+	}
+
+	count, err := c.stat()
+	if err != nil {
+		result.Message = fmt.Sprintf("Getting mailbox status failed : %s", err)
+		return result
+	}
+	result.Details = map[string]string{"messages": strconv.Itoa(count)}
+	if count < d.MinMessages {
+		result.Message = fmt.Sprintf("Found %d messages, but expected at least %d", count, d.MinMessages)
+		return result
+	}
+
+	// Messages are numbered in the order that they were received, so the
+	// newest message has the highest number
+	if regex != nil {
+		if count == 0 {
+			result.Message = "No messages in the mailbox"
+			return result
+		}
+		msg, err := c.retr(count, maxMessage)
+		if err != nil {
+			result.Message = fmt.Sprintf("Retrieving message %d failed : %s", count, err)
+			return result
+		}
+		// The message might contain flags, so only admins get to see it
+		result.AdminDetails = map[string]string{"message": string(msg)}
+		if !regex.Match(msg) {
+			result.Message = "Matching content not found"
+			return result
+		}
+	}
+
+	// If we make it here the check passes
+	result.Passed = true
+	return result
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
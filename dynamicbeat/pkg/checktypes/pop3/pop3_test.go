@@ -0,0 +1,360 @@
+package pop3
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/internal/checktest"
+)
+
+// fakeServer is a scripted POP3 server, which replies like Dovecot does.
+type fakeServer struct {
+	listener  net.Listener
+	users     map[string]string // passwords by username
+	messages  []string          // the messages in every mailbox, oldest first
+	tls       *tls.Config       // the certificate for STLS and POP3S
+	pop3s     bool              // whether connections start with a TLS handshake
+	noSTLS    bool              // reply to STLS with an error
+	plaintext bool              // whether logins are allowed without TLS
+	greeting  string            // sent instead of the greeting, if it is set
+	hang      bool              // stop replying after the greeting
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// newFakeServer starts a fake server, which is set up by configure before it
+// accepts any connections.
+func newFakeServer(t *testing.T, configure func(s *fakeServer)) *fakeServer {
+	t.Helper()
+	s := &fakeServer{users: map[string]string{"alice": "hunter2"}, plaintext: true}
+	if configure != nil {
+		configure(s)
+	}
+	s.listener = checktest.Serve(t, s.serve)
+	return s
+}
+
+func (s *fakeServer) definition() *Definition {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &Definition{Host: host, Port: port, Username: "alice", Password: "hunter2"}
+}
+
+// recorded returns the commands that the server received, without their
+// arguments.
+func (s *fakeServer) recorded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	if s.pop3s {
+		conn = tls.Server(conn, s.tls)
+	}
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	if s.greeting != "" {
+		reply(s.greeting)
+		return
+	}
+	reply("+OK Dovecot ready.")
+	if s.hang {
+		_, _ = reader.ReadString('\n')
+		time.Sleep(time.Second)
+		return
+	}
+
+	secure := s.pop3s
+	user := ""
+	authed := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			reply("-ERR Unknown command.")
+			continue
+		}
+		command := strings.ToUpper(fields[0])
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.TrimSpace(line))
+		s.mu.Unlock()
+
+		switch {
+		case command == "QUIT":
+			reply("+OK Logging out.")
+			return
+		case command == "STLS" && !secure && !s.noSTLS && s.tls != nil:
+			reply("+OK Begin TLS negotiation now.")
+			conn = tls.Server(conn, s.tls)
+			reader = bufio.NewReader(conn)
+			secure = true
+		case command == "USER" && !authed:
+			if !secure && !s.plaintext {
+				reply("-ERR [AUTH] Plaintext authentication disallowed on non-secure (SSL/TLS) connections.")
+				continue
+			}
+			user = fields[1]
+			reply("+OK")
+		case command == "PASS" && !authed:
+			if want, ok := s.users[user]; !ok || len(fields) < 2 || fields[1] != want {
+				reply("-ERR [AUTH] Authentication failed.")
+				continue
+			}
+			authed = true
+			reply("+OK Logged in.")
+		case command == "STAT" && authed:
+			size := 0
+			for _, m := range s.messages {
+				size += len(m)
+			}
+			reply("+OK %d %d", len(s.messages), size)
+		case command == "RETR" && authed:
+			n, err := strconv.Atoi(strings.Join(fields[1:], " "))
+			if err != nil || n < 1 || n > len(s.messages) {
+				reply("-ERR There's no message %s.", strings.Join(fields[1:], " "))
+				continue
+			}
+			msg := s.messages[n-1]
+			reply("+OK %d octets", len(msg))
+			for _, l := range strings.Split(msg, "\n") {
+				// Lines that start with a dot are dot-stuffed
+				if strings.HasPrefix(l, ".") {
+					l = "." + l
+				}
+				reply("%s", l)
+			}
+			reply(".")
+		default:
+			reply("-ERR Unknown command.")
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	cert, ca := checktest.NewCert(t, "mail.example.com")
+	mailbox := func(s *fakeServer) {
+		s.messages = []string{
+			"Subject: Welcome\n\nHello, Alice.",
+			"Subject: Flag\n\nThe flag is\n.flag{pop3}\nGood luck.",
+		}
+	}
+	large := func(s *fakeServer) {
+		s.messages = []string{"Subject: Big\n\n" + strings.Repeat("x", maxMessage) + "\nflag{hidden}"}
+	}
+
+	tests := []struct {
+		name     string
+		server   func(s *fakeServer)
+		def      func(d *Definition)
+		passed   bool
+		message  string   // the start of the message
+		messages string   // the number of messages that the mailbox had
+		commands []string // the commands that the server received, if they are checked
+	}{
+		{
+			name:     "login",
+			server:   mailbox,
+			passed:   true,
+			messages: "2",
+			commands: []string{"USER alice", "PASS hunter2", "STAT", "QUIT"},
+		},
+		{
+			name:     "wrong password",
+			server:   mailbox,
+			def:      func(d *Definition) { d.Password = "hunter3" },
+			message:  "Login with user alice failed : server responded with -ERR [AUTH] Authentication failed.",
+			commands: []string{"USER alice", "PASS hunter3", "QUIT"},
+		},
+		{
+			name:    "unknown user",
+			def:     func(d *Definition) { d.Username = "mallory" },
+			message: "Login with user mallory failed : server responded with -ERR [AUTH] Authentication failed.",
+		},
+		{
+			name:    "plaintext authentication disallowed",
+			server:  func(s *fakeServer) { s.plaintext = false },
+			message: "Login with user alice failed : server responded with -ERR [AUTH] Plaintext authentication disallowed",
+		},
+		{
+			name:     "empty mailbox",
+			def:      func(d *Definition) { d.MinMessages = 1 },
+			message:  "Found 0 messages, but expected at least 1",
+			messages: "0",
+		},
+		{
+			name:     "empty mailbox with a regex",
+			def:      func(d *Definition) { d.MessageRegex = "flag" },
+			message:  "No messages in the mailbox",
+			messages: "0",
+		},
+		{
+			name:     "too few messages",
+			server:   mailbox,
+			def:      func(d *Definition) { d.MinMessages = 3 },
+			message:  "Found 2 messages, but expected at least 3",
+			messages: "2",
+		},
+		{
+			// Only the newest message is retrieved, and dot-stuffing is
+			// removed from it
+			name:     "content match",
+			server:   mailbox,
+			def:      func(d *Definition) { d.MinMessages, d.MessageRegex = 1, `(?m)^\.flag\{pop3\}$` },
+			passed:   true,
+			messages: "2",
+			commands: []string{"USER alice", "PASS hunter2", "STAT", "RETR 2", "QUIT"},
+		},
+		{
+			name:     "content doesn't match",
+			server:   mailbox,
+			def:      func(d *Definition) { d.MessageRegex = "Hello, Alice" },
+			message:  "Matching content not found",
+			messages: "2",
+		},
+		{
+			name:     "content past the limit",
+			server:   large,
+			def:      func(d *Definition) { d.MessageRegex = "flag" },
+			message:  "Matching content not found",
+			messages: "1",
+		},
+		{
+			name:     "starttls",
+			server:   func(s *fakeServer) { mailbox(s); s.tls, s.plaintext = cert, false },
+			def:      func(d *Definition) { d.Encryption, d.Verify, d.CA = "STARTTLS", "true", ca },
+			passed:   true,
+			messages: "2",
+			commands: []string{"STLS", "USER alice", "PASS hunter2", "STAT", "QUIT"},
+		},
+		{
+			name:    "starttls unsupported",
+			server:  func(s *fakeServer) { s.tls, s.noSTLS = cert, true },
+			def:     func(d *Definition) { d.Encryption = "starttls" },
+			message: "STLS with server 127.0.0.1 failed : server responded with -ERR Unknown command.",
+		},
+		{
+			name:    "starttls with an untrusted certificate",
+			server:  func(s *fakeServer) { s.tls = cert },
+			def:     func(d *Definition) { d.Encryption, d.Verify = "starttls", "true" },
+			message: "STLS with server 127.0.0.1 failed : tls: ",
+		},
+		{
+			name:     "starttls without verifying the certificate",
+			server:   func(s *fakeServer) { s.tls = cert },
+			def:      func(d *Definition) { d.Encryption = "starttls" },
+			passed:   true,
+			messages: "0",
+		},
+		{
+			name:     "pop3s",
+			server:   func(s *fakeServer) { mailbox(s); s.tls, s.pop3s = cert, true },
+			def:      func(d *Definition) { d.Encryption, d.Verify, d.CA, d.MessageRegex = "pop3s", "true", ca, "flag" },
+			passed:   true,
+			messages: "2",
+		},
+		{
+			name:    "pop3s with an untrusted certificate",
+			server:  func(s *fakeServer) { s.tls, s.pop3s = cert, true },
+			def:     func(d *Definition) { d.Encryption, d.Verify = "pop3s", "true" },
+			message: "Connecting to server 127.0.0.1 failed : ",
+		},
+		{
+			name:    "pop3s to a plain server",
+			def:     func(d *Definition) { d.Encryption = "pop3s" },
+			message: "Connecting to server 127.0.0.1 failed : ",
+		},
+		{
+			name:    "server busy",
+			server:  func(s *fakeServer) { s.greeting = "-ERR [SYS/TEMP] Max number of connections from your IP reached." },
+			message: "Connecting to server 127.0.0.1 failed : server responded with -ERR [SYS/TEMP] Max number of connections",
+		},
+		{
+			name:    "unknown encryption",
+			def:     func(d *Definition) { d.Encryption = "ssl" },
+			message: "Unknown encryption ssl - must be none, starttls, or pop3s",
+		},
+		{
+			name:    "invalid regex",
+			def:     func(d *Definition) { d.MessageRegex = "(" },
+			message: "Error compiling regex string ( : ",
+		},
+		{
+			name:    "invalid CA",
+			def:     func(d *Definition) { d.CA = "not a certificate" },
+			message: "Invalid TLS configuration : ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t, tt.server)
+			d := s.definition()
+			if tt.def != nil {
+				tt.def(d)
+			}
+
+			result := d.Run(context.Background())
+			if result.Passed != tt.passed {
+				t.Errorf("got passed %v, want %v (message: %s)", result.Passed, tt.passed, result.Message)
+			}
+			if !strings.HasPrefix(result.Message, tt.message) || (tt.message == "" && result.Message != "") {
+				t.Errorf("got message %q, want it to start with %q", result.Message, tt.message)
+			}
+			if got := result.Details["messages"]; got != tt.messages {
+				t.Errorf("got %q messages, want %q", got, tt.messages)
+			}
+			if tt.commands == nil {
+				return
+			}
+			// QUIT isn't waited for, so give the server a moment to read it
+			deadline := time.Now().Add(time.Second)
+			for len(s.recorded()) < len(tt.commands) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := strings.Join(s.recorded(), ", "); got != strings.Join(tt.commands, ", ") {
+				t.Errorf("got commands %s, want %s", got, strings.Join(tt.commands, ", "))
+			}
+		})
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	s := newFakeServer(t, func(s *fakeServer) { s.hang = true })
+	d := s.definition()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result := d.Run(ctx)
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("check took %s, but it should have timed out after 200ms", elapsed)
+	}
+	if result.Passed || !strings.HasPrefix(result.Message, "Login with user alice failed : ") || !strings.Contains(result.Message, "timeout") {
+		t.Errorf("got passed %v with message %q, want a login timeout", result.Passed, result.Message)
+	}
+}
+
+func TestRunConnectionRefused(t *testing.T) {
+	host, port := checktest.ClosedPort(t)
+
+	d := &Definition{Host: host, Port: port, Username: "alice", Password: "hunter2"}
+	result := d.Run(context.Background())
+	if result.Passed || !strings.HasPrefix(result.Message, "Connecting to server 127.0.0.1 failed : ") {
+		t.Errorf("got passed %v with message %q, want a connection failure", result.Passed, result.Message)
+	}
+}
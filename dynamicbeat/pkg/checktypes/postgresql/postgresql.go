@@ -2,29 +2,38 @@ package postgresql
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgconn"
 	// PostgreSQL driver
 	pgx "github.com/jackc/pgx/v4"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
 )
 
-// The Definition configures the behavior of the MySQL check
+// The Definition configures the behavior of the PostgreSQL check
 // it implements the "check" interface
 type Definition struct {
-	Config       check.Config // generic metadata about the check
-	Host         string       `optiontype:"required"`                      // IP or Hostname for the PostgreSQL server
-	Username     string       `optiontype:"required"`                      // Username for the database
-	Password     string       `optiontype:"required"`                      // Password for the user
-	Database     string       `optiontype:"required"`                      // Name of the database to access
-	Table        string       `optiontype:"required"`                      // Name of the table to access
-	Column       string       `optiontype:"required"`                      // Name of the column to access
-	MatchContent string       `optiontype:"optional"`                      // Whether to perform a regex content match on the results of the query
-	ContentRegex string       `optiontype:"optional" optiondefault:".*"`   // Regex to match on
-	Port         string       `optiontype:"optional" optiondefault:"5432"` // Port for the server
+	Config        check.Config // generic metadata about the check
+	Host          string       `optiontype:"required"`                        // IP or Hostname for the PostgreSQL server
+	Username      string       `optiontype:"required"`                        // Username for the database
+	Password      string       `optiontype:"required"`                        // Password for the user
+	Database      string       `optiontype:"required"`                        // Name of the database to access
+	Table         string       `optiontype:"optional"`                        // Name of the table to access, if Query isn't set
+	Column        string       `optiontype:"optional"`                        // Name of the column to access, if Query isn't set
+	MatchContent  string       `optiontype:"optional"`                        // Whether to perform a regex content match on the results of the query
+	ContentRegex  string       `optiontype:"optional" optiondefault:".*"`     // Regex to match on
+	Port          string       `optiontype:"optional" optiondefault:"5432"`   // Port for the server
+	SSLMode       string       `optiontype:"optional" optiondefault:"prefer"` // disable, allow, prefer, require, verify-ca, or verify-full
+	Query         string       `optiontype:"optional"`                        // The query to run instead of selecting Column from Table
+	ExpectedRows  int          `optiontype:"optional"`                        // The fewest rows that the query must return
+	ExpectedValue string       `optiontype:"optional"`                        // Regex that the first column of the first row must match
 }
 
 // Run a single instance of the check
@@ -32,65 +41,127 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
+	query := d.Query
+	if query == "" {
+		if d.Table == "" || d.Column == "" {
+			result.Message = "Either Query or both Table and Column must be set"
+			return result
+		}
+		// Quote the names so that they can't change the query. A dot in Table
+		// separates the schema from the table name.
+		column := pgx.Identifier{d.Column}.Sanitize()
+		table := pgx.Identifier(strings.Split(d.Table, ".")).Sanitize()
+		query = fmt.Sprintf("SELECT %s FROM %s;", column, table)
+	}
+
 	// Create DB handle
-	db, err := pgx.Connect(ctx, fmt.Sprintf("postgresql://%s:%s@%s:%s/%s", d.Username, d.Password, d.Host, d.Port, d.Database))
+	u := url.URL{
+		Scheme:   "postgresql",
+		User:     url.UserPassword(d.Username, d.Password),
+		Host:     net.JoinHostPort(d.Host, d.Port),
+		Path:     "/" + d.Database,
+		RawQuery: url.Values{"sslmode": {d.SSLMode}}.Encode(),
+	}
+	cfg, err := pgx.ParseConfig(u.String())
 	if err != nil {
 		result.Message = fmt.Sprintf("Creating database handle failed : %s", err)
 		return result
 	}
-	defer db.Close(ctx)
-
-	// Check db connection
-	err = db.Ping(ctx)
+	var dialer check.Dialer
+	cfg.DialFunc = dialer.DialContext
+	if check.HasTunnel(ctx) {
+		// The jump host resolves the host itself
+		cfg.LookupFunc = func(_ context.Context, host string) ([]string, error) {
+			return []string{host}, nil
+		}
+	}
+	db, err := pgx.ConnectConfig(ctx, cfg)
+	var pgErr *pgconn.PgError
+	// Class 28 is for invalid authorization
+	if errors.As(err, &pgErr) && strings.HasPrefix(pgErr.Code, "28") {
+		result.Message = fmt.Sprintf("Failed to login with user %s : %s", d.Username, err)
+		return result
+	}
 	if err != nil {
-		result.Message = fmt.Sprintf("Failed to ping database : %s", err)
+		result.Message = fmt.Sprintf("Failed to connect to database : %s", err)
+		return result
 	}
+	defer db.Close(context.Background())
 
 	// Query the DB
-	// TODO: This is SQL injectable. Figure out Paramerterized queries
-	rows, err := db.Query(ctx, fmt.Sprintf("SELECT %s FROM %s;", d.Column, d.Table))
+	rows, err := db.Query(ctx, query)
 	if err != nil {
 		result.Message = fmt.Sprintf("Could not query database : %s", err)
 		return result
 	}
 	defer rows.Close()
 
-	// Store the value from the column
-	var val string
-
-	// Perform regex matching, if necessary
+	// Compile the regexes
+	var contentRegex, valueRegex *regexp.Regexp
 	if matchContent, _ := strconv.ParseBool(d.MatchContent); matchContent {
-		// Compile the regex
-		regex, err := regexp.Compile(d.ContentRegex)
+		contentRegex, err = regexp.Compile(d.ContentRegex)
 		if err != nil {
 			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ContentRegex, err)
 			return result
 		}
+	}
+	if d.ExpectedValue != "" {
+		valueRegex, err = regexp.Compile(d.ExpectedValue)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ExpectedValue, err)
+			return result
+		}
+	}
 
-		// Check the rows
-		for rows.Next() {
-			// Grab a value
-			err := rows.Scan(&val)
-			if err != nil {
-				result.Message = fmt.Sprintf("Could not scan row values : %s", err)
-				return result
-			}
-			// Check value with regex
-			if regex.MatchString(val) {
-				// If we reach here the check passes
-				result.Passed = true
+	// Check the first column of each row
+	count := 0
+	matched := false
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			result.Message = fmt.Sprintf("Could not scan row values : %s", err)
+			return result
+		}
+		if len(values) == 0 {
+			result.Message = "Query did not return any columns"
+			return result
+		}
+		val := ""
+		if values[0] != nil {
+			val = fmt.Sprint(values[0])
+		}
+		if count == 0 {
+			result.AdminDetails = map[string]string{"first_value": val}
+			if valueRegex != nil && !valueRegex.MatchString(val) {
+				result.Message = "First value returned by the query does not match the expected value"
 				return result
 			}
-
+		}
+		count++
+		if contentRegex != nil && contentRegex.MatchString(val) {
+			matched = true
 		}
 	}
 
 	// Check for error in the rows
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		result.Message = fmt.Sprintf("Something happened to the rows : %s", err)
 		return result
 	}
 
+	if count < d.ExpectedRows {
+		result.Message = fmt.Sprintf("Query returned %d rows, but expected at least %d", count, d.ExpectedRows)
+		return result
+	}
+	if valueRegex != nil && count == 0 {
+		result.Message = "Query did not return any rows"
+		return result
+	}
+	if contentRegex != nil && !matched {
+		result.Message = "Matching content not found"
+		return result
+	}
+
 	// Check passes if we reach here
 	result.Passed = true
 	return result
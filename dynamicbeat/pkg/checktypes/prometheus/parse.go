@@ -0,0 +1,157 @@
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A sample is a single value of a metric, with its labels.
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// series returns the sample's name and labels in the exposition format, like
+// up{job="node"}.
+func (s sample) series() string {
+	if len(s.labels) == 0 {
+		return s.name
+	}
+	names := make([]string, 0, len(s.labels))
+	for name := range s.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, s.labels[name])
+	}
+	return s.name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// parse reads the samples of a text exposition format or OpenMetrics page.
+// Comments, including the HELP and TYPE lines, are skipped.
+func parse(r io.Reader) ([]sample, error) {
+	var samples []sample
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// parseSample parses a line like name{label="value"} 1.5 [timestamp].
+func parseSample(line string) (sample, error) {
+	s := sample{labels: make(map[string]string)}
+	end := strings.IndexAny(line, "{ \t")
+	if end < 0 {
+		return s, fmt.Errorf("sample %q has no value", line)
+	}
+	s.name = line[:end]
+	if !validName(s.name) {
+		return s, fmt.Errorf("invalid metric name %q", s.name)
+	}
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		rest, err = parseLabels(rest[1:], s.labels)
+		if err != nil {
+			return s, fmt.Errorf("metric %s: %s", s.name, err)
+		}
+	}
+
+	// OpenMetrics exemplars follow the value and timestamp after a #
+	if hash := strings.Index(rest, "#"); hash >= 0 {
+		rest = rest[:hash]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("metric %s: expected a value and an optional timestamp", s.name)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("metric %s: invalid value %q", s.name, fields[0])
+	}
+	s.value = value
+	return s, nil
+}
+
+// parseLabels parses the labels after the opening brace, and returns the
+// rest of the line after the closing brace.
+func parseLabels(rest string, labels map[string]string) (string, error) {
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if strings.HasPrefix(rest, "}") {
+			return rest[1:], nil
+		}
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return "", fmt.Errorf("label without a value")
+		}
+		name := strings.TrimSpace(rest[:eq])
+		if !validName(name) || strings.Contains(name, ":") {
+			return "", fmt.Errorf("invalid label name %q", name)
+		}
+		rest = strings.TrimLeft(rest[eq+1:], " \t")
+		if !strings.HasPrefix(rest, `"`) {
+			return "", fmt.Errorf("value of label %s is not quoted", name)
+		}
+
+		// Label values escape backslashes, quotes, and newlines
+		var value strings.Builder
+		i := 1
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+				switch rest[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(rest[i])
+				}
+				continue
+			}
+			value.WriteByte(rest[i])
+		}
+		if i == len(rest) {
+			return "", fmt.Errorf("value of label %s is not terminated", name)
+		}
+		labels[name] = value.String()
+		rest = strings.TrimLeft(rest[i+1:], " \t")
+		if strings.HasPrefix(rest, ",") {
+			rest = rest[1:]
+		} else if !strings.HasPrefix(rest, "}") {
+			return "", fmt.Errorf("expected , or } after label %s", name)
+		}
+	}
+}
+
+// validName checks whether a metric or label name only has the characters
+// that Prometheus allows.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		letter := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,289 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// The Definition configures the behavior of the Prometheus check
+// it implements the "check" interface
+type Definition struct {
+	Config            check.Config      // generic metadata about the check
+	URL               string            `optiontype:"required"`                          // URL of the metrics page, like http://10.0.0.5:9100/metrics
+	Verify            string            `optiontype:"optional"`                          // Whether the server's certificate should be validated
+	CA                string            `optiontype:"optional"`                          // PEM CA certificates to trust instead of the system pool
+	ClientCert        string            `optiontype:"optional"`                          // PEM client certificate to present to the server
+	ClientKey         string            `optiontype:"optional"`                          // PEM private key of the client certificate
+	ServerFingerprint string            `optiontype:"optional"`                          // SHA-256 fingerprint that the server certificate must have
+	Username          string            `optiontype:"optional"`                          // User to log in as with basic auth
+	Password          string            `optiontype:"optional"`                          // Password for the user
+	Headers           map[string]string `optiontype:"optional"`                          // Headers to send with the request, like Authorization
+	MaxBytes          int64             `optiontype:"optional" optiondefault:"10485760"` // The largest metrics page that is read
+	Assertions        []*Assertion      `optiontype:"list"`                              // Conditions on metrics that must all pass
+}
+
+// An Assertion requires a metric to exist, and optionally its value to pass
+// a comparison.
+type Assertion struct {
+	Metric     string            `optiontype:"required"`                    // The name of the metric, like node_load1
+	Labels     map[string]string `optiontype:"optional"`                    // Regexes that the values of the sample's labels must match
+	Comparison string            `optiontype:"optional" optiondefault:"=="` // How the value is compared: ==, !=, <, <=, >, >=, or range
+	Value      string            `optiontype:"optional"`                    // Number that the value is compared to; the value isn't compared if it isn't set
+	Min        string            `optiontype:"optional"`                    // The lowest value that passes the range comparison
+	Max        string            `optiontype:"optional"`                    // The highest value that passes the range comparison
+}
+
+// A matcher is a compiled assertion.
+type matcher struct {
+	*Assertion
+	labels map[string]*regexp.Regexp
+	value  float64
+	min    float64
+	max    float64
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	matchers := make([]*matcher, 0, len(d.Assertions))
+	for _, a := range d.Assertions {
+		m, err := compile(a)
+		if err != nil {
+			result.Message = fmt.Sprintf("Invalid assertion on %s : %s", a.Metric, err)
+			return result
+		}
+		matchers = append(matchers, m)
+	}
+
+	verify, _ := strconv.ParseBool(d.Verify)
+	tlsConfig, err := util.NewTLSConfigFromPEM(verify, d.CA, d.ClientCert, d.ClientKey)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not configure TLS : %s", err)
+		return result
+	}
+	if d.ServerFingerprint != "" {
+		err = util.PinFingerprint(tlsConfig, d.ServerFingerprint)
+		if err != nil {
+			result.Message = fmt.Sprintf("Could not configure TLS : %s", err)
+			return result
+		}
+	}
+	var dialer check.Dialer
+	transport := &http.Transport{DialContext: dialer.DialContext, TLSClientConfig: tlsConfig}
+	// Connections aren't kept around between rounds
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.URL, nil)
+	if err != nil {
+		result.Message = fmt.Sprintf("Invalid URL %s : %s", d.URL, err)
+		return result
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	for name, value := range d.Headers {
+		req.Header.Set(name, value)
+	}
+	if d.Username != "" {
+		req.SetBasicAuth(d.Username, d.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not scrape %s : %s", d.URL, err)
+		return result
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		result.Message = fmt.Sprintf("Scraping %s failed : server responded with %s", d.URL, resp.Status)
+		return result
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "protobuf") {
+		result.Message = fmt.Sprintf("Scraping %s failed : the protobuf format isn't supported", d.URL)
+		return result
+	}
+
+	// Fail instead of checking a truncated page
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, d.MaxBytes+1))
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not read metrics from %s : %s", d.URL, err)
+		return result
+	}
+	if int64(len(body)) > d.MaxBytes {
+		result.Message = fmt.Sprintf("Metrics page at %s is larger than %d bytes", d.URL, d.MaxBytes)
+		return result
+	}
+	samples, err := parse(bytes.NewReader(body))
+	if err != nil {
+		result.Message = fmt.Sprintf("Error parsing metrics from %s : %s", d.URL, err)
+		return result
+	}
+	result.Details = map[string]string{"samples": strconv.Itoa(len(samples))}
+
+	for _, m := range matchers {
+		matched := m.find(samples)
+		if len(matched) == 0 {
+			result.Message = m.missing(samples)
+			return result
+		}
+
+		// Any of the matching samples can pass the comparison, and the
+		// value of the one that did is recorded for graphing
+		passed := m.Value == "" && m.Comparison != "range"
+		for _, s := range matched {
+			if passed || m.compare(s.value) {
+				result.Details[s.series()] = formatValue(s.value)
+				passed = true
+				break
+			}
+		}
+		if !passed {
+			s := matched[0]
+			result.Details[s.series()] = formatValue(s.value)
+			if m.Comparison == "range" {
+				result.Message = fmt.Sprintf("Metric %s is %s, which is not between %s and %s", s.series(), formatValue(s.value), m.Min, m.Max)
+			} else {
+				result.Message = fmt.Sprintf("Metric %s is %s, which is not %s %s", s.series(), formatValue(s.value), m.Comparison, m.Value)
+			}
+			return result
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// compile parses the regexes and numbers of an assertion.
+func compile(a *Assertion) (*matcher, error) {
+	m := &matcher{Assertion: a, labels: make(map[string]*regexp.Regexp, len(a.Labels))}
+	for name, pattern := range a.Labels {
+		// Label matchers are anchored, like Prometheus's =~ matchers
+		regex, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("error compiling regex string %s : %s", pattern, err)
+		}
+		m.labels[name] = regex
+	}
+
+	var err error
+	switch a.Comparison {
+	case "==", "!=", "<", "<=", ">", ">=":
+		if a.Value != "" {
+			m.value, err = strconv.ParseFloat(a.Value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s", a.Value)
+			}
+		}
+	case "range":
+		m.min, err = strconv.ParseFloat(a.Min, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minimum %s", a.Min)
+		}
+		m.max, err = strconv.ParseFloat(a.Max, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maximum %s", a.Max)
+		}
+	default:
+		return nil, fmt.Errorf("unknown comparison %s - must be ==, !=, <, <=, >, >=, or range", a.Comparison)
+	}
+	return m, nil
+}
+
+// find returns the samples of the metric whose labels match.
+func (m *matcher) find(samples []sample) []sample {
+	var matched []sample
+	for _, s := range samples {
+		if s.name != m.Metric {
+			continue
+		}
+		ok := true
+		for name, regex := range m.labels {
+			// Missing labels have empty values, like in Prometheus
+			if !regex.MatchString(s.labels[name]) {
+				ok = false
+			}
+		}
+		if ok {
+			matched = append(matched, s)
+		}
+	}
+	return matched
+}
+
+// missing describes why no samples matched: either the metric doesn't exist,
+// or none of its samples have matching labels.
+func (m *matcher) missing(samples []sample) string {
+	for _, s := range samples {
+		if s.name == m.Metric {
+			names := make([]string, 0, len(m.Labels))
+			for name := range m.Labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			pairs := make([]string, len(names))
+			for i, name := range names {
+				pairs[i] = fmt.Sprintf("%s=~%q", name, m.Labels[name])
+			}
+			return fmt.Sprintf("No sample of metric %s matches {%s}", m.Metric, strings.Join(pairs, ","))
+		}
+	}
+	return fmt.Sprintf("Metric %s was not found", m.Metric)
+}
+
+// compare checks whether a value passes the assertion's comparison.
+func (m *matcher) compare(got float64) bool {
+	switch m.Comparison {
+	case "==":
+		return got == m.value
+	case "!=":
+		return got != m.value
+	case "<":
+		return got < m.value
+	case "<=":
+		return got <= m.value
+	case ">":
+		return got > m.value
+	case ">=":
+		return got >= m.value
+	case "range":
+		return got >= m.min && got <= m.max
+	}
+	return false
+}
+
+// formatValue formats a sample value like Prometheus does.
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
@@ -0,0 +1,218 @@
+package rdp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// credsspVersion is the newest version of CredSSP that the client supports.
+// Servers that have been patched for CVE-2018-0886 can refuse clients that
+// use versions before 5.
+const credsspVersion = 6
+
+// The hash magic of the public key binding in versions 5 and up.
+var (
+	clientBindingMagic = []byte("CredSSP Client-To-Server Binding Hash\x00")
+	serverBindingMagic = []byte("CredSSP Server-To-Client Binding Hash\x00")
+)
+
+// tsRequest is the message that every step of CredSSP is sent in.
+type tsRequest struct {
+	Version     int         `asn1:"explicit,tag:0"`
+	NegoTokens  []negoToken `asn1:"optional,explicit,tag:1"`
+	AuthInfo    []byte      `asn1:"optional,explicit,tag:2"`
+	PubKeyAuth  []byte      `asn1:"optional,explicit,tag:3"`
+	ErrorCode   int64       `asn1:"optional,explicit,tag:4"`
+	ClientNonce []byte      `asn1:"optional,explicit,tag:5"`
+}
+
+type negoToken struct {
+	Token []byte `asn1:"explicit,tag:0"`
+}
+
+// The NTSTATUS and SSPI error codes that servers return for failed logins.
+var loginStatuses = map[uint32]string{
+	0x8009030c: "username or password is incorrect",
+	0xc0000064: "user does not exist",
+	0xc000006d: "username or password is incorrect",
+	0xc000006e: "account restrictions prevent logging in",
+	0xc0000071: "password has expired",
+	0xc0000072: "account is disabled",
+	0xc0000193: "account has expired",
+	0xc0000224: "password must be changed",
+	0xc0000234: "account is locked out",
+}
+
+// loginError is returned when the server rejects the credentials.
+type loginError struct {
+	reason string
+}
+
+func (e *loginError) Error() string {
+	return e.reason
+}
+
+// credssp authenticates with NTLM over CredSSP on a TLS connection, which
+// is how Network Level Authentication works. The exchange is stopped after
+// the server proves that it accepted the credentials, so the credentials are
+// never delegated to the server and no session is started.
+func credssp(conn *tls.Conn, user string, password string, domain string) error {
+	pubKey, err := subjectPublicKey(conn)
+	if err != nil {
+		return err
+	}
+	client := &ntlmClient{user: user, password: password, domain: domain}
+
+	err = writeTSRequest(conn, &tsRequest{Version: credsspVersion, NegoTokens: []negoToken{{client.negotiateMessage()}}})
+	if err != nil {
+		return err
+	}
+	challenge, err := readTSRequest(conn)
+	if err != nil {
+		return err
+	}
+	if len(challenge.NegoTokens) == 0 {
+		return fmt.Errorf("server did not send an NTLM challenge")
+	}
+	version := challenge.Version
+	if version > credsspVersion {
+		version = credsspVersion
+	}
+
+	auth, err := client.authenticateMessage(challenge.NegoTokens[0].Token)
+	if err != nil {
+		return err
+	}
+
+	// The server's public key is sent back sealed with the session key, to
+	// show that the TLS connection wasn't intercepted. Versions 5 and up send
+	// a hash of the key with a nonce instead of the key itself.
+	request := &tsRequest{Version: credsspVersion, NegoTokens: []negoToken{{auth}}}
+	var expected []byte
+	if version >= 5 {
+		nonce := make([]byte, 32)
+		_, err = rand.Read(nonce)
+		if err != nil {
+			return err
+		}
+		request.ClientNonce = nonce
+		request.PubKeyAuth = client.seal(bindingHash(clientBindingMagic, nonce, pubKey))
+		expected = bindingHash(serverBindingMagic, nonce, pubKey)
+	} else {
+		request.PubKeyAuth = client.seal(pubKey)
+		expected = append([]byte{pubKey[0] + 1}, pubKey[1:]...)
+	}
+	err = writeTSRequest(conn, request)
+	if err != nil {
+		return err
+	}
+
+	// Older servers close the connection instead of returning an error code
+	response, err := readTSRequest(conn)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &loginError{"server closed the connection after authentication"}
+	}
+	if err != nil {
+		return err
+	}
+	if len(response.PubKeyAuth) == 0 {
+		return &loginError{"server did not accept the authentication"}
+	}
+	serverKey, err := client.unseal(response.PubKeyAuth)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(serverKey, expected) {
+		return fmt.Errorf("server did not prove that it has the public key of its certificate")
+	}
+	return nil
+}
+
+// bindingHash returns the public key binding of CredSSP versions 5 and up.
+func bindingHash(magic []byte, nonce []byte, pubKey []byte) []byte {
+	h := sha256.New()
+	h.Write(magic)
+	h.Write(nonce)
+	h.Write(pubKey)
+	return h.Sum(nil)
+}
+
+// subjectPublicKey returns the public key of the server's certificate,
+// without the algorithm that is around it.
+func subjectPublicKey(conn *tls.Conn) ([]byte, error) {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("server did not present a certificate")
+	}
+	var info struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	_, err := asn1.Unmarshal(certs[0].RawSubjectPublicKeyInfo, &info)
+	if err != nil || len(info.PublicKey.Bytes) == 0 {
+		return nil, fmt.Errorf("failed to parse the public key of the server's certificate")
+	}
+	return info.PublicKey.Bytes, nil
+}
+
+func writeTSRequest(w io.Writer, req *tsRequest) error {
+	data, err := asn1.Marshal(*req)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readTSRequest reads a DER encoded TSRequest. CredSSP messages don't have
+// any framing, so the length is read from the DER header.
+func readTSRequest(r io.Reader) (*tsRequest, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 {
+			return nil, fmt.Errorf("invalid TSRequest length")
+		}
+		extra := make([]byte, n)
+		_, err = io.ReadFull(r, extra)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, extra...)
+		length = 0
+		for _, b := range extra {
+			length = length<<8 | int(b)
+		}
+	}
+	data := make([]byte, len(header)+length)
+	copy(data, header)
+	_, err = io.ReadFull(r, data[len(header):])
+	if err != nil {
+		return nil, err
+	}
+
+	var req tsRequest
+	_, err = asn1.Unmarshal(data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSRequest: %s", err)
+	}
+	if req.ErrorCode != 0 {
+		status := uint32(req.ErrorCode)
+		if reason, ok := loginStatuses[status]; ok {
+			return nil, &loginError{reason}
+		}
+		return nil, fmt.Errorf("server returned error 0x%08x", status)
+	}
+	return &req, nil
+}
@@ -0,0 +1,283 @@
+package rdp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// The NTLM negotiate flags that the client asks for.
+const (
+	ntlmUnicode                 = 0x00000001
+	ntlmRequestTarget           = 0x00000004
+	ntlmSign                    = 0x00000010
+	ntlmSeal                    = 0x00000020
+	ntlmNTLM                    = 0x00000200
+	ntlmAlwaysSign              = 0x00008000
+	ntlmExtendedSessionSecurity = 0x00080000
+	ntlmTargetInfo              = 0x00800000
+	ntlmVersion                 = 0x02000000
+	ntlm128                     = 0x20000000
+	ntlmKeyExchange             = 0x40000000
+	ntlm56                      = 0x80000000
+
+	ntlmFlags = ntlmUnicode | ntlmRequestTarget | ntlmSign | ntlmSeal | ntlmNTLM | ntlmAlwaysSign |
+		ntlmExtendedSessionSecurity | ntlmTargetInfo | ntlmVersion | ntlm128 | ntlmKeyExchange | ntlm56
+)
+
+// The IDs of the AV pairs in the target info of a challenge.
+const (
+	avEOL       = 0x0000
+	avFlags     = 0x0006
+	avTimestamp = 0x0007
+	avFlagsMIC  = 0x00000002 // the MsvAvFlags bit that says the authenticate message has a MIC
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmClient authenticates with NTLMv2, and then seals messages with the
+// session key, which is what CredSSP needs. Only extended session security is
+// supported, which every version of Windows since NT 4.0 SP4 uses.
+type ntlmClient struct {
+	user     string
+	password string
+	domain   string
+
+	negotiate  []byte // the negotiate message, which the MIC covers
+	clientSign []byte
+	serverSign []byte
+	clientSeal *rc4.Cipher
+	serverSeal *rc4.Cipher
+	clientSeq  uint32
+	serverSeq  uint32
+	keyExch    bool
+}
+
+// negotiateMessage returns the first message of the exchange.
+func (c *ntlmClient) negotiateMessage() []byte {
+	msg := make([]byte, 40)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:12], 1)
+	binary.LittleEndian.PutUint32(msg[12:16], ntlmFlags)
+	// The domain and workstation fields are empty, and the version is
+	// Windows 7 with NTLM revision 15
+	copy(msg[32:40], []byte{6, 1, 0xb1, 0x1d, 0, 0, 0, 15})
+	c.negotiate = msg
+	return msg
+}
+
+// authenticateMessage checks the server's challenge message, and returns the
+// authenticate message that answers it. The session keys are set up for
+// sealing afterwards.
+func (c *ntlmClient) authenticateMessage(challenge []byte) ([]byte, error) {
+	if len(challenge) < 48 || !bytes.Equal(challenge[:8], ntlmSignature) || binary.LittleEndian.Uint32(challenge[8:12]) != 2 {
+		return nil, fmt.Errorf("invalid NTLM challenge message")
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:24]) & ntlmFlags
+	if flags&ntlmExtendedSessionSecurity == 0 {
+		return nil, fmt.Errorf("server does not support NTLM extended session security")
+	}
+	serverChallenge := challenge[24:32]
+	targetInfo, err := field(challenge, 40)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NTLM challenge message: %s", err)
+	}
+	pairs, timestamp, err := avPairs(targetInfo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NTLM challenge message: %s", err)
+	}
+	if timestamp == nil {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	}
+
+	random := make([]byte, 24)
+	_, err = rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	clientChallenge, exportedKey := random[:8], random[8:]
+
+	// NTLMv2 response, from the hash of the password
+	responseKey := ntowfv2(c.user, c.password, c.domain)
+	var temp []byte
+	temp = append(temp, 1, 1, 0, 0, 0, 0, 0, 0)
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, pairs...)
+	temp = append(temp, 0, 0, 0, 0)
+	proof := hmacMD5(responseKey, serverChallenge, temp)
+	ntResponse := append(proof, temp...)
+	lmResponse := make([]byte, 24)
+	sessionKey := hmacMD5(responseKey, proof)
+
+	// With key exchange, the session key is random and sent encrypted with
+	// the key from the response
+	var encryptedKey []byte
+	c.keyExch = flags&ntlmKeyExchange != 0
+	if c.keyExch {
+		cipher, _ := rc4.NewCipher(sessionKey)
+		encryptedKey = make([]byte, 16)
+		cipher.XORKeyStream(encryptedKey, exportedKey)
+	} else {
+		exportedKey = sessionKey
+	}
+
+	payload := [][]byte{lmResponse, ntResponse, utf16le(c.domain), utf16le(c.user), nil, encryptedKey}
+	msg := make([]byte, 88)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:12], 3)
+	for i, p := range payload {
+		off := 12 + 8*i
+		binary.LittleEndian.PutUint16(msg[off:], uint16(len(p)))
+		binary.LittleEndian.PutUint16(msg[off+2:], uint16(len(p)))
+		binary.LittleEndian.PutUint32(msg[off+4:], uint32(len(msg)))
+		msg = append(msg, p...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:64], flags)
+	copy(msg[64:72], c.negotiate[32:40])
+	copy(msg[72:88], hmacMD5(exportedKey, c.negotiate, challenge, msg))
+
+	c.setKeys(exportedKey, flags)
+	return msg, nil
+}
+
+// setKeys sets up the signing and sealing keys from the session key.
+func (c *ntlmClient) setKeys(exportedKey []byte, flags uint32) {
+	c.clientSign = md5Sum(exportedKey, "session key to client-to-server signing key magic constant\x00")
+	c.serverSign = md5Sum(exportedKey, "session key to server-to-client signing key magic constant\x00")
+	sealKey := exportedKey
+	switch {
+	case flags&ntlm128 != 0:
+	case flags&ntlm56 != 0:
+		sealKey = exportedKey[:7]
+	default:
+		sealKey = exportedKey[:5]
+	}
+	c.clientSeal, _ = rc4.NewCipher(md5Sum(sealKey, "session key to client-to-server sealing key magic constant\x00"))
+	c.serverSeal, _ = rc4.NewCipher(md5Sum(sealKey, "session key to server-to-client sealing key magic constant\x00"))
+}
+
+// seal encrypts a message for the server, and returns it after its 16 byte
+// signature.
+func (c *ntlmClient) seal(plaintext []byte) []byte {
+	sealed := make([]byte, 16+len(plaintext))
+	c.clientSeal.XORKeyStream(sealed[16:], plaintext)
+	copy(sealed, c.signature(c.clientSeal, c.clientSign, c.clientSeq, plaintext))
+	c.clientSeq++
+	return sealed
+}
+
+// unseal decrypts a sealed message from the server, and checks its signature.
+func (c *ntlmClient) unseal(sealed []byte) ([]byte, error) {
+	if len(sealed) < 16 {
+		return nil, fmt.Errorf("sealed message is too short")
+	}
+	plaintext := make([]byte, len(sealed)-16)
+	c.serverSeal.XORKeyStream(plaintext, sealed[16:])
+	if !hmac.Equal(sealed[:16], c.signature(c.serverSeal, c.serverSign, c.serverSeq, plaintext)) {
+		return nil, fmt.Errorf("sealed message has an invalid signature")
+	}
+	c.serverSeq++
+	return plaintext, nil
+}
+
+// signature returns the extended session security signature of a message.
+func (c *ntlmClient) signature(cipher *rc4.Cipher, key []byte, seq uint32, msg []byte) []byte {
+	sig := make([]byte, 16)
+	binary.LittleEndian.PutUint32(sig[0:4], 1)
+	binary.LittleEndian.PutUint32(sig[12:16], seq)
+	copy(sig[4:12], hmacMD5(key, sig[12:16], msg))
+	if c.keyExch {
+		cipher.XORKeyStream(sig[4:12], sig[4:12])
+	}
+	return sig
+}
+
+// field returns the payload that the length and offset at off in a message
+// point to.
+func field(msg []byte, off int) ([]byte, error) {
+	length := int(binary.LittleEndian.Uint16(msg[off : off+2]))
+	start := int(binary.LittleEndian.Uint32(msg[off+4 : off+8]))
+	if start+length > len(msg) {
+		return nil, fmt.Errorf("field is out of bounds")
+	}
+	return msg[start : start+length], nil
+}
+
+// avPairs returns the target info of a challenge to put in the response, and
+// the server's timestamp if it has one. When there is a timestamp, the
+// authenticate message has a MIC, which is flagged in the target info.
+func avPairs(info []byte) ([]byte, []byte, error) {
+	var pairs, timestamp []byte
+	for {
+		if len(info) < 4 {
+			return nil, nil, fmt.Errorf("target info is not terminated")
+		}
+		id := binary.LittleEndian.Uint16(info[0:2])
+		length := int(binary.LittleEndian.Uint16(info[2:4]))
+		if len(info) < 4+length {
+			return nil, nil, fmt.Errorf("target info is truncated")
+		}
+		switch id {
+		case avEOL:
+			if timestamp != nil {
+				flags := make([]byte, 8)
+				binary.LittleEndian.PutUint16(flags[0:2], avFlags)
+				binary.LittleEndian.PutUint16(flags[2:4], 4)
+				binary.LittleEndian.PutUint32(flags[4:8], avFlagsMIC)
+				pairs = append(pairs, flags...)
+			}
+			return append(pairs, 0, 0, 0, 0), timestamp, nil
+		case avFlags:
+		case avTimestamp:
+			timestamp = info[4 : 4+length]
+			fallthrough
+		default:
+			pairs = append(pairs, info[:4+length]...)
+		}
+		info = info[4+length:]
+	}
+}
+
+// ntowfv2 returns the NTLMv2 hash of a password, which the response is
+// created with.
+func ntowfv2(user string, password string, domain string) []byte {
+	hash := md4.New()
+	hash.Write(utf16le(password))
+	return hmacMD5(hash.Sum(nil), utf16le(strings.ToUpper(user)+domain))
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func md5Sum(key []byte, magic string) []byte {
+	h := md5.New()
+	h.Write(key)
+	h.Write([]byte(magic))
+	return h.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	chars := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(chars))
+	for i, c := range chars {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
@@ -0,0 +1,78 @@
+package rdp
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The test vectors are from section 4.2.4 of MS-NLMP, which uses the user
+// User in the domain Domain with the password Password.
+const (
+	vectorNTOWFv2         = "0c868a403bfd7a93a3001ef22ef02e3f"
+	vectorServerChallenge = "0123456789abcdef"
+	vectorClientChallenge = "aaaaaaaaaaaaaaaa"
+	vectorTimestamp       = "0000000000000000"
+	vectorRandomKey       = "55555555555555555555555555555555"
+	vectorTargetInfo      = "02000c0044006f006d00610069006e0001000c005300650072007600650072000000000000000000"
+	vectorNTProofStr      = "68cd0ab851e51c96aabc927bebef6a1c"
+	vectorSessionBaseKey  = "8de40ccadbc14a82f15cb0ad0de95ca3"
+	vectorEncryptedKey    = "c5dad2544fc9799094ce1ce90bc9d03e"
+	vectorSealed          = "54e50165bf1936dc996020c1811b0f06fb5f"
+	vectorSignature       = "010000007fb38ec5c55d497600000000"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNTOWFv2(t *testing.T) {
+	got := ntowfv2("User", "Password", "Domain")
+	if want := unhex(t, vectorNTOWFv2); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestNTLMv2Response(t *testing.T) {
+	responseKey := ntowfv2("User", "Password", "Domain")
+	var temp []byte
+	temp = append(temp, 1, 1, 0, 0, 0, 0, 0, 0)
+	temp = append(temp, unhex(t, vectorTimestamp)...)
+	temp = append(temp, unhex(t, vectorClientChallenge)...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, unhex(t, vectorTargetInfo)[:36]...)
+	temp = append(temp, 0, 0, 0, 0)
+	proof := hmacMD5(responseKey, unhex(t, vectorServerChallenge), temp)
+	if want := unhex(t, vectorNTProofStr); !bytes.Equal(proof, want) {
+		t.Errorf("got NTProofStr %x, want %x", proof, want)
+	}
+	key := hmacMD5(responseKey, proof)
+	if want := unhex(t, vectorSessionBaseKey); !bytes.Equal(key, want) {
+		t.Errorf("got session base key %x, want %x", key, want)
+	}
+	cipher, _ := rc4.NewCipher(key)
+	encrypted := make([]byte, 16)
+	cipher.XORKeyStream(encrypted, unhex(t, vectorRandomKey))
+	if want := unhex(t, vectorEncryptedKey); !bytes.Equal(encrypted, want) {
+		t.Errorf("got encrypted key %x, want %x", encrypted, want)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	c := &ntlmClient{keyExch: true}
+	c.setKeys(unhex(t, vectorRandomKey), ntlmExtendedSessionSecurity|ntlmKeyExchange|ntlm128)
+	sealed := c.seal(utf16le("Plaintext"))
+	if want := unhex(t, vectorSignature); !bytes.Equal(sealed[:16], want) {
+		t.Errorf("got signature %x, want %x", sealed[:16], want)
+	}
+	if want := unhex(t, vectorSealed); !bytes.Equal(sealed[16:], want) {
+		t.Errorf("got sealed message %x, want %x", sealed[16:], want)
+	}
+}
@@ -0,0 +1,155 @@
+package rdp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// The Definition configures the behavior of the RDP check
+// it implements the "check" interface
+type Definition struct {
+	Config     check.Config // generic metadata about the check
+	Host       string       `optiontype:"required"`                      // IP or hostname of the RDP server
+	Port       string       `optiontype:"optional" optiondefault:"3389"` // Port of the RDP server
+	Username   string       `optiontype:"optional"`                      // User to authenticate as with Network Level Authentication; credentials aren't checked if it isn't set
+	Password   string       `optiontype:"optional"`                      // Password for the user
+	Domain     string       `optiontype:"optional"`                      // Domain of the user; leave empty for local users
+	RequireNLA string       `optiontype:"optional"`                      // Whether the server must refuse connections without Network Level Authentication
+	Verify     string       `optiontype:"optional"`                      // Whether the server's certificate should be validated
+	CA         string       `optiontype:"optional"`                      // PEM CA certificates to trust instead of the system pool
+}
+
+// The stages of the connection, which are recorded in the check details.
+const (
+	stageConnected     = "connected"     // the TCP connection was opened
+	stageNegotiated    = "negotiated"    // the server answered the X.224 connection request
+	stageTLS           = "tls"           // the TLS handshake finished
+	stageAuthenticated = "authenticated" // the server accepted the credentials over CredSSP
+)
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	requireNLA, _ := strconv.ParseBool(d.RequireNLA)
+	verify, _ := strconv.ParseBool(d.Verify)
+	config, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+	if err != nil {
+		result.Message = fmt.Sprintf("Failed to create TLS config : %s", err)
+		return result
+	}
+	config.ServerName = d.Host
+	// Older versions of Windows only support TLS 1.0 for RDP
+	config.MinVersion = tls.VersionTLS10
+
+	conn, err := d.dial(ctx)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer conn.Close()
+	details := map[string]string{"stage": stageConnected}
+	result.Details = details
+
+	// Servers that only support standard RDP security refuse TLS, but are
+	// still RDP servers
+	protocol, err := negotiate(conn, protocolSSL|protocolHybrid|protocolHybridEx, d.Username)
+	var negErr *negotiationError
+	if errors.As(err, &negErr) && negErr.code == sslNotAllowed {
+		protocol, err = protocolRDP, nil
+	}
+	if err != nil {
+		result.Message = fmt.Sprintf("Server did not answer the RDP connection request : %s", err)
+		return result
+	}
+	details["stage"] = stageNegotiated
+	details["protocol"] = protocolName(protocol)
+
+	nla := protocol == protocolHybrid || protocol == protocolHybridEx
+	if !nla && (requireNLA || d.Username != "") {
+		result.Message = "Server does not support Network Level Authentication"
+		return result
+	}
+
+	if protocol != protocolRDP {
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.Handshake()
+		if err != nil {
+			result.Message = fmt.Sprintf("TLS handshake with %s failed : %s", d.Host, err)
+			return result
+		}
+		details["stage"] = stageTLS
+
+		if d.Username != "" {
+			err = credssp(tlsConn, d.Username, d.Password, d.Domain)
+			var loginErr *loginError
+			if errors.As(err, &loginErr) {
+				result.Message = fmt.Sprintf("Login with user %s failed : %s", d.Username, err)
+				return result
+			}
+			if err != nil {
+				result.Message = fmt.Sprintf("Network Level Authentication failed : %s", err)
+				return result
+			}
+			details["stage"] = stageAuthenticated
+		}
+	}
+
+	// Servers pick NLA when it's offered even if they don't require it, so
+	// another connection is made that only offers TLS
+	if requireNLA {
+		probe, err := d.dial(ctx)
+		if err != nil {
+			result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+			return result
+		}
+		defer probe.Close()
+		_, err = negotiate(probe, protocolSSL, d.Username)
+		if err == nil {
+			result.Message = "Server allows connections without Network Level Authentication"
+			return result
+		}
+		if !errors.As(err, &negErr) || negErr.code != hybridRequired {
+			result.Message = fmt.Sprintf("Failed to check whether Network Level Authentication is required : %s", err)
+			return result
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// dial connects to the server. Everything that is done over the connection
+// must finish before the check times out.
+func (d *Definition) dial(ctx context.Context) (net.Conn, error) {
+	var dialer check.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, d.Port))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
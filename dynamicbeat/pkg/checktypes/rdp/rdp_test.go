@@ -0,0 +1,453 @@
+package rdp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rc4"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/internal/checktest"
+	"golang.org/x/crypto/md4"
+)
+
+// fixture reads a packet from testdata, which is written as hex bytes with
+// comments.
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name+".hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return unhex(t, strings.Join(lines, " "))
+}
+
+// The connection confirms that a server answers connection requests with,
+// depending on the protocols that were requested.
+var (
+	onlyRDP = func(uint32) string { return "confirm-rdp" }
+	noTLS   = func(uint32) string { return "confirm-ssl-not-allowed" }
+	onlyTLS = func(uint32) string { return "confirm-ssl" }
+	nla     = func(requested uint32) string {
+		if requested&protocolHybrid != 0 {
+			return "confirm-hybrid"
+		}
+		return "confirm-ssl"
+	}
+	nlaRequired = func(requested uint32) string {
+		if requested&protocolHybrid != 0 {
+			return "confirm-hybrid"
+		}
+		return "confirm-hybrid-required"
+	}
+)
+
+// fakeServer is an RDP server that replays recorded connection confirms and
+// NTLM challenges, and then checks the client's CredSSP authentication like
+// Windows does.
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+	confirm  func(requested uint32) string
+	tls      *tls.Config
+	pubKey   []byte            // the public key of the certificate
+	users    map[string]string // passwords by DOMAIN\user
+	version  int               // the CredSSP version
+	hangUp   bool              // close the connection instead of returning an error code, like servers before CredSSP 3
+	badProof bool              // send back the wrong public key, like a machine in the middle would
+	reply    []byte            // sent instead of the connection confirm, if it is set
+
+	mu       sync.Mutex
+	requests [][]byte
+}
+
+// newFakeServer starts a fake server, which is set up by configure before it
+// accepts any connections.
+func newFakeServer(t *testing.T, cert *tls.Config, configure func(s *fakeServer)) *fakeServer {
+	t.Helper()
+	s := &fakeServer{
+		t:       t,
+		confirm: nla,
+		tls:     cert,
+		users:   map[string]string{`CORP\alice`: "hunter2"},
+		version: 6,
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(leaf.RawSubjectPublicKeyInfo, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.pubKey = info.PublicKey.Bytes
+	if configure != nil {
+		configure(s)
+	}
+	s.listener = checktest.Serve(t, s.serve)
+	return s
+}
+
+func (s *fakeServer) definition() *Definition {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &Definition{Host: host, Port: port}
+}
+
+// recorded returns the connection requests that the server received.
+func (s *fakeServer) recorded() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.requests...)
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	request, err := readTPKT(conn)
+	if err != nil || len(request) < 8 {
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, append([]byte{3, 0, 0, byte(len(request) + 4)}, request...))
+	s.mu.Unlock()
+	if s.reply != nil {
+		_, _ = conn.Write(s.reply)
+		return
+	}
+
+	requested := binary.LittleEndian.Uint32(request[len(request)-4:])
+	confirm := fixture(s.t, s.confirm(requested))
+	_, err = conn.Write(confirm)
+	if err != nil || len(confirm) < 19 || confirm[11] != negotiationResponse {
+		return
+	}
+	selected := binary.LittleEndian.Uint32(confirm[15:19])
+	if selected == protocolRDP {
+		return
+	}
+
+	secure := tls.Server(conn, s.tls)
+	if secure.Handshake() != nil || selected != protocolHybrid {
+		return
+	}
+	s.credssp(secure)
+}
+
+// credssp checks the client's authentication, and proves that the server has
+// the public key of its certificate if the authentication is valid.
+func (s *fakeServer) credssp(conn net.Conn) {
+	negotiate, err := readTSRequest(conn)
+	if err != nil || len(negotiate.NegoTokens) == 0 {
+		return
+	}
+	challenge := fixture(s.t, "challenge")
+	err = writeTSRequest(conn, &tsRequest{Version: s.version, NegoTokens: []negoToken{{challenge}}})
+	if err != nil {
+		return
+	}
+	request, err := readTSRequest(conn)
+	if err != nil || len(request.NegoTokens) == 0 {
+		return
+	}
+	auth := request.NegoTokens[0].Token
+
+	// Check the NTLMv2 response with the user's password
+	payload := func(off int) []byte {
+		length := binary.LittleEndian.Uint16(auth[off:])
+		start := binary.LittleEndian.Uint32(auth[off+4:])
+		return auth[start : start+uint32(length)]
+	}
+	nt, domain, user, encryptedKey := payload(20), fromUTF16(payload(28)), fromUTF16(payload(36)), payload(52)
+	password, ok := s.users[domain+`\`+user]
+	hash := md4.New()
+	hash.Write(toUTF16(password))
+	responseKey := hmacSum(hash.Sum(nil), toUTF16(strings.ToUpper(user)+domain))
+	if !ok || !hmac.Equal(nt[:16], hmacSum(responseKey, challenge[24:32], nt[16:])) {
+		if s.hangUp {
+			return
+		}
+		// Windows sends the error code as a signed 32 bit integer, and this
+		// one is STATUS_LOGON_FAILURE
+		_ = writeTSRequest(conn, &tsRequest{Version: s.version, ErrorCode: int64(int32(-1073741715))})
+		return
+	}
+
+	cipher, _ := rc4.NewCipher(hmacSum(responseKey, nt[:16]))
+	exportedKey := make([]byte, 16)
+	cipher.XORKeyStream(exportedKey, encryptedKey)
+	mic := append([]byte(nil), auth...)
+	copy(mic[72:88], make([]byte, 16))
+	if !hmac.Equal(auth[72:88], hmacSum(exportedKey, negotiate.NegoTokens[0].Token, challenge, mic)) {
+		s.t.Errorf("authenticate message has an invalid MIC")
+		return
+	}
+
+	// Check that the client sent the server's public key back
+	clientSign := md5.Sum(append(append([]byte(nil), exportedKey...), "session key to client-to-server signing key magic constant\x00"...))
+	clientSealKey := md5.Sum(append(append([]byte(nil), exportedKey...), "session key to client-to-server sealing key magic constant\x00"...))
+	serverSign := md5.Sum(append(append([]byte(nil), exportedKey...), "session key to server-to-client signing key magic constant\x00"...))
+	serverSealKey := md5.Sum(append(append([]byte(nil), exportedKey...), "session key to server-to-client sealing key magic constant\x00"...))
+	clientSeal, _ := rc4.NewCipher(clientSealKey[:])
+	serverSeal, _ := rc4.NewCipher(serverSealKey[:])
+
+	sealed := request.PubKeyAuth
+	if len(sealed) < 16 {
+		s.t.Errorf("client did not send the public key back")
+		return
+	}
+	plaintext := make([]byte, len(sealed)-16)
+	clientSeal.XORKeyStream(plaintext, sealed[16:])
+	checksum := hmacSum(clientSign[:], []byte{0, 0, 0, 0}, plaintext)[:8]
+	clientSeal.XORKeyStream(checksum, checksum)
+	want := s.pubKey
+	if s.version >= 5 {
+		want = sha256Sum(clientBindingMagic, request.ClientNonce, s.pubKey)
+	}
+	if !hmac.Equal(sealed[4:12], checksum) || !bytes.Equal(plaintext, want) {
+		s.t.Errorf("client sent back the wrong public key")
+		return
+	}
+
+	proof := append([]byte{s.pubKey[0] + 1}, s.pubKey[1:]...)
+	if s.version >= 5 {
+		proof = sha256Sum(serverBindingMagic, request.ClientNonce, s.pubKey)
+	}
+	if s.badProof {
+		proof[0]++
+	}
+	response := make([]byte, 16+len(proof))
+	serverSeal.XORKeyStream(response[16:], proof)
+	binary.LittleEndian.PutUint32(response[0:4], 1)
+	copy(response[4:12], hmacSum(serverSign[:], []byte{0, 0, 0, 0}, proof)[:8])
+	serverSeal.XORKeyStream(response[4:12], response[4:12])
+	_ = writeTSRequest(conn, &tsRequest{Version: s.version, PubKeyAuth: response})
+}
+
+func hmacSum(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func sha256Sum(data ...[]byte) []byte {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func toUTF16(s string) []byte {
+	var b bytes.Buffer
+	for _, c := range utf16.Encode([]rune(s)) {
+		_ = binary.Write(&b, binary.LittleEndian, c)
+	}
+	return b.Bytes()
+}
+
+func fromUTF16(b []byte) string {
+	chars := make([]uint16, len(b)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(chars))
+}
+
+func TestRun(t *testing.T) {
+	cert, ca := checktest.NewCert(t, "rdp01.corp.example.com")
+	login := func(d *Definition) { d.Username, d.Password, d.Domain = "alice", "hunter2", "CORP" }
+
+	tests := []struct {
+		name     string
+		server   func(s *fakeServer)
+		def      func(d *Definition)
+		passed   bool
+		message  string // the start of the message
+		stage    string
+		protocol string
+	}{
+		{name: "standard RDP security", server: func(s *fakeServer) { s.confirm = onlyRDP }, passed: true, stage: stageNegotiated, protocol: "rdp"},
+		{name: "TLS not allowed", server: func(s *fakeServer) { s.confirm = noTLS }, passed: true, stage: stageNegotiated, protocol: "rdp"},
+		{name: "TLS", server: func(s *fakeServer) { s.confirm = onlyTLS }, passed: true, stage: stageTLS, protocol: "ssl"},
+		{name: "NLA without credentials", passed: true, stage: stageTLS, protocol: "hybrid"},
+		{
+			name:     "verified certificate",
+			def:      func(d *Definition) { d.Verify, d.CA = "true", ca },
+			passed:   true,
+			stage:    stageTLS,
+			protocol: "hybrid",
+		},
+		{name: "login", def: login, passed: true, stage: stageAuthenticated, protocol: "hybrid"},
+		{
+			name:     "login with CredSSP 3",
+			server:   func(s *fakeServer) { s.version = 3 },
+			def:      login,
+			passed:   true,
+			stage:    stageAuthenticated,
+			protocol: "hybrid",
+		},
+		{
+			name:     "wrong password",
+			def:      func(d *Definition) { login(d); d.Password = "hunter3" },
+			message:  "Login with user alice failed : username or password is incorrect",
+			stage:    stageTLS,
+			protocol: "hybrid",
+		},
+		{
+			name:     "wrong domain",
+			def:      func(d *Definition) { login(d); d.Domain = "WORKGROUP" },
+			message:  "Login with user alice failed : username or password is incorrect",
+			stage:    stageTLS,
+			protocol: "hybrid",
+		},
+		{
+			name:     "wrong password with an old server",
+			server:   func(s *fakeServer) { s.version, s.hangUp = 2, true },
+			def:      func(d *Definition) { login(d); d.Password = "hunter3" },
+			message:  "Login with user alice failed : server closed the connection after authentication",
+			stage:    stageTLS,
+			protocol: "hybrid",
+		},
+		{
+			name:     "machine in the middle",
+			server:   func(s *fakeServer) { s.badProof = true },
+			def:      login,
+			message:  "Network Level Authentication failed : server did not prove that it has the public key of its certificate",
+			stage:    stageTLS,
+			protocol: "hybrid",
+		},
+		{
+			name:     "credentials without NLA",
+			server:   func(s *fakeServer) { s.confirm = onlyTLS },
+			def:      login,
+			message:  "Server does not support Network Level Authentication",
+			stage:    stageNegotiated,
+			protocol: "ssl",
+		},
+		{
+			name:     "NLA required",
+			server:   func(s *fakeServer) { s.confirm = nlaRequired },
+			def:      func(d *Definition) { login(d); d.RequireNLA = "true" },
+			passed:   true,
+			stage:    stageAuthenticated,
+			protocol: "hybrid",
+		},
+		{
+			name:     "NLA not required",
+			def:      func(d *Definition) { d.RequireNLA = "true" },
+			message:  "Server allows connections without Network Level Authentication",
+			stage:    stageTLS,
+			protocol: "hybrid",
+		},
+		{
+			name:     "NLA required but not supported",
+			server:   func(s *fakeServer) { s.confirm = onlyRDP },
+			def:      func(d *Definition) { d.RequireNLA = "true" },
+			message:  "Server does not support Network Level Authentication",
+			stage:    stageNegotiated,
+			protocol: "rdp",
+		},
+		{
+			name:     "untrusted certificate",
+			def:      func(d *Definition) { d.Verify = "true" },
+			message:  "TLS handshake with 127.0.0.1 failed : ",
+			stage:    stageNegotiated,
+			protocol: "hybrid",
+		},
+		{
+			name:    "not RDP",
+			server:  func(s *fakeServer) { s.reply = []byte("HTTP/1.1 400 Bad Request\r\n\r\n") },
+			message: "Server did not answer the RDP connection request : response is not a TPKT packet",
+			stage:   stageConnected,
+		},
+		{
+			name:    "not an X.224 connection confirm",
+			server:  func(s *fakeServer) { s.reply = []byte{3, 0, 0, 7, 2, 0xf0, 0x80} },
+			message: "Server did not answer the RDP connection request : response is not an X.224 connection confirm",
+			stage:   stageConnected,
+		},
+		{
+			name:    "invalid CA",
+			def:     func(d *Definition) { d.CA = "not a certificate" },
+			message: "Failed to create TLS config : ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t, cert, tt.server)
+			d := s.definition()
+			if tt.def != nil {
+				tt.def(d)
+			}
+
+			result := d.Run(context.Background())
+			if result.Passed != tt.passed {
+				t.Errorf("got passed %v, want %v (message: %s)", result.Passed, tt.passed, result.Message)
+			}
+			if !strings.HasPrefix(result.Message, tt.message) || (tt.message == "" && result.Message != "") {
+				t.Errorf("got message %q, want it to start with %q", result.Message, tt.message)
+			}
+			if got := result.Details["stage"]; got != tt.stage {
+				t.Errorf("got stage %q, want %q", got, tt.stage)
+			}
+			if got := result.Details["protocol"]; got != tt.protocol {
+				t.Errorf("got protocol %q, want %q", got, tt.protocol)
+			}
+		})
+	}
+}
+
+func TestRunConnectionRequest(t *testing.T) {
+	cert, _ := checktest.NewCert(t, "rdp01.corp.example.com")
+	s := newFakeServer(t, cert, nil)
+	d := s.definition()
+	d.Username, d.Password, d.Domain = "alice", "hunter2", "CORP"
+
+	result := d.Run(context.Background())
+	if !result.Passed {
+		t.Fatalf("check failed: %s", result.Message)
+	}
+	requests := s.recorded()
+	if len(requests) != 1 {
+		t.Fatalf("got %d connection requests, want 1", len(requests))
+	}
+	if want := fixture(t, "request"); !bytes.Equal(requests[0], want) {
+		t.Errorf("got connection request\n%x\nwant\n%x", requests[0], want)
+	}
+}
+
+func TestRunConnectionRefused(t *testing.T) {
+	host, port := checktest.ClosedPort(t)
+
+	d := &Definition{Host: host, Port: port}
+	result := d.Run(context.Background())
+	if result.Passed || !strings.HasPrefix(result.Message, "Could not connect to 127.0.0.1 : ") {
+		t.Errorf("got passed %v with message %q, want a connection failure", result.Passed, result.Message)
+	}
+	if result.Details != nil {
+		t.Errorf("got details %v, want none", result.Details)
+	}
+}
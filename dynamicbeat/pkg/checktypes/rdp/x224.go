@@ -0,0 +1,148 @@
+package rdp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The security protocols that can be negotiated in the X.224 connection
+// request.
+const (
+	protocolRDP      = 0x0 // standard RDP security
+	protocolSSL      = 0x1 // TLS
+	protocolHybrid   = 0x2 // CredSSP, which is Network Level Authentication
+	protocolHybridEx = 0x8 // CredSSP with an early user authorization result
+)
+
+// protocolName returns the name of a security protocol for the check details.
+func protocolName(protocol uint32) string {
+	switch protocol {
+	case protocolRDP:
+		return "rdp"
+	case protocolSSL:
+		return "ssl"
+	case protocolHybrid:
+		return "hybrid"
+	case protocolHybridEx:
+		return "hybrid_ex"
+	default:
+		return fmt.Sprintf("unknown (0x%x)", protocol)
+	}
+}
+
+const (
+	tpktVersion          = 3    // the version of every TPKT header
+	x224ConnectionReq    = 0xe0 // the X.224 TPDU code of connection requests
+	x224ConnectionCfm    = 0xd0 // the X.224 TPDU code of connection confirms
+	negotiationRequest   = 0x01 // the type of RDP_NEG_REQ structures
+	negotiationResponse  = 0x02 // the type of RDP_NEG_RSP structures
+	negotiationFailure   = 0x03 // the type of RDP_NEG_FAILURE structures
+	sslNotAllowed        = 0x02 // the failure code of servers that only support standard RDP security
+	hybridRequired       = 0x05 // the failure code of servers that require CredSSP
+	negotiationStructLen = 8
+)
+
+// negotiationError is returned when the server refuses every protocol that
+// was requested.
+type negotiationError struct {
+	code uint32
+}
+
+func (e *negotiationError) Error() string {
+	switch e.code {
+	case 0x01:
+		return "server requires TLS"
+	case sslNotAllowed:
+		return "server does not allow TLS"
+	case 0x03:
+		return "server does not have a certificate for TLS"
+	case 0x04:
+		return "requested protocols are inconsistent"
+	case hybridRequired:
+		return "server requires Network Level Authentication"
+	case 0x06:
+		return "server requires TLS with user authentication"
+	default:
+		return fmt.Sprintf("unknown negotiation failure code %d", e.code)
+	}
+}
+
+// negotiate sends an X.224 connection request for the given protocols, and
+// returns the protocol that the server selected. Servers that don't have an
+// RDP negotiation response in their connection confirm only support standard
+// RDP security. The cookie is sent to help load balancers route the
+// connection, and is left out if it is empty.
+func negotiate(rw io.ReadWriter, protocols uint32, cookie string) (uint32, error) {
+	// X.224 connection request TPDU, followed by the cookie and RDP_NEG_REQ
+	var body []byte
+	body = append(body, 0, x224ConnectionReq, 0, 0, 0, 0, 0)
+	if cookie != "" {
+		body = append(body, fmt.Sprintf("Cookie: mstshash=%s\r\n", cookie)...)
+	}
+	neg := make([]byte, negotiationStructLen)
+	neg[0] = negotiationRequest
+	binary.LittleEndian.PutUint16(neg[2:4], negotiationStructLen)
+	binary.LittleEndian.PutUint32(neg[4:8], protocols)
+	body = append(body, neg...)
+	body[0] = byte(len(body) - 1)
+
+	err := writeTPKT(rw, body)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err = readTPKT(rw)
+	if err != nil {
+		return 0, err
+	}
+	if len(body) < 7 || int(body[0]) != len(body)-1 || body[1] != x224ConnectionCfm {
+		return 0, fmt.Errorf("response is not an X.224 connection confirm")
+	}
+	neg = body[7:]
+	if len(neg) == 0 {
+		return protocolRDP, nil
+	}
+	if len(neg) < negotiationStructLen {
+		return 0, fmt.Errorf("negotiation response is too short")
+	}
+
+	value := binary.LittleEndian.Uint32(neg[4:8])
+	switch neg[0] {
+	case negotiationResponse:
+		return value, nil
+	case negotiationFailure:
+		return 0, &negotiationError{code: value}
+	default:
+		return 0, fmt.Errorf("unknown negotiation response type %d", neg[0])
+	}
+}
+
+// writeTPKT sends a TPKT packet, which is a 4 byte header with the length of
+// the packet followed by the body.
+func writeTPKT(w io.Writer, body []byte) error {
+	packet := make([]byte, 4, 4+len(body))
+	packet[0] = tpktVersion
+	binary.BigEndian.PutUint16(packet[2:4], uint16(4+len(body)))
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+// readTPKT reads a TPKT packet and returns its body.
+func readTPKT(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != tpktVersion {
+		return nil, fmt.Errorf("response is not a TPKT packet")
+	}
+	length := int(binary.BigEndian.Uint16(header[2:4]))
+	if length < 4 {
+		return nil, fmt.Errorf("TPKT packet is too short")
+	}
+	body := make([]byte, length-4)
+	_, err = io.ReadFull(r, body)
+	return body, err
+}
@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// conn is a small Redis client for the commands that the check needs.
+type conn struct {
+	raw    net.Conn
+	reader *bufio.Reader
+}
+
+// replyError is an error reply from the server, like WRONGPASS or NOAUTH.
+type replyError struct {
+	msg string
+}
+
+func (e *replyError) Error() string {
+	return e.msg
+}
+
+// code returns the first word of the error, which says what kind of error it
+// is.
+func (e *replyError) code() string {
+	return strings.SplitN(e.msg, " ", 2)[0]
+}
+
+// maxBulk is the largest bulk string reply that is read, maxArray is the most
+// items in an array reply that are read, and maxDepth is how deeply arrays can
+// be nested. None of the commands that the check sends get replies anywhere
+// near these, so larger replies are rejected instead of being read.
+const (
+	maxBulk  = 1 << 20
+	maxArray = 1024
+	maxDepth = 8
+)
+
+// dial connects to a Redis server. If config is set, the connection uses TLS.
+// Every command must finish before the deadline of the context.
+func dial(ctx context.Context, addr string, config *tls.Config) (*conn, error) {
+	dialer := check.Dialer{Timeout: 20 * time.Second}
+	var raw net.Conn
+	var err error
+	if config != nil {
+		raw, err = dialer.DialTLS(ctx, "tcp", addr, config)
+	} else {
+		raw, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = raw.SetDeadline(deadline)
+	}
+	return &conn{raw: raw, reader: bufio.NewReader(raw)}, nil
+}
+
+// do sends a command and returns its reply. Error replies are returned as a
+// *replyError.
+func (c *conn) do(args ...string) (interface{}, error) {
+	// Commands are sent as an array of bulk strings
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(c.raw, b.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+// reply reads a reply. Simple and bulk strings are returned as strings,
+// integers as int64, arrays as []interface{}, and nil bulk strings and arrays
+// as nil.
+func (c *conn) reply() (interface{}, error) {
+	return c.readReply(0)
+}
+
+// readReply reads a reply that is nested in depth arrays.
+func (c *conn) readReply(depth int) (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, &replyError{line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxBulk {
+			return nil, fmt.Errorf("invalid bulk string length %s", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(c.reader, data)
+		if err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxArray {
+			return nil, fmt.Errorf("invalid array length %s", line[1:])
+		}
+		if depth >= maxDepth {
+			return nil, fmt.Errorf("arrays are nested more than %d deep", maxDepth)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := c.readReply(depth + 1)
+			if _, ok := err.(*replyError); err != nil && !ok {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply %s", line)
+	}
+}
+
+// auth logs in with a password, and a username for servers that use ACLs.
+func (c *conn) auth(username string, password string) error {
+	args := []string{"AUTH", password}
+	if username != "" {
+		args = []string{"AUTH", username, password}
+	}
+	_, err := c.do(args...)
+	return err
+}
+
+func (c *conn) close() error {
+	return c.raw.Close()
+}
@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  interface{}
+		err   string
+	}{
+		{"simple string", "+PONG\r\n", "PONG", ""},
+		{"error", "-WRONGPASS invalid username-password pair\r\n", nil, "WRONGPASS invalid username-password pair"},
+		{"integer", ":1\r\n", int64(1), ""},
+		{"bulk string", "$5\r\nhello\r\n", "hello", ""},
+		{"multibyte bulk string", "$7\r\nflag✓\r\n", "flag✓", ""},
+		{"nil bulk string", "$-1\r\n", nil, ""},
+		{"array", "*2\r\n$1\r\na\r\n:2\r\n", []interface{}{"a", int64(2)}, ""},
+		{"array with error", "*2\r\n-ERR nope\r\n+OK\r\n", []interface{}{nil, "OK"}, ""},
+		{"nil array", "*-1\r\n", nil, ""},
+		{"empty", "\r\n", nil, "empty reply"},
+		{"unknown type", "!oops\r\n", nil, "unexpected reply !oops"},
+		{"bulk string too long", "$1048577\r\n", nil, "invalid bulk string length 1048577"},
+		{"array too long", "*1025\r\n", nil, "invalid array length 1025"},
+		{"huge array length", "*9223372036854775807\r\n", nil, "invalid array length 9223372036854775807"},
+		{"invalid array length", "*x\r\n", nil, "invalid array length x"},
+		{"nested too deep", strings.Repeat("*1\r\n", maxDepth+1) + "+OK\r\n", nil, "arrays are nested more than 8 deep"},
+		{"truncated bulk string", "$5\r\nhel", nil, "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &conn{reader: bufio.NewReader(strings.NewReader(tt.input))}
+			got, err := c.reply()
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplyErrorCode(t *testing.T) {
+	c := &conn{reader: bufio.NewReader(strings.NewReader("-NOAUTH Authentication required.\r\n"))}
+	_, err := c.reply()
+	var reply *replyError
+	if !errors.As(err, &reply) {
+		t.Fatalf("got %v, want a *replyError", err)
+	}
+	if reply.code() != "NOAUTH" {
+		t.Errorf("got code %s, want NOAUTH", reply.code())
+	}
+}
@@ -0,0 +1,195 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// The Definition configures the behavior of the Redis check
+// it implements the "check" interface
+type Definition struct {
+	Config        check.Config // generic metadata about the check
+	Host          string       `optiontype:"required"`                      // IP or hostname of the Redis server
+	Port          string       `optiontype:"optional" optiondefault:"6379"` // Port of the Redis server
+	Username      string       `optiontype:"optional"`                      // ACL user to log in as; the password is used on its own if this isn't set
+	Password      string       `optiontype:"optional"`                      // Password to log in with; the check doesn't log in if this isn't set
+	TLS           string       `optiontype:"optional"`                      // Whether to connect with TLS
+	Verify        string       `optiontype:"optional"`                      // Whether the server's certificate should be validated
+	CA            string       `optiontype:"optional"`                      // PEM CA certificates to trust instead of the system pool
+	Operation     string       `optiontype:"optional" optiondefault:"ping"` // ping, get, or roundtrip
+	Key           string       `optiontype:"optional"`                      // The key to get, or the scratch key for roundtrip
+	ExpectedValue string       `optiontype:"optional"`                      // Regex that the value of the key must match for get
+}
+
+// scratchTTL is how long the scratch key of a round trip lives, in case it
+// can't be deleted.
+const scratchTTL = "60000"
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	operation := strings.ToLower(d.Operation)
+	switch operation {
+	case "ping", "roundtrip":
+	case "get":
+		if d.Key == "" {
+			result.Message = "Key must be set for the get operation"
+			return result
+		}
+	default:
+		result.Message = fmt.Sprintf("Unknown operation %s - must be ping, get, or roundtrip", d.Operation)
+		return result
+	}
+	regex, err := regexp.Compile(d.ExpectedValue)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ExpectedValue, err)
+		return result
+	}
+
+	var config *tls.Config
+	if useTLS, _ := strconv.ParseBool(d.TLS); useTLS {
+		verify, _ := strconv.ParseBool(d.Verify)
+		config, err = util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to create TLS config : %s", err)
+			return result
+		}
+		config.ServerName = d.Host
+	}
+
+	c, err := dial(ctx, net.JoinHostPort(d.Host, d.Port), config)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer c.close()
+
+	if d.Password != "" {
+		err = c.auth(d.Username, d.Password)
+		if err != nil {
+			result.Message = fmt.Sprintf("Login to %s failed : %s", d.Host, err)
+			return result
+		}
+	}
+
+	switch operation {
+	case "ping":
+		reply, err := c.do("PING")
+		if err != nil {
+			result.Message = d.commandError("PING", err)
+			return result
+		}
+		if reply != "PONG" {
+			result.Message = fmt.Sprintf("PING returned %v instead of PONG", reply)
+			return result
+		}
+	case "get":
+		reply, err := c.do("GET", d.Key)
+		if err != nil {
+			result.Message = d.commandError("GET", err)
+			return result
+		}
+		if reply == nil {
+			result.Message = fmt.Sprintf("Key %s does not exist", d.Key)
+			return result
+		}
+		value, ok := reply.(string)
+		if !ok {
+			result.Message = fmt.Sprintf("GET returned an unexpected reply for key %s", d.Key)
+			return result
+		}
+
+		// The value might contain flags, so only admins get to see it
+		result.AdminDetails = map[string]string{"value": value}
+		if !regex.MatchString(value) {
+			result.Message = fmt.Sprintf("Value of key %s did not match %s", d.Key, d.ExpectedValue)
+			return result
+		}
+	case "roundtrip":
+		message := d.roundTrip(c)
+		if message != "" {
+			result.Message = message
+			return result
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// roundTrip writes a random value to the scratch key, reads it back, and
+// deletes the key. The key expires on its own if it can't be deleted. It
+// returns why the round trip failed, or an empty string if it worked.
+func (d *Definition) roundTrip(c *conn) string {
+	token := make([]byte, 8)
+	_, err := rand.Read(token)
+	if err != nil {
+		return fmt.Sprintf("Failed to generate value : %s", err)
+	}
+	value := hex.EncodeToString(token)
+	key := d.Key
+	if key == "" {
+		key = fmt.Sprintf("scorestack:%s", value)
+	}
+
+	_, err = c.do("SET", key, value, "PX", scratchTTL)
+	if err != nil {
+		return d.commandError("SET", err)
+	}
+	reply, err := c.do("GET", key)
+	if err != nil {
+		return d.commandError("GET", err)
+	}
+	if reply != value {
+		return fmt.Sprintf("Value read from key %s does not match the value that was written", key)
+	}
+	reply, err = c.do("DEL", key)
+	if err != nil {
+		return d.commandError("DEL", err)
+	}
+	if reply != int64(1) {
+		return fmt.Sprintf("Key %s was not deleted", key)
+	}
+	return ""
+}
+
+// commandError describes why a command failed. Servers that need a login
+// reply with NOAUTH, and ACL users that can't run a command get NOPERM.
+func (d *Definition) commandError(command string, err error) string {
+	var reply *replyError
+	if errors.As(err, &reply) {
+		switch reply.code() {
+		case "NOAUTH":
+			return fmt.Sprintf("Server at %s requires a password : %s", d.Host, err)
+		case "NOPERM":
+			return fmt.Sprintf("User is not allowed to run %s : %s", command, err)
+		}
+	}
+	return fmt.Sprintf("Command %s failed : %s", command, err)
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
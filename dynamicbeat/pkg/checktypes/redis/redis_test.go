@@ -0,0 +1,251 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/internal/checktest"
+)
+
+// fakeServer is a scripted Redis server. It keeps keys in memory, and
+// handles the commands that the check sends.
+type fakeServer struct {
+	listener net.Listener
+	password string // AUTH must be sent with this password, if it is set
+	username string // AUTH must be sent with this username, if it is set
+	noAuth   bool   // reply to every command with NOAUTH
+	noPerm   bool   // reply to SET with NOPERM
+	reply    string // sent instead of the reply to every command, if it is set
+
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+// newFakeServer starts a fake server, which is set up by configure before it
+// accepts any connections.
+func newFakeServer(t *testing.T, configure func(s *fakeServer)) *fakeServer {
+	t.Helper()
+	s := &fakeServer{keys: make(map[string]string)}
+	if configure != nil {
+		configure(s)
+	}
+	s.listener = checktest.Serve(t, s.serve)
+	return s
+}
+
+func (s *fakeServer) definition() *Definition {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &Definition{Host: host, Port: port, Operation: "ping"}
+}
+
+func (s *fakeServer) serve(raw net.Conn) {
+	defer raw.Close()
+	reader := bufio.NewReader(raw)
+	authed := s.password == ""
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		_, _ = io.WriteString(raw, s.handle(args, &authed))
+	}
+}
+
+func (s *fakeServer) handle(args []string, authed *bool) string {
+	if s.reply != "" {
+		return s.reply
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	command := strings.ToUpper(args[0])
+	if command == "AUTH" {
+		username, password := "", args[len(args)-1]
+		if len(args) == 3 {
+			username = args[1]
+		}
+		if password != s.password || username != s.username {
+			return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	}
+	if s.noAuth || !*authed {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		value, ok := s.keys[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		if s.noPerm {
+			return "-NOPERM this user has no permissions to run the 'set' command\r\n"
+		}
+		s.keys[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		if _, ok := s.keys[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		delete(s.keys, args[1])
+		return ":1\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// readCommand reads a command, which is sent as an array of bulk strings.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  func(s *fakeServer)
+		def     func(d *Definition)
+		passed  bool
+		message string
+	}{
+		{
+			name:   "ping",
+			passed: true,
+		},
+		{
+			name:    "ping with wrong reply",
+			server:  func(s *fakeServer) { s.reply = "+NOTPONG\r\n" },
+			message: "PING returned NOTPONG instead of PONG",
+		},
+		{
+			name:    "password required",
+			server:  func(s *fakeServer) { s.noAuth = true },
+			message: "requires a password : NOAUTH Authentication required.",
+		},
+		{
+			name:   "password login",
+			server: func(s *fakeServer) { s.password = "hunter2" },
+			def:    func(d *Definition) { d.Password = "hunter2" },
+			passed: true,
+		},
+		{
+			name:   "ACL login",
+			server: func(s *fakeServer) { s.username, s.password = "scorestack", "hunter2" },
+			def:    func(d *Definition) { d.Username, d.Password = "scorestack", "hunter2" },
+			passed: true,
+		},
+		{
+			name:    "wrong password",
+			server:  func(s *fakeServer) { s.password = "hunter2" },
+			def:     func(d *Definition) { d.Password = "hunter3" },
+			message: "failed : WRONGPASS",
+		},
+		{
+			name:   "get matching value",
+			server: func(s *fakeServer) { s.keys["flag"] = "team01" },
+			def: func(d *Definition) {
+				d.Operation, d.Key, d.ExpectedValue = "get", "flag", "^team\\d+$"
+			},
+			passed: true,
+		},
+		{
+			name:   "get value that doesn't match",
+			server: func(s *fakeServer) { s.keys["flag"] = "defaced" },
+			def: func(d *Definition) {
+				d.Operation, d.Key, d.ExpectedValue = "get", "flag", "^team\\d+$"
+			},
+			message: "Value of key flag did not match",
+		},
+		{
+			name:    "get missing key",
+			def:     func(d *Definition) { d.Operation, d.Key = "get", "flag" },
+			message: "Key flag does not exist",
+		},
+		{
+			name:   "roundtrip",
+			def:    func(d *Definition) { d.Operation = "roundtrip" },
+			passed: true,
+		},
+		{
+			name:    "roundtrip without permission",
+			server:  func(s *fakeServer) { s.noPerm = true },
+			def:     func(d *Definition) { d.Operation = "roundtrip" },
+			message: "User is not allowed to run SET",
+		},
+		{
+			name:    "huge array reply",
+			server:  func(s *fakeServer) { s.reply = "*2147483647\r\n" },
+			message: "Command PING failed : invalid array length 2147483647",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t, tt.server)
+			d := s.definition()
+			if tt.def != nil {
+				tt.def(d)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			result := d.Run(ctx)
+			if result.Passed != tt.passed {
+				t.Fatalf("got passed %t, want %t : %s", result.Passed, tt.passed, result.Message)
+			}
+			if !strings.Contains(result.Message, tt.message) {
+				t.Errorf("got message %q, want it to contain %q", result.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestRunRoundTripDeletesKey(t *testing.T) {
+	s := newFakeServer(t, nil)
+	d := s.definition()
+	d.Operation, d.Key = "roundtrip", "scratch"
+	result := d.Run(context.Background())
+	if !result.Passed {
+		t.Fatalf("round trip failed : %s", result.Message)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys["scratch"]; ok {
+		t.Error("scratch key was not deleted")
+	}
+}
@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxResponse is the largest response body that is read.
+const maxResponse = 4 << 20
+
+// client makes requests to the registry API, and logs in when the registry
+// asks it to.
+type client struct {
+	http     *http.Client
+	username string
+	password string
+	token    string // bearer token that is sent with every request
+
+	// authorization is the header from the last login, which is sent with
+	// the next requests so that the client doesn't log in for every request
+	authorization string
+}
+
+// authError is returned when the registry or its token server rejects the
+// credentials.
+type authError struct {
+	msg string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+// apiErrors is the body of a failed request to the registry API.
+type apiErrors struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// describe returns the errors in a response body that failed, or the status
+// of the response if the body doesn't have any.
+func describe(resp *http.Response, body []byte) (string, string) {
+	var errs apiErrors
+	if json.Unmarshal(body, &errs) == nil && len(errs.Errors) > 0 {
+		return errs.Errors[0].Code, fmt.Sprintf("%s: %s", errs.Errors[0].Code, errs.Errors[0].Message)
+	}
+	return "", resp.Status
+}
+
+// do sends a request and reads the response body. If the registry responds
+// with a 401 and a challenge, the client logs in the way the challenge asks
+// and sends the request again. A 401 after logging in is returned as an
+// *authError, and responses with other statuses are returned as they are.
+func (c *client) do(ctx context.Context, method string, target string, header http.Header) (*http.Response, []byte, error) {
+	resp, body, err := c.send(ctx, method, target, header)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, body, err
+	}
+	if c.token != "" {
+		_, reason := describe(resp, body)
+		return nil, nil, &authError{reason}
+	}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	var authorization string
+	switch scheme {
+	case "basic":
+		if c.username == "" {
+			return nil, nil, &authError{"registry requires a login, but no username was given"}
+		}
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+	case "bearer":
+		token, err := c.fetchToken(ctx, params)
+		if err != nil {
+			return nil, nil, err
+		}
+		authorization = "Bearer " + token
+	default:
+		return nil, nil, &authError{fmt.Sprintf("registry sent an unsupported challenge %q", resp.Header.Get("WWW-Authenticate"))}
+	}
+
+	retry := header.Clone()
+	if retry == nil {
+		retry = http.Header{}
+	}
+	retry.Set("Authorization", authorization)
+	resp, body, err = c.send(ctx, method, target, retry)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		_, reason := describe(resp, body)
+		return nil, nil, &authError{reason}
+	}
+	c.authorization = authorization
+	return resp, body, err
+}
+
+// send sends a single request and reads the response body.
+func (c *client) send(ctx context.Context, method string, target string, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.authorization != "" {
+		req.Header.Set("Authorization", c.authorization)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// fetchToken gets a bearer token from the token server in a challenge. The
+// credentials are sent to the token server if there are any, and anonymous
+// tokens are requested otherwise.
+func (c *client) fetchToken(ctx context.Context, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("registry sent an invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		query.Set("scope", params["scope"])
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not get a token from %s : %s", realm.Host, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return "", fmt.Errorf("could not read token from %s : %s", realm.Host, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		_, reason := describe(resp, body)
+		return "", &authError{fmt.Sprintf("token server %s rejected the login : %s", realm.Host, reason)}
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("token server %s returned %s", realm.Host, resp.Status)
+	}
+
+	// Token servers use either name for the token
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return "", fmt.Errorf("could not decode token from %s : %s", realm.Host, err)
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	if token.AccessToken != "" {
+		return token.AccessToken, nil
+	}
+	return "", fmt.Errorf("token server %s did not return a token", realm.Host)
+}
+
+// parseChallenge parses a WWW-Authenticate header like
+// `Bearer realm="https://auth.example.com/token",service="registry"` into its
+// lowercased scheme and its parameters.
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	header = strings.TrimSpace(header)
+	i := strings.IndexByte(header, ' ')
+	if i < 0 {
+		return strings.ToLower(header), params
+	}
+	scheme := strings.ToLower(header[:i])
+	rest := header[i+1:]
+
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return scheme, params
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		// Values are either quoted strings, which can contain commas and
+		// escaped characters, or tokens that end at the next comma
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			j := 1
+			for ; j < len(rest) && rest[j] != '"'; j++ {
+				if rest[j] == '\\' && j+1 < len(rest) {
+					j++
+				}
+				value.WriteByte(rest[j])
+			}
+			rest = rest[j:]
+			if rest != "" {
+				rest = rest[1:]
+			}
+		} else {
+			j := strings.IndexByte(rest, ',')
+			if j < 0 {
+				j = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:j]))
+			rest = rest[j:]
+		}
+		params[key] = value.String()
+	}
+}
@@ -0,0 +1,232 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// The Definition configures the behavior of the Docker registry check
+// it implements the "check" interface
+type Definition struct {
+	Config     check.Config // generic metadata about the check
+	Host       string       `optiontype:"required"`                      // IP or hostname of the registry
+	Port       string       `optiontype:"optional" optiondefault:"5000"` // Port of the registry
+	TLS        string       `optiontype:"optional" optiondefault:"true"` // Whether to connect with HTTPS
+	Verify     string       `optiontype:"optional"`                      // Whether the server's certificate should be validated
+	CA         string       `optiontype:"optional"`                      // PEM CA certificates to trust instead of the system pool
+	Username   string       `optiontype:"optional"`                      // User to log in as when the registry asks for a login
+	Password   string       `optiontype:"optional"`                      // Password for the user
+	Token      string       `optiontype:"optional"`                      // Bearer token to send instead of logging in
+	Repository string       `optiontype:"optional"`                      // Repository to list the tags of, like library/alpine; only the API is checked if it isn't set
+	Tag        string       `optiontype:"optional"`                      // Tag that must exist in the repository
+	Digest     string       `optiontype:"optional"`                      // Digest that the manifest of Tag must have, like sha256:...
+}
+
+const (
+	// maxPages is the most pages of tags that are listed.
+	maxPages = 10
+
+	// manifestTypes are the manifest formats that the check accepts. Without
+	// them, registries convert manifests to an old format with a different
+	// digest.
+	manifestTypes = "application/vnd.docker.distribution.manifest.v2+json, " +
+		"application/vnd.docker.distribution.manifest.list.v2+json, " +
+		"application/vnd.oci.image.manifest.v1+json, " +
+		"application/vnd.oci.image.index.v1+json"
+)
+
+// nextLink matches the URL of the next page in a Link header.
+var nextLink = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	if (d.Tag != "" || d.Digest != "") && d.Repository == "" {
+		result.Message = "Repository must be set to check a tag or digest"
+		return result
+	}
+
+	scheme := "http"
+	var dialer check.Dialer
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	if useTLS, _ := strconv.ParseBool(d.TLS); useTLS {
+		verify, _ := strconv.ParseBool(d.Verify)
+		config, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to create TLS config : %s", err)
+			return result
+		}
+		scheme = "https"
+		transport.TLSClientConfig = config
+	}
+	// Connections aren't kept around between rounds
+	defer transport.CloseIdleConnections()
+	c := &client{
+		http:     &http.Client{Transport: transport},
+		username: d.Username,
+		password: d.Password,
+		token:    d.Token,
+	}
+	base := &url.URL{Scheme: scheme, Host: net.JoinHostPort(d.Host, d.Port)}
+
+	// Make sure the server is a registry that we can log in to
+	resp, body, err := c.do(ctx, http.MethodGet, base.ResolveReference(&url.URL{Path: "/v2/"}).String(), nil)
+	if err != nil {
+		result.Message = d.requestError(err)
+		return result
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		result.Message = fmt.Sprintf("Server at %s is not a Docker registry", d.Host)
+		return result
+	case resp.StatusCode != http.StatusOK:
+		_, reason := describe(resp, body)
+		result.Message = fmt.Sprintf("Registry at %s returned %s", d.Host, reason)
+		return result
+	}
+
+	if d.Repository == "" {
+		// If we reach here the check is successful
+		result.Passed = true
+		return result
+	}
+
+	// List the tags of the repository, following its pages
+	var tags []string
+	found := false
+	next := base.ResolveReference(&url.URL{Path: fmt.Sprintf("/v2/%s/tags/list", d.Repository)}).String()
+	for page := 0; next != "" && page < maxPages; page++ {
+		resp, body, err := c.do(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			result.Message = d.requestError(err)
+			return result
+		}
+		if resp.StatusCode != http.StatusOK {
+			result.Message = d.repositoryError(resp, body)
+			return result
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.Unmarshal(body, &list)
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to decode tags of repository %s : %s", d.Repository, err)
+			return result
+		}
+		tags = append(tags, list.Tags...)
+		for _, tag := range list.Tags {
+			if tag == d.Tag {
+				found = true
+			}
+		}
+
+		next = ""
+		if match := nextLink.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			link, err := url.Parse(match[1])
+			if err == nil {
+				next = base.ResolveReference(link).String()
+			}
+		}
+	}
+	result.Details = map[string]string{"tags": strconv.Itoa(len(tags))}
+	if d.Tag != "" && !found {
+		result.Message = fmt.Sprintf("Tag %s does not exist in repository %s", d.Tag, d.Repository)
+		return result
+	}
+
+	if d.Tag != "" || d.Digest != "" {
+		reference := d.Tag
+		if reference == "" {
+			reference = d.Digest
+		}
+		header := http.Header{"Accept": []string{manifestTypes}}
+		resp, body, err := c.do(ctx, http.MethodGet, base.ResolveReference(&url.URL{Path: fmt.Sprintf("/v2/%s/manifests/%s", d.Repository, reference)}).String(), header)
+		if err != nil {
+			result.Message = d.requestError(err)
+			return result
+		}
+		if resp.StatusCode != http.StatusOK {
+			result.Message = d.repositoryError(resp, body)
+			return result
+		}
+
+		// Registries send the digest in a header, but it's computed from the
+		// manifest if they don't
+		digest := resp.Header.Get("Docker-Content-Digest")
+		if digest == "" {
+			digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+		}
+		result.Details["digest"] = digest
+		if d.Digest != "" && !strings.EqualFold(digest, d.Digest) {
+			result.Message = fmt.Sprintf("Manifest of %s has digest %s, but expected %s", d.image(), digest, d.Digest)
+			return result
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// requestError describes why a request couldn't be completed.
+func (d *Definition) requestError(err error) string {
+	var authErr *authError
+	if errors.As(err, &authErr) {
+		return fmt.Sprintf("Login to %s failed : %s", d.Host, err)
+	}
+	return fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+}
+
+// repositoryError describes why a request for a repository failed.
+// Registries that hide repositories from users that can't pull them reply
+// with a 403 for repositories that don't exist too.
+func (d *Definition) repositoryError(resp *http.Response, body []byte) string {
+	code, reason := describe(resp, body)
+	switch {
+	case code == "NAME_UNKNOWN":
+		return fmt.Sprintf("Repository %s does not exist", d.Repository)
+	case code == "MANIFEST_UNKNOWN":
+		return fmt.Sprintf("Manifest of %s does not exist", d.image())
+	case resp.StatusCode == http.StatusForbidden || code == "DENIED":
+		return fmt.Sprintf("User is not allowed to pull from repository %s : %s", d.Repository, reason)
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Sprintf("Repository %s does not exist : %s", d.Repository, reason)
+	default:
+		return fmt.Sprintf("Registry at %s returned %s", d.Host, reason)
+	}
+}
+
+// image names the image whose manifest is fetched, like team/app:latest or
+// team/app@sha256:...
+func (d *Definition) image() string {
+	if d.Tag != "" {
+		return d.Repository + ":" + d.Tag
+	}
+	return d.Repository + "@" + d.Digest
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
@@ -0,0 +1,521 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/internal/checktest"
+)
+
+const (
+	manifestV2 = "application/vnd.docker.distribution.manifest.v2+json"
+	manifestV1 = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+
+	// staticToken is a bearer token that allows everything, like a token
+	// that was handed out by the organizers.
+	staticToken = "static-token"
+)
+
+// fakeRegistry is a Docker registry that serves the v2 API from a set of
+// repositories, and logs users in with basic auth or with tokens from its
+// own token server, like the distribution registry does.
+type fakeRegistry struct {
+	server      *httptest.Server
+	auth        string            // "basic", "bearer", or "" to allow anonymous pulls
+	users       map[string]string // passwords of the users
+	repos       map[string][]string
+	denied      map[string]bool // repositories that users can't pull from
+	pageSize    int             // how many tags are listed per page
+	noDigest    bool            // leave out the Docker-Content-Digest header
+	notRegistry bool            // serve 404s, like a web server that isn't a registry
+	hang        bool            // never respond
+
+	mu            sync.Mutex
+	tokenRequests int
+}
+
+// newFakeRegistry starts a fake registry, which is set up by configure
+// before it serves any requests.
+func newFakeRegistry(t *testing.T, useTLS bool, configure func(r *fakeRegistry)) *fakeRegistry {
+	t.Helper()
+	r := &fakeRegistry{
+		users: map[string]string{"ci": "hunter2"},
+		repos: map[string][]string{
+			"library/alpine": {"3.13", "3.14", "latest"},
+			"team/app":       {"v1.0.0", "v1.1.0", "v1.2.0", "v2.0.0", "latest"},
+			"team/secret":    {"latest"},
+		},
+		denied:   map[string]bool{"team/secret": true},
+		pageSize: 100,
+	}
+	if configure != nil {
+		configure(r)
+	}
+	done := make(chan struct{})
+	r.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.hang {
+			select {
+			case <-req.Context().Done():
+			case <-done:
+			}
+			return
+		}
+		r.serve(w, req)
+	}))
+	r.server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	if useTLS {
+		r.server.StartTLS()
+	} else {
+		r.server.Start()
+	}
+	t.Cleanup(func() {
+		close(done)
+		r.server.Close()
+	})
+	return r
+}
+
+func (r *fakeRegistry) definition() *Definition {
+	host, port, _ := net.SplitHostPort(r.server.Listener.Addr().String())
+	d := &Definition{Host: host, Port: port, TLS: "false"}
+	if r.server.TLS != nil {
+		d.TLS, d.Verify = "true", "true"
+		d.CA = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.server.Certificate().Raw}))
+	}
+	return d
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	switch {
+	case path == "/token":
+		r.serveToken(w, req)
+		return
+	case r.notRegistry || !strings.HasPrefix(path, "/v2/"):
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if path == "/v2/" {
+		if r.authorize(w, req, "") {
+			fmt.Fprint(w, "{}")
+		}
+		return
+	}
+
+	var name, reference string
+	switch {
+	case strings.HasSuffix(path, "/tags/list"):
+		name = strings.TrimSuffix(strings.TrimPrefix(path, "/v2/"), "/tags/list")
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "/v2/"), "/manifests/", 2)
+		name, reference = parts[0], parts[1]
+	default:
+		apiError(w, http.StatusNotFound, "UNSUPPORTED", "The operation is unsupported.")
+		return
+	}
+	if !r.authorize(w, req, "repository:"+name+":pull") {
+		return
+	}
+	tags, ok := r.repos[name]
+	switch {
+	case r.denied[name]:
+		apiError(w, http.StatusForbidden, "DENIED", "requested access to the resource is denied")
+		return
+	case !ok:
+		apiError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	case reference == "":
+		r.serveTags(w, req, name, tags)
+		return
+	}
+
+	// Registries convert manifests to the old format for clients that don't
+	// accept the new ones
+	mediaType := manifestV1
+	if strings.Contains(req.Header.Get("Accept"), manifestV2) {
+		mediaType = manifestV2
+	}
+	for _, tag := range tags {
+		manifest := newManifest(name, tag, mediaType)
+		if reference == tag || reference == digestOf(manifest) {
+			if !r.noDigest {
+				w.Header().Set("Docker-Content-Digest", digestOf(manifest))
+			}
+			w.Header().Set("Content-Type", mediaType)
+			_, _ = w.Write(manifest)
+			return
+		}
+	}
+	apiError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+}
+
+// serveTags lists the tags of a repository a page at a time, linking to the
+// next page like the distribution registry does.
+func (r *fakeRegistry) serveTags(w http.ResponseWriter, req *http.Request, name string, tags []string) {
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	last := req.URL.Query().Get("last")
+	start := sort.SearchStrings(sorted, last)
+	if last != "" && start < len(sorted) && sorted[start] == last {
+		start++
+	}
+	page := sorted[start:]
+	if len(page) > r.pageSize {
+		page = page[:r.pageSize]
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?last=%s&n=%d>; rel="next"`, name, page[len(page)-1], r.pageSize))
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": page})
+}
+
+// authorize checks the credentials of a request, and sends a challenge for
+// the given scope if they aren't good enough. Tokens are only good for the
+// scope that they were requested for.
+func (r *fakeRegistry) authorize(w http.ResponseWriter, req *http.Request, scope string) bool {
+	authorization := req.Header.Get("Authorization")
+	switch r.auth {
+	case "":
+		return true
+	case "basic":
+		username, password, ok := req.BasicAuth()
+		if ok && r.users[username] == password && password != "" {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="Registry Realm"`)
+	case "bearer":
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if token == staticToken || (strings.HasPrefix(token, "issued:") && (scope == "" || strings.HasSuffix(token, "/"+scope))) {
+			return true
+		}
+		challenge := fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry"`, r.server.URL)
+		if scope != "" {
+			challenge += fmt.Sprintf(`,scope="%s"`, scope)
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	apiError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	return false
+}
+
+// serveToken hands out tokens for the requested scope, to anyone for
+// anonymous pulls or to users with the right password.
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.tokenRequests++
+	r.mu.Unlock()
+
+	username, password, ok := req.BasicAuth()
+	if ok && r.users[username] != password {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"details":"incorrect username or password"}`)
+		return
+	}
+	if req.URL.Query().Get("service") != "fake-registry" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	token := fmt.Sprintf("issued:%s/%s", username, req.URL.Query().Get("scope"))
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": token, "expires_in": 300})
+}
+
+func (r *fakeRegistry) tokens() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tokenRequests
+}
+
+func apiError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":"%s","message":"%s","detail":null}]}`, code, message)
+}
+
+// newManifest creates the manifest of a tag, which is different for each
+// tag and format.
+func newManifest(name string, tag string, mediaType string) []byte {
+	config := sha256.Sum256([]byte(name + ":" + tag))
+	return []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":1472,"digest":"sha256:%x"}}`, mediaType, config))
+}
+
+func digestOf(manifest []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+}
+
+func TestRun(t *testing.T) {
+	appDigest := digestOf(newManifest("team/app", "v1.2.0", manifestV2))
+
+	tests := []struct {
+		name     string
+		tls      bool
+		registry func(r *fakeRegistry)
+		def      func(d *Definition)
+		passed   bool
+		message  string // the start of the message
+		details  map[string]string
+		tokens   int // how many tokens are requested from the token server
+	}{
+		{
+			name:   "API",
+			passed: true,
+		},
+		{
+			name:    "tags",
+			def:     func(d *Definition) { d.Repository = "team/app" },
+			passed:  true,
+			details: map[string]string{"tags": "5"},
+		},
+		{
+			name:     "tags on several pages",
+			registry: func(r *fakeRegistry) { r.pageSize = 2 },
+			def:      func(d *Definition) { d.Repository, d.Tag = "team/app", "v2.0.0" },
+			passed:   true,
+			details:  map[string]string{"tags": "5", "digest": digestOf(newManifest("team/app", "v2.0.0", manifestV2))},
+		},
+		{
+			name:    "tag and digest",
+			def:     func(d *Definition) { d.Repository, d.Tag, d.Digest = "team/app", "v1.2.0", strings.ToUpper(appDigest) },
+			passed:  true,
+			details: map[string]string{"tags": "5", "digest": appDigest},
+		},
+		{
+			name:     "digest without the header",
+			registry: func(r *fakeRegistry) { r.noDigest = true },
+			def:      func(d *Definition) { d.Repository, d.Tag, d.Digest = "team/app", "v1.2.0", appDigest },
+			passed:   true,
+			details:  map[string]string{"tags": "5", "digest": appDigest},
+		},
+		{
+			name:    "digest without a tag",
+			def:     func(d *Definition) { d.Repository, d.Digest = "team/app", appDigest },
+			passed:  true,
+			details: map[string]string{"tags": "5", "digest": appDigest},
+		},
+		{
+			name:    "wrong digest",
+			def:     func(d *Definition) { d.Repository, d.Tag, d.Digest = "team/app", "latest", appDigest },
+			message: fmt.Sprintf("Manifest of team/app:latest has digest %s, but expected %s", digestOf(newManifest("team/app", "latest", manifestV2)), appDigest),
+			details: map[string]string{"tags": "5", "digest": digestOf(newManifest("team/app", "latest", manifestV2))},
+		},
+		{
+			name:    "missing tag",
+			def:     func(d *Definition) { d.Repository, d.Tag = "team/app", "v3.0.0" },
+			message: "Tag v3.0.0 does not exist in repository team/app",
+			details: map[string]string{"tags": "5"},
+		},
+		{
+			name:    "missing manifest",
+			def:     func(d *Definition) { d.Repository, d.Digest = "team/app", "sha256:"+strings.Repeat("0", 64) },
+			message: "Manifest of team/app@sha256:" + strings.Repeat("0", 64) + " does not exist",
+			details: map[string]string{"tags": "5"},
+		},
+		{
+			name:    "missing repository",
+			def:     func(d *Definition) { d.Repository = "team/api" },
+			message: "Repository team/api does not exist",
+		},
+		{
+			name:    "denied repository",
+			def:     func(d *Definition) { d.Repository = "team/secret" },
+			message: "User is not allowed to pull from repository team/secret : DENIED: requested access to the resource is denied",
+		},
+		{
+			name:     "not a registry",
+			registry: func(r *fakeRegistry) { r.notRegistry = true },
+			message:  "Server at 127.0.0.1 is not a Docker registry",
+		},
+		{
+			name:     "basic auth",
+			registry: func(r *fakeRegistry) { r.auth = "basic" },
+			def: func(d *Definition) {
+				d.Username, d.Password, d.Repository, d.Tag = "ci", "hunter2", "team/app", "latest"
+			},
+			passed:  true,
+			details: map[string]string{"tags": "5", "digest": digestOf(newManifest("team/app", "latest", manifestV2))},
+		},
+		{
+			name:     "basic auth with the wrong password",
+			registry: func(r *fakeRegistry) { r.auth = "basic" },
+			def:      func(d *Definition) { d.Username, d.Password, d.Repository = "ci", "hunter3", "team/app" },
+			message:  "Login to 127.0.0.1 failed : UNAUTHORIZED: authentication required",
+		},
+		{
+			name:     "basic auth without a username",
+			registry: func(r *fakeRegistry) { r.auth = "basic" },
+			message:  "Login to 127.0.0.1 failed : registry requires a login, but no username was given",
+		},
+		{
+			// A token is requested for the API, and then for the
+			// repository, which is reused for every page and the manifest
+			name:     "token auth",
+			registry: func(r *fakeRegistry) { r.auth, r.pageSize = "bearer", 2 },
+			def: func(d *Definition) {
+				d.Username, d.Password, d.Repository, d.Tag = "ci", "hunter2", "team/app", "v1.2.0"
+			},
+			passed:  true,
+			details: map[string]string{"tags": "5", "digest": appDigest},
+			tokens:  2,
+		},
+		{
+			name:     "anonymous token auth",
+			registry: func(r *fakeRegistry) { r.auth = "bearer" },
+			def:      func(d *Definition) { d.Repository = "library/alpine" },
+			passed:   true,
+			details:  map[string]string{"tags": "3"},
+			tokens:   2,
+		},
+		{
+			name:     "token auth with the wrong password",
+			registry: func(r *fakeRegistry) { r.auth = "bearer" },
+			def:      func(d *Definition) { d.Username, d.Password = "ci", "hunter3" },
+			message:  "Login to 127.0.0.1 failed : token server 127.0.0.1:",
+			tokens:   1,
+		},
+		{
+			name:     "static token",
+			registry: func(r *fakeRegistry) { r.auth = "bearer" },
+			def:      func(d *Definition) { d.Token, d.Repository, d.Tag = staticToken, "team/app", "latest" },
+			passed:   true,
+			details:  map[string]string{"tags": "5", "digest": digestOf(newManifest("team/app", "latest", manifestV2))},
+		},
+		{
+			name:     "wrong static token",
+			registry: func(r *fakeRegistry) { r.auth = "bearer" },
+			def:      func(d *Definition) { d.Token = "expired-token" },
+			message:  "Login to 127.0.0.1 failed : UNAUTHORIZED: authentication required",
+		},
+		{
+			name:    "TLS",
+			tls:     true,
+			def:     func(d *Definition) { d.Repository, d.Tag = "library/alpine", "3.14" },
+			passed:  true,
+			details: map[string]string{"tags": "3", "digest": digestOf(newManifest("library/alpine", "3.14", manifestV2))},
+		},
+		{
+			name:   "TLS without verification",
+			tls:    true,
+			def:    func(d *Definition) { d.Verify, d.CA = "false", "" },
+			passed: true,
+		},
+		{
+			name:    "untrusted certificate",
+			tls:     true,
+			def:     func(d *Definition) { d.CA = "" },
+			message: "Could not connect to 127.0.0.1 : ",
+		},
+		{
+			name:    "HTTPS to an HTTP registry",
+			def:     func(d *Definition) { d.TLS = "true" },
+			message: "Could not connect to 127.0.0.1 : ",
+		},
+		{
+			name:    "invalid CA",
+			tls:     true,
+			def:     func(d *Definition) { d.CA = "not a certificate" },
+			message: "Failed to create TLS config : ",
+		},
+		{
+			name:    "tag without a repository",
+			def:     func(d *Definition) { d.Tag = "latest" },
+			message: "Repository must be set to check a tag or digest",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRegistry(t, tt.tls, tt.registry)
+			d := r.definition()
+			if tt.def != nil {
+				tt.def(d)
+			}
+
+			result := d.Run(context.Background())
+			if result.Passed != tt.passed {
+				t.Errorf("got passed %v, want %v (message: %s)", result.Passed, tt.passed, result.Message)
+			}
+			if !strings.HasPrefix(result.Message, tt.message) || (tt.message == "" && result.Message != "") {
+				t.Errorf("got message %q, want it to start with %q", result.Message, tt.message)
+			}
+			if fmt.Sprint(result.Details) != fmt.Sprint(tt.details) && (len(result.Details) > 0 || len(tt.details) > 0) {
+				t.Errorf("got details %v, want %v", result.Details, tt.details)
+			}
+			if got := r.tokens(); got != tt.tokens {
+				t.Errorf("got %d token requests, want %d", got, tt.tokens)
+			}
+		})
+	}
+}
+
+func TestRunConnectionRefused(t *testing.T) {
+	host, port := checktest.ClosedPort(t)
+
+	d := &Definition{Host: host, Port: port, TLS: "false"}
+	result := d.Run(context.Background())
+	if result.Passed || !strings.HasPrefix(result.Message, "Could not connect to 127.0.0.1 : ") || !strings.Contains(result.Message, "connection refused") {
+		t.Errorf("got passed %v with message %q, want a connection error", result.Passed, result.Message)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	r := newFakeRegistry(t, false, func(r *fakeRegistry) { r.hang = true })
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	result := r.definition().Run(ctx)
+	if result.Passed || !strings.HasPrefix(result.Message, "Could not connect to 127.0.0.1 : ") || !strings.Contains(result.Message, "deadline exceeded") {
+		t.Errorf("got passed %v with message %q, want a timeout", result.Passed, result.Message)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{
+			header: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`,
+			scheme: "bearer",
+			params: map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/alpine:pull"},
+		},
+		{
+			header: `Basic realm="Registry Realm"`,
+			scheme: "basic",
+			params: map[string]string{"realm": "Registry Realm"},
+		},
+		{
+			header: `Bearer realm="https://gitlab.example.com/jwt/auth", service=container_registry, scope="repository:a/b:pull,push"`,
+			scheme: "bearer",
+			params: map[string]string{"realm": "https://gitlab.example.com/jwt/auth", "service": "container_registry", "scope": "repository:a/b:pull,push"},
+		},
+		{
+			header: `Bearer realm="say \"hi\""`,
+			scheme: "bearer",
+			params: map[string]string{"realm": `say "hi"`},
+		},
+		{
+			header: "Negotiate",
+			scheme: "negotiate",
+			params: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			scheme, params := parseChallenge(tt.header)
+			if scheme != tt.scheme || fmt.Sprint(params) != fmt.Sprint(tt.params) {
+				t.Errorf("got %s %v, want %s %v", scheme, params, tt.scheme, tt.params)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package sip
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// maxBody is the largest response body that is read over TCP.
+const maxBody = 64 << 10
+
+// compactHeaders maps the compact forms of headers to their full names.
+var compactHeaders = map[string]string{
+	"i": "call-id",
+	"m": "contact",
+	"e": "content-encoding",
+	"l": "content-length",
+	"c": "content-type",
+	"f": "from",
+	"s": "subject",
+	"k": "supported",
+	"t": "to",
+	"v": "via",
+}
+
+// A response is a parsed SIP response.
+type response struct {
+	code    int
+	reason  string
+	headers map[string][]string
+}
+
+// header returns the first value of a header, or an empty string if the
+// response doesn't have it.
+func (r *response) header(name string) string {
+	if values := r.headers[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// cseq returns the sequence number and method of the CSeq header.
+func (r *response) cseq() (int, string) {
+	fields := strings.Fields(r.header("cseq"))
+	if len(fields) != 2 {
+		return 0, ""
+	}
+	seq, _ := strconv.Atoi(fields[0])
+	return seq, strings.ToUpper(fields[1])
+}
+
+// readResponse reads a response from a stream. Servers can send the same
+// header several times, fold long headers onto several lines, and use the
+// compact forms of header names, so all of those are handled.
+func readResponse(r *bufio.Reader) (*response, error) {
+	var line string
+	var err error
+
+	// Skip the empty keep-alive lines that some servers send between
+	// messages
+	for line == "" {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+	}
+
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "SIP/") {
+		return nil, fmt.Errorf("invalid status line %q", line)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid status line %q", line)
+	}
+	resp := &response{code: code, headers: make(map[string][]string)}
+	if len(parts) == 3 {
+		resp.reason = parts[2]
+	}
+
+	var name string
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// A folded line continues the last header
+			if values := resp.headers[name]; len(values) > 0 {
+				values[len(values)-1] += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+		name = strings.ToLower(strings.TrimSpace(line[:colon]))
+		if full, ok := compactHeaders[name]; ok {
+			name = full
+		}
+		resp.headers[name] = append(resp.headers[name], strings.TrimSpace(line[colon+1:]))
+	}
+
+	// Skip the body, so that the next response can be read
+	length, _ := strconv.Atoi(resp.header("content-length"))
+	if length > maxBody {
+		return nil, fmt.Errorf("response body is larger than %d bytes", maxBody)
+	}
+	if length > 0 {
+		_, err = io.CopyN(ioutil.Discard, r, int64(length))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// parseResponse parses a response from a single datagram.
+func parseResponse(b []byte) (*response, error) {
+	return readResponse(bufio.NewReader(io.MultiReader(bytes.NewReader(b), strings.NewReader("\r\n\r\n"))))
+}
+
+// randomToken returns a random hex string for tags, branches, and Call-IDs.
+func randomToken() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseChallenge parses the parameters of a Digest challenge.
+func parseChallenge(header string) (map[string]string, bool) {
+	scheme := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(scheme) != 2 || !strings.EqualFold(scheme[0], "Digest") {
+		return nil, false
+	}
+	params := make(map[string]string)
+	rest := scheme[1]
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.Trim(rest[:eq], " ,"))
+		rest = strings.TrimLeft(rest[eq+1:], " ")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			value = rest[1 : end+1]
+			rest = rest[end+1:]
+			rest = strings.TrimPrefix(rest, `"`)
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, " ,")
+	}
+	return params, true
+}
+
+// digestAuthorization answers a Digest challenge for a request, and returns
+// the value of the Authorization header.
+func digestAuthorization(challenge map[string]string, method string, uri string, username string, password string) (string, error) {
+	var h func() hash.Hash
+	algorithm := challenge["algorithm"]
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %s", algorithm)
+	}
+	sum := func(s string) string {
+		d := h()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	realm, nonce := challenge["realm"], challenge["nonce"]
+	ha1 := sum(username + ":" + realm + ":" + password)
+	ha2 := sum(method + ":" + uri)
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, realm, nonce, uri)
+	qop := false
+	for _, option := range strings.Split(challenge["qop"], ",") {
+		if strings.TrimSpace(option) == "auth" {
+			qop = true
+		}
+	}
+	if qop {
+		cnonce := randomToken()
+		header += fmt.Sprintf(`, response="%s", qop=auth, nc=00000001, cnonce="%s"`, sum(ha1+":"+nonce+":00000001:"+cnonce+":auth:"+ha2), cnonce)
+	} else {
+		header += fmt.Sprintf(`, response="%s"`, sum(ha1+":"+nonce+":"+ha2))
+	}
+	if algorithm != "" {
+		header += ", algorithm=" + algorithm
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		header += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return header, nil
+}
@@ -0,0 +1,304 @@
+package sip
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"go.uber.org/zap"
+)
+
+// The Definition configures the behavior of the SIP check
+// it implements the "check" interface
+type Definition struct {
+	Config    check.Config // generic metadata about the check
+	Host      string       `optiontype:"required"`                         // IP or hostname of the SIP server
+	Port      string       `optiontype:"optional" optiondefault:"5060"`    // Port of the SIP server
+	Transport string       `optiontype:"optional" optiondefault:"udp"`     // udp or tcp
+	Mode      string       `optiontype:"optional" optiondefault:"options"` // options to ping the server, or register to log in as Username
+	FromURI   string       `optiontype:"optional"`                         // URI to send the request from; defaults to sip:Username@Host
+	ToURI     string       `optiontype:"optional"`                         // URI to send the request to; defaults to sip:Host for options, or FromURI for register
+	Username  string       `optiontype:"optional"`                         // The extension to register, and the user to authenticate as
+	Password  string       `optiontype:"optional"`                         // The password of the extension
+	Codes     []int        `optiontype:"optional"`                         // Response status codes that pass the check; defaults to 200
+}
+
+// t1 is the first retransmission interval for requests over UDP.
+const t1 = 500 * time.Millisecond
+
+// A client sends requests to a SIP server, and reads its responses.
+type client struct {
+	conn      net.Conn
+	transport string
+	reader    *bufio.Reader
+	buf       []byte
+	callID    string
+	fromTag   string
+	cseq      int
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	transport := strings.ToLower(d.Transport)
+	if transport != "udp" && transport != "tcp" {
+		result.Message = fmt.Sprintf("Unknown transport %s - must be udp or tcp", d.Transport)
+		return result
+	}
+	mode := strings.ToLower(d.Mode)
+	if mode != "options" && mode != "register" {
+		result.Message = fmt.Sprintf("Unknown mode %s - must be options or register", d.Mode)
+		return result
+	}
+	if mode == "register" && d.Username == "" {
+		result.Message = "Username must be set for the register mode"
+		return result
+	}
+	codes := d.Codes
+	if len(codes) == 0 {
+		codes = []int{200}
+	}
+
+	user := d.Username
+	if user == "" {
+		user = "scorestack"
+	}
+	from := d.FromURI
+	if from == "" {
+		from = fmt.Sprintf("sip:%s@%s", user, d.Host)
+	}
+	to := d.ToURI
+	if to == "" && mode == "register" {
+		to = from
+	} else if to == "" {
+		to = "sip:" + d.Host
+	}
+
+	var dialer check.Dialer
+	conn, err := dialer.DialContext(ctx, transport, net.JoinHostPort(d.Host, d.Port))
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer conn.Close()
+	c := &client{
+		conn:      conn,
+		transport: transport,
+		reader:    bufio.NewReader(conn),
+		buf:       make([]byte, 65536),
+		callID:    randomToken() + "@scorestack",
+		fromTag:   randomToken(),
+	}
+
+	var resp *response
+	switch mode {
+	case "options":
+		resp, err = c.do(ctx, "OPTIONS", to, from, to, nil)
+	case "register":
+		resp, err = d.register(ctx, c, from, to, 60)
+	}
+	if err != nil {
+		result.Message = d.requestError(mode, err)
+		return result
+	}
+
+	result.Details = map[string]string{"status": strconv.Itoa(resp.code)}
+	if server := resp.header("server"); server != "" {
+		result.Details["server"] = server
+	} else if agent := resp.header("user-agent"); agent != "" {
+		result.Details["server"] = agent
+	}
+
+	passed := false
+	for _, code := range codes {
+		if resp.code == code {
+			passed = true
+		}
+	}
+	if !passed && mode == "register" && (resp.code == 401 || resp.code == 403 || resp.code == 407) {
+		result.Message = fmt.Sprintf("Login to %s as %s failed : %d %s", d.Host, d.Username, resp.code, resp.reason)
+		return result
+	}
+	if !passed {
+		result.Message = fmt.Sprintf("Server responded with %d %s, but expected one of %v", resp.code, resp.reason, codes)
+		return result
+	}
+
+	if mode == "register" && resp.code/100 == 2 {
+		// Remove the binding that was just registered
+		_, err = d.register(ctx, c, from, to, 0)
+		if err != nil {
+			zap.S().Debugf("Failed to unregister %s from %s: %s", d.Username, d.Host, err)
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// register registers a binding for the extension, and answers the server's
+// challenge with digest authentication if it sends one.
+func (d *Definition) register(ctx context.Context, c *client, from string, to string, expires int) (*response, error) {
+	uri := "sip:" + d.Host
+	headers := []string{"Expires: " + strconv.Itoa(expires)}
+	resp, err := c.do(ctx, "REGISTER", uri, from, to, headers)
+	if err != nil {
+		return nil, err
+	}
+	if resp.code != 401 && resp.code != 407 {
+		return resp, nil
+	}
+
+	// Find a Digest challenge among the challenges that the server sent
+	challengeHeader, authHeader := "www-authenticate", "Authorization"
+	if resp.code == 407 {
+		challengeHeader, authHeader = "proxy-authenticate", "Proxy-Authorization"
+	}
+	var challenge map[string]string
+	for _, value := range resp.headers[challengeHeader] {
+		if params, ok := parseChallenge(value); ok {
+			challenge = params
+			break
+		}
+	}
+	if challenge == nil {
+		return nil, fmt.Errorf("server did not send a Digest challenge")
+	}
+	if d.Password == "" {
+		return nil, fmt.Errorf("server requires authentication, but no Password is set")
+	}
+	auth, err := digestAuthorization(challenge, "REGISTER", uri, d.Username, d.Password)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, "REGISTER", uri, from, to, append(headers, authHeader+": "+auth))
+}
+
+// do sends a request and waits for its final response. Over UDP, the
+// request is sent again with a doubling interval until a response arrives,
+// like RFC 3261 timer A.
+func (c *client) do(ctx context.Context, method string, uri string, from string, to string, extra []string) (*response, error) {
+	c.cseq++
+	local := c.conn.LocalAddr().String()
+	lines := []string{
+		fmt.Sprintf("%s %s SIP/2.0", method, uri),
+		fmt.Sprintf("Via: SIP/2.0/%s %s;branch=z9hG4bK%s;rport", strings.ToUpper(c.transport), local, randomToken()),
+		"Max-Forwards: 70",
+		fmt.Sprintf("From: <%s>;tag=%s", from, c.fromTag),
+		fmt.Sprintf("To: <%s>", to),
+		"Call-ID: " + c.callID,
+		fmt.Sprintf("CSeq: %d %s", c.cseq, method),
+		fmt.Sprintf("Contact: <sip:%s@%s;transport=%s>", contactUser(from), local, c.transport),
+		"User-Agent: Scorestack",
+	}
+	if method == "OPTIONS" {
+		lines = append(lines, "Accept: application/sdp")
+	}
+	lines = append(lines, extra...)
+	lines = append(lines, "Content-Length: 0", "", "")
+	request := []byte(strings.Join(lines, "\r\n"))
+
+	interval := t1
+	for {
+		_, err := c.conn.Write(request)
+		if err != nil {
+			return nil, err
+		}
+
+		// Over TCP the request is only sent once, and the check's deadline
+		// is the only timeout
+		deadline, ok := ctx.Deadline()
+		if c.transport == "udp" && (!ok || time.Now().Add(interval).Before(deadline)) {
+			deadline = time.Now().Add(interval)
+		}
+		_ = c.conn.SetReadDeadline(deadline)
+		resp, err := c.final(method)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && c.transport == "udp" && ctx.Err() == nil {
+			interval *= 2
+			continue
+		}
+		return resp, err
+	}
+}
+
+// final reads responses until the final response to the current request
+// arrives. Provisional responses and responses to earlier requests are
+// skipped.
+func (c *client) final(method string) (*response, error) {
+	for {
+		var resp *response
+		var err error
+		if c.transport == "udp" {
+			var n int
+			n, err = c.conn.Read(c.buf)
+			if err != nil {
+				return nil, err
+			}
+			resp, err = parseResponse(c.buf[:n])
+			if err != nil {
+				// Ignore datagrams that aren't responses
+				continue
+			}
+		} else {
+			resp, err = readResponse(c.reader)
+			if err != nil {
+				return nil, err
+			}
+		}
+		seq, cseqMethod := resp.cseq()
+		if resp.header("call-id") != c.callID || seq != c.cseq || cseqMethod != method {
+			continue
+		}
+		if resp.code >= 200 {
+			return resp, nil
+		}
+	}
+}
+
+// requestError describes why no final response was received.
+func (d *Definition) requestError(mode string, err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Sprintf("No response from %s", d.Host)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		// Over UDP, closed ports are only noticed when reading
+		return fmt.Sprintf("No response from %s : connection refused", d.Host)
+	case mode == "register":
+		return fmt.Sprintf("Registering %s with %s failed : %s", d.Username, d.Host, err)
+	default:
+		return fmt.Sprintf("OPTIONS request to %s failed : %s", d.Host, err)
+	}
+}
+
+// contactUser returns the user part of a SIP URI, or "scorestack" if it
+// doesn't have one.
+func contactUser(uri string) string {
+	uri = strings.TrimPrefix(strings.TrimPrefix(uri, "sips:"), "sip:")
+	if at := strings.IndexByte(uri, '@'); at > 0 {
+		return uri[:at]
+	}
+	return "scorestack"
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
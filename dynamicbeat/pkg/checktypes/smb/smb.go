@@ -1,12 +1,19 @@
 package smb
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"path"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hirochachacha/go-smb2"
@@ -17,15 +24,20 @@ import (
 // The Definition configures the behavior of the SMB check
 // it implements the "check" interface
 type Definition struct {
-	Config       check.Config // generic metadata about the check
-	Host         string       `optiontype:"required"`                     // IP or hostname for SMB server
-	Username     string       `optiontype:"required"`                     // Username for SMB share
-	Password     string       `optiontype:"required"`                     // Password for SMB user
-	Share        string       `optiontype:"required"`                     // Name of the share
-	Domain       string       `optiontype:"required"`                     // The domain found in front of a login (SMB\Administrator : SMB would be the domain)
-	File         string       `optiontype:"required"`                     // The file in the SMB share
-	ContentRegex string       `optiontype:"optional" optiondefault:".*"`  // Regex to match on
-	Port         string       `optiontype:"optional" optiondefault:"445"` // Port of the server
+	Config            check.Config // generic metadata about the check
+	Host              string       `optiontype:"required"`                     // IP or hostname for SMB server
+	Username          string       `optiontype:"required"`                     // Username for SMB share
+	Password          string       `optiontype:"required"`                     // Password for SMB user
+	Share             string       `optiontype:"required"`                     // Name of the share
+	Domain            string       `optiontype:"optional"`                     // The domain found in front of a login (SMB\Administrator : SMB would be the domain); empty for local accounts
+	File              string       `optiontype:"required"`                     // The file in the SMB share
+	ContentRegex      string       `optiontype:"optional" optiondefault:".*"`  // Regex to match on
+	Port              string       `optiontype:"optional" optiondefault:"445"` // Port of the server
+	ContentHash       string       `optiontype:"optional"`                     // The SHA256 hash that the file must have
+	Writable          string       `optiontype:"optional"`                     // Whether to write, read, and delete a scratch file next to File
+	MinDialect        string       `optiontype:"optional"`                     // The oldest dialect that may be negotiated, like 2.1, 3.0, or SMB3
+	RequireSigning    string       `optiontype:"optional"`                     // Whether messages from the server must be signed
+	RequireEncryption string       `optiontype:"optional"`                     // Whether messages from the server must be encrypted
 }
 
 // Run a single instance of the check
@@ -33,25 +45,44 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
+	var minDialect uint16
+	if d.MinDialect != "" {
+		var ok bool
+		minDialect, ok = dialectRevision(d.MinDialect)
+		if !ok {
+			result.Message = fmt.Sprintf("Unknown dialect %s - must be 2.0.2, 2.1, 3.0, 3.0.2, 3.1.1, SMB2, or SMB3", d.MinDialect)
+			return result
+		}
+	}
+
 	// Dial SMB server
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", d.Host, d.Port))
+	var dialer check.Dialer
+	tcpConn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, d.Port))
 	if err != nil {
 		result.Message = fmt.Sprintf("Error with initial dial : %s", err)
 		return result
 	}
-	defer conn.Close()
+	defer tcpConn.Close()
+	conn := &sniffer{Conn: tcpConn}
 
 	// Configure SMB dialer
+	user, domain := d.account()
+	requireSigning, _ := strconv.ParseBool(d.RequireSigning)
 	smbConn := &smb2.Dialer{
+		Negotiator: smb2.Negotiator{
+			RequireMessageSigning: requireSigning,
+		},
 		Initiator: &smb2.NTLMInitiator{
-			User:     d.Username,
+			User:     user,
 			Password: d.Password,
-			Domain:   d.Domain,
+			Domain:   domain,
 		},
 	}
 
 	// Dial SMB server for SMB connection
 	c, err := smbConn.DialContext(ctx, conn)
+	dialect, _, _ := conn.state()
+	result.Details = map[string]string{"dialect": dialectName(dialect)}
 	if err != nil {
 		result.Message = fmt.Sprintf("Error connecting to smb server : %s", err)
 		return result
@@ -76,6 +107,24 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		}
 	}()
 
+	// Check what was negotiated, now that the share's settings are known too
+	_, signed, encrypted := conn.state()
+	result.Details["signed"] = strconv.FormatBool(signed)
+	result.Details["encrypted"] = strconv.FormatBool(encrypted)
+	if dialect < minDialect {
+		result.Message = fmt.Sprintf("Negotiated dialect %s is older than the minimum dialect %s", dialectName(dialect), dialectName(minDialect))
+		return result
+	}
+	// Encrypted messages are protected without signatures
+	if requireSigning && !signed && !encrypted {
+		result.Message = "Messages from the server were not signed"
+		return result
+	}
+	if requireEncryption, _ := strconv.ParseBool(d.RequireEncryption); requireEncryption && !encrypted {
+		result.Message = "Messages from the server were not encrypted"
+		return result
+	}
+
 	// Open the file for reading
 	f, err := fs.Open(d.File)
 	if err != nil {
@@ -98,6 +147,14 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		return result
 	}
 
+	if d.ContentHash != "" {
+		sum := sha256.Sum256(content)
+		if digest := hex.EncodeToString(sum[:]); !strings.EqualFold(digest, d.ContentHash) {
+			result.Message = fmt.Sprintf("Incorrect hash : %s has hash %s", d.File, digest)
+			return result
+		}
+	}
+
 	// Compile regex
 	regex, err := regexp.Compile(d.ContentRegex)
 	if err != nil {
@@ -111,6 +168,64 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		return result
 	}
 
+	if writable, _ := strconv.ParseBool(d.Writable); writable {
+		return d.writeScratch(fs, result)
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// account returns the user and domain to log in with. A domain can be given
+// in the username as DOMAIN\user or user@domain instead of in Domain.
+func (d *Definition) account() (string, string) {
+	if d.Domain != "" {
+		return d.Username, d.Domain
+	}
+	if i := strings.Index(d.Username, `\`); i != -1 {
+		return d.Username[i+1:], d.Username[:i]
+	}
+	if i := strings.LastIndex(d.Username, "@"); i != -1 {
+		return d.Username[:i], d.Username[i+1:]
+	}
+	return d.Username, ""
+}
+
+// writeScratch writes a file with random contents in the directory of File,
+// reads it back, and deletes it.
+func (d *Definition) writeScratch(fs *smb2.Share, result check.Result) check.Result {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error generating scratch file contents : %s", err)
+		return result
+	}
+	content := []byte(hex.EncodeToString(buf))
+	name := path.Join(path.Dir(strings.ReplaceAll(d.File, `\`, "/")), fmt.Sprintf(".scorestack-%x", buf[:4]))
+
+	err = fs.WriteFile(name, content, 0644)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error writing scratch file %s : %s", name, err)
+		return result
+	}
+
+	// Always try to clean up, but report a failed read before a failed delete
+	read, err := fs.ReadFile(name)
+	delErr := fs.Remove(name)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error reading scratch file %s : %s", name, err)
+		return result
+	}
+	if !bytes.Equal(read, content) {
+		result.Message = fmt.Sprintf("Scratch file %s did not contain what was written to it", name)
+		return result
+	}
+	if delErr != nil {
+		result.Message = fmt.Sprintf("Error deleting scratch file %s : %s", name, delErr)
+		return result
+	}
+
 	// If we reach here the check is successful
 	result.Passed = true
 	return result
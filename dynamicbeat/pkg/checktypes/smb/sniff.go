@@ -0,0 +1,162 @@
+package smb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// dialects are the names of the SMB dialects, in the order that they were
+// released.
+var dialects = []struct {
+	name     string
+	revision uint16
+}{
+	{"2.0.2", 0x0202},
+	{"2.1", 0x0210},
+	{"3.0", 0x0300},
+	{"3.0.2", 0x0302},
+	{"3.1.1", 0x0311},
+}
+
+// dialectName returns the name of a dialect revision.
+func dialectName(revision uint16) string {
+	for _, d := range dialects {
+		if d.revision == revision {
+			return d.name
+		}
+	}
+	return "unknown"
+}
+
+// dialectRevision returns the revision of a dialect name, like 3.0. SMB2 and
+// SMB3 are the first dialects of each version.
+func dialectRevision(name string) (uint16, bool) {
+	switch name {
+	case "SMB2", "smb2", "2":
+		name = "2.0.2"
+	case "SMB3", "smb3", "3":
+		name = "3.0"
+	}
+	for _, d := range dialects {
+		if d.name == name {
+			return d.revision, true
+		}
+	}
+	return 0, false
+}
+
+const (
+	headerSize          = 64  // the size of a SMB2 header
+	negotiateCommand    = 0   // the command of NEGOTIATE messages
+	sessionSetupCommand = 1   // the command of SESSION_SETUP messages
+	flagSigned          = 0x8 // the header flag of signed messages
+)
+
+var (
+	smb2Protocol      = []byte("\xfeSMB")
+	transformProtocol = []byte("\xfdSMB") // the protocol of encrypted messages
+)
+
+// sniffer watches the messages that the server sends, since the SMB library
+// doesn't expose what was negotiated. Only the start of each message is
+// looked at, which isn't encrypted for the messages that matter.
+type sniffer struct {
+	net.Conn
+
+	mu        sync.Mutex
+	frame     []byte // the start of the message that is being read
+	skip      int    // the number of bytes left in the message after its start
+	dialect   uint16
+	signed    int // the number of signed messages after the session was set up
+	unsigned  int // the number of unsigned messages after the session was set up
+	encrypted bool
+}
+
+func (s *sniffer) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	s.mu.Lock()
+	s.feed(b[:n])
+	s.mu.Unlock()
+	return n, err
+}
+
+// feed splits the stream into messages, which each start with a 4 byte
+// length, and inspects the start of each one.
+func (s *sniffer) feed(b []byte) {
+	for len(b) > 0 {
+		if s.skip > 0 {
+			n := s.skip
+			if n > len(b) {
+				n = len(b)
+			}
+			s.skip -= n
+			b = b[n:]
+			continue
+		}
+
+		want := 4
+		if len(s.frame) >= 4 {
+			want += s.captured()
+		}
+		n := want - len(s.frame)
+		if n > len(b) {
+			n = len(b)
+		}
+		s.frame = append(s.frame, b[:n]...)
+		b = b[n:]
+
+		if len(s.frame) >= 4 && len(s.frame) == 4+s.captured() {
+			s.inspect(s.frame[4:])
+			s.skip = s.length() - s.captured()
+			s.frame = s.frame[:0]
+		}
+	}
+}
+
+// length returns the size of the current message.
+func (s *sniffer) length() int {
+	return int(s.frame[1])<<16 | int(s.frame[2])<<8 | int(s.frame[3])
+}
+
+// captured returns how much of the current message is inspected, which is
+// enough for the header and the start of a NEGOTIATE response.
+func (s *sniffer) captured() int {
+	if l := s.length(); l < headerSize+6 {
+		return l
+	}
+	return headerSize + 6
+}
+
+func (s *sniffer) inspect(msg []byte) {
+	if bytes.HasPrefix(msg, transformProtocol) {
+		s.encrypted = true
+		return
+	}
+	if !bytes.HasPrefix(msg, smb2Protocol) || len(msg) < headerSize {
+		return
+	}
+
+	// SMB 3.1.1 always signs the end of the session setup, so only the
+	// messages after it show whether signing is used
+	switch command := binary.LittleEndian.Uint16(msg[12:14]); {
+	case command == negotiateCommand:
+		if len(msg) >= headerSize+6 {
+			s.dialect = binary.LittleEndian.Uint16(msg[headerSize+4 : headerSize+6])
+		}
+	case command == sessionSetupCommand:
+	case binary.LittleEndian.Uint32(msg[16:20])&flagSigned != 0:
+		s.signed++
+	default:
+		s.unsigned++
+	}
+}
+
+// state returns what has been seen so far. Messages are only considered
+// signed if every unencrypted message after the session setup was signed.
+func (s *sniffer) state() (dialect uint16, signed bool, encrypted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialect, s.signed > 0 && s.unsigned == 0, s.encrypted
+}
@@ -1,30 +1,40 @@
 package smtp
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"net/smtp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 	"go.uber.org/zap"
 )
 
 // The Definition configures the behavior of the SMTP check
 // it implements the "check" interface
 type Definition struct {
-	Config    check.Config // generic metadata about the check
-	Host      string       `optiontype:"required"`                                       // IP or hostname of the smtp server
-	Username  string       `optiontype:"required"`                                       // Username for the smtp server
-	Password  string       `optiontype:"required"`                                       // Password for the smtp server
-	Sender    string       `optiontype:"required"`                                       // Who is sending the email
-	Reciever  string       `optiontype:"required"`                                       // Who is receiving the email
-	Body      string       `optiontype:"optional" optiondefault:"Hello from Scorestack"` // Body of the email
-	Encrypted string       `optiontype:"optional" optiondefault:"false"`                 // Whether or not to use TLS
-	Port      string       `optiontype:"optional" optiondefault:"25"`                    // Port of the smtp server
+	Config     check.Config // generic metadata about the check
+	Host       string       `optiontype:"required"`                                       // IP or hostname of the smtp server
+	Username   string       `optiontype:"optional"`                                       // Username for the smtp server; the check doesn't log in without one
+	Password   string       `optiontype:"optional"`                                       // Password for the smtp server
+	Sender     string       `optiontype:"required"`                                       // Who is sending the email
+	Reciever   string       `optiontype:"required"`                                       // Who is receiving the email
+	Subject    string       `optiontype:"optional" optiondefault:"Scorestack"`            // Subject of the email, which a random token is added to
+	Body       string       `optiontype:"optional" optiondefault:"Hello from Scorestack"` // Body of the email
+	Encrypted  string       `optiontype:"optional" optiondefault:"false"`                 // Whether or not to use TLS; the same as an Encryption of smtps
+	Encryption string       `optiontype:"optional"`                                       // none, starttls, or smtps
+	Verify     string       `optiontype:"optional"`                                       // Whether the server's certificate should be validated
+	CA         string       `optiontype:"optional"`                                       // PEM CA certificates to trust instead of the system pool
+	Auth       string       `optiontype:"optional" optiondefault:"plain"`                 // plain or login
+	Port       string       `optiontype:"optional"`                                       // Port of the smtp server; defaults to 465 for smtps, or 25 otherwise
 }
 
 // **************************************************
@@ -40,37 +50,93 @@ func (a unencryptedAuth) Start(server *smtp.ServerInfo) (string, []byte, error)
 
 // **************************************************
 
+// loginAuth implements the LOGIN authentication mechanism, which some
+// servers support instead of PLAIN.
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (a loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch prompt := strings.ToLower(string(fromServer)); {
+	case strings.Contains(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.Contains(prompt, "password"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN prompt: %s", fromServer)
+	}
+}
+
 // Run a single instance of the check
 func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
-	// Create a dialer
-	// TODO: change this to be relative to the parent context's timeout
-	dialer := net.Dialer{
-		Timeout: 20 * time.Second,
+	encryption := strings.ToLower(d.Encryption)
+	if encrypted, _ := strconv.ParseBool(d.Encrypted); encryption == "" && encrypted {
+		encryption = "smtps"
+	}
+	if encryption == "" {
+		encryption = "none"
+	}
+	port := d.Port
+	switch encryption {
+	case "none", "starttls":
+		if port == "" {
+			port = "25"
+		}
+	case "smtps":
+		if port == "" {
+			port = "465"
+		}
+	default:
+		result.Message = fmt.Sprintf("Unknown encryption %s - must be none, starttls, or smtps", d.Encryption)
+		return result
 	}
 
 	// ***********************************************
 	// Set up custom auth for bypassing net/smtp protections
-	auth := unencryptedAuth{smtp.PlainAuth("", d.Username, d.Password, d.Host)}
+	var auth smtp.Auth
+	switch strings.ToLower(d.Auth) {
+	case "plain":
+		auth = unencryptedAuth{smtp.PlainAuth("", d.Username, d.Password, d.Host)}
+	case "login":
+		auth = loginAuth{username: d.Username, password: d.Password}
+	default:
+		result.Message = fmt.Sprintf("Unknown auth %s - must be plain or login", d.Auth)
+		return result
+	}
 	// ***********************************************
 
-	// The good way to do auth
-	// auth := smtp.PlainAuth("", d.Username, d.Password, d.Host)
-	// Create TLS config
-	tlsConfig := tls.Config{
-		InsecureSkipVerify: true,
+	// Create TLS config. Certificates are only validated if Verify is set.
+	verify, _ := strconv.ParseBool(d.Verify)
+	tlsConfig, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+	if err != nil {
+		result.Message = fmt.Sprintf("Invalid TLS configuration : %s", err)
+		return result
+	}
+	tlsConfig.ServerName = d.Host
+
+	// Create a dialer that can take as long as the check has left
+	dialer := check.Dialer{
+		Timeout: check.TimeLeft(ctx, 20*time.Second),
 	}
 
 	// Declare these for the below if block
 	var conn net.Conn
-	var err error
-
-	if encrypted, _ := strconv.ParseBool(d.Encrypted); encrypted {
-		conn, err = tls.DialWithDialer(&dialer, "tcp", fmt.Sprintf("%s:%s", d.Host, d.Port), &tlsConfig)
+	addr := net.JoinHostPort(d.Host, port)
+	if encryption == "smtps" {
+		conn, err = dialer.DialTLS(ctx, "tcp", addr, tlsConfig)
 	} else {
-		conn, err = dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%s", d.Host, d.Port))
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
 	}
 	if err != nil {
 		result.Message = fmt.Sprintf("Connecting to server %s failed : %s", d.Host, err)
@@ -78,10 +144,13 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	}
 	defer func() {
 		err := conn.Close()
-		if err != nil {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
 			zap.S().Warnf("Failed to close SMTP connection: %s", err)
 		}
 	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
 
 	// Create smtp client
 	c, err := smtp.NewClient(conn, d.Host)
@@ -96,11 +165,25 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		}
 	}()
 
+	if encryption == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			result.Message = fmt.Sprintf("Server %s does not support STARTTLS", d.Host)
+			return result
+		}
+		err = c.StartTLS(tlsConfig)
+		if err != nil {
+			result.Message = fmt.Sprintf("STARTTLS with server %s failed : %s", d.Host, err)
+			return result
+		}
+	}
+
 	// Login
-	err = c.Auth(auth)
-	if err != nil {
-		result.Message = fmt.Sprintf("Login to %s failed : %s", d.Host, err)
-		return result
+	if d.Username != "" {
+		err = c.Auth(auth)
+		if err != nil {
+			result.Message = fmt.Sprintf("Login to %s failed : %s", d.Host, err)
+			return result
+		}
 	}
 
 	// Set the sender
@@ -117,25 +200,50 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		return result
 	}
 
-	// Send the email body.
+	// Send the email. The server only accepts the message once the writer is
+	// closed.
+	token, msg := d.message()
+	result.Details = map[string]string{"token": token}
 	wc, err := c.Data()
 	if err != nil {
 		result.Message = fmt.Sprintf("Creating writer failed : %s", err)
 		return result
 	}
-	defer wc.Close()
-
-	// Write the body
-	_, err = fmt.Fprintf(wc, d.Body)
+	_, err = wc.Write(msg)
 	if err != nil {
+		wc.Close()
 		result.Message = fmt.Sprintf("Writing mail body failed : %s", err)
 		return result
 	}
+	err = wc.Close()
+	if err != nil {
+		result.Message = fmt.Sprintf("Server did not accept the message : %s", err)
+		return result
+	}
 
 	result.Passed = true
 	return result
 }
 
+// message creates the email to send, with a random token at the end of the
+// subject so that each message can be told apart.
+func (d *Definition) message() (string, []byte) {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", d.Sender)
+	fmt.Fprintf(&msg, "To: %s\r\n", d.Reciever)
+	fmt.Fprintf(&msg, "Subject: %s %s\r\n", d.Subject, token)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@scorestack>\r\n", token)
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(d.Body, "\r\n", "\n"), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return token, msg.Bytes()
+}
+
 // GetConfig returns the current CheckConfig struct this check has been
 // configured with.
 func (d *Definition) GetConfig() check.Config {
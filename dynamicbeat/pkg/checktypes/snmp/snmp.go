@@ -0,0 +1,308 @@
+package snmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// The Definition configures the behavior of the SNMP check
+// it implements the "check" interface
+type Definition struct {
+	Config         check.Config // generic metadata about the check
+	Host           string       `optiontype:"required"`                        // IP or hostname of the SNMP agent
+	Port           string       `optiontype:"optional" optiondefault:"161"`    // Port of the SNMP agent
+	Version        string       `optiontype:"optional" optiondefault:"2c"`     // 1, 2c, or 3
+	Community      string       `optiontype:"optional" optiondefault:"public"` // Community string for versions 1 and 2c
+	Username       string       `optiontype:"optional"`                        // User for version 3
+	AuthProtocol   string       `optiontype:"optional"`                        // md5, sha, sha224, sha256, sha384, or sha512; messages aren't authenticated if it isn't set
+	AuthPassphrase string       `optiontype:"optional"`                        // Passphrase for authentication
+	PrivProtocol   string       `optiontype:"optional"`                        // des, aes, aes192, aes256, aes192c, or aes256c; messages aren't encrypted if it isn't set
+	PrivPassphrase string       `optiontype:"optional"`                        // Passphrase for encryption
+	Gets           []*Get       `optiontype:"list"`                            // OIDs to get, and the values that they must have
+	Walk           string       `optiontype:"optional"`                        // OID of a subtree to walk; the subtree isn't walked if it isn't set
+	MinResults     int          `optiontype:"optional" optiondefault:"1"`      // The fewest OIDs that the walk must return
+}
+
+// A Get requests the value of an OID, and optionally checks it.
+type Get struct {
+	OID        string `optiontype:"required"`                    // The OID to get, like 1.3.6.1.2.1.1.5.0
+	Regex      string `optiontype:"optional"`                    // Regex that the value must match
+	Comparison string `optiontype:"optional" optiondefault:"=="` // How the value is compared to Value: ==, !=, <, <=, >, or >=
+	Value      string `optiontype:"optional"`                    // Number that the value is compared to; the value isn't compared if it isn't set
+}
+
+var authProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"md5":    gosnmp.MD5,
+	"sha":    gosnmp.SHA,
+	"sha224": gosnmp.SHA224,
+	"sha256": gosnmp.SHA256,
+	"sha384": gosnmp.SHA384,
+	"sha512": gosnmp.SHA512,
+}
+
+var privProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"des":     gosnmp.DES,
+	"aes":     gosnmp.AES,
+	"aes192":  gosnmp.AES192,
+	"aes256":  gosnmp.AES256,
+	"aes192c": gosnmp.AES192C,
+	"aes256c": gosnmp.AES256C,
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	port, err := strconv.ParseUint(d.Port, 10, 16)
+	if err != nil {
+		result.Message = fmt.Sprintf("Failed to convert d.Port to int : %s", err)
+		return result
+	}
+	client := &gosnmp.GoSNMP{
+		Target:    d.Host,
+		Port:      uint16(port),
+		Community: d.Community,
+		Context:   ctx,
+		Timeout:   2 * time.Second,
+		Retries:   2,
+		MaxOids:   gosnmp.MaxOids,
+	}
+	switch d.Version {
+	case "1":
+		client.Version = gosnmp.Version1
+	case "2c":
+		client.Version = gosnmp.Version2c
+	case "3":
+		client.Version = gosnmp.Version3
+		params, flags, err := d.security()
+		if err != nil {
+			result.Message = err.Error()
+			return result
+		}
+		client.SecurityModel = gosnmp.UserSecurityModel
+		client.MsgFlags = flags
+		client.SecurityParameters = params
+	default:
+		result.Message = fmt.Sprintf("Unknown version %s - must be 1, 2c, or 3", d.Version)
+		return result
+	}
+
+	// Validate the gets before anything is sent
+	oids := make([]string, 0, len(d.Gets))
+	regexes := make([]*regexp.Regexp, len(d.Gets))
+	for i, get := range d.Gets {
+		oids = append(oids, get.OID)
+		if get.Regex != "" {
+			regex, err := regexp.Compile(get.Regex)
+			if err != nil {
+				result.Message = fmt.Sprintf("Error compiling regex string %s : %s", get.Regex, err)
+				return result
+			}
+			regexes[i] = regex
+		}
+		if get.Value != "" {
+			_, err := compare(get.Comparison, "0", get.Value)
+			if err != nil {
+				result.Message = fmt.Sprintf("Invalid comparison for OID %s : %s", get.OID, err)
+				return result
+			}
+		}
+	}
+	if len(oids) == 0 && d.Walk == "" {
+		result.Message = "At least one of Gets or Walk must be set"
+		return result
+	}
+
+	err = client.Connect()
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer client.Conn.Close()
+
+	// The values might contain flags, so only admins get to see them
+	values := make(map[string]string)
+	result.AdminDetails = values
+
+	if len(oids) > 0 {
+		packet, err := client.Get(oids)
+		if err != nil {
+			result.Message = d.requestError(err)
+			return result
+		}
+		if packet.Error != gosnmp.NoError {
+			result.Message = fmt.Sprintf("Agent returned error %s", packet.Error)
+			return result
+		}
+		if len(packet.Variables) != len(oids) {
+			result.Message = fmt.Sprintf("Agent returned %d values, but %d were requested", len(packet.Variables), len(oids))
+			return result
+		}
+
+		for i, variable := range packet.Variables {
+			get := d.Gets[i]
+			switch variable.Type {
+			case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+				result.Message = fmt.Sprintf("OID %s does not exist on the agent", get.OID)
+				return result
+			}
+			value := format(variable)
+			values[get.OID] = value
+
+			if regexes[i] != nil && !regexes[i].MatchString(value) {
+				result.Message = fmt.Sprintf("Value of OID %s did not match %s", get.OID, get.Regex)
+				return result
+			}
+			if get.Value != "" {
+				ok, err := compare(get.Comparison, value, get.Value)
+				if err != nil {
+					result.Message = fmt.Sprintf("Value of OID %s is not a number : %s", get.OID, value)
+					return result
+				}
+				if !ok {
+					result.Message = fmt.Sprintf("Value of OID %s is %s, which is not %s %s", get.OID, value, get.Comparison, get.Value)
+					return result
+				}
+			}
+		}
+	}
+
+	if d.Walk != "" {
+		// Version 1 doesn't have bulk requests
+		walk := client.BulkWalkAll
+		if client.Version == gosnmp.Version1 {
+			walk = client.WalkAll
+		}
+		variables, err := walk(d.Walk)
+		if err != nil {
+			result.Message = d.requestError(err)
+			return result
+		}
+		for _, variable := range variables {
+			values[strings.TrimPrefix(variable.Name, ".")] = format(variable)
+		}
+		result.Details = map[string]string{"walk_results": strconv.Itoa(len(variables))}
+		if len(variables) < d.MinResults {
+			result.Message = fmt.Sprintf("Walk of %s returned %d OIDs, but at least %d are needed", d.Walk, len(variables), d.MinResults)
+			return result
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// security returns the user security model parameters for version 3.
+func (d *Definition) security() (*gosnmp.UsmSecurityParameters, gosnmp.SnmpV3MsgFlags, error) {
+	params := &gosnmp.UsmSecurityParameters{UserName: d.Username}
+	flags := gosnmp.NoAuthNoPriv
+	if d.AuthProtocol != "" {
+		auth, ok := authProtocols[strings.ToLower(d.AuthProtocol)]
+		if !ok {
+			return nil, 0, fmt.Errorf("Unknown auth protocol %s - must be md5, sha, sha224, sha256, sha384, or sha512", d.AuthProtocol)
+		}
+		params.AuthenticationProtocol = auth
+		params.AuthenticationPassphrase = d.AuthPassphrase
+		flags = gosnmp.AuthNoPriv
+	}
+	if d.PrivProtocol != "" {
+		if flags == gosnmp.NoAuthNoPriv {
+			return nil, 0, fmt.Errorf("AuthProtocol must be set to use PrivProtocol")
+		}
+		priv, ok := privProtocols[strings.ToLower(d.PrivProtocol)]
+		if !ok {
+			return nil, 0, fmt.Errorf("Unknown priv protocol %s - must be des, aes, aes192, aes256, aes192c, or aes256c", d.PrivProtocol)
+		}
+		params.PrivacyProtocol = priv
+		params.PrivacyPassphrase = d.PrivPassphrase
+		flags = gosnmp.AuthPriv
+	}
+	return params, flags, nil
+}
+
+// requestError describes why a request failed. Agents don't answer requests
+// with the wrong community string, so for versions 1 and 2c a wrong community
+// looks the same as an agent that is down. The library doesn't wrap timeout
+// errors, so they are matched by their message.
+func (d *Definition) requestError(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || strings.Contains(err.Error(), "request timeout"):
+		if d.Version == "3" {
+			return fmt.Sprintf("No response from %s", d.Host)
+		}
+		return fmt.Sprintf("No response from %s; the community string might be wrong", d.Host)
+	case errors.Is(err, gosnmp.ErrUnknownUsername):
+		return fmt.Sprintf("Agent does not know user %s", d.Username)
+	case errors.Is(err, gosnmp.ErrWrongDigest):
+		return fmt.Sprintf("Authentication failed for user %s : wrong auth passphrase or protocol", d.Username)
+	case errors.Is(err, gosnmp.ErrDecryption):
+		return fmt.Sprintf("Authentication failed for user %s : wrong priv passphrase or protocol", d.Username)
+	case errors.Is(err, gosnmp.ErrUnknownSecurityLevel):
+		return fmt.Sprintf("Agent does not support the security level for user %s", d.Username)
+	default:
+		return fmt.Sprintf("Request to %s failed : %s", d.Host, err)
+	}
+}
+
+// format returns the value of a variable as a string.
+func format(variable gosnmp.SnmpPDU) string {
+	switch variable.Type {
+	case gosnmp.OctetString:
+		return string(variable.Value.([]byte))
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Counter64, gosnmp.Uinteger32:
+		return gosnmp.ToBigInt(variable.Value).String()
+	case gosnmp.ObjectIdentifier:
+		return strings.TrimPrefix(variable.Value.(string), ".")
+	default:
+		return fmt.Sprint(variable.Value)
+	}
+}
+
+// compare compares a numeric value with an expected number.
+func compare(comparison string, value string, expected string) (bool, error) {
+	want, err := strconv.ParseFloat(expected, 64)
+	if err != nil {
+		return false, err
+	}
+	got, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false, err
+	}
+	switch comparison {
+	case "==":
+		return got == want, nil
+	case "!=":
+		return got != want, nil
+	case "<":
+		return got < want, nil
+	case "<=":
+		return got <= want, nil
+	case ">":
+		return got > want, nil
+	case ">=":
+		return got >= want, nil
+	default:
+		return false, fmt.Errorf("unknown comparison %s - must be ==, !=, <, <=, >, or >=", comparison)
+	}
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
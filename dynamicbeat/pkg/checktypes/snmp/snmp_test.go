@@ -0,0 +1,572 @@
+package snmp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// The OIDs of the USM statistics that agents report errors with, from
+// RFC 3414.
+const (
+	usmStatsUnsupportedSecLevels = ".1.3.6.1.6.3.15.1.1.1.0"
+	usmStatsUnknownUserNames     = ".1.3.6.1.6.3.15.1.1.3.0"
+	usmStatsUnknownEngineIDs     = ".1.3.6.1.6.3.15.1.1.4.0"
+	usmStatsWrongDigests         = ".1.3.6.1.6.3.15.1.1.5.0"
+	usmStatsDecryptionErrors     = ".1.3.6.1.6.3.15.1.1.6.0"
+)
+
+// engineID is the SNMP engine ID of the agent, which is for net-snmp with a
+// random part.
+const engineID = "\x80\x00\x1f\x88\x80\x5c\x4b\x1e\x60\x11\x2c\x0a\x61\x00\x00\x00\x00"
+
+// The MIB of a switch with three interfaces, the last of which is down.
+var switchMIB = map[string]gosnmp.SnmpPDU{
+	".1.3.6.1.2.1.1.1.0":          {Type: gosnmp.OctetString, Value: []byte("Cisco IOS Software, C2960 Software (C2960-LANBASEK9-M), Version 15.0(2)SE11")},
+	".1.3.6.1.2.1.1.2.0":          {Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.9.1.716"},
+	".1.3.6.1.2.1.1.3.0":          {Type: gosnmp.TimeTicks, Value: uint32(8640000)},
+	".1.3.6.1.2.1.1.5.0":          {Type: gosnmp.OctetString, Value: []byte("switch01")},
+	".1.3.6.1.2.1.2.1.0":          {Type: gosnmp.Integer, Value: 3},
+	".1.3.6.1.2.1.2.2.1.2.1":      {Type: gosnmp.OctetString, Value: []byte("GigabitEthernet0/1")},
+	".1.3.6.1.2.1.2.2.1.2.2":      {Type: gosnmp.OctetString, Value: []byte("GigabitEthernet0/2")},
+	".1.3.6.1.2.1.2.2.1.2.10":     {Type: gosnmp.OctetString, Value: []byte("Vlan1")},
+	".1.3.6.1.2.1.2.2.1.8.1":      {Type: gosnmp.Integer, Value: 1},
+	".1.3.6.1.2.1.2.2.1.8.2":      {Type: gosnmp.Integer, Value: 1},
+	".1.3.6.1.2.1.2.2.1.8.10":     {Type: gosnmp.Integer, Value: 2},
+	".1.3.6.1.2.1.31.1.1.1.6.1":   {Type: gosnmp.Counter64, Value: uint64(18446744073709551000)},
+	".1.3.6.1.4.1.9.9.13.1.3.1.3": {Type: gosnmp.Gauge32, Value: uint(38)},
+}
+
+// A user is an SNMPv3 user of the agent.
+type user struct {
+	auth           gosnmp.SnmpV3AuthProtocol
+	authPassphrase string
+	priv           gosnmp.SnmpV3PrivProtocol
+	privPassphrase string
+}
+
+// fakeAgent is an SNMP agent that answers gets, get-nexts, and get-bulks
+// from a MIB. Like net-snmp, it drops requests with the wrong community
+// string, and sends reports for SNMPv3 requests that it can't authenticate.
+type fakeAgent struct {
+	conn      *net.UDPConn
+	mib       map[string]gosnmp.SnmpPDU
+	oids      []string // the OIDs of the MIB in order
+	community string
+	users     map[string]user
+	silent    bool // drop every request, like an agent behind a firewall
+}
+
+// newFakeAgent starts a fake agent, which is set up by configure before it
+// answers any requests.
+func newFakeAgent(t *testing.T, configure func(a *fakeAgent)) *fakeAgent {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	a := &fakeAgent{
+		conn:      conn,
+		mib:       switchMIB,
+		community: "public",
+		users: map[string]user{
+			"alice": {auth: gosnmp.SHA, authPassphrase: "authpass1", priv: gosnmp.AES, privPassphrase: "privpass1"},
+			"bob":   {auth: gosnmp.MD5, authPassphrase: "authpass2", priv: gosnmp.NoPriv},
+			"carol": {auth: gosnmp.SHA256, authPassphrase: "authpass3", priv: gosnmp.DES, privPassphrase: "privpass3"},
+		},
+	}
+	if configure != nil {
+		configure(a)
+	}
+	for oid := range a.mib {
+		a.oids = append(a.oids, oid)
+	}
+	sort.Slice(a.oids, func(i, j int) bool { return compareOIDs(a.oids[i], a.oids[j]) < 0 })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if a.silent {
+				continue
+			}
+			response := a.handle(append([]byte(nil), buf[:n]...))
+			if response != nil {
+				_, _ = conn.WriteToUDP(response, addr)
+			}
+		}
+	}()
+	return a
+}
+
+func (a *fakeAgent) definition() *Definition {
+	addr := a.conn.LocalAddr().(*net.UDPAddr)
+	return &Definition{Host: addr.IP.String(), Port: strconv.Itoa(addr.Port), Version: "2c", Community: "public", MinResults: 1}
+}
+
+// handle returns the response to a request, or nil if the request is
+// dropped.
+func (a *fakeAgent) handle(request []byte) []byte {
+	// Decoding encrypted SNMPv3 requests fails without the user's keys
+	v2c := &gosnmp.GoSNMP{Version: gosnmp.Version2c}
+	packet, err := v2c.SnmpDecodePacket(request)
+	if err != nil || packet.Version == gosnmp.Version3 {
+		return a.handleV3(request)
+	}
+	if packet.Community != a.community {
+		return nil
+	}
+	response := a.respond(packet)
+	response.Community = packet.Community
+	out, err := response.MarshalMsg()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// handleV3 authenticates and decrypts a request with the user's keys, and
+// creates an encrypted and authenticated response.
+func (a *fakeAgent) handleV3(request []byte) []byte {
+	// The header can be read without the user's keys
+	probe := &gosnmp.GoSNMP{
+		Version:            gosnmp.Version3,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		MsgFlags:           gosnmp.NoAuthNoPriv,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{UserName: "probe"},
+	}
+	header, _ := probe.SnmpDecodePacket(request)
+	params, ok := header.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if !ok {
+		return nil
+	}
+	level := header.MsgFlags & gosnmp.AuthPriv
+
+	// Clients discover the engine ID of the agent first
+	if params.AuthoritativeEngineID != engineID {
+		return a.report(header, usmStatsUnknownEngineIDs)
+	}
+	u, ok := a.users[params.UserName]
+	if !ok {
+		return a.report(header, usmStatsUnknownUserNames)
+	}
+	userLevel := gosnmp.NoAuthNoPriv
+	if u.priv != gosnmp.NoPriv {
+		userLevel = gosnmp.AuthPriv
+	} else if u.auth != gosnmp.NoAuth {
+		userLevel = gosnmp.AuthNoPriv
+	}
+	if level > userLevel {
+		return a.report(header, usmStatsUnsupportedSecLevels)
+	}
+
+	agent := &gosnmp.GoSNMP{
+		Version:       gosnmp.Version3,
+		SecurityModel: gosnmp.UserSecurityModel,
+		MsgFlags:      level,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			UserName:                 params.UserName,
+			AuthenticationProtocol:   u.auth,
+			AuthenticationPassphrase: u.authPassphrase,
+			PrivacyProtocol:          u.priv,
+			PrivacyPassphrase:        u.privPassphrase,
+			AuthoritativeEngineID:    engineID,
+		},
+	}
+	if level&gosnmp.AuthPriv == gosnmp.AuthNoPriv {
+		agent.SecurityParameters.(*gosnmp.UsmSecurityParameters).PrivacyProtocol = gosnmp.NoPriv
+	}
+	packet, err := agent.UnmarshalTrap(request, false)
+	switch {
+	case err != nil && strings.Contains(err.Error(), "not authentic"):
+		return a.report(header, usmStatsWrongDigests)
+	case err != nil:
+		return a.report(header, usmStatsDecryptionErrors)
+	}
+
+	response := a.respond(packet)
+	response.MsgFlags = level
+	response.SecurityModel = gosnmp.UserSecurityModel
+	response.SecurityParameters = packet.SecurityParameters
+	response.ContextEngineID = engineID
+	response.MsgID = packet.MsgID
+	out, err := response.MarshalMsg()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// report creates an unauthenticated report of an SNMPv3 error.
+func (a *fakeAgent) report(request *gosnmp.SnmpPacket, oid string) []byte {
+	report := &gosnmp.SnmpPacket{
+		Version:       gosnmp.Version3,
+		MsgFlags:      gosnmp.NoAuthNoPriv,
+		SecurityModel: gosnmp.UserSecurityModel,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			UserName:                 request.SecurityParameters.(*gosnmp.UsmSecurityParameters).UserName,
+			AuthoritativeEngineID:    engineID,
+			AuthoritativeEngineBoots: 3,
+			AuthoritativeEngineTime:  86400,
+		},
+		ContextEngineID: engineID,
+		PDUType:         gosnmp.Report,
+		MsgID:           request.MsgID,
+		RequestID:       request.RequestID,
+		Variables:       []gosnmp.SnmpPDU{{Name: oid, Type: gosnmp.Counter32, Value: uint32(1)}},
+	}
+	out, err := report.MarshalMsg()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// respond looks up the variables of a request in the MIB.
+func (a *fakeAgent) respond(request *gosnmp.SnmpPacket) *gosnmp.SnmpPacket {
+	response := &gosnmp.SnmpPacket{
+		Version:   request.Version,
+		PDUType:   gosnmp.GetResponse,
+		RequestID: request.RequestID,
+	}
+	for i, variable := range request.Variables {
+		switch request.PDUType {
+		case gosnmp.GetRequest:
+			value, ok := a.mib[variable.Name]
+			switch {
+			case ok:
+				value.Name = variable.Name
+				response.Variables = append(response.Variables, value)
+			case request.Version == gosnmp.Version1:
+				// Version 1 agents fail the whole request instead
+				response.Error, response.ErrorIndex = gosnmp.NoSuchName, uint8(i+1)
+				response.Variables = request.Variables
+				return response
+			default:
+				response.Variables = append(response.Variables, gosnmp.SnmpPDU{Name: variable.Name, Type: gosnmp.NoSuchObject})
+			}
+		case gosnmp.GetNextRequest:
+			next := a.next(variable.Name, 1)
+			if len(next) == 0 && request.Version == gosnmp.Version1 {
+				response.Error, response.ErrorIndex = gosnmp.NoSuchName, uint8(i+1)
+				response.Variables = request.Variables
+				return response
+			}
+			response.Variables = append(response.Variables, next...)
+		case gosnmp.GetBulkRequest:
+			// gosnmp doesn't decode max-repetitions, so use the 50 that
+			// it sends by default
+			response.Variables = append(response.Variables, a.next(variable.Name, 50)...)
+		}
+	}
+	return response
+}
+
+// next returns up to count variables after an OID. For SNMPv2, the end of
+// the MIB is marked with endOfMibView.
+func (a *fakeAgent) next(oid string, count int) []gosnmp.SnmpPDU {
+	var variables []gosnmp.SnmpPDU
+	for _, name := range a.oids {
+		if len(variables) == count {
+			return variables
+		}
+		if compareOIDs(name, oid) > 0 {
+			value := a.mib[name]
+			value.Name = name
+			variables = append(variables, value)
+		}
+	}
+	if len(variables) < count {
+		variables = append(variables, gosnmp.SnmpPDU{Name: oid, Type: gosnmp.EndOfMibView})
+	}
+	return variables
+}
+
+// compareOIDs compares OIDs by their numbers, like agents order them.
+func compareOIDs(a string, b string) int {
+	x := strings.Split(strings.Trim(a, "."), ".")
+	y := strings.Split(strings.Trim(b, "."), ".")
+	for i := 0; i < len(x) && i < len(y); i++ {
+		m, _ := strconv.Atoi(x[i])
+		n, _ := strconv.Atoi(y[i])
+		if m != n {
+			return m - n
+		}
+	}
+	return len(x) - len(y)
+}
+
+func TestRun(t *testing.T) {
+	v3 := func(name string, authProtocol string, authPass string, privProtocol string, privPass string) func(d *Definition) {
+		return func(d *Definition) {
+			d.Version, d.Username = "3", name
+			d.AuthProtocol, d.AuthPassphrase = authProtocol, authPass
+			d.PrivProtocol, d.PrivPassphrase = privProtocol, privPass
+			d.Gets = []*Get{{OID: "1.3.6.1.2.1.1.5.0", Regex: "^switch01$"}}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		agent   func(a *fakeAgent)
+		def     func(d *Definition)
+		passed  bool
+		message string // the start of the message
+		details map[string]string
+		values  map[string]string // some of the admin details
+	}{
+		{
+			name:   "get",
+			def:    func(d *Definition) { d.Gets = []*Get{{OID: "1.3.6.1.2.1.1.5.0", Regex: "^switch01$"}} },
+			passed: true,
+			values: map[string]string{"1.3.6.1.2.1.1.5.0": "switch01"},
+		},
+		{
+			name: "interface is up",
+			def: func(d *Definition) {
+				d.Gets = []*Get{{OID: ".1.3.6.1.2.1.2.2.1.8.1", Comparison: "==", Value: "1"}, {OID: "1.3.6.1.2.1.2.2.1.2.1", Regex: "GigabitEthernet"}}
+			},
+			passed: true,
+			values: map[string]string{".1.3.6.1.2.1.2.2.1.8.1": "1", "1.3.6.1.2.1.2.2.1.2.1": "GigabitEthernet0/1"},
+		},
+		{
+			name:    "interface is down",
+			def:     func(d *Definition) { d.Gets = []*Get{{OID: "1.3.6.1.2.1.2.2.1.8.10", Comparison: "==", Value: "1"}} },
+			message: "Value of OID 1.3.6.1.2.1.2.2.1.8.10 is 2, which is not == 1",
+		},
+		{
+			name: "numeric comparisons",
+			def: func(d *Definition) {
+				d.Gets = []*Get{
+					{OID: "1.3.6.1.4.1.9.9.13.1.3.1.3", Comparison: "<", Value: "60"},
+					{OID: "1.3.6.1.2.1.1.3.0", Comparison: ">=", Value: "360000"},
+					{OID: "1.3.6.1.2.1.31.1.1.1.6.1", Comparison: ">", Value: "1e19"},
+					{OID: "1.3.6.1.2.1.2.1.0", Comparison: "!=", Value: "0"},
+				}
+			},
+			passed: true,
+			values: map[string]string{"1.3.6.1.2.1.31.1.1.1.6.1": "18446744073709551000", "1.3.6.1.2.1.1.3.0": "8640000"},
+		},
+		{
+			name:    "regex doesn't match",
+			def:     func(d *Definition) { d.Gets = []*Get{{OID: "1.3.6.1.2.1.1.1.0", Regex: "Juniper"}} },
+			message: "Value of OID 1.3.6.1.2.1.1.1.0 did not match Juniper",
+		},
+		{
+			name:    "value isn't a number",
+			def:     func(d *Definition) { d.Gets = []*Get{{OID: "1.3.6.1.2.1.1.5.0", Comparison: "==", Value: "1"}} },
+			message: "Value of OID 1.3.6.1.2.1.1.5.0 is not a number : switch01",
+		},
+		{
+			name:   "object identifier",
+			def:    func(d *Definition) { d.Gets = []*Get{{OID: "1.3.6.1.2.1.1.2.0", Regex: `^1\.3\.6\.1\.4\.1\.9\.`}} },
+			passed: true,
+		},
+		{
+			name:    "missing OID",
+			def:     func(d *Definition) { d.Gets = []*Get{{OID: "1.3.6.1.2.1.1.5.0"}, {OID: "1.3.6.1.2.1.1.6.0"}} },
+			message: "OID 1.3.6.1.2.1.1.6.0 does not exist on the agent",
+		},
+		{
+			name: "missing OID with version 1",
+			def: func(d *Definition) {
+				d.Version, d.Gets = "1", []*Get{{OID: "1.3.6.1.2.1.1.5.0"}, {OID: "1.3.6.1.2.1.1.6.0"}}
+			},
+			message: "Agent returned error NoSuchName",
+		},
+		{
+			name:    "walk",
+			def:     func(d *Definition) { d.Walk, d.MinResults = "1.3.6.1.2.1.2.2.1.2", 3 },
+			passed:  true,
+			details: map[string]string{"walk_results": "3"},
+			values:  map[string]string{"1.3.6.1.2.1.2.2.1.2.10": "Vlan1"},
+		},
+		{
+			name:    "walk with version 1",
+			def:     func(d *Definition) { d.Version, d.Walk, d.MinResults = "1", "1.3.6.1.2.1.2.2.1.8", 3 },
+			passed:  true,
+			details: map[string]string{"walk_results": "3"},
+		},
+		{
+			name:    "walk with too few results",
+			def:     func(d *Definition) { d.Walk, d.MinResults = "1.3.6.1.2.1.2.2.1.2", 4 },
+			message: "Walk of 1.3.6.1.2.1.2.2.1.2 returned 3 OIDs, but at least 4 are needed",
+			details: map[string]string{"walk_results": "3"},
+		},
+		{
+			name:    "walk of a missing subtree",
+			def:     func(d *Definition) { d.Walk = "1.3.6.1.2.1.4" },
+			message: "Walk of 1.3.6.1.2.1.4 returned 0 OIDs, but at least 1 are needed",
+			details: map[string]string{"walk_results": "0"},
+		},
+		{
+			name:   "version 3 with auth and priv",
+			def:    v3("alice", "SHA", "authpass1", "AES", "privpass1"),
+			passed: true,
+		},
+		{
+			name:   "version 3 with auth",
+			def:    v3("bob", "md5", "authpass2", "", ""),
+			passed: true,
+		},
+		{
+			name: "version 3 walk",
+			def: func(d *Definition) {
+				v3("carol", "sha256", "authpass3", "des", "privpass3")(d)
+				d.Walk, d.MinResults = "1.3.6.1.2.1.2.2.1.8", 3
+			},
+			passed:  true,
+			details: map[string]string{"walk_results": "3"},
+		},
+		{
+			// Users can send requests at a lower security level than they
+			// are allowed to
+			name:   "version 3 with auth for a user with priv",
+			def:    v3("alice", "sha", "authpass1", "", ""),
+			passed: true,
+		},
+		{
+			name:    "unknown user",
+			def:     v3("mallory", "sha", "authpass1", "aes", "privpass1"),
+			message: "Agent does not know user mallory",
+		},
+		{
+			name:    "wrong auth passphrase",
+			def:     v3("alice", "sha", "authpass2", "aes", "privpass1"),
+			message: "Authentication failed for user alice : wrong auth passphrase or protocol",
+		},
+		{
+			name:    "wrong auth protocol",
+			def:     v3("bob", "sha", "authpass2", "", ""),
+			message: "Authentication failed for user bob : wrong auth passphrase or protocol",
+		},
+		{
+			name:    "wrong priv passphrase",
+			def:     v3("alice", "sha", "authpass1", "aes", "privpass2"),
+			message: "Authentication failed for user alice : wrong priv passphrase or protocol",
+		},
+		{
+			name:    "unsupported security level",
+			def:     v3("bob", "md5", "authpass2", "aes", "privpass2"),
+			message: "Agent does not support the security level for user bob",
+		},
+		{
+			name:    "unknown version",
+			def:     func(d *Definition) { d.Version = "2"; d.Walk = "1.3" },
+			message: "Unknown version 2 - must be 1, 2c, or 3",
+		},
+		{
+			name:    "unknown auth protocol",
+			def:     v3("alice", "sha1", "authpass1", "", ""),
+			message: "Unknown auth protocol sha1 - must be md5, sha, sha224, sha256, sha384, or sha512",
+		},
+		{
+			name:    "priv without auth",
+			def:     v3("alice", "", "", "aes", "privpass1"),
+			message: "AuthProtocol must be set to use PrivProtocol",
+		},
+		{
+			name:    "invalid regex",
+			def:     func(d *Definition) { d.Gets = []*Get{{OID: "1.3.6.1.2.1.1.5.0", Regex: "("}} },
+			message: "Error compiling regex string ( : ",
+		},
+		{
+			name:    "invalid comparison",
+			def:     func(d *Definition) { d.Gets = []*Get{{OID: "1.3.6.1.2.1.1.5.0", Comparison: "=", Value: "1"}} },
+			message: "Invalid comparison for OID 1.3.6.1.2.1.1.5.0 : unknown comparison =",
+		},
+		{
+			name:    "nothing to request",
+			message: "At least one of Gets or Walk must be set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newFakeAgent(t, tt.agent)
+			d := a.definition()
+			if tt.def != nil {
+				tt.def(d)
+			}
+
+			result := d.Run(context.Background())
+			if result.Passed != tt.passed {
+				t.Errorf("got passed %v, want %v (message: %s)", result.Passed, tt.passed, result.Message)
+			}
+			if !strings.HasPrefix(result.Message, tt.message) || (tt.message == "" && result.Message != "") {
+				t.Errorf("got message %q, want it to start with %q", result.Message, tt.message)
+			}
+			if fmt.Sprint(result.Details) != fmt.Sprint(tt.details) && (len(result.Details) > 0 || len(tt.details) > 0) {
+				t.Errorf("got details %v, want %v", result.Details, tt.details)
+			}
+			for oid, want := range tt.values {
+				if got := result.AdminDetails[oid]; got != want {
+					t.Errorf("got value %q for %s, want %q", got, oid, want)
+				}
+			}
+		})
+	}
+}
+
+// A wrong community string, an agent that doesn't answer, and an agent that
+// isn't running are told apart.
+func TestRunNoResponse(t *testing.T) {
+	closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := strconv.Itoa(closed.LocalAddr().(*net.UDPAddr).Port)
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		agent   func(a *fakeAgent)
+		def     func(d *Definition)
+		message string
+	}{
+		{
+			name:    "wrong community",
+			def:     func(d *Definition) { d.Community = "private" },
+			message: "No response from 127.0.0.1; the community string might be wrong",
+		},
+		{
+			name:  "silent agent with version 3",
+			agent: func(a *fakeAgent) { a.silent = true },
+			def: func(d *Definition) {
+				d.Version, d.Username, d.AuthProtocol, d.AuthPassphrase = "3", "bob", "md5", "authpass2"
+			},
+			message: "No response from 127.0.0.1",
+		},
+		{
+			name:    "agent isn't running",
+			def:     func(d *Definition) { d.Port = closedPort },
+			message: "Request to 127.0.0.1 failed : ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newFakeAgent(t, tt.agent)
+			d := a.definition()
+			d.Gets = []*Get{{OID: "1.3.6.1.2.1.1.5.0"}}
+			tt.def(d)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			result := d.Run(ctx)
+			community := strings.Contains(result.Message, "community")
+			if result.Passed || !strings.HasPrefix(result.Message, tt.message) || community != strings.Contains(tt.message, "community") {
+				t.Errorf("got passed %v with message %q, want %q", result.Passed, result.Message, tt.message)
+			}
+		})
+	}
+}
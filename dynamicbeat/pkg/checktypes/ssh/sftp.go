@@ -0,0 +1,197 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// checkFile opens an SFTP session and checks the file at Path. In sftp-write
+// mode, a temporary file is written to the Path directory and read back
+// instead.
+func (d *Definition) checkFile(client *ssh.Client, result check.Result) check.Result {
+	if d.Path == "" {
+		result.Message = fmt.Sprintf("Path must be set in %s mode", d.Mode)
+		return result
+	}
+
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error starting SFTP session: %s", err)
+		return result
+	}
+	defer func() {
+		err = sc.Close()
+		if err != nil {
+			zap.S().Warnf("Failed to close SFTP session: %s", err)
+		}
+	}()
+
+	if d.Mode == "sftp-write" {
+		return d.writeFile(sc, result)
+	}
+
+	info, err := sc.Stat(d.Path)
+	if err != nil {
+		result.Assert("file", false)
+		result.Message = fileError("stat", d.Path, err)
+		return result
+	}
+	if info.IsDir() {
+		result.Assert("file", false)
+		result.Message = fmt.Sprintf("%s is a directory", d.Path)
+		return result
+	}
+	result.Details = map[string]string{"size": strconv.FormatInt(info.Size(), 10)}
+	if d.MaxBytes <= 0 && d.ContentHash == "" && d.ExpectedOutput == "" {
+		result.Assert("file", true)
+		result.Assert("content", true)
+
+		// If we made it here the check passes
+		result.Passed = true
+		return result
+	}
+
+	f, err := sc.Open(d.Path)
+	result.Assert("file", err == nil)
+	if err != nil {
+		result.Message = fileError("open", d.Path, err)
+		return result
+	}
+	defer f.Close()
+
+	// The hash covers the whole file, but only the first MaxBytes are kept for
+	// matching. Without a hash, there's no need to read the rest.
+	var r io.Reader = f
+	if d.ContentHash == "" {
+		r = io.LimitReader(f, d.MaxBytes)
+	}
+	hash := sha256.New()
+	content := &util.LimitedBuffer{Max: int(d.MaxBytes)}
+	_, err = io.Copy(io.MultiWriter(hash, content), r)
+	if err != nil {
+		result.Message = fileError("read", d.Path, err)
+		return result
+	}
+	result.AdminDetails = map[string]string{"content": content.String()}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if d.ContentHash != "" && !strings.EqualFold(sum, d.ContentHash) {
+		result.Assert("content", false)
+		result.Message = fmt.Sprintf("Content mismatch: %s has hash %s, but expected %s", d.Path, sum, d.ContentHash)
+		return result
+	}
+	if d.ExpectedOutput != "" {
+		regex, err := regexp.Compile(d.ExpectedOutput)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ExpectedOutput, err)
+			return result
+		}
+		negate, _ := strconv.ParseBool(d.Negate)
+		if regex.Match(content.Bytes()) == negate {
+			result.Assert("content", false)
+			result.Message = fmt.Sprintf("Content mismatch: %s does not match the expected content", d.Path)
+			return result
+		}
+	}
+	result.Assert("content", true)
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// writeFile writes a file with random content to the Path directory, reads
+// it back, and removes it.
+func (d *Definition) writeFile(sc *sftp.Client, result check.Result) check.Result {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error generating file contents: %s", err)
+		return result
+	}
+	content := []byte(hex.EncodeToString(buf))
+	name := path.Join(d.Path, fmt.Sprintf(".scorestack-%x", buf[:4]))
+
+	f, err := sc.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		result.Assert("file", false)
+		result.Message = fileError("create", name, err)
+		return result
+	}
+	defer func() {
+		err := sc.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			zap.S().Warnf("Failed to remove SFTP test file %s: %s", name, err)
+		}
+	}()
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	result.Assert("file", err == nil)
+	if err != nil {
+		result.Message = fileError("write", name, err)
+		return result
+	}
+
+	// The file was written, so failing to read it back only fails the
+	// content assertion
+	f, err = sc.Open(name)
+	if err != nil {
+		result.Assert("content", false)
+		result.Message = fileError("open", name, err)
+		return result
+	}
+	defer f.Close()
+	read, err := ioutil.ReadAll(io.LimitReader(f, int64(len(content))+1))
+	if err != nil {
+		result.Assert("content", false)
+		result.Message = fileError("read", name, err)
+		return result
+	}
+	result.Assert("content", bytes.Equal(read, content))
+	if !bytes.Equal(read, content) {
+		result.Message = fmt.Sprintf("Content mismatch: %s did not contain what was written to it", name)
+		return result
+	}
+
+	err = sc.Remove(name)
+	if err != nil {
+		result.Assert("file", false)
+		result.Message = fileError("remove", name, err)
+		return result
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// fileError describes why an SFTP operation on a file failed.
+func fileError(op string, name string, err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Sprintf("No such file: %s", name)
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Sprintf("Permission denied: failed to %s %s", op, name)
+	default:
+		return fmt.Sprintf("Failed to %s %s: %s", op, name, err)
+	}
+}
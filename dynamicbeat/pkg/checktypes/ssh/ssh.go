@@ -2,12 +2,16 @@ package ssh
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
@@ -15,14 +19,26 @@ import (
 // The Definition configures the behavior of the SSH check
 // it implements the "check" interface
 type Definition struct {
-	Config       check.Config // generic metadata about the check
-	Host         string       `optiontype:"required"`                    // IP or hostname of the host to run the SSH check against
-	Username     string       `optiontype:"required"`                    // The user to login with over ssh
-	Password     string       `optiontype:"required"`                    // The password for the user that you wish to login with
-	Cmd          string       `optiontype:"required"`                    // The command to execute once ssh connection established
-	MatchContent string       `optiontype:"optional"`                    // Whether or not to match content like checking files
-	ContentRegex string       `optiontype:"optional" optiondefault:".*"` // Regex to match if reading a file
-	Port         string       `optiontype:"optional" optiondefault:"22"` // The port to attempt an ssh connection on
+	Config             check.Config // generic metadata about the check
+	Host               string       `optiontype:"required"`                         // IP or hostname of the host to run the SSH check against
+	Username           string       `optiontype:"required"`                         // The user to login with over ssh
+	Password           string       `optiontype:"optional"`                         // The password for the user that you wish to login with
+	Cmd                string       `optiontype:"optional"`                         // The command to execute once ssh connection established
+	MatchContent       string       `optiontype:"optional"`                         // Whether or not to match content like checking files
+	ContentRegex       string       `optiontype:"optional" optiondefault:".*"`      // Regex to match if reading a file
+	Port               string       `optiontype:"optional" optiondefault:"22"`      // The port to attempt an ssh connection on
+	PrivateKey         string       `optiontype:"optional"`                         // PEM or OpenSSH private key to login with
+	KeyPassphrase      string       `optiontype:"optional"`                         // The passphrase of PrivateKey, if it is encrypted
+	AuthMethods        []string     `optiontype:"optional"`                         // The authentication methods to try, in order: publickey, password, or keyboard-interactive
+	HostKeyFingerprint string       `optiontype:"optional"`                         // The SHA256 fingerprint that the host key must have, like SHA256:abc...
+	KnownHosts         string       `optiontype:"optional"`                         // known_hosts lines, one of which must have the host key
+	ExpectedOutput     string       `optiontype:"optional"`                         // Regex that the stdout and stderr of the command must match
+	ExpectedExitCode   int          `optiontype:"optional"`                         // The exit status that the command must have
+	Negate             string       `optiontype:"optional"`                         // Whether the output must not match ExpectedOutput instead
+	Mode               string       `optiontype:"optional" optiondefault:"command"` // command to run Cmd, sftp to check the file at Path, or sftp-write to write a file in the Path directory
+	Path               string       `optiontype:"optional"`                         // The remote path to check in the sftp modes
+	MaxBytes           int64        `optiontype:"optional" optiondefault:"1048576"` // The most bytes of the file to download in sftp mode; 0 only checks that the file exists
+	ContentHash        string       `optiontype:"optional"`                         // The SHA256 hash that the whole file must have in sftp mode
 }
 
 // Run a single instance of the check
@@ -30,21 +46,49 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
-	// Config SSH client
-	// TODO: change timeout to be relative to the parent context's timeout
+	switch d.Mode {
+	case "command", "sftp", "sftp-write":
+	default:
+		result.Message = fmt.Sprintf("Unknown mode %s - must be command, sftp, or sftp-write", d.Mode)
+		return result
+	}
+
+	auth, err := d.authMethods()
+	if err != nil {
+		result.Message = fmt.Sprintf("Error configuring authentication: %s", err)
+		return result
+	}
+	var hostKeyErr error
+	hostKeyCallback, err := util.HostKeyCallback(d.HostKeyFingerprint, d.KnownHosts)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error configuring host key verification: %s", err)
+		return result
+	}
+
+	// Config SSH client, which can take as long as the check has left to
+	// connect
 	config := &ssh.ClientConfig{
 		User: d.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(d.Password),
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = hostKeyCallback(hostname, remote, key)
+			return hostKeyErr
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         20 * time.Second,
+		Timeout: check.TimeLeft(ctx, 20*time.Second),
 	}
 
 	// Create the ssh client
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", d.Host, d.Port), config)
-	if err != nil {
-		result.Message = fmt.Sprintf("Error creating ssh client: %s", err)
+	client, err := dial(ctx, fmt.Sprintf("%s:%s", d.Host, d.Port), config)
+	result.Assert("login", err == nil)
+	switch {
+	case err != nil && hostKeyErr != nil:
+		result.Message = fmt.Sprintf("Host key verification failed: %s", hostKeyErr)
+		return result
+	case err != nil && strings.Contains(err.Error(), "unable to authenticate"):
+		result.Message = fmt.Sprintf("Authentication failed: %s", err)
+		return result
+	case err != nil:
+		result.Message = fmt.Sprintf("Connection failed: %s", err)
 		return result
 	}
 	defer func() {
@@ -54,6 +98,39 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		}
 	}()
 
+	if d.Mode == "command" {
+		return d.runCommand(client, result)
+	}
+	return d.checkFile(client, result)
+}
+
+// dial connects to an SSH server like ssh.Dial, except that it connects
+// through the check's jump host if it has one.
+func dial(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := check.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// runCommand runs Cmd in a new session, and checks its exit status and output.
+func (d *Definition) runCommand(client *ssh.Client, result check.Result) check.Result {
+	if d.Cmd == "" {
+		result.Message = "Cmd must be set in command mode"
+		return result
+	}
+
 	// Create a session from the connection
 	session, err := client.NewSession()
 	if err != nil {
@@ -67,30 +144,71 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 		}
 	}()
 
-	// Run a command
-	output, err := session.CombinedOutput(d.Cmd)
-	if err != nil {
+	// Run a command, and wait for it to finish before checking the output
+	stdout := &util.LimitedBuffer{Max: maxOutput}
+	stderr := &util.LimitedBuffer{Max: maxOutput}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	exitCode := 0
+	err = session.Run(d.Cmd)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitStatus()
+	} else if err != nil {
 		result.Message = fmt.Sprintf("Error executing command: %s", err)
 		return result
 	}
 
+	// The output might contain flags, so only admins get to see it
+	result.Details = map[string]string{"exit_code": strconv.Itoa(exitCode)}
+	result.AdminDetails = map[string]string{"stdout": stdout.String(), "stderr": stderr.String()}
+
+	// Both the exit status and the output are checked, so that each of them
+	// can be scored, but a bad exit status is the one that is reported
+	exitMessage := ""
+	if exitCode != d.ExpectedExitCode {
+		exitMessage = fmt.Sprintf("Command %s exited with status %d, but expected %d", d.Cmd, exitCode, d.ExpectedExitCode)
+	}
+	result.Assert("exit_code", exitMessage == "")
+
 	// Check if we are going to match content
-	if matchContent, _ := strconv.ParseBool(d.MatchContent); !matchContent {
+	pattern := d.ExpectedOutput
+	if matchContent, _ := strconv.ParseBool(d.MatchContent); pattern == "" && matchContent {
+		pattern = d.ContentRegex
+	}
+	if pattern == "" {
+		result.Assert("output", true)
+		if exitMessage != "" {
+			result.Message = exitMessage
+			return result
+		}
+
 		// If we made it here the check passes
-		result.Message = fmt.Sprintf("Command %s executed successfully: %s", d.Cmd, output)
+		result.Message = fmt.Sprintf("Command %s executed successfully", d.Cmd)
 		result.Passed = true
 		return result
 	}
 
 	// Match some content
-	regex, err := regexp.Compile(d.ContentRegex)
+	regex, err := regexp.Compile(pattern)
 	if err != nil {
-		result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ContentRegex, err)
+		result.Message = fmt.Sprintf("Error compiling regex string %s : %s", pattern, err)
 		return result
 	}
 
 	// Check if the content matches
-	if !regex.Match(output) {
+	output := append(append([]byte{}, stdout.Bytes()...), stderr.Bytes()...)
+	negate, _ := strconv.ParseBool(d.Negate)
+	matched := regex.Match(output) != negate
+	result.Assert("output", matched)
+	switch {
+	case exitMessage != "":
+		result.Message = exitMessage
+		return result
+	case !matched && negate:
+		result.Message = "Unexpected matching content found"
+		return result
+	case !matched:
 		result.Message = "Matching content not found"
 		return result
 	}
@@ -100,6 +218,60 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	return result
 }
 
+// maxOutput is the most output that is kept from each of stdout and stderr.
+const maxOutput = 64 << 10
+
+// authMethods returns the authentication methods to try, in order. If no
+// methods are configured, the private key is tried before the password.
+func (d *Definition) authMethods() ([]ssh.AuthMethod, error) {
+	names := d.AuthMethods
+	if len(names) == 0 {
+		if d.PrivateKey != "" {
+			names = append(names, "publickey")
+		}
+		if d.Password != "" {
+			names = append(names, "password")
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("a Password or PrivateKey must be set")
+	}
+
+	var methods []ssh.AuthMethod
+	for _, name := range names {
+		switch name {
+		case "publickey":
+			signer, err := util.ParsePrivateKey(d.PrivateKey, d.KeyPassphrase)
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods, ssh.PublicKeys(signer))
+		case "password":
+			methods = append(methods, ssh.Password(d.Password))
+		case "keyboard-interactive":
+			// Answer every question with the password, which is how
+			// password logins work on servers that only allow this method
+			methods = append(methods, ssh.KeyboardInteractive(func(user string, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = d.Password
+				}
+				return answers, nil
+			}))
+		default:
+			return nil, fmt.Errorf("unknown authentication method %s - must be publickey, password, or keyboard-interactive", name)
+		}
+	}
+	return methods, nil
+}
+
+// Assertions returns the names of the assertions that SSH checks make, for
+// partial credit scoring. The exit_code and output assertions are made in
+// command mode, and the file and content assertions in the sftp modes.
+func (d *Definition) Assertions() []string {
+	return []string{"login", "exit_code", "output", "file", "content"}
+}
+
 // GetConfig returns the current CheckConfig struct this check has been
 // configured with.
 func (d *Definition) GetConfig() check.Config {
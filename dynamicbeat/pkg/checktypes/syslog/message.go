@@ -0,0 +1,84 @@
+package syslog
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// facilities maps the names of syslog facilities to their codes.
+var facilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"ntp":      12,
+	"security": 13,
+	"console":  14,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// severities maps the names of syslog severities to their codes.
+var severities = map[string]int{
+	"emerg":   0,
+	"alert":   1,
+	"crit":    2,
+	"err":     3,
+	"warning": 4,
+	"notice":  5,
+	"info":    6,
+	"debug":   7,
+}
+
+// parseCode parses the name or number of a facility or severity.
+func parseCode(value string, names map[string]int, max int) (int, bool) {
+	value = strings.ToLower(value)
+	if code, ok := names[value]; ok {
+		return code, true
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil || code < 0 || code > max {
+		return 0, false
+	}
+	return code, true
+}
+
+// format builds a syslog message in the RFC 5424 or RFC 3164 format.
+func format(rfc string, priority int, appName string, msg string, now time.Time) []byte {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	if rfc == "3164" {
+		// RFC 3164 hostnames can't contain dots
+		hostname = strings.SplitN(hostname, ".", 2)[0]
+		return []byte(fmt.Sprintf("<%d>%s %s %s: %s", priority, now.Format(time.Stamp), hostname, appName, msg))
+	}
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d - - %s", priority, now.Format("2006-01-02T15:04:05.000000Z07:00"), hostname, appName, os.Getpid(), msg))
+}
+
+// frame frames a message for a stream transport, either with a trailing
+// newline or with octet counting like RFC 6587 describes.
+func frame(framing string, msg []byte) []byte {
+	if framing == "octet" {
+		return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	return append(msg, '\n')
+}
@@ -0,0 +1,276 @@
+package syslog
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// The Definition configures the behavior of the syslog check
+// it implements the "check" interface
+type Definition struct {
+	Config        check.Config // generic metadata about the check
+	Host          string       `optiontype:"required"`                                             // IP or hostname of the syslog collector
+	Port          string       `optiontype:"optional"`                                             // Port of the collector; defaults to 514, or 6514 for tls
+	Transport     string       `optiontype:"optional" optiondefault:"udp"`                         // udp, tcp, or tls
+	Format        string       `optiontype:"optional" optiondefault:"5424"`                        // 5424 or 3164
+	Framing       string       `optiontype:"optional" optiondefault:"newline"`                     // newline or octet, for the tcp and tls transports
+	Facility      string       `optiontype:"optional" optiondefault:"user"`                        // The name or number of the facility
+	Severity      string       `optiontype:"optional" optiondefault:"notice"`                      // The name or number of the severity
+	AppName       string       `optiontype:"optional" optiondefault:"scorestack"`                  // The app name of the message
+	Message       string       `optiontype:"optional" optiondefault:"Scorestack check {{.Token}}"` // Template of the message; {{.Token}} is replaced with a unique token
+	Verify        string       `optiontype:"optional"`                                             // Whether the collector's and query endpoint's certificates should be validated
+	CA            string       `optiontype:"optional"`                                             // PEM CA certificates to trust instead of the system pool
+	ClientCert    string       `optiontype:"optional"`                                             // PEM client certificate to present to the collector
+	ClientKey     string       `optiontype:"optional"`                                             // PEM private key of the client certificate
+	QueryURL      string       `optiontype:"optional"`                                             // URL that must return the token once the message is stored; {{.Token}} is replaced with the token
+	QueryUsername string       `optiontype:"optional"`                                             // Username for basic auth to the query URL
+	QueryPassword string       `optiontype:"optional"`                                             // Password for basic auth to the query URL
+	QueryTimeout  string       `optiontype:"optional" optiondefault:"10s"`                         // How long to wait for the query to return the token
+}
+
+// closeWait is how long the collector has to reset the connection or refuse
+// the message after it is sent.
+const closeWait = time.Second
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	transport := strings.ToLower(d.Transport)
+	if transport != "udp" && transport != "tcp" && transport != "tls" {
+		result.Message = fmt.Sprintf("Unknown transport %s - must be udp, tcp, or tls", d.Transport)
+		return result
+	}
+	if d.Format != "5424" && d.Format != "3164" {
+		result.Message = fmt.Sprintf("Unknown format %s - must be 5424 or 3164", d.Format)
+		return result
+	}
+	framing := strings.ToLower(d.Framing)
+	if framing != "newline" && framing != "octet" {
+		result.Message = fmt.Sprintf("Unknown framing %s - must be newline or octet", d.Framing)
+		return result
+	}
+	facility, ok := parseCode(d.Facility, facilities, 23)
+	if !ok {
+		result.Message = fmt.Sprintf("Unknown facility %s", d.Facility)
+		return result
+	}
+	severity, ok := parseCode(d.Severity, severities, 7)
+	if !ok {
+		result.Message = fmt.Sprintf("Unknown severity %s", d.Severity)
+		return result
+	}
+	queryTimeout, err := time.ParseDuration(d.QueryTimeout)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error parsing query timeout %s : %s", d.QueryTimeout, err)
+		return result
+	}
+	verify, _ := strconv.ParseBool(d.Verify)
+	tlsConfig, err := util.NewTLSConfigFromPEM(verify, d.CA, d.ClientCert, d.ClientKey)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error configuring TLS : %s", err)
+		return result
+	}
+
+	// Put a unique token in the message, so that the query can find it
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	token := hex.EncodeToString(b)
+	msg, err := render(d.Message, token)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error rendering message template : %s", err)
+		return result
+	}
+	if d.QueryURL != "" && !strings.Contains(msg, token) {
+		result.Message = "Message must contain {{.Token}} for the query to find it"
+		return result
+	}
+	result.Details = map[string]string{"token": token}
+
+	port := d.Port
+	if port == "" && transport == "tls" {
+		port = "6514"
+	} else if port == "" {
+		port = "514"
+	}
+	network := transport
+	if network == "tls" {
+		network = "tcp"
+	}
+	var dialer check.Dialer
+	conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(d.Host, port))
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if transport == "tls" {
+		config := tlsConfig.Clone()
+		config.ServerName = d.Host
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.Handshake()
+		if err != nil {
+			result.Message = fmt.Sprintf("TLS handshake with %s failed : %s", d.Host, err)
+			return result
+		}
+		conn = tlsConn
+	}
+
+	packet := format(d.Format, facility*8+severity, d.AppName, msg, time.Now())
+	if transport != "udp" {
+		packet = frame(framing, packet)
+	}
+	_, err = conn.Write(packet)
+	if err != nil {
+		result.Message = fmt.Sprintf("Sending the message to %s failed : %s", d.Host, err)
+		return result
+	}
+	err = closeSession(ctx, conn)
+	if err != nil {
+		result.Message = d.sessionError(transport, err)
+		return result
+	}
+
+	if d.QueryURL != "" {
+		queryCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+		defer cancel()
+		found, err := d.query(queryCtx, tlsConfig, token)
+		if err != nil {
+			result.Message = fmt.Sprintf("Query to %s failed : %s", d.QueryURL, err)
+			return result
+		}
+		if !found {
+			result.Message = fmt.Sprintf("Message with token %s was not returned by %s within %s", token, d.QueryURL, d.QueryTimeout)
+			return result
+		}
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// closeSession ends the session, and waits briefly for the collector to
+// close or reset it. Over UDP, this notices closed ports, since the ICMP
+// error that they send makes the next read fail.
+func closeSession(ctx context.Context, conn net.Conn) error {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		_ = c.CloseWrite()
+	case *net.TCPConn:
+		_ = c.CloseWrite()
+	}
+	deadline := time.Now().Add(closeWait)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetReadDeadline(deadline)
+	_, err := io.Copy(ioutil.Discard, conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		// The collector kept the session open, which is fine
+		return nil
+	}
+	return err
+}
+
+// sessionError describes why the session failed after the message was sent.
+func (d *Definition) sessionError(transport string, err error) string {
+	switch {
+	case transport == "udp" && errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Sprintf("%s refused the message : nothing is listening on the port", d.Host)
+	case errors.Is(err, syscall.ECONNRESET):
+		return fmt.Sprintf("%s reset the connection after the message was sent", d.Host)
+	default:
+		return fmt.Sprintf("Session with %s failed after the message was sent : %s", d.Host, err)
+	}
+}
+
+// query polls the query URL until its response contains the token, and
+// reports whether it ever did.
+func (d *Definition) query(ctx context.Context, tlsConfig *tls.Config, token string) (bool, error) {
+	url, err := render(d.QueryURL, token)
+	if err != nil {
+		return false, err
+	}
+	var dialer check.Dialer
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext, TLSClientConfig: tlsConfig}}
+	found := false
+	err = util.Poll(ctx, time.Second, func() (bool, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return false, err
+		}
+		if d.QueryUsername != "" {
+			req.SetBasicAuth(d.QueryUsername, d.QueryPassword)
+		}
+		resp, err := client.Do(req)
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return false, fmt.Errorf("server responded with %s", resp.Status)
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return false, err
+		}
+		found = bytes.Contains(body, []byte(token))
+		return found, nil
+	})
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false, nil
+	}
+	return found, err
+}
+
+// render fills the token into a template.
+func render(source string, token string) (string, error) {
+	templ, err := template.New("syslog").Parse(source)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = templ.Execute(&buf, map[string]string{"Token": token})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
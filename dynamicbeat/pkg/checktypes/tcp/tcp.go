@@ -0,0 +1,198 @@
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// The Definition configures the behavior of the TCP check
+// it implements the "check" interface
+type Definition struct {
+	Config      check.Config // generic metadata about the check
+	Host        string       `optiontype:"required"`                      // IP or hostname of the server
+	Port        string       `optiontype:"required"`                      // Port of the service
+	Send        string       `optiontype:"optional"`                      // Data to send once connected; \r, \n, \t, \\, and \xNN escapes are supported
+	Expect      string       `optiontype:"optional"`                      // Regex that the response must match; only the connection is checked if it isn't set
+	TLS         string       `optiontype:"optional"`                      // Whether to connect with TLS
+	Verify      string       `optiontype:"optional"`                      // Whether the server's certificate should be validated
+	CA          string       `optiontype:"optional"`                      // PEM CA certificates to trust instead of the system pool
+	ReadTimeout string       `optiontype:"optional" optiondefault:"5s"`   // How long to wait for a response that matches Expect
+	MaxBytes    int          `optiontype:"optional" optiondefault:"4096"` // The most bytes of the response that are read
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	send, err := unescape(d.Send)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error parsing send string %s : %s", d.Send, err)
+		return result
+	}
+	var regex *regexp.Regexp
+	if d.Expect != "" {
+		regex, err = regexp.Compile(d.Expect)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.Expect, err)
+			return result
+		}
+	}
+	readTimeout, err := time.ParseDuration(d.ReadTimeout)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error parsing read timeout %s : %s", d.ReadTimeout, err)
+		return result
+	}
+	if d.MaxBytes <= 0 {
+		result.Message = fmt.Sprintf("MaxBytes must be greater than 0, not %d", d.MaxBytes)
+		return result
+	}
+
+	// Connect to the service
+	var dialer check.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, d.Port))
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		result.Message = fmt.Sprintf("Connection to %s on port %s was refused", d.Host, d.Port)
+		return result
+	}
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if useTLS, _ := strconv.ParseBool(d.TLS); useTLS {
+		verify, _ := strconv.ParseBool(d.Verify)
+		config, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to create TLS config : %s", err)
+			return result
+		}
+		config.ServerName = d.Host
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.Handshake()
+		if err != nil {
+			result.Message = fmt.Sprintf("TLS handshake with %s failed : %s", d.Host, err)
+			return result
+		}
+		conn = tlsConn
+	}
+
+	if len(send) > 0 {
+		_, err = conn.Write(send)
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to send data to %s : %s", d.Host, err)
+			return result
+		}
+	}
+
+	if regex == nil {
+		// If we make it here the check passes
+		result.Passed = true
+		return result
+	}
+
+	// Read until the response matches, the server stops sending, or the
+	// read timeout passes. The read deadline can't be later than the
+	// check's deadline.
+	readDeadline := time.Now().Add(readTimeout)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(readDeadline) {
+		readDeadline = deadline
+	}
+	_ = conn.SetReadDeadline(readDeadline)
+	response := make([]byte, 0, d.MaxBytes)
+	buf := make([]byte, 1024)
+	for len(response) < d.MaxBytes {
+		n := len(buf)
+		if n > d.MaxBytes-len(response) {
+			n = d.MaxBytes - len(response)
+		}
+		n, err = conn.Read(buf[:n])
+		response = append(response, buf[:n]...)
+		if regex.Match(response) || err != nil {
+			break
+		}
+	}
+
+	// The response might contain flags, so only admins get to see it
+	result.AdminDetails = map[string]string{"response": string(response)}
+	if regex.Match(response) {
+		// If we make it here the check passes
+		result.Passed = true
+		return result
+	}
+
+	var netErr net.Error
+	if err != nil && !errors.Is(err, io.EOF) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		result.Message = fmt.Sprintf("Failed to read response from %s : %s", d.Host, err)
+		return result
+	}
+	result.Message = fmt.Sprintf("Response from %s did not match %s", d.Host, d.Expect)
+	return result
+}
+
+// unescape replaces the escape sequences in a string that is sent to the
+// server.
+func unescape(s string) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return nil, fmt.Errorf("string ends with a backslash")
+		}
+		switch s[i] {
+		case 'r':
+			out = append(out, '\r')
+		case 'n':
+			out = append(out, '\n')
+		case 't':
+			out = append(out, '\t')
+		case '0':
+			out = append(out, 0)
+		case '\\':
+			out = append(out, '\\')
+		case 'x':
+			if i+2 >= len(s) {
+				return nil, fmt.Errorf("incomplete hex escape")
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hex escape \\x%s", s[i+1:i+3])
+			}
+			out = append(out, byte(b))
+			i += 2
+		default:
+			return nil, fmt.Errorf("unknown escape \\%s", s[i:i+1])
+		}
+	}
+	return out, nil
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
@@ -0,0 +1,117 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/internal/checktest"
+)
+
+// newFakeServer starts a server that greets each connection, and then echoes
+// each line that it reads.
+func newFakeServer(t *testing.T, greeting string) *Definition {
+	t.Helper()
+	l := checktest.Serve(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = conn.Write([]byte(greeting))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(line))
+		}
+	})
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return &Definition{Host: host, Port: port, ReadTimeout: "1s", MaxBytes: 4096}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		def     func(d *Definition)
+		passed  bool
+		message string // the start of the message
+	}{
+		{
+			name:   "connection",
+			passed: true,
+		},
+		{
+			name:   "greeting",
+			def:    func(d *Definition) { d.Expect = `^220 .* ESMTP` },
+			passed: true,
+		},
+		{
+			name:   "reply",
+			def:    func(d *Definition) { d.Send, d.Expect = `PING\r\n`, "PING" },
+			passed: true,
+		},
+		{
+			name:    "reply doesn't match",
+			def:     func(d *Definition) { d.Send, d.Expect = `PING\n`, "PONG" },
+			message: "Response from 127.0.0.1 did not match PONG",
+		},
+		{
+			// The match is past the first MaxBytes bytes of the response
+			name:    "match after MaxBytes",
+			def:     func(d *Definition) { d.Send, d.Expect, d.MaxBytes = `PING\n`, "PING", 16 },
+			message: "Response from 127.0.0.1 did not match PING",
+		},
+		{
+			name:    "zero MaxBytes",
+			def:     func(d *Definition) { d.Expect, d.MaxBytes = "220", 0 },
+			message: "MaxBytes must be greater than 0, not 0",
+		},
+		{
+			name:    "negative MaxBytes",
+			def:     func(d *Definition) { d.Expect, d.MaxBytes = "220", -1 },
+			message: "MaxBytes must be greater than 0, not -1",
+		},
+		{
+			name:    "invalid escape",
+			def:     func(d *Definition) { d.Send = `\xZZ` },
+			message: `Error parsing send string \xZZ : `,
+		},
+		{
+			name:    "invalid regex",
+			def:     func(d *Definition) { d.Expect = "(" },
+			message: "Error compiling regex string ( : ",
+		},
+		{
+			name:    "invalid read timeout",
+			def:     func(d *Definition) { d.ReadTimeout = "soon" },
+			message: "Error parsing read timeout soon : ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeServer(t, "220 mail.team01.local ESMTP Postfix\r\n")
+			if tt.def != nil {
+				tt.def(d)
+			}
+
+			result := d.Run(context.Background())
+			if result.Passed != tt.passed {
+				t.Errorf("got passed %v, want %v (message: %s)", result.Passed, tt.passed, result.Message)
+			}
+			if !strings.HasPrefix(result.Message, tt.message) || (tt.message == "" && result.Message != "") {
+				t.Errorf("got message %q, want it to start with %q", result.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestRunConnectionRefused(t *testing.T) {
+	host, port := checktest.ClosedPort(t)
+
+	d := &Definition{Host: host, Port: port, ReadTimeout: "1s", MaxBytes: 4096}
+	result := d.Run(context.Background())
+	if want := "Connection to 127.0.0.1 on port " + port + " was refused"; result.Passed || result.Message != want {
+		t.Errorf("got passed %v with message %q, want %q", result.Passed, result.Message, want)
+	}
+}
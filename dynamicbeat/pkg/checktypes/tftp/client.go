@@ -0,0 +1,283 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TFTP packet opcodes.
+const (
+	opRRQ   = 1
+	opWRQ   = 2
+	opDATA  = 3
+	opACK   = 4
+	opERROR = 5
+	opOACK  = 6
+)
+
+// defaultBlockSize is the block size of transfers that don't negotiate one.
+const defaultBlockSize = 512
+
+// An errorPacket is an ERROR packet that the server sent.
+type errorPacket struct {
+	code    uint16
+	message string
+}
+
+func (e *errorPacket) Error() string {
+	return fmt.Sprintf("error %d: %s", e.code, e.message)
+}
+
+// A timeoutError is returned when the server stops responding. started says
+// whether the server had responded to the request before it stopped.
+type timeoutError struct {
+	started bool
+}
+
+func (e *timeoutError) Error() string {
+	return "no response from the server"
+}
+
+// A transfer is a single read or write request, and the packets that follow
+// it.
+type transfer struct {
+	ctx       context.Context
+	conn      *net.UDPConn
+	server    *net.UDPAddr
+	peer      *net.UDPAddr
+	timeout   time.Duration
+	retries   int
+	blockSize int
+	buf       []byte
+}
+
+// newTransfer opens a UDP socket for a transfer with the server.
+func newTransfer(ctx context.Context, host string, port string, timeout time.Duration, retries int) (*transfer, error) {
+	var resolver net.Resolver
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+	server := &net.UDPAddr{IP: addrs[0].IP, Port: portNum, Zone: addrs[0].Zone}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &transfer{
+		ctx:       ctx,
+		conn:      conn,
+		server:    server,
+		timeout:   timeout,
+		retries:   retries,
+		blockSize: defaultBlockSize,
+		buf:       make([]byte, 65536),
+	}, nil
+}
+
+// Close closes the socket.
+func (t *transfer) Close() error {
+	return t.conn.Close()
+}
+
+// request builds an RRQ or WRQ packet, which asks for a block size if it
+// isn't the default.
+func request(opcode uint16, filename string, blockSize int) []byte {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, opcode)
+	b.WriteString(filename + "\x00octet\x00")
+	if blockSize != defaultBlockSize {
+		b.WriteString("blksize\x00" + strconv.Itoa(blockSize) + "\x00")
+	}
+	return b.Bytes()
+}
+
+// packet builds a DATA or ACK packet.
+func packet(opcode uint16, block uint16, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(b, opcode)
+	binary.BigEndian.PutUint16(b[2:], block)
+	return append(b, data...)
+}
+
+// exchange sends a packet, and waits for the server to send a packet that
+// accept returns true for. The packet is sent again each time the timeout
+// passes, until it has been retried too many times. Before the server has
+// responded, packets are sent to the server's port, and the first response
+// sets the port of the rest of the transfer.
+func (t *transfer) exchange(out []byte, accept func(opcode uint16, body []byte) bool) (uint16, []byte, error) {
+	for attempt := 0; attempt <= t.retries; attempt++ {
+		to := t.peer
+		if to == nil {
+			to = t.server
+		}
+		_, err := t.conn.WriteToUDP(out, to)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		deadline := time.Now().Add(t.timeout)
+		if ctxDeadline, ok := t.ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		_ = t.conn.SetReadDeadline(deadline)
+		for {
+			n, from, err := t.conn.ReadFromUDP(t.buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+
+			// Ignore packets from anywhere other than the server
+			if !from.IP.Equal(t.server.IP) || (t.peer != nil && from.Port != t.peer.Port) || n < 4 {
+				continue
+			}
+			opcode := binary.BigEndian.Uint16(t.buf)
+			body := t.buf[2:n]
+			if opcode == opERROR {
+				return 0, nil, &errorPacket{code: binary.BigEndian.Uint16(body), message: string(bytes.TrimRight(body[2:], "\x00"))}
+			}
+			if !accept(opcode, body) {
+				continue
+			}
+			if t.peer == nil {
+				t.peer = from
+			}
+			return opcode, body, nil
+		}
+		if t.ctx.Err() != nil {
+			break
+		}
+	}
+	return 0, nil, &timeoutError{started: t.peer != nil}
+}
+
+// negotiate reads the block size out of an OACK packet.
+func (t *transfer) negotiate(body []byte) error {
+	fields := bytes.Split(bytes.TrimRight(body, "\x00"), []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		if string(bytes.ToLower(fields[i])) != "blksize" {
+			continue
+		}
+		size, err := strconv.Atoi(string(fields[i+1]))
+		if err != nil || size < 8 || size > t.blockSize {
+			return fmt.Errorf("server sent an invalid block size %s", fields[i+1])
+		}
+		t.blockSize = size
+		return nil
+	}
+	t.blockSize = defaultBlockSize
+	return nil
+}
+
+// read downloads a file, and fails if it is larger than max bytes.
+func (t *transfer) read(filename string, blockSize int, max int64) ([]byte, error) {
+	t.blockSize = blockSize
+	out := request(opRRQ, filename, blockSize)
+	var content []byte
+	expected := uint16(1)
+	negotiated := false
+	for {
+		opcode, body, err := t.exchange(out, func(opcode uint16, body []byte) bool {
+			if opcode == opOACK {
+				return expected == 1 && !negotiated
+			}
+			return opcode == opDATA && len(body) >= 2 && binary.BigEndian.Uint16(body) == expected
+		})
+		if err != nil {
+			return content, err
+		}
+		if opcode == opOACK {
+			err = t.negotiate(body)
+			if err != nil {
+				return nil, err
+			}
+			negotiated = true
+			out = packet(opACK, 0, nil)
+			continue
+		}
+		if expected == 1 && !negotiated {
+			// The server ignored the block size option
+			t.blockSize = defaultBlockSize
+		}
+
+		data := body[2:]
+		content = append(content, data...)
+		if int64(len(content)) > max {
+			_, _ = t.conn.WriteToUDP(errorBytes(3, "file is too large"), t.peer)
+			return content, fmt.Errorf("file is larger than %d bytes", max)
+		}
+		out = packet(opACK, expected, nil)
+		if len(data) < t.blockSize {
+			// The last block is acknowledged once, and the server resends
+			// it if the ACK is lost
+			_, err = t.conn.WriteToUDP(out, t.peer)
+			return content, err
+		}
+		expected++
+	}
+}
+
+// write uploads a file.
+func (t *transfer) write(filename string, blockSize int, content []byte) error {
+	t.blockSize = blockSize
+	out := request(opWRQ, filename, blockSize)
+	block := uint16(0)
+	offset := 0
+	last := false
+	for {
+		opcode, body, err := t.exchange(out, func(opcode uint16, body []byte) bool {
+			if opcode == opOACK {
+				return block == 0
+			}
+			return opcode == opACK && len(body) >= 2 && binary.BigEndian.Uint16(body) == block
+		})
+		if err != nil {
+			return err
+		}
+		if opcode == opOACK {
+			err = t.negotiate(body)
+			if err != nil {
+				return err
+			}
+		} else if block == 0 {
+			// The server ignored the block size option
+			t.blockSize = defaultBlockSize
+		}
+		if last {
+			return nil
+		}
+
+		// Send the next block. A short block ends the transfer, so an empty
+		// one is sent if the content fills the last block.
+		end := offset + t.blockSize
+		if end > len(content) {
+			end = len(content)
+		}
+		data := content[offset:end]
+		last = len(data) < t.blockSize
+		offset = end
+		block++
+		out = packet(opDATA, block, data)
+	}
+}
+
+// errorBytes builds an ERROR packet.
+func errorBytes(code uint16, message string) []byte {
+	b := make([]byte, 4, 5+len(message))
+	binary.BigEndian.PutUint16(b, opERROR)
+	binary.BigEndian.PutUint16(b[2:], code)
+	return append(append(b, message...), 0)
+}
@@ -0,0 +1,144 @@
+package tftp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// The Definition configures the behavior of the TFTP check
+// it implements the "check" interface
+type Definition struct {
+	Config       check.Config // generic metadata about the check
+	Host         string       `optiontype:"required"`                         // IP or hostname of the TFTP server
+	Port         string       `optiontype:"optional" optiondefault:"69"`      // Port of the TFTP server
+	Filename     string       `optiontype:"required"`                         // The file to download, or to upload in write mode
+	Mode         string       `optiontype:"optional" optiondefault:"read"`    // read to download Filename, or write to upload a scratch file to it
+	BlockSize    int          `optiontype:"optional" optiondefault:"512"`     // The block size to ask the server for
+	Timeout      string       `optiontype:"optional" optiondefault:"1s"`      // How long to wait for each packet before sending the last one again
+	Retries      int          `optiontype:"optional" optiondefault:"5"`       // How many times to send a packet again before giving up
+	MaxBytes     int64        `optiontype:"optional" optiondefault:"1048576"` // The largest file that is downloaded
+	ContentHash  string       `optiontype:"optional"`                         // The SHA256 hash that the downloaded file must have
+	ContentRegex string       `optiontype:"optional"`                         // Regex that the downloaded file must match
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	if d.Mode != "read" && d.Mode != "write" {
+		result.Message = fmt.Sprintf("Unknown mode %s - must be read or write", d.Mode)
+		return result
+	}
+	if d.BlockSize < 8 || d.BlockSize > 65464 {
+		result.Message = fmt.Sprintf("Invalid block size %d - must be between 8 and 65464", d.BlockSize)
+		return result
+	}
+	timeout, err := time.ParseDuration(d.Timeout)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error parsing timeout %s : %s", d.Timeout, err)
+		return result
+	}
+	var regex *regexp.Regexp
+	if d.ContentRegex != "" {
+		regex, err = regexp.Compile(d.ContentRegex)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ContentRegex, err)
+			return result
+		}
+	}
+
+	t, err := newTransfer(ctx, d.Host, d.Port, timeout, d.Retries)
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer t.Close()
+
+	if d.Mode == "write" {
+		suffix := make([]byte, 8)
+		_, err = rand.Read(suffix)
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to generate scratch file contents : %s", err)
+			return result
+		}
+		err = t.write(d.Filename, d.BlockSize, []byte("scorestack "+hex.EncodeToString(suffix)+"\n"))
+		result.Details = map[string]string{"block_size": strconv.Itoa(t.blockSize)}
+		if err != nil {
+			result.Message = d.transferError("Upload", err)
+			return result
+		}
+
+		// If we reach here the check is successful
+		result.Passed = true
+		return result
+	}
+
+	content, err := t.read(d.Filename, d.BlockSize, d.MaxBytes)
+	if err != nil {
+		result.Message = d.transferError("Download", err)
+		return result
+	}
+	hash := sha256.Sum256(content)
+	result.Details = map[string]string{
+		"sha256":     hex.EncodeToString(hash[:]),
+		"size":       strconv.Itoa(len(content)),
+		"block_size": strconv.Itoa(t.blockSize),
+	}
+
+	if d.ContentHash != "" && !strings.EqualFold(result.Details["sha256"], d.ContentHash) {
+		result.Message = fmt.Sprintf("Content mismatch : %s has SHA256 hash %s instead of %s", d.Filename, result.Details["sha256"], d.ContentHash)
+		return result
+	}
+	if regex != nil && !regex.Match(content) {
+		result.Message = fmt.Sprintf("Content mismatch : %s does not match %s", d.Filename, d.ContentRegex)
+		return result
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// transferError describes why a download or upload failed. Servers that
+// never respond are told apart from transfers that stopped partway, and
+// from errors that the server sent.
+func (d *Definition) transferError(operation string, err error) string {
+	var timeoutErr *timeoutError
+	var errPacket *errorPacket
+	switch {
+	case errors.As(err, &timeoutErr) && !timeoutErr.started:
+		return fmt.Sprintf("No response from %s", d.Host)
+	case errors.As(err, &timeoutErr):
+		return fmt.Sprintf("%s of %s stopped partway : %s stopped responding", operation, d.Filename, d.Host)
+	case errors.As(err, &errPacket) && errPacket.code == 1:
+		return fmt.Sprintf("File %s not found on %s : %s", d.Filename, d.Host, errPacket.message)
+	case errors.As(err, &errPacket) && errPacket.code == 2:
+		return fmt.Sprintf("Access to %s on %s was denied : %s", d.Filename, d.Host, errPacket.message)
+	case errors.As(err, &errPacket):
+		return fmt.Sprintf("%s of %s failed : server sent %s", operation, d.Filename, err)
+	default:
+		return fmt.Sprintf("%s of %s failed : %s", operation, d.Filename, err)
+	}
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
@@ -0,0 +1,205 @@
+package tls
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// startTLS asks the server to upgrade a plaintext connection to TLS using
+// the STARTTLS command of a protocol. Once it returns, the TLS handshake can
+// be started on the connection.
+func startTLS(conn net.Conn, protocol string) error {
+	switch protocol {
+	case "smtp":
+		return startSMTP(textproto.NewConn(conn))
+	case "imap":
+		return startIMAP(textproto.NewConn(conn))
+	case "pop3":
+		return startPOP3(textproto.NewConn(conn))
+	case "ldap":
+		return startLDAP(conn)
+	default:
+		return fmt.Errorf("unknown STARTTLS protocol %s", protocol)
+	}
+}
+
+// startSMTP sends STARTTLS once the server has greeted the client and
+// answered its EHLO.
+func startSMTP(text *textproto.Conn) error {
+	_, _, err := text.ReadResponse(220)
+	if err != nil {
+		return fmt.Errorf("unexpected greeting : %s", err)
+	}
+	_, err = text.Cmd("EHLO scorestack")
+	if err != nil {
+		return err
+	}
+	_, ehlo, err := text.ReadResponse(250)
+	if err != nil {
+		return fmt.Errorf("EHLO failed : %s", err)
+	}
+	if !strings.Contains(strings.ToUpper(ehlo), "STARTTLS") {
+		return fmt.Errorf("server does not support STARTTLS")
+	}
+	_, err = text.Cmd("STARTTLS")
+	if err != nil {
+		return err
+	}
+	_, _, err = text.ReadResponse(220)
+	if err != nil {
+		return fmt.Errorf("STARTTLS failed : %s", err)
+	}
+	return nil
+}
+
+// startIMAP sends STARTTLS once the server has greeted the client.
+func startIMAP(text *textproto.Conn) error {
+	greeting, err := text.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return fmt.Errorf("unexpected greeting : %s", greeting)
+	}
+	_, err = text.Cmd("a1 STARTTLS")
+	if err != nil {
+		return err
+	}
+
+	// Skip any untagged responses before the response to the command
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "a1 ") {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToUpper(line), "A1 OK") {
+			return fmt.Errorf("STARTTLS failed : %s", line)
+		}
+		return nil
+	}
+}
+
+// startPOP3 sends STLS once the server has greeted the client.
+func startPOP3(text *textproto.Conn) error {
+	greeting, err := text.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "+OK") {
+		return fmt.Errorf("unexpected greeting : %s", greeting)
+	}
+	_, err = text.Cmd("STLS")
+	if err != nil {
+		return err
+	}
+	line, err := text.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("STLS failed : %s", line)
+	}
+	return nil
+}
+
+// ldapStartTLS is an LDAP extended request for StartTLS, with a message ID
+// of 1 and the StartTLS OID 1.3.6.1.4.1.1466.20037 as its request name.
+var ldapStartTLS = append([]byte{0x30, 0x1d, 0x02, 0x01, 0x01, 0x77, 0x18, 0x80, 0x16}, "1.3.6.1.4.1.1466.20037"...)
+
+// startLDAP sends a StartTLS extended request, and makes sure that its
+// result code is success.
+func startLDAP(conn net.Conn) error {
+	_, err := conn.Write(ldapStartTLS)
+	if err != nil {
+		return err
+	}
+
+	// The response is an LDAPMessage, which holds the message ID and then
+	// the extended response. Its first element is the result code.
+	tag, message, err := readBER(bufio.NewReader(conn))
+	if err != nil {
+		return fmt.Errorf("failed to read StartTLS response : %s", err)
+	}
+	if tag != 0x30 {
+		return fmt.Errorf("unexpected StartTLS response")
+	}
+	_, _, message, err = parseBER(message)
+	if err != nil {
+		return err
+	}
+	tag, response, _, err := parseBER(message)
+	if err != nil {
+		return err
+	}
+	if tag != 0x78 {
+		return fmt.Errorf("unexpected StartTLS response")
+	}
+	tag, code, _, err := parseBER(response)
+	if err != nil {
+		return err
+	}
+	if tag != 0x0a || len(code) != 1 {
+		return fmt.Errorf("unexpected StartTLS response")
+	}
+	if code[0] != 0 {
+		return fmt.Errorf("StartTLS failed with result code %d", code[0])
+	}
+	return nil
+}
+
+// maxBER is the largest BER element that is read.
+const maxBER = 64 << 10
+
+// readBER reads a single BER element, and returns its tag and contents.
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 3 {
+			return 0, nil, fmt.Errorf("unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxBER {
+		return 0, nil, fmt.Errorf("BER element is too large")
+	}
+	contents := make([]byte, length)
+	_, err = io.ReadFull(r, contents)
+	return tag, contents, err
+}
+
+// parseBER splits the first BER element off of some bytes, and returns its
+// tag, its contents, and the bytes after it.
+func parseBER(b []byte) (byte, []byte, []byte, error) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	tag, contents, err := readBER(r)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid StartTLS response : %s", err)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	return tag, contents, rest, nil
+}
@@ -0,0 +1,194 @@
+package tls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// The Definition configures the behavior of the TLS certificate check
+// it implements the "check" interface
+type Definition struct {
+	Config             check.Config // generic metadata about the check
+	Host               string       `optiontype:"required"`                     // IP or hostname of the server
+	Port               string       `optiontype:"optional" optiondefault:"443"` // Port of the service
+	ServerName         string       `optiontype:"optional"`                     // Name to send for SNI and to match the certificate against; defaults to Host
+	CA                 string       `optiontype:"optional"`                     // PEM CA certificates to trust instead of the system pool
+	StartTLS           string       `optiontype:"optional"`                     // smtp, imap, pop3, or ldap, to upgrade a plaintext connection with STARTTLS
+	MinDaysValid       int          `optiontype:"optional"`                     // The fewest days that the certificate must still be valid for
+	MinKeySize         int          `optiontype:"optional"`                     // The smallest key size in bits that the certificate can have
+	SignatureAlgorithm string       `optiontype:"optional"`                     // The signature algorithm that the certificate must use, like SHA256-RSA
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	serverName := d.ServerName
+	if serverName == "" {
+		serverName = d.Host
+	}
+	starttls := strings.ToLower(d.StartTLS)
+	switch starttls {
+	case "", "smtp", "imap", "pop3", "ldap":
+	default:
+		result.Message = fmt.Sprintf("Unknown STARTTLS protocol %s - must be smtp, imap, pop3, or ldap", d.StartTLS)
+		return result
+	}
+	roots, err := x509.SystemCertPool()
+	if d.CA != "" {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM([]byte(d.CA)) {
+			result.Message = "Failed to create TLS config : no valid PEM certificates found in CA certificate"
+			return result
+		}
+	} else if err != nil {
+		result.Message = fmt.Sprintf("Failed to load the system certificate pool : %s", err)
+		return result
+	}
+
+	var dialer check.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, d.Port))
+	if err != nil {
+		result.Message = fmt.Sprintf("Could not connect to %s : %s", d.Host, err)
+		return result
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if starttls != "" {
+		err = startTLS(conn, starttls)
+		if err != nil {
+			result.Message = fmt.Sprintf("STARTTLS with %s failed : %s", d.Host, err)
+			return result
+		}
+	}
+
+	// The chain is verified after the handshake, so that the certificate can
+	// be described even when it isn't valid
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	err = tlsConn.Handshake()
+	if err != nil {
+		result.Message = fmt.Sprintf("TLS handshake with %s failed : %s", d.Host, err)
+		return result
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		result.Message = fmt.Sprintf("Server at %s did not present a certificate", d.Host)
+		return result
+	}
+	leaf := certs[0]
+
+	sans := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	daysLeft := int(math.Floor(time.Until(leaf.NotAfter).Hours() / 24))
+	size := keySize(leaf)
+	result.Details = map[string]string{
+		"not_after":           leaf.NotAfter.UTC().Format(time.RFC3339),
+		"days_left":           strconv.Itoa(daysLeft),
+		"subject":             leaf.Subject.String(),
+		"issuer":              leaf.Issuer.String(),
+		"sans":                strings.Join(sans, ","),
+		"signature_algorithm": leaf.SignatureAlgorithm.String(),
+		"key_size":            strconv.Itoa(size),
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		result.Message = verifyError(serverName, leaf, err)
+		return result
+	}
+
+	if daysLeft < d.MinDaysValid {
+		result.Message = fmt.Sprintf("Certificate expires in %d days, but must be valid for at least %d", daysLeft, d.MinDaysValid)
+		return result
+	}
+	if size < d.MinKeySize {
+		result.Message = fmt.Sprintf("Certificate has a %d-bit key, but must have at least %d bits", size, d.MinKeySize)
+		return result
+	}
+	if d.SignatureAlgorithm != "" && !strings.EqualFold(leaf.SignatureAlgorithm.String(), d.SignatureAlgorithm) {
+		result.Message = fmt.Sprintf("Certificate is signed with %s instead of %s", leaf.SignatureAlgorithm, d.SignatureAlgorithm)
+		return result
+	}
+
+	// If we reach here the check is successful
+	result.Passed = true
+	return result
+}
+
+// verifyError describes why a certificate isn't valid.
+func verifyError(serverName string, leaf *x509.Certificate, err error) string {
+	var hostErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &hostErr):
+		return fmt.Sprintf("Certificate is not valid for %s : %s", serverName, err)
+	case errors.As(err, &authorityErr):
+		return fmt.Sprintf("Certificate is not signed by a trusted CA : %s", err)
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		if time.Now().Before(leaf.NotBefore) {
+			return fmt.Sprintf("Certificate is not valid until %s", leaf.NotBefore.UTC().Format(time.RFC3339))
+		}
+		if time.Now().After(leaf.NotAfter) {
+			return fmt.Sprintf("Certificate expired on %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+		}
+		return fmt.Sprintf("A certificate in the chain is expired : %s", err)
+	default:
+		return fmt.Sprintf("Certificate is not valid : %s", err)
+	}
+}
+
+// keySize returns the size in bits of the certificate's public key.
+func keySize(cert *x509.Certificate) int {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
+	default:
+		return 0
+	}
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
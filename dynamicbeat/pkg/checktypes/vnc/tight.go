@@ -0,0 +1,80 @@
+package vnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	vnc "github.com/mitchellh/go-vnc"
+)
+
+// The codes of the authentication types that can be used within the Tight
+// security type.
+const (
+	tightNone    = 1
+	tightVNCAuth = 2
+)
+
+// tightAuth is the Tight security type, which TightVNC servers use to offer
+// tunnels and authentication types. No tunnel is used, and VNC
+// Authentication is picked if there is a password, or no authentication
+// otherwise.
+type tightAuth struct {
+	password string
+}
+
+func (*tightAuth) SecurityType() uint8 {
+	return 16
+}
+
+func (a *tightAuth) Handshake(c net.Conn) error {
+	// Tunnels are described by a code, a vendor, and a name
+	var tunnels uint32
+	if err := binary.Read(c, binary.BigEndian, &tunnels); err != nil {
+		return err
+	}
+	if tunnels > 0 {
+		if _, err := io.CopyN(ioutil.Discard, c, int64(tunnels)*16); err != nil {
+			return err
+		}
+		// Pick the NOTUNNEL tunnel
+		if err := binary.Write(c, binary.BigEndian, uint32(0)); err != nil {
+			return err
+		}
+	}
+
+	// Authentication types are described the same way
+	var count uint32
+	if err := binary.Read(c, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	offered := make(map[int32]bool)
+	for i := uint32(0); i < count; i++ {
+		var capability struct {
+			Code   int32
+			Vendor [4]byte
+			Name   [8]byte
+		}
+		if err := binary.Read(c, binary.BigEndian, &capability); err != nil {
+			return err
+		}
+		offered[capability.Code] = true
+	}
+
+	switch {
+	case a.password != "" && offered[tightVNCAuth]:
+		if err := binary.Write(c, binary.BigEndian, uint32(tightVNCAuth)); err != nil {
+			return err
+		}
+		return (&vnc.PasswordAuth{Password: a.password}).Handshake(c)
+	case a.password == "" && offered[tightNone]:
+		return binary.Write(c, binary.BigEndian, uint32(tightNone))
+	default:
+		return fmt.Errorf("no suitable auth schemes found within the Tight security type")
+	}
+}
@@ -2,8 +2,12 @@ package vnc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	vnc "github.com/mitchellh/go-vnc"
@@ -14,10 +18,12 @@ import (
 // The Definition configures the behavior of the VNC check
 // it implements the "check" interface
 type Definition struct {
-	Config   check.Config // generic metadata about the check
-	Host     string       `optiontype:"required"` // The IP or hostname of the vnc server
-	Port     string       `optiontype:"required"` // The port for the vnc server
-	Password string       `optiontype:"required"` // The password for the vnc server
+	Config        check.Config // generic metadata about the check
+	Host          string       `optiontype:"required"`                    // The IP or hostname of the vnc server
+	Port          string       `optiontype:"required"`                    // The port for the vnc server
+	Password      string       `optiontype:"optional"`                    // The password for the vnc server; servers without authentication are accepted if it isn't set
+	Liveness      string       `optiontype:"optional"`                    // Whether the server must send a framebuffer update
+	UpdateTimeout string       `optiontype:"optional" optiondefault:"5s"` // How long to wait for the framebuffer update
 }
 
 // Run a single instance of the check
@@ -25,49 +31,169 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
-	// Configure the vnc client
+	liveness, _ := strconv.ParseBool(d.Liveness)
+	updateTimeout, err := time.ParseDuration(d.UpdateTimeout)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error parsing update timeout %s : %s", d.UpdateTimeout, err)
+		return result
+	}
+
+	// Configure the vnc client. The security type that the server picks is
+	// recorded when its handshake starts.
+	var securityType string
+	var auths []vnc.ClientAuth
+	if d.Password != "" {
+		auths = append(auths, &recordedAuth{&vnc.PasswordAuth{Password: d.Password}, "VNCAuth", &securityType})
+	}
+	auths = append(auths, &recordedAuth{&tightAuth{password: d.Password}, "Tight", &securityType})
+	if d.Password == "" {
+		auths = append(auths, &recordedAuth{new(vnc.ClientAuthNone), "None", &securityType})
+	}
+	updates := make(chan struct{}, 1)
 	config := vnc.ClientConfig{
-		Auth: []vnc.ClientAuth{
-			&vnc.PasswordAuth{Password: d.Password},
-		},
+		Auth:           auths,
+		ServerMessages: []vnc.ServerMessage{&updateMessage{updates}},
 	}
 
 	// Make a dialer
-	dialer := net.Dialer{}
+	dialer := check.Dialer{}
 
 	// Dial the vnc server
 	// conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%s", d.Host, d.Port), 5*time.Second)
 	// TODO: create child context with deadline less than the parent context
-	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%s", d.Host, d.Port))
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, d.Port))
 	if err != nil {
 		result.Message = fmt.Sprintf("Connection to VNC host %s failed : %s", d.Host, err)
 		return result
 	}
 	defer func() {
 		err = conn.Close()
-		if err != nil {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
 			zap.S().Warnf("Failed to close VNC connection: %s", err)
 		}
 	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	recorder := &versionConn{Conn: conn}
 
-	vncClient, err := vnc.Client(conn, &config)
-	if err != nil {
+	// The library doesn't wrap its errors, so the reason for failures can only
+	// be told apart by their message
+	vncClient, err := vnc.Client(recorder, &config)
+	result.Details = make(map[string]string)
+	if recorder.version != "" {
+		result.Details["protocol_version"] = recorder.version
+	}
+	if securityType != "" {
+		result.Details["security_type"] = securityType
+	}
+	switch {
+	case err == nil:
+	case strings.HasPrefix(err.Error(), "no suitable auth schemes found"), strings.HasPrefix(err.Error(), "no security types"):
+		result.Message = fmt.Sprintf("Server %s does not support a usable security type : %s", d.Host, err)
+		return result
+	case strings.HasPrefix(err.Error(), "unsupported"):
+		result.Message = fmt.Sprintf("Server %s uses an unsupported protocol version : %s", d.Host, err)
+		return result
+	case strings.HasPrefix(err.Error(), "security handshake failed"):
 		result.Message = fmt.Sprintf("Login to server %s failed : %s", d.Host, err)
 		return result
+	default:
+		result.Message = fmt.Sprintf("Handshake with server %s failed : %s", d.Host, err)
+		return result
 	}
 	defer func() {
 		err = vncClient.Close()
-		if err != nil {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
 			zap.S().Warnf("Failed to close VNC connection: %s", err)
 		}
 	}()
 
+	// Request a small part of the screen, and wait for the server to send it
+	if liveness {
+		width, height := vncClient.FrameBufferWidth, vncClient.FrameBufferHeight
+		if width > 16 {
+			width = 16
+		}
+		if height > 16 {
+			height = 16
+		}
+		err = vncClient.FramebufferUpdateRequest(false, 0, 0, width, height)
+		if err != nil {
+			result.Message = fmt.Sprintf("Requesting a framebuffer update failed : %s", err)
+			return result
+		}
+		select {
+		case <-updates:
+		case <-time.After(updateTimeout):
+			result.Message = fmt.Sprintf("No framebuffer update received within %s", d.UpdateTimeout)
+			return result
+		case <-ctx.Done():
+			result.Message = "No framebuffer update received before the check timed out"
+			return result
+		}
+	}
+
 	// If we made it here the check passes
 	result.Passed = true
 	return result
 
 }
 
+// recordedAuth records the name of a security type when the server picks it.
+type recordedAuth struct {
+	vnc.ClientAuth
+	name     string
+	selected *string
+}
+
+func (a *recordedAuth) Handshake(c net.Conn) error {
+	*a.selected = a.name
+	return a.ClientAuth.Handshake(c)
+}
+
+// versionConn records the protocol version that the server sends at the
+// start of the connection.
+type versionConn struct {
+	net.Conn
+	buf     []byte
+	version string
+}
+
+func (c *versionConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if len(c.buf) < 12 {
+		c.buf = append(c.buf, b[:n]...)
+		if len(c.buf) >= 12 {
+			var major, minor int
+			if _, err := fmt.Sscanf(string(c.buf[:12]), "RFB %d.%d\n", &major, &minor); err == nil {
+				c.version = fmt.Sprintf("%d.%d", major, minor)
+			}
+		}
+	}
+	return n, err
+}
+
+// updateMessage reads framebuffer updates, and signals that one was received.
+type updateMessage struct {
+	received chan<- struct{}
+}
+
+func (m *updateMessage) Type() uint8 {
+	return new(vnc.FramebufferUpdateMessage).Type()
+}
+
+func (m *updateMessage) Read(c *vnc.ClientConn, r io.Reader) (vnc.ServerMessage, error) {
+	msg, err := new(vnc.FramebufferUpdateMessage).Read(c, r)
+	if err == nil {
+		select {
+		case m.received <- struct{}{}:
+		default:
+		}
+	}
+	return msg, err
+}
+
 // GetConfig returns the current CheckConfig struct this check has been
 // configured with.
 func (d *Definition) GetConfig() check.Config {
@@ -0,0 +1,168 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// The Definition configures the behavior of the WebSocket check
+// it implements the "check" interface
+type Definition struct {
+	Config       check.Config      // generic metadata about the check
+	URL          string            `optiontype:"required"`                       // ws:// or wss:// URL to connect to
+	Verify       string            `optiontype:"optional"`                       // Whether the server's certificate should be validated
+	CA           string            `optiontype:"optional"`                       // PEM CA certificates to trust instead of the system pool
+	Headers      map[string]string `optiontype:"optional"`                       // Headers to send with the upgrade request, like Cookie or Authorization
+	Subprotocols []string          `optiontype:"optional"`                       // Subprotocols to offer; the server must accept one of them
+	Message      string            `optiontype:"optional"`                       // Text message to send once connected
+	Expect       string            `optiontype:"optional"`                       // Regex that a received message must match; only the upgrade is checked if it isn't set
+	ReadTimeout  string            `optiontype:"optional" optiondefault:"5s"`    // How long to wait for a message that matches Expect
+	MaxSize      int64             `optiontype:"optional" optiondefault:"65536"` // The largest message that is read
+}
+
+// Run a single instance of the check
+func (d *Definition) Run(ctx context.Context) check.Result {
+	// Initialize empty result
+	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
+
+	target, err := url.Parse(d.URL)
+	if err != nil || (target.Scheme != "ws" && target.Scheme != "wss") {
+		result.Message = fmt.Sprintf("Invalid URL %s - must start with ws:// or wss://", d.URL)
+		return result
+	}
+	var regex *regexp.Regexp
+	if d.Expect != "" {
+		regex, err = regexp.Compile(d.Expect)
+		if err != nil {
+			result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.Expect, err)
+			return result
+		}
+	}
+	readTimeout, err := time.ParseDuration(d.ReadTimeout)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error parsing read timeout %s : %s", d.ReadTimeout, err)
+		return result
+	}
+
+	verify, _ := strconv.ParseBool(d.Verify)
+	config, err := util.NewTLSConfigFromPEM(verify, d.CA, "", "")
+	if err != nil {
+		result.Message = fmt.Sprintf("Failed to create TLS config : %s", err)
+		return result
+	}
+	var netDialer check.Dialer
+	dialer := websocket.Dialer{
+		NetDialContext:  netDialer.DialContext,
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+		Subprotocols:    d.Subprotocols,
+	}
+	header := http.Header{}
+	for name, value := range d.Headers {
+		header.Set(name, value)
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, d.URL, header)
+	if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+		result.Message = fmt.Sprintf("WebSocket handshake with %s failed : server responded with %s", target.Host, resp.Status)
+		return result
+	}
+	if err != nil {
+		result.Message = fmt.Sprintf("WebSocket handshake with %s failed : %s", target.Host, err)
+		return result
+	}
+	defer conn.Close()
+	conn.SetReadLimit(d.MaxSize)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+	}
+	if len(d.Subprotocols) > 0 && conn.Subprotocol() == "" {
+		result.Message = fmt.Sprintf("Server at %s did not accept any of the subprotocols %v", target.Host, d.Subprotocols)
+		return result
+	}
+
+	if d.Message != "" {
+		err = conn.WriteMessage(websocket.TextMessage, []byte(d.Message))
+		if err != nil {
+			result.Message = fmt.Sprintf("Failed to send message to %s : %s", target.Host, err)
+			return result
+		}
+	}
+
+	if regex == nil {
+		// If we reach here the check is successful
+		result.Passed = true
+		return result
+	}
+
+	// Read messages until one matches, the server closes the connection, or
+	// the read timeout passes. The read deadline can't be later than the
+	// check's deadline.
+	readDeadline := time.Now().Add(readTimeout)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(readDeadline) {
+		readDeadline = deadline
+	}
+	_ = conn.SetReadDeadline(readDeadline)
+	received := 0
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			result.Message = d.readError(target.Host, received, err)
+			return result
+		}
+		received++
+
+		// The message might contain flags, so only admins get to see it
+		result.AdminDetails = map[string]string{"message": string(message)}
+		if regex.Match(message) {
+			// If we reach here the check is successful
+			result.Passed = true
+			return result
+		}
+	}
+}
+
+// readError describes why no matching message was read. Closes and timeouts
+// before any message was received are told apart from messages that didn't
+// match.
+func (d *Definition) readError(host string, received int, err error) string {
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	closed := errors.As(err, &closeErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	timedOut := errors.As(err, &netErr) && netErr.Timeout()
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		return fmt.Sprintf("Message from %s is larger than %d bytes", host, d.MaxSize)
+	case closed && received == 0:
+		return fmt.Sprintf("Server at %s closed the connection before sending a message : %s", host, err)
+	case timedOut && received == 0:
+		return fmt.Sprintf("No message received from %s within %s", host, d.ReadTimeout)
+	case closed || timedOut:
+		return fmt.Sprintf("None of the %d messages from %s matched %s", received, host, d.Expect)
+	default:
+		return fmt.Sprintf("Failed to read message from %s : %s", host, err)
+	}
+}
+
+// GetConfig returns the current CheckConfig struct this check has been
+// configured with.
+func (d *Definition) GetConfig() check.Config {
+	return d.Config
+}
+
+// SetConfig reconfigures this check with a new CheckConfig struct.
+func (d *Definition) SetConfig(c check.Config) {
+	d.Config = c
+}
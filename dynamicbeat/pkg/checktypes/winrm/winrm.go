@@ -1,91 +1,189 @@
 package winrm
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"net"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf16"
 
 	"github.com/oneNutW0nder/winrm"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 )
 
 // The Definition configures the behavior of the WinRM check
 // it implements the "check" interface
 type Definition struct {
-	Config       check.Config // generic metadata about the check
-	Host         string       `optiontype:"required"`                      // IP or hostname of the WinRM box
-	Username     string       `optiontype:"required"`                      // User to login as
-	Password     string       `optiontype:"required"`                      // Password for the user
-	Cmd          string       `optiontype:"required"`                      // Command that will be executed
-	Encrypted    string       `optiontype:"optional" optiondefault:"true"` // Use TLS for connection
-	MatchContent string       `optiontype:"optional"`                      // Turn this on to match content from the output of the cmd
-	ContentRegex string       `optiontype:"optional" optiondefault:".*"`   // Regexp for matching output of a command
-	Port         string       `optiontype:"optional" optiondefault:"5986"` // Port for WinRM
+	Config           check.Config // generic metadata about the check
+	Host             string       `optiontype:"required"`                       // IP or hostname of the WinRM box
+	Username         string       `optiontype:"required"`                       // User to login as
+	Password         string       `optiontype:"required"`                       // Password for the user
+	Cmd              string       `optiontype:"required"`                       // Command that will be executed
+	Encrypted        string       `optiontype:"optional" optiondefault:"true"`  // Use HTTPS for connection
+	Verify           string       `optiontype:"optional"`                       // Whether the server's certificate should be validated
+	CA               string       `optiontype:"optional"`                       // PEM CA certificates to trust instead of the system pool
+	Auth             string       `optiontype:"optional" optiondefault:"basic"` // basic or ntlm
+	Powershell       string       `optiontype:"optional" optiondefault:"true"`  // Whether Cmd is a PowerShell script instead of a cmd.exe command
+	MatchContent     string       `optiontype:"optional"`                       // Turn this on to match content from the output of the cmd
+	ContentRegex     string       `optiontype:"optional" optiondefault:".*"`    // Regexp for matching output of a command
+	ExpectedOutput   string       `optiontype:"optional"`                       // Regex that the output of the command must match
+	ExpectedExitCode int          `optiontype:"optional"`                       // The exit code that the command must return
+	Port             string       `optiontype:"optional"`                       // Port for WinRM; defaults to 5986 for HTTPS, or 5985 for HTTP
 }
 
+// maxOutput is the most output that is kept from each of stdout and stderr.
+const maxOutput = 64 << 10
+
 // Run a single instance of the check
 func (d *Definition) Run(ctx context.Context) check.Result {
 	// Initialize empty result
 	result := check.Result{Timestamp: time.Now(), Metadata: d.Config.Metadata}
 
+	// Convert encrypted to bool
+	encrypted, _ := strconv.ParseBool(d.Encrypted)
+
 	// Convert d.Port to int
+	if d.Port == "" {
+		d.Port = "5985"
+		if encrypted {
+			d.Port = "5986"
+		}
+	}
 	port, err := strconv.Atoi(d.Port)
 	if err != nil {
 		result.Message = fmt.Sprintf("Failed to convert d.Port to int : %s", err)
 		return result
 	}
 
-	// Another timeout for the bois
+	// Every connection is opened within the check's timeout
 	params := *winrm.DefaultParameters
+	dial := func(network, addr string) (net.Conn, error) {
+		var dialer check.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+	params.Dial = dial
+	switch strings.ToLower(d.Auth) {
+	case "basic":
+	case "ntlm":
+		params.TransportDecorator = func() winrm.Transporter {
+			return winrm.NewClientNTLMWithDial(dial)
+		}
+	default:
+		result.Message = fmt.Sprintf("Unknown auth %s - must be basic or ntlm", d.Auth)
+		return result
+	}
 
-	// Convert encrypted to bool
-	encrypted, _ := strconv.ParseBool(d.Encrypted)
-
-	// Login to winrm and create client
-	// endpoint := winrm.NewEndpoint(d.Host, port, d.Encrypted, true, nil, nil, nil, 5*time.Second)
-	endpoint := winrm.NewEndpoint(d.Host, port, encrypted, true, nil, nil, nil, 20*time.Second)
+	// Create the client. Certificates are only validated if Verify is set.
+	verify, _ := strconv.ParseBool(d.Verify)
+	var ca []byte
+	if d.CA != "" {
+		ca = []byte(d.CA)
+	}
+	endpoint := winrm.NewEndpoint(d.Host, port, encrypted, !verify, ca, nil, nil, check.TimeLeft(ctx, 20*time.Second))
 	client, err := winrm.NewClientWithParameters(endpoint, d.Username, d.Password, &params)
 	if err != nil {
-		result.Message = fmt.Sprintf("Login to WinRM host %s failed : %s", d.Host, err)
+		result.Message = fmt.Sprintf("Failed to create WinRM client : %s", err)
 		return result
 	}
 
-	powershellCmd := winrm.Powershell(d.Cmd)
+	// Logging in happens when the shell is created. The library doesn't wrap
+	// its errors, so failed logins can only be told apart by their status
+	// code in the message.
+	shell, err := client.CreateShell()
+	if err != nil && (strings.Contains(err.Error(), "http error 401") || strings.Contains(err.Error(), "http response error: 401")) {
+		result.Message = fmt.Sprintf("Login to WinRM host %s failed : %s", d.Host, err)
+		return result
+	}
+	if err != nil {
+		result.Message = fmt.Sprintf("Connection to WinRM host %s failed : %s", d.Host, err)
+		return result
+	}
+	defer shell.Close()
 
-	bufOut := new(bytes.Buffer)
-	bufErr := new(bytes.Buffer)
+	command := d.Cmd
+	if powershell, _ := strconv.ParseBool(d.Powershell); powershell {
+		command = encodePowershell(d.Cmd)
+	}
+	cmd, err := shell.Execute(command)
+	if err != nil {
+		result.Message = fmt.Sprintf("Executing command %s failed : %s", d.Cmd, err)
+		return result
+	}
 
-	_, err = client.Run(powershellCmd, bufOut, bufErr)
+	// Wait for the command to finish, or for the check to time out
+	stdout := &util.LimitedBuffer{Max: maxOutput}
+	stderr := &util.LimitedBuffer{Max: maxOutput}
+	done := make(chan error, 1)
+	go func() {
+		var wg sync.WaitGroup
+		var outErr, errErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, outErr = io.Copy(stdout, cmd.Stdout)
+		}()
+		go func() {
+			defer wg.Done()
+			_, errErr = io.Copy(stderr, cmd.Stderr)
+		}()
+		wg.Wait()
+		cmd.Wait()
+		if outErr == nil {
+			outErr = errErr
+		}
+		done <- outErr
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Closing the shell makes the next request for output fail, which
+		// stops the output from being read
+		result.Message = fmt.Sprintf("Command %s did not finish before the check timed out", d.Cmd)
+		return result
+	}
 	if err != nil {
 		result.Message = fmt.Sprintf("Executing command %s failed : %s", d.Cmd, err)
 		return result
 	}
 
-	// Check for an error
-	if bufErr.String() != "" {
-		result.Message = fmt.Sprintf("Command %s failed : %s", d.Cmd, bufErr.String())
+	// The output might contain flags, so only admins get to see it
+	exitCode := cmd.ExitCode()
+	result.Details = map[string]string{"exit_code": strconv.Itoa(exitCode)}
+	result.AdminDetails = map[string]string{"stdout": stdout.String(), "stderr": stderr.String()}
+
+	if exitCode != d.ExpectedExitCode {
+		result.Message = fmt.Sprintf("Command %s exited with status %d, but expected %d", d.Cmd, exitCode, d.ExpectedExitCode)
 		return result
 	}
 
 	// Check if we are going to regex
-	if matchContent, _ := strconv.ParseBool(d.MatchContent); !matchContent {
+	pattern := d.ExpectedOutput
+	if matchContent, _ := strconv.ParseBool(d.MatchContent); pattern == "" && matchContent {
+		pattern = d.ContentRegex
+	}
+	if pattern == "" {
 		// If we make it in here the check passes
 		result.Passed = true
 		return result
 	}
 
 	// Match some content
-	regex, err := regexp.Compile(d.ContentRegex)
+	regex, err := regexp.Compile(pattern)
 	if err != nil {
-		result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ContentRegex, err)
+		result.Message = fmt.Sprintf("Error compiling regex string %s : %s", pattern, err)
 		return result
 	}
 
 	// Check if the content matches
-	if !regex.Match(bufOut.Bytes()) {
+	if !regex.Match(stdout.Bytes()) {
 		result.Message = "Matching content not found"
 		return result
 	}
@@ -95,6 +193,18 @@ func (d *Definition) Run(ctx context.Context) check.Result {
 	return result
 }
 
+// encodePowershell creates a command line that runs a PowerShell script.
+// The script is passed with -EncodedCommand, which is base64 of the script in
+// UTF-16LE, so that quotes and other special characters don't need escaping.
+func encodePowershell(script string) string {
+	chars := utf16.Encode([]rune(script))
+	encoded := make([]byte, 2*len(chars))
+	for i, c := range chars {
+		binary.LittleEndian.PutUint16(encoded[2*i:], c)
+	}
+	return fmt.Sprintf("powershell.exe -NoProfile -NonInteractive -EncodedCommand %s", base64.StdEncoding.EncodeToString(encoded))
+}
+
 // GetConfig returns the current CheckConfig struct this check has been
 // configured with.
 func (d *Definition) GetConfig() check.Config {
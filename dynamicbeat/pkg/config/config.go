@@ -12,15 +12,71 @@ import (
 
 type Config struct {
 	RoundTime     time.Duration `mapstructure:"round_time"`
-	Elasticsearch string        `mapstructure:"elasticsearch"`
+	Jitter        int           `mapstructure:"jitter"`
+	ShutdownGrace time.Duration `mapstructure:"shutdown_grace"`
+	Elasticsearch []string      `mapstructure:"elasticsearch"`
 	Username      string        `mapstructure:"username"`
 	Password      string        `mapstructure:"password"`
 	VerifyCerts   bool          `mapstructure:"verify_certs"`
 	Teams         []Team        `mapstructure:"teams"`
-	Setup         struct {
-		Kibana   string `mapstructure:"kibana"`
-		Username string `mapstructure:"username"`
-		Password string `mapstructure:"password"`
+	Namespace     Namespace     `mapstructure:"namespace"`
+	Exec          struct {
+		AllowedCommands []string `mapstructure:"allowed_commands"`
+	} `mapstructure:"exec"`
+	Concurrency struct {
+		MaxChecks int            `mapstructure:"max_checks"`
+		PerTeam   int            `mapstructure:"per_team"`
+		PerType   map[string]int `mapstructure:"per_type"`
+	} `mapstructure:"concurrency"`
+	Metrics struct {
+		Address string `mapstructure:"address"`
+	} `mapstructure:"metrics"`
+	Bulk struct {
+		MaxDocs   int           `mapstructure:"max_docs"`
+		MaxSizeKB int           `mapstructure:"max_size_kb"`
+		Interval  time.Duration `mapstructure:"interval"`
+	} `mapstructure:"bulk"`
+	Spool struct {
+		Path       string `mapstructure:"path"`
+		MaxSizeMB  int64  `mapstructure:"max_size_mb"`
+		ReplayRate int    `mapstructure:"replay_rate"`
+	} `mapstructure:"spool"`
+	Setup struct {
+		Kibana               []string      `mapstructure:"kibana"`
+		Username             string        `mapstructure:"username"`
+		Password             string        `mapstructure:"password"`
+		APIKey               string        `mapstructure:"api_key"`
+		CreateAPIKey         bool          `mapstructure:"create_api_key"`
+		MaxAttempts          int           `mapstructure:"max_attempts"`
+		MaxRetries           int           `mapstructure:"max_retries"`
+		PollInterval         time.Duration `mapstructure:"poll_interval"`
+		LogEvery             time.Duration `mapstructure:"log_every"`
+		MinimumClusterStatus string        `mapstructure:"minimum_cluster_status"`
+		UpdateMappings       bool          `mapstructure:"update_mappings"`
+		RotatePasswords      bool          `mapstructure:"rotate_passwords"`
+		DryRun               bool          `mapstructure:"dry_run"`
+		Concurrency          int           `mapstructure:"concurrency"`
+		SkipVersionCheck     bool          `mapstructure:"skip_version_check"`
+		ResultsRetention     string        `mapstructure:"results_retention"`
+		Proxy                string        `mapstructure:"proxy"`
+		Compress             bool          `mapstructure:"compress"`
+		DebugRequests        bool          `mapstructure:"debug_requests"`
+		ForceDashboards      bool          `mapstructure:"force_dashboards"`
+		Resources            string        `mapstructure:"resources"`
+		AlertFailures        int           `mapstructure:"alert_failures"`
+		Snapshots            struct {
+			Type      string `mapstructure:"type"`
+			Location  string `mapstructure:"location"`
+			Bucket    string `mapstructure:"bucket"`
+			BasePath  string `mapstructure:"base_path"`
+			Schedule  string `mapstructure:"schedule"`
+			Retention string `mapstructure:"retention"`
+		} `mapstructure:"snapshots"`
+		TLS struct {
+			CA   string `mapstructure:"ca"`
+			Cert string `mapstructure:"cert"`
+			Key  string `mapstructure:"key"`
+		} `mapstructure:"tls"`
 	} `mapstructure:"setup"`
 	Log struct {
 		Verbose bool `mapstructure:"verbose"`
@@ -0,0 +1,47 @@
+package config
+
+import "strings"
+
+// DefaultNamespace is the namespace that Scorestack uses unless another one is
+// configured. Resources in the default namespace keep their original names,
+// so existing deployments are left untouched.
+const DefaultNamespace = "scorestack"
+
+// A Namespace separates the Kibana space, indices, roles, and users of one
+// Scorestack deployment from those of other deployments in the same cluster.
+// An empty namespace is the same as the default namespace.
+type Namespace string
+
+// IsDefault returns whether the namespace is the default namespace.
+func (n Namespace) IsDefault() bool {
+	return n == "" || n == DefaultNamespace
+}
+
+// Space returns the ID of the Kibana space for the namespace.
+func (n Namespace) Space() string {
+	if n.IsDefault() {
+		return DefaultNamespace
+	}
+	return string(n)
+}
+
+// Index returns the name of an index, or an index pattern, in the namespace.
+// Outside of the default namespace, index names are prefixed with the
+// namespace, like ctf-results-all.
+func (n Namespace) Index(name string) string {
+	if n.IsDefault() {
+		return name
+	}
+	return string(n) + "-" + name
+}
+
+// Name returns the name of a cluster-wide object in the namespace, like a role,
+// user, or index template. Outside of the default namespace, names are
+// prefixed with the namespace, and names that already start with scorestack-
+// have that prefix replaced, so scorestack-admin becomes ctf-admin.
+func (n Namespace) Name(name string) string {
+	if n.IsDefault() {
+		return name
+	}
+	return string(n) + "-" + strings.TrimPrefix(name, DefaultNamespace+"-")
+}
@@ -0,0 +1,92 @@
+package dynamicbeat
+
+import (
+	"errors"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
+	"go.uber.org/zap"
+)
+
+// The documents that Elasticsearch was too overloaded to index are retried
+// up to bulkRetries times, waiting twice as long after each try.
+const (
+	bulkRetries = 3
+	bulkBackoff = 500 * time.Millisecond
+)
+
+// Once bulkFallbackAfter bulk requests in a row have been rejected, documents
+// are indexed one at a time for bulkFallbackFor before bulk requests are tried
+// again, since something like a proxy in front of Elasticsearch is probably
+// blocking them.
+const (
+	bulkFallbackAfter = 3
+	bulkFallbackFor   = 5 * time.Minute
+)
+
+// bulkLimits are when the publisher indexes the buffered documents: once
+// there are MaxDocs of them, once they add up to MaxBytes, or every Interval,
+// whichever comes first.
+type bulkLimits struct {
+	MaxDocs  int
+	MaxBytes int
+	Interval time.Duration
+}
+
+// index indexes documents in bulk, and returns the documents that couldn't
+// be indexed because Elasticsearch is unavailable. If the bulk request was
+// rejected, the documents are indexed one at a time instead, so that they
+// aren't lost.
+func (p *publisher) index(docs []esclient.ResultDocument) []esclient.ResultDocument {
+	if time.Now().Before(p.fallback) {
+		return p.indexEach(docs)
+	}
+
+	backoff := bulkBackoff
+	for try := 0; ; try++ {
+		indexed, failed, err := p.es.BulkIndex(docs)
+		var unavailable esclient.UnavailableError
+		if errors.As(err, &unavailable) {
+			return docs
+		}
+		if err != nil {
+			p.failures++
+			zap.S().Warnf("Bulk request was rejected, so %d result documents will be indexed one at a time : %s", len(docs), err)
+			if p.failures >= bulkFallbackAfter {
+				zap.S().Warnf("%d bulk requests in a row were rejected, so result documents will be indexed one at a time for %s", p.failures, bulkFallbackFor)
+				p.failures = 0
+				p.fallback = time.Now().Add(bulkFallbackFor)
+			}
+			return p.indexEach(docs)
+		}
+		p.failures = 0
+		p.indexed += uint64(indexed)
+
+		if len(failed) == 0 || try == bulkRetries {
+			return failed
+		}
+		zap.S().Debugf("Elasticsearch was too busy to index %d of %d result documents, retrying in %s", len(failed), len(docs), backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		docs = failed
+	}
+}
+
+// indexEach indexes documents with a request for each of them, and stops at
+// the first one that couldn't be indexed because Elasticsearch is
+// unavailable.
+func (p *publisher) indexEach(docs []esclient.ResultDocument) []esclient.ResultDocument {
+	for i, doc := range docs {
+		err := p.es.IndexResultDocument(doc)
+		var unavailable esclient.UnavailableError
+		switch {
+		case errors.As(err, &unavailable):
+			return docs[i:]
+		case err != nil:
+			zap.S().Errorf("failed to index result document %s: %s", doc.ID, err)
+		default:
+			p.indexed++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package dynamicbeat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
+)
+
+// BenchmarkPublish compares publishing a round of 500 results with bulk
+// requests, using the default bulk limits, to publishing them one document at
+// a time like the publisher does once bulk requests keep being rejected.
+func BenchmarkPublish(b *testing.B) {
+	var results []check.Result
+	for i := 0; i < 500; i++ {
+		results = append(results, check.Result{
+			Timestamp: time.Now(),
+			Metadata:  check.Metadata{ID: fmt.Sprintf("web-team%02d", i), Name: "Web", Type: "http", Group: fmt.Sprintf("team%02d", i), ScoreWeight: 1},
+			Passed:    i%3 != 0,
+			Message:   "Status code 503 does not match 200",
+		})
+	}
+
+	for _, fallback := range []bool{false, true} {
+		name := "bulk"
+		if fallback {
+			name = "one at a time"
+		}
+		b.Run(name, func(b *testing.B) {
+			p, cluster := newTestPublisher(b)
+			p.bulk = bulkLimits{MaxDocs: 500, MaxBytes: 5120 << 10, Interval: time.Second}
+			if fallback {
+				p.fallback = time.Now().Add(time.Hour)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range results {
+					p.add(results[j].ID, &results[j])
+				}
+				p.flush()
+			}
+			b.StopTimer()
+			if got, want := cluster.indexed(), 3*len(results)*b.N; got != want {
+				b.Fatalf("got %d indexed documents, want %d", got, want)
+			}
+			b.ReportMetric(float64(cluster.sent())/float64(b.N), "requests/op")
+		})
+	}
+}
+
+// rejectGeneric is an Elasticsearch cluster that rejects the documents in the
+// generic results index, like after a mapping change, and accepts the rest.
+func rejectGeneric(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		if strings.HasPrefix(r.URL.Path, "/results-all/") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"type":"mapper_parsing_exception"},"status":400}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"result":"created"}`)
+		return
+	}
+
+	var items []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var action struct {
+			Create struct {
+				Index string `json:"_index"`
+			} `json:"create"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &action) != nil || action.Create.Index == "" {
+			continue
+		}
+		// The body of the document is on the next line
+		scanner.Scan()
+		if action.Create.Index == "results-all" {
+			items = append(items, `{"create":{"status":400,"error":{"type":"mapper_parsing_exception"}}}`)
+		} else {
+			items = append(items, `{"create":{"status":201}}`)
+		}
+	}
+	fmt.Fprintf(w, `{"took":3,"errors":true,"items":[%s]}`, strings.Join(items, ","))
+}
+
+// Bulk requests and documents indexed one at a time count the same documents
+// as indexed.
+func TestPublisherIndexed(t *testing.T) {
+	for _, fallback := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fallback %v", fallback), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(rejectGeneric))
+			defer srv.Close()
+			es, err := esclient.NewFromConfig(elasticsearch.Config{Addresses: []string{srv.URL}, DisableRetry: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &publisher{es: es, bulk: bulkLimits{MaxDocs: 500, MaxBytes: 5120 << 10, Interval: time.Second}}
+			if fallback {
+				p.fallback = time.Now().Add(time.Hour)
+			}
+
+			for i := 0; i < 4; i++ {
+				result := check.Result{
+					Timestamp: time.Now(),
+					Metadata:  check.Metadata{ID: fmt.Sprintf("web-team%02d", i), Name: "Web", Type: "http", Group: fmt.Sprintf("team%02d", i)},
+				}
+				p.add(result.ID, &result)
+			}
+			p.flush()
+
+			// Each result has an admin, team, and generic document
+			if p.indexed != 8 {
+				t.Errorf("got %d indexed documents, want 8", p.indexed)
+			}
+		})
+	}
+}
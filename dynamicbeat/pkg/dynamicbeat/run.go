@@ -1,17 +1,27 @@
 package dynamicbeat
 
 import (
+	"context"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checksource"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/exec"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/metrics"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/run"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/spool"
 	"go.uber.org/zap"
 )
 
@@ -21,17 +31,59 @@ const CHECKDEF_INDEX = "checkdef"
 func Run() error {
 	zap.S().Infof("dynamicbeat is running! Hit CTRL-C to stop it.")
 	c := config.Get()
+	if c.Jitter < 0 || c.Jitter > 100 {
+		return fmt.Errorf("jitter must be a percentage from 0 to 100, not %d", c.Jitter)
+	}
+	if c.ShutdownGrace < 0 {
+		return fmt.Errorf("shutdown_grace %s must not be negative", c.ShutdownGrace)
+	}
+
+	// Jitter delays and other random values need to differ between runs
+	rand.Seed(time.Now().UnixNano())
 
 	pub, err := esclient.New(c.Elasticsearch, c.Username, c.Password, c.VerifyCerts)
 	if err != nil {
 		return err
 	}
+	pub.Namespace = c.Namespace
+
+	es, err := checksource.NewElasticsearch(c.Elasticsearch, c.Username, c.Password, c.VerifyCerts, c.Namespace.Index(CHECKDEF_INDEX))
+	if err != nil {
+		return err
+	}
+	es.Namespace = c.Namespace
 
-	es, err := checksource.NewElasticsearch(c.Elasticsearch, c.Username, c.Password, c.VerifyCerts, CHECKDEF_INDEX)
+	err = exec.Allow(c.Exec.AllowedCommands)
 	if err != nil {
 		return err
 	}
 
+	err = run.SetLimits(run.Limits{
+		MaxChecks: c.Concurrency.MaxChecks,
+		PerTeam:   c.Concurrency.PerTeam,
+		PerType:   c.Concurrency.PerType,
+	})
+	if err != nil {
+		return err
+	}
+	if c.Bulk.MaxDocs <= 0 || c.Bulk.MaxSizeKB <= 0 || c.Bulk.Interval <= 0 {
+		return fmt.Errorf("bulk.max_docs, bulk.max_size_kb, and bulk.interval must all be greater than 0")
+	}
+
+	var sp *spool.Spool
+	if c.Spool.Path != "" {
+		if c.Spool.ReplayRate <= 0 {
+			return fmt.Errorf("spool.replay_rate %d must be greater than 0", c.Spool.ReplayRate)
+		}
+		sp, err = spool.Open(c.Spool.Path, c.Spool.MaxSizeMB<<20)
+		if err != nil {
+			return fmt.Errorf("failed to open spool - set spool.path to a writable directory, or to an empty string to disable spooling : %s", err)
+		}
+	}
+	if c.Metrics.Address != "" {
+		go serveMetrics(c.Metrics.Address)
+	}
+
 	// Connect publisher client
 	/*
 		bt.client, err := b.Publisher.Connect()
@@ -40,9 +92,10 @@ func Run() error {
 		}
 	*/
 
-	// Set up CTRL+C handler
+	// Set up a handler for CTRL+C, and for service managers stopping
+	// Dynamicbeat
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
 	// Get initial check definitions
 	var defs []check.Config
@@ -73,27 +126,50 @@ func Run() error {
 		}
 	}
 
-	// Start publisher goroutine
+	atomic.StoreInt32(&ready, 1)
+
+	// Rebuild the runs of failures of checks with SLAs from their newest
+	// results, so that restarting Dynamicbeat doesn't reset them
+	tracker := check.NewTracker()
+	restoreTracker(pub, tracker, defs)
+
+	// Start publisher goroutine, and replay any results that were spooled
+	// while Elasticsearch was unavailable
+	events := &publisher{es: pub, spool: sp, bulk: bulkLimits{
+		MaxDocs:  c.Bulk.MaxDocs,
+		MaxBytes: c.Bulk.MaxSizeKB << 10,
+		Interval: c.Bulk.Interval,
+	}}
+	if sp != nil {
+		defer sp.Close()
+	}
+	replayCtx, stopReplay := context.WithCancel(context.Background())
+	defer stopReplay()
+	if sp != nil {
+		if n := sp.Len(); n > 0 {
+			zap.S().Infof("Replaying %d result documents that were spooled while Elasticsearch was unavailable", n)
+		}
+		go events.replay(replayCtx, c.Spool.ReplayRate)
+	}
 	results := make(chan check.Result)
 	published := make(chan uint64)
-	go publishEvents(pub, results, published)
+	go publishEvents(events, tracker, results, published)
 
-	// Start running checks
+	// Start running checks. Cancelling the context stops the checks that
+	// are still running when Dynamicbeat is stopping.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	ticker := time.NewTicker(c.RoundTime)
 
 	var wg sync.WaitGroup
 	for {
 		select {
 		case <-quit:
-			// Wait for all checks.RunChecks goroutines to exit
-			wg.Wait()
-
-			// Close the event publishing queue so the publishEvents goroutine will exit
-			close(results)
-
-			// Wait for all events to be published
-			<-published
+			// Stop starting rounds, and wait for the running checks to finish
+			ticker.Stop()
+			count := stop(&wg, cancel, c.ShutdownGrace, quit, results, published)
 			close(published)
+			zap.S().Infof("Indexed %d result documents, stopping", count)
 			return nil
 		case <-ticker.C:
 			zap.S().Infof("Number of goroutines: %d", runtime.NumGoroutine())
@@ -104,7 +180,7 @@ func Run() error {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				run.Round(defs, results, started)
+				run.Round(ctx, defs, c.RoundTime, c.Jitter, results, started)
 			}()
 
 			// Wait until all the checks have been started before we refresh
@@ -124,16 +200,125 @@ func Run() error {
 	}
 }
 
-func publishEvents(es *esclient.Client, results <-chan check.Result, out chan<- uint64) {
-	published := uint64(0)
-	for result := range results {
-		err := es.AddResult(result)
+// stop waits for the running rounds with drain, and then publishes the
+// results that are left. It returns how many result documents were indexed.
+func stop(wg *sync.WaitGroup, cancel context.CancelFunc, grace time.Duration, quit <-chan os.Signal, results chan<- check.Result, published <-chan uint64) uint64 {
+	drain(wg, cancel, grace, quit)
+
+	// Close the event publishing queue so the publishEvents goroutine will exit
+	close(results)
+
+	// Wait for all events to be published
+	return <-published
+}
+
+// drain waits for the rounds that are still running to finish. Checks that
+// are still running after the grace period are cancelled. If another signal
+// is received in the meantime, Dynamicbeat exits straight away without
+// publishing the results that are left.
+func drain(wg *sync.WaitGroup, cancel context.CancelFunc, grace time.Duration, quit <-chan os.Signal) {
+	zap.S().Infof("Stopping, waiting up to %s for running checks to finish - stop again to exit straight away", grace)
+	go func() {
+		<-quit
+		zap.S().Warnf("Stopping again, so exiting without waiting for the running checks or publishing their results")
+		os.Exit(1)
+	}()
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-finished:
+		return
+	case <-timer.C:
+		zap.S().Warnf("Checks were still running after the shutdown grace period of %s, so they were cancelled", grace)
+		cancel()
+	}
+	<-finished
+}
+
+func publishEvents(pub *publisher, tracker *check.Tracker, results <-chan check.Result, out chan<- uint64) {
+	ticker := time.NewTicker(pub.bulk.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				pub.flush()
+				out <- pub.indexed
+				return
+			}
+			pub.add(result.ID, &result)
+
+			violation := tracker.Record(result)
+			if violation == nil {
+				continue
+			}
+			zap.S().Infof("[%s] SLA violated after %d failures in a row", violation.ID, violation.Failures)
+			pub.add(violation.ID, violation)
+		case <-ticker.C:
+			pub.flush()
+		}
+	}
+}
+
+// restoreTracker restores the runs of failures of the checks that have an SLA.
+// A check's newest violation has the length of the run up to it, and there
+// are at most Threshold-1 failed results newer than it, so only the last
+// Threshold+1 events of each check are needed.
+func restoreTracker(es *esclient.Client, tracker *check.Tracker, defs []check.Config) {
+	for _, def := range defs {
+		if def.SLA.Threshold <= 0 {
+			continue
+		}
+		events, err := es.RecentEvents(context.Background(), def.ID, def.SLA.Threshold+1)
 		if err != nil {
-			zap.S().Error(err)
-			zap.S().Errorf("check that failed to index: %+v", result)
-		} else {
-			published++
+			zap.S().Warnf("[%s] Failed to restore the SLA failures of the check, so they will be counted from 0 : %s", def.ID, err)
+			continue
 		}
+		tracker.Restore(def.ID, events)
 	}
-	out <- published
+}
+
+// ready is set once the initial check definitions have been loaded, so that
+// the readiness endpoint can tell container orchestrators that Dynamicbeat is
+// running checks.
+var ready int32
+
+// serveMetrics serves the metrics in the Prometheus format at /metrics, the
+// worker pool metrics and the other expvar variables as JSON at /debug/vars,
+// whether Dynamicbeat is running at /healthz, and whether it is ready at
+// /readyz.
+func serveMetrics(addr string) {
+	zap.S().Infof("Serving metrics at http://%s/metrics", addr)
+	err := http.ListenAndServe(addr, metricsHandler())
+	if err != nil {
+		zap.S().Errorf("Failed to serve metrics at %s : %s", addr, err)
+	}
+}
+
+// metricsHandler routes the endpoints of the metrics address. /healthz is a
+// liveness probe, so it succeeds while Dynamicbeat is waiting for
+// Elasticsearch, since restarting Dynamicbeat wouldn't help. /readyz only
+// succeeds once the initial check definitions have been loaded.
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			http.Error(w, "loading check definitions", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
 }
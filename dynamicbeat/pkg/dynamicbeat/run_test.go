@@ -0,0 +1,229 @@
+package dynamicbeat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/run"
+)
+
+// fakeCluster is an Elasticsearch cluster that accepts every document, and
+// counts its requests and the documents in them.
+type fakeCluster struct {
+	mu       sync.Mutex
+	requests int
+	docs     int
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	f.requests++
+	if strings.HasSuffix(r.URL.Path, "/_bulk") {
+		f.docs += bytes.Count(body, []byte(`{"create":`))
+	} else {
+		f.docs++
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"took":3,"errors":false,"items":[]}`)
+}
+
+func (f *fakeCluster) indexed() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.docs
+}
+
+func (f *fakeCluster) sent() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// newTestPublisher creates a publisher for a fake cluster. Its buffer is only
+// flushed when it is full or when it is stopped, so result documents only
+// reach the cluster if the publisher is stopped properly.
+func newTestPublisher(t testing.TB) (*publisher, *fakeCluster) {
+	t.Helper()
+	cluster := &fakeCluster{}
+	srv := httptest.NewServer(cluster)
+	t.Cleanup(srv.Close)
+
+	es, err := esclient.NewFromConfig(elasticsearch.Config{Addresses: []string{srv.URL}, DisableRetry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &publisher{es: es, bulk: bulkLimits{MaxDocs: 1000, MaxBytes: 1 << 20, Interval: time.Hour}}, cluster
+}
+
+// newSlowServer starts a TCP server that reads how long to wait from each
+// connection, like "300ms", and says "ready" once it has waited.
+func newSlowServer(t *testing.T) (string, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				wait, _ := time.ParseDuration(strings.TrimSpace(line))
+				select {
+				case <-time.After(wait):
+					fmt.Fprint(conn, "ready\n")
+				case <-done:
+				}
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return host, port
+}
+
+// slowChecks counts the slow checks, so that each of them gets its own ID.
+// Rounds skip checks that already ran within the round time.
+var slowChecks int64
+
+// slowCheck is a TCP check of a slow server that takes as long as wait to
+// pass.
+func slowCheck(host string, port string, wait time.Duration) check.Config {
+	id := fmt.Sprintf("slow-%d", atomic.AddInt64(&slowChecks, 1))
+	return check.Config{
+		Metadata:   check.Metadata{ID: id, Name: id, Type: "tcp", Group: "team01"},
+		Definition: []byte(fmt.Sprintf(`{"Host": "%s", "Port": "%s", "Send": "%s\\n", "Expect": "ready", "ReadTimeout": "10s"}`, host, port, wait)),
+	}
+}
+
+func TestStop(t *testing.T) {
+	host, port := newSlowServer(t)
+
+	tests := []struct {
+		name    string
+		waits   []time.Duration // how long each check takes
+		grace   time.Duration
+		indexed int           // result documents, of which there are 3 for each result
+		stopped time.Duration // how long stopping may take at most
+	}{
+		{
+			name:    "checks finish during the grace period",
+			waits:   []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 600 * time.Millisecond},
+			grace:   5 * time.Second,
+			indexed: 9,
+			stopped: 2 * time.Second,
+		},
+		{
+			name:    "checks are cancelled after the grace period",
+			waits:   []time.Duration{100 * time.Millisecond, 10 * time.Second},
+			grace:   500 * time.Millisecond,
+			indexed: 3,
+			stopped: 2 * time.Second,
+		},
+		{
+			name:    "no grace period",
+			waits:   []time.Duration{10 * time.Second},
+			indexed: 0,
+			stopped: time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, cluster := newTestPublisher(t)
+			var defs []check.Config
+			for _, wait := range tt.waits {
+				defs = append(defs, slowCheck(host, port, wait))
+			}
+
+			results := make(chan check.Result)
+			published := make(chan uint64)
+			go publishEvents(pub, check.NewTracker(), results, published)
+
+			// Stop right after the round starts, like after a SIGTERM in the
+			// middle of a round
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var wg sync.WaitGroup
+			started := make(chan bool)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				run.Round(ctx, defs, time.Minute, 0, results, started)
+			}()
+			<-started
+
+			start := time.Now()
+			count := stop(&wg, cancel, tt.grace, make(chan os.Signal), results, published)
+			if elapsed := time.Since(start); elapsed > tt.stopped {
+				t.Errorf("took %s to stop, want at most %s", elapsed, tt.stopped)
+			}
+			if count != uint64(tt.indexed) {
+				t.Errorf("got %d indexed result documents, want %d", count, tt.indexed)
+			}
+			if got := cluster.indexed(); got != tt.indexed {
+				t.Errorf("cluster got %d result documents, want %d", got, tt.indexed)
+			}
+		})
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		ready   bool
+		code    int
+		message string
+	}{
+		{name: "alive while loading", path: "/healthz", code: http.StatusOK, message: "ok"},
+		{name: "alive once ready", path: "/healthz", ready: true, code: http.StatusOK, message: "ok"},
+		{name: "not ready while loading", path: "/readyz", code: http.StatusServiceUnavailable, message: "loading check definitions"},
+		{name: "ready", path: "/readyz", ready: true, code: http.StatusOK, message: "ok"},
+		{name: "metrics while loading", path: "/metrics", code: http.StatusOK, message: "# HELP "},
+	}
+	defer atomic.StoreInt32(&ready, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.ready {
+				atomic.StoreInt32(&ready, 1)
+			} else {
+				atomic.StoreInt32(&ready, 0)
+			}
+
+			w := httptest.NewRecorder()
+			metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.code || !strings.HasPrefix(w.Body.String(), tt.message) {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), tt.code, tt.message)
+			}
+		})
+	}
+}
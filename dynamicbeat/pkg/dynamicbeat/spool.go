@@ -0,0 +1,170 @@
+package dynamicbeat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/metrics"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/spool"
+	"go.uber.org/zap"
+)
+
+// replayRetry is how long to wait before replaying spooled documents again
+// after Elasticsearch was unavailable.
+const replayRetry = 5 * time.Second
+
+// buffered is how many documents the publisher has buffered, including the
+// ones that it is indexing.
+var buffered int64
+
+func init() {
+	metrics.NewGaugeFunc("dynamicbeat_publish_queue_documents", "Result documents that are buffered to be indexed.", func() float64 {
+		return float64(atomic.LoadInt64(&buffered))
+	})
+}
+
+// A publisher indexes the documents of events in bulk. Documents that can't
+// be indexed because Elasticsearch is unavailable are written to the spool, if
+// there is one, and are replayed in order once it is available again.
+type publisher struct {
+	es    *esclient.Client
+	spool *spool.Spool
+	bulk  bulkLimits
+
+	buffer   []esclient.ResultDocument
+	size     int
+	indexed  uint64
+	failures int       // the bulk requests in a row that were rejected
+	fallback time.Time // when to stop indexing documents one at a time
+}
+
+// add buffers the documents of an event, and indexes the buffer once it is
+// full.
+func (p *publisher) add(id string, event check.Event) {
+	docs, err := esclient.ResultDocuments(event)
+	if err != nil {
+		zap.S().Errorf("failed to create result documents for %s: %s", id, err)
+		return
+	}
+	for _, doc := range docs {
+		p.buffer = append(p.buffer, doc)
+		p.size += len(doc.Body)
+	}
+	atomic.StoreInt64(&buffered, int64(len(p.buffer)))
+	if len(p.buffer) >= p.bulk.MaxDocs || p.size >= p.bulk.MaxBytes {
+		p.flush()
+	}
+}
+
+// flush indexes the buffered documents. While the spool has documents in it,
+// they are added to the end of it instead of being indexed, so that they are
+// indexed in the order that they were created.
+func (p *publisher) flush() {
+	if len(p.buffer) == 0 {
+		return
+	}
+	docs := p.buffer
+	p.buffer = nil
+	p.size = 0
+	defer atomic.StoreInt64(&buffered, 0)
+	if p.spool != nil && p.spool.Len() > 0 {
+		p.write(docs)
+		return
+	}
+
+	failed := p.index(docs)
+	if len(failed) == 0 {
+		return
+	}
+	if p.spool == nil {
+		zap.S().Errorf("failed to index %d result documents, since Elasticsearch is unavailable", len(failed))
+		return
+	}
+	zap.S().Warnf("Elasticsearch is unavailable, so results will be spooled until it is available again")
+	p.write(failed)
+}
+
+// write adds documents to the end of the spool.
+func (p *publisher) write(docs []esclient.ResultDocument) {
+	for _, doc := range docs {
+		record, err := json.Marshal(doc)
+		if err == nil {
+			err = p.spool.Append(record)
+		}
+		if err != nil {
+			zap.S().Errorf("failed to spool result document %s: %s", doc.ID, err)
+		}
+	}
+}
+
+// replay indexes the documents in the spool, oldest first, at up to rate
+// documents per second, until the context is done. Documents are indexed with
+// the same IDs that they were created with, so documents that were indexed
+// before Dynamicbeat stopped but are still in the spool aren't indexed twice.
+func (p *publisher) replay(ctx context.Context, rate int) {
+	interval := time.Second / time.Duration(rate)
+	replayed := 0
+	for {
+		wait := interval
+		record, err := p.spool.Next()
+		switch {
+		case errors.Is(err, io.EOF):
+			if replayed > 0 {
+				zap.S().Infof("Replayed %d spooled result documents", replayed)
+				replayed = 0
+			}
+			wait = time.Second
+		case err != nil:
+			zap.S().Errorf("failed to read spooled result document: %s", err)
+			wait = replayRetry
+		case !p.replayOne(record):
+			wait = replayRetry
+		default:
+			replayed++
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// replayOne indexes a spooled document, and removes it from the spool unless
+// Elasticsearch is still unavailable. Documents that can't be decoded or that
+// Elasticsearch rejected would fail again, so they are dropped.
+func (p *publisher) replayOne(record []byte) bool {
+	var doc esclient.ResultDocument
+	err := json.Unmarshal(record, &doc)
+	if err != nil {
+		zap.S().Errorf("dropping spooled result document that couldn't be decoded: %s", err)
+		p.ack()
+		return true
+	}
+
+	err = p.es.IndexResultDocument(doc)
+	var unavailable esclient.UnavailableError
+	if errors.As(err, &unavailable) {
+		zap.S().Debugf("Elasticsearch is still unavailable, so spooled results can't be replayed yet: %s", err)
+		return false
+	}
+	if err != nil {
+		zap.S().Errorf("dropping spooled result document that Elasticsearch rejected: %s", err)
+	}
+	p.ack()
+	return true
+}
+
+func (p *publisher) ack() {
+	err := p.spool.Ack()
+	if err != nil {
+		zap.S().Error(err)
+	}
+}
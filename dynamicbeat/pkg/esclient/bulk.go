@@ -0,0 +1,104 @@
+package esclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// publishErrors counts the result documents that couldn't be indexed, because
+// Elasticsearch was unavailable or because it rejected them. Documents that
+// are indexed again later are counted each time that they fail.
+var publishErrors = metrics.NewCounterVec("dynamicbeat_publish_errors_total",
+	"Result documents that couldn't be indexed, because Elasticsearch was unavailable or because it rejected them.",
+	"reason")
+
+// bulkItem is the result of one of the actions of a bulk request.
+type bulkItem struct {
+	Create struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"create"`
+}
+
+// BulkIndex indexes result documents with a single bulk request, like
+// IndexResultDocument does for each of them. It returns how many documents
+// were indexed, and the documents that couldn't be indexed because
+// Elasticsearch was overloaded, so that they can be indexed again. Documents
+// that Elasticsearch rejected are neither. An UnavailableError is returned if Elasticsearch couldn't
+// be reached, and any other error means that the bulk request itself was
+// rejected, so none of the documents were indexed.
+func (c *Client) BulkIndex(docs []ResultDocument) (int, []ResultDocument, error) {
+	var body bytes.Buffer
+	for _, doc := range docs {
+		action, err := json.Marshal(map[string]interface{}{
+			"create": map[string]string{
+				"_index": c.Namespace.Index(doc.Index),
+				"_id":    doc.ID,
+			},
+		})
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to encode bulk action for result document %s: %s", doc.ID, err)
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc.Body)
+		body.WriteByte('\n')
+	}
+
+	res, err := c.Bulk(&body)
+	if err != nil {
+		publishErrors.With("unavailable").Add(float64(len(docs)))
+		return 0, nil, UnavailableError{Err: err}
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		err = fmt.Errorf("failed to bulk index %d result documents: %w", len(docs), c.CloseAndCheck(res))
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError {
+			publishErrors.With("unavailable").Add(float64(len(docs)))
+			return 0, nil, UnavailableError{Err: err}
+		}
+		publishErrors.With("rejected").Add(float64(len(docs)))
+		return 0, nil, err
+	}
+
+	response := struct {
+		Errors bool       `json:"errors"`
+		Items  []bulkItem `json:"items"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to decode bulk response: %s", err)
+	}
+	if !response.Errors {
+		return len(docs), nil, nil
+	}
+	if len(response.Items) != len(docs) {
+		return 0, nil, fmt.Errorf("bulk response has %d items, but %d result documents were sent", len(response.Items), len(docs))
+	}
+
+	// Dynamicbeat can only create documents in the results indices, so a
+	// conflict means that the document is already there
+	indexed := 0
+	failed := make([]ResultDocument, 0)
+	for i, item := range response.Items {
+		status := item.Create.Status
+		switch {
+		case status < 300 || status == http.StatusConflict:
+			indexed++
+		case status == http.StatusTooManyRequests || status >= http.StatusInternalServerError:
+			publishErrors.With("unavailable").Inc()
+			failed = append(failed, docs[i])
+		default:
+			publishErrors.With("rejected").Inc()
+			// Documents that Elasticsearch rejected would be rejected
+			// again, so they aren't returned
+			zap.S().Errorf("failed to index result document %s: %s", docs[i].ID, item.Create.Error)
+		}
+	}
+	return indexed, failed, nil
+}
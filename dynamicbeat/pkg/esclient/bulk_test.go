@@ -0,0 +1,105 @@
+package esclient
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// counter is a fake Elasticsearch cluster that counts its requests, and
+// accepts every document.
+type counter struct {
+	requests int64
+}
+
+func (c *counter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&c.requests, 1)
+	_, _ = io.Copy(ioutil.Discard, r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"took":3,"errors":false,"items":[]}`)
+}
+
+// roundDocuments creates the result documents of a round with a check for
+// each of the given number of teams.
+func roundDocuments(b *testing.B, teams int) []ResultDocument {
+	b.Helper()
+	var docs []ResultDocument
+	for i := 0; i < teams; i++ {
+		result := check.Result{
+			Timestamp: time.Now(),
+			Metadata:  check.Metadata{ID: fmt.Sprintf("web-team%02d", i), Name: "Web", Type: "http", Group: fmt.Sprintf("team%02d", i), ScoreWeight: 1},
+			Passed:    i%3 != 0,
+			Message:   "Status code 503 does not match 200",
+		}
+		events, err := ResultDocuments(&result)
+		if err != nil {
+			b.Fatal(err)
+		}
+		docs = append(docs, events...)
+	}
+	return docs
+}
+
+// BenchmarkIndex compares indexing a round of 500 results with bulk requests
+// to indexing their documents one at a time.
+func BenchmarkIndex(b *testing.B) {
+	docs := roundDocuments(b, 500)
+
+	b.Run("bulk", func(b *testing.B) {
+		cluster := &counter{}
+		c := newTestClient(b, cluster)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			indexed, failed, err := c.BulkIndex(docs)
+			if err != nil || indexed != len(docs) {
+				b.Fatalf("got %d indexed and %d failed documents and error %v", indexed, len(failed), err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&cluster.requests))/float64(b.N), "requests/op")
+	})
+	b.Run("one at a time", func(b *testing.B) {
+		cluster := &counter{}
+		c := newTestClient(b, cluster)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, doc := range docs {
+				err := c.IndexResultDocument(doc)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&cluster.requests))/float64(b.N), "requests/op")
+	})
+}
+
+func TestBulkIndex(t *testing.T) {
+	docs := []ResultDocument{{ID: "created", Index: "results-admin"}, {ID: "conflict", Index: "results-admin"}, {ID: "busy", Index: "results-admin"}, {ID: "rejected", Index: "results-admin"}}
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"took":3,"errors":true,"items":[`+
+			`{"create":{"_id":"created","status":201}},`+
+			`{"create":{"_id":"conflict","status":409,"error":{"type":"version_conflict_engine_exception"}}},`+
+			`{"create":{"_id":"busy","status":429,"error":{"type":"es_rejected_execution_exception"}}},`+
+			`{"create":{"_id":"rejected","status":400,"error":{"type":"mapper_parsing_exception"}}}]}`)
+	}))
+
+	// Conflicts mean the document was already indexed, and rejected
+	// documents are neither indexed nor returned
+	indexed, failed, err := c.BulkIndex(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 2 {
+		t.Errorf("got %d indexed documents, want 2", indexed)
+	}
+	if len(failed) != 1 || failed[0].ID != "busy" {
+		t.Errorf("got failed documents %v, want only busy", failed)
+	}
+}
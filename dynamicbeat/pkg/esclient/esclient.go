@@ -3,34 +3,95 @@ package esclient
 import (
 	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 )
 
 type Client struct {
 	*elasticsearch.Client
+	MaxAttempts          int              // the number of times Wait will check the cluster health before giving up; 0 means never give up
+	MinimumClusterStatus string           // the lowest cluster health status that Wait will accept as ready; defaults to green
+	UpdateMappings       bool             // whether AddIndex should update the mappings of indices that already exist
+	RotatePasswords      bool             // whether AddUser should reset the passwords of users that already exist
+	Plan                 *util.Plan       // the requests that were skipped in dry-run mode
+	Version              util.Version     // the version of Elasticsearch, once it has been fetched with FetchVersion
+	Namespace            config.Namespace // the namespace that result documents are indexed into
+
+	PollInterval time.Duration // how often Wait checks the cluster health; defaults to util.DefaultPollInterval
+	LogEvery     time.Duration // how often Wait logs that it is still waiting; defaults to PollInterval
 }
 
-func New(host string, username string, password string, verify bool) (*Client, error) {
-	clientConfig := elasticsearch.Config{
-		Addresses: []string{host},
+// New creates a client for an Elasticsearch cluster. If more than one host is
+// given, requests will fail over to the next host when a host is unavailable.
+func New(hosts []string, username string, password string, verify bool) (*Client, error) {
+	return NewFromConfig(elasticsearch.Config{
+		Addresses: hosts,
 		Username:  username,
 		Password:  password,
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 10,
-			DialContext:         (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: !verify,
-			},
-		},
-	}
+		Transport: NewTransport(&tls.Config{
+			InsecureSkipVerify: !verify,
+		}),
+	})
+}
+
+// NewFromConfig creates a client from a fully-specified Elasticsearch client
+// configuration.
+func NewFromConfig(clientConfig elasticsearch.Config) (*Client, error) {
 	es, err := elasticsearch.NewClient(clientConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Elasticsearch client: %s", err)
 	}
 
-	return &Client{es}, nil
+	return &Client{Client: es}, nil
+}
+
+// NewTransport creates the HTTP transport used for connections to
+// Elasticsearch.
+func NewTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		MaxIdleConnsPerHost: 10,
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		TLSClientConfig:     tlsConfig,
+	}
+}
+
+// DryRunTransport is an HTTP transport that only sends requests which don't
+// change anything. Other requests are recorded in Plan, and a successful empty
+// response is returned in their place.
+type DryRunTransport struct {
+	Next http.RoundTripper
+	Plan *util.Plan
+}
+
+func (t *DryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !util.IsMutating(req.Method) {
+		return t.Next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body of Elasticsearch request: %s", err)
+		}
+	}
+	t.Plan.Add("Elasticsearch", req.Method, req.URL.Path, body)
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
 }
@@ -0,0 +1,67 @@
+package esclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+)
+
+// newTestClient creates a client for a fake Elasticsearch cluster, which is
+// stopped when the test finishes.
+func newTestClient(t testing.TB, handler http.Handler) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	c, err := NewFromConfig(elasticsearch.Config{Addresses: []string{srv.URL}, DisableRetry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// recorder is a fake Elasticsearch cluster that records every request as its
+// method, path, and body, and responds with respond, or with an empty object if
+// respond is nil.
+type recorder struct {
+	respond  func(w http.ResponseWriter, r *http.Request)
+	mu       sync.Mutex
+	requests []string
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rec.mu.Lock()
+	rec.requests = append(rec.requests, strings.TrimSpace(fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, body)))
+	rec.mu.Unlock()
+
+	if rec.respond != nil {
+		rec.respond(w, r)
+		return
+	}
+	fmt.Fprint(w, "{}")
+}
+
+func (rec *recorder) recorded() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string{}, rec.requests...)
+}
+
+// versionHandler responds to info requests with an Elasticsearch version, and
+// to every other request with an empty object.
+func versionHandler(version string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprintf(w, `{"version":{"number":"%s"}}`, version)
+			return
+		}
+		fmt.Fprint(w, "{}")
+	}
+}
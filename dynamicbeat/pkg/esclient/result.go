@@ -1,69 +1,189 @@
 package esclient
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"sync"
 
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"go.uber.org/zap"
 )
 
-func (c *Client) AddResult(result check.Result) error {
-	docs := make([]struct {
-		string
-		io.Reader
-		error
-	}, 0)
-
-	// Create the documents
-	index, reader, err := result.Admin()
-	docs = append(docs, struct {
-		string
-		io.Reader
-		error
-	}{index, reader, err})
-	index, reader, err = result.Team()
-	docs = append(docs, struct {
-		string
-		io.Reader
-		error
-	}{index, reader, err})
-	index, reader, err = result.Generic()
-	docs = append(docs, struct {
-		string
-		io.Reader
-		error
-	}{index, reader, err})
+// A ResultDocument is one of the documents of an event. Its ID is made from
+// the key of the event, so that indexing it again, like when it is replayed
+// from the spool, doesn't count the event twice.
+type ResultDocument struct {
+	ID    string          `json:"id"`
+	Index string          `json:"index"` // the index without the namespace
+	Body  json.RawMessage `json:"body"`
+}
+
+// An UnavailableError means that a document couldn't be indexed because
+// Elasticsearch couldn't be reached or was overloaded, so it can be indexed
+// again later.
+type UnavailableError struct {
+	Err error
+}
+
+func (e UnavailableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// AddResult indexes the documents of a check result. The documents that
+// couldn't be indexed because Elasticsearch was unavailable are returned, so
+// that they can be indexed later.
+func (c *Client) AddResult(result check.Result) ([]ResultDocument, error) {
+	return c.addEvent(result.ID, &result)
+}
+
+// AddViolation indexes the documents of an SLA violation, like AddResult.
+func (c *Client) AddViolation(v check.Violation) ([]ResultDocument, error) {
+	return c.addEvent(v.ID, &v)
+}
+
+func (c *Client) addEvent(id string, event check.Event) ([]ResultDocument, error) {
+	docs, err := ResultDocuments(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create result documents for %s: %s", id, err)
+	}
 
 	// Loop through the documents and index them
+	var mu sync.Mutex
 	var wg sync.WaitGroup
+	failed := make([]ResultDocument, 0)
 	for _, doc := range docs {
 		wg.Add(1)
-		go func(doc struct {
-			string
-			io.Reader
-			error
-		}, wg *sync.WaitGroup) {
+		go func(doc ResultDocument) {
 			defer wg.Done()
-			if doc.error != nil {
-				fmt.Printf("failed to index result for %s: %s\n", result.ID, doc.error)
+			err := c.IndexResultDocument(doc)
+			if err == nil {
 				return
 			}
 
-			res, err := c.Index(doc.string, doc.Reader)
-			if err != nil {
-				fmt.Printf("failed to index result document for %s: %s\n", result.ID, err)
+			var unavailable UnavailableError
+			if errors.As(err, &unavailable) {
+				mu.Lock()
+				defer mu.Unlock()
+				failed = append(failed, doc)
 				return
 			}
-			if res.IsError() {
-				// TODO: better error message here. res.String() is for testing or
-				// debugging only
-				fmt.Printf("failed to index result document in elasticsearch for %s: %s\n", result.ID, res.String())
-				return
-			}
-			defer res.Body.Close()
-		}(doc, &wg)
+			// Documents that Elasticsearch rejected would be rejected
+			// again, so they aren't returned
+			zap.S().Errorf("failed to index result document %s: %s", doc.ID, err)
+		}(doc)
 	}
 	wg.Wait()
-	return nil
+	return failed, nil
+}
+
+// ResultDocuments creates the documents of an event for each of the results
+// indices.
+func ResultDocuments(event check.Event) ([]ResultDocument, error) {
+	sum := sha256.Sum256([]byte(event.Key()))
+	id := hex.EncodeToString(sum[:20])
+
+	docs := make([]ResultDocument, 0, 3)
+	for _, create := range []func() (string, io.Reader, error){event.Admin, event.Team, event.Generic} {
+		index, reader, err := create()
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, ResultDocument{ID: id, Index: index, Body: body})
+	}
+	return docs, nil
+}
+
+// IndexResultDocument indexes a result document, unless a document with the
+// same ID has already been indexed. Dynamicbeat can only create documents in
+// the results indices, so a conflict means that the document is already
+// there. An UnavailableError is returned if the document can be indexed again
+// later.
+func (c *Client) IndexResultDocument(doc ResultDocument) error {
+	res, err := c.Index(
+		c.Namespace.Index(doc.Index),
+		bytes.NewReader(doc.Body),
+		c.Index.WithDocumentID(doc.ID),
+		c.Index.WithOpType("create"),
+	)
+	if err != nil {
+		publishErrors.With("unavailable").Inc()
+		return UnavailableError{Err: err}
+	}
+	err = c.CloseAndCheck(res, http.StatusConflict)
+	if err == nil {
+		return nil
+	}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError {
+		publishErrors.With("unavailable").Inc()
+		return UnavailableError{Err: err}
+	}
+	publishErrors.With("rejected").Inc()
+	return err
+}
+
+// RecentEvents returns the newest results and SLA violations of a check from
+// the admin results index, newest first.
+func (c *Client) RecentEvents(ctx context.Context, id string, size int) ([]check.PastEvent, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{
+				"id.keyword": id,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode query for the events of %s: %s", id, err)
+	}
+
+	index := c.Namespace.Index("results-admin")
+	res, err := c.Search(
+		c.Search.WithIndex(index),
+		c.Search.WithBody(bytes.NewReader(query)),
+		c.Search.WithSize(size),
+		c.Search.WithSort("epoch:desc"),
+		c.Search.WithSource("event_type", "epoch", "passed", "sla_failures"),
+		c.Search.WithIgnoreUnavailable(true),
+		c.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for the events of %s: %s", id, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("failed to search for the events of %s: %w", id, c.CloseAndCheck(res))
+	}
+
+	docs := struct {
+		Hits struct {
+			Hits []struct {
+				Source check.PastEvent `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&docs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the events of %s: %s", id, err)
+	}
+
+	events := make([]check.PastEvent, 0, len(docs.Hits.Hits))
+	for _, hit := range docs.Hits.Hits {
+		events = append(events, hit.Source)
+	}
+	return events, nil
 }
@@ -1,82 +1,129 @@
 package esclient
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"strings"
+	"regexp"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 	"go.uber.org/zap"
 )
 
-func (c *Client) CloseAndCheck(res *esapi.Response) error {
-	defer res.Body.Close()
-	if res.IsError() {
-		buf := new(strings.Builder)
-		_, err := io.Copy(buf, res.Body)
-		if err != nil {
-			return fmt.Errorf("got %v response code and couldn't read response body: %s", res.StatusCode, err)
-		}
-		return fmt.Errorf("response code was %v - response body: %s", res.StatusCode, buf)
-	}
+// CloseAndCheck closes the body of a response, and returns an error if the
+// response code was not a 2xx code or one of the allowed codes.
+func (c *Client) CloseAndCheck(res *esapi.Response, allowed ...int) error {
+	return util.CheckResponse(res.StatusCode, res.Body, allowed...)
+}
 
-	return nil
+// clusterStatuses ranks the Elasticsearch cluster health statuses from worst
+// to best.
+var clusterStatuses = map[string]int{
+	"red":    0,
+	"yellow": 1,
+	"green":  2,
 }
 
-func (c *Client) Wait() error {
-	first := true
-	for {
-		// If we haven't been through this loop yet, sleep for 5 seconds
-		if !first {
-			zap.S().Info("waiting for Elasticsearch to be ready...")
-			time.Sleep(5 * time.Second)
+func (c *Client) Wait(ctx context.Context) error {
+	// Figure out which cluster health status is good enough
+	minimum := c.MinimumClusterStatus
+	if minimum == "" {
+		minimum = "green"
+	}
+	minimumRank, ok := clusterStatuses[minimum]
+	if !ok {
+		return fmt.Errorf("invalid minimum cluster status '%s' - must be one of green, yellow, or red", minimum)
+	}
+
+	// Keep track of the last thing we saw so we can report it if we give up
+	lastStatus := "unknown"
+	var lastErr error
+
+	// We could use WithWaitForStatus to block until the status is green, but
+	// then there wouldn't be output to the user that we were still waiting.
+	// Waiting for green status takes a while, and if we didn't periodically
+	// update the user that we're still waiting, they might get concerned that
+	// the program isn't working.
+	logEvery := c.LogEvery
+	if logEvery <= 0 {
+		logEvery = c.PollInterval
+	}
+	shouldLog := util.Every(logEvery)
+	attempt := 0
+	return util.Poll(ctx, c.PollInterval, func() (bool, error) {
+		attempt++
+		status, err := c.ClusterHealth(ctx)
+		if util.IsStatus(err, 401) || util.IsStatus(err, 403) {
+			return false, fmt.Errorf("Elasticsearch rejected the setup credentials: %w", err)
 		}
-		first = false
-
-		// We could use WithWaitForStatus to block until the status is green,
-		// but then there wouldn't be output to the user that we were still
-		// waiting. Waiting for green status takes a while, and if we didn't
-		// periodically update the user that we're still waiting, they might
-		// get concerned that the program isn't working.
-		res, err := c.Cluster.Health()
-		if err != nil || res.IsError() {
-			continue
+		if err == nil {
+			lastStatus = status
+			if rank, ok := clusterStatuses[status]; ok && rank >= minimumRank {
+				return true, nil
+			}
+		} else {
+			zap.S().Debugf("Elasticsearch is not ready: %s", err)
 		}
+		lastErr = err
 
-		// Check if response status is "green"
-		health := struct {
-			Status string `json:"status"`
-		}{}
-		decoder := json.NewDecoder(res.Body)
-		err = decoder.Decode(&health)
-		if err != nil {
-			continue
+		if c.MaxAttempts > 0 && attempt >= c.MaxAttempts {
+			return false, fmt.Errorf("Elasticsearch did not become ready after %d attempts (last status: %s, last error: %v)", c.MaxAttempts, lastStatus, lastErr)
 		}
-		res.Body.Close()
-		if health.Status == "green" {
-			break
+		if shouldLog() {
+			if err == nil {
+				zap.S().Infof("Elasticsearch cluster status is %s, waiting for at least %s", status, minimum)
+			} else {
+				zap.S().Info("waiting for Elasticsearch to be ready...")
+			}
 		}
-	}
+		return false, nil
+	})
+}
 
-	return nil
+// AddIndex creates an index using the index definition returned by data. If
+// the index already exists, it will be skipped unless UpdateMappings is set, in
+// which case the mappings from the index definition will be applied to the
+// existing index.
+func (c *Client) AddIndex(ctx context.Context, name string, data func() io.Reader) error {
+	return c.addIndex(ctx, name, data, c.UpdateMappings)
+}
+
+// AddOrUpdateIndex creates an index using the index definition returned by
+// data. If the index already exists, the mappings from the index definition
+// will be applied to the existing index.
+func (c *Client) AddOrUpdateIndex(ctx context.Context, name string, data func() io.Reader) error {
+	return c.addIndex(ctx, name, data, true)
 }
 
-func (c *Client) AddIndex(name string, body io.Reader) error {
-	res, err := c.Indices.Exists([]string{name})
+func (c *Client) addIndex(ctx context.Context, name string, data func() io.Reader, update bool) error {
+	// Elasticsearch responds to HEAD /<index> with a 200 if the index exists
+	res, err := c.Indices.Exists([]string{name}, c.Indices.Exists.WithContext(ctx))
 	if err != nil {
 		return fmt.Errorf("failed to check if index '%s' exists: %s", name, err)
 	}
-	defer res.Body.Close()
 
 	// Don't create the index if it already exists
-	if res.StatusCode == 200 {
-		zap.S().Debugf("index '%s' already exists, skipping...", name)
-		return nil
+	err = c.CloseAndCheck(res)
+	if err == nil {
+		if !update {
+			zap.S().Debugf("index '%s' already exists, skipping...", name)
+			return nil
+		}
+
+		return c.updateMappings(ctx, name, data())
+	}
+	if !util.IsStatus(err, 404) {
+		return fmt.Errorf("failed to check if index '%s' exists: %w", name, err)
 	}
 
-	res, err = c.Indices.Create(name, c.Indices.Create.WithBody(body))
+	zap.S().Infof("adding index: %s", name)
+	res, err = c.Indices.Create(name, c.Indices.Create.WithBody(data()), c.Indices.Create.WithContext(ctx))
 	if err != nil {
 		return fmt.Errorf("failed to create index '%s': %s", name, err)
 	}
@@ -84,23 +131,461 @@ func (c *Client) AddIndex(name string, body io.Reader) error {
 	return c.CloseAndCheck(res)
 }
 
-func (c *Client) AddUser(name string, body io.Reader) error {
-	res, err := c.Security.GetUser(c.Security.GetUser.WithUsername(name))
+// updateMappings applies the mappings from an index definition to an existing
+// index.
+func (c *Client) updateMappings(ctx context.Context, name string, body io.Reader) error {
+	index := struct {
+		Mappings json.RawMessage `json:"mappings"`
+	}{}
+	err := json.NewDecoder(body).Decode(&index)
+	if err != nil {
+		return fmt.Errorf("failed to decode index definition for '%s': %s", name, err)
+	}
+	if index.Mappings == nil {
+		zap.S().Debugf("index definition for '%s' has no mappings, skipping...", name)
+		return nil
+	}
+
+	return c.UpdateIndexMapping(ctx, name, bytes.NewReader(index.Mappings))
+}
+
+// sameMapper matches the reason that Elasticsearch gives for rejecting a field
+// that is redefined with the same name, which may or may not include the name
+// of the field.
+var sameMapper = regexp.MustCompile(`mapper (\[[^\]]*\] )?of same name`)
+
+// UpdateIndexMapping adds new fields to the mappings of an existing index. New
+// fields can be added to an index at any time, but fields that already exist
+// can't have their type changed. If the new mappings conflict with the
+// existing mappings, an error including the reason for the conflict is
+// returned.
+func (c *Client) UpdateIndexMapping(ctx context.Context, name string, mappings io.Reader) error {
+	zap.S().Infof("updating mappings for index: %s", name)
+	res, err := c.Indices.PutMapping(mappings, c.Indices.PutMapping.WithIndex(name), c.Indices.PutMapping.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to update mappings for index '%s': %s", name, err)
+	}
+
+	err = c.CloseAndCheck(res)
+	var re *util.ResponseError
+	if !errors.As(err, &re) || re.StatusCode != 400 {
+		return err
+	}
+
+	// Figure out why Elasticsearch rejected the mappings
+	body := struct {
+		Error struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}{}
+	if json.Unmarshal([]byte(re.Body), &body) != nil {
+		return fmt.Errorf("failed to update mappings for index '%s': %w", name, err)
+	}
+
+	// Redefining a field with an identical definition isn't a real problem
+	if sameMapper.MatchString(body.Error.Reason) {
+		zap.S().Debugf("mappings for index '%s' are unchanged: %s", name, body.Error.Reason)
+		return nil
+	}
+
+	return fmt.Errorf("mappings conflict with the existing mappings for index '%s' (%s: %s): %w", name, body.Error.Type, body.Error.Reason, err)
+}
+
+// AddUser creates a user from the user definition in body. If the user already
+// exists, they will be skipped unless RotatePasswords is set, in which case
+// their password will be reset to the one in the user definition.
+func (c *Client) AddUser(ctx context.Context, name string, body io.Reader) error {
+	return c.addUser(ctx, name, body, c.RotatePasswords)
+}
+
+// UpsertUser creates a user from the user definition in body. If the user
+// already exists, their password is reset to the one in the user definition.
+func (c *Client) UpsertUser(ctx context.Context, name string, body io.Reader) error {
+	return c.addUser(ctx, name, body, true)
+}
+
+func (c *Client) addUser(ctx context.Context, name string, body io.Reader, rotate bool) error {
+	res, err := c.Security.GetUser(c.Security.GetUser.WithUsername(name), c.Security.GetUser.WithContext(ctx))
 	if err != nil {
 		return fmt.Errorf("failed to check if user '%s' exists: %s", name, err)
 	}
-	defer res.Body.Close()
 
 	// Don't create the user if they already exist
-	if res.StatusCode == 200 {
-		zap.S().Debugf("user '%s' already exists, skipping...", name)
+	err = c.CloseAndCheck(res)
+	if err == nil {
+		if !rotate {
+			zap.S().Infof("user '%s' already exists, leaving untouched", name)
+			return nil
+		}
+
+		err = c.setPassword(ctx, name, body)
+		if err != nil {
+			return err
+		}
+		zap.S().Infof("user '%s' already exists, rotated password", name)
 		return nil
 	}
+	if !util.IsStatus(err, 404) {
+		return fmt.Errorf("failed to check if user '%s' exists: %w", name, err)
+	}
 
-	res, err = c.Security.PutUser(name, body)
+	res, err = c.Security.PutUser(name, body, c.Security.PutUser.WithContext(ctx))
 	if err != nil {
 		return fmt.Errorf("failed to create user '%s': %s", name, err)
 	}
 
+	err = c.CloseAndCheck(res)
+	if err != nil {
+		return err
+	}
+	zap.S().Infof("created user '%s'", name)
+	return nil
+}
+
+// setPassword sets the password of an existing user to the password in a user
+// definition.
+func (c *Client) setPassword(ctx context.Context, name string, body io.Reader) error {
+	// The password API only accepts the password, not the whole user definition
+	user := struct {
+		Password string `json:"password"`
+	}{}
+	err := json.NewDecoder(body).Decode(&user)
+	if err != nil {
+		return fmt.Errorf("failed to decode definition of user '%s': %s", name, err)
+	}
+	if user.Password == "" {
+		return fmt.Errorf("definition of user '%s' does not include a password", name)
+	}
+	password, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("failed to encode password for user '%s': %s", name, err)
+	}
+
+	res, err := c.Security.ChangePassword(bytes.NewReader(password), c.Security.ChangePassword.WithUsername(name), c.Security.ChangePassword.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to change password of user '%s': %s", name, err)
+	}
+
+	return c.CloseAndCheck(res)
+}
+
+// CreateAPIKey creates a new API key with the same privileges as the user the
+// client is authenticated as. The returned key is the base64-encoded id:key
+// pair that is used in ApiKey authorization headers.
+func (c *Client) CreateAPIKey(ctx context.Context, name string) (string, error) {
+	body, err := json.Marshal(map[string]string{"name": name})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode API key request: %s", err)
+	}
+
+	res, err := c.Security.CreateAPIKey(bytes.NewReader(body), c.Security.CreateAPIKey.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("failed to create API key '%s': %s", name, err)
+	}
+	if res.IsError() {
+		return "", c.CloseAndCheck(res)
+	}
+	defer res.Body.Close()
+
+	key := struct {
+		ID     string `json:"id"`
+		APIKey string `json:"api_key"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&key)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode API key response: %s", err)
+	}
+
+	zap.S().Infof("created API key '%s' with id %s", name, key.ID)
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", key.ID, key.APIKey))), nil
+}
+
+// RemoveIndex deletes an index. Indices that don't exist are ignored.
+func (c *Client) RemoveIndex(ctx context.Context, name string) error {
+	zap.S().Infof("removing index: %s", name)
+	res, err := c.Indices.Delete([]string{name}, c.Indices.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to remove index '%s': %s", name, err)
+	}
+
+	return c.CloseAndCheck(res, 404)
+}
+
+// RemoveUser deletes a user. Users that don't exist are ignored.
+func (c *Client) RemoveUser(ctx context.Context, name string) error {
+	zap.S().Infof("removing user: %s", name)
+	res, err := c.Security.DeleteUser(name, c.Security.DeleteUser.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to remove user '%s': %s", name, err)
+	}
+
+	return c.CloseAndCheck(res, 404)
+}
+
+// ListIndices returns the names of the indices that match any of the given
+// index patterns.
+func (c *Client) ListIndices(ctx context.Context, patterns ...string) ([]string, error) {
+	res, err := c.Cat.Indices(
+		c.Cat.Indices.WithIndex(patterns...),
+		c.Cat.Indices.WithH("index"),
+		c.Cat.Indices.WithFormat("json"),
+		c.Cat.Indices.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indices: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("failed to list indices: %w", c.CloseAndCheck(res))
+	}
+
+	var indices []struct {
+		Index string `json:"index"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&indices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode index list: %s", err)
+	}
+
+	names := make([]string, 0, len(indices))
+	for _, i := range indices {
+		names = append(names, i.Index)
+	}
+	return names, nil
+}
+
+// FetchVersion gets the version of the Elasticsearch cluster, and stores it in
+// the client's Version field.
+func (c *Client) FetchVersion(ctx context.Context) (util.Version, error) {
+	res, err := c.Info(c.Info.WithContext(ctx))
+	if err != nil {
+		return util.Version{}, fmt.Errorf("failed to get Elasticsearch version: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return util.Version{}, fmt.Errorf("failed to get Elasticsearch version: %w", c.CloseAndCheck(res))
+	}
+
+	info := struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&info)
+	if err != nil {
+		return util.Version{}, fmt.Errorf("failed to decode Elasticsearch info: %s", err)
+	}
+	version, err := util.ParseVersion(info.Version.Number)
+	if err != nil {
+		return util.Version{}, fmt.Errorf("failed to get Elasticsearch version: %s", err)
+	}
+
+	c.Version = version
+	return version, nil
+}
+
+// AddILMPolicy creates an index lifecycle management policy, or updates it if
+// it already exists.
+func (c *Client) AddILMPolicy(ctx context.Context, name string, data io.Reader) error {
+	zap.S().Infof("adding ILM policy: %s", name)
+	res, err := c.ILM.PutLifecycle(name, c.ILM.PutLifecycle.WithBody(data), c.ILM.PutLifecycle.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to add ILM policy '%s': %s", name, err)
+	}
+
 	return c.CloseAndCheck(res)
 }
+
+// A Document is a document that was found in an index.
+type Document struct {
+	Index  string          `json:"_index"`
+	ID     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+}
+
+// scrollSize is how many documents GetAllDocuments fetches per request, and
+// scrollKeepAlive is how long Elasticsearch keeps the search context between
+// requests.
+const (
+	scrollSize      = 1000
+	scrollKeepAlive = time.Minute
+)
+
+// GetAllDocuments returns all of the documents in the indices that match the
+// given index pattern. The documents are fetched a page at a time with a
+// scroll, since a single search can't return more than 10,000 documents.
+func (c *Client) GetAllDocuments(ctx context.Context, pattern string) ([]Document, error) {
+	res, err := c.Search(
+		c.Search.WithIndex(pattern),
+		c.Search.WithSize(scrollSize),
+		c.Search.WithSort("_doc"),
+		c.Search.WithScroll(scrollKeepAlive),
+		c.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for documents in '%s': %s", pattern, err)
+	}
+
+	var all []Document
+	var scrollID string
+	defer func() {
+		if scrollID != "" {
+			c.clearScroll(scrollID)
+		}
+	}()
+	for {
+		page, err := c.decodePage(res, pattern)
+		if err != nil {
+			return nil, err
+		}
+		scrollID = page.ScrollID
+		all = append(all, page.Hits.Hits...)
+		if len(page.Hits.Hits) < scrollSize || scrollID == "" {
+			return all, nil
+		}
+
+		res, err = c.Scroll(c.Scroll.WithScrollID(scrollID), c.Scroll.WithScroll(scrollKeepAlive), c.Scroll.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to scroll through documents in '%s': %s", pattern, err)
+		}
+	}
+}
+
+// A searchPage is a single page of search results.
+type searchPage struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []Document `json:"hits"`
+	} `json:"hits"`
+}
+
+func (c *Client) decodePage(res *esapi.Response, pattern string) (searchPage, error) {
+	var page searchPage
+	defer res.Body.Close()
+	if res.IsError() {
+		return page, fmt.Errorf("failed to search for documents in '%s': %w", pattern, c.CloseAndCheck(res))
+	}
+	err := json.NewDecoder(res.Body).Decode(&page)
+	if err != nil {
+		return page, fmt.Errorf("failed to decode documents in '%s': %s", pattern, err)
+	}
+	return page, nil
+}
+
+// clearScroll frees the search context of a scroll once all of its documents
+// have been fetched, instead of waiting for it to expire.
+func (c *Client) clearScroll(id string) {
+	res, err := c.ClearScroll(c.ClearScroll.WithScrollID(id))
+	if err == nil {
+		err = c.CloseAndCheck(res, 404)
+	}
+	if err != nil {
+		zap.S().Debugf("failed to clear scroll: %s", err)
+	}
+}
+
+// GetUser gets the definition of a user, without their password. If the user
+// doesn't exist, a nil definition is returned.
+func (c *Client) GetUser(ctx context.Context, name string) (json.RawMessage, error) {
+	res, err := c.Security.GetUser(c.Security.GetUser.WithUsername(name), c.Security.GetUser.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user '%s': %s", name, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("failed to get user '%s': %w", name, c.CloseAndCheck(res))
+	}
+
+	users := make(map[string]json.RawMessage)
+	err = json.NewDecoder(res.Body).Decode(&users)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode user '%s': %s", name, err)
+	}
+	return users[name], nil
+}
+
+// CountDocuments returns the number of documents in the indices that match the
+// given index pattern.
+func (c *Client) CountDocuments(ctx context.Context, pattern string) (int, error) {
+	res, err := c.Count(c.Count.WithIndex(pattern), c.Count.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count documents in '%s': %s", pattern, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return 0, fmt.Errorf("failed to count documents in '%s': %w", pattern, c.CloseAndCheck(res))
+	}
+
+	count := struct {
+		Count int `json:"count"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode document count for '%s': %s", pattern, err)
+	}
+	return count.Count, nil
+}
+
+// ClusterHealth returns the current health status of the Elasticsearch
+// cluster, without waiting for it to change.
+func (c *Client) ClusterHealth(ctx context.Context) (string, error) {
+	res, err := c.Cluster.Health(c.Cluster.Health.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("failed to get cluster health: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", fmt.Errorf("failed to get cluster health: %w", c.CloseAndCheck(res))
+	}
+
+	health := struct {
+		Status string `json:"status"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&health)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode cluster health: %s", err)
+	}
+	return health.Status, nil
+}
+
+// LatestTimestamp returns the @timestamp of the newest document in the indices
+// that match the given index pattern. If there are no documents, an empty
+// timestamp is returned.
+func (c *Client) LatestTimestamp(ctx context.Context, pattern string) (string, error) {
+	res, err := c.Search(
+		c.Search.WithIndex(pattern),
+		c.Search.WithSize(1),
+		c.Search.WithSort("@timestamp:desc"),
+		c.Search.WithSource("@timestamp"),
+		c.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to search for the latest document in '%s': %s", pattern, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", fmt.Errorf("failed to search for the latest document in '%s': %w", pattern, c.CloseAndCheck(res))
+	}
+
+	docs := struct {
+		Hits struct {
+			Hits []struct {
+				Source struct {
+					Timestamp string `json:"@timestamp"`
+				} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&docs)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode the latest document in '%s': %s", pattern, err)
+	}
+	if len(docs.Hits.Hits) == 0 {
+		return "", nil
+	}
+	return docs.Hits.Hits[0].Source.Timestamp, nil
+}
@@ -0,0 +1,453 @@
+package esclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scrollServer is a fake Elasticsearch cluster with a single index, which
+// serves its documents with scrolls. Like Elasticsearch, it rejects searches
+// for more than 10,000 documents at once.
+type scrollServer struct {
+	index string
+	docs  int
+
+	mu       sync.Mutex
+	scrolls  map[string]int // the offset of the next page of each open scroll
+	size     int
+	requests int
+	cleared  []string
+}
+
+func (s *scrollServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	var scrollID string
+	var offset int
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/"+s.index+"/_search":
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		if size > 10000 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":{"type":"illegal_argument_exception","reason":"Result window is too large, from + size must be less than or equal to: [10000] but was [%d]."}}`, size)
+			return
+		}
+		if r.URL.Query().Get("scroll") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.size = size
+		scrollID = fmt.Sprintf("scroll-%d", len(s.scrolls))
+	case r.Method == "GET" && r.URL.Path == "/_search/scroll":
+		scrollID = r.URL.Query().Get("scroll_id")
+		var ok bool
+		offset, ok = s.scrolls[scrollID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/_search/scroll/"):
+		id := strings.TrimPrefix(r.URL.Path, "/_search/scroll/")
+		delete(s.scrolls, id)
+		s.cleared = append(s.cleared, id)
+		fmt.Fprint(w, `{"succeeded":true}`)
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var hits []Document
+	for i := offset; i < s.docs && i < offset+s.size; i++ {
+		hits = append(hits, Document{Index: s.index, ID: strconv.Itoa(i), Source: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i))})
+	}
+	s.scrolls[scrollID] = offset + len(hits)
+	page := searchPage{ScrollID: scrollID}
+	page.Hits.Hits = hits
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+func TestGetAllDocuments(t *testing.T) {
+	tests := []struct {
+		docs     int
+		requests int // the searches and scrolls, not counting clearing the scroll
+	}{
+		{docs: 0, requests: 1},
+		{docs: 1, requests: 1},
+		{docs: scrollSize, requests: 2},
+		{docs: 10050, requests: 11},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.docs), func(t *testing.T) {
+			s := &scrollServer{index: "checks", docs: tt.docs, scrolls: make(map[string]int)}
+			c := newTestClient(t, s)
+
+			docs, err := c.GetAllDocuments(context.Background(), "checks")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) != tt.docs {
+				t.Fatalf("got %d documents, want %d", len(docs), tt.docs)
+			}
+			for i, doc := range docs {
+				if doc.ID != strconv.Itoa(i) {
+					t.Fatalf("document %d has ID %s", i, doc.ID)
+				}
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.requests != tt.requests+1 {
+				t.Errorf("got %d requests, want %d", s.requests, tt.requests+1)
+			}
+			if len(s.scrolls) != 0 || len(s.cleared) != 1 {
+				t.Errorf("scroll wasn't cleared: open %v, cleared %v", s.scrolls, s.cleared)
+			}
+		})
+	}
+}
+
+func TestGetAllDocumentsError(t *testing.T) {
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"type":"index_not_found_exception"}}`)
+	}))
+
+	_, err := c.GetAllDocuments(context.Background(), "checks")
+	if err == nil || !strings.Contains(err.Error(), "index_not_found_exception") {
+		t.Errorf("got error %v, want the response body in it", err)
+	}
+}
+
+// healthServer is a fake Elasticsearch cluster that responds to health
+// requests with each of its responses in turn, repeating the last one.
+type healthServer struct {
+	responses []string // a cluster status, or an HTTP status code for an error
+	mu        sync.Mutex
+	requests  int
+}
+
+func (s *healthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	i := s.requests
+	if i >= len(s.responses) {
+		i = len(s.responses) - 1
+	}
+	s.requests++
+	s.mu.Unlock()
+
+	if r.URL.Path != "/_cluster/health" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if code, err := strconv.Atoi(s.responses[i]); err == nil {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"status":%d}`, code)
+		return
+	}
+	fmt.Fprintf(w, `{"cluster_name":"scorestack","status":"%s"}`, s.responses[i])
+}
+
+func repeat(s string, n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = s
+	}
+	return out
+}
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name        string
+		responses   []string
+		minimum     string
+		maxAttempts int
+		requests    int    // how many health requests Wait makes
+		err         string // part of the error, if Wait fails
+	}{
+		{name: "green", responses: []string{"green"}, requests: 1},
+		{name: "green by default", responses: []string{"red", "yellow", "green"}, requests: 3},
+		{name: "yellow is good enough", responses: []string{"red", "yellow", "green"}, minimum: "yellow", requests: 2},
+		{name: "green is better than yellow", responses: []string{"red", "green"}, minimum: "yellow", requests: 2},
+		{name: "red is good enough", responses: []string{"red"}, minimum: "red", requests: 1},
+		{name: "unknown status", responses: []string{"purple", "green"}, minimum: "red", requests: 2},
+		{name: "invalid minimum", responses: []string{"green"}, minimum: "blue", err: "invalid minimum cluster status 'blue'"},
+		{name: "unavailable", responses: []string{"503", "502", "green"}, requests: 3},
+		{
+			name:        "attempts limit",
+			responses:   []string{"red", "yellow"},
+			maxAttempts: 3,
+			requests:    3,
+			err:         "did not become ready after 3 attempts (last status: yellow",
+		},
+		{
+			name:        "attempts limit with errors",
+			responses:   []string{"yellow", "503"},
+			maxAttempts: 2,
+			requests:    2,
+			err:         "last status: yellow, last error: ",
+		},
+		{
+			// The zero value waits for as long as it takes
+			name:      "no attempts limit",
+			responses: append(repeat("red", 50), "green"),
+			requests:  51,
+		},
+		{name: "rejected credentials", responses: []string{"401"}, requests: 1, err: "rejected the setup credentials"},
+		{name: "forbidden", responses: []string{"503", "403"}, requests: 2, err: "rejected the setup credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &healthServer{responses: tt.responses}
+			c := newTestClient(t, s)
+			c.MinimumClusterStatus = tt.minimum
+			c.MaxAttempts = tt.maxAttempts
+			c.PollInterval = time.Millisecond
+
+			err := c.Wait(context.Background())
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+			if s.requests != tt.requests {
+				t.Errorf("got %d health requests, want %d", s.requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	c := newTestClient(t, &healthServer{responses: []string{"red"}})
+	c.PollInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.Wait(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// indexServer is a fake Elasticsearch cluster that records the requests for
+// an index.
+type indexServer struct {
+	exists   bool
+	mapping  func(w http.ResponseWriter) // responds to mapping updates
+	mu       sync.Mutex
+	requests []string // the method, path, and body of each request
+}
+
+func (s *indexServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	s.requests = append(s.requests, strings.TrimSpace(fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, body)))
+	s.mu.Unlock()
+
+	switch {
+	case r.Method == "HEAD" && r.URL.Path == "/results-admin":
+		if !s.exists {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == "PUT" && r.URL.Path == "/results-admin":
+		fmt.Fprint(w, `{"acknowledged":true,"index":"results-admin"}`)
+	case r.Method == "PUT" && r.URL.Path == "/results-admin/_mapping":
+		if s.mapping != nil {
+			s.mapping(w)
+			return
+		}
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// indexDefinition returns an index definition, and counts how many times it
+// is read.
+func indexDefinition(calls *int) func() io.Reader {
+	return func() io.Reader {
+		*calls++
+		return strings.NewReader(`{"settings":{"number_of_shards":1},"mappings":{"properties":{"passed":{"type":"boolean"}}}}`)
+	}
+}
+
+func TestAddIndexExistenceCheck(t *testing.T) {
+	for _, exists := range []bool{false, true} {
+		t.Run(fmt.Sprintf("exists %t", exists), func(t *testing.T) {
+			s := &indexServer{exists: exists}
+			c := newTestClient(t, s)
+			calls := 0
+
+			err := c.AddIndex(context.Background(), "results-admin", indexDefinition(&calls))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The existence check is a HEAD without a body, and the
+			// definition is only read if the index is created
+			if s.requests[0] != "HEAD /results-admin" {
+				t.Errorf("got existence check %s, want HEAD /results-admin without a body", s.requests[0])
+			}
+			want := 1
+			if exists {
+				want = 0
+			}
+			if calls != want {
+				t.Errorf("index definition was read %d times, want %d", calls, want)
+			}
+		})
+	}
+}
+
+func TestAddIndex(t *testing.T) {
+	const definition = `{"settings":{"number_of_shards":1},"mappings":{"properties":{"passed":{"type":"boolean"}}}}`
+	tests := []struct {
+		name     string
+		exists   bool
+		update   bool
+		def      string
+		mapping  func(w http.ResponseWriter)
+		requests []string // the requests after the existence check
+		err      string
+	}{
+		{
+			name:     "create",
+			def:      definition,
+			requests: []string{"PUT /results-admin " + definition},
+		},
+		{
+			name:     "create even when updating",
+			update:   true,
+			def:      definition,
+			requests: []string{"PUT /results-admin " + definition},
+		},
+		{
+			name:   "skip existing",
+			exists: true,
+			def:    definition,
+		},
+		{
+			name:     "update existing",
+			exists:   true,
+			update:   true,
+			def:      definition,
+			requests: []string{`PUT /results-admin/_mapping {"properties":{"passed":{"type":"boolean"}}}`},
+		},
+		{
+			name:   "update existing without mappings",
+			exists: true,
+			update: true,
+			def:    `{"settings":{"number_of_shards":1}}`,
+		},
+		{
+			name:   "unchanged mappings",
+			exists: true,
+			update: true,
+			def:    definition,
+			mapping: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":{"type":"illegal_argument_exception","reason":"mapper [passed] of same name already exists"}}`)
+			},
+			requests: []string{`PUT /results-admin/_mapping {"properties":{"passed":{"type":"boolean"}}}`},
+		},
+		{
+			name:   "unchanged mappings without a field name",
+			exists: true,
+			update: true,
+			def:    definition,
+			mapping: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":{"type":"illegal_argument_exception","reason":"mapper of same name already exists"}}`)
+			},
+			requests: []string{`PUT /results-admin/_mapping {"properties":{"passed":{"type":"boolean"}}}`},
+		},
+		{
+			name:   "conflicting mappings",
+			exists: true,
+			update: true,
+			def:    definition,
+			mapping: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":{"type":"illegal_argument_exception","reason":"mapper [passed] cannot be changed from type [keyword] to [boolean]"}}`)
+			},
+			requests: []string{`PUT /results-admin/_mapping {"properties":{"passed":{"type":"boolean"}}}`},
+			err:      "mappings conflict with the existing mappings for index 'results-admin' (illegal_argument_exception: mapper [passed] cannot be changed from type [keyword] to [boolean]): response code was 400",
+		},
+		{
+			name:   "mapping update failure",
+			exists: true,
+			update: true,
+			def:    definition,
+			mapping: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"error":{"type":"security_exception"}}`)
+			},
+			requests: []string{`PUT /results-admin/_mapping {"properties":{"passed":{"type":"boolean"}}}`},
+			err:      "security_exception",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &indexServer{exists: tt.exists, mapping: tt.mapping}
+			c := newTestClient(t, s)
+			c.UpdateMappings = tt.update
+
+			err := c.AddIndex(context.Background(), "results-admin", func() io.Reader {
+				return strings.NewReader(tt.def)
+			})
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+
+			got := s.requests[1:]
+			if strings.Join(got, "\n") != strings.Join(tt.requests, "\n") {
+				t.Errorf("got requests %q, want %q", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestAddOrUpdateIndex(t *testing.T) {
+	s := &indexServer{exists: true}
+	c := newTestClient(t, s)
+
+	// AddOrUpdateIndex updates the mappings even if UpdateMappings isn't set
+	err := c.AddOrUpdateIndex(context.Background(), "results-admin", func() io.Reader {
+		return strings.NewReader(`{"mappings":{"properties":{"score":{"type":"long"}}}}`)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"HEAD /results-admin", `PUT /results-admin/_mapping {"properties":{"score":{"type":"long"}}}`}
+	if strings.Join(s.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests %q, want %q", s.requests, want)
+	}
+}
+
+func TestAddIndexExistenceError(t *testing.T) {
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	err := c.AddIndex(context.Background(), "results-admin", func() io.Reader {
+		t.Error("index definition was read")
+		return strings.NewReader("{}")
+	})
+	if err == nil || !strings.Contains(err.Error(), "failed to check if index 'results-admin' exists") {
+		t.Errorf("got error %v, want the existence check to fail", err)
+	}
+}
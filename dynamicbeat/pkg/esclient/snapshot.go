@@ -0,0 +1,47 @@
+package esclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+)
+
+// AddSnapshotRepository registers a snapshot repository, or updates it if it
+// already exists. Once the repository is registered, it is verified to make
+// sure that every node in the cluster can write to it.
+func (c *Client) AddSnapshotRepository(ctx context.Context, name string, data io.Reader) error {
+	zap.S().Infof("adding snapshot repository: %s", name)
+	res, err := c.Snapshot.CreateRepository(name, data, c.Snapshot.CreateRepository.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to add snapshot repository '%s': %s", name, err)
+	}
+	err = c.CloseAndCheck(res)
+	if err != nil {
+		return fmt.Errorf("failed to add snapshot repository '%s': %w", name, err)
+	}
+
+	res, err = c.Snapshot.VerifyRepository(name, c.Snapshot.VerifyRepository.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to verify snapshot repository '%s': %s", name, err)
+	}
+	err = c.CloseAndCheck(res)
+	if err != nil {
+		return fmt.Errorf("snapshot repository '%s' was added, but failed verification - make sure every node can write to it: %w", name, err)
+	}
+
+	return nil
+}
+
+// AddSLMPolicy creates a snapshot lifecycle management policy, or updates it if
+// it already exists.
+func (c *Client) AddSLMPolicy(ctx context.Context, name string, data io.Reader) error {
+	zap.S().Infof("adding SLM policy: %s", name)
+	res, err := c.SlmPutLifecycle(name, c.SlmPutLifecycle.WithBody(data), c.SlmPutLifecycle.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to add SLM policy '%s': %s", name, err)
+	}
+
+	return c.CloseAndCheck(res)
+}
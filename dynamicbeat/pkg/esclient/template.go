@@ -0,0 +1,131 @@
+package esclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// composableTemplatesVersion is the first version of Elasticsearch that
+// supports composable index templates.
+var composableTemplatesVersion = util.Version{Major: 7, Minor: 8}
+
+// AddIndexTemplate creates a composable index template using the template
+// definition returned by data, or overwrites it if it already exists. On
+// clusters that are older than 7.8, the template is converted to and installed
+// as a legacy index template instead, using the template's priority as its
+// order.
+func (c *Client) AddIndexTemplate(ctx context.Context, name string, data func() io.Reader) error {
+	legacy, err := c.useLegacyTemplates(ctx)
+	if err != nil {
+		return err
+	}
+
+	zap.S().Infof("adding index template: %s", name)
+	if !legacy {
+		res, err := c.Indices.PutIndexTemplate(name, data(), c.Indices.PutIndexTemplate.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to add index template '%s': %s", name, err)
+		}
+
+		return c.CloseAndCheck(res)
+	}
+
+	body, err := toLegacyTemplate(data())
+	if err != nil {
+		return fmt.Errorf("failed to convert index template '%s': %s", name, err)
+	}
+	res, err := c.Indices.PutTemplate(name, body, c.Indices.PutTemplate.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to add legacy index template '%s': %s", name, err)
+	}
+
+	return c.CloseAndCheck(res)
+}
+
+// RemoveIndexTemplate deletes a composable index template, as well as any
+// legacy index template of the same name. Templates that don't exist are
+// ignored.
+func (c *Client) RemoveIndexTemplate(ctx context.Context, name string) error {
+	legacy, err := c.useLegacyTemplates(ctx)
+	if err != nil {
+		return err
+	}
+
+	zap.S().Infof("removing index template: %s", name)
+	if !legacy {
+		res, err := c.Indices.DeleteIndexTemplate(name, c.Indices.DeleteIndexTemplate.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to remove index template '%s': %s", name, err)
+		}
+		err = c.CloseAndCheck(res, 404)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := c.Indices.DeleteTemplate(name, c.Indices.DeleteTemplate.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to remove legacy index template '%s': %s", name, err)
+	}
+
+	return c.CloseAndCheck(res, 404)
+}
+
+// useLegacyTemplates checks if the cluster is too old to support composable
+// index templates.
+func (c *Client) useLegacyTemplates(ctx context.Context) (bool, error) {
+	version := c.Version
+	if version.IsZero() {
+		var err error
+		version, err = c.FetchVersion(ctx)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return version.Less(composableTemplatesVersion), nil
+}
+
+// toLegacyTemplate converts a composable index template into a legacy index
+// template.
+func toLegacyTemplate(data io.Reader) (io.Reader, error) {
+	composable := struct {
+		IndexPatterns []string `json:"index_patterns"`
+		Priority      int      `json:"priority"`
+		Template      struct {
+			Settings json.RawMessage `json:"settings,omitempty"`
+			Mappings json.RawMessage `json:"mappings,omitempty"`
+			Aliases  json.RawMessage `json:"aliases,omitempty"`
+		} `json:"template"`
+	}{}
+	err := json.NewDecoder(data).Decode(&composable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode index template: %s", err)
+	}
+
+	legacy := struct {
+		IndexPatterns []string        `json:"index_patterns"`
+		Order         int             `json:"order"`
+		Settings      json.RawMessage `json:"settings,omitempty"`
+		Mappings      json.RawMessage `json:"mappings,omitempty"`
+		Aliases       json.RawMessage `json:"aliases,omitempty"`
+	}{
+		IndexPatterns: composable.IndexPatterns,
+		Order:         composable.Priority,
+		Settings:      composable.Template.Settings,
+		Mappings:      composable.Template.Mappings,
+		Aliases:       composable.Template.Aliases,
+	}
+	body, err := json.Marshal(legacy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode legacy index template: %s", err)
+	}
+
+	return bytes.NewReader(body), nil
+}
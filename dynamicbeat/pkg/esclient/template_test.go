@@ -0,0 +1,126 @@
+package esclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+const composableTemplate = `{"index_patterns":["results-*"],"priority":100,"template":{"settings":{"number_of_shards":1},"mappings":{"properties":{"passed":{"type":"boolean"}}}}}`
+
+func TestAddIndexTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string // the version that the cluster reports
+		known   util.Version
+		want    []string
+	}{
+		{
+			name:    "composable",
+			version: "7.9.2",
+			want:    []string{"GET /", "PUT /_index_template/results " + composableTemplate},
+		},
+		{
+			name:    "composable on the first version that supports it",
+			version: "7.8.0",
+			want:    []string{"GET /", "PUT /_index_template/results " + composableTemplate},
+		},
+		{
+			name:    "legacy",
+			version: "7.7.1",
+			want: []string{
+				"GET /",
+				`PUT /_template/results {"index_patterns":["results-*"],"order":100,"settings":{"number_of_shards":1},"mappings":{"properties":{"passed":{"type":"boolean"}}}}`,
+			},
+		},
+		{
+			name:  "known version",
+			known: util.Version{Major: 8, Minor: 1},
+			want:  []string{"PUT /_index_template/results " + composableTemplate},
+		},
+		{
+			name:  "known legacy version",
+			known: util.Version{Major: 6, Minor: 8},
+			want: []string{
+				`PUT /_template/results {"index_patterns":["results-*"],"order":100,"settings":{"number_of_shards":1},"mappings":{"properties":{"passed":{"type":"boolean"}}}}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{respond: versionHandler(tt.version)}
+			c := newTestClient(t, rec)
+			c.Version = tt.known
+
+			err := c.AddIndexTemplate(context.Background(), "results", func() io.Reader {
+				return strings.NewReader(composableTemplate)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rec.recorded(); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got requests %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddIndexTemplateInvalid(t *testing.T) {
+	c := newTestClient(t, &recorder{})
+	c.Version = util.Version{Major: 7, Minor: 4}
+	err := c.AddIndexTemplate(context.Background(), "results", func() io.Reader {
+		return strings.NewReader(`{"index_patterns":`)
+	})
+	if err == nil || !strings.Contains(err.Error(), "failed to convert index template 'results'") {
+		t.Errorf("got error %v, want a conversion error", err)
+	}
+}
+
+func TestRemoveIndexTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		version util.Version
+		code    int
+		want    []string
+	}{
+		{
+			name:    "composable",
+			version: util.Version{Major: 7, Minor: 9},
+			code:    200,
+			want:    []string{"DELETE /_index_template/results", "DELETE /_template/results"},
+		},
+		{
+			name:    "legacy",
+			version: util.Version{Major: 7, Minor: 7},
+			code:    200,
+			want:    []string{"DELETE /_template/results"},
+		},
+		{
+			name:    "missing",
+			version: util.Version{Major: 7, Minor: 9},
+			code:    404,
+			want:    []string{"DELETE /_index_template/results", "DELETE /_template/results"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{respond: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+			}}
+			c := newTestClient(t, rec)
+			c.Version = tt.version
+
+			err := c.RemoveIndexTemplate(context.Background(), "results")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rec.recorded(); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got requests %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package esclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// AddTransform creates a continuous transform and starts it. If the transform
+// already exists, its definition is left untouched, but it is started again if
+// it has stopped. A transform that has failed is force-stopped and restarted.
+func (c *Client) AddTransform(ctx context.Context, name string, data io.Reader) error {
+	state, err := c.transformState(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	switch state {
+	case "":
+		zap.S().Infof("adding transform: %s", name)
+		res, err := c.TransformPutTransform(data, name, c.TransformPutTransform.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to add transform '%s': %s", name, err)
+		}
+		err = c.CloseAndCheck(res)
+		if err != nil {
+			return fmt.Errorf("failed to add transform '%s': %w", name, err)
+		}
+	case "started", "indexing":
+		zap.S().Debugf("transform '%s' is already running, skipping", name)
+		return nil
+	case "stopped":
+		zap.S().Infof("transform '%s' is stopped, starting it again", name)
+	case "stopping":
+		// The transform can't be started until it has finished stopping
+		zap.S().Infof("waiting for transform '%s' to stop before starting it again", name)
+		err = util.Poll(ctx, c.PollInterval, func() (bool, error) {
+			state, err := c.transformState(ctx, name)
+			return state != "stopping", err
+		})
+		if err != nil {
+			return err
+		}
+	case "failed":
+		zap.S().Warnf("transform '%s' has failed, restarting it", name)
+		err = c.stopTransform(ctx, name, true)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("transform '%s' is in unknown state '%s'", name, state)
+	}
+
+	res, err := c.TransformStartTransform(name, c.TransformStartTransform.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to start transform '%s': %s", name, err)
+	}
+	err = c.CloseAndCheck(res)
+	if err != nil {
+		return fmt.Errorf("failed to start transform '%s': %w", name, err)
+	}
+	return nil
+}
+
+// RemoveTransform stops and deletes a transform. Transforms that don't exist
+// are ignored.
+func (c *Client) RemoveTransform(ctx context.Context, name string) error {
+	state, err := c.transformState(ctx, name)
+	if err != nil || state == "" {
+		return err
+	}
+
+	zap.S().Infof("removing transform: %s", name)
+	if state != "stopped" {
+		err = c.stopTransform(ctx, name, state == "failed")
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := c.TransformDeleteTransform(name, c.TransformDeleteTransform.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to remove transform '%s': %s", name, err)
+	}
+	return c.CloseAndCheck(res, 404)
+}
+
+// stopTransform stops a transform and waits for it to finish stopping. Failed
+// transforms can only be stopped with force.
+func (c *Client) stopTransform(ctx context.Context, name string, force bool) error {
+	res, err := c.TransformStopTransform(name,
+		c.TransformStopTransform.WithForce(force),
+		c.TransformStopTransform.WithWaitForCompletion(true),
+		c.TransformStopTransform.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to stop transform '%s': %s", name, err)
+	}
+	err = c.CloseAndCheck(res)
+	if err != nil {
+		return fmt.Errorf("failed to stop transform '%s': %w", name, err)
+	}
+	return nil
+}
+
+// transformState returns the state of a transform, like started or stopped, or
+// an empty state if the transform doesn't exist.
+func (c *Client) transformState(ctx context.Context, name string) (string, error) {
+	res, err := c.TransformGetTransformStats(name, c.TransformGetTransformStats.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("failed to get state of transform '%s': %s", name, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return "", nil
+	}
+	if res.IsError() {
+		return "", fmt.Errorf("failed to get state of transform '%s': %w", name, c.CloseAndCheck(res))
+	}
+
+	stats := struct {
+		Transforms []struct {
+			ID    string `json:"id"`
+			State string `json:"state"`
+		} `json:"transforms"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&stats)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode state of transform '%s': %s", name, err)
+	}
+	for _, t := range stats.Transforms {
+		if t.ID == name {
+			return t.State, nil
+		}
+	}
+	return "", nil
+}
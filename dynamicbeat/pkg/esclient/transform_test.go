@@ -0,0 +1,158 @@
+package esclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// transformServer is a fake Elasticsearch cluster with one transform, which
+// reports each of its states in turn, repeating the last one. An empty state
+// means that the transform doesn't exist. Every request is recorded, except for
+// the stats requests.
+type transformServer struct {
+	states   []string
+	fail     string // the request that fails, if any
+	mu       sync.Mutex
+	stats    int
+	requests []string
+}
+
+func (s *transformServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.HasSuffix(r.URL.Path, "/_stats") {
+		state := s.states[len(s.states)-1]
+		if s.stats < len(s.states) {
+			state = s.states[s.stats]
+		}
+		s.stats++
+		if state == "" {
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"error":{"type":"resource_not_found_exception"}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"count":1,"transforms":[{"id":"scores","state":"%s"}]}`, state)
+		return
+	}
+
+	request := r.Method + " " + r.URL.RequestURI()
+	s.requests = append(s.requests, request)
+	if request == s.fail {
+		w.WriteHeader(409)
+		fmt.Fprint(w, `{"error":{"type":"status_exception"}}`)
+		return
+	}
+	fmt.Fprint(w, `{"acknowledged":true}`)
+}
+
+func TestAddTransform(t *testing.T) {
+	const (
+		put       = "PUT /_transform/scores"
+		start     = "POST /_transform/scores/_start"
+		forceStop = "POST /_transform/scores/_stop?force=true&wait_for_completion=true"
+	)
+	tests := []struct {
+		name     string
+		states   []string
+		fail     string
+		requests []string
+		stats    int // how many times the state is checked
+		err      string
+	}{
+		{name: "new", states: []string{""}, requests: []string{put, start}, stats: 1},
+		{name: "started", states: []string{"started"}, stats: 1},
+		{name: "indexing", states: []string{"indexing"}, stats: 1},
+		{name: "stopped", states: []string{"stopped"}, requests: []string{start}, stats: 1},
+		{name: "stopping", states: []string{"stopping", "stopping", "stopped"}, requests: []string{start}, stats: 3},
+		// The transform is started again if it was deleted while stopping
+		{name: "deleted while stopping", states: []string{"stopping", ""}, requests: []string{start}, stats: 2},
+		{name: "failed", states: []string{"failed"}, requests: []string{forceStop, start}, stats: 1},
+		{name: "unknown state", states: []string{"aborting"}, stats: 1, err: "transform 'scores' is in unknown state 'aborting'"},
+		{name: "create failure", states: []string{""}, fail: put, requests: []string{put}, stats: 1, err: "failed to add transform 'scores'"},
+		{name: "start failure", states: []string{"stopped"}, fail: start, requests: []string{start}, stats: 1, err: "failed to start transform 'scores'"},
+		{name: "stop failure", states: []string{"failed"}, fail: forceStop, requests: []string{forceStop}, stats: 1, err: "failed to stop transform 'scores'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &transformServer{states: tt.states, fail: tt.fail}
+			c := newTestClient(t, s)
+			c.PollInterval = time.Millisecond
+
+			err := c.AddTransform(context.Background(), "scores", strings.NewReader(`{"source":{"index":"results-*"}}`))
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+			if strings.Join(s.requests, "\n") != strings.Join(tt.requests, "\n") {
+				t.Errorf("got requests %q, want %q", s.requests, tt.requests)
+			}
+			if s.stats != tt.stats {
+				t.Errorf("checked the state %d times, want %d", s.stats, tt.stats)
+			}
+		})
+	}
+}
+
+func TestAddTransformCanceledWhileStopping(t *testing.T) {
+	s := &transformServer{states: []string{"stopping"}}
+	c := newTestClient(t, s)
+	c.PollInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := c.AddTransform(ctx, "scores", strings.NewReader(`{}`))
+	if err == nil {
+		t.Fatal("transform was started while it was still stopping")
+	}
+	if len(s.requests) != 0 {
+		t.Errorf("got requests %q, want none", s.requests)
+	}
+}
+
+func TestRemoveTransform(t *testing.T) {
+	const (
+		del       = "DELETE /_transform/scores"
+		stop      = "POST /_transform/scores/_stop?force=false&wait_for_completion=true"
+		forceStop = "POST /_transform/scores/_stop?force=true&wait_for_completion=true"
+	)
+	tests := []struct {
+		name     string
+		state    string
+		fail     string
+		requests []string
+		err      string
+	}{
+		{name: "missing", state: ""},
+		{name: "stopped", state: "stopped", requests: []string{del}},
+		{name: "started", state: "started", requests: []string{stop, del}},
+		{name: "indexing", state: "indexing", requests: []string{stop, del}},
+		{name: "failed", state: "failed", requests: []string{forceStop, del}},
+		{name: "stop failure", state: "started", fail: stop, requests: []string{stop}, err: "failed to stop transform 'scores'"},
+		{name: "delete failure", state: "stopped", fail: del, requests: []string{del}, err: "response code was 409"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &transformServer{states: []string{tt.state}, fail: tt.fail}
+			c := newTestClient(t, s)
+
+			err := c.RemoveTransform(context.Background(), "scores")
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+			if strings.Join(s.requests, "\n") != strings.Join(tt.requests, "\n") {
+				t.Errorf("got requests %q, want %q", s.requests, tt.requests)
+			}
+		})
+	}
+}
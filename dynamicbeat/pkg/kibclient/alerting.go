@@ -0,0 +1,161 @@
+package kibclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// The alerting API was added in Kibana 7.7 under /api/alerts, and moved to
+// /api/alerting in Kibana 7.13 with snake_case field names.
+var (
+	alertingVersion     = util.Version{Major: 7, Minor: 7}
+	alertingRuleVersion = util.Version{Major: 7, Minor: 13}
+)
+
+// ruleFields are the fields of a rule that were renamed when the alerting API
+// moved to /api/alerting, mapped to their names in the older API.
+var ruleFields = map[string]string{
+	"rule_type_id": "alertTypeId",
+	"notify_when":  "notifyWhen",
+}
+
+// immutableRuleFields are the fields of a rule that can only be set when the
+// rule is created.
+var immutableRuleFields = []string{"rule_type_id", "consumer", "enabled"}
+
+// AddAlertRule creates a Kibana alerting rule in the default space, or updates
+// the rule if one with the same name already exists. The rule is defined the
+// same way as for the /api/alerting/rule API, and is converted for the older
+// /api/alerts API on Kibana versions before 7.13. If the definition has no
+// actions, the actions of an existing rule are kept so that connectors
+// attached by operators aren't removed.
+func (c *Client) AddAlertRule(ctx context.Context, name string, data io.Reader) error {
+	version, err := c.version(ctx)
+	if err != nil {
+		return err
+	}
+	if version.Less(alertingVersion) {
+		return fmt.Errorf("failed to add alerting rule '%s': alerting requires Kibana %s or newer", name, alertingVersion)
+	}
+	legacy := version.Less(alertingRuleVersion)
+
+	rule := make(map[string]interface{})
+	err = json.NewDecoder(data).Decode(&rule)
+	if err != nil {
+		return fmt.Errorf("failed to decode alerting rule '%s': %s", name, err)
+	}
+	rule["name"] = name
+
+	existing, err := c.findAlertRule(ctx, name, legacy)
+	if err != nil {
+		return err
+	}
+
+	path := "/api/alerting/rule"
+	if legacy {
+		path = "/api/alerts/alert"
+	}
+	method := "POST"
+	if existing != nil {
+		zap.S().Infof("updating alerting rule: %s", name)
+		method = "PUT"
+		path = fmt.Sprintf("%s/%s", path, existing.ID)
+		for _, field := range immutableRuleFields {
+			delete(rule, field)
+		}
+		if actions, ok := rule["actions"].([]interface{}); !ok || len(actions) == 0 {
+			rule["actions"] = existing.actions()
+		}
+	} else {
+		zap.S().Infof("adding alerting rule: %s", name)
+	}
+
+	if legacy {
+		for field, old := range ruleFields {
+			if value, ok := rule[field]; ok {
+				rule[old] = value
+				delete(rule, field)
+			}
+		}
+	}
+
+	body, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("failed to encode alerting rule '%s': %s", name, err)
+	}
+
+	err = c.CheckedReq(ctx, method, path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to add alerting rule '%s': %w", name, err)
+	}
+	return nil
+}
+
+// An alertRule is an alerting rule that already exists in Kibana.
+type alertRule struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Actions []struct {
+		Group  string                 `json:"group"`
+		ID     string                 `json:"id"`
+		Params map[string]interface{} `json:"params"`
+	} `json:"actions"`
+}
+
+// actions returns the actions of a rule in the form that the update API
+// accepts.
+func (r *alertRule) actions() []interface{} {
+	actions := make([]interface{}, 0, len(r.Actions))
+	for _, a := range r.Actions {
+		actions = append(actions, map[string]interface{}{
+			"group":  a.Group,
+			"id":     a.ID,
+			"params": a.Params,
+		})
+	}
+	return actions
+}
+
+// findAlertRule returns the alerting rule in the default space with the given
+// name, or nil if there isn't one.
+func (c *Client) findAlertRule(ctx context.Context, name string, legacy bool) (*alertRule, error) {
+	query := url.Values{}
+	query.Set("search_fields", "name")
+	query.Set("search", fmt.Sprintf("%q", name))
+	query.Set("per_page", "100")
+	path := "/api/alerting/rules/_find?"
+	if legacy {
+		path = "/api/alerts/_find?"
+	}
+
+	res, err := c.get(ctx, path+query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up alerting rule '%s': %w", name, err)
+	}
+	if res == nil {
+		return nil, nil
+	}
+
+	found := struct {
+		Data []alertRule `json:"data"`
+	}{}
+	err = json.Unmarshal(res, &found)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode alerting rules: %s", err)
+	}
+
+	// The search matches on words, so make sure the name is an exact match
+	for i := range found.Data {
+		if found.Data[i].Name == name {
+			return &found.Data[i], nil
+		}
+	}
+	return nil, nil
+}
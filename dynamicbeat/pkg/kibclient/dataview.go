@@ -0,0 +1,123 @@
+package kibclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// AddDataView creates a data view (called an index pattern before Kibana 8)
+// in a Kibana space, unless a data view with the same title already exists,
+// and returns the ID of the data view.
+// An empty space name adds the data view to the default space. The data views
+// API is used on Kibana 8.1 and newer, the index patterns API is used on 7.11
+// and newer, and the saved objects API is used on older versions.
+func (c *Client) AddDataView(ctx context.Context, space string, title string, timeField string) (string, error) {
+	id, err := c.findDataView(ctx, space, title)
+	if err != nil {
+		return "", err
+	}
+	if id != "" {
+		zap.S().Debugf("data view '%s' already exists as '%s', skipping", title, id)
+		return id, nil
+	}
+
+	version, err := c.version(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	id = DataViewID(title)
+	view := map[string]interface{}{
+		"title":         title,
+		"timeFieldName": timeField,
+	}
+	var path string
+	var payload map[string]interface{}
+	switch {
+	case version.Less(util.Version{Major: 7, Minor: 11}):
+		path = fmt.Sprintf("/api/saved_objects/index-pattern/%s", id)
+		payload = map[string]interface{}{"attributes": view}
+	case version.Less(util.Version{Major: 8, Minor: 1}):
+		view["id"] = id
+		path = "/api/index_patterns/index_pattern"
+		payload = map[string]interface{}{"index_pattern": view}
+	default:
+		view["id"] = id
+		path = "/api/data_views/data_view"
+		payload = map[string]interface{}{"data_view": view}
+	}
+	if space != "" {
+		path = fmt.Sprintf("/s/%s%s", space, path)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode data view '%s': %s", title, err)
+	}
+
+	zap.S().Infof("adding data view: %s", title)
+	err = c.CheckedReq(ctx, "POST", path, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// findDataView returns the ID of the data view with the given title, or an
+// empty ID if there isn't one. The saved objects API is used so that the
+// lookup works on every Kibana version.
+func (c *Client) findDataView(ctx context.Context, space string, title string) (string, error) {
+	query := url.Values{}
+	query.Set("type", "index-pattern")
+	query.Set("search_fields", "title")
+	query.Set("search", fmt.Sprintf("%q", title))
+	query.Set("per_page", "100")
+	path := "/api/saved_objects/_find?" + query.Encode()
+	if space != "" {
+		path = fmt.Sprintf("/s/%s%s", space, path)
+	}
+
+	res, err := c.get(ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up data view '%s': %w", title, err)
+	}
+
+	found := struct {
+		SavedObjects []struct {
+			ID         string `json:"id"`
+			Attributes struct {
+				Title string `json:"title"`
+			} `json:"attributes"`
+		} `json:"saved_objects"`
+	}{}
+	err = json.Unmarshal(res, &found)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode data views: %s", err)
+	}
+
+	// The search matches on words, so make sure the title is an exact match
+	for _, obj := range found.SavedObjects {
+		if obj.Attributes.Title == title {
+			return obj.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// DataViewID returns the ID that AddDataView gives to a new data view with the
+// given title.
+func DataViewID(title string) string {
+	return "scorestack-data-view-" + strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(title)), "-")
+}
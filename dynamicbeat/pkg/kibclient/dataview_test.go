@@ -0,0 +1,192 @@
+package kibclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+func TestAddDataView(t *testing.T) {
+	const find = "GET /api/saved_objects/_find?per_page=100&search=%22results-%2A%22&search_fields=title&type=index-pattern"
+	tests := []struct {
+		name    string
+		version util.Version
+		space   string
+		found   string // the saved objects that the lookup finds
+		id      string // the ID that is returned, if it isn't the new data view's
+		want    []string
+	}{
+		{
+			name:    "saved objects",
+			version: util.Version{Major: 7, Minor: 10, Patch: 2},
+			want: []string{
+				find,
+				`POST /api/saved_objects/index-pattern/scorestack-data-view-results {"attributes":{"timeFieldName":"@timestamp","title":"results-*"}}`,
+			},
+		},
+		{
+			name:    "index patterns",
+			version: util.Version{Major: 7, Minor: 11},
+			want: []string{
+				find,
+				`POST /api/index_patterns/index_pattern {"index_pattern":{"id":"scorestack-data-view-results","timeFieldName":"@timestamp","title":"results-*"}}`,
+			},
+		},
+		{
+			name:    "index patterns on 8.0",
+			version: util.Version{Major: 8},
+			want: []string{
+				find,
+				`POST /api/index_patterns/index_pattern {"index_pattern":{"id":"scorestack-data-view-results","timeFieldName":"@timestamp","title":"results-*"}}`,
+			},
+		},
+		{
+			name:    "data views",
+			version: util.Version{Major: 8, Minor: 1},
+			want: []string{
+				find,
+				`POST /api/data_views/data_view {"data_view":{"id":"scorestack-data-view-results","timeFieldName":"@timestamp","title":"results-*"}}`,
+			},
+		},
+		{
+			name:    "data views in a space",
+			version: util.Version{Major: 8, Minor: 5},
+			space:   "team01",
+			want: []string{
+				"GET /s/team01" + strings.TrimPrefix(find, "GET "),
+				`POST /s/team01/api/data_views/data_view {"data_view":{"id":"scorestack-data-view-results","timeFieldName":"@timestamp","title":"results-*"}}`,
+			},
+		},
+		{
+			name:    "legacy in a space",
+			version: util.Version{Major: 7, Minor: 9, Patch: 2},
+			space:   "team01",
+			want: []string{
+				"GET /s/team01" + strings.TrimPrefix(find, "GET "),
+				`POST /s/team01/api/saved_objects/index-pattern/scorestack-data-view-results {"attributes":{"timeFieldName":"@timestamp","title":"results-*"}}`,
+			},
+		},
+		{
+			name:    "already exists",
+			version: util.Version{Major: 8, Minor: 1},
+			found:   `{"id":"existing","attributes":{"title":"results-*"}}`,
+			id:      "existing",
+			want:    []string{find},
+		},
+		{
+			// The lookup matches on words, so it can find other data views
+			name:    "similar title",
+			version: util.Version{Major: 8, Minor: 1},
+			found:   `{"id":"other","attributes":{"title":"results-admin*"}}`,
+			want: []string{
+				find,
+				`POST /api/data_views/data_view {"data_view":{"id":"scorestack-data-view-results","timeFieldName":"@timestamp","title":"results-*"}}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{respond: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" {
+					fmt.Fprintf(w, `{"saved_objects":[%s]}`, tt.found)
+					return
+				}
+				fmt.Fprint(w, "{}")
+			}}
+			c := newTestClient(t, rec)
+			c.Version = tt.version
+
+			id, err := c.AddDataView(context.Background(), tt.space, "results-*", "@timestamp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantID := tt.id
+			if wantID == "" {
+				wantID = "scorestack-data-view-results"
+			}
+			if id != wantID {
+				t.Errorf("got ID %s, want %s", id, wantID)
+			}
+
+			var got []string
+			for _, r := range rec.recorded() {
+				got = append(got, strings.TrimSpace(r.Method+" "+r.Path+" "+r.Body))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got requests:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestAddDataViewFetchesVersion(t *testing.T) {
+	var paths []string
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/api/status":
+			statusHandler(w, r)
+		case "/api/saved_objects/_find":
+			fmt.Fprint(w, `{"saved_objects":[]}`)
+		default:
+			fmt.Fprint(w, "{}")
+		}
+	}))
+
+	_, err := c.AddDataView(context.Background(), "", "results-*", "@timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "GET /api/saved_objects/_find GET /api/status POST /api/saved_objects/index-pattern/scorestack-data-view-results"
+	if got := strings.Join(paths, " "); got != want {
+		t.Errorf("got requests %s, want %s", got, want)
+	}
+}
+
+func TestAddDataViewErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		find int
+		add  int
+		want string
+	}{
+		{"lookup failure", 500, 200, "failed to look up data view 'results-*'"},
+		{"create failure", 200, 400, "response code was 400"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" {
+					w.WriteHeader(tt.find)
+					fmt.Fprint(w, `{"saved_objects":[]}`)
+					return
+				}
+				w.WriteHeader(tt.add)
+				fmt.Fprint(w, `{"message":"bad request"}`)
+			}))
+			c.Version = util.Version{Major: 8, Minor: 1}
+
+			_, err := c.AddDataView(context.Background(), "", "results-*", "@timestamp")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDataViewID(t *testing.T) {
+	tests := map[string]string{
+		"results-*":          "scorestack-data-view-results",
+		"results-team01*":    "scorestack-data-view-results-team01",
+		"Practice_Results-*": "scorestack-data-view-practice-results",
+	}
+	for title, want := range tests {
+		if got := DataViewID(title); got != want {
+			t.Errorf("DataViewID(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
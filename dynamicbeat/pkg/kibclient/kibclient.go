@@ -1,35 +1,189 @@
 package kibclient
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 	"go.uber.org/zap"
 )
 
 type Client struct {
-	Inner    http.Client
-	Username string
-	Password string
-	Host     string
+	Inner       http.Client
+	Username    string
+	Password    string
+	Hosts       []string     // the base URLs of the Kibana hosts, in order of preference
+	APIKey      string       // base64-encoded id:key API key to authenticate with instead of the username and password
+	MaxAttempts int          // the number of times Wait will check the Kibana status before giving up; 0 means never give up
+	MaxRetries  int          // the number of times a request will be retried after a temporary failure
+	DryRun      bool         // whether to skip requests that change anything, recording them in Plan instead
+	Plan        *util.Plan   // the requests that were skipped in dry-run mode
+	Version     util.Version // the version of Kibana, once it has been fetched with FetchVersion
+
+	ForceDashboards bool     // whether AddDashboard should import dashboards even if they haven't changed
+	DashboardSpaces []string // the spaces that dashboards are imported into; defaults to the default space and the scorestack space
+
+	PollInterval time.Duration // how often Wait checks the Kibana status; defaults to util.DefaultPollInterval
+	LogEvery     time.Duration // how often Wait logs that it is still waiting; defaults to PollInterval
+
+	mu        sync.Mutex
+	preferred int // the index of the last host that handled a request
+}
+
+func New(host string, username string, password string, verify bool) *Client {
+	// Configure TLS verification based on the Dynamicbeat config setting
+	return NewWithTLS([]string{host}, username, password, &tls.Config{
+		InsecureSkipVerify: !verify,
+	})
+}
+
+// NewWithTLS creates a client that uses a custom TLS configuration for its
+// connections to Kibana. If more than one host is given, requests will fail
+// over to the next host when a host is unavailable.
+func NewWithTLS(hosts []string, username string, password string, tlsConfig *tls.Config) *Client {
+	return NewWithTransport(hosts, username, password, &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           http.ProxyFromEnvironment,
+	})
+}
+
+// NewWithTransport creates a client that uses a custom HTTP transport for its
+// connections to Kibana, like one that sends requests through a proxy.
+func NewWithTransport(hosts []string, username string, password string, tr http.RoundTripper) *Client {
+	return &Client{
+		Inner:    http.Client{Transport: tr, Timeout: 5 * time.Second},
+		Username: username,
+		Password: password,
+		Hosts:    hosts,
+	}
+}
+
+// retryStatuses are the response codes that indicate that Kibana is
+// temporarily unable to handle a request.
+var retryStatuses = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+}
+
+// Req sends a request to Kibana, retrying up to MaxRetries times if the request
+// fails due to a connection error or a temporary server error.
+func (c *Client) Req(ctx context.Context, method string, path string, body io.Reader) (int, io.ReadCloser, error) {
+	return c.req(ctx, method, path, "application/json", body)
+}
+
+// req works like Req, but sends the request body with the given content type.
+func (c *Client) req(ctx context.Context, method string, path string, contentType string, body io.Reader) (int, io.ReadCloser, error) {
+	// Buffer the request body so it can be resent if the request is retried
+	var buf []byte
+	if body != nil {
+		var err error
+		buf, err = ioutil.ReadAll(body)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to read body of Kibana request to '%s': %s", path, err)
+		}
+	}
+
+	// Pretend that changes succeeded when in dry-run mode
+	if c.DryRun && util.IsMutating(method) {
+		c.Plan.Add("Kibana", method, path, buf)
+		return 200, ioutil.NopCloser(strings.NewReader("{}")), nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		code, resBody, err := c.send(ctx, method, path, contentType, buf)
+		if attempt >= c.MaxRetries || (err == nil && !retryStatuses[code]) {
+			return code, resBody, err
+		}
+
+		// Throw away the failed response before trying again
+		if err == nil {
+			_, _ = io.Copy(ioutil.Discard, resBody)
+			resBody.Close()
+		}
+
+		delay := util.Backoff(attempt)
+		zap.S().Debugf("retrying Kibana request %s %s (attempt %d of %d) in %s - code: %d, error: %v", method, path, attempt+1, c.MaxRetries, delay, code, err)
+		select {
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// send makes a single attempt at sending a request to Kibana. The request is
+// sent to the host that last handled a request, and fails over to the other
+// hosts in order if that host is unavailable.
+func (c *Client) send(ctx context.Context, method string, path string, contentType string, body []byte) (int, io.ReadCloser, error) {
+	if len(c.Hosts) == 0 {
+		return 0, nil, fmt.Errorf("failed to send Kibana request to '%s': no Kibana hosts configured", path)
+	}
+
+	c.mu.Lock()
+	start := c.preferred
+	c.mu.Unlock()
+
+	var code int
+	var resBody io.ReadCloser
+	var err error
+	for i := range c.Hosts {
+		host := (start + i) % len(c.Hosts)
+		if i > 0 {
+			// Throw away the failed response before trying the next host
+			if err == nil {
+				_, _ = io.Copy(ioutil.Discard, resBody)
+				resBody.Close()
+			}
+			zap.S().Debugf("failing over Kibana request %s %s to %s - code: %d, error: %v", method, path, c.Hosts[host], code, err)
+		}
+
+		code, resBody, err = c.sendTo(ctx, c.Hosts[host], method, path, contentType, body)
+		if err == nil && code != http.StatusBadGateway && code != http.StatusServiceUnavailable {
+			c.mu.Lock()
+			c.preferred = host
+			c.mu.Unlock()
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return code, resBody, err
 }
 
-func (c *Client) Req(method string, path string, body io.Reader) (int, io.ReadCloser, error) {
-	url := fmt.Sprintf("%s%s", c.Host, path)
+// sendTo sends a request to a single Kibana host.
+func (c *Client) sendTo(ctx context.Context, host string, method string, path string, contentType string, body []byte) (int, io.ReadCloser, error) {
+	url := fmt.Sprintf("%s%s", strings.TrimSuffix(host, "/"), path)
 
-	// Build request
-	req, err := http.NewRequest(method, url, body)
+	// Build request. Empty bodies aren't sent at all, so that GET and HEAD
+	// requests never have a body or a Content-Type.
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
 	if err != nil {
 		return 0, nil, fmt.Errorf("failed to build Kibana request to '%s': %s", path, err)
 	}
-	req.SetBasicAuth(c.Username, c.Password)
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("ApiKey %s", c.APIKey))
+	} else {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
 	req.Header.Set("kbn-xsrf", "true")
-	if body != nil {
-		req.Header.Set("Content-Type", "application/json")
+	if reader != nil {
+		req.Header.Set("Content-Type", contentType)
 	}
 
 	// Send request
@@ -40,89 +194,262 @@ func (c *Client) Req(method string, path string, body io.Reader) (int, io.ReadCl
 	return res.StatusCode, res.Body, nil
 }
 
-func (c *Client) CheckedReq(method string, path string, body io.Reader) error {
-	return CloseAndCheck(c.Req(method, path, body))
+// CheckedReq sends a request to Kibana and checks that it succeeded. Response
+// codes other than 2xx codes can be treated as success by passing them as
+// allowed codes.
+func (c *Client) CheckedReq(ctx context.Context, method string, path string, body io.Reader, allowed ...int) error {
+	return CloseAndCheckAllowing(allowed...)(c.Req(ctx, method, path, body))
 }
 
-func (c *Client) Wait() error {
-	first := true
-	for {
-		// If we haven't been through this loop yet, sleep for 5 seconds
-		if !first {
-			zap.S().Info("waiting for Kibana to be ready...")
-			time.Sleep(5 * time.Second)
+func (c *Client) Wait(ctx context.Context) error {
+	// Keep track of the last thing we saw so we can report it if we give up
+	lastStatus := "unknown"
+	var lastErr error
+
+	logEvery := c.LogEvery
+	if logEvery <= 0 {
+		logEvery = c.PollInterval
+	}
+	shouldLog := util.Every(logEvery)
+	attempt := 0
+	return util.Poll(ctx, c.PollInterval, func() (bool, error) {
+		attempt++
+		status, err := c.Status(ctx)
+		if util.IsStatus(err, 401) || util.IsStatus(err, 403) {
+			return false, fmt.Errorf("Kibana rejected the setup credentials: %w", err)
+		}
+		if err == nil {
+			lastStatus = status
+			if status == "green" || status == "available" {
+				return true, nil
+			}
+		} else {
+			zap.S().Debugf("Kibana is not ready: %s", err)
 		}
-		first = false
+		lastErr = err
 
-		_, body, err := c.Req("GET", "/api/status", nil)
-		if err != nil {
-			continue
-		}
-
-		// Check if response status is "green"
-		health := struct {
-			Status struct {
-				Overall struct {
-					State string `json:"state"`
-					Level string `json:"level"`
-				} `json:"overall"`
-			} `json:"status"`
-		}{}
-		decoder := json.NewDecoder(body)
-		err = decoder.Decode(&health)
-		if err != nil {
-			continue
+		if c.MaxAttempts > 0 && attempt >= c.MaxAttempts {
+			return false, fmt.Errorf("Kibana did not become ready after %d attempts (last status: %s, last error: %v)", c.MaxAttempts, lastStatus, lastErr)
 		}
-		body.Close()
-		if health.Status.Overall.State == "green" || health.Status.Overall.Level == "available" {
-			break
+		if shouldLog() {
+			zap.S().Info("waiting for Kibana to be ready...")
 		}
+		return false, nil
+	})
+}
+
+// Status returns the overall state of Kibana, without waiting for it to
+// change. Older versions of Kibana report a color like "green", while newer
+// versions report a level like "available".
+func (c *Client) Status(ctx context.Context) (string, error) {
+	code, body, err := c.send(ctx, "GET", "/api/status", "", nil)
+	if err != nil {
+		return "", err
+	}
+	if !util.IsSuccess(code) {
+		return "", CloseAndCheck(code, body, nil)
 	}
+	defer body.Close()
 
-	return nil
+	health := struct {
+		Status struct {
+			Overall struct {
+				State string `json:"state"`
+				Level string `json:"level"`
+			} `json:"overall"`
+		} `json:"status"`
+	}{}
+	err = json.NewDecoder(body).Decode(&health)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode Kibana status: %s", err)
+	}
+	if health.Status.Overall.State != "" {
+		return health.Status.Overall.State, nil
+	}
+	return health.Status.Overall.Level, nil
 }
 
+// CloseAndCheck closes the body of a response from Req, and returns an error if
+// the request failed or the response code was not a 2xx code.
 func CloseAndCheck(code int, body io.ReadCloser, err error) error {
 	if err != nil {
 		return err
 	}
-	defer body.Close()
-	if code != 200 && code != 204 {
-		buf := new(strings.Builder)
-		_, err := io.Copy(buf, body)
+
+	return util.CheckResponse(code, body)
+}
+
+// CloseAndCheckAllowing works like CloseAndCheck, but also treats the given
+// response codes as success. This is useful for idempotent requests, like
+// creating an object that may already exist:
+//
+//	err := CloseAndCheckAllowing(409)(c.Req(ctx, "POST", path, body))
+func CloseAndCheckAllowing(allowed ...int) func(int, io.ReadCloser, error) error {
+	return func(code int, body io.ReadCloser, err error) error {
 		if err != nil {
-			return fmt.Errorf("got %v response code and couldn't read response body: %s", code, err)
+			return err
 		}
-		return fmt.Errorf("response code was %v - response body: %s", code, buf)
-	}
 
-	return nil
+		return util.CheckResponse(code, body, allowed...)
+	}
 }
 
-func (c *Client) AddDashboard(data func() io.Reader) error {
-	zap.S().Info("adding dashboards")
-	err := CloseAndCheck(c.Req("POST", "/api/kibana/dashboards/import?force=true", data()))
+// AddDashboard imports a set of dashboards and their related saved objects into
+// each of the DashboardSpaces, and returns the objects that were imported. The
+// data must be in the legacy dashboards import format. Kibana 7.15 and newer no
+// longer support the legacy dashboards import API, so the saved objects import
+// API is used instead on those versions.
+//
+// A hash of the objects is saved in each space after they are imported, and
+// the import is skipped in spaces where the objects haven't changed since the
+// last import, so that customizations aren't overwritten. Set ForceDashboards
+// to always import the objects.
+func (c *Client) AddDashboard(ctx context.Context, data func() io.Reader) ([]SavedObject, ImportResult, error) {
+	objects, err := savedObjectRefs(data())
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	if len(objects) == 0 {
+		return nil, "", fmt.Errorf("no saved objects to import")
+	}
+	ndjson, err := toNDJSON(data())
+	if err != nil {
+		return nil, "", err
+	}
+	hash := contentHash(ndjson)
+	marker := importMarker(objects)
+
+	legacy, err := c.supportsLegacyDashboardImport(ctx)
+	if err != nil {
+		return nil, "", err
 	}
 
-	return CloseAndCheck(c.Req("POST", "/s/scorestack/api/kibana/dashboards/import?force=true", data()))
+	result := ImportSkipped
+	for _, space := range c.dashboardSpaces() {
+		if !c.ForceDashboards {
+			unchanged, err := c.importUnchanged(ctx, space, marker, hash)
+			if err != nil {
+				return nil, "", err
+			}
+			if unchanged {
+				continue
+			}
+		}
+
+		if legacy {
+			path := "/api/kibana/dashboards/import?force=true"
+			if space != "" {
+				path = fmt.Sprintf("/s/%s%s", space, path)
+			}
+			err = CloseAndCheck(c.Req(ctx, "POST", path, data()))
+		} else {
+			err = c.AddSavedObjects(ctx, space, bytes.NewReader(ndjson))
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		err = c.saveImportMarker(ctx, space, marker, hash)
+		if err != nil {
+			return nil, "", err
+		}
+		result = ImportImported
+		if c.ForceDashboards {
+			result = ImportForced
+		}
+	}
+
+	zap.S().Infof("dashboard %s: %s", objects[0].ID, result)
+	return objects, result, nil
+}
+
+// dashboardSpaces returns the spaces that dashboards are imported into, where
+// the default space is an empty name.
+func (c *Client) dashboardSpaces() []string {
+	if len(c.DashboardSpaces) == 0 {
+		return []string{"", "scorestack"}
+	}
+	return c.DashboardSpaces
 }
 
-func (c *Client) AddRole(name string, data io.Reader) error {
+func (c *Client) AddRole(ctx context.Context, name string, data io.Reader) error {
 	zap.S().Infof("adding role: %s", name)
-	return CloseAndCheck(c.Req("PUT", fmt.Sprintf("/api/security/role/%s", name), data))
+	return CloseAndCheck(c.Req(ctx, "PUT", fmt.Sprintf("/api/security/role/%s", name), data))
 }
 
-func (c *Client) AddSpace(name string, data func() io.Reader) error {
+func (c *Client) AddSpace(ctx context.Context, name string, data func() io.Reader) error {
 	// Try to update the space if it already exists
-	code, b, err := c.Req("PUT", fmt.Sprintf("/api/spaces/space/%s", name), data())
-	if code == 404 {
-		// If the space doesn't exist, create it
+	err := CloseAndCheck(c.Req(ctx, "PUT", fmt.Sprintf("/api/spaces/space/%s", name), data()))
+	if util.IsStatus(err, 404) {
+		// If the space doesn't exist, create it. The create API requires the
+		// space ID in the body, so make sure it's there and matches the name.
+		space := make(map[string]interface{})
+		err = json.NewDecoder(data()).Decode(&space)
+		if err != nil {
+			return fmt.Errorf("failed to decode Kibana space '%s': %s", name, err)
+		}
+		space["id"] = name
+		body, err := json.Marshal(space)
+		if err != nil {
+			return fmt.Errorf("failed to encode Kibana space '%s': %s", name, err)
+		}
+
+		// The space may have been created since we tried to update it
 		zap.S().Infof("adding Kibana space: %s", name)
-		return CloseAndCheck(c.Req("POST", "/api/spaces/space", data()))
+		return CloseAndCheckAllowing(409)(c.Req(ctx, "POST", "/api/spaces/space", bytes.NewReader(body)))
 	}
+	if err != nil {
+		return err
+	}
+
+	zap.S().Debugf("Kibana space '%s' already exists, updated it", name)
+	return nil
+}
 
-	zap.S().Debugf("Kibana space '%s' already exists, skipping...", name)
-	return CloseAndCheck(code, b, err)
+// RemoveRole deletes a role. Roles that don't exist are ignored.
+func (c *Client) RemoveRole(ctx context.Context, name string) error {
+	zap.S().Infof("removing role: %s", name)
+	return CloseAndCheckAllowing(404)(c.Req(ctx, "DELETE", fmt.Sprintf("/api/security/role/%s", name), nil))
+}
+
+// RemoveSpace deletes a Kibana space and all of the saved objects in it.
+// Spaces that don't exist are ignored.
+func (c *Client) RemoveSpace(ctx context.Context, name string) error {
+	zap.S().Infof("removing Kibana space: %s", name)
+	return CloseAndCheckAllowing(404)(c.Req(ctx, "DELETE", fmt.Sprintf("/api/spaces/space/%s", name), nil))
+}
+
+// GetRole gets the definition of a role. If the role doesn't exist, a nil
+// definition is returned.
+func (c *Client) GetRole(ctx context.Context, name string) (json.RawMessage, error) {
+	return c.get(ctx, fmt.Sprintf("/api/security/role/%s", name))
+}
+
+// GetSpace gets the definition of a Kibana space. If the space doesn't exist,
+// a nil definition is returned.
+func (c *Client) GetSpace(ctx context.Context, name string) (json.RawMessage, error) {
+	return c.get(ctx, fmt.Sprintf("/api/spaces/space/%s", name))
+}
+
+// get sends a GET request to Kibana and returns the response body, or nil if
+// the response code was 404.
+func (c *Client) get(ctx context.Context, path string) (json.RawMessage, error) {
+	code, body, err := c.Req(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if code == 404 {
+		return nil, CloseAndCheckAllowing(404)(code, body, nil)
+	}
+	if !util.IsSuccess(code) {
+		return nil, CloseAndCheck(code, body, nil)
+	}
+	defer body.Close()
+
+	var raw json.RawMessage
+	err = json.NewDecoder(body).Decode(&raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Kibana response from '%s': %s", path, err)
+	}
+	return raw, nil
 }
@@ -0,0 +1,482 @@
+package kibclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient creates a client for a fake Kibana server, which is stopped
+// when the test finishes.
+func newTestClient(t *testing.T, handler http.Handler) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return NewWithTransport([]string{srv.URL}, "elastic", "changeme", http.DefaultTransport)
+}
+
+// A recordedRequest is a request that a recorder received.
+type recordedRequest struct {
+	Method      string
+	Path        string // the path and query
+	ContentType string
+	Body        string
+}
+
+// recorder is a fake Kibana server that records every request, and responds
+// with respond, or with an empty object if respond is nil.
+type recorder struct {
+	respond  func(w http.ResponseWriter, r *http.Request)
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rec.mu.Lock()
+	rec.requests = append(rec.requests, recordedRequest{
+		Method:      r.Method,
+		Path:        r.URL.RequestURI(),
+		ContentType: r.Header.Get("Content-Type"),
+		Body:        string(body),
+	})
+	rec.mu.Unlock()
+
+	if rec.respond != nil {
+		rec.respond(w, r)
+		return
+	}
+	fmt.Fprint(w, "{}")
+}
+
+func (rec *recorder) recorded() []recordedRequest {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]recordedRequest{}, rec.requests...)
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/status" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fmt.Fprint(w, `{"version":{"number":"7.9.2"},"status":{"overall":{"state":"green"}}}`)
+}
+
+func TestNewWithTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(statusHandler))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	tests := []struct {
+		name   string
+		config *tls.Config
+		err    string
+	}{
+		{name: "trusted CA", config: &tls.Config{RootCAs: pool}},
+		{name: "skip verify", config: &tls.Config{InsecureSkipVerify: true}},
+		{name: "untrusted", config: &tls.Config{}, err: "certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewWithTLS([]string{srv.URL}, "elastic", "changeme", tt.config)
+			status, err := c.Status(context.Background())
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != "green" {
+				t.Errorf("got status %s, want green", status)
+			}
+		})
+	}
+}
+
+func TestReqBody(t *testing.T) {
+	tests := []struct {
+		method string
+		body   io.Reader
+		want   string // the body that Kibana receives
+	}{
+		{method: "GET"},
+		{method: "GET", body: strings.NewReader("")},
+		{method: "HEAD"},
+		{method: "DELETE"},
+		{method: "POST", body: strings.NewReader(`{"id":"scorestack"}`), want: `{"id":"scorestack"}`},
+		{method: "PUT", body: strings.NewReader(`{"elasticsearch":{}}`), want: `{"elasticsearch":{}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			rec := &recorder{}
+			c := newTestClient(t, rec)
+			err := CloseAndCheck(c.Req(context.Background(), tt.method, "/api/spaces/space/scorestack", tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := rec.recorded()[0]
+			if req.Method != tt.method || req.Body != tt.want {
+				t.Errorf("got %s with body %q, want %s with body %q", req.Method, req.Body, tt.method, tt.want)
+			}
+			if tt.want == "" && req.ContentType != "" {
+				t.Errorf("request without a body has Content-Type %s", req.ContentType)
+			}
+			if tt.want != "" && req.ContentType != "application/json" {
+				t.Errorf("got Content-Type %q, want application/json", req.ContentType)
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		body string
+		want string
+		err  string
+	}{
+		{name: "found", code: 200, body: `{"id":"scorestack"}`, want: `{"id":"scorestack"}`},
+		{name: "missing", code: 404, body: `{"statusCode":404,"error":"Not Found"}`},
+		{name: "error", code: 500, body: `{"statusCode":500}`, err: "response code was 500"},
+		{name: "invalid JSON", code: 200, body: `{"id":`, err: "failed to decode Kibana response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{respond: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+				fmt.Fprint(w, tt.body)
+			}}
+			c := newTestClient(t, rec)
+
+			got, err := c.GetSpace(context.Background(), "scorestack")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			req := rec.recorded()[0]
+			if req.Method != "GET" || req.Path != "/api/spaces/space/scorestack" || req.Body != "" {
+				t.Errorf("got %s %s with body %q, want GET /api/spaces/space/scorestack without a body", req.Method, req.Path, req.Body)
+			}
+		})
+	}
+}
+
+func TestAddSpace(t *testing.T) {
+	tests := []struct {
+		name   string
+		update int // the response code of the update
+		create int // the response code of the create
+		body   string
+		want   []string // the method, path, and body of each request
+		err    string
+	}{
+		{
+			name:   "update existing",
+			update: 200,
+			body:   `{"name":"Scorestack"}`,
+			want:   []string{`PUT /api/spaces/space/scorestack {"name":"Scorestack"}`},
+		},
+		{
+			name:   "create",
+			update: 404,
+			create: 200,
+			body:   `{"name":"Scorestack"}`,
+			want: []string{
+				`PUT /api/spaces/space/scorestack {"name":"Scorestack"}`,
+				`POST /api/spaces/space {"id":"scorestack","name":"Scorestack"}`,
+			},
+		},
+		{
+			name:   "create with the wrong ID",
+			update: 404,
+			create: 200,
+			body:   `{"id":"other","name":"Scorestack"}`,
+			want: []string{
+				`PUT /api/spaces/space/scorestack {"id":"other","name":"Scorestack"}`,
+				`POST /api/spaces/space {"id":"scorestack","name":"Scorestack"}`,
+			},
+		},
+		{
+			// The space was created by something else after the update
+			name:   "created concurrently",
+			update: 404,
+			create: 409,
+			body:   `{"name":"Scorestack"}`,
+			want: []string{
+				`PUT /api/spaces/space/scorestack {"name":"Scorestack"}`,
+				`POST /api/spaces/space {"id":"scorestack","name":"Scorestack"}`,
+			},
+		},
+		{
+			name:   "create failure",
+			update: 404,
+			create: 400,
+			body:   `{"name":"Scorestack"}`,
+			want: []string{
+				`PUT /api/spaces/space/scorestack {"name":"Scorestack"}`,
+				`POST /api/spaces/space {"id":"scorestack","name":"Scorestack"}`,
+			},
+			err: "response code was 400",
+		},
+		{
+			name:   "update failure",
+			update: 403,
+			body:   `{"name":"Scorestack"}`,
+			want:   []string{`PUT /api/spaces/space/scorestack {"name":"Scorestack"}`},
+			err:    "response code was 403",
+		},
+		{
+			name:   "invalid space",
+			update: 404,
+			body:   `{"name":`,
+			want:   []string{`PUT /api/spaces/space/scorestack {"name":`},
+			err:    "failed to decode Kibana space 'scorestack'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{respond: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "PUT" {
+					w.WriteHeader(tt.update)
+				} else {
+					w.WriteHeader(tt.create)
+				}
+				fmt.Fprint(w, "{}")
+			}}
+			c := newTestClient(t, rec)
+
+			err := c.AddSpace(context.Background(), "scorestack", func() io.Reader {
+				return strings.NewReader(tt.body)
+			})
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+
+			var got []string
+			for _, req := range rec.recorded() {
+				got = append(got, fmt.Sprintf("%s %s %s", req.Method, req.Path, req.Body))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got requests %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// refusedURL returns the URL of a port that nothing is listening on, so that
+// connections to it are refused.
+func refusedURL(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func TestSendFailover(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	live := &recorder{respond: statusHandler}
+	liveSrv := httptest.NewServer(live)
+	defer liveSrv.Close()
+
+	tests := []struct {
+		name      string
+		hosts     []string
+		preferred int
+		err       string
+	}{
+		{name: "first host refuses connections", hosts: []string{refusedURL(t), liveSrv.URL}, preferred: 1},
+		{name: "first host is unavailable", hosts: []string{unavailable.URL, liveSrv.URL}, preferred: 1},
+		{name: "first host is healthy", hosts: []string{liveSrv.URL, refusedURL(t)}, preferred: 0},
+		{name: "every host is down", hosts: []string{refusedURL(t), refusedURL(t)}, err: "connection refused"},
+		{name: "no hosts", err: "no Kibana hosts configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewWithTransport(tt.hosts, "elastic", "changeme", http.DefaultTransport)
+			status, err := c.Status(context.Background())
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != "green" {
+				t.Errorf("got status %s, want green", status)
+			}
+			if c.preferred != tt.preferred {
+				t.Errorf("preferred host is %d, want %d", c.preferred, tt.preferred)
+			}
+		})
+	}
+}
+
+func TestSendPrefersHealthyHost(t *testing.T) {
+	var first, second int
+	down := true
+	var mu sync.Mutex
+	firstSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		first++
+		if down {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		statusHandler(w, r)
+	}))
+	defer firstSrv.Close()
+	secondSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		second++
+		mu.Unlock()
+		statusHandler(w, r)
+	}))
+	defer secondSrv.Close()
+
+	c := NewWithTransport([]string{firstSrv.URL, secondSrv.URL}, "elastic", "changeme", http.DefaultTransport)
+	for i := 0; i < 3; i++ {
+		_, err := c.Status(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once the first host failed, requests go straight to the second host,
+	// even after the first host recovers
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	_, err := c.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if first != 1 || second != 4 {
+		t.Errorf("first host got %d requests and second host got %d, want 1 and 4", first, second)
+	}
+}
+
+// statusServer is a fake Kibana server that responds to status requests with
+// each of its responses in turn, repeating the last one. Numeric responses are
+// sent as the response code, states like "green" are reported the way that
+// Kibana 7 does, and levels like "level:available" the way that Kibana 8 does.
+type statusServer struct {
+	responses []string
+	mu        sync.Mutex
+	requests  int
+}
+
+func (s *statusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	response := s.responses[len(s.responses)-1]
+	if s.requests < len(s.responses) {
+		response = s.responses[s.requests]
+	}
+	s.requests++
+	s.mu.Unlock()
+
+	if code, err := strconv.Atoi(response); err == nil {
+		w.WriteHeader(code)
+		fmt.Fprint(w, `{"statusCode":`+response+`}`)
+		return
+	}
+	if strings.HasPrefix(response, "level:") {
+		fmt.Fprintf(w, `{"status":{"overall":{"level":"%s"}}}`, strings.TrimPrefix(response, "level:"))
+		return
+	}
+	fmt.Fprintf(w, `{"status":{"overall":{"state":"%s"}}}`, response)
+}
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name        string
+		responses   []string
+		maxAttempts int
+		requests    int    // how many status requests Wait makes
+		err         string // part of the error, if Wait fails
+	}{
+		{name: "green", responses: []string{"green"}, requests: 1},
+		{name: "available", responses: []string{"level:available"}, requests: 1},
+		{name: "starting up", responses: []string{"red", "yellow", "green"}, requests: 3},
+		{name: "degraded", responses: []string{"level:critical", "level:degraded", "level:available"}, requests: 3},
+		{name: "unavailable", responses: []string{"503", "500", "green"}, requests: 3},
+		{
+			name:        "attempts limit",
+			responses:   []string{"red", "yellow"},
+			maxAttempts: 3,
+			requests:    3,
+			err:         "did not become ready after 3 attempts (last status: yellow",
+		},
+		{name: "rejected credentials", responses: []string{"401"}, requests: 1, err: "rejected the setup credentials"},
+		{name: "forbidden", responses: []string{"503", "red", "403"}, requests: 3, err: "rejected the setup credentials"},
+		{
+			// Rejected credentials fail straight away, even without a limit
+			name:      "rejected credentials without an attempts limit",
+			responses: []string{"401", "green"},
+			requests:  1,
+			err:       "response code was 401",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &statusServer{responses: tt.responses}
+			c := newTestClient(t, s)
+			c.MaxAttempts = tt.maxAttempts
+			c.PollInterval = time.Millisecond
+
+			err := c.Wait(context.Background())
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+			if s.requests != tt.requests {
+				t.Errorf("got %d status requests, want %d", s.requests, tt.requests)
+			}
+		})
+	}
+}
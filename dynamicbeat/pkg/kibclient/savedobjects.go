@@ -0,0 +1,337 @@
+package kibclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// FetchVersion gets the version of the Kibana server from the status API, and
+// stores it in the client's Version field.
+func (c *Client) FetchVersion(ctx context.Context) (util.Version, error) {
+	status := struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}{}
+
+	code, body, err := c.Req(ctx, "GET", "/api/status", nil)
+	if err != nil {
+		return util.Version{}, err
+	}
+	if code != 200 {
+		return util.Version{}, CloseAndCheck(code, body, nil)
+	}
+	defer body.Close()
+
+	err = json.NewDecoder(body).Decode(&status)
+	if err != nil {
+		return util.Version{}, fmt.Errorf("failed to decode Kibana status: %s", err)
+	}
+	version, err := util.ParseVersion(status.Version.Number)
+	if err != nil {
+		return util.Version{}, fmt.Errorf("failed to get Kibana version: %s", err)
+	}
+
+	c.Version = version
+	return version, nil
+}
+
+// supportsLegacyDashboardImport checks if the Kibana server is older than 7.15,
+// which is when the legacy dashboards import API was deprecated.
+func (c *Client) supportsLegacyDashboardImport(ctx context.Context) (bool, error) {
+	version, err := c.version(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return version.Less(util.Version{Major: 7, Minor: 15}), nil
+}
+
+// version returns the version of Kibana, fetching it first if it hasn't been
+// fetched yet.
+func (c *Client) version(ctx context.Context) (util.Version, error) {
+	if !c.Version.IsZero() {
+		return c.Version, nil
+	}
+
+	return c.FetchVersion(ctx)
+}
+
+// AddSavedObjects imports NDJSON-formatted saved objects into a Kibana space
+// with the saved objects import API, overwriting any objects that already
+// exist. An empty space name imports the objects into the default space.
+func (c *Client) AddSavedObjects(ctx context.Context, space string, data io.Reader) error {
+	path := "/api/saved_objects/_import?overwrite=true"
+	if space != "" {
+		path = fmt.Sprintf("/s/%s%s", space, path)
+	}
+
+	// The import API only accepts objects uploaded as a file
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	file, err := form.CreateFormFile("file", "export.ndjson")
+	if err != nil {
+		return fmt.Errorf("failed to build saved objects import request: %s", err)
+	}
+	_, err = io.Copy(file, data)
+	if err != nil {
+		return fmt.Errorf("failed to build saved objects import request: %s", err)
+	}
+	err = form.Close()
+	if err != nil {
+		return fmt.Errorf("failed to build saved objects import request: %s", err)
+	}
+
+	code, body, err := c.req(ctx, "POST", path, form.FormDataContentType(), &buf)
+	if err != nil {
+		return err
+	}
+	if code != 200 || c.DryRun {
+		return CloseAndCheck(code, body, nil)
+	}
+	defer body.Close()
+
+	// The import API responds with a 200 even if some of the objects failed to
+	// import, so the response has to be checked for errors
+	result := struct {
+		Success      bool `json:"success"`
+		SuccessCount int  `json:"successCount"`
+		Errors       []struct {
+			ID    string `json:"id"`
+			Type  string `json:"type"`
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"errors"`
+	}{}
+	err = json.NewDecoder(body).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("failed to decode saved objects import response: %s", err)
+	}
+	if !result.Success {
+		failures := make([]string, 0, len(result.Errors))
+		for _, e := range result.Errors {
+			failure := fmt.Sprintf("%s '%s': %s", e.Type, e.ID, e.Error.Type)
+			if e.Error.Message != "" {
+				failure = fmt.Sprintf("%s (%s)", failure, e.Error.Message)
+			}
+			failures = append(failures, failure)
+		}
+		return fmt.Errorf("failed to import %d saved objects: %s", len(result.Errors), strings.Join(failures, "; "))
+	}
+
+	zap.S().Debugf("imported %d saved objects", result.SuccessCount)
+	return nil
+}
+
+// A SavedObject identifies a Kibana saved object.
+type SavedObject struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// An ImportResult describes what AddDashboard did with a set of dashboards.
+type ImportResult string
+
+const (
+	ImportImported ImportResult = "imported"            // the dashboards were new or had changed
+	ImportSkipped  ImportResult = "skipped (unchanged)" // the dashboards hadn't changed since they were last imported
+	ImportForced   ImportResult = "forced"              // the dashboards were imported because ForceDashboards was set
+)
+
+// GetSavedObject gets a saved object from a Kibana space. An empty space name
+// gets the object from the default space. If the object doesn't exist, a nil
+// object is returned.
+func (c *Client) GetSavedObject(ctx context.Context, space string, objType string, id string) (json.RawMessage, error) {
+	path := fmt.Sprintf("/api/saved_objects/%s/%s", objType, id)
+	if space != "" {
+		path = fmt.Sprintf("/s/%s%s", space, path)
+	}
+
+	return c.get(ctx, path)
+}
+
+// Import markers are stored as short URL saved objects, since they are
+// supported by every version of Kibana and aren't shown alongside dashboards.
+const (
+	markerType   = "url"
+	markerPrefix = "scorestack-hash:"
+)
+
+// importMarker returns the ID of the import marker for a set of objects.
+func importMarker(objects []SavedObject) string {
+	return fmt.Sprintf("scorestack-import-%s", objects[0].ID)
+}
+
+// importUnchanged checks whether the import marker in a space matches a hash.
+func (c *Client) importUnchanged(ctx context.Context, space string, marker string, hash string) (bool, error) {
+	obj, err := c.GetSavedObject(ctx, space, markerType, marker)
+	if err != nil {
+		return false, fmt.Errorf("failed to get import marker '%s': %w", marker, err)
+	}
+	if obj == nil {
+		return false, nil
+	}
+
+	saved := struct {
+		Attributes struct {
+			URL string `json:"url"`
+		} `json:"attributes"`
+	}{}
+	err = json.Unmarshal(obj, &saved)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode import marker '%s': %s", marker, err)
+	}
+	return saved.Attributes.URL == markerPrefix+hash, nil
+}
+
+// saveImportMarker records the hash of the objects that were imported into a
+// space.
+func (c *Client) saveImportMarker(ctx context.Context, space string, marker string, hash string) error {
+	path := fmt.Sprintf("/api/saved_objects/%s/%s?overwrite=true", markerType, marker)
+	if space != "" {
+		path = fmt.Sprintf("/s/%s%s", space, path)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	body, err := json.Marshal(map[string]interface{}{
+		"attributes": map[string]interface{}{
+			"url":         markerPrefix + hash,
+			"accessCount": 0,
+			"createDate":  now,
+			"accessDate":  now,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode import marker '%s': %s", marker, err)
+	}
+
+	err = CloseAndCheck(c.Req(ctx, "POST", path, bytes.NewReader(body)))
+	if err != nil {
+		return fmt.Errorf("failed to save import marker '%s': %w", marker, err)
+	}
+	return nil
+}
+
+// contentHash returns a hex-encoded SHA-256 hash of some data.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// savedObjectRefs returns the saved objects in the legacy dashboards import
+// format.
+func savedObjectRefs(data io.Reader) ([]SavedObject, error) {
+	export := struct {
+		Objects []SavedObject `json:"objects"`
+	}{}
+	err := json.NewDecoder(data).Decode(&export)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode saved objects: %s", err)
+	}
+
+	return export.Objects, nil
+}
+
+// toNDJSON converts saved objects in the legacy dashboards import format into
+// the newline-delimited format used by the saved objects import API.
+func toNDJSON(data io.Reader) ([]byte, error) {
+	export := struct {
+		Objects []json.RawMessage `json:"objects"`
+	}{}
+	err := json.NewDecoder(data).Decode(&export)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode saved objects: %s", err)
+	}
+
+	var buf bytes.Buffer
+	for _, obj := range export.Objects {
+		err = json.Compact(&buf, obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode saved object: %s", err)
+		}
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+// RemoveDashboards deletes a set of dashboards and their related saved objects
+// from each of the DashboardSpaces. The data must be in the same format that is
+// accepted by AddDashboard. Objects that don't exist are ignored.
+func (c *Client) RemoveDashboards(ctx context.Context, data io.Reader) error {
+	objects, err := savedObjectRefs(data)
+	if err != nil {
+		return err
+	}
+
+	// Remove the import marker too, so the dashboards are imported again
+	// the next time that they are added
+	if len(objects) > 0 {
+		objects = append(objects, SavedObject{Type: markerType, ID: importMarker(objects)})
+	}
+
+	zap.S().Info("removing dashboards")
+	for _, space := range c.dashboardSpaces() {
+		prefix := ""
+		if space != "" {
+			prefix = fmt.Sprintf("/s/%s", space)
+		}
+		for _, obj := range objects {
+			path := fmt.Sprintf("%s/api/saved_objects/%s/%s", prefix, obj.Type, obj.ID)
+			err = CloseAndCheckAllowing(404)(c.Req(ctx, "DELETE", path, nil))
+			if err != nil {
+				return fmt.Errorf("failed to remove %s '%s': %w", obj.Type, obj.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ExportSavedObjects exports all saved objects of the given types from a
+// Kibana space as NDJSON, including the objects that they reference. An empty
+// space name exports objects from the default space.
+func (c *Client) ExportSavedObjects(ctx context.Context, space string, types ...string) ([]byte, error) {
+	path := "/api/saved_objects/_export"
+	if space != "" {
+		path = fmt.Sprintf("/s/%s%s", space, path)
+	}
+
+	req, err := json.Marshal(map[string]interface{}{
+		"type":                  types,
+		"includeReferencesDeep": true,
+		"excludeExportDetails":  true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode saved objects export request: %s", err)
+	}
+
+	code, body, err := c.Req(ctx, "POST", path, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	if !util.IsSuccess(code) {
+		return nil, CloseAndCheck(code, body, nil)
+	}
+	defer body.Close()
+
+	objects, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read saved objects export: %s", err)
+	}
+	return objects, nil
+}
@@ -0,0 +1,247 @@
+package kibclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+func TestGetSavedObject(t *testing.T) {
+	tests := []struct {
+		name  string
+		space string
+		code  int
+		body  string
+		path  string
+		want  string // the object, or part of the error if the lookup fails
+		err   bool
+	}{
+		{
+			name: "found",
+			code: 200,
+			body: `{"type":"dashboard","id":"overview","attributes":{"title":"Overview"}}`,
+			path: "/api/saved_objects/dashboard/overview",
+			want: `{"type":"dashboard","id":"overview","attributes":{"title":"Overview"}}`,
+		},
+		{
+			name:  "found in a space",
+			space: "team01",
+			code:  200,
+			body:  `{"id":"overview"}`,
+			path:  "/s/team01/api/saved_objects/dashboard/overview",
+			want:  `{"id":"overview"}`,
+		},
+		{
+			name: "missing",
+			code: 404,
+			body: `{"statusCode":404,"error":"Not Found"}`,
+			path: "/api/saved_objects/dashboard/overview",
+		},
+		{
+			name: "error",
+			code: 500,
+			body: `{"statusCode":500,"error":"Internal Server Error"}`,
+			path: "/api/saved_objects/dashboard/overview",
+			want: "response code was 500",
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{respond: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+				fmt.Fprint(w, tt.body)
+			}}
+			c := newTestClient(t, rec)
+
+			obj, err := c.GetSavedObject(context.Background(), tt.space, "dashboard", "overview")
+			if tt.err {
+				if err == nil || !strings.Contains(err.Error(), tt.want) || !util.IsStatus(err, tt.code) {
+					t.Errorf("got error %v, want one containing %q", err, tt.want)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(obj) != tt.want {
+					t.Errorf("got object %q, want %q", obj, tt.want)
+				}
+				if tt.want == "" && obj != nil {
+					t.Errorf("got object %q for a missing object, want nil", obj)
+				}
+			}
+			if got := rec.recorded(); len(got) != 1 || got[0].Method != "GET" || got[0].Path != tt.path {
+				t.Errorf("got requests %+v, want GET %s", got, tt.path)
+			}
+		})
+	}
+}
+
+// dashboardServer is a fake Kibana server that keeps the saved objects that
+// are created individually, like import markers, and records dashboard
+// imports.
+type dashboardServer struct {
+	mu      sync.Mutex
+	objects map[string]string // saved objects by their path
+	imports []string          // the paths that dashboards were imported with
+	fail    int               // the response code of saved object lookups, if they fail
+}
+
+func (s *dashboardServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case strings.Contains(r.URL.Path, "/_import") || strings.Contains(r.URL.Path, "/dashboards/import"):
+		s.imports = append(s.imports, r.URL.Path)
+		fmt.Fprint(w, `{"success":true,"successCount":2}`)
+	case r.Method == "GET" && s.fail != 0:
+		w.WriteHeader(s.fail)
+		fmt.Fprint(w, `{}`)
+	case r.Method == "GET":
+		obj, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"statusCode":404}`)
+			return
+		}
+		fmt.Fprint(w, obj)
+	case r.Method == "POST":
+		s.objects[r.URL.Path] = string(body)
+		fmt.Fprint(w, string(body))
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+func (s *dashboardServer) takeImports() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	imports := s.imports
+	s.imports = nil
+	return imports
+}
+
+func dashboard(title string) func() io.Reader {
+	return func() io.Reader {
+		return strings.NewReader(fmt.Sprintf(`{"objects":[
+			{"type":"dashboard","id":"overview","attributes":{"title":%q}},
+			{"type":"visualization","id":"scores","attributes":{"title":"Scores"}}
+		]}`, title))
+	}
+}
+
+func TestAddDashboard(t *testing.T) {
+	versions := []struct {
+		name    string
+		version util.Version
+		imports []string
+	}{
+		{"saved objects", util.Version{Major: 8, Minor: 5}, []string{"/api/saved_objects/_import", "/s/scorestack/api/saved_objects/_import"}},
+		{"legacy", util.Version{Major: 7, Minor: 9, Patch: 2}, []string{"/api/kibana/dashboards/import", "/s/scorestack/api/kibana/dashboards/import"}},
+	}
+	steps := []struct {
+		name     string
+		title    string
+		force    bool
+		result   ImportResult
+		imported bool // whether the dashboards are imported in every space
+	}{
+		{"first import", "Overview", false, ImportImported, true},
+		{"unchanged", "Overview", false, ImportSkipped, false},
+		{"changed", "Scoreboard", false, ImportImported, true},
+		{"unchanged again", "Scoreboard", false, ImportSkipped, false},
+		{"forced", "Scoreboard", true, ImportForced, true},
+		{"unchanged after forcing", "Scoreboard", false, ImportSkipped, false},
+	}
+	for _, v := range versions {
+		t.Run(v.name, func(t *testing.T) {
+			s := &dashboardServer{objects: make(map[string]string)}
+			c := newTestClient(t, s)
+			c.Version = v.version
+
+			// Each step runs against the markers left by the steps before it
+			for _, step := range steps {
+				c.ForceDashboards = step.force
+				objects, result, err := c.AddDashboard(context.Background(), dashboard(step.title))
+				if err != nil {
+					t.Fatalf("%s: %s", step.name, err)
+				}
+				if result != step.result {
+					t.Errorf("%s: got result %q, want %q", step.name, result, step.result)
+				}
+				if len(objects) != 2 || objects[0] != (SavedObject{Type: "dashboard", ID: "overview"}) {
+					t.Errorf("%s: got objects %+v", step.name, objects)
+				}
+
+				var want []string
+				if step.imported {
+					want = v.imports
+				}
+				if got := s.takeImports(); strings.Join(got, " ") != strings.Join(want, " ") {
+					t.Errorf("%s: got imports %q, want %q", step.name, got, want)
+				}
+			}
+
+			// A marker is saved in each space
+			for _, path := range []string{"/api/saved_objects/url/scorestack-import-overview", "/s/scorestack/api/saved_objects/url/scorestack-import-overview"} {
+				marker := struct {
+					Attributes struct {
+						URL string `json:"url"`
+					} `json:"attributes"`
+				}{}
+				err := json.Unmarshal([]byte(s.objects[path]), &marker)
+				if err != nil || !strings.HasPrefix(marker.Attributes.URL, markerPrefix) {
+					t.Errorf("got marker %q at %s", s.objects[path], path)
+				}
+			}
+		})
+	}
+}
+
+func TestAddDashboardOneSpaceChanged(t *testing.T) {
+	s := &dashboardServer{objects: make(map[string]string)}
+	c := newTestClient(t, s)
+	c.Version = util.Version{Major: 8, Minor: 5}
+	_, _, err := c.AddDashboard(context.Background(), dashboard("Overview"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.takeImports()
+
+	// Only the space that no longer has the marker is imported into again
+	delete(s.objects, "/s/scorestack/api/saved_objects/url/scorestack-import-overview")
+	_, result, err := c.AddDashboard(context.Background(), dashboard("Overview"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != ImportImported {
+		t.Errorf("got result %q, want %q", result, ImportImported)
+	}
+	if got := s.takeImports(); len(got) != 1 || got[0] != "/s/scorestack/api/saved_objects/_import" {
+		t.Errorf("got imports %q, want only the scorestack space", got)
+	}
+}
+
+func TestAddDashboardMarkerError(t *testing.T) {
+	s := &dashboardServer{objects: make(map[string]string), fail: 500}
+	c := newTestClient(t, s)
+	c.Version = util.Version{Major: 8, Minor: 5}
+
+	_, _, err := c.AddDashboard(context.Background(), dashboard("Overview"))
+	if err == nil || !strings.Contains(err.Error(), "failed to get import marker 'scorestack-import-overview'") || !util.IsStatus(err, 500) {
+		t.Errorf("got error %v, want a marker lookup error", err)
+	}
+	if got := s.takeImports(); len(got) != 0 {
+		t.Errorf("dashboards were imported after the marker lookup failed: %q", got)
+	}
+}
@@ -0,0 +1,52 @@
+package kibclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// SetSpaceDefaults changes advanced settings in a Kibana space, like
+// defaultRoute or theme:darkMode. An empty space name changes the settings of
+// the default space. Each setting is changed separately, so a setting that
+// this version of Kibana rejects is logged as a warning and the rest of the
+// settings are still changed.
+func (c *Client) SetSpaceDefaults(ctx context.Context, space string, settings map[string]interface{}) error {
+	prefix := ""
+	if space != "" {
+		prefix = fmt.Sprintf("/s/%s", space)
+	}
+
+	for _, key := range sortedKeys(settings) {
+		body, err := json.Marshal(map[string]interface{}{"value": settings[key]})
+		if err != nil {
+			return fmt.Errorf("failed to encode setting '%s': %s", key, err)
+		}
+
+		zap.S().Infof("changing Kibana setting: %s", key)
+		err = c.CheckedReq(ctx, "POST", fmt.Sprintf("%s/api/kibana/settings/%s", prefix, key), bytes.NewReader(body))
+		if util.IsStatus(err, 400) {
+			zap.S().Warnf("Kibana did not accept setting '%s', skipping it: %s", key, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to change setting '%s': %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,291 @@
+// Package metrics keeps counters, gauges, and histograms about Dynamicbeat,
+// and serves them in the Prometheus text format. Metrics are registered when
+// they are created, like expvar variables, so they are usually package-level
+// variables.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A metric is a set of series that share a name, help text, and labels.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics map[string]metric
+}{metrics: make(map[string]metric)}
+
+func register(name string, m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	registry.metrics[name] = m
+}
+
+// Handler serves every metric in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry.Lock()
+		names := make([]string, 0, len(registry.metrics))
+		for name := range registry.metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		metrics := make([]metric, 0, len(names))
+		for _, name := range names {
+			metrics = append(metrics, registry.metrics[name])
+		}
+		registry.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(w)
+		for _, m := range metrics {
+			m.write(out)
+		}
+		_ = out.Flush()
+	})
+}
+
+// desc is the name, help text, and label names of a metric.
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d desc) header(w *bufio.Writer, kind string) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, kind)
+}
+
+// format formats the name and labels of a series, like name{a="b"}. Extra
+// labels, like the le label of histogram buckets, go after the metric's own.
+func (d desc) format(suffix string, values []string, extra ...string) string {
+	var b strings.Builder
+	b.WriteString(d.name)
+	b.WriteString(suffix)
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, v := range values {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, d.labels[i], escape(v)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escape(extra[i+1])))
+	}
+	if len(pairs) > 0 {
+		b.WriteString("{")
+		b.WriteString(strings.Join(pairs, ","))
+		b.WriteString("}")
+	}
+	return b.String()
+}
+
+func escape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// key joins label values into a map key.
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// A CounterVec is a set of counters with the same labels.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*Counter
+}
+
+// A Counter is a value that only goes up.
+type Counter struct {
+	values []string
+	mu     sync.Mutex
+	value  float64
+}
+
+// NewCounterVec creates and registers a set of counters.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	v := &CounterVec{desc: desc{name, help, labels}, series: make(map[string]*Counter)}
+	register(name, v)
+	return v
+}
+
+// With returns the counter with the given label values, in the order of the
+// labels.
+func (v *CounterVec) With(values ...string) *Counter {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, but %d values were given", v.name, len(v.labels), len(values)))
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.series[key(values)]
+	if !ok {
+		c = &Counter{values: values}
+		v.series[key(values)] = c
+	}
+	return c
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds to the counter. Negative values are ignored, since counters only go
+// up.
+func (c *Counter) Add(f float64) {
+	if f < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value += f
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.header(w, "counter")
+	for _, c := range v.sorted() {
+		c.mu.Lock()
+		value := c.value
+		c.mu.Unlock()
+		fmt.Fprintf(w, "%s %s\n", v.format("", c.values), formatFloat(value))
+	}
+}
+
+func (v *CounterVec) sorted() []*Counter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*Counter, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, v.series[k])
+	}
+	return out
+}
+
+// A GaugeFunc is a value that can go up and down, which is read from a
+// function whenever the metrics are served.
+type GaugeFunc struct {
+	desc
+	value func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge that is read from a function.
+func NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name: name, help: help}, value: value}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+// A HistogramVec is a set of histograms with the same labels and buckets.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*Histogram
+}
+
+// A Histogram counts observations in buckets by their upper bounds.
+type Histogram struct {
+	values  []string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64 // the observations in each bucket, not counting the lower buckets
+	count   uint64
+	sum     float64
+}
+
+// NewHistogramVec creates and registers a set of histograms with the given
+// bucket upper bounds, which must be sorted.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{desc: desc{name, help, labels}, buckets: buckets, series: make(map[string]*Histogram)}
+	register(name, v)
+	return v
+}
+
+// With returns the histogram with the given label values, in the order of
+// the labels.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, but %d values were given", v.name, len(v.labels), len(values)))
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.series[key(values)]
+	if !ok {
+		h = &Histogram{values: values, buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+		v.series[key(values)] = h
+	}
+	return h
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(f float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.SearchFloat64s(h.buckets, f)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += f
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.header(w, "histogram")
+
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]*Histogram, 0, len(keys))
+	for _, k := range keys {
+		series = append(series, v.series[k])
+	}
+	v.mu.Unlock()
+
+	for _, h := range series {
+		h.mu.Lock()
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s %d\n", v.format("_bucket", h.values, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s %d\n", v.format("_bucket", h.values, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s %s\n", v.format("_sum", h.values), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s %d\n", v.format("_count", h.values), h.count)
+		h.mu.Unlock()
+	}
+}
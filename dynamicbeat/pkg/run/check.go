@@ -14,19 +14,33 @@ import (
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes"
 )
 
+// unpackError starts the messages of results of checks whose definitions
+// couldn't be unpacked.
+const unpackError = "encountered an error when unpacking check definition"
+
 func Check(ctx context.Context, def check.Config) check.Result {
 	// Create a check from the definition
-	chk, err := unpackDef(def)
+	chk, shared, err := unpackDef(def)
 	if err != nil {
 		return check.Result{
 			Timestamp: time.Now(),
 			Metadata:  def.Metadata,
 			Passed:    false,
-			Message:   fmt.Sprintf("encountered an error when unpacking check definition: %s", err),
+			Message:   fmt.Sprintf("%s: %s", unpackError, err),
 			Details:   nil,
 		}
 	}
 
+	// Connections to the target go through the jump host, if there is one.
+	// The tunnel is closed when the check finishes or times out, along with
+	// any connections that the check left open.
+	var tunnel *check.Tunnel
+	if shared.JumpHost != nil {
+		tunnel = check.NewTunnel(shared.JumpHost)
+		defer tunnel.Close()
+		ctx = check.WithTunnel(ctx, tunnel)
+	}
+
 	// Set up the channel to recieve the CheckResult from the Check
 	result := make(chan check.Result, 1)
 
@@ -41,33 +55,66 @@ func Check(ctx context.Context, def check.Config) check.Result {
 		case <-ctx.Done():
 			// We already initialized the event with the correct values for a
 			// context timeout, so just return that.
-			return check.Result{
+			return score(withJumpHostError(check.Result{
 				Timestamp: time.Now(),
 				Metadata:  def.Metadata,
 				Passed:    false,
 				Message:   "check timed out",
 				Details:   nil,
-			}
+			}, tunnel), shared.Scoring)
 		case r := <-result:
 			close(result)
-			return r
+			return score(withJumpHostError(r, tunnel), shared.Scoring)
 		}
 	}
 }
 
-func unpackDef(config check.Config) (check.Check, error) {
+// withJumpHostError replaces the message of a failed result with the error
+// from connecting to the jump host, if there was one, so that jump host
+// failures aren't mistaken for failures of the target.
+func withJumpHostError(r check.Result, tunnel *check.Tunnel) check.Result {
+	if tunnel == nil || r.Passed {
+		return r
+	}
+	if err := tunnel.Err(); err != nil {
+		r.Message = fmt.Sprintf("Could not connect through %s", err)
+	}
+	return r
+}
+
+// sharedFields are the fields that the definitions of every check type can
+// have.
+type sharedFields struct {
+	JumpHost *check.JumpHost
+	Scoring  *check.Scoring
+}
+
+// score sets the score of a result. Results of checks without partial credit
+// scoring score 1 if they passed, and 0 otherwise.
+func score(r check.Result, scoring *check.Scoring) check.Result {
+	if scoring != nil {
+		scoring.Apply(&r)
+	} else if r.Passed {
+		r.Score = 1
+	}
+	return r
+}
+
+func unpackDef(config check.Config) (check.Check, sharedFields, error) {
+	var shared sharedFields
+
 	// Render any template strings in the definition
 	var renderedJSON []byte
 	templ := template.New("definition")
-	templ, err := templ.Parse(string(config.Definition))
+	templ, err := templ.Parse(checktypes.EscapePlaceholders(config.Type, string(config.Definition)))
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse template for check: %s", err.Error())
+		return nil, shared, fmt.Errorf("Failed to parse template for check: %s", err.Error())
 	}
 
 	var buf bytes.Buffer
 	err = templ.Execute(&buf, config.Attributes.Merged())
 	if err != nil {
-		return nil, fmt.Errorf("Failed to execute template for check: %s", err.Error())
+		return nil, shared, fmt.Errorf("Failed to execute template for check: %s", err.Error())
 	}
 
 	renderedJSON = buf.Bytes()
@@ -76,10 +123,35 @@ func unpackDef(config check.Config) (check.Check, error) {
 	def := checktypes.GetCheckType(config)
 	err = initCheck(config, renderedJSON, def)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unpack definition and apply attributes to check: %s", err)
+		return nil, shared, fmt.Errorf("failed to unpack definition and apply attributes to check: %s", err)
+	}
+
+	// Every check type can have a jump host and partial credit scoring
+	err = json.Unmarshal(renderedJSON, &shared)
+	if err != nil {
+		return nil, shared, fmt.Errorf("failed to unpack shared fields: %s", err)
+	}
+	if shared.JumpHost != nil {
+		if !checktypes.SupportsJumpHost(config.Type) {
+			return nil, shared, fmt.Errorf("%s checks can't connect through a jump host", config.Type)
+		}
+		err = processFields(shared.JumpHost, config.ID, config.Type)
+		if err != nil {
+			return nil, shared, fmt.Errorf("invalid jump host: %s", err)
+		}
+	}
+
+	if shared.Scoring != nil {
+		err = processFields(shared.Scoring, config.ID, config.Type)
+		if err == nil {
+			err = shared.Scoring.Validate(def)
+		}
+		if err != nil {
+			return nil, shared, fmt.Errorf("invalid scoring: %s", err)
+		}
 	}
 
-	return def, nil
+	return def, shared, nil
 }
 
 func initCheck(config check.Config, def []byte, chk check.Check) error {
@@ -0,0 +1,44 @@
+package run
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/http"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checktypes/tcp"
+)
+
+func TestUnpackDefPlaceholders(t *testing.T) {
+	attrs := check.Attributes{Admin: map[string]string{"Host": "10.0.0.1"}}
+
+	// The values that HTTP checks save are filled in when they run
+	def, _, err := unpackDef(check.Config{
+		Metadata:   check.Metadata{ID: "web", Type: "http"},
+		Definition: []byte(`{"Requests": [{"Host": "{{.Host}}", "Path": "/", "Extract": [{"Name": "CSRF", "Regex": "x"}]}, {"Host": "{{.Host}}", "Path": "/{{.CSRF}}"}]}`),
+		Attributes: attrs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := def.(*http.Definition).Requests
+	if requests[0].Host != "10.0.0.1" {
+		t.Errorf("got host %s, want 10.0.0.1", requests[0].Host)
+	}
+	if requests[1].Path != "/{{.CSRF}}" {
+		t.Errorf("got path %s, want /{{.CSRF}}", requests[1].Path)
+	}
+
+	// Other check types don't have placeholders of their own
+	def, _, err = unpackDef(check.Config{
+		Metadata:   check.Metadata{ID: "echo", Type: "tcp"},
+		Definition: []byte(`{"Host": "{{.Host}}", "Port": "7", "Send": "{{.Missing}}"}`),
+		Attributes: attrs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if send := def.(*tcp.Definition).Send; strings.Contains(send, "{{") {
+		t.Errorf("got send %s, want the placeholder to be rendered", send)
+	}
+}
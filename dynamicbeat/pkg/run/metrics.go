@@ -0,0 +1,49 @@
+package run
+
+import (
+	"strings"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/metrics"
+)
+
+// Prometheus metrics of the checks and rounds that have run.
+var (
+	checksTotal = metrics.NewCounterVec("dynamicbeat_checks_total",
+		"Checks that have finished, by check type and outcome. Checks with the error outcome failed because of how Dynamicbeat is set up to run them, rather than because of the service that they check.",
+		"type", "outcome")
+	checkDuration = metrics.NewHistogramVec("dynamicbeat_check_duration_seconds",
+		"How long checks ran for, by check type, not counting their jitter delay or the time that they waited for a free worker.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60},
+		"type")
+	roundDuration = metrics.NewHistogramVec("dynamicbeat_round_duration_seconds",
+		"How long rounds took, from when they started until their last check finished.",
+		[]float64{1, 5, 10, 15, 20, 25, 30, 45, 60, 120, 300})
+)
+
+func init() {
+	metrics.NewGaugeFunc("dynamicbeat_checks_in_flight", "Checks that are running.", func() float64 {
+		return float64(runningChecks.Value())
+	})
+	metrics.NewGaugeFunc("dynamicbeat_checks_queued", "Checks that are waiting for a free worker.", func() float64 {
+		return float64(queuedChecks.Value())
+	})
+}
+
+// record counts a finished check towards the metrics.
+func record(def check.Config, r check.Result) {
+	checksTotal.With(def.Type, outcome(r)).Inc()
+	checkDuration.With(def.Type).Observe(r.Elapsed.Seconds())
+}
+
+// outcome returns whether a check passed, failed, or couldn't be run because
+// of a problem on Dynamicbeat's side, like an invalid definition or source IP.
+func outcome(r check.Result) string {
+	switch {
+	case r.Passed:
+		return "passed"
+	case strings.HasPrefix(r.Message, unpackError), strings.Contains(r.Message, check.ConfigErrorPrefix):
+		return "error"
+	}
+	return "failed"
+}
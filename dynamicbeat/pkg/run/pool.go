@@ -0,0 +1,139 @@
+package run
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+)
+
+// Limits are the most checks that can run at once, in total, for each team,
+// and for each check type. A limit of 0 means that there is no limit.
+type Limits struct {
+	MaxChecks int
+	PerTeam   int
+	PerType   map[string]int
+}
+
+// Metrics of the worker pool, which are served by the metrics endpoint. The
+// queued and running checks are the current numbers, and the started checks
+// and the seconds that they waited in the queue are totals, so the average
+// wait is wait_seconds divided by started.
+var (
+	queuedChecks  = expvar.NewInt("dynamicbeat.checks.queued")
+	runningChecks = expvar.NewInt("dynamicbeat.checks.running")
+	startedChecks = expvar.NewInt("dynamicbeat.checks.started")
+	waitSeconds   = expvar.NewFloat("dynamicbeat.checks.wait_seconds")
+)
+
+// A pool limits how many checks run at once. Checks that are over a limit
+// wait in a queue until a running check finishes.
+type pool struct {
+	limits Limits
+	all    chan struct{}
+
+	mu    sync.Mutex
+	teams map[string]chan struct{}
+	types map[string]chan struct{}
+}
+
+// workers is the pool that every round runs its checks in, so that checks
+// that are still running from an earlier round count towards the limits.
+var workers = newPool(Limits{})
+
+// SetLimits sets how many checks can run at once.
+func SetLimits(l Limits) error {
+	if l.MaxChecks < 0 {
+		return fmt.Errorf("concurrency.max_checks %d must not be negative", l.MaxChecks)
+	}
+	if l.PerTeam < 0 {
+		return fmt.Errorf("concurrency.per_team %d must not be negative", l.PerTeam)
+	}
+	for t, n := range l.PerType {
+		if n < 0 {
+			return fmt.Errorf("concurrency.per_type limit %d of %s checks must not be negative", n, t)
+		}
+	}
+	workers = newPool(l)
+	return nil
+}
+
+func newPool(l Limits) *pool {
+	p := &pool{
+		limits: l,
+		teams:  make(map[string]chan struct{}),
+		types:  make(map[string]chan struct{}),
+	}
+	if l.MaxChecks > 0 {
+		p.all = make(chan struct{}, l.MaxChecks)
+	}
+	return p
+}
+
+// semaphores returns the semaphores that a check needs a slot in to run.
+// They are always taken in the same order, so that checks waiting for
+// different limits can't deadlock.
+func (p *pool) semaphores(def check.Config) []chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var sems []chan struct{}
+	if p.limits.PerTeam > 0 {
+		sem, ok := p.teams[def.Group]
+		if !ok {
+			sem = make(chan struct{}, p.limits.PerTeam)
+			p.teams[def.Group] = sem
+		}
+		sems = append(sems, sem)
+	}
+	if n := p.limits.PerType[def.Type]; n > 0 {
+		sem, ok := p.types[def.Type]
+		if !ok {
+			sem = make(chan struct{}, n)
+			p.types[def.Type] = sem
+		}
+		sems = append(sems, sem)
+	}
+	if p.all != nil {
+		sems = append(sems, p.all)
+	}
+	return sems
+}
+
+// acquire waits until a check can run without going over any of the limits,
+// and returns how long it waited and a function that frees its slots once it
+// has finished. It gives up if the context is done before then.
+func (p *pool) acquire(ctx context.Context, def check.Config) (time.Duration, func(), error) {
+	start := time.Now()
+	queuedChecks.Add(1)
+	sems := p.semaphores(def)
+	for i, sem := range sems {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			free(sems[:i])
+			queuedChecks.Add(-1)
+			return time.Since(start), nil, ctx.Err()
+		}
+	}
+	queuedChecks.Add(-1)
+	runningChecks.Add(1)
+
+	wait := time.Since(start)
+	startedChecks.Add(1)
+	waitSeconds.Add(wait.Seconds())
+	return wait, func() {
+		free(sems)
+		runningChecks.Add(-1)
+	}, nil
+}
+
+// free gives back a slot in each of the semaphores.
+func free(sems []chan struct{}) {
+	for _, sem := range sems {
+		<-sem
+	}
+}
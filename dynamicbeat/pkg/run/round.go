@@ -2,6 +2,8 @@ package run
 
 import (
 	"context"
+	"errors"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -9,20 +11,57 @@ import (
 	"go.uber.org/zap"
 )
 
+// roundMargin is how long before the next round starts that every check must
+// have finished by.
+const roundMargin = 5 * time.Second
+
+// clamped tracks the timeouts that have already been warned about as too long
+// for the round, by check ID, so that the warning isn't logged every round.
+var clamped = struct {
+	sync.Mutex
+	timeouts map[string]time.Duration
+}{timeouts: make(map[string]time.Duration)}
+
+// waitTolerance is the shortest wait for a worker that can be warned about,
+// since checks without a timeout don't have any time to spare.
+const waitTolerance = 100 * time.Millisecond
+
+// schedule tracks when each check last started and which checks are still
+// running, by check ID, so that checks with a period only run once it has
+// passed, and no check runs twice at once.
+var schedule = struct {
+	sync.Mutex
+	started map[string]time.Time
+	running map[string]bool
+}{started: make(map[string]time.Time), running: make(map[string]bool)}
+
 // Round : Run a course of checks based on the currently-loaded configuration.
-func Round(defs []check.Config, results chan<- check.Result, started chan<- bool) {
+// Checks without a timeout can run for as long as the round allows, which is
+// the round time minus a safety margin. With jitter, each check starts after
+// a random delay within the first jitter percent of the round, which is picked
+// again every round. Once the context is done, checks that haven't started
+// yet are skipped, and running checks are cancelled without publishing their
+// results, since they didn't fail on their own.
+func Round(ctx context.Context, defs []check.Config, roundTime time.Duration, jitter int, results chan<- check.Result, started chan<- bool) {
 	start := time.Now()
+	limit := maxTimeout(roundTime)
+	window := time.Duration(jitter) * roundTime / 100
+	if window > limit {
+		window = limit
+	}
 
 	// Make an event queue separate from the publisher queue so we can track
 	// which checks are still running
 	finished := make(chan check.Result, len(defs))
 
 	// Iterate over each check
-	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
-	defer cancel()
 	names := make(map[string]bool)
 	var wg sync.WaitGroup
 	for _, d := range defs {
+		if !due(d, start, roundTime) {
+			continue
+		}
+
 		// Start check goroutine
 		names[d.ID] = false
 		wg.Add(1)
@@ -30,10 +69,46 @@ func Round(defs []check.Config, results chan<- check.Result, started chan<- bool
 		def := d
 		go func() {
 			defer wg.Done()
+			defer done(def.ID)
+
+			timeout, delay := checkTiming(def, limit, window)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				zap.S().Infof("[%s] Dynamicbeat is stopping, so the check will not be started", def.ID)
+				return
+			}
+
+			// The timeout starts once the check gets a worker, so checks
+			// that waited in the queue for longer than they had to spare
+			// can run past the end of the round
+			wait, release, err := workers.acquire(ctx, def)
+			if err != nil {
+				zap.S().Infof("[%s] Dynamicbeat is stopping, so the check will not be started", def.ID)
+				return
+			}
+			defer release()
+			if spare := limit - delay - timeout; wait > spare && wait > waitTolerance {
+				zap.S().Warnf("[%s] Waited %s for a free worker, so it may not finish before the next round starts - raise the concurrency limits if this keeps happening", def.ID, wait.Round(time.Millisecond))
+			}
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
 
 			checkStart := time.Now()
-			result := Check(ctx, def)
-			zap.S().Debugf("[%s] Finished after %.2f seconds", result.ID, time.Since(checkStart).Seconds())
+			result := Check(checkCtx, def)
+			if errors.Is(checkCtx.Err(), context.Canceled) {
+				zap.S().Warnf("[%s] Check was cancelled because Dynamicbeat is stopping, so its result will not be published", def.ID)
+				return
+			}
+			result.Timeout = timeout
+			result.Elapsed = time.Since(checkStart)
+			result.SLA = def.SLA
+			result.RoundStart = start
+			result.Period = period(def, roundTime)
+			result.Delay = delay
+			result.Wait = wait
+			zap.S().Debugf("[%s] Finished after %.2f seconds", result.ID, result.Elapsed.Seconds())
+			record(def, result)
 			finished <- result
 		}()
 	}
@@ -41,28 +116,123 @@ func Round(defs []check.Config, results chan<- check.Result, started chan<- bool
 	// Signal that all checks have started
 	started <- true
 
-	// Wait for checks to finish
-	defer wg.Wait()
-	// zap.S().Infof("Checks started at %s have finished in %.2f seconds", start.Format("15:04:05.000"), time.Since(start).Seconds())
+	// Close the queue once every check has finished, so that the round only
+	// returns after all of its results have been published
 	go func() {
-		for {
-			if len(names) == 0 {
-				break
-			} else {
-				time.Sleep(30 * time.Second)
-				if len(names) > 0 {
-					zap.S().Warnf("Checks still running after %.2f seconds: %+v", time.Since(start).Seconds(), names)
-				}
-			}
-		}
-		zap.S().Infof("All checks started %.2f seconds ago have finished", time.Since(start).Seconds())
+		wg.Wait()
 		close(finished)
 	}()
-	for result := range finished {
-		// Record that the check has finished
-		delete(names, result.ID)
 
-		// Publish the event to the publisher queue
-		results <- result
+	running := time.NewTicker(30 * time.Second)
+	defer running.Stop()
+	for {
+		select {
+		case result, ok := <-finished:
+			if !ok {
+				roundDuration.With().Observe(time.Since(start).Seconds())
+				zap.S().Infof("All checks started %.2f seconds ago have finished", time.Since(start).Seconds())
+				return
+			}
+
+			// Record that the check has finished
+			delete(names, result.ID)
+
+			// Publish the event to the publisher queue
+			results <- result
+		case <-running.C:
+			if len(names) > 0 {
+				zap.S().Warnf("Checks still running after %.2f seconds: %+v", time.Since(start).Seconds(), names)
+			}
+		}
+	}
+}
+
+// maxTimeout returns the longest that checks can run for in a round, so that
+// they finish before the next round starts. Short rounds keep half of the
+// round time as the margin instead.
+func maxTimeout(roundTime time.Duration) time.Duration {
+	margin := roundMargin
+	if roundTime < 2*margin {
+		margin = roundTime / 2
+	}
+	return roundTime - margin
+}
+
+// period returns how often a check runs. Periods shorter than the round time
+// run the check every round.
+func period(def check.Config, roundTime time.Duration) time.Duration {
+	if def.Period < roundTime {
+		return roundTime
+	}
+	return def.Period
+}
+
+// due checks whether a check should start in the round that started at start,
+// and marks it as running if it should. A check is skipped if it is still
+// running from an earlier round, or if its period hasn't passed since it last
+// started. Rounds don't start exactly on time, so a period counts as passed if
+// less than half a round is left of it.
+func due(def check.Config, start time.Time, roundTime time.Duration) bool {
+	schedule.Lock()
+	defer schedule.Unlock()
+	if schedule.running[def.ID] {
+		zap.S().Warnf("[%s] Check is still running from an earlier round, so it will not be started this round", def.ID)
+		return false
+	}
+	last, ok := schedule.started[def.ID]
+	if ok && start.Sub(last) < period(def, roundTime)-roundTime/2 {
+		return false
+	}
+	schedule.started[def.ID] = start
+	schedule.running[def.ID] = true
+	return true
+}
+
+// done marks a check as no longer running.
+func done(id string) {
+	schedule.Lock()
+	defer schedule.Unlock()
+	delete(schedule.running, id)
+}
+
+// checkTiming returns the timeout that a check runs with, and a random delay
+// within the jitter window to start it after. The check must still finish
+// within the limit of the round, so checks with their own timeout get a
+// shorter delay if the timeout doesn't leave room for the whole window, and
+// checks without one get a shorter timeout instead.
+func checkTiming(def check.Config, limit time.Duration, window time.Duration) (time.Duration, time.Duration) {
+	timeout := checkTimeout(def, limit)
+	if window <= 0 {
+		return timeout, 0
+	}
+	if def.Timeout == 0 {
+		delay := time.Duration(rand.Int63n(int64(window)))
+		return limit - delay, delay
+	}
+	if room := limit - timeout; room < window {
+		window = room
+	}
+	if window <= 0 {
+		return timeout, 0
+	}
+	return timeout, time.Duration(rand.Int63n(int64(window)))
+}
+
+// checkTimeout returns the timeout that a check runs with: its own timeout if
+// it has one, clamped to the limit of the round.
+func checkTimeout(def check.Config, limit time.Duration) time.Duration {
+	if def.Timeout == 0 {
+		return limit
+	}
+	if def.Timeout <= limit {
+		return def.Timeout
+	}
+
+	clamped.Lock()
+	defer clamped.Unlock()
+	if clamped.timeouts[def.ID] != def.Timeout {
+		clamped.timeouts[def.ID] = def.Timeout
+		zap.S().Warnf("[%s] Timeout of %s is too long for the round time, so %s will be used instead", def.ID, def.Timeout, limit)
 	}
+	return limit
 }
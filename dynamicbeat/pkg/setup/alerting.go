@@ -0,0 +1,98 @@
+package setup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// esQueryVersion is the first version of Kibana with the Elasticsearch query
+// rule type that the default alerting rules use.
+var esQueryVersion = util.Version{Major: 7, Minor: 11}
+
+// alertRuleSteps builds the steps that add an alerting rule for each team,
+// which fires when the team's checks have failed AlertFailures times in the
+// last AlertFailures rounds. No steps are returned if AlertFailures is 0 or
+// Kibana is too old for the rules.
+func (c *Client) alertRuleSteps(teams []config.Team) (Plan, error) {
+	if c.AlertFailures <= 0 {
+		return nil, nil
+	}
+	if !c.Kibana.Version.IsZero() && c.Kibana.Version.Less(esQueryVersion) {
+		zap.S().Warnf("Kibana %s is too old for the check failure alerting rules, so they will not be added - they need Kibana %s or newer", c.Kibana.Version, esQueryVersion)
+		return nil, nil
+	}
+
+	var plan Plan
+	for _, team := range teams {
+		index := c.Namespace.Index(fmt.Sprintf("results-%s", team.Name))
+		rule, err := failureRule(c.Namespace, team.Name, index, c.AlertFailures, c.RoundTime)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, Step{
+			Kind:      "alert-rule",
+			Name:      c.Namespace.Name(fmt.Sprintf("scorestack-%s-check-failures", team.Name)),
+			Data:      rule,
+			DependsOn: []string{"index:" + index},
+		})
+	}
+	return plan, nil
+}
+
+// failureRule builds an Elasticsearch query rule that fires when a team has at
+// least failures failed results in its results index within the last failures
+// rounds, which
+// includes any check that has failed every one of those rounds. The rule
+// writes to the default action group so that operators can attach any
+// connector to it.
+func failureRule(ns config.Namespace, team string, index string, failures int, roundTime time.Duration) (func() io.Reader, error) {
+	if roundTime <= 0 {
+		roundTime = time.Minute
+	}
+
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{"passed": false}},
+				},
+				// SLA violations are published along with a failed result,
+				// so they would count the failure twice
+				"must_not": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{"event_type": check.EventSLAViolation}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode alerting rule query for team '%s': %s", team, err)
+	}
+
+	seconds := int(math.Ceil(roundTime.Seconds()))
+	return jsonData(map[string]interface{}{
+		"rule_type_id": ".es-query",
+		"consumer":     "alerts",
+		"tags":         []string{ns.Space(), team},
+		"schedule":     map[string]interface{}{"interval": fmt.Sprintf("%ds", seconds)},
+		"notify_when":  "onActionGroupChange",
+		"actions":      []interface{}{},
+		"params": map[string]interface{}{
+			"index":               []string{index},
+			"timeField":           "@timestamp",
+			"esQuery":             string(query),
+			"size":                100,
+			"timeWindowSize":      failures * seconds,
+			"timeWindowUnit":      "s",
+			"threshold":           []int{failures},
+			"thresholdComparator": ">=",
+		},
+	})
+}
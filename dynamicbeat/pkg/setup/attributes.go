@@ -0,0 +1,133 @@
+package setup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/checksource"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// An AttributeKind is the type of a check attribute, which determines who is
+// allowed to see and change it.
+type AttributeKind string
+
+const (
+	AdminAttributes AttributeKind = "admin" // attributes that only admins can see and change
+	UserAttributes  AttributeKind = "user"  // attributes that the check's team can see and change
+)
+
+// templateAction matches a template action in a check definition, like
+// {{.Username}}.
+var templateAction = regexp.MustCompile(`{{(.*?)}}`)
+
+// templateField matches a field reference inside of a template action.
+var templateField = regexp.MustCompile(`\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// AddAttributes sets attributes of a check, leaving any other attributes that
+// the check already has untouched. Attributes that aren't referenced by the
+// check's definition are rejected unless AllowUnreferencedAttributes is set.
+func (c *Client) AddAttributes(ctx context.Context, checkID string, kind AttributeKind, attribs map[string]string) error {
+	if kind != AdminAttributes && kind != UserAttributes {
+		return fmt.Errorf("invalid attribute kind '%s' - must be admin or user", kind)
+	}
+
+	// Look up the check to find its team and the attributes it references
+	res, err := c.Elasticsearch.Get(c.Namespace.Index("checkdef"), checkID, c.Elasticsearch.Get.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to get check '%s': %s", checkID, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("failed to get check '%s': %w", checkID, c.Elasticsearch.CloseAndCheck(res))
+	}
+	doc := struct {
+		Source struct {
+			Group      string                 `json:"group"`
+			Definition map[string]interface{} `json:"definition"`
+		} `json:"_source"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&doc)
+	if err != nil {
+		return fmt.Errorf("failed to decode check '%s': %s", checkID, err)
+	}
+
+	if !c.AllowUnreferencedAttributes {
+		def, err := json.Marshal(doc.Source.Definition)
+		if err != nil {
+			return fmt.Errorf("failed to encode definition of check '%s': %s", checkID, err)
+		}
+		referenced := referencedAttributes(string(def))
+
+		var unknown []string
+		for k := range attribs {
+			if !referenced[k] {
+				unknown = append(unknown, k)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return fmt.Errorf("check '%s' does not reference attributes: %s", checkID, strings.Join(unknown, ", "))
+		}
+	}
+
+	// Merge the attributes into the existing attribute document
+	body, err := json.Marshal(map[string]interface{}{
+		"doc":           attribs,
+		"doc_as_upsert": true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode attributes for check '%s': %s", checkID, err)
+	}
+	index := c.Namespace.Index(fmt.Sprintf("attrib_%s_%s", kind, doc.Source.Group))
+	zap.S().Infof("updating %s attributes for check %s", kind, checkID)
+	res, err = c.Elasticsearch.Update(index, checkID, bytes.NewReader(body), c.Elasticsearch.Update.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to update attributes for check '%s': %s", checkID, err)
+	}
+
+	return c.Elasticsearch.CloseAndCheck(res)
+}
+
+// AddTeamAttributes sets attributes of a check for every team, using the same
+// check ID format as check definition files. Attribute values are templated
+// with the team's overrides, as well as the team's name as Team.
+func (c *Client) AddTeamAttributes(ctx context.Context, baseID string, kind AttributeKind, attribs map[string]string, teams []config.Team) error {
+	return forEachTeam(teams, c.Concurrency, func(team config.Team) error {
+		vars := checksource.TeamOverrides(team)
+		if _, exists := vars["Team"]; !exists {
+			vars["Team"] = team.Name
+		}
+
+		templated := make(map[string]string)
+		for k, v := range attribs {
+			val, err := util.ApplyTemplating(v, vars)
+			if err != nil {
+				return fmt.Errorf("failed to template attribute '%s': %s", k, err)
+			}
+			templated[k] = val
+		}
+
+		return c.AddAttributes(ctx, fmt.Sprintf("%s-%s", baseID, team.Name), kind, templated)
+	})
+}
+
+// referencedAttributes finds the names of the attributes that are used in the
+// templates in a check definition.
+func referencedAttributes(def string) map[string]bool {
+	names := make(map[string]bool)
+	for _, action := range templateAction.FindAllStringSubmatch(def, -1) {
+		for _, field := range templateField.FindAllStringSubmatch(action[1], -1) {
+			names[field[1]] = true
+		}
+	}
+
+	return names
+}
@@ -4,61 +4,162 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/check"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/checksource"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
 	"go.uber.org/zap"
 )
 
-func Checks(c *esclient.Client, f *checksource.Filesystem) error {
+// CheckSummary counts what happened to each check that was added.
+type CheckSummary struct {
+	Added   int // checks that didn't exist before
+	Updated int // checks that already existed and were overwritten
+	Failed  int // checks that were invalid or couldn't be indexed
+}
+
+func Checks(ctx context.Context, c *esclient.Client, f *checksource.Filesystem) error {
+	_, err := addChecksFromDir(ctx, c, "", f)
+	return err
+}
+
+// AddCheck adds a single check definition and its attributes, overwriting the
+// check if it already exists.
+func (c *Client) AddCheck(ctx context.Context, def check.Config) error {
+	summary, err := addChecks(ctx, c.Elasticsearch, c.Namespace, []check.Config{def})
+	if err != nil {
+		return err
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("failed to add check '%s'", def.ID)
+	}
+
+	return nil
+}
+
+// AddChecksFromDir adds a copy of each check definition in a directory for
+// every team, overwriting any checks that already exist.
+func (c *Client) AddChecksFromDir(ctx context.Context, path string, teams []config.Team) (CheckSummary, error) {
+	return addChecksFromDir(ctx, c.Elasticsearch, c.Namespace, &checksource.Filesystem{
+		Path:  path,
+		Teams: teams,
+	})
+}
+
+func addChecksFromDir(ctx context.Context, c *esclient.Client, ns config.Namespace, f *checksource.Filesystem) (CheckSummary, error) {
 	zap.S().Infof("loading checks from %s", f.Path)
 	defs, err := f.LoadAll()
 	if err != nil {
-		return err
+		return CheckSummary{}, err
 	}
 
+	return addChecks(ctx, c, ns, defs)
+}
+
+func addChecks(ctx context.Context, c *esclient.Client, ns config.Namespace, defs []check.Config) (CheckSummary, error) {
+	var summary CheckSummary
+	results := newCheckResults()
+
 	indexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
 		Client: c.Client,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to build bulk indexer: %s", err)
+		return summary, fmt.Errorf("failed to build bulk indexer: %s", err)
 	}
 
 	for _, def := range defs {
+		err := def.Validate()
+		if err != nil {
+			zap.S().Errorf("skipping check due to error - %s", err)
+			summary.Failed++
+			continue
+		}
+
 		chk, generic, admin, user, err := def.Documents()
 		if err != nil {
 			zap.S().Errorf("skipping check due to error - %s", err)
+			summary.Failed++
+			continue
 		}
 
-		queueItem(indexer, "checkdef", def.ID, chk)
-		queueItem(indexer, "checks", def.ID, generic)
+		queueItem(ctx, indexer, ns.Index("checkdef"), true, def.ID, chk, results)
+		queueItem(ctx, indexer, ns.Index("checks"), false, def.ID, generic, results)
 		if admin != nil {
-			queueItem(indexer, fmt.Sprintf("attrib_admin_%s", def.Group), def.ID, admin)
+			queueItem(ctx, indexer, ns.Index(fmt.Sprintf("attrib_admin_%s", def.Group)), false, def.ID, admin, results)
 		}
 		if user != nil {
-			queueItem(indexer, fmt.Sprintf("attrib_user_%s", def.Group), def.ID, user)
+			queueItem(ctx, indexer, ns.Index(fmt.Sprintf("attrib_user_%s", def.Group)), false, def.ID, user, results)
 		}
 	}
 
 	zap.S().Info("waiting for checks to finish indexing...")
-	return indexer.Close(context.Background())
+	err = indexer.Close(ctx)
+
+	// A check only counts as added or updated if all of its documents were
+	// indexed
+	for id, created := range results.created {
+		if results.failed[id] {
+			continue
+		}
+		if created {
+			summary.Added++
+		} else {
+			summary.Updated++
+		}
+	}
+	summary.Failed += len(results.failed)
+	return summary, err
 }
 
-func queueItem(i esutil.BulkIndexer, index string, id string, body io.Reader) {
+// checkResults tracks the outcome of indexing the documents for each check.
+type checkResults struct {
+	mu      sync.Mutex
+	created map[string]bool // whether each check's definition was new
+	failed  map[string]bool // checks that had a document fail to index
+}
+
+func newCheckResults() *checkResults {
+	return &checkResults{
+		created: make(map[string]bool),
+		failed:  make(map[string]bool),
+	}
+}
+
+// queueItem adds a check document to a bulk request. Whether each check was
+// created is tracked from the result of indexing its definition document.
+func queueItem(ctx context.Context, i esutil.BulkIndexer, index string, definition bool, id string, body io.Reader, results *checkResults) {
 	err := i.Add(
-		context.Background(),
+		ctx,
 		esutil.BulkIndexerItem{
 			Index:      index,
 			Action:     "index",
 			DocumentID: id,
 			Body:       body,
+			OnSuccess: func(
+				ctx context.Context,
+				item esutil.BulkIndexerItem,
+				res esutil.BulkIndexerResponseItem,
+			) {
+				if !definition {
+					return
+				}
+				results.mu.Lock()
+				defer results.mu.Unlock()
+				results.created[id] = res.Result == "created"
+			},
 			OnFailure: func(
 				ctx context.Context,
 				item esutil.BulkIndexerItem,
 				res esutil.BulkIndexerResponseItem,
 				err error,
 			) {
+				results.mu.Lock()
+				results.failed[id] = true
+				results.mu.Unlock()
+
 				if err != nil {
 					zap.S().Errorf("failed to add document of id '%s' to index '%s': %s", id, index, err)
 				} else {
@@ -68,6 +169,9 @@ func queueItem(i esutil.BulkIndexer, index string, id string, body io.Reader) {
 		},
 	)
 	if err != nil {
-		zap.S().Errorf("failed to add document of id '%s' and index '%s' to bulk index queue: %s", err)
+		results.mu.Lock()
+		results.failed[id] = true
+		results.mu.Unlock()
+		zap.S().Errorf("failed to add document of id '%s' and index '%s' to bulk index queue: %s", id, index, err)
 	}
 }
@@ -0,0 +1,83 @@
+package setup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// The range of Elastic Stack versions that setup supports. The minimum is
+// inclusive, and the maximum is exclusive.
+var (
+	minimumVersion = util.Version{Major: 7}
+	maximumVersion = util.Version{Major: 8}
+)
+
+// An IncompatibleVersionError is returned when Elasticsearch or Kibana is a
+// version that setup doesn't support.
+type IncompatibleVersionError struct {
+	Service string       // the name of the service that is incompatible
+	Version util.Version // the version of the service
+}
+
+func (e *IncompatibleVersionError) Error() string {
+	return fmt.Sprintf("%s %s is not supported - the version must be at least %s and less than %s (set setup.skip_version_check to try anyway)", e.Service, e.Version, minimumVersion, maximumVersion)
+}
+
+// CheckCompatibility waits for Elasticsearch and Kibana to be ready, and then
+// checks that their versions are supported. The versions are stored in the
+// Elasticsearch and Kibana clients. If SkipVersionCheck is set, unsupported
+// versions are logged instead of being returned as an
+// IncompatibleVersionError.
+func (c *Client) CheckCompatibility(ctx context.Context) error {
+	err := c.checkElasticsearch(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.checkKibana(ctx)
+}
+
+func (c *Client) checkElasticsearch(ctx context.Context) error {
+	err := c.Elasticsearch.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	version, err := c.Elasticsearch.FetchVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.checkVersion("Elasticsearch", version)
+}
+
+func (c *Client) checkKibana(ctx context.Context) error {
+	err := c.Kibana.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	version, err := c.Kibana.FetchVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.checkVersion("Kibana", version)
+}
+
+func (c *Client) checkVersion(service string, version util.Version) error {
+	zap.S().Infof("detected %s version %s", service, version)
+	if !version.Less(minimumVersion) && version.Less(maximumVersion) {
+		return nil
+	}
+
+	err := &IncompatibleVersionError{Service: service, Version: version}
+	if c.SkipVersionCheck {
+		zap.S().Warnf("continuing anyway: %s", err)
+		return nil
+	}
+	return err
+}
@@ -1,61 +1,220 @@
 package setup
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"strings"
+	"io"
 
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets/indices"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets/transforms"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets/users"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 	"go.uber.org/zap"
 )
 
-func Elasticsearch(c *esclient.Client, teams []config.Team) error {
-	err := c.Wait()
+func Elasticsearch(ctx context.Context, c *esclient.Client, teams []config.Team) error {
+	err := c.Wait(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = c.AddUser("dynamicbeat", users.Dynamicbeat())
+	// The roles that users depend on are added to Kibana separately
+	client := &Client{Elasticsearch: c}
+	plan := client.elasticsearchPlan(teams).only(func(string) bool { return true })
+	p := &progress{total: elasticsearchSteps("") + len(plan)}
+	err = configureElasticsearch(ctx, c, p, client.Namespace, "")
 	if err != nil {
 		return err
 	}
+	_, err = client.apply(ctx, plan, p)
+	return err
+}
+
+// elasticsearchSteps returns the number of steps that are reported to the
+// progress function while configuring Elasticsearch, not including the steps
+// in the plan.
+func elasticsearchSteps(retention string) int {
+	steps := 4
+	if retention != "" {
+		steps++
+	}
+	return steps
+}
+
+// scoreboardTransform is the name of the transform that precomputes the
+// scoreboard into the scorestack-scoreboard index.
+const scoreboardTransform = "scorestack-scoreboard"
+
+// resultsPolicy is the name of the ILM policy that is attached to results
+// indices.
+const resultsPolicy = "scorestack-results"
 
+// configureElasticsearch adds the index templates and lifecycle policy that
+// need to be in place before any Scorestack indices in a namespace are
+// created.
+func configureElasticsearch(ctx context.Context, c *esclient.Client, p *progress, ns config.Namespace, retention string) error {
 	// Add default index template
+	name := ns.Name("default")
 	zap.S().Info("adding default index template")
-	idx := strings.NewReader(`{"index_patterns":["check*","attrib_*","results*"],"settings":{"number_of_replicas":"0"}}`)
-	res, err := c.Indices.PutTemplate("default", idx)
+	idx, err := json.Marshal(map[string]interface{}{
+		"index_patterns": []string{ns.Index("check*"), ns.Index("attrib_*"), ns.Index("results*")},
+		"settings":       map[string]interface{}{"number_of_replicas": "0"},
+	})
 	if err != nil {
-		return err
+		return p.step("index template: "+name, fmt.Errorf("failed to encode index template '%s': %s", name, err))
+	}
+	res, err := c.Indices.PutTemplate(name, bytes.NewReader(idx), c.Indices.PutTemplate.WithContext(ctx))
+	if err != nil {
+		return p.step("index template: "+name, err)
 	}
-	err = c.CloseAndCheck(res)
+	err = p.step("index template: "+name, c.CloseAndCheck(res))
 	if err != nil {
 		return err
 	}
 
-	// Create results indices
-	err = c.AddIndex("results-admin", indices.ResultsAdmin())
+	// Add the retention policy and templates for results indices
+	policy := ""
+	if retention != "" {
+		added, err := addResultsPolicy(ctx, c, p, ns.Name(resultsPolicy), retention)
+		if err != nil {
+			return err
+		}
+		if added {
+			policy = ns.Name(resultsPolicy)
+		}
+	}
+	return addIndexTemplates(ctx, c, p, ns, policy)
+}
+
+// elasticsearchPlan builds the steps that add the default Scorestack resources
+// to Elasticsearch.
+func (c *Client) elasticsearchPlan(teams []config.Team) Plan {
+	ns := c.Namespace
+	dynamicbeat := ns.Name(serviceAccount)
+	all := ns.Index("results-all")
+	plan := Plan{
+		{Kind: "user", Name: dynamicbeat, Data: namespaceUser(ns, users.Dynamicbeat), DependsOn: []string{"role:" + dynamicbeat}},
+		{Kind: "index", Name: ns.Index("results-admin"), Data: indices.ResultsAdmin},
+		{Kind: "index", Name: all, Data: indices.ResultsAll},
+
+		// Precompute the scoreboard from the results of every team
+		{Kind: "transform", Name: ns.Name(scoreboardTransform), Data: namespaceTransform(ns, transforms.Scoreboard), DependsOn: []string{"index:" + all}},
+	}
+
+	for _, team := range teams {
+		name := team.Name
+		user := ns.Name(name)
+		plan = append(plan,
+			Step{Kind: "user", Name: user, DependsOn: []string{"role:" + user}, Data: namespaceUser(ns, func() io.Reader {
+				return users.Team(name)
+			})},
+			Step{Kind: "index", Name: ns.Index(fmt.Sprintf("results-%s", name)), Data: indices.ResultsTeam},
+		)
+	}
+
+	return plan
+}
+
+// addResultsPolicy adds an ILM policy that deletes results indices once they
+// are older than the retention period, and returns whether the policy was
+// added. If ILM isn't available on the cluster, a warning is logged and the
+// policy is skipped.
+func addResultsPolicy(ctx context.Context, c *esclient.Client, p *progress, name string, retention string) (bool, error) {
+	policy, err := json.Marshal(map[string]interface{}{
+		"policy": map[string]interface{}{
+			"phases": map[string]interface{}{
+				"hot": map[string]interface{}{
+					"actions": map[string]interface{}{},
+				},
+				"delete": map[string]interface{}{
+					"min_age": retention,
+					"actions": map[string]interface{}{
+						"delete": map[string]interface{}{},
+					},
+				},
+			},
+		},
+	})
 	if err != nil {
-		return err
+		return false, fmt.Errorf("failed to encode ILM policy: %s", err)
+	}
+
+	err = c.AddILMPolicy(ctx, name, bytes.NewReader(policy))
+	if util.IsStatus(err, 400) || util.IsStatus(err, 404) {
+		zap.S().Warnf("ILM appears to be unavailable on this cluster, so results will not be deleted automatically: %s", err)
+		p.step(fmt.Sprintf("ILM policy: %s", name), nil)
+		return false, nil
 	}
-	err = c.AddIndex("results-all", indices.ResultsAll())
+	err = p.step(fmt.Sprintf("ILM policy: %s", name), err)
 	if err != nil {
-		return err
+		return false, err
 	}
+	return true, nil
+}
 
-	for _, team := range teams {
-		zap.S().Infof("adding user and results index for %s", team.Name)
-		err = c.AddUser(team.Name, users.Team(team.Name))
+// addIndexTemplates adds index templates for the indices that Dynamicbeat
+// writes to, so that any new indices get the correct mappings. If policy isn't
+// empty, it is attached to the results indices.
+func addIndexTemplates(ctx context.Context, c *esclient.Client, p *progress, ns config.Namespace, policy string) error {
+	templates := []struct {
+		name     string
+		patterns []string
+		priority int
+		index    func() io.Reader
+		policy   string
+	}{
+		{ns.Name("scorestack-results"), []string{ns.Index("results-*")}, 100, indices.ResultsTeam, policy},
+		{ns.Name("scorestack-results-all"), []string{ns.Index("results-all*")}, 200, indices.ResultsAll, policy},
+		{ns.Name("scorestack-checkdef"), []string{ns.Index("checkdef*")}, 100, indices.Checkdef, ""},
+	}
+
+	for _, t := range templates {
+		data, err := indexTemplate(t.patterns, t.priority, t.index(), t.policy)
 		if err != nil {
-			zap.S().Errorf("failed to add user for %s: %s", team.Name, err)
+			return p.step(fmt.Sprintf("index template: %s", t.name), fmt.Errorf("failed to build index template '%s': %s", t.name, err))
 		}
 
-		err = c.AddIndex(fmt.Sprintf("results-%s", team.Name), indices.ResultsTeam())
+		err = p.step(fmt.Sprintf("index template: %s", t.name), c.AddIndexTemplate(ctx, t.name, data))
 		if err != nil {
-			zap.S().Errorf("failed to add results index for %s: %s", team.Name, err)
+			return err
 		}
 	}
 
 	return nil
 }
+
+// indexTemplate builds a composable index template from an index definition.
+func indexTemplate(patterns []string, priority int, index io.Reader, policy string) (func() io.Reader, error) {
+	def := struct {
+		Aliases  map[string]interface{} `json:"aliases,omitempty"`
+		Mappings map[string]interface{} `json:"mappings,omitempty"`
+		Settings map[string]interface{} `json:"settings,omitempty"`
+	}{}
+	err := json.NewDecoder(index).Decode(&def)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode index definition: %s", err)
+	}
+	if policy != "" {
+		if def.Settings == nil {
+			def.Settings = make(map[string]interface{})
+		}
+		def.Settings["index.lifecycle.name"] = policy
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"index_patterns": patterns,
+		"priority":       priority,
+		"template":       def,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode index template: %s", err)
+	}
+
+	return func() io.Reader {
+		return bytes.NewReader(body)
+	}, nil
+}
@@ -0,0 +1,284 @@
+package setup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/kibclient"
+)
+
+// fakeCluster is an in-memory Elasticsearch cluster and Kibana server, which
+// handles the parts of their APIs that setup uses.
+type fakeCluster struct {
+	mu      sync.Mutex
+	spaces  map[string]json.RawMessage
+	roles   map[string]json.RawMessage
+	users   map[string]json.RawMessage
+	passwds map[string]string // the passwords of the users, which are never returned
+	indices map[string]map[string]json.RawMessage
+	objects map[string]map[string]json.RawMessage // saved objects by space, then by ID
+	scrolls map[string][]esclient.Document
+}
+
+func newFakeCluster() *fakeCluster {
+	f := &fakeCluster{}
+	f.wipe()
+	return f
+}
+
+// wipe deletes everything in the cluster.
+func (f *fakeCluster) wipe() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.spaces = make(map[string]json.RawMessage)
+	f.roles = make(map[string]json.RawMessage)
+	f.users = make(map[string]json.RawMessage)
+	f.passwds = make(map[string]string)
+	f.indices = make(map[string]map[string]json.RawMessage)
+	f.objects = make(map[string]map[string]json.RawMessage)
+	f.scrolls = make(map[string][]esclient.Document)
+}
+
+// client creates a setup client for the cluster.
+func (f *fakeCluster) client(t *testing.T) *Client {
+	t.Helper()
+	es := httptest.NewServer(http.HandlerFunc(f.elasticsearch))
+	t.Cleanup(es.Close)
+	kib := httptest.NewServer(http.HandlerFunc(f.kibana))
+	t.Cleanup(kib.Close)
+
+	esClient, err := esclient.NewFromConfig(elasticsearch.Config{Addresses: []string{es.URL}, DisableRetry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Client{
+		Elasticsearch: esClient,
+		Kibana:        kibclient.NewWithTransport([]string{kib.URL}, "", "", http.DefaultTransport),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// withField returns a JSON object with a field set.
+func withField(obj []byte, field string, value interface{}) json.RawMessage {
+	m := make(map[string]interface{})
+	_ = json.Unmarshal(obj, &m)
+	m[field] = value
+	out, _ := json.Marshal(m)
+	return out
+}
+
+func (f *fakeCluster) elasticsearch(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 3 && parts[0] == "_security" && parts[1] == "user":
+		name := parts[2]
+		switch r.Method {
+		case "GET":
+			user, ok := f.users[name]
+			if !ok {
+				writeJSON(w, 404, map[string]interface{}{})
+				return
+			}
+			writeJSON(w, 200, map[string]json.RawMessage{name: user})
+		case "PUT", "POST":
+			// Like Elasticsearch, passwords are never returned
+			user := make(map[string]interface{})
+			_ = json.Unmarshal(body, &user)
+			f.passwds[name], _ = user["password"].(string)
+			delete(user, "password")
+			user["username"] = name
+			f.users[name], _ = json.Marshal(user)
+			writeJSON(w, 200, map[string]bool{"created": true})
+		}
+	case len(parts) == 4 && parts[0] == "_security" && parts[1] == "user" && parts[3] == "_password":
+		if _, ok := f.users[parts[2]]; !ok {
+			writeJSON(w, 404, map[string]interface{}{})
+			return
+		}
+		password := struct {
+			Password string `json:"password"`
+		}{}
+		_ = json.Unmarshal(body, &password)
+		f.passwds[parts[2]] = password.Password
+		writeJSON(w, 200, map[string]interface{}{})
+	case len(parts) == 3 && parts[0] == "_cat" && parts[1] == "indices":
+		var names []map[string]string
+		for index := range f.indices {
+			for _, pattern := range strings.Split(parts[2], ",") {
+				if ok, _ := path.Match(pattern, index); ok {
+					names = append(names, map[string]string{"index": index})
+					break
+				}
+			}
+		}
+		sort.Slice(names, func(i, j int) bool { return names[i]["index"] < names[j]["index"] })
+		writeJSON(w, 200, names)
+	case len(parts) == 2 && parts[1] == "_search" && r.Method == "GET":
+		docs := f.indices[parts[0]]
+		ids := make([]string, 0, len(docs))
+		for id := range docs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		var hits []esclient.Document
+		for _, id := range ids {
+			hits = append(hits, esclient.Document{Index: parts[0], ID: id, Source: docs[id]})
+		}
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		if size > 10000 {
+			writeJSON(w, 400, map[string]string{"error": "Result window is too large"})
+			return
+		}
+		id := fmt.Sprintf("scroll-%d", len(f.scrolls))
+		f.scrolls[id] = hits
+		f.page(w, id, size)
+	case r.URL.Path == "/_search/scroll" && r.Method == "GET":
+		f.page(w, r.URL.Query().Get("scroll_id"), 1000)
+	case len(parts) == 3 && parts[0] == "_search" && parts[1] == "scroll" && r.Method == "DELETE":
+		delete(f.scrolls, parts[2])
+		writeJSON(w, 200, map[string]bool{"succeeded": true})
+	case len(parts) == 3 && parts[1] == "_doc" && (r.Method == "PUT" || r.Method == "POST"):
+		if f.indices[parts[0]] == nil {
+			f.indices[parts[0]] = make(map[string]json.RawMessage)
+		}
+		f.indices[parts[0]][parts[2]] = body
+		writeJSON(w, 201, map[string]string{"result": "created"})
+	default:
+		writeJSON(w, 404, map[string]string{"error": fmt.Sprintf("unhandled request %s %s", r.Method, r.URL.Path)})
+	}
+}
+
+// page writes the next page of a scroll.
+func (f *fakeCluster) page(w http.ResponseWriter, id string, size int) {
+	hits, ok := f.scrolls[id]
+	if !ok {
+		writeJSON(w, 404, map[string]string{"error": "search_context_missing_exception"})
+		return
+	}
+	if size > len(hits) {
+		size = len(hits)
+	}
+	f.scrolls[id] = hits[size:]
+	writeJSON(w, 200, map[string]interface{}{
+		"_scroll_id": id,
+		"hits":       map[string]interface{}{"hits": hits[:size]},
+	})
+}
+
+func (f *fakeCluster) kibana(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	space := ""
+	p := r.URL.Path
+	if strings.HasPrefix(p, "/s/") {
+		parts := strings.SplitN(strings.TrimPrefix(p, "/s/"), "/", 2)
+		space, p = parts[0], "/"+parts[1]
+	}
+
+	switch {
+	case strings.HasPrefix(p, "/api/spaces/space"):
+		name := strings.TrimPrefix(strings.TrimPrefix(p, "/api/spaces/space"), "/")
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.Method {
+		case "GET":
+			space, ok := f.spaces[name]
+			if !ok {
+				writeJSON(w, 404, map[string]string{"error": "Not Found"})
+				return
+			}
+			writeJSON(w, 200, space)
+		case "PUT":
+			if _, ok := f.spaces[name]; !ok {
+				writeJSON(w, 404, map[string]string{"error": "Not Found"})
+				return
+			}
+			f.spaces[name] = body
+			writeJSON(w, 200, json.RawMessage(body))
+		case "POST":
+			created := struct {
+				ID string `json:"id"`
+			}{}
+			_ = json.Unmarshal(body, &created)
+			if created.ID == "" {
+				writeJSON(w, 400, map[string]string{"message": "[request body.id]: expected value of type [string] but got [undefined]"})
+				return
+			}
+			if _, ok := f.spaces[created.ID]; ok {
+				writeJSON(w, 409, map[string]string{"error": "Conflict"})
+				return
+			}
+			f.spaces[created.ID] = body
+			writeJSON(w, 200, json.RawMessage(body))
+		}
+	case strings.HasPrefix(p, "/api/security/role/"):
+		name := strings.TrimPrefix(p, "/api/security/role/")
+		switch r.Method {
+		case "GET":
+			role, ok := f.roles[name]
+			if !ok {
+				writeJSON(w, 404, map[string]string{"error": "Not Found"})
+				return
+			}
+			// Kibana adds the name and metadata to the role
+			role = withField(role, "name", name)
+			role = withField(role, "transient_metadata", map[string]bool{"enabled": true})
+			writeJSON(w, 200, role)
+		case "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			f.roles[name] = body
+			w.WriteHeader(204)
+		}
+	case p == "/api/saved_objects/_export" && r.Method == "POST":
+		ids := make([]string, 0, len(f.objects[space]))
+		for id := range f.objects[space] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		w.Header().Set("Content-Type", "application/ndjson")
+		for _, id := range ids {
+			fmt.Fprintf(w, "%s\n", f.objects[space][id])
+		}
+	case p == "/api/saved_objects/_import" && r.Method == "POST":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeJSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		if f.objects[space] == nil {
+			f.objects[space] = make(map[string]json.RawMessage)
+		}
+		count := 0
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			obj := struct {
+				ID string `json:"id"`
+			}{}
+			_ = json.Unmarshal([]byte(line), &obj)
+			f.objects[space][obj.ID] = json.RawMessage(line)
+			count++
+		}
+		writeJSON(w, 200, map[string]interface{}{"success": true, "successCount": count})
+	default:
+		writeJSON(w, 404, map[string]string{"error": fmt.Sprintf("unhandled request %s %s", r.Method, r.URL.Path)})
+	}
+}
@@ -1,103 +1,168 @@
 package setup
 
 import (
-	"crypto/tls"
-	"net/http"
-	"strings"
-	"time"
+	"context"
+	"fmt"
+	"io"
 
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets/dashboards"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets/roles"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets/spaces"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/kibclient"
-	"go.uber.org/zap"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
 )
 
-func Kibana(host string, user string, pass string, verify bool, teams []config.Team) error {
-	// Configure TLS verification based on the Dynamicbeat config setting
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: !verify,
-		},
-	}
-
-	c := kibclient.Client{
-		Inner:    http.Client{Transport: tr, Timeout: 5 * time.Second},
-		Username: user,
-		Password: pass,
-		Host:     host,
-	}
-
-	err := c.Wait()
+func Kibana(ctx context.Context, c *kibclient.Client, teams []config.Team) error {
+	err := c.Wait(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Add Dynamicbeat role
-	err = c.AddRole("dynamicbeat", roles.Dynamicbeat())
+	client := &Client{Kibana: c}
+	plan, err := client.kibanaPlan(teams)
 	if err != nil {
 		return err
 	}
+	_, err = client.Apply(ctx, plan)
+	return err
+}
 
-	// Add Scorestack space
-	err = c.AddSpace("scorestack", spaces.Scorestack)
-	if err != nil {
-		return err
-	}
+// scoreboardID is the ID of the Scoreboard dashboard.
+const scoreboardID = "scorestack-scoreboard"
 
-	zap.S().Info("enabling dark theme")
-	valTrue := strings.NewReader(`{"value":"true"}`)
-	err = c.CheckedReq("POST", "/api/kibana/settings/theme:darkMode", valTrue)
+// resultsDataView is the title of the data view for the results indices.
+const resultsDataView = "results-*"
+
+// kibanaPlan builds the steps that add the default Scorestack resources to
+// Kibana.
+func (c *Client) kibanaPlan(teams []config.Team) (Plan, error) {
+	ns := c.Namespace
+	role, err := GenerateDynamicbeatRole(ns)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	valTrue = strings.NewReader(`{"value":"true"}`)
-	err = c.CheckedReq("POST", "/s/scorestack/api/kibana/settings/theme:darkMode", valTrue)
+	dynamicbeat, err := readerData(role)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// Add base role for common permissions
-	err = c.AddRole("common", roles.Common())
+	role, err = GenerateAdminRole(ns)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// Add spectator role
-	err = c.AddRole("spectator", roles.Spectator())
+	admin, err := readerData(role)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Add admin roles
-	err = c.AddRole("attribute-admin", roles.AttributeAdmin())
-	if err != nil {
-		return err
-	}
-	err = c.AddRole("check-admin", roles.AttributeAdmin())
-	if err != nil {
-		return err
+	space := "space:" + ns.Space()
+	plan := Plan{
+		{Kind: "role", Name: ns.Name(serviceAccount), Data: dynamicbeat},
+		{Kind: "space", Name: ns.Space(), Data: namespaceSpace(ns, spaces.Scorestack)},
+		{Kind: "role", Name: ns.Name("common"), Data: namespaceRole(ns, roles.Common)},
+		{Kind: "role", Name: ns.Name("spectator"), Data: namespaceRole(ns, roles.Spectator)},
+		{Kind: "role", Name: ns.Name("attribute-admin"), Data: namespaceRole(ns, roles.AttributeAdmin)},
+		{Kind: "role", Name: ns.Name("check-admin"), Data: namespaceRole(ns, roles.AttributeAdmin)},
+		{Kind: "role", Name: ns.Name("scorestack-admin"), Data: admin},
 	}
 
-	// Add Scoreboard dashboard
-	err = c.AddDashboard(dashboards.Scoreboard)
+	darkMode, err := jsonData(map[string]interface{}{"theme:darkMode": true})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	plan = append(plan, Step{Kind: "kibana-settings", Name: "default", Data: darkMode})
 
-	for _, team := range teams {
-		err = c.AddRole(team.Name, roles.Team(team.Name))
+	// Add data views for results before the dashboards that use them. The
+	// default space is shared with other namespaces, so only the default
+	// namespace adds dashboards there.
+	views := ns.Index(resultsDataView)
+	dashboardSpaces := []string{ns.Space()}
+	if ns.IsDefault() {
+		dashboardSpaces = []string{"default", ns.Space()}
+	}
+	scoreboardDeps := []string{space}
+	for _, s := range dashboardSpaces {
+		view, err := jsonData(map[string]interface{}{
+			"space":      spaceID(s),
+			"title":      views,
+			"time_field": "@timestamp",
+		})
 		if err != nil {
-			zap.S().Errorf("failed to add role for %s: %s", team.Name, err)
+			return nil, err
 		}
-
-		// TODO: don't hardcode the number of rows in the table
-		err = c.AddDashboard(dashboards.TeamOverview(team.Name, 20))
-		if err != nil {
-			zap.S().Errorf("failed to add team overview dashboard for %s: %s", team.Name, err)
+		step := Step{
+			Kind:      "data-view",
+			Name:      fmt.Sprintf("%s/%s", s, views),
+			Data:      view,
+			DependsOn: []string{space},
 		}
+		plan = append(plan, step)
+		scoreboardDeps = append(scoreboardDeps, step.ID())
+	}
+	teamDeps := []string{space, fmt.Sprintf("data-view:%s/%s", ns.Space(), views)}
+
+	plan = append(plan,
+		Step{
+			Kind:      "dashboard",
+			Name:      "scoreboard",
+			Data:      namespaceDashboard(ns, dashboards.Scoreboard),
+			DependsOn: scoreboardDeps,
+		},
+
+		// Send users in the Scorestack space to the scoreboard when they log in
+		Step{
+			Kind:      "kibana-settings",
+			Name:      ns.Space(),
+			DependsOn: []string{"dashboard:scoreboard"},
+			Data: func() io.Reader {
+				// The dashboard's path depends on the Kibana version, which
+				// isn't known until the steps are applied
+				return jsonReader(map[string]interface{}{
+					"theme:darkMode": true,
+					"defaultIndex":   kibclient.DataViewID(views),
+					"defaultRoute":   dashboardRoute(c.Kibana.Version, scoreboardID),
+				})
+			},
+		},
+	)
+
+	for _, team := range teams {
+		name := team.Name
+		plan = append(plan,
+			Step{Kind: "role", Name: ns.Name(name), Data: namespaceRole(ns, func() io.Reader {
+				return roles.Team(name)
+			})},
+			// TODO: don't hardcode the number of rows in the table
+			Step{
+				Kind:      "dashboard",
+				Name:      fmt.Sprintf("team-overview-%s", name),
+				Data:      namespaceDashboard(ns, dashboards.TeamOverview(name, 20)),
+				DependsOn: teamDeps,
+			},
+		)
+	}
+
+	alerts, err := c.alertRuleSteps(teams)
+	if err != nil {
+		return nil, err
 	}
+	return append(plan, alerts...), nil
+}
 
-	return nil
+// spaceID converts the name of a Kibana space in a plan to the space ID that
+// the Kibana client expects, where the default space is an empty ID.
+func spaceID(space string) string {
+	if space == "default" {
+		return ""
+	}
+	return space
+}
+
+// dashboardRoute returns the path of a dashboard in Kibana. The dashboards app
+// moved to its own path in Kibana 7.10.
+func dashboardRoute(version util.Version, id string) string {
+	if !version.IsZero() && version.Less(util.Version{Major: 7, Minor: 10}) {
+		return fmt.Sprintf("/app/kibana#/dashboard/%s", id)
+	}
+	return fmt.Sprintf("/app/dashboards#/view/%s", id)
 }
@@ -0,0 +1,132 @@
+package setup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+)
+
+// namespaced returns a step data function that rewrites a JSON definition
+// from the embedded assets so that it refers to the resources of a namespace.
+// Definitions are returned untouched in the default namespace.
+func namespaced(ns config.Namespace, data func() io.Reader, rewrite func(def map[string]interface{})) func() io.Reader {
+	if ns.IsDefault() {
+		return data
+	}
+
+	return func() io.Reader {
+		def := make(map[string]interface{})
+		err := json.NewDecoder(data()).Decode(&def)
+		if err != nil {
+			// The embedded assets are always valid, but an empty body will
+			// fail to apply if they aren't
+			return &bytes.Buffer{}
+		}
+		rewrite(def)
+		return jsonReader(def)
+	}
+}
+
+// namespaceRole rewrites the index names and Kibana spaces in a role
+// definition.
+func namespaceRole(ns config.Namespace, data func() io.Reader) func() io.Reader {
+	return namespaced(ns, data, func(def map[string]interface{}) {
+		es, _ := def["elasticsearch"].(map[string]interface{})
+		indices, _ := es["indices"].([]interface{})
+		for _, i := range indices {
+			if privileges, ok := i.(map[string]interface{}); ok {
+				mapStrings(privileges["names"], ns.Index)
+			}
+		}
+
+		kibana, _ := def["kibana"].([]interface{})
+		for _, k := range kibana {
+			if privileges, ok := k.(map[string]interface{}); ok {
+				mapStrings(privileges["spaces"], func(space string) string {
+					if space == config.DefaultNamespace {
+						return ns.Space()
+					}
+					return space
+				})
+			}
+		}
+	})
+}
+
+// namespaceUser rewrites the roles in a user definition.
+func namespaceUser(ns config.Namespace, data func() io.Reader) func() io.Reader {
+	return namespaced(ns, data, func(def map[string]interface{}) {
+		mapStrings(def["roles"], ns.Name)
+	})
+}
+
+// namespaceSpace rewrites the ID of a Kibana space definition, and names the
+// space after the namespace.
+func namespaceSpace(ns config.Namespace, data func() io.Reader) func() io.Reader {
+	return namespaced(ns, data, func(def map[string]interface{}) {
+		def["id"] = ns.Space()
+		def["name"] = ns.Space()
+	})
+}
+
+// namespaceDashboard rewrites the titles of the index patterns in a dashboard
+// export.
+func namespaceDashboard(ns config.Namespace, data func() io.Reader) func() io.Reader {
+	return namespaced(ns, data, func(def map[string]interface{}) {
+		objects, _ := def["objects"].([]interface{})
+		for _, o := range objects {
+			obj, _ := o.(map[string]interface{})
+			attrs, _ := obj["attributes"].(map[string]interface{})
+			if title, ok := attrs["title"].(string); ok && obj["type"] == "index-pattern" {
+				attrs["title"] = ns.Index(title)
+			}
+		}
+	})
+}
+
+// namespaceTransform rewrites the source and destination indices of a
+// transform definition. The destination is named like other Scorestack
+// objects, so scorestack-scoreboard becomes ctf-scoreboard.
+func namespaceTransform(ns config.Namespace, data func() io.Reader) func() io.Reader {
+	return namespaced(ns, data, func(def map[string]interface{}) {
+		source, _ := def["source"].(map[string]interface{})
+		mapStrings(source["index"], ns.Index)
+		if dest, ok := def["dest"].(map[string]interface{}); ok {
+			if index, ok := dest["index"].(string); ok {
+				dest["index"] = ns.Name(index)
+			}
+		}
+	})
+}
+
+// namespaceNames returns the names of cluster-wide objects in a namespace.
+func namespaceNames(ns config.Namespace, names ...string) []string {
+	namespaced := make([]string, 0, len(names))
+	for _, name := range names {
+		namespaced = append(namespaced, ns.Name(name))
+	}
+	return namespaced
+}
+
+// namespaceIndices returns the names of indices or index patterns in a
+// namespace.
+func namespaceIndices(ns config.Namespace, indices ...string) []string {
+	namespaced := make([]string, 0, len(indices))
+	for _, index := range indices {
+		namespaced = append(namespaced, ns.Index(index))
+	}
+	return namespaced
+}
+
+// mapStrings replaces each string in a decoded JSON array with the result of
+// f. Values that aren't strings are left untouched.
+func mapStrings(v interface{}, f func(string) string) {
+	values, _ := v.([]interface{})
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			values[i] = f(s)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package setup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Step is a single resource for Apply to add to Kibana or Elasticsearch.
+type Step struct {
+	Kind      string           // the kind of resource, like role or index
+	Name      string           // the name of the resource
+	Data      func() io.Reader // returns the definition of the resource
+	DependsOn []string         // the IDs of the steps that must succeed before this step runs
+}
+
+// ID returns the identifier that other steps use to depend on a step, like
+// role:common.
+func (s Step) ID() string {
+	return fmt.Sprintf("%s:%s", s.Kind, s.Name)
+}
+
+// A Plan is an ordered list of steps. Steps run in order, except that a step
+// never runs before the steps that it depends on.
+type Plan []Step
+
+// A StepResult is the outcome of applying a single step.
+type StepResult struct {
+	ID      string
+	Err     error // the error that occurred while applying the step, if any
+	Skipped bool  // whether the step was skipped because a dependency failed
+}
+
+// StepErrors collects the errors for each step that failed or was skipped
+// during Apply, keyed by step ID.
+type StepErrors map[string]error
+
+func (e StepErrors) Error() string {
+	ids := make([]string, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	msgs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", id, e[id]))
+	}
+	return fmt.Sprintf("failed to apply %d steps: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// A stepFunc adds the resource described by a step.
+type stepFunc func(ctx context.Context, c *Client, s Step) error
+
+// stepKinds are the kinds of resources that can be added by a step, in the
+// order that LoadPlan adds them.
+var stepKinds = []string{"space", "role", "user", "index-template", "index", "transform", "data-view", "dashboard", "alert-rule", "kibana-settings"}
+
+// stepFuncs add each kind of resource.
+var stepFuncs = map[string]stepFunc{
+	"space": func(ctx context.Context, c *Client, s Step) error {
+		return c.Kibana.AddSpace(ctx, s.Name, s.Data)
+	},
+	"role": func(ctx context.Context, c *Client, s Step) error {
+		return c.Kibana.AddRole(ctx, s.Name, s.Data())
+	},
+	"user": func(ctx context.Context, c *Client, s Step) error {
+		return c.Elasticsearch.AddUser(ctx, s.Name, s.Data())
+	},
+	"index-template": func(ctx context.Context, c *Client, s Step) error {
+		return c.Elasticsearch.AddIndexTemplate(ctx, s.Name, s.Data)
+	},
+	"index": func(ctx context.Context, c *Client, s Step) error {
+		return c.Elasticsearch.AddIndex(ctx, s.Name, s.Data)
+	},
+	"transform": func(ctx context.Context, c *Client, s Step) error {
+		return c.Elasticsearch.AddTransform(ctx, s.Name, s.Data())
+	},
+	"data-view": func(ctx context.Context, c *Client, s Step) error {
+		view := struct {
+			Space     string `json:"space"`
+			Title     string `json:"title"`
+			TimeField string `json:"time_field"`
+		}{}
+		err := json.NewDecoder(s.Data()).Decode(&view)
+		if err != nil {
+			return fmt.Errorf("failed to decode data view: %s", err)
+		}
+		_, err = c.Kibana.AddDataView(ctx, view.Space, view.Title, view.TimeField)
+		return err
+	},
+	"dashboard": func(ctx context.Context, c *Client, s Step) error {
+		_, _, err := c.Kibana.AddDashboard(ctx, s.Data)
+		return err
+	},
+	"alert-rule": func(ctx context.Context, c *Client, s Step) error {
+		return c.Kibana.AddAlertRule(ctx, s.Name, s.Data())
+	},
+	"kibana-settings": func(ctx context.Context, c *Client, s Step) error {
+		settings := make(map[string]interface{})
+		err := json.NewDecoder(s.Data()).Decode(&settings)
+		if err != nil {
+			return fmt.Errorf("failed to decode settings: %s", err)
+		}
+		return c.Kibana.SetSpaceDefaults(ctx, spaceID(s.Name), settings)
+	},
+}
+
+// kibanaKinds are the kinds of steps that add resources to Kibana.
+var kibanaKinds = map[string]bool{"space": true, "role": true, "data-view": true, "dashboard": true, "alert-rule": true, "kibana-settings": true}
+
+// only returns the steps in a plan whose kinds are accepted by keep.
+// Dependencies on steps that were removed are dropped.
+func (p Plan) only(keep func(kind string) bool) Plan {
+	kept := make(map[string]bool)
+	var filtered Plan
+	for _, s := range p {
+		if keep(s.Kind) {
+			kept[s.ID()] = true
+			filtered = append(filtered, s)
+		}
+	}
+
+	for i, s := range filtered {
+		var deps []string
+		for _, dep := range s.DependsOn {
+			if kept[dep] {
+				deps = append(deps, dep)
+			}
+		}
+		filtered[i].DependsOn = deps
+	}
+	return filtered
+}
+
+// validate checks that every step in a plan has a known kind and a unique ID,
+// and that the dependencies exist and don't form a cycle.
+func (p Plan) validate() error {
+	steps := make(map[string]Step)
+	for _, s := range p {
+		if _, ok := stepFuncs[s.Kind]; !ok {
+			return fmt.Errorf("step '%s' has unknown kind '%s' - must be one of %s", s.ID(), s.Kind, strings.Join(stepKinds, ", "))
+		}
+		if s.Data == nil {
+			return fmt.Errorf("step '%s' has no data", s.ID())
+		}
+		if _, exists := steps[s.ID()]; exists {
+			return fmt.Errorf("step '%s' appears more than once", s.ID())
+		}
+		steps[s.ID()] = s
+	}
+
+	// Look for cycles with a depth-first search
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(id string, path []string) error
+	visit = func(id string, path []string) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("steps depend on each other in a cycle: %s", strings.Join(append(path, id), " -> "))
+		case visited:
+			return nil
+		}
+
+		state[id] = visiting
+		for _, dep := range steps[id].DependsOn {
+			if _, ok := steps[dep]; !ok {
+				return fmt.Errorf("step '%s' depends on unknown step '%s'", id, dep)
+			}
+			err := visit(dep, append(path, id))
+			if err != nil {
+				return err
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	for _, s := range p {
+		err := visit(s.ID(), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Apply adds the resources in a plan, and returns the result of each step in
+// the order that the steps finished. Up to Concurrency steps run at the same
+// time, and a step only starts once all of its dependencies have succeeded.
+// Steps whose dependencies failed are skipped, but every other step is still
+// applied. If any steps failed or were skipped, the returned error is a
+// StepErrors.
+func (c *Client) Apply(ctx context.Context, plan Plan) ([]StepResult, error) {
+	return c.apply(ctx, plan, &progress{f: c.Progress, total: len(plan)})
+}
+
+func (c *Client) apply(ctx context.Context, plan Plan, p *progress) ([]StepResult, error) {
+	err := plan.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := c.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	done := make(map[string]error, len(plan))
+	started := make([]bool, len(plan))
+	finished := make(chan StepResult)
+	results := make([]StepResult, 0, len(plan))
+	errs := make(StepErrors)
+	finish := func(r StepResult) {
+		done[r.ID] = r.Err
+		results = append(results, r)
+		if r.Err != nil {
+			errs[r.ID] = r.Err
+		}
+	}
+
+	running := 0
+	for len(results) < len(plan) {
+		// Start every step that is ready, in plan order
+		for i, s := range plan {
+			if started[i] || running >= concurrency {
+				continue
+			}
+
+			ready := true
+			var failed string
+			for _, dep := range s.DependsOn {
+				depErr, ok := done[dep]
+				if !ok {
+					ready = false
+				} else if depErr != nil {
+					failed = dep
+				}
+			}
+			if failed != "" {
+				started[i] = true
+				err := fmt.Errorf("skipped because '%s' failed", failed)
+				p.step(fmt.Sprintf("%s: %s", s.Kind, s.Name), err)
+				finish(StepResult{ID: s.ID(), Err: err, Skipped: true})
+				continue
+			}
+			if !ready {
+				continue
+			}
+
+			started[i] = true
+			running++
+			go func(s Step) {
+				err := stepFuncs[s.Kind](ctx, c, s)
+				finished <- StepResult{ID: s.ID(), Err: p.step(fmt.Sprintf("%s: %s", s.Kind, s.Name), err)}
+			}(s)
+		}
+
+		if running == 0 {
+			// Skipping steps may have finished the plan without starting
+			// anything else
+			continue
+		}
+		finish(<-finished)
+		running--
+	}
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// LoadPlan reads the steps for a plan from a directory. Each resource is a JSON
+// file in a subdirectory named after its kind, and the name of the resource is
+// the name of the file without the extension. For example, a role named
+// extra-admin is read from role/extra-admin.json. Steps are ordered by kind so
+// that, for example, spaces are added before the dashboards that go in them.
+func LoadPlan(dir string) (Plan, error) {
+	var plan Plan
+	var earlier []string
+	for _, kind := range stepKinds {
+		files, err := filepath.Glob(filepath.Join(dir, kind, "*.json"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s resources in '%s': %s", kind, dir, err)
+		}
+		sort.Strings(files)
+
+		var ids []string
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read resource '%s': %s", file, err)
+			}
+			if !json.Valid(data) {
+				return nil, fmt.Errorf("resource '%s' is not valid JSON", file)
+			}
+
+			s := Step{
+				Kind:      kind,
+				Name:      strings.TrimSuffix(filepath.Base(file), ".json"),
+				Data:      staticData(data),
+				DependsOn: earlier,
+			}
+			plan = append(plan, s)
+			ids = append(ids, s.ID())
+		}
+		earlier = append(append([]string{}, earlier...), ids...)
+	}
+
+	// Catch typos in the kind directories, which would otherwise be ignored
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read resources directory '%s': %s", dir, err)
+	}
+	for _, e := range entries {
+		if _, ok := stepFuncs[e.Name()]; e.IsDir() && !ok {
+			return nil, fmt.Errorf("unknown resource kind directory '%s' in '%s' - must be one of %s", e.Name(), dir, strings.Join(stepKinds, ", "))
+		}
+	}
+
+	return plan, nil
+}
+
+// staticData returns a step data function that always returns the same body.
+func staticData(data []byte) func() io.Reader {
+	return func() io.Reader {
+		return bytes.NewReader(data)
+	}
+}
+
+// readerData reads a body so that it can be returned by a step data function
+// more than once.
+func readerData(r io.Reader) (func() io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return staticData(data), nil
+}
+
+// jsonReader encodes a value as JSON for a step data function that builds its
+// body when it is called. Values that can't be encoded result in an empty
+// body, which will fail to apply.
+func jsonReader(v interface{}) io.Reader {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return &bytes.Buffer{}
+	}
+	return bytes.NewReader(data)
+}
+
+// jsonData encodes a value as the body returned by a step data function.
+func jsonData(v interface{}) (func() io.Reader, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode step data: %s", err)
+	}
+	return staticData(data), nil
+}
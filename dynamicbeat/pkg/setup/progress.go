@@ -0,0 +1,129 @@
+package setup
+
+import (
+	"context"
+	"sync"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+)
+
+// A ProgressFunc is called after each step of setup is processed. The step
+// describes the object that was processed, and err is the error that occurred
+// while processing it, if any. Steps are counted starting from 1.
+type ProgressFunc func(step string, current int, total int, err error)
+
+// progress reports the steps of setup to a ProgressFunc. It is safe for
+// concurrent use.
+type progress struct {
+	mu      sync.Mutex
+	f       ProgressFunc
+	current int
+	total   int
+}
+
+// step reports that a step was processed, and returns the error passed to it
+// so that it can wrap the call that performs the step.
+func (p *progress) step(name string, err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current++
+	if p.f != nil {
+		p.f(name, p.current, p.total, err)
+	}
+	return err
+}
+
+// DefaultPlan builds the steps that add the default Scorestack resources to
+// Kibana and Elasticsearch for the given teams.
+func (c *Client) DefaultPlan(teams []config.Team) (Plan, error) {
+	plan, err := c.kibanaPlan(teams)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(plan, c.elasticsearchPlan(teams)...), nil
+}
+
+// Setup adds everything needed for Scorestack to Kibana and Elasticsearch,
+// reporting each step to the client's ProgressFunc if it is set. The default
+// resources are added first, followed by any resources in ResourcesDir.
+func (c *Client) Setup(ctx context.Context, teams []config.Team) error {
+	return c.setup(ctx, teams, func(string) bool { return true })
+}
+
+// SetupKibana works like Setup, but only sets up Kibana.
+func (c *Client) SetupKibana(ctx context.Context, teams []config.Team) error {
+	return c.setup(ctx, teams, func(kind string) bool { return kibanaKinds[kind] })
+}
+
+// SetupElasticsearch works like Setup, but only sets up Elasticsearch.
+func (c *Client) SetupElasticsearch(ctx context.Context, teams []config.Team) error {
+	return c.setup(ctx, teams, func(kind string) bool { return !kibanaKinds[kind] })
+}
+
+// setup adds the resources of the kinds accepted by keep, along with the
+// Elasticsearch configuration if any Elasticsearch resources are kept.
+func (c *Client) setup(ctx context.Context, teams []config.Team, keep func(kind string) bool) error {
+	// Broken resources would otherwise fail partway through setup, after
+	// other resources were already added
+	err := c.validateSetupResources()
+	if err != nil {
+		return err
+	}
+
+	kibana := keep("role")
+	elasticsearch := keep("index")
+	switch {
+	case kibana && elasticsearch:
+		err = c.CheckCompatibility(ctx)
+	case kibana:
+		err = c.checkKibana(ctx)
+	default:
+		err = c.checkElasticsearch(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	defaults, err := c.DefaultPlan(teams)
+	if err != nil {
+		return err
+	}
+	defaults = defaults.only(keep)
+	var extra Plan
+	if c.ResourcesDir != "" {
+		extra, err = LoadPlan(c.ResourcesDir)
+		if err != nil {
+			return err
+		}
+		extra = extra.only(keep)
+	}
+
+	total := len(defaults) + len(extra)
+	if elasticsearch {
+		total += elasticsearchSteps(c.ResultsRetention) + c.Snapshots.snapshotSteps()
+	}
+	p := &progress{f: c.Progress, total: total}
+
+	// Index templates have to exist before the indices that they apply to
+	if elasticsearch {
+		err = configureElasticsearch(ctx, c.Elasticsearch, p, c.Namespace, c.ResultsRetention)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = c.apply(ctx, defaults, p)
+	if err != nil {
+		return err
+	}
+	_, err = c.apply(ctx, extra, p)
+	if err != nil {
+		return err
+	}
+
+	if elasticsearch {
+		return c.addSnapshots(ctx, p)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package setup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+)
+
+// A role is the body of a Kibana role API request.
+type role struct {
+	Elasticsearch struct {
+		Indices []indexPrivileges `json:"indices"`
+	} `json:"elasticsearch"`
+	Kibana []kibanaPrivileges `json:"kibana,omitempty"`
+}
+
+// indexPrivileges grants privileges for a set of indices. If the query is
+// set, only documents matching the query can be accessed.
+type indexPrivileges struct {
+	Names      []string `json:"names"`
+	Privileges []string `json:"privileges"`
+	Query      string   `json:"query,omitempty"`
+}
+
+// kibanaPrivileges grants privileges in a set of Kibana spaces.
+type kibanaPrivileges struct {
+	Base   []string `json:"base"`
+	Spaces []string `json:"spaces"`
+}
+
+// GenerateTeamRole builds a role for a team in a namespace. The role can only
+// read the team's own documents in the results indices, and can read the
+// namespace's space in Kibana.
+func GenerateTeamRole(ns config.Namespace, team string) (io.Reader, error) {
+	// Kibana expects the query as a string containing JSON
+	query, err := json.Marshal(map[string]interface{}{
+		"term": map[string]interface{}{
+			"group.keyword": team,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode results query for team '%s': %s", team, err)
+	}
+
+	var r role
+	r.Elasticsearch.Indices = []indexPrivileges{
+		{
+			Names:      []string{ns.Index("results-*")},
+			Privileges: []string{"read"},
+			Query:      string(query),
+		},
+		{
+			Names:      []string{ns.Index(fmt.Sprintf("attrib_user_%s", team))},
+			Privileges: []string{"read", "index", "view_index_metadata"},
+		},
+	}
+	r.Kibana = []kibanaPrivileges{
+		{
+			Base:   []string{"read"},
+			Spaces: []string{ns.Space()},
+		},
+	}
+
+	return encodeRole(r)
+}
+
+// GenerateAdminRole builds a role for Scorestack administrators. The role has
+// full access to all of the namespace's indices and its space in Kibana.
+func GenerateAdminRole(ns config.Namespace) (io.Reader, error) {
+	var r role
+	r.Elasticsearch.Indices = []indexPrivileges{
+		{
+			Names:      []string{ns.Index("results-*"), ns.Index("checkdef"), ns.Index("checks"), ns.Index("attrib_*")},
+			Privileges: []string{"all"},
+		},
+	}
+	r.Kibana = []kibanaPrivileges{
+		{
+			Base:   []string{"all"},
+			Spaces: []string{ns.Space()},
+		},
+	}
+
+	return encodeRole(r)
+}
+
+// GenerateDynamicbeatRole builds the role for the account that Dynamicbeat
+// runs as in a namespace. The role can only read check definitions and
+// attributes, and can only add new documents to the results indices.
+func GenerateDynamicbeatRole(ns config.Namespace) (io.Reader, error) {
+	var r role
+	r.Elasticsearch.Indices = []indexPrivileges{
+		{
+			Names:      []string{ns.Index("checkdef"), ns.Index("attrib_*")},
+			Privileges: []string{"read"},
+		},
+		{
+			Names:      []string{ns.Index("results-*")},
+			Privileges: []string{"create_doc"},
+		},
+		{
+			// The newest results are read at startup to restore SLA failures
+			Names:      []string{ns.Index("results-admin")},
+			Privileges: []string{"read"},
+		},
+	}
+
+	return encodeRole(r)
+}
+
+func encodeRole(r role) (io.Reader, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode role: %s", err)
+	}
+
+	return bytes.NewReader(body), nil
+}
@@ -0,0 +1,96 @@
+package setup
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// golden compares generated JSON to a golden file in testdata, after
+// indenting it so that changes to the golden files are easy to review. The
+// golden file is rewritten instead if the -update flag is set.
+func golden(t *testing.T, name string, r io.Reader) {
+	t.Helper()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	err = json.Indent(&got, data, "", "  ")
+	if err != nil {
+		t.Fatalf("generated invalid JSON: %s\n%s", err, data)
+	}
+	got.WriteByte('\n')
+
+	path := filepath.Join("testdata", name)
+	if *update {
+		err = ioutil.WriteFile(path, got.Bytes(), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file, run the tests with -update to create it: %s", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("generated JSON doesn't match %s, run the tests with -update if the change is intended\ngot:\n%s\nwant:\n%s", path, got.Bytes(), want)
+	}
+}
+
+func TestGenerateRoles(t *testing.T) {
+	tests := []struct {
+		golden   string
+		generate func() (io.Reader, error)
+	}{
+		{"roles/team.json", func() (io.Reader, error) { return GenerateTeamRole("", "team01") }},
+		{"roles/team-namespaced.json", func() (io.Reader, error) { return GenerateTeamRole(config.Namespace("practice"), "team01") }},
+		{"roles/admin.json", func() (io.Reader, error) { return GenerateAdminRole("") }},
+		{"roles/admin-namespaced.json", func() (io.Reader, error) { return GenerateAdminRole(config.Namespace("practice")) }},
+		{"roles/dynamicbeat.json", func() (io.Reader, error) { return GenerateDynamicbeatRole("") }},
+		{"roles/dynamicbeat-namespaced.json", func() (io.Reader, error) { return GenerateDynamicbeatRole(config.Namespace("practice")) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			r, err := tt.generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden(t, tt.golden, r)
+		})
+	}
+}
+
+func TestGenerateTeamRoleEscapesName(t *testing.T) {
+	// The team is embedded in a query that is itself a JSON string, so it must
+	// survive being encoded twice
+	team := `team"01\`
+	r, err := GenerateTeamRole("", team)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var role role
+	err = json.NewDecoder(r).Decode(&role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query struct {
+		Term map[string]string `json:"term"`
+	}
+	err = json.Unmarshal([]byte(role.Elasticsearch.Indices[0].Query), &query)
+	if err != nil {
+		t.Fatalf("query isn't valid JSON: %s", err)
+	}
+	if got := query.Term["group.keyword"]; got != team {
+		t.Errorf("got team %q in query, want %q", got, team)
+	}
+}
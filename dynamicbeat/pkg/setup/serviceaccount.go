@@ -0,0 +1,59 @@
+package setup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets/users"
+	"go.uber.org/zap"
+)
+
+// serviceAccount is the name of the user and role that Dynamicbeat runs as in
+// the default namespace.
+const serviceAccount = "dynamicbeat"
+
+// ServiceAccount returns the name of the user that Dynamicbeat runs as.
+func (c *Client) ServiceAccount() string {
+	return c.Namespace.Name(serviceAccount)
+}
+
+// AddServiceAccount creates the least-privilege role and user that Dynamicbeat
+// runs as, so that it doesn't need the credentials that were used for setup.
+// The user is given a random password, which is returned. If the user already
+// exists, its password is only changed if rotate is set; otherwise the user is
+// left untouched and an empty password is returned.
+func (c *Client) AddServiceAccount(ctx context.Context, rotate bool) (string, error) {
+	name := c.ServiceAccount()
+	role, err := GenerateDynamicbeatRole(c.Namespace)
+	if err != nil {
+		return "", err
+	}
+	err = c.Kibana.AddRole(ctx, name, role)
+	if err != nil {
+		return "", fmt.Errorf("failed to add role: %w", err)
+	}
+
+	existing, err := c.Elasticsearch.GetUser(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil && !rotate {
+		zap.S().Infof("user %s already exists, leaving its password unchanged", name)
+		return "", nil
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return "", err
+	}
+	user, err := withPassword(name, namespaceUser(c.Namespace, users.Dynamicbeat)(), password)
+	if err != nil {
+		return "", err
+	}
+	err = c.Elasticsearch.UpsertUser(ctx, name, user)
+	if err != nil {
+		return "", fmt.Errorf("failed to add user: %w", err)
+	}
+
+	return password, nil
+}
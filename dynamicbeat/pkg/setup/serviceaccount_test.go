@@ -0,0 +1,73 @@
+package setup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+)
+
+func TestAddServiceAccount(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace config.Namespace
+		user      string
+		role      string
+	}{
+		{"default namespace", "", "dynamicbeat", "roles/dynamicbeat.json"},
+		{"namespaced", "practice", "practice-dynamicbeat", "roles/dynamicbeat-namespaced.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCluster()
+			c := f.client(t)
+			c.Namespace = tt.namespace
+			ctx := context.Background()
+
+			password, err := c.AddServiceAccount(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(password) < 16 {
+				t.Errorf("got password %q, want a long random password", password)
+			}
+			if got := f.passwds[tt.user]; got != password {
+				t.Errorf("user %s has password %q, want the returned password %q", tt.user, got, password)
+			}
+			golden(t, tt.role, bytes.NewReader(f.roles[tt.user]))
+
+			user := struct {
+				Roles []string `json:"roles"`
+			}{}
+			err = json.Unmarshal(f.users[tt.user], &user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(user.Roles) != 1 || user.Roles[0] != tt.user {
+				t.Errorf("user %s has roles %q, want only its own role", tt.user, user.Roles)
+			}
+
+			// The password is left alone unless it is rotated
+			again, err := c.AddServiceAccount(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != "" || f.passwds[tt.user] != password {
+				t.Errorf("adding the account again returned password %q and changed it to %q", again, f.passwds[tt.user])
+			}
+
+			rotated, err := c.AddServiceAccount(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated == "" || rotated == password {
+				t.Errorf("rotating the password returned %q, want a new password", rotated)
+			}
+			if f.passwds[tt.user] != rotated {
+				t.Errorf("user %s has password %q after rotating, want %q", tt.user, f.passwds[tt.user], rotated)
+			}
+		})
+	}
+}
@@ -1,22 +1,266 @@
 package setup
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
 	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/kibclient"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/version"
+	"go.uber.org/zap"
 )
 
-func Run() error {
+func Run(ctx context.Context) error {
 	c := config.Get()
 
-	err := Kibana(c.Setup.Kibana, c.Setup.Username, c.Setup.Password, c.VerifyCerts, c.Teams)
+	// Tag every log line with the run ID so that logs can be matched up with
+	// the request IDs in the Elasticsearch and Kibana logs
+	logger := zap.L()
+	zap.ReplaceGlobals(logger.With(zap.String("run_id", runID)))
+	defer zap.ReplaceGlobals(logger)
+	zap.S().Infof("starting setup run %s as %s", runID, userAgent())
+
+	// Check the resources before anything is sent to the cluster, including
+	// the API key request
+	err := (&Client{ResourcesDir: c.Setup.Resources}).validateSetupResources()
+	if err != nil {
+		return err
+	}
+
+	// Switch to API key authentication for the rest of setup if requested
+	if c.Setup.CreateAPIKey && c.Setup.DryRun {
+		zap.S().Info("dry run: not creating an API key for setup")
+	} else if c.Setup.CreateAPIKey && c.Setup.APIKey == "" {
+		key, err := createAPIKey(ctx, c)
+		if err != nil {
+			return err
+		}
+		c.Setup.APIKey = key
+	}
+
+	client, err := NewClient(c)
 	if err != nil {
 		return err
 	}
+	client.Progress = func(step string, current int, total int, err error) {
+		if err == nil {
+			zap.S().Infof("[%d/%d] finished %s", current, total, step)
+		}
+	}
 
-	es, err := esclient.New(c.Elasticsearch, c.Setup.Username, c.Setup.Password, c.VerifyCerts)
+	err = client.Setup(ctx, c.Teams)
 	if err != nil {
 		return err
 	}
 
-	return Elasticsearch(es, c.Teams)
+	if c.Setup.DryRun {
+		return PrintPlan(os.Stdout, client.Kibana.Plan, client.Elasticsearch.Plan)
+	}
+	return nil
+}
+
+// PrintPlan writes a table of the requests that were skipped in dry-run mode.
+func PrintPlan(w io.Writer, plans ...*util.Plan) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tMETHOD\tPATH\tBODY")
+	for _, plan := range plans {
+		for _, a := range plan.Actions() {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.Service, a.Method, a.Path, a.Summary)
+		}
+	}
+	return tw.Flush()
+}
+
+// KibanaClient creates a Kibana client that is configured using the setup
+// settings from the Dynamicbeat config.
+func KibanaClient(c config.Config) (*kibclient.Client, error) {
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := util.NewProxyFunc(c.Setup.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure proxy for setup: %s", err)
+	}
+
+	kib := kibclient.NewWithTransport(c.Setup.Kibana, c.Setup.Username, c.Setup.Password, debugTransport(c, tagTransport(compressTransport(c, &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           proxy,
+	}))))
+	kib.APIKey = c.Setup.APIKey
+	if kib.APIKey != "" {
+		zap.S().Warn("an API key is configured, so the setup username and password will not be used for Kibana")
+	}
+	kib.MaxAttempts = c.Setup.MaxAttempts
+	kib.MaxRetries = c.Setup.MaxRetries
+	kib.PollInterval = c.Setup.PollInterval
+	kib.LogEvery = c.Setup.LogEvery
+	kib.DryRun = c.Setup.DryRun
+	kib.ForceDashboards = c.Setup.ForceDashboards
+	if !c.Namespace.IsDefault() {
+		// The default space is shared with the default namespace
+		kib.DashboardSpaces = []string{c.Namespace.Space()}
+	}
+	kib.Plan = &util.Plan{}
+
+	return kib, nil
+}
+
+// ElasticsearchClient creates an Elasticsearch client that is configured using
+// the setup settings from the Dynamicbeat config.
+func ElasticsearchClient(c config.Config) (*esclient.Client, error) {
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := util.NewProxyFunc(c.Setup.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure proxy for setup: %s", err)
+	}
+	transport := esclient.NewTransport(tlsConfig)
+	transport.Proxy = proxy
+
+	// The Elasticsearch client fails over to other hosts by retrying requests,
+	// so allow enough retries to try every host at least once
+	retries := c.Setup.MaxRetries
+	if retries < len(c.Elasticsearch)-1 {
+		retries = len(c.Elasticsearch) - 1
+	}
+
+	clientConfig := elasticsearch.Config{
+		Addresses: c.Elasticsearch,
+		Username:  c.Setup.Username,
+		Password:  c.Setup.Password,
+		Transport: debugTransport(c, tagTransport(compressTransport(c, transport))),
+
+		// Retry requests that fail while the cluster is still starting up
+		RetryOnStatus: []int{429, 502, 503},
+		MaxRetries:    retries,
+		DisableRetry:  retries == 0,
+		RetryBackoff: func(attempt int) time.Duration {
+			// The Elasticsearch client counts attempts starting at 1
+			delay := util.Backoff(attempt - 1)
+			zap.S().Debugf("retrying Elasticsearch request (attempt %d of %d) in %s", attempt, retries, delay)
+			return delay
+		},
+	}
+	if c.Setup.APIKey != "" {
+		zap.S().Warn("an API key is configured, so the setup username and password will not be used for Elasticsearch")
+		clientConfig.APIKey = c.Setup.APIKey
+		clientConfig.Username = ""
+		clientConfig.Password = ""
+	}
+
+	plan := &util.Plan{}
+	if c.Setup.DryRun {
+		clientConfig.Transport = &esclient.DryRunTransport{Next: clientConfig.Transport, Plan: plan}
+	}
+
+	es, err := esclient.NewFromConfig(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	es.Plan = plan
+	es.MaxAttempts = c.Setup.MaxAttempts
+	es.PollInterval = c.Setup.PollInterval
+	es.LogEvery = c.Setup.LogEvery
+	es.MinimumClusterStatus = c.Setup.MinimumClusterStatus
+	es.UpdateMappings = c.Setup.UpdateMappings
+	es.RotatePasswords = c.Setup.RotatePasswords
+
+	return es, nil
+}
+
+// createAPIKey creates an API key for setup using the configured setup username
+// and password.
+func createAPIKey(ctx context.Context, c config.Config) (string, error) {
+	es, err := ElasticsearchClient(c)
+	if err != nil {
+		return "", err
+	}
+
+	err = es.Wait(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return es.CreateAPIKey(ctx, c.Namespace.Name("scorestack-setup"))
+}
+
+// runID identifies the requests made by this run of setup. Every setup client
+// in the process shares it, along with requestCount.
+var runID = newRunID()
+
+// requestCount is the number of setup requests that have been sent.
+var requestCount uint64
+
+func newRunID() string {
+	id, err := util.NewUUID()
+	if err != nil {
+		// A less unique ID is still enough to be useful in the server logs
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return id
+}
+
+// userAgent returns the User-Agent that setup requests are sent with.
+func userAgent() string {
+	return "scorestack-setup/" + version.Version
+}
+
+// tagTransport wraps a transport so that every request is sent with the setup
+// User-Agent and a request ID made from the run ID.
+func tagTransport(tr http.RoundTripper) http.RoundTripper {
+	return &util.RequestIDTransport{Next: tr, UserAgent: userAgent(), RunID: runID, Counter: &requestCount}
+}
+
+// maxLoggedBody is the number of bytes of each request and response body that
+// are logged when setup.debug_requests is enabled.
+const maxLoggedBody = 4096
+
+// debugTransport wraps a transport so that it logs every request if
+// setup.debug_requests is enabled.
+func debugTransport(c config.Config, tr http.RoundTripper) http.RoundTripper {
+	if !c.Setup.DebugRequests {
+		return tr
+	}
+
+	return &util.LoggingTransport{Next: tr, MaxBody: maxLoggedBody}
+}
+
+// minCompressedBody is the smallest request body that is compressed when
+// setup.compress is enabled. Smaller bodies aren't worth the overhead.
+const minCompressedBody = 1024
+
+// compressTransport wraps a transport so that it compresses requests and
+// responses if setup.compress is enabled. Otherwise, compression is disabled
+// entirely, since some proxies mangle compressed bodies.
+func compressTransport(c config.Config, tr *http.Transport) http.RoundTripper {
+	if !c.Setup.Compress {
+		tr.DisableCompression = true
+		return tr
+	}
+
+	return &util.GzipTransport{Next: tr, MinSize: minCompressedBody}
+}
+
+func newTLSConfig(c config.Config) (*tls.Config, error) {
+	tlsConfig, err := util.NewTLSConfig(c.VerifyCerts, c.Setup.TLS.CA, c.Setup.TLS.Cert, c.Setup.TLS.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure TLS for setup: %s", err)
+	}
+
+	return tlsConfig, nil
 }
@@ -0,0 +1,305 @@
+package setup
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+)
+
+// testCert is a certificate and its private key, in PEM.
+type testCert struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    []byte
+	keyPEM []byte
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA
+// certificate if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert, usage ...x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  usage,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:   cert,
+		key:    key,
+		pem:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, dir string, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClientTLS(t *testing.T) {
+	ca := newTestCert(t, "Scorestack Test CA", nil)
+	server := newTestCert(t, "127.0.0.1", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "scorestack-setup", ca, x509.ExtKeyUsageClientAuth)
+	dir := t.TempDir()
+	caFile := writeFile(t, dir, "ca.crt", ca.pem)
+	certFile := writeFile(t, dir, "client.crt", client.pem)
+	keyFile := writeFile(t, dir, "client.key", client.keyPEM)
+
+	tests := []struct {
+		name       string
+		clientAuth bool // whether the server requires a client certificate
+		verify     bool
+		ca         string
+		cert       string
+		key        string
+		err        string
+	}{
+		{name: "CA file", verify: true, ca: caFile},
+		{name: "system pool", verify: true, err: "certificate"},
+		{name: "skip verify", verify: false},
+		{name: "client certificate", clientAuth: true, verify: true, ca: caFile, cert: certFile, key: keyFile},
+		{name: "missing client certificate", clientAuth: true, verify: true, ca: caFile, err: "certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/_cluster/health":
+					fmt.Fprint(w, `{"status":"green"}`)
+				case "/api/status":
+					fmt.Fprint(w, `{"status":{"overall":{"level":"available"}}}`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			pair, err := tls.X509KeyPair(server.pem, server.keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+			if tt.clientAuth {
+				pool := x509.NewCertPool()
+				pool.AddCert(ca.cert)
+				srv.TLS.ClientCAs = pool
+				srv.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+			srv.StartTLS()
+			defer srv.Close()
+
+			c := config.Config{Elasticsearch: []string{srv.URL}, VerifyCerts: tt.verify}
+			c.Setup.Kibana = []string{srv.URL}
+			c.Setup.TLS.CA, c.Setup.TLS.Cert, c.Setup.TLS.Key = tt.ca, tt.cert, tt.key
+
+			// Both clients must be configured the same way
+			es, err := ElasticsearchClient(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, esErr := es.ClusterHealth(context.Background())
+			kib, err := KibanaClient(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, kibErr := kib.Status(context.Background())
+
+			for service, err := range map[string]error{"Elasticsearch": esErr, "Kibana": kibErr} {
+				if tt.err == "" && err != nil {
+					t.Errorf("%s request failed: %s", service, err)
+				}
+				if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+					t.Errorf("%s request got error %v, want it to contain %q", service, err, tt.err)
+				}
+			}
+		})
+	}
+}
+
+func TestClientTLSInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		ca   string
+		cert string
+		key  string
+		err  string
+	}{
+		{name: "missing CA", ca: filepath.Join(dir, "missing.crt"), err: "failed to read CA certificate file"},
+		{name: "invalid CA", ca: writeFile(t, dir, "invalid.crt", []byte("not a certificate")), err: "no valid PEM certificates"},
+		{name: "certificate without key", cert: writeFile(t, dir, "client.crt", []byte("x")), err: "both a client certificate and a client key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := config.Config{Elasticsearch: []string{"https://127.0.0.1:9200"}, VerifyCerts: true}
+			c.Setup.TLS.CA, c.Setup.TLS.Cert, c.Setup.TLS.Key = tt.ca, tt.cert, tt.key
+			_, err := ElasticsearchClient(c)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.err)
+			}
+			_, err = KibanaClient(c)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestElasticsearchClientFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + l.Addr().String()
+	l.Close()
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"green"}`)
+	}))
+	defer live.Close()
+
+	// The Elasticsearch client retries on the next host, so setup allows
+	// enough retries to reach every host even when retries are disabled
+	c := config.Config{Elasticsearch: []string{refused, live.URL}}
+	es, err := ElasticsearchClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		status, err := es.ClusterHealth(context.Background())
+		if err != nil {
+			t.Fatalf("request %d failed: %s", i+1, err)
+		}
+		if status != "green" {
+			t.Errorf("got status %s, want green", status)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/":
+			fmt.Fprint(w, `{"version":{"number":"7.9.2"}}`)
+		case r.Method == "HEAD":
+			// Nothing exists yet, so everything would be created
+			w.WriteHeader(404)
+		default:
+			fmt.Fprint(w, "{}")
+		}
+	}))
+	defer srv.Close()
+
+	c := config.Config{Elasticsearch: []string{srv.URL}}
+	c.Setup.Kibana = []string{srv.URL}
+	c.Setup.DryRun = true
+	es, err := ElasticsearchClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kib, err := KibanaClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	body := func() io.Reader { return strings.NewReader(`{"mappings":{"properties":{"name":{"type":"keyword"}}}}`) }
+	template := func() io.Reader { return strings.NewReader(`{"index_patterns":["results-*"]}`) }
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"add index", func() error { return es.AddIndex(ctx, "checkdef", body) }},
+		{"add index template", func() error { return es.AddIndexTemplate(ctx, "results", template) }},
+		{"add space", func() error { return kib.AddSpace(ctx, "scorestack", template) }},
+		{"add role", func() error { return kib.AddRole(ctx, "spectator", strings.NewReader(`{"kibana":[]}`)) }},
+		{"remove space", func() error { return kib.RemoveSpace(ctx, "scorestack") }},
+	}
+	for _, step := range steps {
+		err := step.run()
+		if err != nil {
+			t.Fatalf("%s failed: %s", step.name, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, r := range received {
+		if util.IsMutating(strings.Fields(r)[0]) {
+			t.Errorf("server received mutating request %s", r)
+		}
+	}
+
+	var planned []string
+	for _, plan := range []*util.Plan{es.Plan, kib.Plan} {
+		for _, a := range plan.Actions() {
+			planned = append(planned, fmt.Sprintf("%s %s %s", a.Service, a.Method, a.Path))
+		}
+	}
+	want := []string{
+		"Elasticsearch PUT /checkdef",
+		"Elasticsearch PUT /_index_template/results",
+		"Kibana PUT /api/spaces/space/scorestack",
+		"Kibana PUT /api/security/role/spectator",
+		"Kibana DELETE /api/spaces/space/scorestack",
+	}
+	if strings.Join(planned, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got planned actions %q, want %q", planned, want)
+	}
+}
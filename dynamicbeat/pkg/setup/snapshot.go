@@ -0,0 +1,119 @@
+package setup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/util"
+	"go.uber.org/zap"
+)
+
+// The names of the snapshot repository and SLM policy that setup adds.
+const (
+	snapshotRepository = "scorestack"
+	snapshotPolicy     = "scorestack-nightly"
+)
+
+// snapshotIndices are the index patterns that are included in snapshots.
+var snapshotIndices = []string{"checkdef", "checks", "attrib_*", "results-*"}
+
+// SnapshotOptions controls the snapshot repository and policy that setup adds.
+type SnapshotOptions struct {
+	Type      string // the repository type, either fs or s3; snapshots aren't set up if this is empty
+	Location  string // the path of an fs repository, which must be listed in path.repo on every node
+	Bucket    string // the bucket of an s3 repository
+	BasePath  string // the path within the bucket of an s3 repository
+	Schedule  string // the cron schedule to take snapshots on
+	Retention string // how long to keep snapshots, like 7d
+}
+
+// snapshotSteps returns the number of steps that are reported to the progress
+// function while setting up snapshots.
+func (o SnapshotOptions) snapshotSteps() int {
+	if o.Type == "" {
+		return 0
+	}
+	return 2
+}
+
+// repository builds the definition of the snapshot repository.
+func (o SnapshotOptions) repository() ([]byte, error) {
+	settings := make(map[string]interface{})
+	switch o.Type {
+	case "fs":
+		if o.Location == "" {
+			return nil, fmt.Errorf("a location is required for fs snapshot repositories")
+		}
+		settings["location"] = o.Location
+	case "s3":
+		if o.Bucket == "" {
+			return nil, fmt.Errorf("a bucket is required for s3 snapshot repositories")
+		}
+		settings["bucket"] = o.Bucket
+		if o.BasePath != "" {
+			settings["base_path"] = o.BasePath
+		}
+	default:
+		return nil, fmt.Errorf("invalid snapshot repository type '%s' - must be fs or s3", o.Type)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"type":     o.Type,
+		"settings": settings,
+	})
+}
+
+// addSnapshots adds the snapshot repository and the SLM policy that takes
+// nightly snapshots of the Scorestack indices. If SLM isn't available on the
+// cluster, a warning is logged and the policy is skipped.
+func (c *Client) addSnapshots(ctx context.Context, p *progress) error {
+	o := c.Snapshots
+	if o.Type == "" {
+		return nil
+	}
+
+	repository := c.Namespace.Name(snapshotRepository)
+	policyName := c.Namespace.Name(snapshotPolicy)
+	repo, err := o.repository()
+	if err != nil {
+		err = fmt.Errorf("invalid snapshot settings: %s", err)
+	} else {
+		err = c.Elasticsearch.AddSnapshotRepository(ctx, repository, bytes.NewReader(repo))
+	}
+	err = p.step(fmt.Sprintf("snapshot repository: %s", repository), err)
+	if err != nil {
+		return err
+	}
+
+	policy, err := json.Marshal(map[string]interface{}{
+		"schedule":   o.Schedule,
+		"name":       fmt.Sprintf("<%s-{now/d}>", c.Namespace.Space()),
+		"repository": repository,
+		"config": map[string]interface{}{
+			"indices":              namespaceIndices(c.Namespace, snapshotIndices...),
+			"ignore_unavailable":   true,
+			"include_global_state": false,
+		},
+		"retention": map[string]interface{}{
+			"expire_after": o.Retention,
+		},
+	})
+	if err != nil {
+		return p.step(fmt.Sprintf("SLM policy: %s", policyName), fmt.Errorf("failed to encode SLM policy: %s", err))
+	}
+
+	// Clusters without SLM don't have a handler for the SLM API, while a 400 with
+	// any other message means that the policy itself is invalid
+	err = c.Elasticsearch.AddSLMPolicy(ctx, policyName, bytes.NewReader(policy))
+	var resErr *util.ResponseError
+	if errors.As(err, &resErr) && (resErr.StatusCode == 404 || (resErr.StatusCode == 400 && strings.Contains(resErr.Body, "no handler found"))) {
+		zap.S().Warnf("SLM appears to be unavailable on this cluster, so snapshots will not be taken automatically: %s", err)
+		p.step(fmt.Sprintf("SLM policy: %s", policyName), nil)
+		return nil
+	}
+	return p.step(fmt.Sprintf("SLM policy: %s", policyName), err)
+}
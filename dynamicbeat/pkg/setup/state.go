@@ -0,0 +1,332 @@
+package setup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"go.uber.org/zap"
+)
+
+// stateVersion is the version of the state archive format written by
+// ExportState.
+const stateVersion = 1
+
+// The kinds of entries in a state archive.
+const (
+	stateHeader      = "header"
+	stateSpace       = "space"
+	stateRole        = "role"
+	stateUser        = "user"
+	stateDocument    = "document"
+	stateSavedObject = "saved_object"
+)
+
+// A StateEntry is a single object in a state archive. Archives are written as
+// NDJSON, with one entry per line.
+type StateEntry struct {
+	Kind  string          `json:"kind"`            // the kind of object
+	ID    string          `json:"id,omitempty"`    // the name or ID of the object
+	Index string          `json:"index,omitempty"` // the index that a document is in
+	Space string          `json:"space,omitempty"` // the Kibana space that a saved object is in
+	Body  json.RawMessage `json:"body"`            // the definition of the object
+}
+
+// stateIndices are the index patterns of the indices that hold Scorestack
+// documents which can't be recreated by setup.
+var stateIndices = []string{"checkdef", "checks", "attrib_*"}
+
+// ExportState writes an archive of the checks, attributes, roles, users,
+// spaces, and Kibana saved objects that Scorestack manages. The archive can be
+// restored with ImportState. User passwords are not included in the archive.
+func (c *Client) ExportState(ctx context.Context, w io.Writer, teams []config.Team) error {
+	enc := json.NewEncoder(w)
+	write := func(e StateEntry) error {
+		err := enc.Encode(e)
+		if err != nil {
+			return fmt.Errorf("failed to write %s '%s' to state archive: %s", e.Kind, e.ID, err)
+		}
+		return nil
+	}
+
+	header, err := json.Marshal(map[string]interface{}{
+		"version":     stateVersion,
+		"exported_at": time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode state archive header: %s", err)
+	}
+	err = write(StateEntry{Kind: stateHeader, Body: header})
+	if err != nil {
+		return err
+	}
+
+	// Spaces, including the default space for the default namespace
+	ns := c.Namespace
+	spaceNames := []string{ns.Space()}
+	for _, team := range teams {
+		spaceNames = append(spaceNames, ns.Name(team.Name))
+	}
+	var exportedSpaces []string
+	if ns.IsDefault() {
+		exportedSpaces = append(exportedSpaces, "")
+	}
+	for _, name := range spaceNames {
+		space, err := c.Kibana.GetSpace(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to export space '%s': %w", name, err)
+		}
+		if space == nil {
+			continue
+		}
+		exportedSpaces = append(exportedSpaces, name)
+		err = write(StateEntry{Kind: stateSpace, ID: name, Body: space})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Roles and users
+	roleNames := namespaceNames(ns, baseRoles...)
+	userNames := namespaceNames(ns, serviceAccount)
+	for _, team := range teams {
+		roleNames = append(roleNames, ns.Name(team.Name))
+		userNames = append(userNames, ns.Name(team.Name))
+	}
+	for _, name := range roleNames {
+		role, err := c.Kibana.GetRole(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to export role '%s': %w", name, err)
+		}
+		if role == nil {
+			continue
+		}
+		role, err = withoutFields(role, "name", "transient_metadata")
+		if err != nil {
+			return fmt.Errorf("failed to export role '%s': %s", name, err)
+		}
+		err = write(StateEntry{Kind: stateRole, ID: name, Body: role})
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range userNames {
+		user, err := c.Elasticsearch.GetUser(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to export user '%s': %w", name, err)
+		}
+		if user == nil {
+			continue
+		}
+		user, err = withoutFields(user, "username")
+		if err != nil {
+			return fmt.Errorf("failed to export user '%s': %s", name, err)
+		}
+		err = write(StateEntry{Kind: stateUser, ID: name, Body: user})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Documents
+	indices, err := c.Elasticsearch.ListIndices(ctx, namespaceIndices(ns, stateIndices...)...)
+	if err != nil {
+		return fmt.Errorf("failed to export documents: %w", err)
+	}
+	for _, index := range indices {
+		docs, err := c.Elasticsearch.GetAllDocuments(ctx, index)
+		if err != nil {
+			return fmt.Errorf("failed to export documents: %w", err)
+		}
+		for _, doc := range docs {
+			err = write(StateEntry{Kind: stateDocument, ID: doc.ID, Index: doc.Index, Body: doc.Source})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Saved objects that were added by setup
+	for _, space := range exportedSpaces {
+		objects, err := c.Kibana.ExportSavedObjects(ctx, space, "dashboard", "visualization", "index-pattern")
+		if err != nil {
+			return fmt.Errorf("failed to export saved objects: %w", err)
+		}
+		for _, line := range bytes.Split(objects, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			obj := struct {
+				ID string `json:"id"`
+			}{}
+			err = json.Unmarshal(line, &obj)
+			if err != nil {
+				return fmt.Errorf("failed to decode exported saved object: %s", err)
+			}
+			if !strings.HasPrefix(obj.ID, "scorestack-") {
+				continue
+			}
+			err = write(StateEntry{Kind: stateSavedObject, ID: obj.ID, Space: space, Body: line})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ImportState restores an archive that was written by ExportState, using the
+// same methods that setup uses to add each object. Users that don't already
+// exist are created with a random password, since passwords aren't included
+// in the archive.
+func (c *Client) ImportState(ctx context.Context, r io.Reader) error {
+	var spaces, roles, users, docs []StateEntry
+	objects := make(map[string][]byte)
+	var objectSpaces []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var e StateEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return fmt.Errorf("failed to decode line %d of state archive: %s", line, err)
+		}
+
+		switch e.Kind {
+		case stateHeader:
+			header := struct {
+				Version int `json:"version"`
+			}{}
+			err = json.Unmarshal(e.Body, &header)
+			if err != nil {
+				return fmt.Errorf("failed to decode state archive header: %s", err)
+			}
+			if header.Version != stateVersion {
+				return fmt.Errorf("unsupported state archive version %d", header.Version)
+			}
+		case stateSpace:
+			spaces = append(spaces, e)
+		case stateRole:
+			roles = append(roles, e)
+		case stateUser:
+			users = append(users, e)
+		case stateDocument:
+			docs = append(docs, e)
+		case stateSavedObject:
+			if _, exists := objects[e.Space]; !exists {
+				objectSpaces = append(objectSpaces, e.Space)
+			}
+			objects[e.Space] = append(append(objects[e.Space], e.Body...), '\n')
+		default:
+			zap.S().Warnf("skipping unknown %s entry on line %d of state archive", e.Kind, line)
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read state archive: %s", err)
+	}
+
+	// Restore objects in the same order that setup creates them
+	for _, e := range spaces {
+		body := e.Body
+		err = c.Kibana.AddSpace(ctx, e.ID, func() io.Reader {
+			return bytes.NewReader(body)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to import space '%s': %w", e.ID, err)
+		}
+	}
+	for _, e := range roles {
+		err = c.Kibana.AddRole(ctx, e.ID, bytes.NewReader(e.Body))
+		if err != nil {
+			return fmt.Errorf("failed to import role '%s': %w", e.ID, err)
+		}
+	}
+	for _, e := range users {
+		err = c.importUser(ctx, e)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range docs {
+		res, err := c.Elasticsearch.Index(e.Index, bytes.NewReader(e.Body), c.Elasticsearch.Index.WithDocumentID(e.ID), c.Elasticsearch.Index.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to import document '%s' into '%s': %s", e.ID, e.Index, err)
+		}
+		err = c.Elasticsearch.CloseAndCheck(res)
+		if err != nil {
+			return fmt.Errorf("failed to import document '%s' into '%s': %w", e.ID, e.Index, err)
+		}
+	}
+	for _, space := range objectSpaces {
+		err = c.Kibana.AddSavedObjects(ctx, space, bytes.NewReader(objects[space]))
+		if err != nil {
+			return fmt.Errorf("failed to import saved objects: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// importUser restores a user from a state archive. Existing users keep their
+// current password.
+func (c *Client) importUser(ctx context.Context, e StateEntry) error {
+	existing, err := c.Elasticsearch.GetUser(ctx, e.ID)
+	if err != nil {
+		return fmt.Errorf("failed to import user '%s': %w", e.ID, err)
+	}
+
+	user := make(map[string]interface{})
+	err = json.Unmarshal(e.Body, &user)
+	if err != nil {
+		return fmt.Errorf("failed to decode user '%s': %s", e.ID, err)
+	}
+	if existing == nil {
+		password, err := generatePassword()
+		if err != nil {
+			return err
+		}
+		user["password"] = password
+		zap.S().Warnf("user '%s' did not exist, so it was created with a random password that must be reset", e.ID)
+	}
+	body, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("failed to encode user '%s': %s", e.ID, err)
+	}
+
+	res, err := c.Elasticsearch.Security.PutUser(e.ID, bytes.NewReader(body), c.Elasticsearch.Security.PutUser.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to import user '%s': %s", e.ID, err)
+	}
+	err = c.Elasticsearch.CloseAndCheck(res)
+	if err != nil {
+		return fmt.Errorf("failed to import user '%s': %w", e.ID, err)
+	}
+	return nil
+}
+
+// withoutFields removes fields from a JSON object.
+func withoutFields(obj json.RawMessage, fields ...string) (json.RawMessage, error) {
+	m := make(map[string]json.RawMessage)
+	err := json.Unmarshal(obj, &m)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		delete(m, f)
+	}
+
+	return json.Marshal(m)
+}
@@ -0,0 +1,115 @@
+package setup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+)
+
+// populate fills a fake cluster with the objects that setup would create, and
+// enough documents that they can't be fetched with a single search.
+func populate(f *fakeCluster) {
+	f.spaces["scorestack"] = json.RawMessage(`{"id":"scorestack","name":"Scorestack"}`)
+	f.spaces["team01"] = json.RawMessage(`{"id":"team01","name":"team01"}`)
+	f.roles["common"] = json.RawMessage(`{"elasticsearch":{"cluster":[],"indices":[{"names":["results-all*"],"privileges":["read"]}]}}`)
+	f.roles["team01"] = json.RawMessage(`{"elasticsearch":{"indices":[{"names":["results-team01*"],"privileges":["read"]}]},"kibana":[{"spaces":["team01"],"base":["read"]}]}`)
+	f.users["dynamicbeat"] = json.RawMessage(`{"username":"dynamicbeat","roles":["dynamicbeat"],"enabled":true}`)
+	f.users["team01"] = json.RawMessage(`{"username":"team01","roles":["team01","common"],"enabled":true}`)
+
+	f.indices["checkdef"] = map[string]json.RawMessage{"web-team01": json.RawMessage(`{"type":"http","definition":{"Requests":[]}}`)}
+	f.indices["checks"] = map[string]json.RawMessage{"web-team01": json.RawMessage(`{"name":"Web","group":"team01"}`)}
+	admin := make(map[string]json.RawMessage)
+	for i := 0; i < 10050; i++ {
+		admin[fmt.Sprintf("check%05d-team01", i)] = json.RawMessage(fmt.Sprintf(`{"Host":"10.0.1.%d"}`, i%256))
+	}
+	f.indices["attrib_admin_team01"] = admin
+	f.indices["results-team01"] = map[string]json.RawMessage{"result": json.RawMessage(`{}`)}
+
+	f.objects[""] = map[string]json.RawMessage{
+		"scorestack-overview": json.RawMessage(`{"id":"scorestack-overview","type":"dashboard","attributes":{"title":"Overview"}}`),
+		"custom":              json.RawMessage(`{"id":"custom","type":"dashboard","attributes":{"title":"Not Scorestack's"}}`),
+	}
+	f.objects["scorestack"] = map[string]json.RawMessage{
+		"scorestack-results": json.RawMessage(`{"id":"scorestack-results","type":"index-pattern","attributes":{"title":"results-*"}}`),
+	}
+}
+
+// export exports the state of a cluster, without its header, which has the
+// time of the export.
+func export(t *testing.T, c *Client, teams []config.Team) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	err := c.ExportState(context.Background(), &buf, teams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !strings.Contains(lines[0], `"kind":"header"`) {
+		t.Fatalf("archive doesn't start with a header: %s", lines[0])
+	}
+	return lines[1:]
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	teams := []config.Team{{Name: "team01"}}
+	f := newFakeCluster()
+	populate(f)
+	c := f.client(t)
+
+	before := export(t, c, teams)
+	kinds := make(map[string]int)
+	for _, line := range before {
+		e := StateEntry{}
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds[e.Kind]++
+		if e.Kind == stateSavedObject && !strings.HasPrefix(e.ID, "scorestack-") {
+			t.Errorf("exported saved object %s that setup didn't add", e.ID)
+		}
+	}
+	want := map[string]int{stateSpace: 2, stateRole: 2, stateUser: 2, stateDocument: 10052, stateSavedObject: 2}
+	for kind, n := range want {
+		if kinds[kind] != n {
+			t.Errorf("exported %d %s entries, want %d", kinds[kind], kind, n)
+		}
+	}
+
+	var archive bytes.Buffer
+	err := c.ExportState(context.Background(), &archive, teams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.wipe()
+	err = c.ImportState(context.Background(), &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := export(t, c, teams)
+	if len(after) != len(before) {
+		t.Fatalf("exported %d entries after importing, want %d", len(after), len(before))
+	}
+	for i := range before {
+		if before[i] != after[i] {
+			t.Fatalf("entry %d changed after importing:\n%s\n%s", i, before[i], after[i])
+		}
+	}
+	if len(f.scrolls) != 0 {
+		t.Errorf("%d scrolls were left open", len(f.scrolls))
+	}
+}
+
+func TestImportStateVersion(t *testing.T) {
+	c := newFakeCluster().client(t)
+	err := c.ImportState(context.Background(), strings.NewReader(`{"kind":"header","body":{"version":2}}`+"\n"))
+	if err == nil || !strings.Contains(err.Error(), "unsupported state archive version 2") {
+		t.Errorf("got error %v, want an unsupported version error", err)
+	}
+}
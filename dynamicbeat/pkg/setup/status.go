@@ -0,0 +1,127 @@
+package setup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"go.uber.org/zap"
+)
+
+// Unreachable is reported in a Status for anything that couldn't be checked.
+const Unreachable = "unreachable"
+
+// statusIndices are the index patterns of the indices that Scorestack needs.
+var statusIndices = []string{"checkdef", "checks", "attrib_admin_*", "attrib_user_*", "results-all*", "results-admin*"}
+
+// A Status is a snapshot of the health of a Scorestack instance. The counts are
+// nil if they couldn't be checked.
+type Status struct {
+	Namespace     string          `json:"namespace"`     // the namespace that was checked
+	Elasticsearch string          `json:"elasticsearch"` // the cluster health status
+	Kibana        string          `json:"kibana"`        // the overall Kibana state
+	Indices       map[string]bool `json:"indices"`       // whether any indices match each Scorestack index pattern
+	Results       *int            `json:"results"`       // the number of result documents
+	Checks        *int            `json:"checks"`        // the number of check definitions
+	LatestResult  string          `json:"latest_result"` // the timestamp of the newest result, if there is one
+}
+
+// Status checks the health of Elasticsearch, Kibana, and the Scorestack
+// indices. Unlike setup, it doesn't wait for anything to become ready. If a
+// part of the status can't be checked, it is reported as Unreachable and the
+// rest of the status is still checked.
+func (c *Client) Status(ctx context.Context) Status {
+	s := Status{
+		Namespace:     c.Namespace.Space(),
+		Elasticsearch: Unreachable,
+		Kibana:        Unreachable,
+		Indices:       make(map[string]bool),
+		LatestResult:  Unreachable,
+	}
+
+	health, err := c.Elasticsearch.ClusterHealth(ctx)
+	if err != nil {
+		zap.S().Debugf("failed to get Elasticsearch status: %s", err)
+	} else {
+		s.Elasticsearch = health
+	}
+
+	state, err := c.Kibana.Status(ctx)
+	if err != nil {
+		zap.S().Debugf("failed to get Kibana status: %s", err)
+	} else {
+		s.Kibana = state
+	}
+
+	ns := c.Namespace
+	for _, pattern := range namespaceIndices(ns, statusIndices...) {
+		indices, err := c.Elasticsearch.ListIndices(ctx, pattern)
+		if err != nil {
+			zap.S().Debugf("failed to list indices for '%s': %s", pattern, err)
+			continue
+		}
+		s.Indices[pattern] = len(indices) > 0
+	}
+
+	// Missing indices can't be counted, so only count the ones that exist
+	results := ns.Index("results-all*")
+	if s.Indices[results] {
+		s.Results = c.countDocuments(ctx, results)
+		latest, err := c.Elasticsearch.LatestTimestamp(ctx, results)
+		if err != nil {
+			zap.S().Debugf("failed to get latest result: %s", err)
+		} else {
+			s.LatestResult = latest
+		}
+	}
+	if checkdef := ns.Index("checkdef"); s.Indices[checkdef] {
+		s.Checks = c.countDocuments(ctx, checkdef)
+	}
+
+	return s
+}
+
+func (c *Client) countDocuments(ctx context.Context, pattern string) *int {
+	count, err := c.Elasticsearch.CountDocuments(ctx, pattern)
+	if err != nil {
+		zap.S().Debugf("failed to count documents in '%s': %s", pattern, err)
+		return nil
+	}
+	return &count
+}
+
+// PrintStatus writes a Status as a human-readable table.
+func PrintStatus(w io.Writer, s Status) error {
+	count := func(n *int) string {
+		if n == nil {
+			return Unreachable
+		}
+		return strconv.Itoa(*n)
+	}
+	latest := s.LatestResult
+	if latest == "" {
+		latest = "none"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Elasticsearch\t%s\n", s.Elasticsearch)
+	fmt.Fprintf(tw, "Kibana\t%s\n", s.Kibana)
+	fmt.Fprintf(tw, "Namespace\t%s\n", s.Namespace)
+	for _, pattern := range namespaceIndices(config.Namespace(s.Namespace), statusIndices...) {
+		exists, ok := s.Indices[pattern]
+		state := Unreachable
+		if ok && exists {
+			state = "exists"
+		} else if ok {
+			state = "missing"
+		}
+		fmt.Fprintf(tw, "Index %s\t%s\n", pattern, state)
+	}
+	fmt.Fprintf(tw, "Results\t%s\n", count(s.Results))
+	fmt.Fprintf(tw, "Checks\t%s\n", count(s.Checks))
+	fmt.Fprintf(tw, "Latest result\t%s\n", latest)
+	return tw.Flush()
+}
@@ -0,0 +1,291 @@
+package setup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets/spaces"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets/users"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/kibclient"
+	"go.uber.org/zap"
+)
+
+// Client bundles the Elasticsearch and Kibana clients that are needed to set
+// up objects that span both services, like teams.
+type Client struct {
+	Elasticsearch *esclient.Client
+	Kibana        *kibclient.Client
+	Namespace     config.Namespace // the namespace that the Scorestack resources are in
+	Progress      ProgressFunc     // called as each step of Setup is processed; may be nil
+	Concurrency   int              // the number of teams that Setup will work on at the same time
+
+	// How long to keep results indices before they are deleted by ILM, like
+	// 30d; empty means results are kept forever
+	ResultsRetention string
+
+	// Whether to continue setup if Elasticsearch or Kibana is an unsupported
+	// version
+	SkipVersionCheck bool
+
+	// The snapshot repository and policy to add during setup
+	Snapshots SnapshotOptions
+
+	// The number of rounds in a row that a check must fail for before the
+	// team's alerting rule fires; 0 means no alerting rules are added
+	AlertFailures int
+
+	// How often Dynamicbeat runs a round of checks, which the alerting rules
+	// use to find the results of the last few rounds
+	RoundTime time.Duration
+
+	// A directory of extra resources to add after the default resources; see
+	// LoadPlan for the layout
+	ResourcesDir string
+
+	// Whether AddAttributes should accept attributes that aren't referenced
+	// by the check definition
+	AllowUnreferencedAttributes bool
+}
+
+// NewClient creates Elasticsearch and Kibana clients that are configured using
+// the setup settings from the Dynamicbeat config.
+func NewClient(c config.Config) (*Client, error) {
+	es, err := ElasticsearchClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	kib, err := KibanaClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		Elasticsearch:    es,
+		Kibana:           kib,
+		Namespace:        c.Namespace,
+		Concurrency:      c.Setup.Concurrency,
+		SkipVersionCheck: c.Setup.SkipVersionCheck,
+		ResultsRetention: c.Setup.ResultsRetention,
+		ResourcesDir:     c.Setup.Resources,
+		AlertFailures:    c.Setup.AlertFailures,
+		RoundTime:        c.RoundTime,
+		Snapshots: SnapshotOptions{
+			Type:      c.Setup.Snapshots.Type,
+			Location:  c.Setup.Snapshots.Location,
+			Bucket:    c.Setup.Snapshots.Bucket,
+			BasePath:  c.Setup.Snapshots.BasePath,
+			Schedule:  c.Setup.Snapshots.Schedule,
+			Retention: c.Setup.Snapshots.Retention,
+		},
+	}, nil
+}
+
+// TeamOptions controls which objects are created for a team.
+type TeamOptions struct {
+	Password string // the password for the team's user; a random password is generated if this is empty
+	Space    bool   // whether to create a Kibana space for the team
+}
+
+// TeamConfig is a team to be created by AddTeams.
+type TeamConfig struct {
+	Name string
+	TeamOptions
+}
+
+// TeamCredentials are the login details of a team's user.
+type TeamCredentials struct {
+	Name     string // the username, which includes the namespace outside of the default namespace
+	Password string
+}
+
+// TeamErrors collects the errors for each team that could not be created by
+// AddTeams, keyed by team name.
+type TeamErrors map[string]error
+
+func (e TeamErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", name, e[name]))
+	}
+	return fmt.Sprintf("failed to add %d teams: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// forEachTeam calls f for each team, with up to concurrency calls running at
+// the same time. Every team is processed even if some fail. If any calls fail,
+// the returned error is a TeamErrors.
+func forEachTeam(teams []config.Team, concurrency int, f func(config.Team) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(TeamErrors)
+	sem := make(chan struct{}, concurrency)
+	for _, team := range teams {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(team config.Team) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := f(team)
+			if err != nil {
+				mu.Lock()
+				errs[team.Name] = err
+				mu.Unlock()
+			}
+		}(team)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// AddTeam creates a team's role, user, and optionally Kibana space. The team's
+// role can only read the team's own documents in the results indices. It
+// is safe to call AddTeam for a team that already exists; the team's password
+// will be reset to the returned password.
+func (c *Client) AddTeam(ctx context.Context, name string, opts TeamOptions) (string, error) {
+	password := opts.Password
+	if password == "" {
+		var err error
+		password, err = generatePassword()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	account := c.Namespace.Name(name)
+	role, err := GenerateTeamRole(c.Namespace, name)
+	if err != nil {
+		return "", err
+	}
+	err = c.Kibana.AddRole(ctx, account, role)
+	if err != nil {
+		return "", fmt.Errorf("failed to add role: %w", err)
+	}
+
+	user, err := c.teamUser(name, password)
+	if err != nil {
+		return "", err
+	}
+	err = c.Elasticsearch.UpsertUser(ctx, account, user)
+	if err != nil {
+		return "", fmt.Errorf("failed to add user: %w", err)
+	}
+
+	if opts.Space {
+		err = c.Kibana.AddSpace(ctx, account, namespaced(c.Namespace, func() io.Reader {
+			return spaces.Team(name)
+		}, func(def map[string]interface{}) {
+			def["id"] = account
+		}))
+		if err != nil {
+			return "", fmt.Errorf("failed to add space: %w", err)
+		}
+	}
+
+	return password, nil
+}
+
+// AddTeams creates several teams with AddTeam, working on up to concurrency
+// teams at a time. The credentials of every team that was created are
+// returned, even if other teams failed. If any teams failed, the returned
+// error is a TeamErrors.
+func (c *Client) AddTeams(ctx context.Context, teams []TeamConfig, concurrency int) ([]TeamCredentials, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	creds := make([]TeamCredentials, 0, len(teams))
+	errs := make(TeamErrors)
+	sem := make(chan struct{}, concurrency)
+	for _, team := range teams {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(team TeamConfig) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			password, err := c.AddTeam(ctx, team.Name, team.TeamOptions)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				zap.S().Errorf("failed to add team %s: %s", team.Name, err)
+				errs[team.Name] = err
+				return
+			}
+			zap.S().Infof("added team %s", team.Name)
+			creds = append(creds, TeamCredentials{Name: c.Namespace.Name(team.Name), Password: password})
+		}(team)
+	}
+	wg.Wait()
+
+	// Keep the credentials in a predictable order for printing
+	sort.Slice(creds, func(i, j int) bool {
+		return creds[i].Name < creds[j].Name
+	})
+
+	if len(errs) > 0 {
+		return creds, errs
+	}
+	return creds, nil
+}
+
+// teamUser builds the user definition for a team with the given password.
+func (c *Client) teamUser(name string, password string) (io.Reader, error) {
+	return withPassword(name, namespaceUser(c.Namespace, func() io.Reader {
+		return users.Team(name)
+	})(), password)
+}
+
+// withPassword replaces the password in the definition of a user.
+func withPassword(name string, def io.Reader, password string) (io.Reader, error) {
+	user := make(map[string]interface{})
+	err := json.NewDecoder(def).Decode(&user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode definition of user '%s': %s", name, err)
+	}
+	user["password"] = password
+
+	body, err := json.Marshal(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode definition of user '%s': %s", name, err)
+	}
+	return bytes.NewReader(body), nil
+}
+
+func generatePassword() (string, error) {
+	buf := make([]byte, 18)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate password: %s", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,143 @@
+package setup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets/dashboards"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/esclient"
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/kibclient"
+	"go.uber.org/zap"
+)
+
+// baseRoles are the roles that are created by setup regardless of the teams
+// that are configured.
+var baseRoles = []string{"dynamicbeat", "common", "spectator", "attribute-admin", "check-admin", "scorestack-admin"}
+
+// Teardown removes everything that setup creates in a namespace from Kibana and
+// Elasticsearch.
+// Objects are removed in reverse order of creation, so nothing is left
+// referencing an object that was already removed. If dryRun is set, the
+// objects that would be removed are logged but left untouched.
+func Teardown(ctx context.Context, es *esclient.Client, kib *kibclient.Client, ns config.Namespace, teams []config.Team, dryRun bool) error {
+	err := es.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	err = kib.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	remove := func(kind string, name string, f func() error) error {
+		if dryRun {
+			zap.S().Infof("would remove %s: %s", kind, name)
+			return nil
+		}
+		err := f()
+		if err != nil {
+			return fmt.Errorf("failed to remove %s '%s': %w", kind, name, err)
+		}
+		return nil
+	}
+
+	// Remove dashboards before the space that holds them
+	for _, team := range teams {
+		name := team.Name
+		err = remove("dashboards", name, func() error {
+			return kib.RemoveDashboards(ctx, dashboards.TeamOverview(name, 20)())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = remove("dashboards", "scoreboard", func() error {
+		return kib.RemoveDashboards(ctx, dashboards.Scoreboard())
+	})
+	if err != nil {
+		return err
+	}
+	err = remove("Kibana space", ns.Space(), func() error {
+		return kib.RemoveSpace(ctx, ns.Space())
+	})
+	if err != nil {
+		return err
+	}
+
+	// Remove users before the roles that they are assigned
+	users := namespaceNames(ns, serviceAccount)
+	roles := namespaceNames(ns, baseRoles...)
+	for _, team := range teams {
+		users = append(users, ns.Name(team.Name))
+		roles = append(roles, ns.Name(team.Name))
+	}
+	for _, name := range users {
+		name := name
+		err = remove("user", name, func() error {
+			return es.RemoveUser(ctx, name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range roles {
+		name := name
+		err = remove("role", name, func() error {
+			return kib.RemoveRole(ctx, name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Stop the transform before removing the indices that it reads and writes
+	transform := ns.Name(scoreboardTransform)
+	err = remove("transform", transform, func() error {
+		return es.RemoveTransform(ctx, transform)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Remove indices last, since they hold the data everything else was using.
+	// The check indices are named exactly, since a pattern like check* would
+	// also match indices like checkout-* that aren't Scorestack's when there's
+	// no namespace. They can't be listed by name if they don't exist, but
+	// removing indices that don't exist is ignored.
+	patterns := namespaceIndices(ns, "results-*", "attrib_*")
+	indices, err := es.ListIndices(ctx, append(patterns, transform+"*")...)
+	if err != nil {
+		return err
+	}
+	indices = append(namespaceIndices(ns, "checkdef", "checks"), indices...)
+	for _, name := range indices {
+		name := name
+		err = remove("index", name, func() error {
+			return es.RemoveIndex(ctx, name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range namespaceNames(ns, "scorestack-results", "scorestack-results-all", "scorestack-checkdef", "default") {
+		name := name
+		err = remove("index template", name, func() error {
+			return es.RemoveIndexTemplate(ctx, name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Clusters without ILM respond with a 400, so there's nothing to remove
+	policy := ns.Name(resultsPolicy)
+	return remove("ILM policy", policy, func() error {
+		res, err := es.ILM.DeleteLifecycle(policy, es.ILM.DeleteLifecycle.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		return es.CloseAndCheck(res, 400, 404)
+	})
+}
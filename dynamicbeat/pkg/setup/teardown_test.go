@@ -0,0 +1,120 @@
+package setup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/config"
+)
+
+func TestTeardownIndices(t *testing.T) {
+	// Indices that aren't Scorestack's share the cluster with it
+	existing := []string{
+		"attrib_admin_web", "attrib_user_web", "checkdef", "checks", "results-admin", "results-all-2021.10.01", "scorestack-scoreboard",
+		"ctf-attrib_admin_web", "ctf-checkdef", "ctf-checks", "ctf-results-all", "ctf-scoreboard",
+		"checkout-2021.10", "checks-archive", "checkpoints",
+	}
+
+	tests := []struct {
+		name    string
+		ns      config.Namespace
+		missing []string // indices that were already removed
+		removed []string
+	}{
+		{
+			name:    "default namespace",
+			removed: []string{"attrib_admin_web", "attrib_user_web", "checkdef", "checks", "results-admin", "results-all-2021.10.01", "scorestack-scoreboard"},
+		},
+		{
+			name:    "namespace",
+			ns:      "ctf",
+			removed: []string{"ctf-attrib_admin_web", "ctf-checkdef", "ctf-checks", "ctf-results-all", "ctf-scoreboard"},
+		},
+		{
+			name:    "check indices were already removed",
+			missing: []string{"checkdef", "checks"},
+			removed: []string{"attrib_admin_web", "attrib_user_web", "results-admin", "results-all-2021.10.01", "scorestack-scoreboard"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			indices := make(map[string]bool)
+			for _, name := range existing {
+				indices[name] = true
+			}
+			for _, name := range tt.missing {
+				delete(indices, name)
+			}
+
+			// Elasticsearch and Kibana accept every request, and only the
+			// indices are tracked
+			var mu sync.Mutex
+			var removed []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+				switch {
+				case r.URL.Path == "/":
+					fmt.Fprint(w, `{"version":{"number":"7.9.2"}}`)
+				case r.URL.Path == "/_cluster/health":
+					fmt.Fprint(w, `{"status":"green"}`)
+				case r.URL.Path == "/api/status":
+					fmt.Fprint(w, `{"status":{"overall":{"level":"available"}}}`)
+				case len(parts) == 3 && parts[0] == "_cat" && parts[1] == "indices":
+					var names []string
+					for index := range indices {
+						for _, pattern := range strings.Split(parts[2], ",") {
+							if ok, _ := path.Match(pattern, index); ok {
+								names = append(names, fmt.Sprintf(`{"index":"%s"}`, index))
+								break
+							}
+						}
+					}
+					fmt.Fprintf(w, "[%s]", strings.Join(names, ","))
+				case len(parts) == 1 && r.Method == "DELETE" && !strings.HasPrefix(parts[0], "_"):
+					if !indices[parts[0]] {
+						w.WriteHeader(http.StatusNotFound)
+						fmt.Fprint(w, `{"error":{"type":"index_not_found_exception"},"status":404}`)
+						return
+					}
+					delete(indices, parts[0])
+					removed = append(removed, parts[0])
+					fmt.Fprint(w, `{"acknowledged":true}`)
+				default:
+					fmt.Fprint(w, "{}")
+				}
+			}))
+			defer srv.Close()
+
+			c := config.Config{Elasticsearch: []string{srv.URL}}
+			c.Setup.Kibana = []string{srv.URL}
+			es, err := ElasticsearchClient(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kib, err := KibanaClient(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = Teardown(context.Background(), es, kib, tt.ns, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			sort.Strings(removed)
+			if strings.Join(removed, " ") != strings.Join(tt.removed, " ") {
+				t.Errorf("got removed indices %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package setup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/assets"
+)
+
+// assetKinds are the kinds of resources in each directory of the embedded
+// assets.
+var assetKinds = map[string]string{
+	"dashboards": "dashboard",
+	"indices":    "index",
+	"roles":      "role",
+	"spaces":     "space",
+	"transforms": "transform",
+	"users":      "user",
+}
+
+// requiredFields are the top-level fields that each kind of resource must
+// have. Kinds that aren't listed only have to be JSON objects.
+var requiredFields = map[string][]string{
+	"space":          {"id", "name"},
+	"role":           {"elasticsearch"},
+	"user":           {"roles"},
+	"index-template": {"index_patterns"},
+	"index":          {"mappings"},
+	"transform":      {"source", "dest"},
+	"data-view":      {"title"},
+	"dashboard":      {"objects"},
+	"alert-rule":     {"rule_type_id", "consumer", "schedule", "params"},
+}
+
+// ResourceErrors collects every problem that was found with a set of
+// resources, keyed by the path of the resource.
+type ResourceErrors map[string]error
+
+func (e ResourceErrors) Error() string {
+	paths := make([]string, 0, len(e))
+	for p := range e {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	msgs := make([]string, 0, len(paths))
+	for _, p := range paths {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", p, e[p]))
+	}
+	return fmt.Sprintf("found problems with %d resources: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// ValidateResources checks that every embedded resource is a JSON object with
+// the fields that its kind of resource needs. Team resources are checked with
+// a placeholder team templated in. Every problem is returned at once as a
+// ResourceErrors, so that they can all be fixed before setup makes any
+// changes.
+func ValidateResources() error {
+	files, err := assets.Files()
+	if err != nil {
+		return fmt.Errorf("failed to list embedded resources: %s", err)
+	}
+
+	errs := make(ResourceErrors)
+	for _, file := range files {
+		kind, ok := assetKinds[path.Dir(file)]
+		if !ok {
+			continue
+		}
+
+		data, err := assets.Render(file)
+		if err == nil {
+			err = validateResource(kind, data)
+		}
+		if err != nil {
+			errs[file] = err
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateResourceDir checks the resources in a directory with the layout
+// that LoadPlan reads, like the resources of a check pack. Like
+// ValidateResources, every problem is returned at once as a ResourceErrors.
+func ValidateResourceDir(dir string) error {
+	errs := make(ResourceErrors)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read resources directory '%s': %s", dir, err)
+	}
+	for _, e := range entries {
+		if _, ok := stepFuncs[e.Name()]; e.IsDir() && !ok {
+			errs[filepath.Join(dir, e.Name())] = fmt.Errorf("unknown resource kind - must be one of %s", strings.Join(stepKinds, ", "))
+		}
+	}
+
+	for _, kind := range stepKinds {
+		files, err := filepath.Glob(filepath.Join(dir, kind, "*.json"))
+		if err != nil {
+			return fmt.Errorf("failed to list %s resources in '%s': %s", kind, dir, err)
+		}
+
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err == nil {
+				err = validateResource(kind, data)
+			}
+			if err != nil {
+				errs[file] = err
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateResource checks that a resource is a JSON object with the required
+// fields for its kind.
+func validateResource(kind string, data []byte) error {
+	def := make(map[string]json.RawMessage)
+	err := json.Unmarshal(data, &def)
+	if err != nil {
+		return fmt.Errorf("not a valid JSON object: %s", err)
+	}
+
+	var missing []string
+	for _, field := range requiredFields[kind] {
+		if _, ok := def[field]; !ok {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s is missing required fields: %s", kind, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// validateSetupResources checks the embedded resources and the extra
+// resources directory, if there is one.
+func (c *Client) validateSetupResources() error {
+	err := ValidateResources()
+	if err != nil {
+		return err
+	}
+	if c.ResourcesDir == "" {
+		return nil
+	}
+	if _, err := os.Stat(c.ResourcesDir); os.IsNotExist(err) {
+		// LoadPlan treats a missing directory as empty
+		return nil
+	}
+	return ValidateResourceDir(c.ResourcesDir)
+}
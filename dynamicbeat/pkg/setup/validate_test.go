@@ -0,0 +1,120 @@
+package setup
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateResources(t *testing.T) {
+	err := ValidateResources()
+	if err != nil {
+		t.Errorf("embedded resources are invalid: %s", err)
+	}
+}
+
+func TestValidateResourceDir(t *testing.T) {
+	err := ValidateResourceDir(filepath.Join("testdata", "resources", "valid"))
+	if err != nil {
+		t.Errorf("valid resources were rejected: %s", err)
+	}
+}
+
+func TestValidateResourceDirBroken(t *testing.T) {
+	dir := filepath.Join("testdata", "resources", "broken")
+	want := map[string]string{
+		"space/missing-name.json":       "space is missing required fields: name",
+		"role/truncated.json":           "not a valid JSON object: unexpected end of JSON input",
+		"user/array.json":               "not a valid JSON object: json: cannot unmarshal array",
+		"index/empty.json":              "not a valid JSON object: unexpected end of JSON input",
+		"transform/missing-fields.json": "transform is missing required fields: source, dest",
+		"widgets":                       "unknown resource kind - must be one of space, role,",
+	}
+
+	err := ValidateResourceDir(dir)
+	var errs ResourceErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got error %v, want ResourceErrors", err)
+	}
+	for file, msg := range want {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		got, ok := errs[path]
+		if !ok {
+			t.Errorf("no problem was found with %s", path)
+			continue
+		}
+		if !strings.HasPrefix(got.Error(), msg) {
+			t.Errorf("got problem %q with %s, want %q", got, path, msg)
+		}
+	}
+	for path := range errs {
+		file, _ := filepath.Rel(dir, path)
+		if _, ok := want[filepath.ToSlash(file)]; !ok {
+			t.Errorf("unexpected problem with %s: %s", path, errs[path])
+		}
+	}
+
+	// Every problem is reported at once, in a stable order
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "found problems with 6 resources: ") {
+		t.Errorf("got error %q, want it to count 6 resources", msg)
+	}
+	if i, j := strings.Index(msg, "index/empty.json"), strings.Index(msg, "widgets"); i < 0 || j < i {
+		t.Errorf("problems aren't sorted by path: %s", msg)
+	}
+}
+
+func TestValidateResourceDirMissing(t *testing.T) {
+	err := ValidateResourceDir(filepath.Join("testdata", "resources", "missing"))
+	if err == nil || !strings.Contains(err.Error(), "failed to read resources directory") {
+		t.Errorf("got error %v, want a read error", err)
+	}
+}
+
+func TestValidateSetupResources(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  string
+		err  bool
+	}{
+		{"no resources directory", "", false},
+		{"missing resources directory", filepath.Join("testdata", "resources", "missing"), false},
+		{"valid resources", filepath.Join("testdata", "resources", "valid"), false},
+		{"broken resources", filepath.Join("testdata", "resources", "broken"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Client{ResourcesDir: tt.dir}).validateSetupResources()
+			if (err != nil) != tt.err {
+				t.Errorf("got error %v, want error: %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateResource(t *testing.T) {
+	tests := []struct {
+		kind string
+		data string
+		err  string
+	}{
+		{"space", `{"id":"practice","name":"Practice"}`, ""},
+		{"space", `{}`, "space is missing required fields: id, name"},
+		{"index-template", `{"template":{}}`, "index-template is missing required fields: index_patterns"},
+		{"dashboard", `{"objects":[]}`, ""},
+		{"kibana-settings", `{"theme:darkMode":true}`, ""},
+		{"kibana-settings", `"dark"`, "not a valid JSON object"},
+		{"role", `{"elasticsearch":{}} trailing`, "not a valid JSON object"},
+		{"alert-rule", `{"rule_type_id":".index-threshold","consumer":"alerts"}`, "alert-rule is missing required fields: schedule, params"},
+	}
+	for _, tt := range tests {
+		err := validateResource(tt.kind, []byte(tt.data))
+		if tt.err == "" && err != nil {
+			t.Errorf("%s %s: unexpected error: %s", tt.kind, tt.data, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s %s: got error %v, want %q", tt.kind, tt.data, err, tt.err)
+		}
+	}
+}
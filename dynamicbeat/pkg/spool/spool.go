@@ -0,0 +1,343 @@
+// Package spool queues records on disk, so that they survive Dynamicbeat
+// restarting while they wait to be sent.
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/scorestack/scorestack/dynamicbeat/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// Metrics of the spool, which are served by the metrics endpoint.
+var (
+	spooledRecords = expvar.NewInt("dynamicbeat.spool.records")
+	spooledBytes   = expvar.NewInt("dynamicbeat.spool.bytes")
+	droppedRecords = expvar.NewInt("dynamicbeat.spool.dropped")
+)
+
+func init() {
+	metrics.NewGaugeFunc("dynamicbeat_spool_documents", "Records in the spool that are waiting to be indexed.", func() float64 {
+		return float64(spooledRecords.Value())
+	})
+}
+
+// segments is how many files the spool is split into at most, so that the
+// oldest records can be dropped once the spool is full without dropping all
+// of them.
+const segments = 4
+
+// A Spool is an append-only queue of records, split across numbered files in
+// a directory. Records are read back in the order that they were appended,
+// and each file is removed once all of its records have been read and
+// acknowledged. Records that were read but not acknowledged when Dynamicbeat
+// stopped are read again when the spool is opened, so records can be read
+// more than once.
+type Spool struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	mu    sync.Mutex
+	files []*file // oldest first; the newest is appended to
+	out   *os.File
+
+	in      *os.File
+	reader  *bufio.Reader
+	read    int    // the records of the oldest file that have been acknowledged
+	pending []byte // the record that Next returned, until it is acknowledged
+}
+
+type file struct {
+	seq     int
+	size    int64
+	records int
+}
+
+// Open opens the spool in a directory, creating the directory if needed. The
+// spool drops its oldest records once its files add up to more than maxSize
+// bytes.
+func Open(dir string, maxSize int64) (*Spool, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("spool size %d must be greater than 0", maxSize)
+	}
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool directory %s: %s", dir, err)
+	}
+
+	s := &Spool{dir: dir, maxSize: maxSize, segmentSize: maxSize / segments}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory %s: %s", dir, err)
+	}
+	for _, e := range entries {
+		seq, ok := parseName(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		f := &file{seq: seq, size: e.Size()}
+		f.records, err = countRecords(s.path(seq))
+		if err != nil {
+			return nil, err
+		}
+		s.files = append(s.files, f)
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].seq < s.files[j].seq })
+
+	s.updateMetrics()
+	return s, nil
+}
+
+// Append adds a record to the end of the spool. Records must not contain
+// newlines.
+func (s *Spool) Append(record []byte) error {
+	if bytes.IndexByte(record, '\n') >= 0 {
+		return fmt.Errorf("spool records must not contain newlines")
+	}
+	size := int64(len(record) + 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.updateMetrics()
+
+	// Start a new file once the newest one is full, and drop the oldest files
+	// once the spool is. A new file is also started after opening the spool,
+	// since the newest file can end with a record that was cut off.
+	newest := s.newest()
+	if s.out == nil || (newest.size > 0 && newest.size+size > s.segmentSize) {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+		newest = s.newest()
+	}
+	for s.size()+size > s.maxSize && len(s.files) > 1 {
+		s.dropOldest()
+	}
+
+	_, err := s.out.Write(append(record, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to write to spool file %s: %s", s.out.Name(), err)
+	}
+	newest.size += size
+	newest.records++
+	return nil
+}
+
+// Next returns the oldest record that hasn't been acknowledged, or io.EOF if
+// the spool is empty. The same record is returned until it is acknowledged.
+func (s *Spool) Next() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending != nil {
+		return s.pending, nil
+	}
+
+	for len(s.files) > 0 {
+		oldest := s.files[0]
+		if s.read < oldest.records {
+			if s.reader == nil {
+				in, err := os.Open(s.path(oldest.seq))
+				if err != nil {
+					return nil, fmt.Errorf("failed to open spool file: %s", err)
+				}
+				s.in = in
+				s.reader = bufio.NewReader(in)
+			}
+			line, err := s.reader.ReadBytes('\n')
+			if err != nil {
+				return nil, fmt.Errorf("failed to read spool file %s: %s", s.in.Name(), err)
+			}
+			s.pending = bytes.TrimSuffix(line, []byte("\n"))
+			return s.pending, nil
+		}
+
+		// Every record of the newest file has been read, so keep it to be
+		// appended to
+		if len(s.files) == 1 {
+			break
+		}
+		err := s.remove(oldest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, io.EOF
+}
+
+// Ack acknowledges the record that Next returned, so that it won't be
+// returned again.
+func (s *Spool) Ack() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.updateMetrics()
+	if s.pending == nil {
+		return nil
+	}
+	s.pending = nil
+	s.read++
+
+	// Remove the newest file too once all of it has been read, so the spool
+	// doesn't keep records on disk that have already been sent
+	if len(s.files) == 1 && s.read == s.files[0].records {
+		return s.remove(s.files[0])
+	}
+	return nil
+}
+
+// Len returns how many records haven't been acknowledged.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records()
+}
+
+// Close closes the files of the spool. Its records are kept on disk.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeReader()
+	if s.out != nil {
+		err := s.out.Close()
+		s.out = nil
+		return err
+	}
+	return nil
+}
+
+func (s *Spool) newest() *file {
+	if len(s.files) == 0 {
+		return nil
+	}
+	return s.files[len(s.files)-1]
+}
+
+// rotate starts a new file to append to.
+func (s *Spool) rotate() error {
+	seq := 0
+	if newest := s.newest(); newest != nil {
+		seq = newest.seq + 1
+	}
+	if s.out != nil {
+		err := s.out.Close()
+		s.out = nil
+		if err != nil {
+			return fmt.Errorf("failed to close spool file: %s", err)
+		}
+	}
+	out, err := os.OpenFile(s.path(seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %s", err)
+	}
+	s.out = out
+	s.files = append(s.files, &file{seq: seq})
+	return nil
+}
+
+// dropOldest removes the oldest file, along with the records in it that
+// haven't been acknowledged.
+func (s *Spool) dropOldest() {
+	oldest := s.files[0]
+	if dropped := oldest.records - s.read; dropped > 0 {
+		zap.S().Errorf("Spool is over its maximum size of %d bytes, so %d of the oldest records in it were dropped", s.maxSize, dropped)
+		droppedRecords.Add(int64(dropped))
+	}
+	err := s.remove(oldest)
+	if err != nil {
+		zap.S().Error(err)
+	}
+}
+
+// remove removes the oldest file.
+func (s *Spool) remove(f *file) error {
+	s.closeReader()
+	if len(s.files) == 1 && s.out != nil {
+		s.out.Close()
+		s.out = nil
+	}
+	s.files = s.files[1:]
+	s.read = 0
+	err := os.Remove(s.path(f.seq))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove spool file: %s", err)
+	}
+	return nil
+}
+
+func (s *Spool) closeReader() {
+	if s.in != nil {
+		s.in.Close()
+	}
+	s.in = nil
+	s.reader = nil
+	s.pending = nil
+}
+
+func (s *Spool) size() int64 {
+	var size int64
+	for _, f := range s.files {
+		size += f.size
+	}
+	return size
+}
+
+func (s *Spool) records() int {
+	records := -s.read
+	for _, f := range s.files {
+		records += f.records
+	}
+	return records
+}
+
+func (s *Spool) updateMetrics() {
+	spooledRecords.Set(int64(s.records()))
+	spooledBytes.Set(s.size())
+}
+
+func (s *Spool) path(seq int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("spool-%08d.jsonl", seq))
+}
+
+// parseName returns the number of a spool file from its name.
+func parseName(name string) (int, bool) {
+	if !strings.HasPrefix(name, "spool-") || !strings.HasSuffix(name, ".jsonl") {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "spool-"), ".jsonl"))
+	return seq, err == nil
+}
+
+// countRecords counts the complete records in a spool file. A record that
+// was cut off when Dynamicbeat stopped is ignored.
+func countRecords(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open spool file: %s", err)
+	}
+	defer f.Close()
+
+	records := 0
+	reader := bufio.NewReader(f)
+	for {
+		_, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read spool file %s: %s", path, err)
+		}
+		records++
+	}
+}
@@ -0,0 +1,19 @@
+package util
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff calculates how long to wait before making the given retry attempt,
+// starting at 0 for the first retry. The delay doubles with each attempt up to
+// a maximum of 30 seconds, and up to 50% random jitter is added so that many
+// clients retrying at once don't all hit the server at the same time.
+func Backoff(attempt int) time.Duration {
+	delay := 30 * time.Second
+	if attempt < 5 {
+		delay = time.Second << uint(attempt)
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(delay/2)))
+}
@@ -0,0 +1,35 @@
+package util
+
+import "bytes"
+
+// A LimitedBuffer keeps the first Max bytes that are written to it, and
+// discards the rest. It is used to capture command output without letting a
+// noisy command use up Dynamicbeat's memory.
+type LimitedBuffer struct {
+	Max int
+
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *LimitedBuffer) Write(p []byte) (int, error) {
+	if room := b.Max - b.buf.Len(); len(p) > room {
+		b.truncated = true
+		b.buf.Write(p[:room])
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// Bytes returns the output that was kept.
+func (b *LimitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// String returns the output that was kept, with a note if any was discarded.
+func (b *LimitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
@@ -0,0 +1,92 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// A GzipTransport is an HTTP transport that compresses request bodies of at
+// least MinSize bytes with gzip, and asks for responses to be compressed.
+// Compressed responses are decompressed before they are returned, so callers
+// always read plain bodies.
+type GzipTransport struct {
+	Next    http.RoundTripper
+	MinSize int
+}
+
+func (t *GzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests must not be modified by a transport, so work on a copy
+	req = req.Clone(req.Context())
+
+	if req.Body != nil && req.Header.Get("Content-Encoding") == "" {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(body) >= t.MinSize {
+			body, err = gzipBody(body)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		req.ContentLength = int64(len(body))
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	// Setting Accept-Encoding stops the standard transport from decompressing
+	// the response itself, so it has to be done here instead
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := t.Next.RoundTrip(req)
+	if err != nil || res.Header.Get("Content-Encoding") != "gzip" {
+		return res, err
+	}
+
+	r, err := gzip.NewReader(res.Body)
+	if err != nil {
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to decompress response: %s", err)
+	}
+	res.Body = &gzipReadCloser{Reader: r, body: res.Body}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return res, nil
+}
+
+// gzipBody compresses a request body.
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress request: %s", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress request: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipReadCloser decompresses a response body, and closes the underlying body
+// when it is closed.
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
@@ -0,0 +1,199 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoServer responds with the body of each request after decompressing it,
+// compressing the response if the request asks for it with the gzip query
+// parameter. The headers of the last request are kept.
+type echoServer struct {
+	header http.Header
+	sent   int // the length of the last request body, as it was sent
+}
+
+func (s *echoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.header = r.Header.Clone()
+	body, _ := ioutil.ReadAll(r.Body)
+	s.sent = len(body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ = ioutil.ReadAll(zr)
+	}
+
+	switch r.URL.Query().Get("gzip") {
+	case "valid":
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		_, _ = zw.Write(body)
+		_ = zw.Close()
+	case "invalid":
+		w.Header().Set("Content-Encoding", "gzip")
+		fmt.Fprint(w, "not gzip")
+	default:
+		_, _ = w.Write(body)
+	}
+}
+
+func TestGzipTransport(t *testing.T) {
+	large := strings.Repeat(`{"name":"ssh-team01","type":"ssh"}`, 100)
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		encoding string // the Content-Encoding that the request is sent with
+		query    string
+		compress bool // whether the body is compressed
+	}{
+		{name: "no body", method: "GET"},
+		{name: "small body", method: "POST", body: `{"query":{}}`},
+		{name: "large body", method: "POST", body: large, compress: true},
+		{name: "body at the minimum size", method: "PUT", body: large[:1024], compress: true},
+		{name: "body under the minimum size", method: "PUT", body: large[:1023]},
+		{name: "already encoded", method: "POST", body: large, encoding: "identity"},
+		{name: "compressed response", method: "POST", body: large, query: "?gzip=valid", compress: true},
+		{name: "compressed response to a small request", method: "POST", body: "{}", query: "?gzip=valid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &echoServer{}
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+			client := &http.Client{Transport: &GzipTransport{Next: http.DefaultTransport, MinSize: 1024}}
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req, err := http.NewRequest(tt.method, srv.URL+"/"+tt.query, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.body {
+				t.Errorf("got response body of %d bytes, want the %d bytes that were sent", len(got), len(tt.body))
+			}
+			if res.Header.Get("Content-Encoding") != "" {
+				t.Errorf("response still has Content-Encoding %q", res.Header.Get("Content-Encoding"))
+			}
+			if s.header.Get("Accept-Encoding") != "gzip" {
+				t.Errorf("request was sent with Accept-Encoding %q, want gzip", s.header.Get("Accept-Encoding"))
+			}
+			encoding := s.header.Get("Content-Encoding")
+			switch {
+			case tt.compress && (encoding != "gzip" || s.sent >= len(tt.body)):
+				t.Errorf("request was sent with Content-Encoding %q and %d bytes, want it compressed from %d bytes", encoding, s.sent, len(tt.body))
+			case !tt.compress && (encoding != tt.encoding || s.sent != len(tt.body)):
+				t.Errorf("request was sent with Content-Encoding %q and %d bytes, want it unchanged", encoding, s.sent)
+			}
+
+			// The request that was passed in must not be modified
+			if req.Header.Get("Accept-Encoding") != "" || req.Header.Get("Content-Encoding") != tt.encoding {
+				t.Errorf("transport modified the request headers: %v", req.Header)
+			}
+		})
+	}
+}
+
+func TestGzipTransportRetry(t *testing.T) {
+	// Retries resend the body from GetBody, which must still be compressed
+	var bodies [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+
+	var sent *http.Request
+	transport := &GzipTransport{Next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req
+		return http.DefaultTransport.RoundTrip(req)
+	}), MinSize: 10}
+	req, err := http.NewRequest("POST", srv.URL, strings.NewReader(strings.Repeat("a", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	again, err := sent.GetBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resent, _ := ioutil.ReadAll(again)
+	if !bytes.Equal(resent, bodies[0]) || int64(len(resent)) != sent.ContentLength {
+		t.Errorf("GetBody returned %d bytes, but %d compressed bytes were sent", len(resent), len(bodies[0]))
+	}
+}
+
+func TestGzipTransportInvalidResponse(t *testing.T) {
+	srv := httptest.NewServer(&echoServer{})
+	defer srv.Close()
+	client := &http.Client{Transport: &GzipTransport{Next: http.DefaultTransport}}
+
+	_, err := client.Get(srv.URL + "/?gzip=invalid")
+	if err == nil || !strings.Contains(err.Error(), "failed to decompress response") {
+		t.Errorf("got error %v, want a decompression error", err)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func BenchmarkGzipTransport(b *testing.B) {
+	body := []byte(strings.Repeat(`{"_index":"results-team01","check_id":"ssh-team01","passed":true}`+"\n", 1000))
+	for _, minSize := range []int{len(body) + 1, 1024} {
+		name := "compressed"
+		if minSize > len(body) {
+			name = "uncompressed"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := &echoServer{}
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+			client := &http.Client{Transport: &GzipTransport{Next: http.DefaultTransport, MinSize: minSize}}
+
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res, err := client.Post(srv.URL+"/?gzip=valid", "application/x-ndjson", bytes.NewReader(body))
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, _ = ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}
+			b.ReportMetric(float64(s.sent), "sent-bytes/op")
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// redacted replaces secrets in request logs.
+const redacted = "[REDACTED]"
+
+// secretHeaders are the headers whose values are never logged.
+var secretHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+// secretField matches a JSON string field whose name looks like it holds a
+// secret, like "password" or "api_key". Matching is done with a regular
+// expression instead of decoding the body so that truncated bodies can still
+// be redacted, including values that were cut off partway through.
+var secretField = regexp.MustCompile(`(?i)("[^"]*(?:password|passwd|secret|api_key|token|encoded)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*(?:"|\\?$)`)
+
+// RedactSecrets replaces the values of JSON fields that look like they hold
+// secrets.
+func RedactSecrets(body []byte) []byte {
+	return secretField.ReplaceAll(body, []byte(`${1}"`+redacted+`"`))
+}
+
+// A LoggingTransport is an HTTP transport that logs each request and response
+// at debug level, with credentials and secret JSON fields redacted. Bodies are
+// truncated to MaxBody bytes in the log, but are passed along in full.
+type LoggingTransport struct {
+	Next    http.RoundTripper
+	MaxBody int
+}
+
+func (t *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	zap.S().Debugw("sending request",
+		"method", req.Method,
+		"url", req.URL.Redacted(),
+		"headers", redactHeaders(req.Header),
+		"body", t.truncate(body),
+	)
+
+	start := time.Now()
+	res, err := t.Next.RoundTrip(req)
+	if err != nil {
+		zap.S().Debugw("request failed",
+			"method", req.Method,
+			"url", req.URL.Redacted(),
+			"error", err,
+		)
+		return nil, err
+	}
+
+	// Only read as much of the response as will be logged, and put it back in
+	// front of the rest of the body for the caller
+	prefix, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(t.MaxBody)+1))
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), res.Body), res.Body}
+
+	zap.S().Debugw("received response",
+		"method", req.Method,
+		"url", req.URL.Redacted(),
+		"status", res.StatusCode,
+		"duration", time.Since(start),
+		"headers", redactHeaders(res.Header),
+		"body", t.truncate(prefix),
+	)
+
+	return res, nil
+}
+
+// truncate redacts a body and shortens it to MaxBody bytes for logging.
+func (t *LoggingTransport) truncate(body []byte) string {
+	if len(body) > t.MaxBody {
+		return string(RedactSecrets(body[:t.MaxBody])) + "...(truncated)"
+	}
+	return string(RedactSecrets(body))
+}
+
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range secretHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, redacted)
+		}
+	}
+	return h
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// A PlannedAction is a request that was skipped because a client was in
+// dry-run mode.
+type PlannedAction struct {
+	Service string // the service that the request would have been sent to
+	Method  string // the HTTP method of the request
+	Path    string // the path of the request
+	Summary string // a short summary of the request body
+}
+
+// A Plan collects the actions that a client in dry-run mode would have taken.
+// It is safe for concurrent use, and a nil Plan discards every action.
+type Plan struct {
+	mu      sync.Mutex
+	actions []PlannedAction
+}
+
+// IsMutating returns whether a request with the given HTTP method may change
+// something on the server.
+func IsMutating(method string) bool {
+	return method != "GET" && method != "HEAD"
+}
+
+// Add logs a planned action and adds it to the plan.
+func (p *Plan) Add(service string, method string, path string, body []byte) {
+	action := PlannedAction{
+		Service: service,
+		Method:  method,
+		Path:    path,
+		Summary: summarize(body),
+	}
+	zap.S().Infof("dry run: skipping %s request %s %s %s", service, method, path, action.Summary)
+
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.actions = append(p.actions, action)
+}
+
+// Actions returns the actions in the plan, in the order they were added.
+func (p *Plan) Actions() []PlannedAction {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]PlannedAction{}, p.actions...)
+}
+
+// summarize shortens a request body so that it can be logged on a single line.
+func summarize(body []byte) string {
+	if len(body) == 0 {
+		return "(no body)"
+	}
+
+	var buf bytes.Buffer
+	if json.Compact(&buf, body) != nil {
+		return fmt.Sprintf("(%d bytes)", len(body))
+	}
+	if buf.Len() > 80 {
+		return fmt.Sprintf("%s... (%d bytes)", buf.String()[:80], len(body))
+	}
+	return buf.String()
+}
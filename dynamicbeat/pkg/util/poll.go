@@ -0,0 +1,48 @@
+package util
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultPollInterval is how often Poll calls its function if no interval is
+// given.
+const DefaultPollInterval = 5 * time.Second
+
+// Poll calls f immediately, and then once every interval until f reports that
+// it is done, f returns an error, or the context is done.
+func Poll(ctx context.Context, interval time.Duration, f func() (bool, error)) error {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		done, err := f()
+		if err != nil || done {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Every returns a function that reports whether at least d has passed since
+// the last time it returned true. It always returns true the first time it is
+// called. This is useful for limiting how often a message is logged.
+func Every(d time.Duration) func() bool {
+	var last time.Time
+	return func() bool {
+		now := time.Now()
+		if !last.IsZero() && now.Sub(last) < d {
+			return false
+		}
+		last = now
+		return true
+	}
+}
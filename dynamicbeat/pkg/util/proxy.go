@@ -0,0 +1,38 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// NewProxyFunc creates a function that chooses the proxy for each HTTP request.
+// If proxyURL is empty, the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment
+// variables are used. Otherwise, every request is sent through proxyURL, which
+// may include a username and password for the proxy.
+func NewProxyFunc(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		// Parse errors include the whole URL, along with any password in it
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid proxy URL: %s", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL scheme '%s' - must be http, https, or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL '%s' - no host was given", u.Redacted())
+	}
+
+	return http.ProxyURL(u), nil
+}
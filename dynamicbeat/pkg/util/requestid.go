@@ -0,0 +1,49 @@
+package util
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// A RequestIDTransport is an HTTP transport that tags each request with a
+// User-Agent and a request ID, so that requests can be found in server logs.
+// The request ID is RunID followed by a counter, and is sent as both
+// X-Opaque-Id, which Elasticsearch records in its slow and audit logs, and
+// X-Request-Id. Transports that share a Counter number their requests in a
+// single sequence.
+type RequestIDTransport struct {
+	Next      http.RoundTripper
+	UserAgent string
+	RunID     string
+	Counter   *uint64
+}
+
+func (t *RequestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests must not be modified by a transport, so work on a copy
+	req = req.Clone(req.Context())
+
+	n := atomic.AddUint64(t.Counter, 1)
+	id := fmt.Sprintf("%s-%d", t.RunID, n)
+	if t.UserAgent != "" {
+		req.Header.Set("User-Agent", t.UserAgent)
+	}
+	req.Header.Set("X-Opaque-Id", id)
+	req.Header.Set("X-Request-Id", id)
+
+	return t.Next.RoundTrip(req)
+}
+
+// NewUUID generates a random version 4 UUID.
+func NewUUID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate UUID: %s", err)
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
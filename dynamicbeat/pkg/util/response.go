@@ -0,0 +1,60 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A ResponseError represents an unsuccessful response from Elasticsearch or
+// Kibana.
+type ResponseError struct {
+	StatusCode int    // the response code
+	Body       string // the response body
+}
+
+func (r *ResponseError) Error() string {
+	return fmt.Sprintf("response code was %v - response body: %s", r.StatusCode, r.Body)
+}
+
+// IsStatus returns whether an error is a ResponseError with the given
+// response code.
+func IsStatus(err error, code int) bool {
+	var r *ResponseError
+	return errors.As(err, &r) && r.StatusCode == code
+}
+
+// CheckResponse closes an HTTP response body and returns a *ResponseError if
+// the response code does not indicate success. All 2xx response codes are
+// considered successful, as well as any codes in the allowed list. The response
+// body is included in the error to help with debugging.
+func CheckResponse(code int, body io.ReadCloser, allowed ...int) error {
+	defer body.Close()
+	if IsSuccess(code, allowed...) {
+		return nil
+	}
+
+	buf := new(strings.Builder)
+	_, err := io.Copy(buf, body)
+	if err != nil {
+		return &ResponseError{StatusCode: code, Body: fmt.Sprintf("(couldn't read response body: %s)", err)}
+	}
+	return &ResponseError{StatusCode: code, Body: buf.String()}
+}
+
+// IsSuccess returns whether a response code is either a 2xx code or one of the
+// allowed codes.
+func IsSuccess(code int, allowed ...int) bool {
+	if code >= 200 && code < 300 {
+		return true
+	}
+
+	for _, a := range allowed {
+		if code == a {
+			return true
+		}
+	}
+
+	return false
+}
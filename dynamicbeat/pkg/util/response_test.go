@@ -0,0 +1,101 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testBody is a response body that records whether it was closed.
+type testBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *testBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+// failingReader fails every read.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		code    int
+		body    string
+		allowed []int
+		err     bool
+	}{
+		{code: 200, body: `{"acknowledged":true}`},
+		{code: 201, body: `{"result":"created"}`},
+		{code: 202},
+		{code: 204},
+		{code: 299},
+		{code: 301, body: "moved", err: true},
+		{code: 404, body: `{"error":"index_not_found_exception"}`, err: true},
+		{code: 404, body: `{"error":"index_not_found_exception"}`, allowed: []int{404}},
+		{code: 409, body: `{"error":"version_conflict_engine_exception"}`, allowed: []int{404, 409}},
+		{code: 409, body: `{"error":"version_conflict_engine_exception"}`, allowed: []int{404}, err: true},
+		{code: 500, body: `{"error":"internal server error"}`, err: true},
+		{code: 503, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d allowing %v", tt.code, tt.allowed), func(t *testing.T) {
+			body := &testBody{Reader: strings.NewReader(tt.body)}
+			err := CheckResponse(tt.code, body, tt.allowed...)
+			if !body.closed {
+				t.Error("body wasn't closed")
+			}
+			if !tt.err {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+
+			var r *ResponseError
+			if !errors.As(err, &r) {
+				t.Fatalf("got error %v, want a *ResponseError", err)
+			}
+			if r.StatusCode != tt.code || r.Body != tt.body {
+				t.Errorf("got code %d and body %q, want %d and %q", r.StatusCode, r.Body, tt.code, tt.body)
+			}
+			if !IsStatus(err, tt.code) || IsStatus(err, tt.code+1) {
+				t.Errorf("IsStatus doesn't match code %d", tt.code)
+			}
+			want := fmt.Sprintf("response code was %d - response body: %s", tt.code, tt.body)
+			if err.Error() != want {
+				t.Errorf("got message %q, want %q", err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestCheckResponseUnreadableBody(t *testing.T) {
+	body := &testBody{Reader: failingReader{}}
+	err := CheckResponse(500, body)
+	if !body.closed {
+		t.Error("body wasn't closed")
+	}
+	var r *ResponseError
+	if !errors.As(err, &r) || r.StatusCode != 500 || !strings.Contains(r.Body, "couldn't read response body: connection reset") {
+		t.Errorf("got error %v, want the read error in the body", err)
+	}
+}
+
+func TestIsStatusWrapped(t *testing.T) {
+	err := fmt.Errorf("failed to add role: %w", &ResponseError{StatusCode: 403})
+	if !IsStatus(err, 403) {
+		t.Error("IsStatus didn't find the wrapped ResponseError")
+	}
+	if IsStatus(errors.New("response code was 403"), 403) {
+		t.Error("IsStatus matched an error that isn't a ResponseError")
+	}
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ParsePrivateKey parses a PEM or OpenSSH private key, which may be encrypted.
+func ParsePrivateKey(key string, passphrase string) (ssh.Signer, error) {
+	if key == "" {
+		return nil, fmt.Errorf("publickey authentication needs a PrivateKey")
+	}
+
+	if passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %s", err)
+		}
+		return signer, nil
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(key))
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("private key is encrypted, but no KeyPassphrase was given")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %s", err)
+	}
+	return signer, nil
+}
+
+// HostKeyCallback returns a callback that checks the host key against a
+// pinned SHA256 fingerprint and known_hosts lines. Any host key is accepted
+// if neither is set.
+func HostKeyCallback(pinned string, knownHosts string) (ssh.HostKeyCallback, error) {
+	var known []ssh.PublicKey
+	rest := []byte(knownHosts)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var key ssh.PublicKey
+		var err error
+		_, _, key, _, rest, err = ssh.ParseKnownHosts(rest)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse KnownHosts: %s", err)
+		}
+		known = append(known, key)
+	}
+
+	if pinned == "" && len(known) == 0 {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if pinned != "" && fingerprint != pinned {
+			return fmt.Errorf("host key %s does not match the pinned fingerprint", fingerprint)
+		}
+		if len(known) > 0 {
+			for _, k := range known {
+				if bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil
+				}
+			}
+			return fmt.Errorf("host key %s is not in the known hosts", fingerprint)
+		}
+		return nil
+	}, nil
+}
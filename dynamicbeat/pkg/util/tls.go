@@ -0,0 +1,104 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// NewTLSConfig creates a TLS configuration for connecting to a server. If
+// caFile is set, the PEM certificates in that file will be trusted instead of
+// the system certificate pool. If certFile and keyFile are set, the PEM
+// certificate and key in those files will be presented to the server as a
+// client certificate.
+func NewTLSConfig(verify bool, caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: !verify,
+	}
+
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate file '%s': %s", caFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no valid PEM certificates found in CA certificate file '%s'", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both a client certificate and a client key must be provided")
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate '%s' and key '%s': %s", certFile, keyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// NewTLSConfigFromPEM works like NewTLSConfig, but takes the PEM contents of
+// the CA certificates, client certificate, and client key instead of the
+// names of files that hold them.
+func NewTLSConfigFromPEM(verify bool, ca string, cert string, key string) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: !verify,
+	}
+
+	if ca != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, fmt.Errorf("no valid PEM certificates found in CA certificate")
+		}
+		config.RootCAs = pool
+	}
+
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, fmt.Errorf("both a client certificate and a client key must be provided")
+		}
+
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client certificate and key: %s", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	return config, nil
+}
+
+// PinFingerprint makes a TLS configuration only accept servers whose leaf
+// certificate has the given SHA-256 fingerprint, as hex with or without
+// colons. The fingerprint is checked even if certificate verification is
+// disabled.
+func PinFingerprint(config *tls.Config, fingerprint string) error {
+	want, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("invalid SHA-256 fingerprint '%s'", fingerprint)
+	}
+
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("server did not present a certificate")
+		}
+		got := sha256.Sum256(state.PeerCertificates[0].Raw)
+		if !bytes.Equal(got[:], want) {
+			return fmt.Errorf("server certificate fingerprint %s does not match the pinned fingerprint", hex.EncodeToString(got[:]))
+		}
+		return nil
+	}
+	return nil
+}
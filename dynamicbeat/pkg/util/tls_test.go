@@ -0,0 +1,293 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its private key, in PEM.
+type testCert struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    string
+	keyPEM string
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA
+// certificate if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert, usage ...x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  usage,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:   cert,
+		key:    key,
+		pem:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+// fingerprint returns the SHA-256 fingerprint of a certificate as hex.
+func (c *testCert) fingerprint() string {
+	sum := sha256.Sum256(c.cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// tlsTestServer starts a TLS server with a certificate signed by ca, which
+// requires a client certificate signed by ca if clientAuth is set.
+func tlsTestServer(t *testing.T, ca *testCert, clientAuth bool) *httptest.Server {
+	t.Helper()
+	server := newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth)
+	pair, err := tls.X509KeyPair([]byte(server.pem), []byte(server.keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	if clientAuth {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		srv.TLS.ClientCAs = pool
+		srv.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// Rejected handshakes are expected, so don't log them
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// get makes a request to a server with a TLS configuration.
+func get(config *tls.Config, url string) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	defer client.CloseIdleConnections()
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func TestNewTLSConfigFromPEM(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	other := newTestCert(t, "other ca", nil)
+	client := newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth)
+	untrusted := newTestCert(t, "untrusted client", other, x509.ExtKeyUsageClientAuth)
+
+	tests := []struct {
+		name       string
+		clientAuth bool
+		verify     bool
+		ca         string
+		cert, key  string
+		err        string // part of the error from the request, if it fails
+	}{
+		{name: "trusted CA", verify: true, ca: ca.pem},
+		{name: "system pool", verify: true, err: "certificate signed by unknown authority"},
+		{name: "wrong CA", verify: true, ca: other.pem, err: "certificate signed by unknown authority"},
+		{name: "several CAs", verify: true, ca: other.pem + ca.pem},
+		{name: "verification disabled", verify: false},
+		{name: "client certificate", clientAuth: true, verify: true, ca: ca.pem, cert: client.pem, key: client.keyPEM},
+		{name: "missing client certificate", clientAuth: true, verify: true, ca: ca.pem, err: "remote error: tls:"},
+		{name: "untrusted client certificate", clientAuth: true, verify: true, ca: ca.pem, cert: untrusted.pem, key: untrusted.keyPEM, err: "remote error: tls:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := tlsTestServer(t, ca, tt.clientAuth)
+			config, err := NewTLSConfigFromPEM(tt.verify, tt.ca, tt.cert, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = get(config, srv.URL)
+			if tt.err == "" && err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfigFromPEMInvalid(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	client := newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth)
+	other := newTestCert(t, "other", ca, x509.ExtKeyUsageClientAuth)
+
+	tests := []struct {
+		name      string
+		ca        string
+		cert, key string
+		err       string
+	}{
+		{name: "invalid CA", ca: "not a certificate", err: "no valid PEM certificates found in CA certificate"},
+		{name: "key as CA", ca: ca.keyPEM, err: "no valid PEM certificates found in CA certificate"},
+		{name: "certificate without key", cert: client.pem, err: "both a client certificate and a client key must be provided"},
+		{name: "key without certificate", key: client.keyPEM, err: "both a client certificate and a client key must be provided"},
+		{name: "mismatched key", cert: client.pem, key: other.keyPEM, err: "failed to parse client certificate and key"},
+		{name: "swapped certificate and key", cert: client.keyPEM, key: client.pem, err: "failed to parse client certificate and key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTLSConfigFromPEM(true, tt.ca, tt.cert, tt.key)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	client := newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth)
+	dir := t.TempDir()
+	write := func(name string, data string) string {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(data), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caFile := write("ca.pem", ca.pem)
+	certFile := write("client.pem", client.pem)
+	keyFile := write("client-key.pem", client.keyPEM)
+	invalid := write("invalid.pem", "not a certificate")
+
+	srv := tlsTestServer(t, ca, true)
+	config, err := NewTLSConfig(true, caFile, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = get(config, srv.URL)
+	if err != nil {
+		t.Errorf("request failed: %s", err)
+	}
+
+	tests := []struct {
+		name                string
+		ca, cert, key, want string
+	}{
+		{name: "missing CA file", ca: filepath.Join(dir, "missing.pem"), want: "failed to read CA certificate file"},
+		{name: "invalid CA file", ca: invalid, want: "no valid PEM certificates found in CA certificate file"},
+		{name: "certificate without key", cert: certFile, want: "both a client certificate and a client key must be provided"},
+		{name: "invalid key file", cert: certFile, key: invalid, want: "failed to load client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTLSConfig(true, tt.ca, tt.cert, tt.key)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinFingerprint(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	srv := tlsTestServer(t, ca, false)
+	leaf := srv.TLS.Certificates[0].Certificate[0]
+	sum := sha256.Sum256(leaf)
+	right := hex.EncodeToString(sum[:])
+	var colons []string
+	for i := 0; i < len(right); i += 2 {
+		colons = append(colons, strings.ToUpper(right[i:i+2]))
+	}
+
+	tests := []struct {
+		name        string
+		verify      bool
+		ca          string
+		fingerprint string
+		err         string
+	}{
+		{name: "pinned", fingerprint: right},
+		{name: "pinned with colons", fingerprint: strings.Join(colons, ":")},
+		{name: "pinned and verified", verify: true, ca: ca.pem, fingerprint: right},
+		// Pinning doesn't replace verification when it is enabled
+		{name: "pinned but not trusted", verify: true, fingerprint: right, err: "certificate signed by unknown authority"},
+		{name: "CA fingerprint", fingerprint: ca.fingerprint(), err: "does not match the pinned fingerprint"},
+		{name: "wrong fingerprint", verify: true, ca: ca.pem, fingerprint: strings.Repeat("ab", sha256.Size), err: "server certificate fingerprint " + right + " does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := NewTLSConfigFromPEM(tt.verify, tt.ca, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = PinFingerprint(config, tt.fingerprint)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = get(config, srv.URL)
+			if tt.err == "" && err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPinFingerprintInvalid(t *testing.T) {
+	for _, fingerprint := range []string{"", "not hex", "abcd", strings.Repeat("ab", sha256.Size+1), strings.Repeat("zz", sha256.Size)} {
+		err := PinFingerprint(&tls.Config{}, fingerprint)
+		if err == nil || !strings.Contains(err.Error(), "invalid SHA-256 fingerprint") {
+			t.Errorf("PinFingerprint(%q) returned %v, want an invalid fingerprint error", fingerprint, err)
+		}
+	}
+}
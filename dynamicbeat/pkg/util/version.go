@@ -0,0 +1,45 @@
+package util
+
+import (
+	"fmt"
+)
+
+// A Version is a major.minor.patch version number of an Elastic Stack
+// service.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseVersion parses a version number like 7.12.1. Suffixes like -SNAPSHOT
+// are ignored.
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	_, err := fmt.Sscanf(s, "%d.%d.%d", &v.Major, &v.Minor, &v.Patch)
+	if err != nil {
+		return Version{}, fmt.Errorf("failed to parse version '%s': %s", s, err)
+	}
+
+	return v, nil
+}
+
+// Less returns whether v is an earlier version than other.
+func (v Version) Less(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+// IsZero returns whether the version is unset.
+func (v Version) IsZero() bool {
+	return v == Version{}
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
@@ -0,0 +1,8 @@
+// Package version holds the version of Dynamicbeat, which is set at build time
+// with:
+//
+//	go build -ldflags "-X github.com/scorestack/scorestack/dynamicbeat/pkg/version.Version=1.2.3"
+package version
+
+// Version is the version of Dynamicbeat. Builds that don't set it are "dev".
+var Version = "dev"